@@ -10,9 +10,24 @@ const swaggerJsdoc = require('swagger-jsdoc');
 const config = require('config');
 
 const logger = require('./utils/logger');
+const { getSmsConfigErrors } = require('./utils/sms');
 const { errorHandler } = require('./utils/error.handler');
 const versionMiddleware = require('./middleware/version.middleware');
 const sessionMiddleware = require('./middleware/session.middleware');
+const { requireJson } = require('./middleware/content-type.middleware');
+const { requestTimeout } = require('./middleware/timeout.middleware');
+const scheduler = require('./services/scheduler.service');
+const DatabaseService = require('./services/database.service');
+const QueryMonitorService = require('./services/query.monitor.service');
+const AppointmentService = require('./services/appointment.service');
+const notificationService = require('./services/notification.service');
+const RetentionService = require('./services/retention.service');
+const SettingsService = require('./services/settings.service');
+const ScanService = require('./services/scan.service');
+const InstantConsultService = require('./services/instant.consult.service');
+const notificationWorker = require('./services/notification.worker');
+const deliveryWorker = require('./services/delivery.worker');
+const appConfig = require('./config/config');
 
 // Debug environment variables
 logger.info('Environment variables:', {
@@ -33,6 +48,12 @@ const paymentRoutes = require('./routes/payment.routes');
 const chatRoutes = require('./routes/chat.routes');
 const videoRoutes = require('./routes/video.routes');
 const adminRoutes = require('./routes/admin.routes');
+const configRoutes = require('./routes/config.routes');
+const documentRoutes = require('./routes/document.routes');
+const recommendationRoutes = require('./routes/recommendation.routes');
+const surveyRoutes = require('./routes/survey.routes');
+const searchRoutes = require('./routes/search.routes');
+const consultRoutes = require('./routes/consult.routes');
 
 const app = express();
 
@@ -49,14 +70,20 @@ const connectDB = async () => {
     const maskedUri = process.env.MONGODB_URI.replace(/(mongodb(\+srv)?:\/\/[^:]+:)([^@]+)(@.*)/, '$1****$4');
     logger.info('Attempting to connect to MongoDB:', { uri: maskedUri });
 
-    await mongoose.connect(process.env.MONGODB_URI, {
-      serverSelectionTimeoutMS: 10000, // Increased timeout
-      socketTimeoutMS: 45000,
-      family: 4,  // Force IPv4
-      retryWrites: true,
-      w: 'majority'
-    });
+    await mongoose.connect(process.env.MONGODB_URI, DatabaseService.getConnectionOptions());
     logger.info('Connected to MongoDB');
+    try {
+      await DatabaseService.detectTransactionSupport();
+    } catch (error) {
+      // Bookings can't be written safely as configured; don't start half working
+      logger.error(error.message);
+      process.exit(1);
+    }
+    if (appConfig.mongodb.slowQueries.enabled) {
+      QueryMonitorService.watch(mongoose.connection.getClient());
+    }
+    // Configured defaults apply until the scheduled refresh succeeds
+    await SettingsService.refresh().catch(error => logger.error('Failed to load platform settings:', error));
   } catch (err) {
     logger.error('MongoDB connection error:', err);
     // Log more details about the error
@@ -70,8 +97,7 @@ const connectDB = async () => {
   }
 };
 
-// Call the connection function
-connectDB();
+DatabaseService.watchConnection();
 
 // Basic middleware
 app.use(express.json());
@@ -95,7 +121,8 @@ app.use(compression());
 const corsOptions = {
   origin: ['http://localhost:8085', 'http://127.0.0.1:8085'],
   methods: ['GET', 'POST', 'PUT', 'DELETE', 'PATCH', 'OPTIONS'],
-  allowedHeaders: ['Content-Type', 'Authorization', 'X-Requested-With', 'Accept', 'Origin', 'x-session-id'],
+  allowedHeaders: ['Content-Type', 'Authorization', 'X-Requested-With', 'Accept', 'Origin', 'x-session-id', 'Idempotency-Key'],
+  exposedHeaders: ['Idempotent-Replayed'],
   credentials: true,
   maxAge: 86400 // 24 hours
 };
@@ -172,9 +199,18 @@ app.get('/api-docs.json', (req, res) => {
   res.send(swaggerSpec);
 });
 
-// Health check endpoint
+// Health check endpoint. Reports 503 while MongoDB is unreachable so load
+// balancers stop routing traffic here until it recovers.
 app.get('/health', (req, res) => {
-  res.json({ status: 'ok', timestamp: new Date().toISOString() });
+  const database = DatabaseService.getHealth();
+  res.status(database.healthy ? 200 : 503).json({
+    status: database.healthy ? 'ok' : 'degraded',
+    database: {
+      status: database.healthy ? 'up' : 'down',
+      lastCheckedAt: database.lastCheckedAt
+    },
+    timestamp: new Date().toISOString()
+  });
 });
 
 // Debug middleware to log API routes
@@ -185,23 +221,54 @@ app.use((req, res, next) => {
   next();
 });
 
-// API routes with version middleware
-app.use('/api/v1', versionMiddleware);
+// API routes, registered once and mounted under every API prefix below
+const apiRouter = express.Router();
+
+// Resolve and check the version in the path
+apiRouter.use(versionMiddleware);
+
+// Per-route deadlines; see config.requestTimeouts
+apiRouter.use(requestTimeout());
+
+// Mutating API requests must send JSON, or multipart for uploads
+apiRouter.use(requireJson);
 
 // Apply session middleware to all API routes
-app.use('/api/v1', sessionMiddleware);
+apiRouter.use(sessionMiddleware);
 
 // Mount routes
-app.use('/api/v1/auth', authRoutes);
-app.use('/api/v1/users', userRoutes);
-app.use('/api/v1/doctors', doctorRoutes);
-app.use('/api/v1/appointments', appointmentRoutes);
-app.use('/api/v1/reviews', reviewRoutes);
-app.use('/api/v1/notifications', notificationRoutes);
-app.use('/api/v1/payments', paymentRoutes);
-app.use('/api/v1/chats', chatRoutes);
-app.use('/api/v1/video', videoRoutes);
-app.use('/api/v1/admin', adminRoutes);
+apiRouter.use('/auth', authRoutes);
+apiRouter.use('/users', userRoutes);
+apiRouter.use('/doctors', doctorRoutes);
+apiRouter.use('/appointments', appointmentRoutes);
+apiRouter.use('/reviews', reviewRoutes);
+apiRouter.use('/notifications', notificationRoutes);
+apiRouter.use('/payments', paymentRoutes);
+apiRouter.use('/chats', chatRoutes);
+apiRouter.use('/video', videoRoutes);
+apiRouter.use('/admin', adminRoutes);
+apiRouter.use('/config', configRoutes);
+apiRouter.use('/documents', documentRoutes);
+apiRouter.use('/recommendations', recommendationRoutes);
+apiRouter.use('/surveys', surveyRoutes);
+apiRouter.use('/search', searchRoutes);
+apiRouter.use('/consult', consultRoutes);
+
+// Versioned prefixes first. A breaking change gets its own router under
+// /api/v2; unversioned /api/... stays an alias of v1 for existing clients.
+app.use(appConfig.apiPrefix, apiRouter);
+
+// /api/v1 paths that v1 didn't match go on to the 404 rather than through
+// the API middleware a second time
+const legacyApiRouter = express.Router();
+legacyApiRouter.use((req, res, next) => {
+  if (/^\/v1(\/|$)/.test(req.path)) {
+    return next('router');
+  }
+  next();
+});
+legacyApiRouter.use(apiRouter);
+app.use('/api', legacyApiRouter);
 
 // Error handling middleware
 app.use(errorHandler);
@@ -215,24 +282,88 @@ app.use((req, res, next) => {
   });
 });
 
-// Start server
-const PORT = process.env.PORT || 8085;
-logger.info(`Attempting to start server on port ${PORT}`);
-app.listen(PORT, () => {
-  logger.info(`Server running on port ${PORT}`);
-  logger.info(`Swagger documentation available at http://localhost:${PORT}/api-docs`);
-});
+// Misconfigured SMS senders are left off messages; say so at startup
+getSmsConfigErrors().forEach(error => logger.warn(error));
 
-// Handle uncaught exceptions
-process.on('uncaughtException', (error) => {
-  logger.error('Uncaught Exception:', error);
-  process.exit(1);
+// Background jobs
+scheduler.registerJob('mongodb-health-check', appConfig.mongodb.healthCheckIntervalMs, DatabaseService.checkHealth);
+scheduler.registerJob('refresh-platform-settings', appConfig.settings.refreshIntervalMs, SettingsService.refresh);
+// Reminders run after expiry, so a booking cancelled this tick isn't reminded
+scheduler.registerJob('expire-unpaid-appointments', 60 * 1000, async () => {
+  await AppointmentService.expireUnpaidAppointments();
+  if (appConfig.payments.unpaidReminder.enabled) {
+    const reminders = await AppointmentService.remindUnpaidAppointments();
+    for (const { appointment, deadline } of reminders) {
+      await notificationService.sendPaymentReminder(appointment, deadline);
+    }
+  }
 });
+scheduler.registerJob('expire-appointment-drafts', 60 * 60 * 1000, AppointmentService.expireDrafts);
+scheduler.registerJob('appointment-reminders', 5 * 60 * 1000, () => notificationService.sendUpcomingReminders());
+scheduler.registerJob('video-join-links', 60 * 1000, () => notificationService.sendVideoJoinLinks());
+scheduler.registerJob('instant-consult-queue', 30 * 1000, () => InstantConsultService.processQueue());
+if (appConfig.retention.enabled) {
+  scheduler.registerJob('purge-expired-data', appConfig.retention.intervalMs, () => RetentionService.purgeExpiredData());
+}
+if (appConfig.uploadScan.enabled) {
+  scheduler.registerJob('rescan-pending-uploads', 5 * 60 * 1000, () => ScanService.rescanPendingUploads());
+}
+if (appConfig.appointments.autoComplete.enabled) {
+  scheduler.registerJob('auto-complete-appointments', 5 * 60 * 1000, async () => {
+    const completed = await AppointmentService.autoCompleteAppointments();
+    if (appConfig.appointments.autoComplete.promptForNotes) {
+      for (const appointment of completed) {
+        await notificationService.sendConsultationNotesPrompt(appointment);
+      }
+    }
+    if (appConfig.surveys.enabled) {
+      for (const appointment of completed) {
+        await notificationService.sendSurveyInvitation(appointment);
+      }
+    }
+  });
+}
+if (appConfig.appointments.pendingEscalation.enabled) {
+  scheduler.registerJob('pending-confirmation-escalation', 5 * 60 * 1000, async () => {
+    const { reminders, cancelled } = await AppointmentService.escalatePendingAppointments();
+    for (const { appointment, final, deadline } of reminders) {
+      await notificationService.sendPendingConfirmationReminder(appointment, { final, deadline });
+    }
+    for (const { appointment, refunded } of cancelled) {
+      await notificationService.sendUnconfirmedCancellationNotice(appointment, refunded);
+    }
+  });
+}
 
-// Handle unhandled promise rejections
-process.on('unhandledRejection', (error) => {
-  logger.error('Unhandled Rejection:', error);
-  process.exit(1);
-});
+// Start server. Tests require the app without connecting or listening.
+if (require.main === module) {
+  connectDB();
+
+  const PORT = process.env.PORT || 8085;
+  logger.info(`Attempting to start server on port ${PORT}`);
+  app.listen(PORT, () => {
+    logger.info(`Server running on port ${PORT}`);
+    logger.info(`Swagger documentation available at http://localhost:${PORT}/api-docs`);
+    scheduler.start();
+    if (appConfig.aws.sqs.workerEnabled) {
+      notificationWorker.start();
+    }
+    if (appConfig.aws.deliveryFeedback.workerEnabled) {
+      deliveryWorker.start();
+    }
+  });
+
+  // Handle uncaught exceptions
+  process.on('uncaughtException', (error) => {
+    logger.error('Uncaught Exception:', error);
+    process.exit(1);
+  });
+
+  // Handle unhandled promise rejections
+  process.on('unhandledRejection', (error) => {
+    logger.error('Unhandled Rejection:', error);
+    process.exit(1);
+  });
+}
 
 module.exports = app; 
\ No newline at end of file
@@ -4,12 +4,61 @@ module.exports = {
   env: process.env.NODE_ENV || 'development',
   port: process.env.PORT || 8080,
   mongoUri: process.env.MONGODB_URI || 'mongodb://localhost:27017/med-connecter',
+  // MongoDB driver pool and timeouts
+  mongodb: {
+    maxPoolSize: parseInt(process.env.MONGODB_MAX_POOL_SIZE, 10) || 20,
+    minPoolSize: parseInt(process.env.MONGODB_MIN_POOL_SIZE, 10) || 2,
+    serverSelectionTimeoutMS: parseInt(process.env.MONGODB_SERVER_SELECTION_TIMEOUT_MS, 10) || 10000,
+    socketTimeoutMS: parseInt(process.env.MONGODB_SOCKET_TIMEOUT_MS, 10) || 45000,
+    connectTimeoutMS: parseInt(process.env.MONGODB_CONNECT_TIMEOUT_MS, 10) || 10000,
+    retryWrites: process.env.MONGODB_RETRY_WRITES !== 'false',
+    retryReads: process.env.MONGODB_RETRY_READS !== 'false',
+    // How often /health readiness is refreshed with a ping
+    healthCheckIntervalMs: parseInt(process.env.MONGODB_HEALTH_CHECK_INTERVAL_MS, 10) || 15000,
+    pingTimeoutMS: 2000,
+    // Queries slower than thresholdMs are logged with the shape of their
+    // filter (never its values) and counted in GET /admin/metrics
+    slowQueries: {
+      enabled: process.env.MONGODB_SLOW_QUERY_LOG !== 'false',
+      thresholdMs: parseInt(process.env.MONGODB_SLOW_QUERY_MS, 10) || 500
+    },
+    // Multi-document writes run in transactions, which need a replica set.
+    // 'auto' uses them when the server is one, e.g. not a standalone
+    // development server; 'true' refuses to start without them.
+    transactions: {
+      mode: process.env.MONGODB_TRANSACTIONS || 'auto',
+      maxAttempts: parseInt(process.env.MONGODB_TRANSACTION_MAX_ATTEMPTS, 10) || 3,
+      // Wait before a rerun, growing with each attempt, so a transaction that
+      // hit a write conflict gives the other one time to commit
+      retryDelayMs: parseInt(process.env.MONGODB_TRANSACTION_RETRY_DELAY_MS, 10) || 50
+    }
+  },
+  // Deadlines for read requests; writes always run to completion. The first
+  // route whose pattern matches the path wins; 0 means no deadline, for
+  // exports that stream their response.
+  requestTimeouts: {
+    defaultMs: parseInt(process.env.REQUEST_TIMEOUT_MS, 10) || 10000,
+    // Patterns match the path within the API, e.g. /admin/reports/... for
+    // both /api/v1/admin/reports/... and /api/admin/reports/...
+    routes: [
+      { pattern: /^\/admin\/reports\//, ms: 0 },
+      { pattern: /^\/doctors\/me\/calendar\.ics$/, ms: 0 },
+      { pattern: /^\/admin\/(analytics|dashboard|appointments)/, ms: parseInt(process.env.REQUEST_TIMEOUT_REPORTING_MS, 10) || 30000 }
+    ]
+  },
   frontendUrl: process.env.FRONTEND_URL || 'http://localhost:3000',
+  apiUrl: process.env.API_URL || 'http://localhost:8080',
+  // Where the current API version is mounted; links to the API are built from it
+  apiPrefix: '/api/v1',
   
   // JWT settings
   jwt: {
     secret: process.env.JWT_SECRET || 'your-secret-key',
-    expiresIn: '7d'
+    expiresIn: '7d',
+    // Access tokens are short-lived; clients trade their refresh token for a
+    // new pair at POST /auth/refresh
+    accessTokenMinutes: 15,
+    refreshTokenDays: 30
   },
 
   // Redis/Valkey settings (AWS ElastiCache) - Temporarily disabled
@@ -57,7 +106,22 @@ module.exports = {
   sms: {
     provider: process.env.SMS_PROVIDER || 'twilio',
     apiKey: process.env.SMS_API_KEY,
-    from: process.env.SMS_FROM
+    from: process.env.SMS_FROM,
+    // Shown to recipients instead of a random long code where the destination
+    // country supports alphanumeric sender IDs (1-11 letters or digits, at
+    // least one letter)
+    senderId: process.env.SMS_SENDER_ID || 'MEDCONN',
+    // Dedicated number to send from, for countries without sender ID support
+    originationNumber: process.env.SMS_ORIGINATION_NUMBER,
+    smsType: process.env.SMS_TYPE || 'Transactional',
+    // Per calling code overrides of the settings above; the longest matching
+    // code wins. The US and Canada don't support sender IDs.
+    regions: {
+      '+1': {
+        senderId: null,
+        originationNumber: process.env.SMS_ORIGINATION_NUMBER_US
+      }
+    }
   },
 
   // BIG-register API settings
@@ -71,6 +135,26 @@ module.exports = {
     region: process.env.AWS_REGION || 'eu-west-1',
     s3: {
       bucket: process.env.AWS_BUCKET
+    },
+    sqs: {
+      queueUrl: process.env.AWS_SQS_QUEUE_URL,
+      deadLetterQueueUrl: process.env.AWS_SQS_DLQ_URL,
+      workerEnabled: process.env.SQS_WORKER_ENABLED === 'true',
+      // A message that fails this many receives is moved to the dead-letter queue
+      maxReceiveCount: parseInt(process.env.SQS_MAX_RECEIVE_COUNT, 10) || 5,
+      visibilityTimeoutSeconds: parseInt(process.env.SQS_VISIBILITY_TIMEOUT_SECONDS, 10) || 60,
+      retryBaseDelaySeconds: parseInt(process.env.SQS_RETRY_BASE_DELAY_SECONDS, 10) || 30
+    },
+    ses: {
+      // Configuration set whose event destination publishes bounces,
+      // complaints and deliveries to the SNS topic feeding the feedback queue
+      configurationSet: process.env.AWS_SES_CONFIGURATION_SET
+    },
+    // Queue receiving SES events and SNS SMS delivery status records, which
+    // update notifications' delivery status and the suppression list
+    deliveryFeedback: {
+      queueUrl: process.env.AWS_SQS_DELIVERY_FEEDBACK_QUEUE_URL,
+      workerEnabled: process.env.DELIVERY_FEEDBACK_WORKER_ENABLED === 'true'
     }
   },
 
@@ -78,7 +162,28 @@ module.exports = {
   videoCall: {
     provider: process.env.VIDEO_CALL_PROVIDER,
     apiKey: process.env.VIDEO_CALL_API_KEY,
-    apiSecret: process.env.VIDEO_CALL_API_SECRET
+    apiSecret: process.env.VIDEO_CALL_API_SECRET,
+    // How long before a video appointment the join link is sent out
+    joinLinkLeadMinutes: parseInt(process.env.VIDEO_JOIN_LINK_LEAD_MINUTES, 10) || 15,
+    // Participants can join from this long before the start until this long after the end
+    joinEarlyGraceMinutes: parseInt(process.env.VIDEO_JOIN_EARLY_GRACE_MINUTES, 10) || 15,
+    joinLateGraceMinutes: parseInt(process.env.VIDEO_JOIN_LATE_GRACE_MINUTES, 10) || 10
+  },
+
+  // Outbound webhooks to external systems, e.g. clinics' EHRs
+  webhooks: {
+    timeoutMs: parseInt(process.env.WEBHOOK_TIMEOUT_MS, 10) || 10000
+  },
+
+  // On-demand video consults with whichever online doctor is free next
+  instantConsult: {
+    // Online doctors count as offline once their last heartbeat is older than this
+    heartbeatTimeoutSeconds: parseInt(process.env.INSTANT_CONSULT_HEARTBEAT_SECONDS, 10) || 90,
+    durationMinutes: parseInt(process.env.INSTANT_CONSULT_DURATION_MINUTES, 10) || 15,
+    // Patients still waiting after this long are offered scheduled slots instead
+    maxWaitMinutes: parseInt(process.env.INSTANT_CONSULT_MAX_WAIT_MINUTES, 10) || 20,
+    // A matched doctor who hasn't joined the call by then is skipped and the patient requeued
+    joinTimeoutMinutes: parseInt(process.env.INSTANT_CONSULT_JOIN_TIMEOUT_MINUTES, 10) || 5
   },
 
   // Admin settings
@@ -94,6 +199,343 @@ module.exports = {
     region: process.env.CLOUD_STORAGE_REGION
   },
 
+  // Upload constraints per category (sizes in bytes). Allowed types can be
+  // narrowed per category; only types upload.service can recognise from the
+  // file contents are ever accepted.
+  uploads: {
+    profileImage: {
+      maxSize: parseInt(process.env.UPLOAD_PROFILE_IMAGE_MAX_SIZE, 10) || 5 * 1024 * 1024,
+      allowedTypes: (process.env.UPLOAD_PROFILE_IMAGE_TYPES || 'image/jpeg,image/png,image/webp')
+        .split(',').map(type => type.trim()).filter(Boolean)
+    },
+    chatAttachment: {
+      maxSize: parseInt(process.env.UPLOAD_CHAT_ATTACHMENT_MAX_SIZE, 10) || 10 * 1024 * 1024,
+      allowedTypes: (process.env.UPLOAD_CHAT_ATTACHMENT_TYPES || 'image/jpeg,image/png,image/gif,application/pdf')
+        .split(',').map(type => type.trim()).filter(Boolean)
+    },
+    document: {
+      maxSize: parseInt(process.env.UPLOAD_DOCUMENT_MAX_SIZE, 10) || 20 * 1024 * 1024,
+      allowedTypes: (process.env.UPLOAD_DOCUMENT_TYPES || 'application/pdf,image/jpeg,image/png')
+        .split(',').map(type => type.trim()).filter(Boolean)
+    },
+    clinicPhoto: {
+      maxSize: parseInt(process.env.UPLOAD_CLINIC_PHOTO_MAX_SIZE, 10) || 5 * 1024 * 1024,
+      allowedTypes: (process.env.UPLOAD_CLINIC_PHOTO_TYPES || 'image/jpeg,image/png,image/webp')
+        .split(',').map(type => type.trim()).filter(Boolean)
+    },
+    // Schedule imports (POST /doctors/me/availability/import); parsed, never stored
+    availabilityImport: {
+      maxSize: 256 * 1024,
+      allowedTypes: ['text/csv']
+    }
+  },
+
+  // Malware scanning of uploads (see services/scan.service.js). Public
+  // uploads are scanned before they are stored; documents and clinic photos
+  // are stored first and only served once a scan found them clean.
+  uploadScan: {
+    enabled: process.env.UPLOAD_SCAN_ENABLED === 'true',
+    // Quarantined files whose scan failed are retried after this long
+    retryAfterMinutes: parseInt(process.env.UPLOAD_SCAN_RETRY_MINUTES, 10) || 15,
+    batchSize: 50
+  },
+
+  // Clinic photos shown on doctor profiles
+  clinicPhotos: {
+    maxPerClinic: parseInt(process.env.CLINIC_PHOTOS_MAX, 10) || 10,
+    // Lifetime of the presigned URLs returned with doctor details
+    urlTtlSeconds: 3600
+  },
+
+  // Appointment settings
+  appointments: {
+    slotDurationMinutes: parseInt(process.env.APPOINTMENT_SLOT_DURATION_MINUTES, 10) || 30,
+    // Zone for doctors who haven't set their own (Doctor.timeZone). Schedules
+    // and appointment dates/times are wall-clock times in the doctor's zone
+    // (see getAppointmentStart).
+    scheduleTimeZone: 'UTC',
+    allowedSlotDurations: [15, 30, 45, 60],
+    // Minutes kept free around appointments of each mode for travel and
+    // cleanup. Doctors can override them (Doctor.appointmentBuffers).
+    bufferMinutes: {
+      'in-person': parseInt(process.env.APPOINTMENT_BUFFER_IN_PERSON_MINUTES, 10) || 0,
+      video: parseInt(process.env.APPOINTMENT_BUFFER_VIDEO_MINUTES, 10) || 0,
+      phone: parseInt(process.env.APPOINTMENT_BUFFER_PHONE_MINUTES, 10) || 0
+    },
+    // Doctors must record an outcome when completing an appointment. Off by
+    // default so existing clients can keep completing without one.
+    requireDisposition: process.env.REQUIRE_APPOINTMENT_DISPOSITION === 'true',
+    maxReschedules: parseInt(process.env.MAX_APPOINTMENT_RESCHEDULES, 10) || 2,
+    // Patients rescheduling less than freeHoursBefore hours ahead pay a fee:
+    // a fixed amount, or else a percentage of the consultation fee. With
+    // collect on it is charged through the payment flow; otherwise it is only
+    // recorded, e.g. for the clinic to invoice. No fee by default.
+    rescheduleFee: {
+      freeHoursBefore: parseInt(process.env.RESCHEDULE_FREE_HOURS, 10) || 24,
+      amount: parseFloat(process.env.RESCHEDULE_FEE_AMOUNT) || 0,
+      percent: parseFloat(process.env.RESCHEDULE_FEE_PERCENT) || 0,
+      collect: process.env.RESCHEDULE_FEE_COLLECT === 'true'
+    },
+    // Alternatives offered when a requested slot can't be booked
+    suggestionCount: 3,
+    // How far ahead doctor listings look for each doctor's next free slot
+    nextAvailableLookaheadDays: 14,
+    // Confirmed appointments are marked completed this long after they end.
+    // Clinics that complete appointments by hand can switch this off.
+    autoComplete: {
+      enabled: process.env.APPOINTMENT_AUTO_COMPLETE !== 'false',
+      delayMinutes: parseInt(process.env.APPOINTMENT_AUTO_COMPLETE_DELAY_MINUTES, 10) || 60,
+      promptForNotes: process.env.APPOINTMENT_AUTO_COMPLETE_NOTES_PROMPT !== 'false'
+    },
+    // Bookings the doctor hasn't confirmed: the doctor is reminded this many
+    // minutes after the booking became pending, the last time also by SMS,
+    // and the booking is cancelled and refunded at the deadline or when it
+    // would start, whichever comes first
+    pendingEscalation: {
+      enabled: process.env.PENDING_ESCALATION !== 'false',
+      reminderMinutes: (process.env.PENDING_ESCALATION_REMINDER_MINUTES || '60,240')
+        .split(',').map(value => parseInt(value, 10)).filter(value => value > 0).sort((a, b) => a - b),
+      autoCancelMinutes: parseInt(process.env.PENDING_ESCALATION_CANCEL_MINUTES, 10) || 24 * 60
+    },
+    // Optionally only allow completing appointments of these types when the
+    // consultation visibly happened: a video call was joined or chat messages
+    // were exchanged. Otherwise they must be marked no-show. Admins can
+    // always complete.
+    completionRequiresActivity: {
+      enabled: process.env.COMPLETION_REQUIRES_ACTIVITY === 'true',
+      types: (process.env.COMPLETION_REQUIRES_ACTIVITY_TYPES || 'video')
+        .split(',').map(type => type.trim()).filter(Boolean)
+    },
+    // When a doctor cancels, offer the patient the doctor's next free slots,
+    // each with a token that books it in one step
+    rebookOnDoctorCancel: {
+      enabled: process.env.REBOOK_ON_DOCTOR_CANCEL !== 'false',
+      slotCount: 3,
+      tokenTtlHours: parseInt(process.env.REBOOK_TOKEN_TTL_HOURS, 10) || 48
+    },
+    // A booking retried with the same idempotency key within this window
+    // returns the original appointment instead of booking again
+    idempotencyWindowHours: parseInt(process.env.BOOKING_IDEMPOTENCY_WINDOW_HOURS, 10) || 24,
+    // How many days ahead patients can book; doctors can set their own
+    maxAdvanceBookingDays: parseInt(process.env.MAX_ADVANCE_BOOKING_DAYS, 10) || 90,
+    // Availability changes that leave booked appointments outside the new
+    // schedule are refused unless the doctor confirms them (confirmConflicts);
+    // either way the affected patients are asked to reschedule
+    confirmScheduleConflicts: process.env.CONFIRM_SCHEDULE_CONFLICTS !== 'false',
+    // Longest window a doctor can cancel in one go (POST /doctors/me/cancel-range)
+    cancelRangeMaxDays: parseInt(process.env.CANCEL_RANGE_MAX_DAYS, 10) || 31,
+    // Unfinished booking drafts are deleted after this long without changes
+    draftExpiryHours: parseInt(process.env.APPOINTMENT_DRAFT_EXPIRY_HOURS, 10) || 72,
+    // Code given to the patient at booking for check-in at the clinic. At the
+    // default 8 characters there are about 850 billion codes.
+    confirmationCodeLength: Math.max(parseInt(process.env.APPOINTMENT_CONFIRMATION_CODE_LENGTH, 10) || 8, 6)
+  },
+
+  // Payment settings
+  payments: {
+    currencies: (process.env.SUPPORTED_CURRENCIES || 'EUR').split(',').map(c => c.trim()),
+    // When enabled, bookings that are never paid are cancelled after unpaidExpiryMinutes
+    payBeforeConfirm: process.env.PAY_BEFORE_CONFIRM === 'true',
+    unpaidExpiryMinutes: parseInt(process.env.UNPAID_APPOINTMENT_EXPIRY_MINUTES, 10) || 60,
+    // Patients are reminded to pay, with a payment link, this long before an
+    // unpaid booking is cancelled
+    unpaidReminder: {
+      enabled: process.env.UNPAID_APPOINTMENT_REMINDER !== 'false',
+      minutesBefore: parseInt(process.env.UNPAID_APPOINTMENT_REMINDER_MINUTES, 10) || 15
+    },
+    // How long a slot stays reserved while a payment is in progress
+    holdMinutes: parseInt(process.env.PAYMENT_HOLD_MINUTES, 10) || 15,
+    webhookSecret: process.env.PAYMENT_WEBHOOK_SECRET,
+    // Percentage of each successful payment the platform keeps
+    commissionPercent: parseFloat(process.env.PLATFORM_COMMISSION_PERCENT) || 0
+  },
+
+  // Patient health insurance, for claiming consultations
+  insurance: {
+    // Insurers patients can pick; empty accepts any name
+    insurers: (process.env.INSURERS || 'Zilveren Kruis,VGZ,CZ,Menzis,DSW,ONVZ,a.s.r.,Zorg en Zekerheid,ENO,Salland')
+      .split(',').map(insurer => insurer.trim()).filter(Boolean),
+    // Longest period one claims export covers
+    claimsMaxDays: parseInt(process.env.CLAIMS_EXPORT_MAX_DAYS, 10) || 366
+  },
+
+  // Doctor recommendations
+  recommendations: {
+    // How long the booking token returned with a recommendation stays valid
+    bookingTokenTtlMinutes: parseInt(process.env.RECOMMENDATION_BOOKING_TOKEN_TTL_MINUTES, 10) || 30,
+    // Urgent booking path: only slots starting within maxWaitHours are offered
+    urgent: {
+      maxWaitHours: parseInt(process.env.URGENT_MAX_WAIT_HOURS, 10) || 24,
+      maxOptions: 5,
+      // Doctors considered before picking the soonest slots
+      maxCandidates: 100,
+      emergencyNumber: process.env.EMERGENCY_NUMBER || '112'
+    }
+  },
+
+  // Appointment reminders
+  reminders: {
+    channels: ['email', 'sms', 'push', 'in-app'],
+    // Lead times users can pick from, in minutes before the appointment
+    allowedLeadTimesMinutes: [15, 60, 120, 1440, 2880],
+    maxLeadTimes: 3,
+    // For users who haven't chosen; SMS still needs their consent
+    defaults: {
+      patient: { channels: ['email', 'sms'], leadTimesMinutes: [1440] },
+      doctor: { channels: ['email'], leadTimesMinutes: [1440] }
+    }
+  },
+
+  // Doctor reviews
+  reviews: {
+    // Only reviews of completed, paid appointments count towards a doctor's
+    // rating, and the average is shown once there are this many
+    minReviewsForRating: parseInt(process.env.MIN_REVIEWS_FOR_RATING, 10) || 3
+  },
+
+  // Post-consultation satisfaction surveys
+  surveys: {
+    // Invite the patient to fill one in when an appointment is completed
+    enabled: process.env.SURVEYS_ENABLED !== 'false'
+  },
+
+  // Referrals between doctors
+  referrals: {
+    // Doctors in the referred specialty suggested to the patient
+    recommendationCount: 3,
+    // Referrals stay open for a while, so their booking tokens outlive the
+    // recommendation ones
+    bookingTokenTtlHours: parseInt(process.env.REFERRAL_BOOKING_TOKEN_TTL_HOURS, 10) || 72
+  },
+
+  // Doctor profile changes
+  doctorProfile: {
+    // Verified doctors' changes to these fields wait for admin approval; other
+    // fields apply immediately
+    reviewedFields: (process.env.DOCTOR_PROFILE_REVIEWED_FIELDS || 'specializations')
+      .split(',').map(field => field.trim()).filter(Boolean)
+  },
+
+  // Doctor profile view analytics
+  doctorViews: {
+    statsDefaultDays: 30,
+    statsMaxDays: 365
+  },
+
+  // User activity tracking
+  activity: {
+    // Minimum time between writes of a user's last-seen timestamp
+    updateIntervalMinutes: parseInt(process.env.ACTIVITY_UPDATE_INTERVAL_MINUTES, 10) || 5
+  },
+
+  // Nearby doctor search
+  search: {
+    nearby: {
+      defaultRadiusKm: parseFloat(process.env.NEARBY_DEFAULT_RADIUS_KM) || 25,
+      maxRadiusKm: 100,
+      // Doctors pulled from the geo query before ranking and paging
+      maxCandidates: 100,
+      defaultSort: process.env.NEARBY_DEFAULT_SORT || 'distance',
+      // Relative weights of the composite ranking; they don't need to add up to 1
+      weights: {
+        distance: parseFloat(process.env.NEARBY_WEIGHT_DISTANCE) || 0.5,
+        rating: parseFloat(process.env.NEARBY_WEIGHT_RATING) || 0.3,
+        availability: parseFloat(process.env.NEARBY_WEIGHT_AVAILABILITY) || 0.2
+      }
+    },
+    // Universal search box across doctors, specialties and symptoms
+    unified: {
+      minQueryLength: 2,
+      sectionLimit: parseInt(process.env.SEARCH_SECTION_LIMIT) || 5,
+      maxSectionLimit: 20,
+      // Doctors pulled from the name/specialization queries before ranking
+      maxDoctorCandidates: 100
+    }
+  },
+
+  // Verification required before booking appointments or making payments
+  verification: {
+    requireEmail: process.env.REQUIRE_VERIFIED_EMAIL !== 'false',
+    requirePhone: process.env.REQUIRE_VERIFIED_PHONE === 'true',
+    // Codes sent by SMS from POST /auth/send-otp
+    phoneOtp: {
+      expiryMinutes: 5,
+      // At most maxPerWindow codes per phone number every windowMinutes
+      maxPerWindow: 3,
+      windowMinutes: 15,
+      // Wrong guesses before a code stops working
+      maxAttempts: 5
+    }
+  },
+
+  // Region defaults; the platform is Netherlands-focused
+  locale: {
+    defaultCountry: process.env.DEFAULT_COUNTRY || 'NL',
+    // Applied to phone numbers entered without a country code
+    defaultCountryCode: process.env.DEFAULT_PHONE_COUNTRY_CODE || '+31',
+    // Used to format dates, times and amounts in notifications and responses
+    defaultLocale: process.env.DEFAULT_LOCALE || 'nl-NL'
+  },
+
+  // Chat settings
+  chat: {
+    maxMessageLength: parseInt(process.env.CHAT_MAX_MESSAGE_LENGTH, 10) || 2000,
+    // Saved replies per doctor
+    maxTemplatesPerDoctor: 100,
+    // Block new messages once the doctor on the appointment loses verification
+    requireVerifiedDoctor: process.env.CHAT_REQUIRE_VERIFIED_DOCTOR !== 'false'
+  },
+
+  // Medical documents
+  documents: {
+    // Lifetime of the presigned URL a download redirects to
+    downloadUrlTtlSeconds: parseInt(process.env.DOCUMENT_DOWNLOAD_URL_TTL_SECONDS, 10) || 60
+  },
+
+  // Admin-editable platform settings (see SettingsService). Other instances
+  // pick up a change within this interval.
+  settings: {
+    refreshIntervalMs: parseInt(process.env.SETTINGS_REFRESH_INTERVAL_MS, 10) || 60 * 1000
+  },
+
+  // Data retention. A daily job deletes or archives records older than their
+  // retention age; archiving moves them to a "<collection>_archive"
+  // collection. Medical records are never removed before the legal minimum
+  // (20 years under the Dutch WGBO), whatever is configured.
+  retention: {
+    enabled: process.env.RETENTION_PURGE_ENABLED === 'true',
+    // Only log what would be purged
+    dryRun: process.env.RETENTION_DRY_RUN === 'true',
+    intervalMs: 24 * 60 * 60 * 1000,
+    // Records handled per batch, so one run doesn't hold everything in memory
+    batchSize: 500,
+    medicalRecordMinDays: 20 * 365,
+    policies: {
+      chatMessages: {
+        days: parseInt(process.env.RETENTION_CHAT_MESSAGES_DAYS, 10) || 365,
+        action: process.env.RETENTION_CHAT_MESSAGES_ACTION || 'delete'
+      },
+      // Days after a completed appointment its chat content is purged,
+      // keeping the messages' metadata
+      chatContent: {
+        days: parseInt(process.env.RETENTION_CHAT_CONTENT_DAYS, 10) || 180,
+        action: 'redact'
+      },
+      videoSessions: {
+        days: parseInt(process.env.RETENTION_VIDEO_SESSIONS_DAYS, 10) || 90,
+        action: process.env.RETENTION_VIDEO_SESSIONS_ACTION || 'delete'
+      },
+      notifications: {
+        days: parseInt(process.env.RETENTION_NOTIFICATIONS_DAYS, 10) || 90,
+        action: process.env.RETENTION_NOTIFICATIONS_ACTION || 'delete'
+      },
+      medicalDocuments: {
+        days: parseInt(process.env.RETENTION_MEDICAL_DOCUMENTS_DAYS, 10) || 20 * 365,
+        action: process.env.RETENTION_MEDICAL_DOCUMENTS_ACTION || 'archive'
+      }
+    }
+  },
+
   // Notification settings
   notifications: {
     email: process.env.ENABLE_EMAIL_NOTIFICATIONS === 'true',
@@ -1,7 +1,81 @@
 const Doctor = require('../models/doctor.model');
 const User = require('../models/user.model');
 const Review = require('../models/review.model');
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const QueueJob = require('../models/queue.job.model');
+const Suppression = require('../models/suppression.model');
+const WebhookEndpoint = require('../models/webhook.endpoint.model');
+const WebhookDelivery = require('../models/webhook.delivery.model');
+const WebhookService = require('../services/webhook.service');
+const Block = require('../models/block.model');
+const BlockService = require('../services/block.service');
+const BookingThrottleService = require('../services/booking.throttle.service');
+const Payout = require('../models/payout.model');
+const IntakeForm = require('../models/intake.form.model');
+const PrepInstruction = require('../models/prep.instruction.model');
+const PayoutService = require('../services/payout.service');
+const ReportService = require('../services/report.service');
+const IntakeService = require('../services/intake.service');
+const SettingsService = require('../services/settings.service');
+const DatabaseService = require('../services/database.service');
+const QueryMonitorService = require('../services/query.monitor.service');
+const sqsService = require('../services/aws/sqs.service');
 const BigRegisterService = require('../services/bigRegister.service');
+const { toCsvRow } = require('../utils/csv');
+const { getQueryOptions, isTimeoutError } = require('../middleware/timeout.middleware');
+
+const ANALYTICS_GRANULARITIES = ['day', 'week', 'month'];
+
+// Mirror $dateTrunc (UTC, weeks starting Monday) so empty periods can be filled in
+const truncateDate = (date, unit) => {
+  const d = new Date(date);
+  d.setUTCHours(0, 0, 0, 0);
+  if (unit === 'week') {
+    d.setUTCDate(d.getUTCDate() - ((d.getUTCDay() + 6) % 7));
+  } else if (unit === 'month') {
+    d.setUTCDate(1);
+  }
+  return d;
+};
+
+const nextPeriod = (date, unit) => {
+  const d = new Date(date);
+  if (unit === 'day') d.setUTCDate(d.getUTCDate() + 1);
+  else if (unit === 'week') d.setUTCDate(d.getUTCDate() + 7);
+  else d.setUTCMonth(d.getUTCMonth() + 1);
+  return d;
+};
+
+// Turn grouped results into a continuous series with zeroes for empty periods
+const fillSeries = (rows, start, end, unit, empty) => {
+  const byPeriod = new Map(rows.map(row => [row._id.getTime(), row]));
+  const series = [];
+  for (let period = truncateDate(start, unit); period <= end; period = nextPeriod(period, unit)) {
+    const row = byPeriod.get(period.getTime());
+    const point = { period: period.toISOString() };
+    Object.keys(empty).forEach(key => {
+      point[key] = row ? row[key] : empty[key];
+    });
+    series.push(point);
+  }
+  return series;
+};
+
+// Cancellation counts for every category, zeroes included, split by who
+// cancelled. Cancellations from before categories existed, or by the system,
+// have no category and count as uncategorized.
+const summarizeCancellationCategories = (rows) => {
+  const categories = [...Appointment.CANCELLATION_CATEGORIES, 'uncategorized'];
+  return categories.map(category => {
+    const matching = rows.filter(row => (row._id.category || 'uncategorized') === category);
+    return {
+      category,
+      count: matching.reduce((sum, row) => sum + row.count, 0),
+      byCancelledBy: Object.fromEntries(matching.map(row => [row._id.cancelledBy || 'unknown', row.count]))
+    };
+  });
+};
 
 class AdminHandler {
   // Get all pending doctor verifications
@@ -73,6 +147,97 @@ class AdminHandler {
     }
   }
 
+  // Doctors with profile changes waiting for approval, oldest first
+  static async getPendingProfileChanges(req, res) {
+    try {
+      const doctors = await Doctor.find({ 'pendingProfileChanges.submittedAt': { $exists: true } })
+        .select('userId registrationNumber specializations pendingProfileChanges')
+        .populate('userId', 'firstName lastName email')
+        .sort({ 'pendingProfileChanges.submittedAt': 1 });
+
+      res.json({
+        success: true,
+        data: doctors
+      });
+    } catch (error) {
+      console.error('Error in getPendingProfileChanges:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch pending profile changes'
+      });
+    }
+  }
+
+  // Approve or reject a doctor's pending profile changes
+  static async reviewProfileChanges(req, res) {
+    try {
+      const { status, reason } = req.body;
+
+      const doctor = await Doctor.findById(req.params.id);
+      if (!doctor) {
+        return res.status(404).json({
+          success: false,
+          error: 'Doctor not found'
+        });
+      }
+
+      const pending = doctor.pendingProfileChanges && doctor.pendingProfileChanges.changes;
+      if (!pending) {
+        return res.status(409).json({
+          success: false,
+          error: 'Doctor has no pending profile changes'
+        });
+      }
+
+      const fields = Object.keys(pending);
+      const update = {
+        $unset: { pendingProfileChanges: 1 },
+        $set: {
+          profileChangeReview: {
+            status,
+            fields,
+            reason,
+            reviewedBy: req.user._id,
+            reviewedAt: new Date()
+          }
+        }
+      };
+      if (status === 'approved') {
+        Object.assign(update.$set, pending);
+      }
+
+      // Conditional on the submission reviewed, so changes submitted meanwhile aren't lost
+      const updated = await Doctor.findOneAndUpdate(
+        { _id: doctor._id, 'pendingProfileChanges.submittedAt': doctor.pendingProfileChanges.submittedAt },
+        update,
+        { new: true, runValidators: true }
+      );
+      if (!updated) {
+        return res.status(409).json({
+          success: false,
+          error: 'The pending changes were updated; review them again'
+        });
+      }
+
+      res.json({
+        success: true,
+        message: `Profile changes ${status}`,
+        data: {
+          doctorId: updated._id,
+          fields,
+          specializations: updated.specializations,
+          profileChangeReview: updated.profileChangeReview
+        }
+      });
+    } catch (error) {
+      console.error('Error in reviewProfileChanges:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to review profile changes'
+      });
+    }
+  }
+
   // Get all doctors
   static async getAllDoctors(req, res) {
     try {
@@ -258,6 +423,1030 @@ class AdminHandler {
       });
     }
   }
+
+  // Time-series analytics for charts
+  static async getAnalytics(req, res) {
+    try {
+      const granularity = req.query.granularity || 'day';
+      if (!ANALYTICS_GRANULARITIES.includes(granularity)) {
+        return res.status(400).json({
+          success: false,
+          error: `granularity must be one of: ${ANALYTICS_GRANULARITIES.join(', ')}`
+        });
+      }
+
+      const endDate = req.query.endDate ? new Date(req.query.endDate) : new Date();
+      const startDate = req.query.startDate
+        ? new Date(req.query.startDate)
+        : new Date(endDate.getTime() - 30 * 24 * 60 * 60 * 1000);
+      if (isNaN(startDate) || isNaN(endDate) || startDate > endDate) {
+        return res.status(400).json({
+          success: false,
+          error: 'Invalid date range'
+        });
+      }
+
+      const createdInRange = { createdAt: { $gte: startDate, $lte: endDate } };
+      // Unfinished booking drafts don't count as bookings
+      const bookedInRange = { ...createdInRange, status: { $ne: 'draft' } };
+      const periodOf = (date) => ({
+        $dateTrunc: { date, unit: granularity, startOfWeek: 'monday', timezone: 'UTC' }
+      });
+      const period = periodOf('$createdAt');
+
+      const [appointmentRows, revenueRows, userRows, topSpecialties, cancellationRows] = await Promise.all([
+        // Grouped by booking date, with each booking's current outcome
+        Appointment.aggregate([
+          { $match: bookedInRange },
+          {
+            $group: {
+              _id: period,
+              booked: { $sum: 1 },
+              completed: { $sum: { $cond: [{ $eq: ['$status', 'completed'] }, 1, 0] } },
+              cancelled: { $sum: { $cond: [{ $eq: ['$status', 'cancelled'] }, 1, 0] } }
+            }
+          }
+        ]).option(getQueryOptions(req)),
+        // By when the payment went through, with amounts kept apart per
+        // currency since they can't be summed together
+        Payment.aggregate([
+          { $match: { status: 'success', paidAt: { $gte: startDate, $lte: endDate } } },
+          {
+            $group: {
+              _id: { period: periodOf('$paidAt'), currency: { $ifNull: ['$currency', 'EUR'] } },
+              amount: { $sum: '$amount' },
+              payments: { $sum: 1 }
+            }
+          },
+          {
+            $group: {
+              _id: '$_id.period',
+              amounts: { $push: { k: '$_id.currency', v: '$amount' } },
+              payments: { $sum: '$payments' }
+            }
+          },
+          { $project: { amounts: { $arrayToObject: '$amounts' }, payments: 1 } }
+        ]).option(getQueryOptions(req)),
+        User.aggregate([
+          { $match: createdInRange },
+          {
+            $group: {
+              _id: period,
+              patients: { $sum: { $cond: [{ $eq: ['$role', 'patient'] }, 1, 0] } },
+              doctors: { $sum: { $cond: [{ $eq: ['$role', 'doctor'] }, 1, 0] } }
+            }
+          }
+        ]).option(getQueryOptions(req)),
+        Appointment.aggregate([
+          { $match: bookedInRange },
+          { $group: { _id: '$doctorId', appointments: { $sum: 1 } } },
+          {
+            $lookup: {
+              from: 'doctors',
+              localField: '_id',
+              foreignField: '_id',
+              as: 'doctor'
+            }
+          },
+          { $unwind: '$doctor' },
+          { $unwind: '$doctor.specializations' },
+          { $group: { _id: '$doctor.specializations', appointments: { $sum: '$appointments' } } },
+          { $sort: { appointments: -1 } },
+          { $limit: 10 },
+          { $project: { _id: 0, specialty: '$_id', appointments: 1 } }
+        ]).option(getQueryOptions(req)),
+        // By when the cancellation happened, not when the booking was made
+        Appointment.aggregate([
+          { $match: { status: 'cancelled', cancellationTime: { $gte: startDate, $lte: endDate } } },
+          { $group: { _id: { category: '$cancellationCategory', cancelledBy: '$cancelledBy' }, count: { $sum: 1 } } }
+        ]).option(getQueryOptions(req))
+      ]);
+
+      res.json({
+        success: true,
+        data: {
+          granularity,
+          startDate,
+          endDate,
+          appointments: fillSeries(appointmentRows, startDate, endDate, granularity, { booked: 0, completed: 0, cancelled: 0 }),
+          revenue: fillSeries(revenueRows, startDate, endDate, granularity, { amounts: {}, payments: 0 }),
+          newUsers: fillSeries(userRows, startDate, endDate, granularity, { patients: 0, doctors: 0 }),
+          topSpecialties,
+          cancellationCategories: summarizeCancellationCategories(cancellationRows)
+        }
+      });
+    } catch (error) {
+      if (isTimeoutError(error)) {
+        return res.status(503).json({
+          success: false,
+          error: 'Request timed out'
+        });
+      }
+      console.error('Error in getAnalytics:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch analytics'
+      });
+    }
+  }
+
+  // Jobs that exhausted their retries, plus the dead-letter queue depth
+  static async getDeadLetterJobs(req, res) {
+    try {
+      const { page = 1, limit = 20 } = req.query;
+      const skip = (Number(page) - 1) * Number(limit);
+
+      const [jobs, total, queueDepth] = await Promise.all([
+        QueueJob.find({ status: 'dead' })
+          .sort({ updatedAt: -1 })
+          .skip(skip)
+          .limit(Number(limit)),
+        QueueJob.countDocuments({ status: 'dead' }),
+        sqsService.getDeadLetterCount()
+      ]);
+
+      res.json({
+        success: true,
+        data: {
+          jobs,
+          queueDepth,
+          pagination: {
+            page: Number(page),
+            limit: Number(limit),
+            total,
+            pages: Math.ceil(total / limit)
+          }
+        }
+      });
+    } catch (error) {
+      console.error('Error in getDeadLetterJobs:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch dead-letter jobs'
+      });
+    }
+  }
+
+  // Send dead-lettered messages back to the main queue for another try
+  static async redriveDeadLetterJobs(req, res) {
+    try {
+      const limit = Math.min(Number(req.body.limit) || 10, 100);
+      const redriven = await sqsService.redriveDeadLetters(limit);
+
+      const jobIds = redriven
+        .map(body => {
+          try {
+            return JSON.parse(body).jobId;
+          } catch (err) {
+            return null;
+          }
+        })
+        .filter(Boolean);
+      if (jobIds.length > 0) {
+        await QueueJob.updateMany(
+          { jobId: { $in: jobIds }, status: 'dead' },
+          { $set: { status: 'pending' } }
+        );
+      }
+
+      res.json({
+        success: true,
+        data: { redriven: redriven.length }
+      });
+    } catch (error) {
+      console.error('Error in redriveDeadLetterJobs:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to redrive dead-letter jobs'
+      });
+    }
+  }
+
+  // Addresses nothing is sent to after a hard bounce, complaint or SMS failure
+  static async getSuppressions(req, res) {
+    try {
+      const { channel, page = 1, limit = 20 } = req.query;
+      const skip = (Number(page) - 1) * Number(limit);
+      const query = channel ? { channel } : {};
+
+      const [suppressions, total] = await Promise.all([
+        Suppression.find(query)
+          .sort({ createdAt: -1 })
+          .skip(skip)
+          .limit(Number(limit)),
+        Suppression.countDocuments(query)
+      ]);
+
+      res.json({
+        success: true,
+        data: {
+          suppressions,
+          pagination: {
+            page: Number(page),
+            limit: Number(limit),
+            total,
+            pages: Math.ceil(total / limit)
+          }
+        }
+      });
+    } catch (error) {
+      console.error('Error in getSuppressions:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch suppressions'
+      });
+    }
+  }
+
+  // Lift a suppression, e.g. once the user has fixed their mailbox
+  static async deleteSuppression(req, res) {
+    try {
+      const suppression = await Suppression.findByIdAndDelete(req.params.id);
+      if (!suppression) {
+        return res.status(404).json({
+          success: false,
+          error: 'Suppression not found'
+        });
+      }
+
+      res.json({
+        success: true,
+        data: suppression
+      });
+    } catch (error) {
+      console.error('Error in deleteSuppression:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to delete suppression'
+      });
+    }
+  }
+
+  // Set or clear a doctor's commission override
+  static async updateDoctorCommission(req, res) {
+    try {
+      const { commissionPercent } = req.body;
+      const update = commissionPercent === null
+        ? { $unset: { commissionPercent: 1 } }
+        : { $set: { commissionPercent } };
+
+      const doctor = await Doctor.findByIdAndUpdate(req.params.id, update, { new: true });
+      if (!doctor) {
+        return res.status(404).json({
+          success: false,
+          error: 'Doctor not found'
+        });
+      }
+
+      res.json({
+        success: true,
+        data: {
+          doctorId: doctor._id,
+          commissionPercent: doctor.commissionPercent != null ? doctor.commissionPercent : null
+        }
+      });
+    } catch (error) {
+      console.error('Error in updateDoctorCommission:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to update commission'
+      });
+    }
+  }
+
+  // Bundle a doctor's outstanding payments into pending payouts
+  static async createPayouts(req, res) {
+    try {
+      const { doctorId, periodStart, periodEnd } = req.body;
+
+      const doctor = await Doctor.findById(doctorId);
+      if (!doctor) {
+        return res.status(404).json({
+          success: false,
+          error: 'Doctor not found'
+        });
+      }
+
+      const payouts = await PayoutService.createPayouts(
+        doctor._id,
+        periodStart ? new Date(periodStart) : undefined,
+        periodEnd ? new Date(periodEnd) : new Date()
+      );
+
+      res.status(201).json({
+        success: true,
+        data: { payouts }
+      });
+    } catch (error) {
+      console.error('Error in createPayouts:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to create payouts'
+      });
+    }
+  }
+
+  static async getPayouts(req, res) {
+    try {
+      const { status, doctorId, page = 1, limit = 20 } = req.query;
+      const skip = (Number(page) - 1) * Number(limit);
+
+      const filter = {};
+      if (status) filter.status = status;
+      if (doctorId) filter.doctorId = doctorId;
+
+      const [payouts, total] = await Promise.all([
+        Payout.find(filter)
+          .select('-payments')
+          .sort({ createdAt: -1 })
+          .skip(skip)
+          .limit(Number(limit)),
+        Payout.countDocuments(filter)
+      ]);
+
+      res.json({
+        success: true,
+        data: {
+          payouts,
+          pagination: {
+            page: Number(page),
+            limit: Number(limit),
+            total,
+            pages: Math.ceil(total / limit)
+          }
+        }
+      });
+    } catch (error) {
+      console.error('Error in getPayouts:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch payouts'
+      });
+    }
+  }
+
+  // Record that a payout has been transferred to the doctor
+  static async markPayoutPaid(req, res) {
+    try {
+      const payout = await PayoutService.markPayoutPaid(req.params.id, req.body.reference);
+      if (!payout) {
+        const exists = await Payout.exists({ _id: req.params.id });
+        return res.status(exists ? 409 : 404).json({
+          success: false,
+          error: exists ? 'Payout is already paid' : 'Payout not found'
+        });
+      }
+
+      res.json({
+        success: true,
+        data: { payout }
+      });
+    } catch (error) {
+      console.error('Error in markPayoutPaid:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to mark payout as paid'
+      });
+    }
+  }
+
+  // Successful payments with their appointment and doctor for accounting,
+  // streamed as CSV or JSON so large periods don't have to fit in memory
+  static async getFinancialReport(req, res) {
+    try {
+      const to = req.query.to ? new Date(req.query.to) : new Date();
+      const from = req.query.from
+        ? new Date(req.query.from)
+        : new Date(to.getTime() - 30 * 24 * 60 * 60 * 1000);
+      if (isNaN(from) || isNaN(to) || from > to) {
+        return res.status(400).json({
+          success: false,
+          error: 'Invalid date range'
+        });
+      }
+
+      const columns = ReportService.FINANCIAL_REPORT_COLUMNS;
+      const cursor = ReportService.getFinancialReport(from, to).cursor({ batchSize: 500 });
+      const period = `${from.toISOString().slice(0, 10)}_${to.toISOString().slice(0, 10)}`;
+
+      if (req.query.format === 'csv') {
+        res.set('Content-Type', 'text/csv; charset=utf-8');
+        res.set('Content-Disposition', `attachment; filename="financial-report_${period}.csv"`);
+        res.write(toCsvRow(columns));
+        for await (const payment of cursor) {
+          const row = ReportService.toFinancialReportRow(payment);
+          res.write(toCsvRow(columns.map(column => row[column])));
+        }
+        return res.end();
+      }
+
+      res.set('Content-Type', 'application/json; charset=utf-8');
+      res.write(`{"success":true,"data":{"from":${JSON.stringify(from)},"to":${JSON.stringify(to)},"columns":${JSON.stringify(columns)},"rows":[`);
+      let first = true;
+      for await (const payment of cursor) {
+        res.write((first ? '' : ',') + JSON.stringify(ReportService.toFinancialReportRow(payment)));
+        first = false;
+      }
+      res.end(']}}');
+    } catch (error) {
+      console.error('Error in getFinancialReport:', error);
+      // Once rows are streaming the status can't change; cut the response short
+      if (res.headersSent) {
+        return res.destroy(error);
+      }
+      res.status(500).json({
+        success: false,
+        error: 'Failed to generate financial report'
+      });
+    }
+  }
+
+  static async getIntakeForms(req, res) {
+    try {
+      const forms = await IntakeForm.find().sort({ specialty: 1 });
+      res.json({
+        success: true,
+        data: { forms }
+      });
+    } catch (error) {
+      console.error('Error in getIntakeForms:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to get intake forms'
+      });
+    }
+  }
+
+  static async createIntakeForm(req, res) {
+    try {
+      const { specialty, title, questions, isActive } = req.body;
+      const questionErrors = IntakeService.getQuestionErrors(questions);
+      if (questionErrors) {
+        return res.status(400).json({
+          success: false,
+          error: 'Invalid questions',
+          errors: questionErrors
+        });
+      }
+
+      const form = await IntakeForm.create({ specialty, title, questions, isActive });
+      res.status(201).json({
+        success: true,
+        data: { form }
+      });
+    } catch (error) {
+      if (error.code === 11000) {
+        return res.status(409).json({
+          success: false,
+          error: 'This specialty already has an intake form'
+        });
+      }
+      if (error.name === 'ValidationError') {
+        return res.status(400).json({
+          success: false,
+          error: error.message
+        });
+      }
+      console.error('Error in createIntakeForm:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to create intake form'
+      });
+    }
+  }
+
+  // Edit or (de)activate a form. Changing the questions bumps the version;
+  // answers already given keep the labels they were given under.
+  static async updateIntakeForm(req, res) {
+    try {
+      const form = await IntakeForm.findById(req.params.id);
+      if (!form) {
+        return res.status(404).json({
+          success: false,
+          error: 'Intake form not found'
+        });
+      }
+
+      const { title, questions, isActive } = req.body;
+      if (questions !== undefined) {
+        const questionErrors = IntakeService.getQuestionErrors(questions);
+        if (questionErrors) {
+          return res.status(400).json({
+            success: false,
+            error: 'Invalid questions',
+            errors: questionErrors
+          });
+        }
+        form.questions = questions;
+        form.version += 1;
+      }
+      if (title !== undefined) form.title = title;
+      if (isActive !== undefined) form.isActive = isActive;
+      await form.save();
+
+      res.json({
+        success: true,
+        data: { form }
+      });
+    } catch (error) {
+      if (error.name === 'ValidationError') {
+        return res.status(400).json({
+          success: false,
+          error: error.message
+        });
+      }
+      console.error('Error in updateIntakeForm:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to update intake form'
+      });
+    }
+  }
+
+  static async getPrepInstructions(req, res) {
+    try {
+      const instructions = await PrepInstruction.find().sort({ specialty: 1, appointmentType: 1 });
+      res.json({
+        success: true,
+        data: { instructions }
+      });
+    } catch (error) {
+      console.error('Error in getPrepInstructions:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to get prep instructions'
+      });
+    }
+  }
+
+  static async createPrepInstruction(req, res) {
+    try {
+      const { specialty, appointmentType, instructions, isActive } = req.body;
+      const instruction = await PrepInstruction.create({ specialty, appointmentType, instructions, isActive });
+      res.status(201).json({
+        success: true,
+        data: { instruction }
+      });
+    } catch (error) {
+      if (error.code === 11000) {
+        return res.status(409).json({
+          success: false,
+          error: 'Prep instructions already exist for this specialty and appointment type'
+        });
+      }
+      if (error.name === 'ValidationError') {
+        return res.status(400).json({
+          success: false,
+          error: error.message
+        });
+      }
+      console.error('Error in createPrepInstruction:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to create prep instructions'
+      });
+    }
+  }
+
+  // Edit or (de)activate instructions; what they apply to stays fixed
+  static async updatePrepInstruction(req, res) {
+    try {
+      const instruction = await PrepInstruction.findById(req.params.id);
+      if (!instruction) {
+        return res.status(404).json({
+          success: false,
+          error: 'Prep instructions not found'
+        });
+      }
+
+      const { instructions, isActive } = req.body;
+      if (instructions !== undefined) instruction.instructions = instructions;
+      if (isActive !== undefined) instruction.isActive = isActive;
+      await instruction.save();
+
+      res.json({
+        success: true,
+        data: { instruction }
+      });
+    } catch (error) {
+      if (error.name === 'ValidationError') {
+        return res.status(400).json({
+          success: false,
+          error: error.message
+        });
+      }
+      console.error('Error in updatePrepInstruction:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to update prep instructions'
+      });
+    }
+  }
+
+  // Webhook endpoints, without their secrets
+  static async getWebhookEndpoints(req, res) {
+    try {
+      const endpoints = await WebhookEndpoint.find().sort({ createdAt: -1 });
+      res.json({
+        success: true,
+        data: { endpoints }
+      });
+    } catch (error) {
+      console.error('Error in getWebhookEndpoints:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch webhook endpoints'
+      });
+    }
+  }
+
+  // Register an endpoint. Its signing secret is only ever returned here.
+  static async createWebhookEndpoint(req, res) {
+    try {
+      const { url, events, description } = req.body;
+      const secret = WebhookService.generateSecret();
+      const endpoint = await WebhookEndpoint.create({ url, events, description, secret, createdBy: req.user.id });
+      res.status(201).json({
+        success: true,
+        data: { endpoint: { ...endpoint.toObject(), secret } }
+      });
+    } catch (error) {
+      if (error.name === 'ValidationError') {
+        return res.status(400).json({
+          success: false,
+          error: error.message
+        });
+      }
+      console.error('Error in createWebhookEndpoint:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to create webhook endpoint'
+      });
+    }
+  }
+
+  // Change an endpoint's URL, events or description, (de)activate it, or
+  // rotate its secret
+  static async updateWebhookEndpoint(req, res) {
+    try {
+      const endpoint = await WebhookEndpoint.findById(req.params.id);
+      if (!endpoint) {
+        return res.status(404).json({
+          success: false,
+          error: 'Webhook endpoint not found'
+        });
+      }
+
+      const { url, events, description, active, rotateSecret } = req.body;
+      if (url !== undefined) endpoint.url = url;
+      if (events !== undefined) endpoint.events = events;
+      if (description !== undefined) endpoint.description = description;
+      if (active !== undefined) endpoint.active = active;
+      const secret = rotateSecret ? WebhookService.generateSecret() : undefined;
+      if (secret) endpoint.secret = secret;
+      await endpoint.save();
+
+      const { secret: stored, ...data } = endpoint.toObject();
+      res.json({
+        success: true,
+        data: { endpoint: secret ? { ...data, secret } : data }
+      });
+    } catch (error) {
+      if (error.name === 'ValidationError') {
+        return res.status(400).json({
+          success: false,
+          error: error.message
+        });
+      }
+      console.error('Error in updateWebhookEndpoint:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to update webhook endpoint'
+      });
+    }
+  }
+
+  // Remove an endpoint; its queued deliveries are dropped when they come up
+  static async deleteWebhookEndpoint(req, res) {
+    try {
+      const endpoint = await WebhookEndpoint.findByIdAndDelete(req.params.id);
+      if (!endpoint) {
+        return res.status(404).json({
+          success: false,
+          error: 'Webhook endpoint not found'
+        });
+      }
+      res.json({
+        success: true,
+        data: { endpoint }
+      });
+    } catch (error) {
+      console.error('Error in deleteWebhookEndpoint:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to delete webhook endpoint'
+      });
+    }
+  }
+
+  // An endpoint's deliveries with their attempts, newest first
+  static async getWebhookDeliveries(req, res) {
+    try {
+      const { status, event, page = 1, limit = 20 } = req.query;
+      const skip = (Number(page) - 1) * Number(limit);
+      const query = { endpointId: req.params.id };
+      if (status) query.status = status;
+      if (event) query.event = event;
+
+      const [deliveries, total] = await Promise.all([
+        WebhookDelivery.find(query)
+          .sort({ createdAt: -1 })
+          .skip(skip)
+          .limit(Number(limit)),
+        WebhookDelivery.countDocuments(query)
+      ]);
+
+      res.json({
+        success: true,
+        data: {
+          deliveries,
+          pagination: {
+            page: Number(page),
+            limit: Number(limit),
+            total,
+            pages: Math.ceil(total / limit)
+          }
+        }
+      });
+    } catch (error) {
+      console.error('Error in getWebhookDeliveries:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch webhook deliveries'
+      });
+    }
+  }
+
+  // Send a delivery's event again, e.g. after the receiver was down
+  static async replayWebhookDelivery(req, res) {
+    try {
+      const delivery = await WebhookDelivery.findById(req.params.id);
+      if (!delivery) {
+        return res.status(404).json({
+          success: false,
+          error: 'Webhook delivery not found'
+        });
+      }
+      const replay = await WebhookService.replayDelivery(delivery);
+      res.status(201).json({
+        success: true,
+        data: { delivery: replay }
+      });
+    } catch (error) {
+      console.error('Error in replayWebhookDelivery:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to replay webhook delivery'
+      });
+    }
+  }
+
+  // Doctor-patient blocks with their audit trail
+  static async getBlocks(req, res) {
+    try {
+      const { doctorId, patientId, active, page = 1, limit = 20 } = req.query;
+      const skip = (Number(page) - 1) * Number(limit);
+      const query = {};
+      if (doctorId) query.doctorId = doctorId;
+      if (patientId) query.patientId = patientId;
+      if (active !== undefined) query.active = active === 'true';
+
+      const [blocks, total] = await Promise.all([
+        Block.find(query)
+          .sort({ updatedAt: -1 })
+          .skip(skip)
+          .limit(Number(limit))
+          .populate('patientId', 'firstName lastName email')
+          .populate({ path: 'doctorId', select: 'userId', populate: { path: 'userId', select: 'firstName lastName' } }),
+        Block.countDocuments(query)
+      ]);
+
+      res.json({
+        success: true,
+        data: {
+          blocks,
+          pagination: {
+            page: Number(page),
+            limit: Number(limit),
+            total,
+            pages: Math.ceil(total / limit)
+          }
+        }
+      });
+    } catch (error) {
+      console.error('Error in getBlocks:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch blocks'
+      });
+    }
+  }
+
+  // Block a patient for a doctor, e.g. after a reported incident
+  static async createBlock(req, res) {
+    try {
+      const { doctorId, patientId, reason } = req.body;
+      const [doctor, patient] = await Promise.all([
+        Doctor.findById(doctorId).select('_id'),
+        User.findOne({ _id: patientId, role: 'patient' }).select('_id')
+      ]);
+      if (!doctor || !patient) {
+        return res.status(404).json({
+          success: false,
+          error: doctor ? 'Patient not found' : 'Doctor not found'
+        });
+      }
+      const { block, created } = await BlockService.blockPatient(doctor._id, patient._id, { userId: req.user._id, role: 'admin' }, reason);
+      res.status(created ? 201 : 200).json({
+        success: true,
+        data: block
+      });
+    } catch (error) {
+      console.error('Error in createBlock:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to create block'
+      });
+    }
+  }
+
+  // Lift a block; the history is kept
+  static async deleteBlock(req, res) {
+    try {
+      const block = await Block.findOne({ _id: req.params.id, active: true });
+      if (!block) {
+        return res.status(404).json({
+          success: false,
+          error: 'Block not found'
+        });
+      }
+      const updated = await BlockService.unblock(block, { userId: req.user._id, role: 'admin' }, req.body && req.body.reason);
+      res.json({
+        success: true,
+        data: updated
+      });
+    } catch (error) {
+      console.error('Error in deleteBlock:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to lift block'
+      });
+    }
+  }
+
+  // Specialty booking throttles with this hour's and today's bookings
+  static async getBookingThrottles(req, res) {
+    try {
+      res.json({
+        success: true,
+        data: await BookingThrottleService.listThrottles()
+      });
+    } catch (error) {
+      console.error('Error in getBookingThrottles:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch booking throttles'
+      });
+    }
+  }
+
+  // Cap new bookings for a specialty, e.g. during a demand spike
+  static async setBookingThrottle(req, res) {
+    try {
+      const { maxPerHour, maxPerDay, reason } = req.body;
+      if (maxPerHour == null && maxPerDay == null) {
+        return res.status(400).json({
+          success: false,
+          error: 'Set maxPerHour, maxPerDay or both'
+        });
+      }
+      const { throttle, created } = await BookingThrottleService.setThrottle(
+        req.params.specialty,
+        { maxPerHour, maxPerDay, reason },
+        req.user._id
+      );
+      res.status(created ? 201 : 200).json({
+        success: true,
+        data: throttle
+      });
+    } catch (error) {
+      console.error('Error in setBookingThrottle:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to set booking throttle'
+      });
+    }
+  }
+
+  // Lift a specialty's throttle; its bookings are unlimited again
+  static async deleteBookingThrottle(req, res) {
+    try {
+      const removed = await BookingThrottleService.removeThrottle(req.params.specialty);
+      if (!removed) {
+        return res.status(404).json({
+          success: false,
+          error: 'Booking throttle not found'
+        });
+      }
+      res.json({
+        success: true,
+        data: removed
+      });
+    } catch (error) {
+      console.error('Error in deleteBookingThrottle:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to remove booking throttle'
+      });
+    }
+  }
+
+  // Effective platform settings, which are overridden, and recent changes
+  static async getSettings(req, res) {
+    try {
+      await SettingsService.refresh();
+      res.json({
+        success: true,
+        data: {
+          ...SettingsService.getSettings(),
+          limits: SettingsService.SETTING_DEFINITIONS,
+          history: await SettingsService.getHistory()
+        }
+      });
+    } catch (error) {
+      console.error('Error in getSettings:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch settings'
+      });
+    }
+  }
+
+  // Change settings at runtime. The update names the version it was based
+  // on, so two admins editing at once can't silently overwrite each other.
+  static async updateSettings(req, res) {
+    try {
+      const changes = SettingsService.flattenSettings(req.body.settings);
+      const errors = SettingsService.getSettingsErrors(changes);
+      if (errors) {
+        return res.status(400).json({
+          success: false,
+          error: 'Invalid settings',
+          errors
+        });
+      }
+
+      const updated = await SettingsService.updateSettings(changes, req.body.version, req.user.id);
+      if (!updated) {
+        await SettingsService.refresh();
+        return res.status(409).json({
+          success: false,
+          error: 'Settings were changed by someone else; reload and try again',
+          data: SettingsService.getSettings()
+        });
+      }
+
+      res.json({
+        success: true,
+        data: SettingsService.getSettings()
+      });
+    } catch (error) {
+      console.error('Error in updateSettings:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to update settings'
+      });
+    }
+  }
+
+  // Database readiness and the slow queries seen since this instance started
+  static async getMetrics(req, res) {
+    try {
+      res.json({
+        success: true,
+        data: {
+          database: DatabaseService.getHealth(),
+          slowQueries: QueryMonitorService.getSlowQueryStats()
+        }
+      });
+    } catch (error) {
+      console.error('Error in getMetrics:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch metrics'
+      });
+    }
+  }
 }
 
 module.exports = AdminHandler; 
\ No newline at end of file
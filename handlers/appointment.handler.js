@@ -1,75 +1,788 @@
+const mongoose = require('mongoose');
 const Appointment = require('../models/appointment.model');
 const Doctor = require('../models/doctor.model');
 const User = require('../models/user.model');
+const Referral = require('../models/referral.model');
+const Payment = require('../models/payment.model');
 const { validationResult } = require('express-validator');
+const { v4: uuidv4 } = require('uuid');
+const { getFieldErrors } = require('../middleware/validation.middleware');
+const config = require('../config/config');
+const notificationService = require('../services/notification.service');
+const AppointmentService = require('../services/appointment.service');
+const AppointmentStatusService = require('../services/appointment.status.service');
+const AvailabilityService = require('../services/availability.service');
+const ReferralService = require('../services/referral.service');
+const IntakeService = require('../services/intake.service');
+const ChatService = require('../services/chat.service');
+const DocumentService = require('../services/document.service');
+const PricingService = require('../services/pricing.service');
+const SettingsService = require('../services/settings.service');
+const DatabaseService = require('../services/database.service');
+const ScanService = require('../services/scan.service');
+const WebhookService = require('../services/webhook.service');
+const BlockService = require('../services/block.service');
+const BookingThrottleService = require('../services/booking.throttle.service');
+const { verifyBookingToken } = require('../services/recommendation.service');
+const { getVerificationError } = require('../utils/verification');
+const { formatCurrency } = require('../utils/currency');
+const { timeToMinutes, getWeekday, getAppointmentStart, toZonedDateTime } = require('../utils/helpers');
+
+// 409 for a slot that can't be booked, with nearby free slots the client can
+// offer instead; options.language only suggests slots offering that language
+const respondWithSuggestions = async (res, doctor, date, startTime, endTime, type, body, options = {}) => {
+  const suggestions = await AvailabilityService.suggestAlternativeSlots(doctor, date, startTime, {
+    duration: timeToMinutes(endTime) - timeToMinutes(startTime),
+    type,
+    ...options
+  });
+  return res.status(409).json({ ...body, suggestions });
+};
+
+// 409 with suggestions when a concurrent booking took the slot after
+// checkBooking passed; false for any other error, to be rethrown
+const respondIfSlotTaken = async (res, error, booking, body) => {
+  if (error.errorCode !== 'SLOT_UNAVAILABLE') {
+    return false;
+  }
+  await respondWithSuggestions(res, booking.doctor, body.date, booking.startTime, booking.endTime, body.type, {
+    message: error.message,
+    code: error.errorCode
+  });
+  return true;
+};
+
+// The patient a booking is for: the caller, or anyone given as patientId
+// when the caller is an admin. Sends 403 and returns null when anyone else
+// names another patient.
+const getBookingPatientId = (req, res) => {
+  const { patientId } = req.body;
+  if (!patientId || patientId === req.user.id) {
+    return req.user.id;
+  }
+  if (req.user.role !== 'admin') {
+    res.status(403).json({ message: 'You can only book appointments for yourself' });
+    return null;
+  }
+  return patientId;
+};
+
+// Checks shared by booking and its preview: the doctor, the slot against
+// their schedule, clinic hours, other bookings and room capacity, and the fee.
+// Resolves to the booking details, or sends the rejection and resolves to null.
+const checkBooking = async (req, res, patientId) => {
+  const { doctorId, date, timeSlot, type, consultationTypeId, referralId, language } = req.body;
+  const doctor = await Doctor.findById(doctorId);
+  if (!doctor) {
+    res.status(404).json({ message: 'Doctor not found' });
+    return null;
+  }
+  if (await BlockService.isBlocked(doctor._id, patientId)) {
+    res.status(409).json(BlockService.BOOKING_BLOCKED_RESPONSE);
+    return null;
+  }
+  if (referralId && !(await ReferralService.findOpenReferral(referralId, patientId))) {
+    res.status(400).json({ message: 'Validation Error', errors: { referralId: 'Referral not found or already booked' } });
+    return null;
+  }
+  const windowError = AppointmentService.getBookingWindowError(doctor, date);
+  if (windowError) {
+    res.status(400).json(windowError);
+    return null;
+  }
+  // Parse requested slot
+  const [startTime, endTime] = timeSlot.split('-');
+  const durationMinutes = timeToMinutes(endTime) - timeToMinutes(startTime);
+  // The chosen consultation type sets the price and must match the slot length
+  let consultationType = null;
+  if (consultationTypeId) {
+    consultationType = doctor.consultationTypes.id(consultationTypeId);
+    if (!consultationType) {
+      res.status(400).json({ message: 'Validation Error', errors: { consultationTypeId: 'Consultation type is not offered by this doctor' } });
+      return null;
+    }
+    if (durationMinutes !== consultationType.duration) {
+      res.status(400).json({ message: 'Validation Error', errors: { timeSlot: `Time slot must be ${consultationType.duration} minutes for ${consultationType.name}` } });
+      return null;
+    }
+  }
+  // Check if requested slot fits within any available slot
+  const weekday = getWeekday(date);
+  const daySchedule = doctor.availability.find(s => s.day.toLowerCase() === weekday);
+  if (!daySchedule) {
+    await respondWithSuggestions(res, doctor, date, startTime, endTime, type, { message: 'No available slots for this day', code: 'OUTSIDE_DOCTOR_AVAILABILITY' });
+    return null;
+  }
+  if (!AvailabilityService.fitsDaySchedule(doctor, daySchedule, startTime, endTime)) {
+    await respondWithSuggestions(res, doctor, date, startTime, endTime, type, { message: 'Requested time slot does not fit in available slots', code: 'OUTSIDE_DOCTOR_AVAILABILITY' });
+    return null;
+  }
+  // The slot's block and the mode may limit the languages on offer; the
+  // agreed language is the requested one, or the only one offered
+  const doctorUser = await User.findById(doctor.userId).select('languages');
+  const doctorLanguages = doctorUser && doctorUser.languages;
+  const languages = AvailabilityService.getLanguagesAt(doctor, daySchedule, startTime, endTime, type, doctorLanguages);
+  if (!AvailabilityService.offersLanguage(languages, language)) {
+    await respondWithSuggestions(res, doctor, date, startTime, endTime, type, {
+      message: `Consultations at this time are offered in ${languages.join(', ')}, not ${language}`,
+      code: 'LANGUAGE_NOT_OFFERED',
+      languages
+    }, { language, doctorLanguages });
+    return null;
+  }
+  if (!AppointmentService.isWithinClinicHours(doctor, date, startTime, endTime, type)) {
+    await respondWithSuggestions(res, doctor, date, startTime, endTime, type, { message: 'Requested time is outside clinic opening hours', code: 'OUTSIDE_CLINIC_HOURS' });
+    return null;
+  }
+  // Check for overlap with existing appointments, keeping the buffers of
+  // both appointments' modes free
+  const appointments = await Appointment.find({ doctorId, date, status: { $nin: ['cancelled'] } });
+  if (AvailabilityService.isAtDailyCap(doctor, appointments)) {
+    await respondWithSuggestions(res, doctor, date, startTime, endTime, type, {
+      message: `This doctor takes at most ${doctor.maxAppointmentsPerDay} appointments a day and this day is full`,
+      code: 'DAILY_LIMIT_REACHED'
+    });
+    return null;
+  }
+  for (const appt of appointments) {
+    // Lapsed holds and expired unpaid bookings no longer occupy the slot
+    if (!AppointmentService.isBlockingAppointment(appt)) continue;
+    if (AvailabilityService.conflictsWithAppointment(doctor, timeToMinutes(startTime), timeToMinutes(endTime), type, appt)) {
+      await respondWithSuggestions(res, doctor, date, startTime, endTime, type, { message: 'Time slot overlaps with another appointment', code: 'SLOT_UNAVAILABLE' });
+      return null;
+    }
+  }
+  if (!(await AppointmentService.hasClinicRoomAvailable(doctor, date, startTime, endTime, type))) {
+    await respondWithSuggestions(res, doctor, date, startTime, endTime, type, { message: 'All consultation rooms at the clinic are booked at this time', code: 'CLINIC_AT_CAPACITY' });
+    return null;
+  }
+  const price = PricingService.getSlotPrice(doctor, date, startTime, consultationType ? consultationType.fee : doctor.consultationFee);
+  return {
+    doctor,
+    startTime,
+    endTime,
+    durationMinutes,
+    consultationType,
+    language: language ? language.toLowerCase() : (languages.length === 1 ? languages[0] : undefined),
+    fee: price.fee,
+    price
+  };
+};
+
+// Count a new booking against its specialty throttles. Resolves to the
+// reservation to release if the booking isn't saved, or sends 429 with
+// Retry-After and resolves to null when a specialty is at its limit.
+const reserveBookingCapacity = async (res, doctor) => {
+  const { reservation, throttled } = await BookingThrottleService.reserveBooking(doctor);
+  if (throttled) {
+    res.set('Retry-After', String(Math.max(1, Math.ceil((throttled.retryAfter - Date.now()) / 1000))));
+    res.status(429).json({
+      message: `New ${throttled.specialty} bookings are limited right now because of high demand. Please try again later.`,
+      code: 'SPECIALTY_BOOKINGS_THROTTLED',
+      specialty: throttled.specialty,
+      retryAfter: throttled.retryAfter
+    });
+    return null;
+  }
+  return reservation;
+};
+
+// Snapshot of a peak pricing adjustment for the appointment; none at the base fee
+const toPricingSnapshot = (price) => (price.multiplier !== 1
+  ? { baseFee: price.baseFee, multiplier: price.multiplier, rule: price.rule || undefined }
+  : undefined);
+
+// A new appointment for a booking that passed checkBooking: pending, or
+// confirmed for a doctor who auto-accepts bookings
+const buildAppointment = (body, booking, patientId) => {
+  const { doctorId, date, type, reason, patientDetails } = body;
+  const { startTime, endTime, durationMinutes, consultationType, language, fee, price } = booking;
+  const appointment = new Appointment({
+    doctorId,
+    patientId,
+    date,
+    startTime,
+    endTime,
+    type,
+    reason,
+    patientDetails: patientDetails && {
+      name: patientDetails.name,
+      dob: patientDetails.dob,
+      relationship: patientDetails.relationship
+    },
+    consultationType: consultationType
+      ? { typeId: consultationType._id, name: consultationType.name }
+      : undefined,
+    language,
+    fee,
+    pricing: toPricingSnapshot(price),
+    durationMinutes,
+    timeZone: AppointmentService.getScheduleTimeZone(booking.doctor),
+    status: 'pending'
+  });
+  AppointmentService.applyConfirmationMode(appointment, booking.doctor);
+  return appointment;
+};
+
+// Publish a new booking. One that was auto-accepted is also published as
+// confirmed, and both sides are told.
+const announceBooking = async (appointment) => {
+  await WebhookService.publishAppointmentEvent('appointment.created', appointment);
+  if (appointment.status !== 'confirmed') {
+    return;
+  }
+  await WebhookService.publishStatusChange(appointment);
+  notificationService.sendAppointmentConfirmation(appointment)
+    .catch(err => console.error('Appointment confirmation notification error:', err));
+  notificationService.sendAutoAcceptedBookingNotice(appointment)
+    .catch(err => console.error('Auto-accepted booking notice error:', err));
+};
+
+const formatBookedAppointment = (appointment) => ({
+  id: appointment._id,
+  doctorId: appointment.doctorId,
+  patientId: appointment.patientId,
+  date: appointment.date,
+  startTime: appointment.startTime,
+  endTime: appointment.endTime,
+  type: appointment.type,
+  reason: appointment.reason,
+  patientDetails: appointment.patientDetails,
+  consultationType: appointment.consultationType,
+  language: appointment.language,
+  fee: appointment.fee,
+  pricing: appointment.pricing,
+  durationMinutes: appointment.durationMinutes,
+  status: appointment.status,
+  // 'auto' when the doctor auto-accepts bookings: confirmed already, or once
+  // paid when payment is required first
+  confirmationMode: appointment.confirmationMode || 'manual',
+  confirmationCode: appointment.confirmationCode,
+  createdAt: appointment.createdAt,
+  updatedAt: appointment.updatedAt
+});
+
+// Answer a booking request whose idempotency key was already used. Resolves
+// to true when a response was sent: the earlier appointment (200, with
+// Idempotent-Replayed), or 422 when the key was used for a different booking.
+const replayIdempotentBooking = async (req, res, patientId, key) => {
+  const earlier = await AppointmentService.findIdempotentBooking(patientId, key);
+  if (!earlier) {
+    return false;
+  }
+  if (!AppointmentService.matchesIdempotentBooking(earlier, req.body)) {
+    res.status(422).json({
+      message: 'This idempotency key was already used for a different booking',
+      code: 'IDEMPOTENCY_KEY_REUSED'
+    });
+    return true;
+  }
+  res.set('Idempotent-Replayed', 'true');
+  res.status(200).json(formatBookedAppointment(earlier));
+  return true;
+};
+
+// A draft's saved choices in the shape of a booking request, so finalizing
+// can run the same validation as booking directly
+const getDraftBookingFields = (draft) => {
+  const fields = {
+    doctorId: draft.doctorId.toString(),
+    date: draft.date ? draft.date.toISOString().slice(0, 10) : undefined,
+    timeSlot: draft.startTime && draft.endTime ? `${draft.startTime}-${draft.endTime}` : undefined,
+    type: draft.type,
+    reason: draft.reason,
+    consultationTypeId: draft.consultationType && draft.consultationType.typeId
+      ? draft.consultationType.typeId.toString()
+      : undefined,
+    language: draft.language,
+    patientDetails: draft.patientDetails && draft.patientDetails.name
+      ? {
+        name: draft.patientDetails.name,
+        dob: draft.patientDetails.dob ? draft.patientDetails.dob.toISOString().slice(0, 10) : undefined,
+        relationship: draft.patientDetails.relationship
+      }
+      : undefined
+  };
+  return Object.fromEntries(Object.entries(fields).filter(([, value]) => value !== undefined));
+};
+
+const formatDraft = (draft) => ({
+  id: draft._id,
+  ...getDraftBookingFields(draft),
+  symptoms: draft.symptoms,
+  status: draft.status,
+  expiresAt: new Date(draft.updatedAt.getTime() + config.appointments.draftExpiryHours * 60 * 60 * 1000),
+  createdAt: draft.createdAt,
+  updatedAt: draft.updatedAt
+});
+
+// Apply draft fields from a request; anything left out keeps its saved value
+const applyDraftFields = (draft, body, doctor) => {
+  const { date, timeSlot, type, reason, symptoms, consultationTypeId, language, patientDetails } = body;
+  if (date !== undefined) draft.date = date;
+  if (timeSlot !== undefined) {
+    [draft.startTime, draft.endTime] = timeSlot.split('-');
+  }
+  if (type !== undefined) draft.type = type;
+  if (reason !== undefined) draft.reason = reason;
+  if (symptoms !== undefined) draft.symptoms = symptoms;
+  if (language !== undefined) draft.language = language ? language.toLowerCase() : undefined;
+  if (consultationTypeId !== undefined) {
+    const consultationType = doctor.consultationTypes.id(consultationTypeId);
+    if (!consultationType) {
+      return { consultationTypeId: 'Consultation type is not offered by this doctor' };
+    }
+    draft.consultationType = { typeId: consultationType._id, name: consultationType.name };
+  }
+  if (patientDetails !== undefined) {
+    draft.patientDetails = {
+      name: patientDetails.name,
+      dob: patientDetails.dob,
+      relationship: patientDetails.relationship
+    };
+  }
+  return null;
+};
+
+// Load the appointment in req.params.id for its patient or doctor to view.
+// Sends the 404/403 and resolves to null otherwise. Drafts are only visible
+// to the patient writing them.
+const loadViewableAppointment = async (req, res) => {
+  const appointment = await Appointment.findById(req.params.id);
+  if (!appointment) {
+    res.status(404).json({ message: 'Appointment not found' });
+    return null;
+  }
+  const role = await AppointmentStatusService.getActorRole(appointment, req.user);
+  if (role !== 'patient' && role !== 'doctor') {
+    res.status(403).json({ message: 'Forbidden' });
+    return null;
+  }
+  if (appointment.status === 'draft' && appointment.patientId.toString() !== req.user.id) {
+    res.status(404).json({ message: 'Appointment not found' });
+    return null;
+  }
+  return { appointment, role };
+};
+
+// Mongoose returns unset nested paths as empty objects, so check the submission time
+const getSubmittedIntake = (appointment) => (
+  appointment.intake && appointment.intake.submittedAt ? appointment.intake : null
+);
+
+// Private notes are the doctor's own and never reach the patient
+const getPrivateNotes = async (appointment, role) => {
+  if (role !== 'doctor') {
+    return undefined;
+  }
+  return (await Appointment.findById(appointment._id).select('privateNotes')).privateNotes || null;
+};
+
+// Who the patient is and their last completed visits with this doctor
+const getPatientSummary = async (appointment) => {
+  const [patient, previousVisits] = await Promise.all([
+    User.findById(appointment.patientId).select('firstName lastName dob gender languages avatarUrl'),
+    Appointment.find({
+      patientId: appointment.patientId,
+      doctorId: appointment.doctorId,
+      status: 'completed',
+      _id: { $ne: appointment._id }
+    })
+      .sort({ date: -1 })
+      .limit(5)
+      .select('date startTime type reason disposition')
+  ]);
+  return patient && {
+    id: patient._id,
+    firstName: patient.firstName,
+    lastName: patient.lastName,
+    dob: patient.dob,
+    gender: patient.gender,
+    languages: patient.languages,
+    avatarUrl: patient.avatarUrl,
+    previousVisits
+  };
+};
 
 const AppointmentHandler = {
   // Create a new appointment
   async createAppointment(req, res) {
     try {
-      const errors = validationResult(req);
-      if (!errors.isEmpty()) {
-        return res.status(400).json({ errors: errors.array() });
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
       }
-      const { doctorId, patientId, date, timeSlot, type, reason } = req.body;
-      const doctor = await Doctor.findById(doctorId);
+      const verificationError = getVerificationError(req.user);
+      if (verificationError) {
+        return res.status(403).json(verificationError);
+      }
+      const { referralId } = req.body;
+      const bookingPatientId = getBookingPatientId(req, res);
+      if (!bookingPatientId) {
+        return;
+      }
+      // A retried request gets the appointment it already booked, before the
+      // slot checks would report that slot as taken
+      const idempotencyKey = req.get('Idempotency-Key') || req.body.requestId;
+      if (idempotencyKey) {
+        const replay = await replayIdempotentBooking(req, res, bookingPatientId, idempotencyKey);
+        if (replay) {
+          return;
+        }
+      }
+      const booking = await checkBooking(req, res, bookingPatientId);
+      if (!booking) {
+        return;
+      }
+      const reservation = await reserveBookingCapacity(res, booking.doctor);
+      if (!reservation) {
+        return;
+      }
+      // The appointment and its referral are booked together or not at all
+      let appointment;
+      try {
+        appointment = await DatabaseService.withTransaction(async (session) => {
+          const created = buildAppointment(req.body, booking, bookingPatientId);
+          created.idempotencyKey = idempotencyKey;
+          await AppointmentService.saveBooking(created, session);
+          if (referralId) {
+            await ReferralService.markReferralBooked(referralId, created._id, { session });
+          }
+          return created;
+        });
+      } catch (error) {
+        await BookingThrottleService.releaseBooking(reservation);
+        // A concurrent retry with the same key saved first: this one either
+        // clashes on the key or finds the slot taken by that booking
+        const keyTaken = error.code === 11000 && error.keyPattern && error.keyPattern.idempotencyKey;
+        if (idempotencyKey && (keyTaken || error.errorCode === 'SLOT_UNAVAILABLE')) {
+          if (await replayIdempotentBooking(req, res, bookingPatientId, idempotencyKey)) {
+            return;
+          }
+        }
+        if (await respondIfSlotTaken(res, error, booking, req.body)) {
+          return;
+        }
+        throw error;
+      }
+      await announceBooking(appointment);
+      res.status(201).json(formatBookedAppointment(appointment));
+    } catch (error) {
+      console.error('createAppointment error:', error);
+      res.status(500).json({ message: 'Error creating appointment' });
+    }
+  },
+
+  // Save the first steps of a booking; nothing is reserved until it is finalized
+  async createDraft(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const doctor = await Doctor.findById(req.body.doctorId);
       if (!doctor) {
         return res.status(404).json({ message: 'Doctor not found' });
       }
-      // Parse requested slot
-      const [startTime, endTime] = timeSlot.split('-');
-      const [reqStart, reqEnd] = [startTime, endTime].map(t => parseInt(t.replace(':', ''), 10));
-      // Check if requested slot fits within any available slot
-      const weekday = new Date(date).toLocaleString('en-US', { weekday: 'long' }).toLowerCase();
-      const daySchedule = doctor.availability.find(s => s.day.toLowerCase() === weekday);
-      if (!daySchedule) {
-        return res.status(409).json({ message: 'No available slots for this day' });
-      }
-      let fits = false;
-      for (const slot of daySchedule.slots) {
-        const [slotStart, slotEnd] = [slot.startTime, slot.endTime].map(t => parseInt(t.replace(':', ''), 10));
-        if (reqStart >= slotStart && reqEnd <= slotEnd) {
-          fits = true;
-          break;
-        }
+      const draft = new Appointment({ doctorId: doctor._id, patientId: req.user.id, status: 'draft' });
+      const draftErrors = applyDraftFields(draft, req.body, doctor);
+      if (draftErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: draftErrors });
+      }
+      await draft.save();
+      res.status(201).json(formatDraft(draft));
+    } catch (error) {
+      console.error('createDraft error:', error);
+      res.status(500).json({ message: 'Error saving draft' });
+    }
+  },
+
+  // The patient's unfinished booking drafts, most recently edited first
+  async getDrafts(req, res) {
+    try {
+      const drafts = await Appointment.find({ patientId: req.user.id, status: 'draft' })
+        .sort({ updatedAt: -1 });
+      res.json({ drafts: drafts.map(formatDraft) });
+    } catch (error) {
+      console.error('getDrafts error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Continue filling in a draft
+  async updateDraft(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
       }
-      if (!fits) {
-        return res.status(409).json({ message: 'Requested time slot does not fit in available slots' });
+      const draft = mongoose.isValidObjectId(req.params.id)
+        ? await Appointment.findOne({ _id: req.params.id, patientId: req.user.id, status: 'draft' })
+        : null;
+      if (!draft) {
+        return res.status(404).json({ message: 'Draft not found' });
       }
-      // Check for overlap with existing appointments
-      const appointments = await Appointment.find({ doctorId, date, status: { $nin: ['cancelled'] } });
-      for (const appt of appointments) {
-        const [apptStart, apptEnd] = [appt.startTime, appt.endTime].map(t => parseInt(t.replace(':', ''), 10));
-        if (!(reqEnd <= apptStart || reqStart >= apptEnd)) {
-          return res.status(409).json({ message: 'Time slot overlaps with another appointment' });
+      // Switching doctor drops the consultation type, which belongs to the old one
+      if (req.body.doctorId && !draft.doctorId.equals(req.body.doctorId)) {
+        draft.doctorId = req.body.doctorId;
+        draft.consultationType = undefined;
+      }
+      const doctor = await Doctor.findById(draft.doctorId);
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor not found' });
+      }
+      const draftErrors = applyDraftFields(draft, req.body, doctor);
+      if (draftErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: draftErrors });
+      }
+      await draft.save();
+      res.json(formatDraft(draft));
+    } catch (error) {
+      console.error('updateDraft error:', error);
+      res.status(500).json({ message: 'Error saving draft' });
+    }
+  },
+
+  // Middleware for finalizing: loads the draft and fills the request body
+  // from it, so the booking validators check the draft's saved choices.
+  // Fields sent with the request override the saved ones.
+  async loadDraftForFinalize(req, res, next) {
+    try {
+      const draft = mongoose.isValidObjectId(req.params.id)
+        ? await Appointment.findOne({ _id: req.params.id, patientId: req.user.id, status: 'draft' })
+        : null;
+      if (!draft) {
+        return res.status(404).json({ message: 'Draft not found' });
+      }
+      // The draft's owner is the patient; patientId can't be overridden here
+      const { patientId, ...overrides } = req.body || {};
+      req.draft = draft;
+      req.body = { ...getDraftBookingFields(draft), ...overrides };
+      next();
+    } catch (error) {
+      next(error);
+    }
+  },
+
+  // Book the appointment a draft describes, after the full booking checks
+  async finalizeDraft(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      // Optional while drafting, but a booked appointment needs one
+      if (!req.body.reason) {
+        return res.status(400).json({ message: 'Validation Error', errors: { reason: 'Reason is required' } });
+      }
+      const verificationError = getVerificationError(req.user);
+      if (verificationError) {
+        return res.status(403).json(verificationError);
+      }
+      const booking = await checkBooking(req, res, req.user.id);
+      if (!booking) {
+        return;
+      }
+      const reservation = await reserveBookingCapacity(res, booking.doctor);
+      if (!reservation) {
+        return;
+      }
+      const { draft } = req;
+      // The appointment replaces its draft and books its referral together or
+      // not at all
+      let appointment;
+      try {
+        appointment = await DatabaseService.withTransaction(async (session) => {
+          // Two finalize requests for the same draft: only the one that removes it books
+          const { deletedCount } = await Appointment.deleteOne({ _id: draft._id, status: 'draft' }, { session });
+          if (deletedCount === 0) {
+            return null;
+          }
+          const created = buildAppointment(req.body, booking, req.user.id);
+          created.symptoms = draft.symptoms;
+          await AppointmentService.saveBooking(created, session);
+          if (req.body.referralId) {
+            await ReferralService.markReferralBooked(req.body.referralId, created._id, { session });
+          }
+          return created;
+        });
+      } catch (error) {
+        await BookingThrottleService.releaseBooking(reservation);
+        if (await respondIfSlotTaken(res, error, booking, req.body)) {
+          return;
         }
+        throw error;
+      }
+      if (!appointment) {
+        await BookingThrottleService.releaseBooking(reservation);
+        return res.status(409).json({ message: 'This draft has already been finalized or discarded', code: 'DRAFT_GONE' });
       }
-      const appointment = new Appointment({
-        doctorId,
-        patientId: patientId || req.user.id,
-        date,
-        startTime,
-        endTime,
+      await announceBooking(appointment);
+      res.status(201).json({ ...formatBookedAppointment(appointment), draftId: draft._id });
+    } catch (error) {
+      console.error('finalizeDraft error:', error);
+      res.status(500).json({ message: 'Error creating appointment' });
+    }
+  },
+
+  // Throw away a draft
+  async deleteDraft(req, res) {
+    try {
+      const { deletedCount } = mongoose.isValidObjectId(req.params.id)
+        ? await Appointment.deleteOne({ _id: req.params.id, patientId: req.user.id, status: 'draft' })
+        : { deletedCount: 0 };
+      if (deletedCount === 0) {
+        return res.status(404).json({ message: 'Draft not found' });
+      }
+      res.json({ message: 'Draft discarded' });
+    } catch (error) {
+      console.error('deleteDraft error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Run every booking check without saving and summarize what would be booked
+  async previewAppointment(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const verificationError = getVerificationError(req.user);
+      if (verificationError) {
+        return res.status(403).json(verificationError);
+      }
+      const patientId = getBookingPatientId(req, res);
+      if (!patientId) {
+        return;
+      }
+      const booking = await checkBooking(req, res, patientId);
+      if (!booking) {
+        return;
+      }
+      const { date, type } = req.body;
+      const { doctor, startTime, endTime, durationMinutes, consultationType, fee, price } = booking;
+      await doctor.populate('userId', 'firstName lastName');
+      res.json({
+        doctor: {
+          id: doctor._id,
+          name: doctor.userId ? `Dr. ${doctor.userId.firstName} ${doctor.userId.lastName}` : null,
+          specializations: doctor.specializations,
+          clinicLocation: type === 'in-person' && doctor.clinicLocation
+            ? { address: doctor.clinicLocation.address, city: doctor.clinicLocation.city, postalCode: doctor.clinicLocation.postalCode }
+            : undefined
+        },
+        slot: {
+          date,
+          startTime,
+          endTime,
+          durationMinutes,
+          startsAt: getAppointmentStart(date, startTime, AppointmentService.getScheduleTimeZone(doctor)),
+          timeZone: AppointmentService.getScheduleTimeZone(doctor)
+        },
         type,
-        reason,
-        status: 'pending'
+        consultationType: consultationType
+          ? { id: consultationType._id, name: consultationType.name }
+          : null,
+        // The platform commission comes out of the doctor's share and no tax
+        // is charged, so the patient pays the fee
+        price: {
+          baseFee: price.baseFee,
+          multiplier: price.multiplier,
+          rule: price.rule,
+          fee,
+          currency: doctor.currency || 'EUR',
+          total: fee,
+          formattedTotal: formatCurrency(fee, doctor.currency || 'EUR')
+        },
+        policy: {
+          // 'auto' when the doctor confirms bookings automatically
+          confirmationMode: doctor.autoAcceptBookings ? 'auto' : 'manual',
+          payBeforeConfirm: config.payments.payBeforeConfirm,
+          unpaidExpiryMinutes: config.payments.payBeforeConfirm ? config.payments.unpaidExpiryMinutes : null,
+          maxReschedules: SettingsService.getSetting('appointments.maxReschedules'),
+          lateRescheduleFee: AppointmentService.getLateRescheduleAmount(fee) > 0
+            ? {
+              amount: AppointmentService.getLateRescheduleAmount(fee),
+              currency: doctor.currency || 'EUR',
+              formattedAmount: formatCurrency(AppointmentService.getLateRescheduleAmount(fee), doctor.currency || 'EUR'),
+              freeHoursBefore: config.appointments.rescheduleFee.freeHoursBefore
+            }
+            : null,
+          cancellation: 'Free cancellation before the appointment'
+        }
       });
-      await appointment.save();
+    } catch (error) {
+      console.error('previewAppointment error:', error);
+      res.status(500).json({ message: 'Error previewing appointment' });
+    }
+  },
+
+  // Book the slot offered with a doctor recommendation
+  async createFromRecommendation(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const verificationError = getVerificationError(req.user);
+      if (verificationError) {
+        return res.status(403).json(verificationError);
+      }
+      const { bookingToken, referralId } = req.body;
+      const { payload, error } = verifyBookingToken(bookingToken);
+      if (error) {
+        return res.status(400).json({
+          message: error === 'expired'
+            ? 'This booking offer has expired. Please request new recommendations.'
+            : 'Invalid booking token',
+          code: error === 'expired' ? 'BOOKING_TOKEN_EXPIRED' : 'BOOKING_TOKEN_INVALID'
+        });
+      }
+      // The offered slot goes through the same checks as booking it directly:
+      // booking window, schedule, language, daily cap, overlaps and rooms.
+      // The patient is always the caller.
+      const { patientId, ...fields } = req.body;
+      req.body = {
+        ...fields,
+        doctorId: payload.doctorId,
+        date: payload.date,
+        timeSlot: `${payload.startTime}-${payload.endTime}`
+      };
+      const booking = await checkBooking(req, res, req.user.id);
+      if (!booking) {
+        return;
+      }
+      const reservation = await reserveBookingCapacity(res, booking.doctor);
+      if (!reservation) {
+        return;
+      }
+      // The appointment and its referral are booked together or not at all
+      let appointment;
+      try {
+        appointment = await DatabaseService.withTransaction(async (session) => {
+          const created = buildAppointment(req.body, booking, req.user.id);
+          created.symptoms = payload.symptoms;
+          await AppointmentService.saveBooking(created, session);
+          if (referralId) {
+            await ReferralService.markReferralBooked(referralId, created._id, { session });
+          }
+          return created;
+        });
+      } catch (error) {
+        await BookingThrottleService.releaseBooking(reservation);
+        if (await respondIfSlotTaken(res, error, booking, req.body)) {
+          return;
+        }
+        throw error;
+      }
+      await announceBooking(appointment);
       res.status(201).json({
-        id: appointment._id,
-        doctorId: appointment.doctorId,
-        patientId: appointment.patientId,
-        date: appointment.date,
-        startTime: appointment.startTime,
-        endTime: appointment.endTime,
-        type: appointment.type,
-        reason: appointment.reason,
-        status: appointment.status,
-        createdAt: appointment.createdAt,
-        updatedAt: appointment.updatedAt
+        ...formatBookedAppointment(appointment),
+        symptoms: appointment.symptoms
       });
     } catch (error) {
-      console.error('createAppointment error:', error);
+      console.error('createFromRecommendation error:', error);
       res.status(500).json({ message: 'Error creating appointment' });
     }
   },
@@ -81,14 +794,24 @@ const AppointmentHandler = {
       const query = {};
       if (doctorId) query.doctorId = doctorId;
       else query.$or = [{ patientId: req.user.id }, { doctorId: req.user.id }];
-      if (status) query.status = status;
+      // Drafts are private to the patient and listed by GET /appointments/drafts
+      query.status = status && status !== 'draft' ? status : { $ne: 'draft' };
       if (type) query.type = type;
       const skip = (parseInt(page) - 1) * parseInt(limit);
       const [appointments, total] = await Promise.all([
         Appointment.find(query).sort({ date: -1 }).skip(skip).limit(parseInt(limit)),
         Appointment.countDocuments(query)
       ]);
-      res.json({ appointments, total, page: parseInt(page), pages: Math.ceil(total / limit) });
+      const capabilities = await AppointmentService.getCapabilitiesForAppointments(appointments);
+      res.json({
+        appointments: appointments.map(appointment => ({
+          ...appointment.toJSON(),
+          capabilities: capabilities.get(appointment._id.toString())
+        })),
+        total,
+        page: parseInt(page),
+        pages: Math.ceil(total / limit)
+      });
     } catch (error) {
       console.error('getAppointments error:', error);
       res.status(500).json({ message: 'Server error' });
@@ -98,21 +821,105 @@ const AppointmentHandler = {
   // Get appointment by ID
   async getAppointment(req, res) {
     try {
-      const { id } = req.params;
-      const appointment = await Appointment.findById(id);
-      if (!appointment) {
+      // Only allow doctor or patient to view
+      const viewable = await loadViewableAppointment(req, res);
+      if (!viewable) return;
+      const { appointment, role } = viewable;
+      const [capabilities, privateNotes] = await Promise.all([
+        AppointmentService.getCapabilitiesForAppointments([appointment]),
+        getPrivateNotes(appointment, role)
+      ]);
+      res.json({
+        ...appointment.toJSON(),
+        ...(privateNotes !== undefined ? { privateNotes } : {}),
+        capabilities: capabilities.get(appointment._id.toString())
+      });
+    } catch (error) {
+      console.error('getAppointment error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Look up a booking by the confirmation code the patient shows at check-in.
+  // Codes of appointments the user may not see are reported as not found.
+  async getAppointmentByCode(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const appointment = await Appointment.findOne({
+        confirmationCode: req.params.code.toUpperCase(),
+        status: { $ne: 'draft' }
+      });
+      const role = appointment && await AppointmentStatusService.getActorRole(appointment, req.user);
+      if (!role) {
         return res.status(404).json({ message: 'Appointment not found' });
       }
-      // Only allow doctor or patient to view
-      if (
-        appointment.patientId.toString() !== req.user.id &&
-        appointment.doctorId.toString() !== req.user.id
-      ) {
-        return res.status(403).json({ message: 'Forbidden' });
+      const [patient, privateNotes] = await Promise.all([
+        User.findById(appointment.patientId).select('firstName lastName'),
+        getPrivateNotes(appointment, role)
+      ]);
+      res.json({
+        ...appointment.toJSON(),
+        ...(privateNotes !== undefined ? { privateNotes } : {}),
+        patient: patient && { _id: patient._id, firstName: patient.firstName, lastName: patient.lastName }
+      });
+    } catch (error) {
+      console.error('getAppointmentByCode error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Everything the consult screen needs in one call: the appointment, a page
+  // of chat history, notes, attachments with presigned links, intake answers
+  // and a patient summary. Only the appointment's patient and doctor get it.
+  async getAppointmentContext(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
       }
-      res.json(appointment);
+      const viewable = await loadViewableAppointment(req, res);
+      if (!viewable) return;
+      const { appointment, role } = viewable;
+      const chatPage = parseInt(req.query.chatPage, 10) || 1;
+      const chatLimit = parseInt(req.query.chatLimit, 10) || 50;
+
+      const [capabilities, privateNotes, chat, documents, patient] = await Promise.all([
+        AppointmentService.getCapabilitiesForAppointments([appointment]),
+        getPrivateNotes(appointment, role),
+        ChatService.getMessagePage(appointment._id, chatPage, chatLimit),
+        DocumentService.getAppointmentDocuments(appointment._id, { includeKeys: true }),
+        getPatientSummary(appointment)
+      ]);
+      // Each presigned link is logged like a download. Documents not yet
+      // found clean by the malware scan get no link.
+      const access = { userId: req.user.id, role: req.user.role, ip: req.ip, userAgent: req.get('user-agent') };
+      const attachments = await Promise.all(documents.map(async document => {
+        const { key, ...details } = document.toJSON();
+        const url = ScanService.isServable(document) ? await DocumentService.getLoggedDownloadUrl(document, access) : null;
+        return { ...details, url };
+      }));
+
+      res.set('Cache-Control', 'no-store');
+      res.json({
+        appointment: {
+          ...appointment.toJSON(),
+          capabilities: capabilities.get(appointment._id.toString())
+        },
+        chat,
+        notes: {
+          patientVisibleNotes: appointment.patientVisibleNotes || null,
+          ...(privateNotes !== undefined ? { privateNotes } : {}),
+          disposition: appointment.disposition || null
+        },
+        attachments,
+        intake: getSubmittedIntake(appointment),
+        patient
+      });
     } catch (error) {
-      console.error('getAppointment error:', error);
+      console.error('getAppointmentContext error:', error);
       res.status(500).json({ message: 'Server error' });
     }
   },
@@ -120,44 +927,87 @@ const AppointmentHandler = {
   // Update appointment status
   async updateAppointmentStatus(req, res) {
     try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
       const { id } = req.params;
-      const { status } = req.body;
+      const { status, disposition, reason, cancellationCategory } = req.body;
       const appointment = await Appointment.findById(id);
       if (!appointment) {
         return res.status(404).json({ message: 'Appointment not found' });
       }
-      // Only doctor or patient can update
-      if (
-        appointment.patientId.toString() !== req.user.id &&
-        appointment.doctorId.toString() !== req.user.id
-      ) {
+      // Which changes each participant may make is up to the status service
+      const actor = await AppointmentStatusService.getActorRole(appointment, req.user);
+      if (!actor) {
         return res.status(403).json({ message: 'Forbidden' });
       }
-      appointment.status = status;
-      await appointment.save();
-      res.json(appointment);
+      const dispositionError = AppointmentService.getDispositionError(status, disposition)
+        || AppointmentService.getCancellationCategoryError(status, cancellationCategory);
+      if (dispositionError) {
+        return res.status(400).json({ message: dispositionError });
+      }
+      const updated = await AppointmentStatusService.transitionStatus(appointment, status, {
+        actor,
+        userId: req.user.id,
+        reason,
+        set: {
+          ...(disposition && { disposition }),
+          ...(cancellationCategory && { cancellationCategory })
+        }
+      });
+      if (status === 'confirmed') {
+        notificationService.sendAppointmentConfirmation(updated)
+          .catch(err => console.error('Appointment confirmation notification error:', err));
+      }
+      if (status === 'cancelled' && actor === 'doctor') {
+        notificationService.sendDoctorCancellationNotice(updated)
+          .catch(err => console.error('Doctor cancellation notice error:', err));
+      }
+      if (status === 'completed' && config.surveys.enabled) {
+        notificationService.sendSurveyInvitation(updated)
+          .catch(err => console.error('Survey invitation error:', err));
+      }
+      res.json(updated);
     } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message, code: error.errorCode });
+      }
       console.error('updateAppointmentStatus error:', error);
       res.status(500).json({ message: 'Server error' });
     }
   },
 
-  // Update appointment notes (doctor only)
+  // Update appointment notes (doctor only). notes is the older name for
+  // patientVisibleNotes; fields left out keep their current value.
   async updateAppointmentNotes(req, res) {
     try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
       const { id } = req.params;
-      const { notes } = req.body;
-      const appointment = await Appointment.findById(id);
+      const { notes, privateNotes } = req.body;
+      const patientVisibleNotes = req.body.patientVisibleNotes !== undefined ? req.body.patientVisibleNotes : notes;
+      const appointment = await Appointment.findById(id).select('+privateNotes');
       if (!appointment) {
         return res.status(404).json({ message: 'Appointment not found' });
       }
       // Only doctor can update notes
-      if (appointment.doctorId.toString() !== req.user.id) {
+      if ((await AppointmentStatusService.getActorRole(appointment, req.user)) !== 'doctor') {
         return res.status(403).json({ message: 'Forbidden' });
       }
-      appointment.notes = notes;
+      if (patientVisibleNotes !== undefined) {
+        appointment.patientVisibleNotes = patientVisibleNotes;
+        // Drop the pre-split field so it can't shadow the new notes
+        appointment.set('notes', undefined, { strict: false });
+      }
+      if (privateNotes !== undefined) appointment.privateNotes = privateNotes;
       await appointment.save();
-      res.json(appointment);
+      res.json({
+        ...appointment.toJSON(),
+        privateNotes: appointment.privateNotes || null
+      });
     } catch (error) {
       console.error('updateAppointmentNotes error:', error);
       res.status(500).json({ message: 'Server error' });
@@ -173,7 +1023,7 @@ const AppointmentHandler = {
         return res.status(404).json({ message: 'Doctor not found' });
       }
       // Find the weekday
-      const weekday = new Date(date).toLocaleString('en-US', { weekday: 'long' }).toLowerCase();
+      const weekday = getWeekday(date);
       const daySchedule = doctor.availability.find(s => s.day.toLowerCase() === weekday);
       if (!daySchedule) {
         return res.json({ slots: [] });
@@ -195,65 +1045,196 @@ const AppointmentHandler = {
   // Reschedule an appointment
   async rescheduleAppointment(req, res) {
     try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
       const { id } = req.params;
-      const { date, timeSlot } = req.body;
+      const { date, timeSlot, paymentMethod } = req.body;
       const appointment = await Appointment.findById(id);
       if (!appointment) {
         return res.status(404).json({ message: 'Appointment not found' });
       }
-      if (appointment.status === 'cancelled') {
-        return res.status(409).json({ message: 'Cannot reschedule a cancelled appointment' });
+      if (AppointmentStatusService.isFinalStatus(appointment.status)) {
+        return res.status(409).json({ message: `Cannot reschedule a ${appointment.status} appointment` });
       }
-      if (
-        appointment.patientId.toString() !== req.user.id &&
-        appointment.doctorId.toString() !== req.user.id
-      ) {
+      const actor = await AppointmentStatusService.getActorRole(appointment, req.user);
+      if (!actor) {
         return res.status(403).json({ message: 'Forbidden' });
       }
+      const isPatient = actor === 'patient';
+      const isAdmin = req.user.role === 'admin';
+      // Patients get a limited number of reschedules per appointment; admins can override
+      const maxReschedules = SettingsService.getSetting('appointments.maxReschedules');
+      if (isPatient && !isAdmin && appointment.rescheduleCount >= maxReschedules) {
+        return res.status(409).json({
+          message: `This appointment has already been rescheduled ${appointment.rescheduleCount} times. Please cancel and book a new appointment.`,
+          code: 'RESCHEDULE_LIMIT_REACHED'
+        });
+      }
       // Parse requested slot
       const [startTime, endTime] = timeSlot.split('-');
-      const [reqStart, reqEnd] = [startTime, endTime].map(t => parseInt(t.replace(':', ''), 10));
       // Check if requested slot fits within any available slot
       const doctor = await Doctor.findById(appointment.doctorId);
-      const weekday = new Date(date).toLocaleString('en-US', { weekday: 'long' }).toLowerCase();
+      const windowError = AppointmentService.getBookingWindowError(doctor, date);
+      if (windowError) {
+        return res.status(400).json(windowError);
+      }
+      const weekday = getWeekday(date);
       const daySchedule = doctor.availability.find(s => s.day.toLowerCase() === weekday);
       if (!daySchedule) {
-        return res.status(409).json({ message: 'No available slots for this day' });
-      }
-      let fits = false;
-      for (const slot of daySchedule.slots) {
-        const [slotStart, slotEnd] = [slot.startTime, slot.endTime].map(t => parseInt(t.replace(':', ''), 10));
-        if (reqStart >= slotStart && reqEnd <= slotEnd) {
-          fits = true;
-          break;
+        return res.status(409).json({ message: 'No available slots for this day', code: 'OUTSIDE_DOCTOR_AVAILABILITY' });
+      }
+      if (!AvailabilityService.fitsDaySchedule(doctor, daySchedule, startTime, endTime)) {
+        return res.status(409).json({ message: 'Requested time slot does not fit in available slots', code: 'OUTSIDE_DOCTOR_AVAILABILITY' });
+      }
+      // The new time must still offer the language agreed at booking
+      if (appointment.language) {
+        const doctorUser = await User.findById(doctor.userId).select('languages');
+        const languages = AvailabilityService.getLanguagesAt(doctor, daySchedule, startTime, endTime, appointment.type, doctorUser && doctorUser.languages);
+        if (!AvailabilityService.offersLanguage(languages, appointment.language)) {
+          return res.status(409).json({
+            message: `Consultations at this time are offered in ${languages.join(', ')}, not ${appointment.language}`,
+            code: 'LANGUAGE_NOT_OFFERED',
+            languages
+          });
         }
       }
-      if (!fits) {
-        return res.status(409).json({ message: 'Requested time slot does not fit in available slots' });
+      if (!AppointmentService.isWithinClinicHours(doctor, date, startTime, endTime, appointment.type)) {
+        return res.status(409).json({ message: 'Requested time is outside clinic opening hours', code: 'OUTSIDE_CLINIC_HOURS' });
       }
-      // Check for overlap with existing appointments
+      // Check for overlap with existing appointments, buffers included
       const appointments = await Appointment.find({ doctorId: appointment.doctorId, date, status: { $nin: ['cancelled'] }, _id: { $ne: id } });
+      if (AvailabilityService.isAtDailyCap(doctor, appointments)) {
+        return res.status(409).json({
+          message: `This doctor takes at most ${doctor.maxAppointmentsPerDay} appointments a day and this day is full`,
+          code: 'DAILY_LIMIT_REACHED'
+        });
+      }
       for (const appt of appointments) {
-        const [apptStart, apptEnd] = [appt.startTime, appt.endTime].map(t => parseInt(t.replace(':', ''), 10));
-        if (!(reqEnd <= apptStart || reqStart >= apptEnd)) {
+        // Lapsed holds and expired unpaid bookings no longer occupy the slot
+        if (!AppointmentService.isBlockingAppointment(appt)) continue;
+        if (AvailabilityService.conflictsWithAppointment(doctor, timeToMinutes(startTime), timeToMinutes(endTime), appointment.type, appt)) {
           return res.status(409).json({ message: 'Time slot overlaps with another appointment' });
         }
       }
-      appointment.date = date;
-      appointment.startTime = startTime;
-      appointment.endTime = endTime;
-      appointment.status = 'pending';
-      await appointment.save();
-      res.json(appointment);
+      if (!(await AppointmentService.hasClinicRoomAvailable(doctor, date, startTime, endTime, appointment.type, { excludeId: appointment._id }))) {
+        return res.status(409).json({ message: 'All consultation rooms at the clinic are booked at this time', code: 'CLINIC_AT_CAPACITY' });
+      }
+      // Late reschedules by the patient may cost a fee, charged before the move
+      const rescheduleFee = AppointmentService.getRescheduleFee(appointment, { actor, currency: doctor.currency });
+      const collectFee = rescheduleFee.amount > 0 && rescheduleFee.collect;
+      if (collectFee && !paymentMethod) {
+        return res.status(402).json({
+          message: `Rescheduling within ${rescheduleFee.freeHoursBefore} hours of the appointment costs ${rescheduleFee.formattedAmount}. Choose a payment method to continue.`,
+          code: 'RESCHEDULE_FEE_REQUIRED',
+          rescheduleFee
+        });
+      }
+      // The fee and its payment are recorded with the move, or not at all
+      const payment = await DatabaseService.withTransaction(async (session) => {
+        let created = null;
+        if (collectFee) {
+          created = new Payment({
+            appointmentId: appointment._id,
+            patientId: appointment.patientId,
+            doctorId: appointment.doctorId,
+            amount: rescheduleFee.amount,
+            currency: rescheduleFee.currency,
+            purpose: 'reschedule-fee',
+            method: paymentMethod,
+            status: 'pending',
+            transactionId: `txn_${uuidv4()}`
+          });
+          await created.save({ session });
+        }
+        if (rescheduleFee.amount > 0) {
+          appointment.rescheduleFees.push({
+            amount: rescheduleFee.amount,
+            currency: rescheduleFee.currency,
+            hoursBefore: rescheduleFee.hoursBefore,
+            status: created ? 'pending' : 'unpaid',
+            paymentId: created ? created._id : undefined
+          });
+        }
+        appointment.date = date;
+        appointment.startTime = startTime;
+        appointment.endTime = endTime;
+        appointment.timeZone = AppointmentService.getScheduleTimeZone(doctor);
+        // Reminders already sent were for the old time
+        appointment.reminderSent = false;
+        appointment.remindersSent = { patient: [], doctor: [] };
+        appointment.scheduleConflictNotifiedAt = undefined;
+        if (isPatient) appointment.rescheduleCount += 1;
+        await appointment.save({ session });
+        return created;
+      });
+      // The new time needs confirming again
+      const updated = appointment.status === 'pending'
+        ? appointment
+        : await AppointmentStatusService.transitionStatus(appointment, 'pending', {
+          actor,
+          userId: req.user.id,
+          reason: 'Rescheduled'
+        });
+      res.json({
+        ...updated.toJSON(),
+        rescheduleFee: {
+          amount: rescheduleFee.amount,
+          currency: rescheduleFee.currency,
+          formattedAmount: rescheduleFee.formattedAmount,
+          status: rescheduleFee.amount > 0 ? (payment ? 'pending' : 'unpaid') : null,
+          payment: payment
+            ? { id: payment._id, amount: payment.amount, currency: payment.currency, status: payment.status, paymentMethod: payment.method, transactionId: payment.transactionId }
+            : null
+        }
+      });
     } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message, code: error.errorCode });
+      }
       console.error('rescheduleAppointment error:', error);
       res.status(500).json({ message: 'Server error' });
     }
   },
 
-  // Get available slots for a doctor for a date range
+  // What rescheduling an appointment would cost right now
+  async getRescheduleFee(req, res) {
+    try {
+      const appointment = await Appointment.findById(req.params.id);
+      if (!appointment) {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+      const actor = await AppointmentStatusService.getActorRole(appointment, req.user);
+      if (!actor) {
+        return res.status(403).json({ message: 'Forbidden' });
+      }
+      if (AppointmentStatusService.isFinalStatus(appointment.status)) {
+        return res.status(409).json({ message: `Cannot reschedule a ${appointment.status} appointment` });
+      }
+      const doctor = await Doctor.findById(appointment.doctorId).select('currency');
+      const rescheduleFee = AppointmentService.getRescheduleFee(appointment, { actor, currency: doctor && doctor.currency });
+      const freeUntil = new Date(getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone).getTime() - rescheduleFee.freeHoursBefore * 60 * 60 * 1000);
+      res.json({
+        ...rescheduleFee,
+        // Only the patient's own reschedules are charged
+        freeUntil: actor === 'patient' ? freeUntil : null
+      });
+    } catch (error) {
+      console.error('getRescheduleFee error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Get available slots for a doctor for a date range. With a duration, only
+  // start times that fit a consultation of that length are returned.
   async getAvailableSlotsForRange(req, res) {
     try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+
       const { doctorId, startDate, endDate } = req.query;
       const doctor = await Doctor.findById(doctorId);
       if (!doctor) {
@@ -264,47 +1245,66 @@ const AppointmentHandler = {
       if (isNaN(start) || isNaN(end) || start > end) {
         return res.status(400).json({ message: 'Invalid date range' });
       }
-      const results = [];
-      for (let d = new Date(start); d <= end; d.setDate(d.getDate() + 1)) {
-        const weekday = d.toLocaleString('en-US', { weekday: 'long' }).toLowerCase();
-        const daySchedule = doctor.availability.find(s => s.day.toLowerCase() === weekday);
-        const dateStr = d.toISOString().slice(0, 10);
-        if (!daySchedule) {
-          results.push({ date: dateStr, slots: [] });
-          continue;
-        }
-        const appointments = await Appointment.find({ doctorId, date: dateStr, status: { $nin: ['cancelled'] } });
-        // For each available slot, break it into 30-min intervals and filter out those overlapping with existing appointments
-        const booked = appointments.map(a => [a.startTime, a.endTime].map(t => parseInt(t.replace(':', ''), 10)));
-        const availableSlots = [];
-        for (const slot of daySchedule.slots) {
-          const [slotStart, slotEnd] = [slot.startTime, slot.endTime].map(t => parseInt(t.replace(':', ''), 10));
-          // Generate all possible 30-min sub-slots
-          let current = slotStart;
-          while (current < slotEnd) {
-            let next = current + 30;
-            if (next > slotEnd) break;
-            // Check overlap with booked
-            let overlap = false;
-            for (const [bStart, bEnd] of booked) {
-              if (!(next <= bStart || current >= bEnd)) {
-                overlap = true;
-                break;
-              }
-            }
-            if (!overlap) {
-              // Format as HH:MM-HH:MM
-              const format = n => n.toString().padStart(4, '0');
-              const s = format(current);
-              const e = format(next);
-              availableSlots.push(`${s.slice(0,2)}:${s.slice(2)}-${e.slice(0,2)}:${e.slice(2)}`);
-            }
-            current = next;
-          }
+      // Longer visits keep the regular slot grid for start times, so a
+      // 60 minute visit can still start on the half hour
+      // Slots for a mode keep that mode's buffers around other bookings
+      const options = { type: req.query.type };
+      // Only slots offering the patient's language; unrestricted slots offer all the doctor's
+      const doctorUser = await User.findById(doctor.userId).select('languages');
+      options.doctorLanguages = doctorUser ? doctorUser.languages : [];
+      if (req.query.language) {
+        options.language = req.query.language;
+      }
+      if (req.query.consultationTypeId) {
+        const consultationType = doctor.consultationTypes.id(req.query.consultationTypeId);
+        if (!consultationType) {
+          return res.status(400).json({ message: 'Validation Error', errors: { consultationTypeId: 'Consultation type is not offered by this doctor' } });
         }
-        results.push({ date: dateStr, slots: availableSlots });
+        options.baseFee = consultationType.fee;
+        options.duration = consultationType.duration;
+        options.step = Math.min(options.duration, SettingsService.getSetting('appointments.slotDurationMinutes'));
+      }
+      if (req.query.duration) {
+        options.duration = parseInt(req.query.duration, 10);
+        options.step = Math.min(options.duration, SettingsService.getSetting('appointments.slotDurationMinutes'));
       }
-      res.json({ availability: results });
+      const days = await AvailabilityService.getSlotsForRange(doctor, start, end, options);
+      // Times are in the schedule zone; each slot also gets exact UTC
+      // instants and, when tz is given, its wall-clock time there
+      const { tz } = req.query;
+      const doctorTimeZone = AppointmentService.getScheduleTimeZone(doctor);
+      const withTimes = (date, slot) => {
+        const startsAt = getAppointmentStart(date, slot.startTime, doctorTimeZone);
+        const endsAt = getAppointmentStart(date, slot.endTime, doctorTimeZone);
+        const detail = { ...slot, startsAt: startsAt.toISOString(), endsAt: endsAt.toISOString() };
+        if (tz) {
+          const localStart = toZonedDateTime(startsAt, tz);
+          detail.local = {
+            date: localStart.date,
+            startTime: localStart.time,
+            endTime: toZonedDateTime(endsAt, tz).time
+          };
+        }
+        return detail;
+      };
+      const results = days.map(day => ({
+        date: day.date,
+        slots: day.slots
+          .filter(slot => !slot.isBooked && !slot.isHeld)
+          .map(slot => `${slot.startTime}-${slot.endTime}`),
+        // Every slot with its state, so clients can show held slots as tentatively taken
+        slotDetails: day.slots.map(slot => withTimes(day.date, slot))
+      }));
+      res.json({
+        duration: options.duration || SettingsService.getSetting('appointments.slotDurationMinutes'),
+        currency: doctor.currency || 'EUR',
+        lastBookableDate: AppointmentService.getLastBookableDate(doctor).toISOString().slice(0, 10),
+        timeZone: {
+          doctor: doctorTimeZone,
+          requested: tz || null
+        },
+        availability: results
+      });
     } catch (error) {
       console.error('getAvailableSlotsForRange error:', error);
       res.status(500).json({ message: 'Server error' });
@@ -315,25 +1315,32 @@ const AppointmentHandler = {
   async cancelAppointment(req, res) {
     try {
       const { id } = req.params;
-      const { reason } = req.body;
-      const appointment = await Appointment.findById(id);
+      const { reason, cancellationCategory } = req.body;
+      const categoryError = AppointmentService.getCancellationCategoryError('cancelled', cancellationCategory);
+      if (categoryError) {
+        return res.status(400).json({ message: 'Validation Error', errors: { cancellationCategory: categoryError } });
+      }
+      let appointment = await Appointment.findById(id);
       if (!appointment) {
         return res.status(404).json({ message: 'Appointment not found' });
       }
-      // Only doctor or patient can cancel
-      if (
-        appointment.patientId.toString() !== req.user.id &&
-        appointment.doctorId.toString() !== req.user.id
-      ) {
+      const actor = await AppointmentStatusService.getActorRole(appointment, req.user);
+      if (!actor) {
         return res.status(403).json({ message: 'Forbidden' });
       }
       if (appointment.status === 'cancelled') {
         return res.status(409).json({ message: 'Appointment already cancelled' });
       }
-      appointment.status = 'cancelled';
-      appointment.cancellationReason = reason;
-      appointment.cancellationTime = new Date();
-      await appointment.save();
+      appointment = await AppointmentStatusService.transitionStatus(appointment, 'cancelled', {
+        actor,
+        userId: req.user.id,
+        reason,
+        set: cancellationCategory ? { cancellationCategory } : {}
+      });
+      if (actor === 'doctor') {
+        notificationService.sendDoctorCancellationNotice(appointment)
+          .catch(err => console.error('Doctor cancellation notice error:', err));
+      }
       res.json({
         id: appointment._id,
         doctorId: appointment.doctorId,
@@ -345,14 +1352,247 @@ const AppointmentHandler = {
         reason: appointment.reason,
         status: appointment.status,
         cancellationReason: appointment.cancellationReason,
+        cancellationCategory: appointment.cancellationCategory,
         cancellationTime: appointment.cancellationTime,
+        cancelledBy: appointment.cancelledBy,
         createdAt: appointment.createdAt,
         updatedAt: appointment.updatedAt
       });
     } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message, code: error.errorCode });
+      }
       console.error('cancelAppointment error:', error);
       res.status(500).json({ message: 'Error cancelling appointment' });
     }
+  },
+
+  // Intake form for the appointment's specialty, with any answers already given
+  async getIntakeForm(req, res) {
+    try {
+      const appointment = await Appointment.findById(req.params.id);
+      if (!appointment || appointment.status === 'draft') {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+      if (!(await AppointmentService.isAppointmentParticipant(appointment, req.user))) {
+        return res.status(403).json({ message: 'Forbidden' });
+      }
+      const form = await IntakeService.getIntakeFormForAppointment(appointment);
+      if (!form && !getSubmittedIntake(appointment)) {
+        return res.status(404).json({ message: 'No intake form for this appointment' });
+      }
+      res.json({
+        form: form && {
+          id: form._id,
+          specialty: form.specialty,
+          title: form.title,
+          version: form.version,
+          questions: form.questions
+        },
+        intake: getSubmittedIntake(appointment),
+        canSubmit: !!form && appointment.patientId.toString() === req.user.id
+          && !AppointmentStatusService.isFinalStatus(appointment.status)
+      });
+    } catch (error) {
+      console.error('getIntakeForm error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Store the patient's intake answers; submitting again replaces them
+  async submitIntakeForm(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const appointment = await Appointment.findById(req.params.id);
+      if (!appointment || appointment.status === 'draft') {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+      if (appointment.patientId.toString() !== req.user.id) {
+        return res.status(403).json({ message: 'Only the patient can answer the intake form' });
+      }
+      if (AppointmentStatusService.isFinalStatus(appointment.status)) {
+        return res.status(409).json({ message: `Cannot answer the intake form of a ${appointment.status} appointment` });
+      }
+      const form = await IntakeService.getIntakeFormForAppointment(appointment);
+      if (!form) {
+        return res.status(404).json({ message: 'No intake form for this appointment' });
+      }
+      const { answers } = req.body;
+      const answerErrors = IntakeService.getIntakeAnswerErrors(form, answers);
+      if (answerErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: answerErrors });
+      }
+      const intake = IntakeService.buildIntake(form, answers);
+      await Appointment.updateOne({ _id: appointment._id }, { $set: { intake } });
+      res.json({ intake });
+    } catch (error) {
+      console.error('submitIntakeForm error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Refer the patient of an appointment to another doctor or specialty
+  async referAppointment(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const appointment = await Appointment.findById(req.params.id);
+      if (!appointment) {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+      const doctor = await Doctor.findOne({ userId: req.user.id });
+      if (!doctor || !appointment.doctorId.equals(doctor._id)) {
+        return res.status(403).json({ message: 'Only the appointment\'s doctor can refer its patient' });
+      }
+      if (appointment.status === 'cancelled') {
+        return res.status(409).json({ message: 'Cannot refer from a cancelled appointment' });
+      }
+
+      const { referredDoctorId, note, booking } = req.body;
+      let referredDoctor = null;
+      if (referredDoctorId) {
+        if (doctor._id.equals(referredDoctorId)) {
+          return res.status(400).json({ message: 'Validation Error', errors: { referredDoctorId: 'Cannot refer a patient to yourself' } });
+        }
+        referredDoctor = await Doctor.findById(referredDoctorId);
+        if (!referredDoctor) {
+          return res.status(404).json({ message: 'Referred doctor not found' });
+        }
+      }
+      const specialty = req.body.specialty || (referredDoctor && referredDoctor.specializations[0]);
+      if (!specialty) {
+        return res.status(400).json({ message: 'Validation Error', errors: { specialty: 'Specialty is required when no doctor is named' } });
+      }
+
+      // Optionally book the referred doctor straight away, with the same
+      // checks a patient booking goes through
+      let linkedAppointment = null;
+      let referral;
+      if (booking) {
+        const bookingRequest = {
+          user: req.user,
+          body: {
+            doctorId: referredDoctor._id.toString(),
+            patientId: appointment.patientId.toString(),
+            date: booking.date,
+            timeSlot: booking.timeSlot,
+            type: booking.type,
+            consultationTypeId: booking.consultationTypeId,
+            language: booking.language,
+            reason: note || `Referral for ${specialty}`
+          }
+        };
+        const checked = await checkBooking(bookingRequest, res, appointment.patientId.toString());
+        if (!checked) {
+          return;
+        }
+        const reservation = await reserveBookingCapacity(res, checked.doctor);
+        if (!reservation) {
+          return;
+        }
+        // The appointment and the referral it follows are saved together or not at all
+        try {
+          ({ linkedAppointment, referral } = await DatabaseService.withTransaction(async (session) => {
+            const created = buildAppointment(bookingRequest.body, checked, appointment.patientId);
+            created.symptoms = appointment.symptoms;
+            await AppointmentService.saveBooking(created, session);
+            const linkedReferral = new Referral({
+              appointmentId: appointment._id,
+              patientId: appointment.patientId,
+              referringDoctorId: doctor._id,
+              referredDoctorId: referredDoctor._id,
+              specialty,
+              note,
+              status: 'booked',
+              linkedAppointmentId: created._id
+            });
+            await linkedReferral.save({ session });
+            return { linkedAppointment: created, referral: linkedReferral };
+          }));
+        } catch (error) {
+          await BookingThrottleService.releaseBooking(reservation);
+          if (await respondIfSlotTaken(res, error, checked, bookingRequest.body)) {
+            return;
+          }
+          throw error;
+        }
+        await announceBooking(linkedAppointment);
+      } else {
+        referral = await Referral.create({
+          appointmentId: appointment._id,
+          patientId: appointment.patientId,
+          referringDoctorId: doctor._id,
+          referredDoctorId: referredDoctor ? referredDoctor._id : undefined,
+          specialty,
+          note
+        });
+      }
+
+      const recommendations = linkedAppointment
+        ? []
+        : await ReferralService.getRecommendedDoctors(referral, { symptoms: appointment.symptoms });
+      notificationService.sendReferralNotice(referral, recommendations, linkedAppointment)
+        .catch(err => console.error('Referral notification error:', err));
+
+      res.status(201).json({
+        ...referral.toJSON(),
+        linkedAppointment,
+        recommendations
+      });
+    } catch (error) {
+      console.error('referAppointment error:', error);
+      res.status(500).json({ message: 'Error creating referral' });
+    }
+  },
+
+  // The patient's referrals, with fresh recommendations for open ones
+  async getReferrals(req, res) {
+    try {
+      const { status } = req.query;
+      const query = { patientId: req.user.id };
+      if (status) query.status = status;
+      const referrals = await Referral.find(query)
+        .sort({ createdAt: -1 })
+        .populate({ path: 'referringDoctorId', select: 'userId specializations', populate: { path: 'userId', select: 'firstName lastName' } })
+        .populate('linkedAppointmentId', 'doctorId date startTime endTime type status');
+
+      const results = await Promise.all(referrals.map(async referral => ({
+        ...referral.toJSON(),
+        recommendations: referral.status === 'pending'
+          ? await ReferralService.getRecommendedDoctors({
+            ...referral.toObject(),
+            referringDoctorId: referral.referringDoctorId._id
+          })
+          : []
+      })));
+      res.json({ referrals: results });
+    } catch (error) {
+      console.error('getReferrals error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Patient declines a referral they don't intend to follow up
+  async declineReferral(req, res) {
+    try {
+      const referral = await Referral.findOneAndUpdate(
+        { _id: req.params.referralId, patientId: req.user.id, status: 'pending' },
+        { $set: { status: 'declined' } },
+        { new: true }
+      );
+      if (!referral) {
+        return res.status(404).json({ message: 'Open referral not found' });
+      }
+      res.json(referral);
+    } catch (error) {
+      console.error('declineReferral error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
   }
 };
 
@@ -1,9 +1,19 @@
 const User = require('../models/user.model');
 const Session = require('../models/session.model');
 const OTPService = require('../services/otp.service');
-const { generateToken, isValidEmail, isValidPhone, formatPhoneNumber } = require('../utils/helpers');
+const TokenService = require('../services/token.service');
+const { generateToken, isValidEmail } = require('../utils/helpers');
+const { normalizePhoneNumber } = require('../utils/phone');
+const { AppError } = require('../utils/error.handler');
 const logger = require('../utils/logger');
 
+// Phone identifiers are matched on the normalized national number, so
+// "06 12345678" and "+31612345678" find the same account
+const phoneLookupNumber = (identifier) => {
+  const normalized = normalizePhoneNumber(identifier);
+  return normalized ? normalized.number : identifier;
+};
+
 class AuthHandler {
   // Request OTP for login
   static async initiateLogin(req, res) {
@@ -19,7 +29,7 @@ class AuthHandler {
 
       // Determine if identifier is email or phone
       const type = isValidEmail(identifier) ? 'email' : 
-                  isValidPhone(identifier) ? 'phone' : null;
+                  normalizePhoneNumber(identifier) ? 'phone' : null;
 
       if (!type) {
         return res.status(400).json({ 
@@ -31,7 +41,7 @@ class AuthHandler {
       // Check if user exists
       const user = await User.findOne(
         type === 'email' ? { email: identifier } : 
-        { 'phone.number': identifier }
+        { 'phone.number': phoneLookupNumber(identifier) }
       );
 
       if (!user) {
@@ -83,7 +93,7 @@ class AuthHandler {
       // Find user
       const user = await User.findOne(
         type === 'email' ? { email: identifier } : 
-        { 'phone.number': identifier }
+        { 'phone.number': phoneLookupNumber(identifier) }
       );
 
       if (!user) {
@@ -112,6 +122,7 @@ class AuthHandler {
         lastActivity: new Date()
       });
       await session.save();
+      const refreshToken = await TokenService.issueRefreshToken(user._id, tokenId);
 
       // Update last login and save user
       user.lastLogin = new Date();
@@ -120,6 +131,7 @@ class AuthHandler {
       res.json({
         success: true,
         token,
+        refreshToken,
         sessionId: session._id,
         user: {
           id: user._id,
@@ -154,7 +166,7 @@ class AuthHandler {
 
       // Determine if identifier is email or phone
       const type = isValidEmail(identifier) ? 'email' : 
-                  isValidPhone(identifier) ? 'phone' : null;
+                  normalizePhoneNumber(identifier) ? 'phone' : null;
 
       if (!type) {
         return res.status(400).json({
@@ -166,7 +178,7 @@ class AuthHandler {
       // Find user
       const user = await User.findOne(
         type === 'email' ? { email: identifier } : 
-        { 'phone.number': identifier }
+        { 'phone.number': phoneLookupNumber(identifier) }
       );
 
       if (!user) {
@@ -212,7 +224,7 @@ class AuthHandler {
       // Find user
       const user = await User.findOne(
         type === 'email' ? { email: identifier } : 
-        { 'phone.number': identifier }
+        { 'phone.number': phoneLookupNumber(identifier) }
       );
 
       if (!user) {
@@ -259,16 +271,19 @@ class AuthHandler {
 
   // Update existing unverified user
   static async updateUnverifiedUser(existingUser, userData) {
-    const { firstName, lastName, role, address, email, phone } = userData;
+    const { firstName, lastName, role, address, email, phone, smsConsent } = userData;
 
     existingUser.firstName = firstName;
     existingUser.lastName = lastName;
     existingUser.role = role;
     existingUser.address = address;
+    if (typeof smsConsent === 'boolean') {
+      existingUser.setSmsConsent(smsConsent);
+    }
 
     // Update phone if changed
-    if (phone.number !== existingUser.phone.number) {
-      existingUser.phone = formatPhoneNumber(phone);
+    if (phone.number !== existingUser.phone.number || phone.countryCode !== existingUser.phone.countryCode) {
+      existingUser.phone = phone;
       existingUser.isPhoneVerified = false;
     }
 
@@ -301,16 +316,17 @@ class AuthHandler {
       
       const { 
         email, 
-        phone, 
+        phone: rawPhone, 
         firstName, 
         lastName, 
         role = 'patient',
-        address
+        address,
+        smsConsent
       } = req.body;
 
       // Validate required fields
-      if (!email || !phone || !firstName || !lastName) {
-        logger.warn('Missing required fields:', { email, phone, firstName, lastName });
+      if (!email || !rawPhone || !firstName || !lastName) {
+        logger.warn('Missing required fields:', { email, phone: rawPhone, firstName, lastName });
         return res.status(400).json({ 
           success: false, 
           error: 'Missing required fields' 
@@ -326,8 +342,10 @@ class AuthHandler {
         });
       }
 
-      if (!isValidPhone(phone.number)) {
-        logger.warn('Invalid phone number format:', { phone });
+      // Stored as country code + national number; local numbers get the default region
+      const phone = normalizePhoneNumber(rawPhone);
+      if (!phone) {
+        logger.warn('Invalid phone number format:', { phone: rawPhone });
         return res.status(400).json({ 
           success: false, 
           error: 'Invalid phone number format' 
@@ -352,7 +370,8 @@ class AuthHandler {
             role,
             address,
             email,
-            phone
+            phone,
+            smsConsent
           });
 
           if (!result.success) {
@@ -368,6 +387,8 @@ class AuthHandler {
               role: result.user.role,
               firstName: result.user.firstName,
               lastName: result.user.lastName,
+              phone: result.user.phone,
+              smsConsent: result.user.smsConsent,
               isEmailVerified: result.user.isEmailVerified,
               isPhoneVerified: result.user.isPhoneVerified
             }
@@ -384,7 +405,7 @@ class AuthHandler {
       // Create new user
       const user = new User({
         email,
-        phone: formatPhoneNumber(phone),
+        phone,
         firstName,
         lastName,
         role,
@@ -392,6 +413,7 @@ class AuthHandler {
         isEmailVerified: false,
         isPhoneVerified: false
       });
+      user.setSmsConsent(smsConsent === true);
 
       try {
         await user.save();
@@ -425,7 +447,9 @@ class AuthHandler {
           email: user.email,
           role: user.role,
           firstName: user.firstName,
-          lastName: user.lastName
+          lastName: user.lastName,
+          phone: user.phone,
+          smsConsent: user.smsConsent
         }
       });
     } catch (error) {
@@ -506,6 +530,91 @@ class AuthHandler {
     }
   }
 
+  // Send a code by SMS to verify the signed-in user's phone
+  static async sendPhoneOTP(req, res) {
+    try {
+      if (req.user.isPhoneVerified) {
+        return res.status(400).json({
+          success: false,
+          error: 'Phone is already verified'
+        });
+      }
+
+      const result = await OTPService.sendPhoneVerificationOTP(req.user);
+      if (!result.success) {
+        res.set('Retry-After', String(Math.max(1, Math.ceil((result.retryAfter - Date.now()) / 1000))));
+        return res.status(429).json({
+          success: false,
+          error: 'Too many verification codes requested. Please try again later.',
+          retryAfter: result.retryAfter
+        });
+      }
+
+      res.json({
+        success: true,
+        message: 'Verification code sent to your phone',
+        expiresAt: result.expiresAt
+      });
+    } catch (error) {
+      logger.error('Send phone OTP error:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to send verification code'
+      });
+    }
+  }
+
+  // Verify the signed-in user's phone with the code sent by SMS
+  static async verifyPhoneOTP(req, res) {
+    try {
+      if (req.user.isPhoneVerified) {
+        return res.json({
+          success: true,
+          message: 'Phone verified successfully'
+        });
+      }
+
+      const result = await OTPService.verifyPhoneVerificationOTP(req.user, String(req.body.otp));
+      if (!result.success) {
+        return res.status(400).json(result);
+      }
+
+      res.json(result);
+    } catch (error) {
+      logger.error('Verify phone OTP error:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to verify phone'
+      });
+    }
+  }
+
+  // Exchange a refresh token for a new access token and refresh token
+  static async refresh(req, res) {
+    try {
+      const { token, refreshToken } = await TokenService.rotateRefreshToken(req.body.refreshToken);
+
+      res.json({
+        success: true,
+        token,
+        refreshToken
+      });
+    } catch (error) {
+      if (error instanceof AppError) {
+        return res.status(error.statusCode).json({
+          success: false,
+          error: error.message,
+          code: error.errorCode
+        });
+      }
+      logger.error('Token refresh error:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to refresh token'
+      });
+    }
+  }
+
   // Logout from current device
   static async logout(req, res) {
     try {
@@ -529,6 +638,8 @@ class AuthHandler {
       session.isActive = false;
       session.loggedOutAt = new Date();
       await session.save();
+      await TokenService.revokeFamily(session.tokenId);
+      await TokenService.revokeAccessToken(req.tokenPayload);
 
       res.json({
         status: 'success',
@@ -560,6 +671,9 @@ class AuthHandler {
         }
       );
 
+      await TokenService.revokeUserRefreshTokens(req.user._id);
+      await TokenService.revokeAccessToken(req.tokenPayload);
+
       res.json({
         status: 'success',
         message: 'Logged out from all devices'
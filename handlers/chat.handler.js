@@ -1,38 +1,81 @@
 const Chat = require('../models/chat.model');
 const Message = require('../models/message.model');
 const Appointment = require('../models/appointment.model');
-const AWSService = require('../services/aws.service');
+const Doctor = require('../models/doctor.model');
+const User = require('../models/user.model');
+const MessageTemplate = require('../models/message.template.model');
+const config = require('../config/config');
+const { expandTemplate } = require('../services/message.template.service');
+const AppointmentService = require('../services/appointment.service');
+const ChatService = require('../services/chat.service');
+const BlockService = require('../services/block.service');
+const { handleUpload } = require('../services/upload.service');
+const { getFieldErrors } = require('../middleware/validation.middleware');
+
+// Check that the user may post to an appointment's chat. Returns the error
+// status and body, or null when allowed. Reading history isn't restricted.
+const getSendError = async (appointmentId, user) => {
+  const appointment = await Appointment.findById(appointmentId);
+  if (!appointment) {
+    return { status: 404, body: { message: 'Appointment not found' } };
+  }
+  if (!(await AppointmentService.isAppointmentParticipant(appointment, user))) {
+    return { status: 403, body: { message: 'Not a participant in this chat' } };
+  }
+
+  const doctor = await Doctor.findById(appointment.doctorId).select('verificationStatus status');
+  if (!AppointmentService.isChatOpenForDoctor(doctor)) {
+    return {
+      status: 403,
+      body: {
+        message: 'This doctor is no longer verified, so new messages cannot be sent. Earlier messages remain available.',
+        code: 'DOCTOR_NOT_VERIFIED'
+      }
+    };
+  }
+  // Either side gets the same neutral answer when the doctor blocked the patient
+  if (await BlockService.isBlocked(appointment.doctorId, appointment.patientId)) {
+    return { status: 403, body: BlockService.CHAT_BLOCKED_RESPONSE };
+  }
+
+  return null;
+};
+
+// Expand the sending doctor's template for the appointment. Returns the
+// message text, or the error status and body.
+const getTemplateContent = async (appointmentId, templateId, user) => {
+  const doctor = user.role === 'doctor' && await Doctor.findOne({ userId: user.id }).select('_id');
+  const appointment = doctor && await Appointment.findOne({ _id: appointmentId, doctorId: doctor._id });
+  if (!appointment) {
+    return { error: { status: 403, body: { message: 'Only the appointment\'s doctor can send templates' } } };
+  }
+  // Templates are private, so someone else's looks the same as a missing one
+  const template = await MessageTemplate.findOne({ _id: templateId, doctorId: doctor._id });
+  if (!template) {
+    return { error: { status: 404, body: { message: 'Template not found' } } };
+  }
+  const [patient, doctorUser] = await Promise.all([
+    User.findById(appointment.patientId).select('firstName lastName'),
+    User.findById(user.id).select('firstName lastName')
+  ]);
+  const content = expandTemplate(template.content, { appointment, patient, doctorUser }).trim();
+  if (!content || content.length > config.chat.maxMessageLength) {
+    return {
+      error: {
+        status: 400,
+        body: { message: 'Validation Error', errors: { templateId: `The expanded template must be between 1 and ${config.chat.maxMessageLength} characters` } }
+      }
+    };
+  }
+  return { content };
+};
 
 const ChatHandler = {
   async getChatMessages(req, res) {
     try {
       const { appointmentId } = req.params;
       const { page = 1, limit = 50 } = req.query;
-      const skip = (parseInt(page) - 1) * parseInt(limit);
-      const [messages, total] = await Promise.all([
-        Message.find({ chatId: appointmentId })
-          .populate('senderId', 'firstName lastName avatar')
-          .sort({ createdAt: 1 })
-          .skip(skip)
-          .limit(parseInt(limit)),
-        Message.countDocuments({ chatId: appointmentId })
-      ]);
-      res.json({
-        messages: messages.map(m => ({
-          id: m._id,
-          chatId: m.chatId,
-          senderId: m.senderId,
-          content: m.content,
-          type: m.type,
-          fileUrl: m.fileUrl,
-          read: m.read,
-          createdAt: m.createdAt,
-          updatedAt: m.updatedAt
-        })),
-        total,
-        page: parseInt(page),
-        pages: Math.ceil(total / limit)
-      });
+      res.json(await ChatService.getMessagePage(appointmentId, parseInt(page), parseInt(limit)));
     } catch (error) {
       console.error('getChatMessages error:', error);
       res.status(500).json({ message: 'Server error' });
@@ -41,8 +84,24 @@ const ChatHandler = {
 
   async sendMessage(req, res) {
     try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
       const { appointmentId } = req.params;
-      const { content, type } = req.body;
+      const sendError = await getSendError(appointmentId, req.user);
+      if (sendError) {
+        return res.status(sendError.status).json(sendError.body);
+      }
+      let { content, type } = req.body;
+      if (req.body.templateId) {
+        const expanded = await getTemplateContent(appointmentId, req.body.templateId, req.user);
+        if (expanded.error) {
+          return res.status(expanded.error.status).json(expanded.error.body);
+        }
+        content = expanded.content;
+        type = 'text';
+      }
       const senderId = req.user.id;
       // Create message
       const message = new Message({
@@ -73,16 +132,13 @@ const ChatHandler = {
   async uploadFile(req, res) {
     try {
       const { appointmentId } = req.params;
-      const senderId = req.user.id;
-      if (!req.file) {
-        return res.status(400).json({ message: 'No file uploaded' });
+      const sendError = await getSendError(appointmentId, req.user);
+      if (sendError) {
+        return res.status(sendError.status).json(sendError.body);
       }
-      // Upload file to S3 using the correct method
-      const fileUrl = await AWSService.uploadToS3(
-        req.file.buffer,
-        req.file.originalname,
-        req.file.mimetype
-      );
+      const senderId = req.user.id;
+      // Validate against the chat attachment limits and upload to S3
+      const fileUrl = await handleUpload(req.file, 'chatAttachment', senderId);
       // Create message
       const message = new Message({
         chatId: appointmentId,
@@ -107,11 +163,40 @@ const ChatHandler = {
         updatedAt: message.updatedAt
       });
     } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message });
+      }
       console.error('uploadFile error:', error);
       res.status(500).json({ message: 'Server error' });
     }
   },
 
+  // Either participant, or an admin, can remove a completed appointment's chat content
+  async purgeChat(req, res) {
+    try {
+      const appointment = await Appointment.findById(req.params.appointmentId);
+      if (!appointment) {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+      const isAdmin = req.user.role === 'admin';
+      if (!isAdmin && !(await AppointmentService.isAppointmentParticipant(appointment, req.user))) {
+        return res.status(403).json({ message: 'Not a participant in this chat' });
+      }
+      if (appointment.status !== 'completed') {
+        return res.status(409).json({ message: 'Only the chat of a completed appointment can be purged' });
+      }
+
+      const summary = await ChatService.purgeChatContent(appointment, {
+        purgedBy: req.user.id,
+        reason: isAdmin ? 'admin' : 'participant'
+      });
+      res.json({ appointmentId: appointment._id, ...summary });
+    } catch (error) {
+      console.error('purgeChat error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
   async getUnreadCount(req, res) {
     try {
       const userId = req.user.id;
@@ -0,0 +1,45 @@
+const config = require('../config/config');
+const Appointment = require('../models/appointment.model');
+const { getSetting } = require('../services/settings.service');
+
+// Bump when the shape of the public config changes in a way clients must handle
+const PUBLIC_CONFIG_VERSION = 1;
+
+const ConfigHandler = {
+  // Public, non-secret settings the frontend needs to render forms
+  async getPublicConfig(req, res) {
+    try {
+      res.set('Cache-Control', 'public, max-age=300');
+      res.json({
+        version: PUBLIC_CONFIG_VERSION,
+        locale: {
+          defaultCountry: config.locale.defaultCountry,
+          defaultCountryCode: config.locale.defaultCountryCode,
+          defaultLocale: config.locale.defaultLocale
+        },
+        appointments: {
+          modes: Appointment.schema.path('type').enumValues,
+          slotDurationMinutes: getSetting('appointments.slotDurationMinutes'),
+          allowedSlotDurations: config.appointments.allowedSlotDurations,
+          dependentRelationships: Appointment.DEPENDENT_RELATIONSHIPS
+        },
+        payments: {
+          currencies: config.payments.currencies,
+          payBeforeConfirm: config.payments.payBeforeConfirm,
+          holdMinutes: getSetting('payments.holdMinutes')
+        },
+        uploads: Object.fromEntries(
+          Object.entries(config.uploads).map(([category, { maxSize, allowedTypes }]) => [
+            category,
+            { maxSize, allowedTypes }
+          ])
+        )
+      });
+    } catch (error) {
+      console.error('getPublicConfig error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  }
+};
+
+module.exports = ConfigHandler;
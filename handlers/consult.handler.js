@@ -0,0 +1,131 @@
+const Doctor = require('../models/doctor.model');
+const InstantConsult = require('../models/instant.consult.model');
+const InstantConsultService = require('../services/instant.consult.service');
+const { getFieldErrors } = require('../middleware/validation.middleware');
+
+// The patient's own request; someone else's looks the same as a missing one
+const findOwnConsult = (req) => InstantConsult.findOne({ _id: req.params.id, patientId: req.user.id });
+
+// Any request, for admins
+const findAnyConsult = (req) => InstantConsult.findById(req.params.id);
+
+// Report where a request stands, found by findConsult
+const getConsult = (findConsult) => async (req, res) => {
+  try {
+    const fieldErrors = getFieldErrors(req);
+    if (fieldErrors) {
+      return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+    }
+    const consult = await findConsult(req);
+    if (!consult) {
+      return res.status(404).json({ message: 'Instant consult request not found' });
+    }
+    res.json(await InstantConsultService.getConsultStatus(consult));
+  } catch (error) {
+    console.error('getInstant error:', error);
+    res.status(500).json({ message: 'Server error' });
+  }
+};
+
+// Take a waiting request, found by findConsult, out of the queue
+const cancelConsult = (findConsult) => async (req, res) => {
+  try {
+    const fieldErrors = getFieldErrors(req);
+    if (fieldErrors) {
+      return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+    }
+    const consult = await findConsult(req);
+    if (!consult) {
+      return res.status(404).json({ message: 'Instant consult request not found' });
+    }
+    const cancelled = await InstantConsultService.cancelConsult(consult);
+    if (!cancelled) {
+      return res.status(409).json({
+        message: 'Only waiting requests can be cancelled; cancel the appointment of a matched consult instead',
+        code: 'INSTANT_CONSULT_NOT_WAITING'
+      });
+    }
+    res.json(await InstantConsultService.getConsultStatus(cancelled));
+  } catch (error) {
+    console.error('cancelInstant error:', error);
+    res.status(500).json({ message: 'Server error' });
+  }
+};
+
+const ConsultHandler = {
+  // Doctor goes online or offline for instant consults. Online doctors send
+  // this again within the heartbeat interval to stay online.
+  async setOnline(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const doctor = await Doctor.findOne({ userId: req.user.id });
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor profile not found' });
+      }
+      const online = req.body.online === true || req.body.online === 'true';
+      if (online && (doctor.verificationStatus !== 'verified' || doctor.status === 'suspended')) {
+        return res.status(403).json({ message: 'Only verified doctors can take instant consults', code: 'DOCTOR_NOT_VERIFIED' });
+      }
+      res.json(await InstantConsultService.setDoctorOnline(doctor, online));
+    } catch (error) {
+      console.error('setOnline error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // The doctor's instant consult state and current match
+  async getOnline(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user.id });
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor profile not found' });
+      }
+      res.json(await InstantConsultService.getDoctorState(doctor));
+    } catch (error) {
+      console.error('getOnline error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Patient asks for a consult with the next free online doctor in a specialty
+  async requestInstant(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const { specialty, reason } = req.body;
+      const result = await InstantConsultService.requestConsult(req.user.id, { specialty, reason });
+      if (!result.consult) {
+        return res.status(409).json({
+          message: 'No doctor is online for instant consults in this specialty; book one of the next available appointments instead',
+          code: 'NO_DOCTORS_ONLINE',
+          suggestions: result.fallback
+        });
+      }
+      const status = await InstantConsultService.getConsultStatus(result.consult);
+      if (!result.created) {
+        return res.status(409).json({ message: 'You already have an open instant consult request', code: 'INSTANT_CONSULT_OPEN', consult: status });
+      }
+      res.status(201).json(status);
+    } catch (error) {
+      console.error('requestInstant error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Queue position while waiting, the appointment once matched. Clients poll this.
+  getInstant: getConsult(findOwnConsult),
+
+  // Patient leaves the queue
+  cancelInstant: cancelConsult(findOwnConsult),
+
+  // Admins look up or cancel anyone's request
+  getAnyInstant: getConsult(findAnyConsult),
+  cancelAnyInstant: cancelConsult(findAnyConsult)
+};
+
+module.exports = ConsultHandler;
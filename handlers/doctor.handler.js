@@ -2,14 +2,150 @@ const Doctor = require('../models/doctor.model');
 const User = require('../models/user.model');
 const Appointment = require('../models/appointment.model');
 const BigRegisterService = require('../services/bigRegister.service');
-const { isValidRegistrationNumber } = require('../utils/helpers');
+const notificationService = require('../services/notification.service');
+const AppointmentService = require('../services/appointment.service');
+const AppointmentStatusService = require('../services/appointment.status.service');
+const PayoutService = require('../services/payout.service');
+const PaymentService = require('../services/payment.service');
+const AvailabilityService = require('../services/availability.service');
+const RankingService = require('../services/ranking.service');
+const ReviewService = require('../services/review.service');
+const SearchService = require('../services/search.service');
+const SettingsService = require('../services/settings.service');
+const PricingService = require('../services/pricing.service');
+const DoctorProfileService = require('../services/doctor.profile.service');
+const DoctorViewService = require('../services/doctor.view.service');
+const Payout = require('../models/payout.model');
+const BulkCancellation = require('../models/bulk.cancellation.model');
+const MessageTemplate = require('../models/message.template.model');
+const MessageTemplateService = require('../services/message.template.service');
+const Block = require('../models/block.model');
+const BlockService = require('../services/block.service');
+const { isValidRegistrationNumber, isValidTimeZone } = require('../utils/helpers');
+const { CURSOR_SORT, decodeCursor, afterCursor, toCursorPage } = require('../utils/pagination');
 const { validationResult } = require('express-validator');
 const logger = require('../utils/logger');
 const mongoose = require('mongoose');
 const axios = require('axios');
+const crypto = require('crypto');
+const config = require('../config/config');
+const { getAppointmentStart, getWeekday, minutesToTime } = require('../utils/helpers');
+const { buildCalendar } = require('../utils/ical');
+const { parseCsv } = require('../utils/csv');
+const { sanitizeRichText } = require('../utils/sanitize');
+const { handlePrivateUpload } = require('../services/upload.service');
+const ScanService = require('../services/scan.service');
+const { getQueryOptions, isTimeoutError } = require('../middleware/timeout.middleware');
+const s3Service = require('../services/aws/s3.service');
 const xml2js = require('xml2js');
 
 const BIG_REGISTER_URL = 'https://webservice.bigregister.cibg.nl/';
+const MAX_ABOUT_LENGTH = 5000;
+const MAX_AVAILABILITY_IMPORT_ROWS = 500;
+
+// Buffer minutes per appointment mode in effect for a doctor, defaults included
+const getAppointmentBuffers = (doctor) => Object.fromEntries(
+  AvailabilityService.APPOINTMENT_MODES.map(mode => [mode, AvailabilityService.getBufferMinutes(doctor, mode)])
+);
+
+// Validation message for an appointmentBuffers update, or null when valid
+const getAppointmentBuffersError = (buffers) => {
+  if (!buffers || typeof buffers !== 'object' || Array.isArray(buffers)) {
+    return 'appointmentBuffers must be an object keyed by appointment mode';
+  }
+  for (const [mode, minutes] of Object.entries(buffers)) {
+    if (!AvailabilityService.APPOINTMENT_MODES.includes(mode)) {
+      return `Unknown appointment mode in appointmentBuffers: ${mode}`;
+    }
+    if (minutes !== null && (!Number.isInteger(minutes) || minutes < 0 || minutes > 120)) {
+      return `appointmentBuffers.${mode} must be a whole number of minutes between 0 and 120, or null for the platform default`;
+    }
+  }
+  return null;
+};
+
+// Languages offered per appointment mode; empty lists offer all the doctor's languages
+const getConsultationLanguages = (doctor) => Object.fromEntries(
+  AvailabilityService.APPOINTMENT_MODES.map(mode => [
+    mode,
+    doctor.consultationLanguages && doctor.consultationLanguages[mode] ? [...doctor.consultationLanguages[mode]] : []
+  ])
+);
+
+// Validation message for language restrictions on availability blocks and
+// appointment modes, or null when valid. Restrictions must be languages the
+// doctor lists on their profile, when they list any.
+const getLanguageRestrictionsError = (availability, consultationLanguages, spoken) => {
+  if (consultationLanguages !== undefined) {
+    if (!consultationLanguages || typeof consultationLanguages !== 'object' || Array.isArray(consultationLanguages)) {
+      return 'consultationLanguages must be an object keyed by appointment mode';
+    }
+    for (const [mode, languages] of Object.entries(consultationLanguages)) {
+      if (!AvailabilityService.APPOINTMENT_MODES.includes(mode)) {
+        return `Unknown appointment mode in consultationLanguages: ${mode}`;
+      }
+      const error = AvailabilityService.getLanguagesError(languages);
+      if (error) {
+        return `consultationLanguages.${mode}: ${error}`;
+      }
+    }
+  }
+  const known = (spoken || []).map(language => language.toLowerCase());
+  if (known.length === 0) {
+    return null;
+  }
+  const restricted = [
+    ...(availability || []).flatMap(entry => (entry.slots || []).flatMap(slot => slot.languages || [])),
+    ...Object.values(consultationLanguages || {}).flatMap(languages => languages || [])
+  ];
+  const unknown = restricted.find(language => !known.includes(language.toLowerCase()));
+  return unknown ? `${unknown} is not one of the languages on your profile (${known.join(', ')})` : null;
+};
+
+// A booked appointment the doctor's schedule no longer covers, as reported to them
+const formatScheduleConflict = (appointment) => ({
+  id: appointment._id,
+  date: appointment.date.toISOString().slice(0, 10),
+  startTime: appointment.startTime,
+  endTime: appointment.endTime,
+  type: appointment.type,
+  status: appointment.status,
+  patientNotified: !!appointment.scheduleConflictNotifiedAt
+});
+
+// Refusal of a schedule change that leaves booked appointments uncovered, or
+// null when it may go ahead
+const getScheduleConflictsError = (conflicts, confirmed) => {
+  if (conflicts.length === 0 || confirmed || !config.appointments.confirmScheduleConflicts) {
+    return null;
+  }
+  return {
+    success: false,
+    error: `${conflicts.length} booked appointment(s) fall outside the new schedule. Confirm the change to save it anyway; the patients will be asked to reschedule.`,
+    code: 'SCHEDULE_CONFLICTS',
+    conflicts: conflicts.map(formatScheduleConflict)
+  };
+};
+
+// Ask the patients of appointments a schedule change left uncovered to
+// reschedule, once per appointment
+const notifyScheduleConflicts = async (doctor, conflicts) => {
+  const unnotified = conflicts.filter(appointment => !appointment.scheduleConflictNotifiedAt);
+  if (unnotified.length === 0) {
+    return;
+  }
+  const user = await User.findById(doctor.userId).select('lastName');
+  const doctorName = user ? `Dr. ${user.lastName}` : 'Your doctor';
+  for (const appointment of unnotified) {
+    try {
+      await notificationService.sendScheduleConflictNotice(appointment, doctorName);
+      appointment.scheduleConflictNotifiedAt = new Date();
+      await Appointment.updateOne({ _id: appointment._id }, { $set: { scheduleConflictNotifiedAt: appointment.scheduleConflictNotifiedAt } });
+    } catch (error) {
+      logger.error('Schedule conflict notice failed', { appointmentId: appointment._id, error: error.message });
+    }
+  }
+};
 
 class DoctorHandler {
   // Verify registration number
@@ -110,15 +246,6 @@ class DoctorHandler {
     try {
       const userId = req.user._id.toString(); // Convert to hex string
 
-      // Check if user is a doctor
-      const user = await User.findById(userId);
-      if (!user || user.role !== 'doctor') {
-        return res.status(403).json({
-          success: false,
-          error: 'Only doctors can create/update doctor profiles'
-        });
-      }
-
       // Find existing doctor profile
       let doctor = await Doctor.findOne({ userId });
       if (!doctor) {
@@ -142,12 +269,15 @@ class DoctorHandler {
         experience,
         consultationFee,
         currency,
+        timeZone,
         about,
         education,
         training,
         awards,
         publications,
         services,
+        consultationTypes,
+        pricingRules,
         clinicLocation,
         availability
       } = req.body;
@@ -174,6 +304,43 @@ class DoctorHandler {
         });
       }
 
+      // Schedule times are wall-clock times in this zone
+      if (timeZone !== undefined && (typeof timeZone !== 'string' || !isValidTimeZone(timeZone))) {
+        return res.status(400).json({
+          success: false,
+          error: 'Time zone must be an IANA time zone name, e.g. Europe/Amsterdam'
+        });
+      }
+
+      if (consultationTypes !== undefined) {
+        if (!Array.isArray(consultationTypes)) {
+          return res.status(400).json({
+            success: false,
+            error: 'Consultation types must be an array'
+          });
+        }
+        for (const type of consultationTypes) {
+          if (!type.name || typeof type.name !== 'string' ||
+              !config.appointments.allowedSlotDurations.includes(type.duration) ||
+              typeof type.fee !== 'number' || type.fee < 0) {
+            return res.status(400).json({
+              success: false,
+              error: `Each consultation type needs a name, a duration of ${config.appointments.allowedSlotDurations.join(', ')} minutes and a fee`
+            });
+          }
+        }
+      }
+
+      if (pricingRules !== undefined) {
+        const pricingError = PricingService.getPricingRulesError(pricingRules);
+        if (pricingError) {
+          return res.status(400).json({
+            success: false,
+            error: pricingError
+          });
+        }
+      }
+
       if (!about || typeof about !== 'string' || about.trim().length === 0) {
         return res.status(400).json({
           success: false,
@@ -181,6 +348,21 @@ class DoctorHandler {
         });
       }
 
+      // The bio is shown in the public directory; only keep safe formatting
+      const cleanAbout = sanitizeRichText(about);
+      if (cleanAbout.length === 0) {
+        return res.status(400).json({
+          success: false,
+          error: 'About section is required'
+        });
+      }
+      if (cleanAbout.length > MAX_ABOUT_LENGTH) {
+        return res.status(400).json({
+          success: false,
+          error: `About section must be at most ${MAX_ABOUT_LENGTH} characters`
+        });
+      }
+
       if (!education || !Array.isArray(education) || education.length === 0) {
         return res.status(400).json({
           success: false,
@@ -206,6 +388,13 @@ class DoctorHandler {
         });
       }
 
+      if (clinicLocation.rooms !== undefined && (!Number.isInteger(clinicLocation.rooms) || clinicLocation.rooms < 1)) {
+        return res.status(400).json({
+          success: false,
+          error: 'Clinic rooms must be a whole number of at least 1'
+        });
+      }
+
       // Validate coordinates if provided
       if (clinicLocation.coordinates) {
         if (!clinicLocation.coordinates.coordinates || !Array.isArray(clinicLocation.coordinates.coordinates) || clinicLocation.coordinates.coordinates.length !== 2) {
@@ -222,27 +411,67 @@ class DoctorHandler {
         experience,
         consultationFee,
         currency: currency || 'EUR',
-        about,
+        timeZone: timeZone || doctor.timeZone,
+        about: cleanAbout,
         education,
         training: training || [],
         awards: awards || [],
         publications: publications || [],
-        services: services || [],
-        clinicLocation,
-        availability: availability || [],
-        status: 'pending' // Set to pending for admin review
+        services: (services || []).map(service => ({
+          ...service,
+          description: sanitizeRichText(service.description)
+        })),
+        consultationTypes: (consultationTypes || doctor.consultationTypes || []).map(type => ({
+          _id: type._id,
+          name: type.name,
+          duration: type.duration,
+          fee: type.fee
+        })),
+        pricingRules: (pricingRules || doctor.pricingRules || []).map(rule => ({
+          days: rule.days,
+          startTime: rule.startTime,
+          endTime: rule.endTime,
+          multiplier: rule.multiplier,
+          label: rule.label
+        })),
+        // Photos are managed through their own endpoints
+        clinicLocation: { ...clinicLocation, photos: doctor.clinicLocation.photos },
+        availability: availability || []
       };
 
+      // An approved profile stays live: reviewed fields wait for an admin while
+      // everything else applies now. Profiles not yet approved go back for review.
+      let update = { $set: { ...updateData, status: 'pending' } };
+      let pendingChanges = null;
+      if (DoctorProfileService.requiresChangeReview(doctor)) {
+        const { immediate, pending } = DoctorProfileService.splitProfileUpdate(doctor, updateData);
+        update = { $set: immediate };
+        if (pending) {
+          pendingChanges = {
+            changes: { ...((doctor.pendingProfileChanges && doctor.pendingProfileChanges.changes) || {}), ...pending },
+            submittedAt: new Date()
+          };
+          update.$set.pendingProfileChanges = pendingChanges;
+        }
+      }
+
       // Update doctor profile
       doctor = await Doctor.findByIdAndUpdate(
         doctor._id,
-        { $set: updateData },
+        update,
         { new: true, runValidators: true }
       );
 
+      let message = 'Doctor profile updated successfully. Waiting for admin approval.';
+      if (doctor.status === 'active') {
+        message = pendingChanges
+          ? `Doctor profile updated. Changes to ${Object.keys(pendingChanges.changes).join(', ')} are waiting for admin approval.`
+          : 'Doctor profile updated successfully.';
+      }
+
       res.json({
         success: true,
-        message: 'Doctor profile updated successfully. Waiting for admin approval.',
+        message,
         doctor: {
           id: doctor._id,
           registrationNumber: doctor.registrationNumber,
@@ -252,14 +481,18 @@ class DoctorHandler {
           experience: doctor.experience,
           consultationFee: doctor.consultationFee,
           currency: doctor.currency,
+          timeZone: AppointmentService.getScheduleTimeZone(doctor),
           about: doctor.about,
           education: doctor.education,
           training: doctor.training,
           awards: doctor.awards,
           publications: doctor.publications,
           services: doctor.services,
+          consultationTypes: doctor.consultationTypes,
+          pricingRules: doctor.pricingRules,
           clinicLocation: doctor.clinicLocation,
-          availability: doctor.availability
+          availability: doctor.availability,
+          pendingProfileChanges: doctor.pendingProfileChanges
         }
       });
     } catch (error) {
@@ -295,14 +528,24 @@ class DoctorHandler {
           experience: doctor.experience,
           consultationFee: doctor.consultationFee,
           currency: doctor.currency,
+          timeZone: AppointmentService.getScheduleTimeZone(doctor),
           about: doctor.about,
           education: doctor.education,
           training: doctor.training,
           awards: doctor.awards,
           publications: doctor.publications,
           services: doctor.services,
+          consultationTypes: doctor.consultationTypes,
+          pricingRules: doctor.pricingRules,
           clinicLocation: doctor.clinicLocation,
           availability: doctor.availability,
+          firstSlotOffset: doctor.firstSlotOffset,
+          lastSlotCutoff: doctor.lastSlotCutoff,
+          maxAdvanceBookingDays: doctor.maxAdvanceBookingDays != null ? doctor.maxAdvanceBookingDays : null,
+          maxAppointmentsPerDay: doctor.maxAppointmentsPerDay || null,
+          autoAcceptBookings: Boolean(doctor.autoAcceptBookings),
+          appointmentBuffers: getAppointmentBuffers(doctor),
+          consultationLanguages: getConsultationLanguages(doctor),
           createdAt: doctor.createdAt,
           updatedAt: doctor.updatedAt
         }
@@ -459,8 +702,10 @@ class DoctorHandler {
         return res.status(404).json({ message: 'Doctor profile not found' });
       }
 
-      const appointments = await Appointment.find({ doctorId: doctor._id })
-        .populate('patientId', 'firstName lastName email phone')
+      // Drafts are the patient's unfinished bookings and not the doctor's concern
+      const appointments = await Appointment.find({ doctorId: doctor._id, status: { $ne: 'draft' } })
+        // Last-seen only reaches doctors through their own appointments
+        .populate('patientId', 'firstName lastName email phone lastActiveAt')
         .sort({ date: -1 });
 
       res.json(appointments);
@@ -478,9 +723,14 @@ class DoctorHandler {
       }
 
       const { id } = req.params;
-      const { status } = req.body;
+      const { status, disposition, reason } = req.body;
       const userId = req.user._id.toString(); // Convert to hex string
 
+      const dispositionError = AppointmentService.getDispositionError(status, disposition);
+      if (dispositionError) {
+        return res.status(400).json({ message: dispositionError });
+      }
+
       const doctor = await Doctor.findOne({ userId });
       if (!doctor) {
         return res.status(404).json({ message: 'Doctor profile not found' });
@@ -495,20 +745,41 @@ class DoctorHandler {
         return res.status(404).json({ message: 'Appointment not found' });
       }
 
-      appointment.status = status;
-      await appointment.save();
+      const updated = await AppointmentStatusService.transitionStatus(appointment, status, {
+        actor: 'doctor',
+        userId,
+        reason,
+        set: disposition ? { disposition } : {}
+      });
+
+      if (status === 'confirmed') {
+        notificationService.sendAppointmentConfirmation(updated)
+          .catch(err => logger.error('Appointment confirmation notification error:', err));
+      }
+      if (status === 'cancelled') {
+        notificationService.sendDoctorCancellationNotice(updated)
+          .catch(err => logger.error('Doctor cancellation notice error:', err));
+      }
+      if (status === 'completed' && config.surveys.enabled) {
+        notificationService.sendSurveyInvitation(updated)
+          .catch(err => logger.error('Survey invitation error:', err));
+      }
 
-      res.json(appointment);
+      res.json(updated);
     } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message, code: error.errorCode });
+      }
       logger.error('Error updating appointment status:', error);
       res.status(500).json({ message: 'Error updating appointment status' });
     }
   }
 
-  // Get all doctors
+  // Get all doctors. Pages by offset, or after the cursor when one is given;
+  // nextCursor is returned either way.
   static async getDoctors(req, res) {
     try {
-      const { specialization, verified, page = 1, limit = 10 } = req.query;
+      const { specialization, verified, cursor, page = 1, limit = 10 } = req.query;
       const query = {};
 
       if (specialization) {
@@ -519,19 +790,36 @@ class DoctorHandler {
         query.verificationStatus = verified === 'true' ? 'verified' : 'pending';
       }
 
-      const doctors = await Doctor.find(query)
-        .populate('userId', 'firstName lastName email')
-        .skip((page - 1) * limit)
-        .limit(Number(limit))
-        .sort({ createdAt: -1 });
+      const position = cursor && decodeCursor(cursor);
+      if (cursor && !position) {
+        return res.status(400).json({
+          success: false,
+          error: 'Invalid cursor'
+        });
+      }
 
-      const total = await Doctor.countDocuments(query);
+      const found = await Doctor.find(position ? afterCursor(query, position) : query)
+        .populate('userId', 'firstName lastName email')
+        .sort(CURSOR_SORT)
+        .skip(position ? 0 : (page - 1) * limit)
+        .limit(Number(limit) + 1);
+      const { items: doctors, nextCursor } = toCursorPage(found, Number(limit));
+
+      const [total, nextAvailable] = await Promise.all([
+        Doctor.countDocuments(query),
+        AvailabilityService.getNextAvailableForDoctors(doctors)
+      ]);
 
       res.json({
-        doctors,
+        doctors: doctors.map(doctor => ({
+          ...doctor.toJSON(),
+          ratingSummary: ReviewService.getRatingSummary(doctor),
+          nextAvailable: nextAvailable.get(doctor._id.toString())
+        })),
         total,
-        page: Number(page),
-        pages: Math.ceil(total / limit)
+        page: position ? undefined : Number(page),
+        pages: position ? undefined : Math.ceil(total / limit),
+        nextCursor
       });
     } catch (error) {
       logger.error('Get doctors error:', error);
@@ -542,6 +830,90 @@ class DoctorHandler {
     }
   }
 
+  // Find verified doctors near a location, ranked by distance, rating or a
+  // blend of distance, rating and availability
+  static async getNearbyDoctors(req, res) {
+    try {
+      const nearbyConfig = config.search.nearby;
+      const lat = parseFloat(req.query.lat);
+      const lng = parseFloat(req.query.lng);
+      if (isNaN(lat) || isNaN(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180) {
+        return res.status(400).json({
+          success: false,
+          error: 'Valid lat and lng query parameters are required'
+        });
+      }
+
+      const sort = req.query.sort || nearbyConfig.defaultSort;
+      if (!RankingService.SORT_OPTIONS.includes(sort)) {
+        return res.status(400).json({
+          success: false,
+          error: `sort must be one of: ${RankingService.SORT_OPTIONS.join(', ')}`
+        });
+      }
+
+      const radiusKm = Math.min(parseFloat(req.query.radiusKm) || nearbyConfig.defaultRadiusKm, nearbyConfig.maxRadiusKm);
+      const limit = Math.min(parseInt(req.query.limit, 10) || 10, 50);
+
+      const query = { verificationStatus: 'verified' };
+      if (req.query.specialization) {
+        query.specializations = req.query.specialization;
+      }
+
+      // Distance comes from the geo index; ranking happens over the candidates
+      const candidates = await Doctor.aggregate([
+        {
+          $geoNear: {
+            near: { type: 'Point', coordinates: [lng, lat] },
+            distanceField: 'distanceMeters',
+            maxDistance: radiusKm * 1000,
+            spherical: true,
+            query
+          }
+        },
+        { $limit: nearbyConfig.maxCandidates }
+      ]).option(getQueryOptions(req));
+      await Doctor.populate(candidates, { path: 'userId', select: 'firstName lastName' });
+
+      const nextAvailable = await AvailabilityService.getNextAvailableForDoctors(candidates);
+      const now = new Date();
+      const entries = candidates.map(doctor => {
+        // Ratings from too few verified reviews don't help a doctor's rank
+        const entry = {
+          distanceKm: Math.round(doctor.distanceMeters / 10) / 100,
+          rating: ReviewService.getRatingSummary(doctor).average || 0,
+          nextAvailable: nextAvailable.get(doctor._id.toString())
+        };
+        return { doctor, ...entry, scores: RankingService.scoreDoctor(entry, { radiusKm, now }) };
+      });
+
+      const ranked = RankingService.rankDoctors(entries, sort).slice(0, limit);
+
+      res.json({
+        success: true,
+        sort,
+        radiusKm,
+        weights: sort === 'composite' ? nearbyConfig.weights : undefined,
+        doctors: ranked.map(({ doctor, distanceKm, nextAvailable: next, scores }) => {
+          const { distanceMeters, calendarFeedTokenHash, ...profile } = doctor;
+          return { ...profile, ratingSummary: ReviewService.getRatingSummary(doctor), distanceKm, nextAvailable: next, scores };
+        })
+      });
+    } catch (error) {
+      if (isTimeoutError(error)) {
+        return res.status(503).json({
+          success: false,
+          error: 'Request timed out'
+        });
+      }
+      logger.error('Get nearby doctors error:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to fetch nearby doctors'
+      });
+    }
+  }
+
   // Get doctor by ID (query param)
   static async getDoctorById(req, res) {
     try {
@@ -559,7 +931,18 @@ class DoctorHandler {
           error: 'Doctor not found'
         });
       }
-      res.json({ success: true, doctor });
+      // Counted in the background so a slow write never delays the profile;
+      // doctors looking at their own profile don't count
+      const viewer = DoctorViewService.getViewer(req);
+      if (doctor.verificationStatus === 'verified' && doctor.userId && viewer.userId !== doctor.userId._id.toString()) {
+        DoctorViewService.recordView(doctor._id, viewer.viewerKey)
+          .catch(error => logger.warn('Failed to record profile view:', error));
+      }
+      const clinicPhotos = await DoctorProfileService.getClinicPhotoUrls(doctor);
+      res.json({
+        success: true,
+        doctor: { ...doctor.toJSON(), ratingSummary: ReviewService.getRatingSummary(doctor), clinicPhotos }
+      });
     } catch (error) {
       logger.error('Get doctor by ID error:', error);
       res.status(500).json({
@@ -573,7 +956,7 @@ class DoctorHandler {
   static async getSpecialties(req, res) {
     try {
       // Get unique specializations from the doctor collection
-      const specializations = await Doctor.distinct('specializations', { specializations: { $ne: [] } });
+      const specializations = await SearchService.getSpecialties();
       res.json({
         success: true,
         data: specializations
@@ -599,23 +982,39 @@ class DoctorHandler {
         return res.status(400).json({ success: false, error: 'startDate and endDate are required' });
       }
       const start = new Date(startDate);
-      const end = new Date(endDate);
-      if (isNaN(start) || isNaN(end) || start > end) {
+      const requestedEnd = new Date(endDate);
+      if (isNaN(start) || isNaN(requestedEnd) || start > requestedEnd) {
         return res.status(400).json({ success: false, error: 'Invalid date range' });
       }
+      // Nothing past the booking window can be booked, so it isn't listed
+      const lastBookableDate = AppointmentService.getLastBookableDate(doctor);
+      const end = new Date(Math.min(requestedEnd, lastBookableDate));
+      // Days that reached the doctor's daily cap have nothing left to book
+      const booked = doctor.maxAppointmentsPerDay
+        ? await Appointment.find({ doctorId: doctor._id, date: { $gte: start, $lte: end }, status: { $ne: 'cancelled' } })
+          .select('date startTime endTime type status paymentStatus holdExpiresAt createdAt')
+        : [];
       const results = [];
-      for (let d = new Date(start); d <= end; d.setDate(d.getDate() + 1)) {
+      for (let d = new Date(start); d <= end; d.setUTCDate(d.getUTCDate() + 1)) {
         const dateStr = d.toISOString().slice(0, 10);
-        const weekday = d.toLocaleDateString('en-US', { weekday: 'long' }).toLowerCase();
+        if (AvailabilityService.isAtDailyCap(doctor, booked.filter(a => a.date.toISOString().slice(0, 10) === dateStr))) {
+          results.push({ date: dateStr, slots: [], full: true });
+          continue;
+        }
+        const weekday = getWeekday(d);
         const recurring = doctor.availability.find(a => a.day === weekday);
-        let slots = recurring ? [...recurring.slots] : [];
+        // Blocks as bookable, after the first-slot offset and last-slot cutoff
+        let slots = recurring
+          ? AvailabilityService.getBookableRanges(doctor, recurring)
+            .map(range => ({ startTime: minutesToTime(range.start), endTime: minutesToTime(range.end) }))
+          : [];
         const unavail = doctor.unavailability.find(u => u.date.toISOString().slice(0,10) === dateStr);
         if (unavail) {
           slots = slots.filter(slot => !unavail.slots.some(uSlot => slot.startTime < uSlot.endTime && slot.endTime > uSlot.startTime));
         }
         results.push({ date: dateStr, slots });
       }
-      res.json({ success: true, availability: results });
+      res.json({ success: true, lastBookableDate: lastBookableDate.toISOString().slice(0, 10), availability: results });
     } catch (error) {
       logger.error('Get availability error:', error);
       res.status(500).json({ success: false, error: 'Failed to fetch availability' });
@@ -635,13 +1034,96 @@ class DoctorHandler {
         });
       }
 
-      doctor.availability = req.body.availability;
+      const { availability, firstSlotOffset, lastSlotCutoff, maxAdvanceBookingDays, maxAppointmentsPerDay, autoAcceptBookings, appointmentBuffers, consultationLanguages } = req.body;
+      for (const [name, value] of Object.entries({ firstSlotOffset, lastSlotCutoff })) {
+        if (value !== undefined && (!Number.isInteger(value) || value < 0 || value > 240)) {
+          return res.status(400).json({
+            success: false,
+            error: `${name} must be a whole number of minutes between 0 and 240`
+          });
+        }
+      }
+      const availabilityError = availability !== undefined && AvailabilityService.getAvailabilityError(availability);
+      if (availabilityError) {
+        return res.status(400).json({
+          success: false,
+          error: availabilityError
+        });
+      }
+      if (maxAdvanceBookingDays !== undefined && maxAdvanceBookingDays !== null &&
+          (!Number.isInteger(maxAdvanceBookingDays) || maxAdvanceBookingDays < 1 || maxAdvanceBookingDays > 365)) {
+        return res.status(400).json({
+          success: false,
+          error: 'maxAdvanceBookingDays must be a whole number of days between 1 and 365, or null for the platform default'
+        });
+      }
+      if (maxAppointmentsPerDay !== undefined && maxAppointmentsPerDay !== null &&
+          (!Number.isInteger(maxAppointmentsPerDay) || maxAppointmentsPerDay < 1 || maxAppointmentsPerDay > 100)) {
+        return res.status(400).json({
+          success: false,
+          error: 'maxAppointmentsPerDay must be a whole number between 1 and 100, or null for no limit'
+        });
+      }
+      if (autoAcceptBookings !== undefined && typeof autoAcceptBookings !== 'boolean') {
+        return res.status(400).json({
+          success: false,
+          error: 'autoAcceptBookings must be a boolean'
+        });
+      }
+      const buffersError = appointmentBuffers !== undefined && getAppointmentBuffersError(appointmentBuffers);
+      if (buffersError) {
+        return res.status(400).json({
+          success: false,
+          error: buffersError
+        });
+      }
+      if (availability !== undefined || consultationLanguages !== undefined) {
+        const user = await User.findById(userId).select('languages');
+        const languagesError = getLanguageRestrictionsError(availability, consultationLanguages, user && user.languages);
+        if (languagesError) {
+          return res.status(400).json({
+            success: false,
+            error: languagesError
+          });
+        }
+      }
+
+      if (availability !== undefined) doctor.availability = availability;
+      if (firstSlotOffset !== undefined) doctor.firstSlotOffset = firstSlotOffset;
+      if (lastSlotCutoff !== undefined) doctor.lastSlotCutoff = lastSlotCutoff;
+      if (maxAdvanceBookingDays !== undefined) doctor.maxAdvanceBookingDays = maxAdvanceBookingDays === null ? undefined : maxAdvanceBookingDays;
+      if (maxAppointmentsPerDay !== undefined) doctor.maxAppointmentsPerDay = maxAppointmentsPerDay === null ? undefined : maxAppointmentsPerDay;
+      if (autoAcceptBookings !== undefined) doctor.autoAcceptBookings = autoAcceptBookings;
+      // null clears a mode back to the platform default
+      Object.entries(appointmentBuffers || {}).forEach(([mode, minutes]) => {
+        doctor.set(`appointmentBuffers.${mode}`, minutes === null ? undefined : minutes);
+      });
+      Object.entries(consultationLanguages || {}).forEach(([mode, languages]) => {
+        doctor.set(`consultationLanguages.${mode}`, languages || []);
+      });
+
+      // Don't quietly strand appointments booked in hours being removed
+      const scheduleChanged = availability !== undefined || firstSlotOffset !== undefined || lastSlotCutoff !== undefined;
+      const conflicts = scheduleChanged ? await AvailabilityService.findScheduleConflicts(doctor) : [];
+      const conflictsError = getScheduleConflictsError(conflicts, req.body.confirmConflicts === true);
+      if (conflictsError) {
+        return res.status(409).json(conflictsError);
+      }
       await doctor.save();
+      await notifyScheduleConflicts(doctor, conflicts);
 
       res.json({
         success: true,
         message: 'Availability updated successfully',
-        availability: doctor.availability
+        availability: doctor.availability,
+        firstSlotOffset: doctor.firstSlotOffset,
+        lastSlotCutoff: doctor.lastSlotCutoff,
+        maxAdvanceBookingDays: doctor.maxAdvanceBookingDays != null ? doctor.maxAdvanceBookingDays : null,
+        maxAppointmentsPerDay: doctor.maxAppointmentsPerDay || null,
+        autoAcceptBookings: Boolean(doctor.autoAcceptBookings),
+        appointmentBuffers: getAppointmentBuffers(doctor),
+        consultationLanguages: getConsultationLanguages(doctor),
+        conflicts: conflicts.map(formatScheduleConflict)
       });
     } catch (error) {
       logger.error('Update availability error:', error);
@@ -657,15 +1139,6 @@ class DoctorHandler {
     try {
       const userId = req.user._id.toString(); // Convert to hex string
 
-      // Check if user is a doctor
-      const user = await User.findById(userId);
-      if (!user || user.role !== 'doctor') {
-        return res.status(403).json({
-          success: false,
-          error: 'Only doctors can register'
-        });
-      }
-
       // Check if doctor profile already exists
       const existingDoctor = await Doctor.findOne({ userId });
       if (existingDoctor) {
@@ -762,6 +1235,197 @@ class DoctorHandler {
     }
   }
 
+  // Import the weekly schedule from a CSV of day,startTime,endTime rows. Rows
+  // are checked one by one; by default valid rows are applied even when
+  // others are rejected, with atomic=true any rejected row aborts the import.
+  static async importAvailability(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id });
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      if (!req.file) {
+        return res.status(400).json({ success: false, error: 'Upload the CSV as the file field' });
+      }
+
+      const mode = req.body.mode || 'merge';
+      if (!['merge', 'replace'].includes(mode)) {
+        return res.status(400).json({ success: false, error: 'mode must be merge or replace' });
+      }
+      const atomic = req.body.atomic === 'true';
+
+      const text = req.file.buffer.toString('utf8');
+      if (text.includes('\u0000')) {
+        return res.status(415).json({ success: false, error: 'The file must be a CSV text file' });
+      }
+      const lines = parseCsv(text);
+      // The header row is optional
+      const hasHeader = lines.length > 0 && lines[0][0].toLowerCase() === 'day';
+      const dataLines = hasHeader ? lines.slice(1) : lines;
+      if (dataLines.length === 0) {
+        return res.status(400).json({ success: false, error: 'The CSV has no rows' });
+      }
+      if (dataLines.length > MAX_AVAILABILITY_IMPORT_ROWS) {
+        return res.status(400).json({ success: false, error: `The CSV can have at most ${MAX_AVAILABILITY_IMPORT_ROWS} rows` });
+      }
+
+      const rows = dataLines.map(([day, startTime, endTime], index) => ({
+        row: index + (hasHeader ? 2 : 1),
+        day,
+        startTime,
+        endTime
+      }));
+      const { availability, results } = AvailabilityService.importAvailability(doctor.availability, rows, mode);
+      const count = (status) => results.filter(result => result.status === status).length;
+      const summary = {
+        mode,
+        atomic,
+        rows: rows.length,
+        imported: count('imported'),
+        duplicates: count('duplicate'),
+        rejected: count('rejected'),
+        applied: false
+      };
+
+      // Replacing with nothing would wipe the schedule, most likely by mistake
+      if ((atomic && summary.rejected > 0) || (mode === 'replace' && summary.imported + summary.duplicates === 0)) {
+        return res.status(422).json({
+          success: false,
+          error: 'Nothing was imported; fix the rejected rows and try again',
+          summary,
+          results
+        });
+      }
+
+      doctor.availability = availability;
+      const conflicts = await AvailabilityService.findScheduleConflicts(doctor);
+      const conflictsError = getScheduleConflictsError(conflicts, req.body.confirmConflicts === 'true');
+      if (conflictsError) {
+        return res.status(409).json({ ...conflictsError, summary, results });
+      }
+      await doctor.save();
+      await notifyScheduleConflicts(doctor, conflicts);
+      summary.applied = true;
+      logger.info('Doctor imported availability', { doctorId: doctor._id, ...summary });
+
+      res.json({
+        success: true,
+        summary,
+        results,
+        availability: doctor.availability,
+        conflicts: conflicts.map(formatScheduleConflict)
+      });
+    } catch (error) {
+      logger.error('Import availability error:', error);
+      res.status(500).json({ success: false, error: 'Failed to import availability' });
+    }
+  }
+
+  // Emergency: cancel every open appointment of the doctor in a time range,
+  // refunding and notifying each patient. Each appointment is handled on its
+  // own so one failure doesn't stop the rest, and the run is audited.
+  static async cancelAppointmentRange(req, res) {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+
+      const doctor = await Doctor.findOne({ userId: req.user.id });
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+
+      const from = new Date(req.body.from);
+      const to = new Date(req.body.to);
+      const maxDays = config.appointments.cancelRangeMaxDays;
+      if (from >= to) {
+        return res.status(400).json({ success: false, error: 'from must be before to' });
+      }
+      if (to - from > maxDays * 24 * 60 * 60 * 1000) {
+        return res.status(400).json({ success: false, error: `The range can span at most ${maxDays} days` });
+      }
+      const { reason } = req.body;
+      const cancellationCategory = req.body.cancellationCategory || 'doctor_unavailable';
+      const offerRebooking = req.body.offerRebooking !== false;
+
+      const firstDay = new Date(from);
+      firstDay.setUTCHours(0, 0, 0, 0);
+      const candidates = await Appointment.find({
+        doctorId: doctor._id,
+        date: { $gte: firstDay, $lte: to },
+        status: { $in: ['pending', 'confirmed'] }
+      }).sort({ date: 1, startTime: 1 });
+      const inRange = candidates.filter(appointment => {
+        const start = getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone);
+        return start >= from && start < to;
+      });
+
+      const results = [];
+      for (const appointment of inRange) {
+        try {
+          const cancelled = await AppointmentStatusService.transitionStatus(appointment, 'cancelled', {
+            actor: 'doctor',
+            userId: req.user.id,
+            reason,
+            set: { cancellationCategory }
+          });
+          const refundedAmount = await AppointmentService.refundDoctorCancellation(cancelled);
+          let rebookOptions = 0;
+          try {
+            // Offer times after the emergency window, not the slots just freed
+            const offers = await notificationService.sendDoctorCancellationNotice(cancelled, { offerRebooking, after: to });
+            rebookOptions = offers.length;
+          } catch (error) {
+            logger.error('Doctor cancellation notice error:', error);
+          }
+          results.push({ appointmentId: appointment._id, outcome: 'cancelled', refundedAmount, rebookOptions });
+        } catch (error) {
+          logger.error('Range cancellation failed for appointment', { appointmentId: appointment._id, error: error.message });
+          results.push({ appointmentId: appointment._id, outcome: 'failed', error: error.message });
+        }
+      }
+
+      const cancelledCount = results.filter(result => result.outcome === 'cancelled').length;
+      const audit = await BulkCancellation.create({
+        doctorId: doctor._id,
+        userId: req.user.id,
+        from,
+        to,
+        reason,
+        cancellationCategory,
+        offerRebooking,
+        results,
+        cancelledCount,
+        failedCount: results.length - cancelledCount,
+        ip: req.ip
+      });
+      logger.info('Doctor cancelled appointments in range', {
+        doctorId: doctor._id,
+        from,
+        to,
+        cancelled: cancelledCount,
+        failed: results.length - cancelledCount,
+        auditId: audit._id
+      });
+
+      res.json({
+        success: true,
+        data: {
+          id: audit._id,
+          from,
+          to,
+          cancelled: cancelledCount,
+          failed: audit.failedCount,
+          results
+        }
+      });
+    } catch (error) {
+      logger.error('Cancel appointment range error:', error);
+      res.status(500).json({ success: false, error: 'Failed to cancel appointments' });
+    }
+  }
+
   // Get unavailability for a doctor
   static async getUnavailability(req, res) {
     try {
@@ -827,6 +1491,435 @@ class DoctorHandler {
       res.status(500).json({ message: 'Error fetching from BIG register' });
     }
   }
+
+  // Issue (or rotate) the secret token for the doctor's calendar feed
+  static async createCalendarFeedToken(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id });
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor profile not found' });
+      }
+
+      const token = crypto.randomBytes(32).toString('hex');
+      doctor.calendarFeedTokenHash = crypto.createHash('sha256').update(token).digest('hex');
+      await doctor.save();
+
+      res.status(201).json({
+        token,
+        url: `${config.apiUrl}${config.apiPrefix}/doctors/me/calendar.ics?token=${token}`
+      });
+    } catch (error) {
+      logger.error('Error creating calendar feed token:', error);
+      res.status(500).json({ message: 'Error creating calendar feed token' });
+    }
+  }
+
+  // Revoke the calendar feed token; existing subscriptions stop working
+  static async revokeCalendarFeedToken(req, res) {
+    try {
+      const result = await Doctor.updateOne(
+        { userId: req.user._id },
+        { $unset: { calendarFeedTokenHash: 1 } }
+      );
+      if (result.matchedCount === 0) {
+        return res.status(404).json({ message: 'Doctor profile not found' });
+      }
+
+      res.json({ message: 'Calendar feed token revoked' });
+    } catch (error) {
+      logger.error('Error revoking calendar feed token:', error);
+      res.status(500).json({ message: 'Error revoking calendar feed token' });
+    }
+  }
+
+  // Add a photo of the doctor's clinic
+  static async addClinicPhoto(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id });
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+
+      const { maxPerClinic } = config.clinicPhotos;
+      if ((doctor.clinicLocation.photos || []).length >= maxPerClinic) {
+        return res.status(409).json({ success: false, error: `A clinic can have at most ${maxPerClinic} photos` });
+      }
+
+      const { key, contentType, scan } = await handlePrivateUpload(req.file, 'clinicPhoto', `clinic-photos/${doctor._id}`);
+
+      // Conditional on the photo count so parallel uploads can't exceed the limit
+      const updated = await Doctor.findOneAndUpdate(
+        { _id: doctor._id, [`clinicLocation.photos.${maxPerClinic - 1}`]: { $exists: false } },
+        { $push: { 'clinicLocation.photos': { key, contentType, size: req.file.size, scan } } },
+        { new: true }
+      );
+      if (!updated) {
+        await s3Service.deleteFile(key);
+        return res.status(409).json({ success: false, error: `A clinic can have at most ${maxPerClinic} photos` });
+      }
+      const photo = updated.clinicLocation.photos.find(p => p.key === key);
+      ScanService.scanInBackground('clinicPhoto', {
+        id: photo._id,
+        key,
+        contentType,
+        fileName: req.file.originalname,
+        uploadedBy: req.user._id
+      }, req.file.buffer);
+
+      res.status(201).json({
+        success: true,
+        // The doctor also sees photos still being scanned, without a link
+        photos: await DoctorProfileService.getClinicPhotoUrls(updated, { includeQuarantined: true })
+      });
+    } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ success: false, error: error.message });
+      }
+      logger.error('Add clinic photo error:', error);
+      res.status(500).json({ success: false, error: 'Failed to add clinic photo' });
+    }
+  }
+
+  // Remove one of the doctor's clinic photos
+  static async removeClinicPhoto(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id });
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+
+      const photo = (doctor.clinicLocation.photos || []).find(p => p._id.toString() === req.params.photoId);
+      if (!photo) {
+        return res.status(404).json({ success: false, error: 'Photo not found' });
+      }
+
+      const updated = await Doctor.findByIdAndUpdate(
+        doctor._id,
+        { $pull: { 'clinicLocation.photos': { _id: photo._id } } },
+        { new: true }
+      );
+      await s3Service.deleteFile(photo.key)
+        .catch(err => logger.error('Failed to delete clinic photo from S3:', err));
+
+      res.json({
+        success: true,
+        photos: await DoctorProfileService.getClinicPhotoUrls(updated, { includeQuarantined: true })
+      });
+    } catch (error) {
+      logger.error('Remove clinic photo error:', error);
+      res.status(500).json({ success: false, error: 'Failed to remove clinic photo' });
+    }
+  }
+
+  // The doctor's saved chat replies
+  static async getMessageTemplates(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      const templates = await MessageTemplate.find({ doctorId: doctor._id }).sort({ name: 1 });
+      res.json({
+        success: true,
+        templates,
+        placeholders: MessageTemplateService.TEMPLATE_PLACEHOLDERS
+      });
+    } catch (error) {
+      logger.error('Get message templates error:', error);
+      res.status(500).json({ success: false, error: 'Failed to fetch message templates' });
+    }
+  }
+
+  static async createMessageTemplate(req, res) {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      const { name, content } = req.body;
+      const contentError = MessageTemplateService.getTemplateContentError(content);
+      if (contentError) {
+        return res.status(400).json({ success: false, error: contentError });
+      }
+      const maxTemplatesPerDoctor = SettingsService.getSetting('chat.maxTemplatesPerDoctor');
+      if (await MessageTemplate.countDocuments({ doctorId: doctor._id }) >= maxTemplatesPerDoctor) {
+        return res.status(409).json({ success: false, error: `You can save at most ${maxTemplatesPerDoctor} templates` });
+      }
+      const template = await MessageTemplate.create({ doctorId: doctor._id, name, content });
+      res.status(201).json({ success: true, template });
+    } catch (error) {
+      if (error.code === 11000) {
+        return res.status(409).json({ success: false, error: 'You already have a template with this name' });
+      }
+      logger.error('Create message template error:', error);
+      res.status(500).json({ success: false, error: 'Failed to create message template' });
+    }
+  }
+
+  static async updateMessageTemplate(req, res) {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      const template = await MessageTemplate.findOne({ _id: req.params.id, doctorId: doctor._id });
+      if (!template) {
+        return res.status(404).json({ success: false, error: 'Template not found' });
+      }
+      const { name, content } = req.body;
+      if (content !== undefined) {
+        const contentError = MessageTemplateService.getTemplateContentError(content);
+        if (contentError) {
+          return res.status(400).json({ success: false, error: contentError });
+        }
+        template.content = content;
+      }
+      if (name !== undefined) template.name = name;
+      await template.save();
+      res.json({ success: true, template });
+    } catch (error) {
+      if (error.code === 11000) {
+        return res.status(409).json({ success: false, error: 'You already have a template with this name' });
+      }
+      logger.error('Update message template error:', error);
+      res.status(500).json({ success: false, error: 'Failed to update message template' });
+    }
+  }
+
+  static async deleteMessageTemplate(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      const result = await MessageTemplate.deleteOne({ _id: req.params.id, doctorId: doctor._id });
+      if (result.deletedCount === 0) {
+        return res.status(404).json({ success: false, error: 'Template not found' });
+      }
+      res.json({ success: true, message: 'Template deleted' });
+    } catch (error) {
+      logger.error('Delete message template error:', error);
+      res.status(500).json({ success: false, error: 'Failed to delete message template' });
+    }
+  }
+
+  // Patients the doctor has blocked
+  static async getBlockedPatients(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      const blocks = await Block.find({ doctorId: doctor._id, active: true })
+        .sort({ updatedAt: -1 })
+        .select('-history')
+        .populate('patientId', 'firstName lastName');
+      res.json({ success: true, blocks });
+    } catch (error) {
+      logger.error('Get blocked patients error:', error);
+      res.status(500).json({ success: false, error: 'Failed to fetch blocked patients' });
+    }
+  }
+
+  // Block one of the doctor's patients from booking or messaging them.
+  // Existing appointments and chat history stay as they are, and the patient
+  // isn't told.
+  static async blockPatient(req, res) {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      const { patientId, reason } = req.body;
+      // Only patients who have booked with the doctor, so user IDs can't be probed
+      if (!(await Appointment.exists({ doctorId: doctor._id, patientId }))) {
+        return res.status(404).json({ success: false, error: 'Patient not found' });
+      }
+      const { block, created } = await BlockService.blockPatient(doctor._id, patientId, { userId: req.user._id, role: 'doctor' }, reason);
+      res.status(created ? 201 : 200).json({ success: true, block });
+    } catch (error) {
+      logger.error('Block patient error:', error);
+      res.status(500).json({ success: false, error: 'Failed to block patient' });
+    }
+  }
+
+  static async unblockPatient(req, res) {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ success: false, error: 'Doctor profile not found' });
+      }
+      const block = await Block.findOne({ doctorId: doctor._id, patientId: req.params.patientId, active: true });
+      if (!block) {
+        return res.status(404).json({ success: false, error: 'Block not found' });
+      }
+      if (block.placedBy && block.placedBy.role === 'admin') {
+        return res.status(403).json({ success: false, error: 'This block was placed by an admin; contact support to lift it' });
+      }
+      const updated = await BlockService.unblock(block, { userId: req.user._id, role: 'doctor' });
+      res.json({ success: true, block: updated });
+    } catch (error) {
+      logger.error('Unblock patient error:', error);
+      res.status(500).json({ success: false, error: 'Failed to unblock patient' });
+    }
+  }
+
+  // The doctor's payout history and what they're currently owed
+  static async getMyPayouts(req, res) {
+    try {
+      const doctor = await Doctor.findOne({ userId: req.user._id });
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor profile not found' });
+      }
+
+      const { page = 1, limit = 20 } = req.query;
+      const skip = (Number(page) - 1) * Number(limit);
+
+      const [payouts, total, pending] = await Promise.all([
+        Payout.find({ doctorId: doctor._id })
+          .select('-payments')
+          .sort({ createdAt: -1 })
+          .skip(skip)
+          .limit(Number(limit)),
+        Payout.countDocuments({ doctorId: doctor._id }),
+        PayoutService.getPendingPayout(doctor._id)
+      ]);
+
+      res.json({
+        pending,
+        commissionPercent: PaymentService.getCommissionPercent(doctor),
+        payouts,
+        pagination: {
+          page: Number(page),
+          limit: Number(limit),
+          total,
+          pages: Math.ceil(total / limit)
+        }
+      });
+    } catch (error) {
+      logger.error('Error fetching payouts:', error);
+      res.status(500).json({ message: 'Error fetching payouts' });
+    }
+  }
+
+  // Profile views over time and how many turned into bookings
+  static async getViewStats(req, res) {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+
+      const doctor = await Doctor.findOne({ userId: req.user._id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor profile not found' });
+      }
+
+      const stats = await DoctorViewService.getViewStats(doctor._id, {
+        days: req.query.days ? parseInt(req.query.days, 10) : undefined
+      });
+      res.json(stats);
+    } catch (error) {
+      logger.error('Error fetching profile view stats:', error);
+      res.status(500).json({ message: 'Error fetching profile view stats' });
+    }
+  }
+
+  // Read-only ICS feed of upcoming appointments, authenticated by feed token
+  static async getCalendarFeed(req, res) {
+    try {
+      const { token } = req.query;
+      if (!token) {
+        return res.status(401).json({ message: 'Calendar feed token required' });
+      }
+
+      const tokenHash = crypto.createHash('sha256').update(String(token)).digest('hex');
+      const doctor = await Doctor.findOne({ calendarFeedTokenHash: tokenHash })
+        .populate('userId', 'firstName lastName');
+      if (!doctor) {
+        return res.status(401).json({ message: 'Invalid calendar feed token' });
+      }
+
+      const today = new Date();
+      today.setUTCHours(0, 0, 0, 0);
+      const filter = {
+        doctorId: doctor._id,
+        date: { $gte: today },
+        status: { $in: ['pending', 'confirmed'] }
+      };
+
+      // Calendar clients poll often; answer an unchanged feed before loading
+      // and rendering it. The tag follows the appointments in the feed, the
+      // doctor's profile and the day the feed starts on.
+      const [latest] = await Appointment.aggregate([
+        { $match: filter },
+        { $group: { _id: null, count: { $sum: 1 }, updatedAt: { $max: '$updatedAt' } } }
+      ]);
+      const version = [
+        today.toISOString(),
+        doctor.updatedAt.getTime(),
+        latest ? latest.count : 0,
+        latest ? latest.updatedAt.getTime() : 0
+      ].join(':');
+      const etag = `"${crypto.createHash('sha1').update(version).digest('hex')}"`;
+      res.set('ETag', etag);
+      res.set('Cache-Control', 'private, max-age=300');
+      if (req.get('If-None-Match') === etag) {
+        return res.status(304).end();
+      }
+
+      const appointments = await Appointment.find(filter)
+        .select('patientId patientDetails date startTime endTime timeZone type status updatedAt')
+        .populate('patientId', 'firstName lastName')
+        .sort({ date: 1, startTime: 1 })
+        .lean();
+
+      const events = appointments.map(appointment => {
+        const patientName = appointment.patientDetails && appointment.patientDetails.name
+          ? appointment.patientDetails.name
+          : appointment.patientId
+            ? `${appointment.patientId.firstName} ${appointment.patientId.lastName}`
+            : 'Patient';
+        return {
+          uid: `${appointment._id}@medconnecter`,
+          start: getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone),
+          end: getAppointmentStart(appointment.date, appointment.endTime, appointment.timeZone),
+          summary: `${patientName} (${appointment.type})`,
+          description: `Mode: ${appointment.type}\nStatus: ${appointment.status}`,
+          location: appointment.type === 'in-person' && doctor.clinicLocation
+            ? `${doctor.clinicLocation.address}, ${doctor.clinicLocation.city}`
+            : undefined,
+          status: appointment.status === 'confirmed' ? 'CONFIRMED' : 'TENTATIVE',
+          updatedAt: appointment.updatedAt
+        };
+      });
+
+      const body = buildCalendar(`Dr. ${doctor.userId.lastName} - Appointments`, events, {
+        timeZone: AppointmentService.getScheduleTimeZone(doctor)
+      });
+
+      res.type('text/calendar; charset=utf-8').send(body);
+    } catch (error) {
+      logger.error('Error generating calendar feed:', error);
+      res.status(500).json({ message: 'Error generating calendar feed' });
+    }
+  }
 }
 
 module.exports = DoctorHandler; 
\ No newline at end of file
@@ -0,0 +1,136 @@
+const { validationResult } = require('express-validator');
+const Document = require('../models/document.model');
+const DocumentAccessLog = require('../models/document.access.log.model');
+const Appointment = require('../models/appointment.model');
+const AppointmentService = require('../services/appointment.service');
+const DocumentService = require('../services/document.service');
+const ScanService = require('../services/scan.service');
+const { handlePrivateUpload } = require('../services/upload.service');
+
+// Appointment participants and admins may see an appointment's documents
+const canAccessAppointment = async (appointment, user) => {
+  return user.role === 'admin' || AppointmentService.isAppointmentParticipant(appointment, user);
+};
+
+const DocumentHandler = {
+  // Upload a document to an appointment
+  async uploadDocument(req, res) {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+
+      const { appointmentId } = req.body;
+      const appointment = await Appointment.findById(appointmentId);
+      if (!appointment) {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+      if (!(await AppointmentService.isAppointmentParticipant(appointment, req.user))) {
+        return res.status(403).json({ message: 'Forbidden' });
+      }
+
+      const { key, contentType, scan } = await handlePrivateUpload(req.file, 'document', `documents/${appointment._id}`);
+      const document = await Document.create({
+        appointmentId: appointment._id,
+        uploadedBy: req.user.id,
+        key,
+        fileName: req.file.originalname,
+        contentType,
+        size: req.file.size,
+        scan
+      });
+      ScanService.scanInBackground('document', {
+        id: document._id,
+        key,
+        contentType,
+        fileName: document.fileName,
+        uploadedBy: document.uploadedBy
+      }, req.file.buffer);
+
+      res.status(201).json({
+        id: document._id,
+        appointmentId: document.appointmentId,
+        fileName: document.fileName,
+        contentType: document.contentType,
+        size: document.size,
+        scanStatus: document.scan.status,
+        createdAt: document.createdAt
+      });
+    } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message });
+      }
+      console.error('uploadDocument error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // List the documents of an appointment
+  async getAppointmentDocuments(req, res) {
+    try {
+      const appointment = await Appointment.findById(req.params.appointmentId);
+      if (!appointment) {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+      if (!(await canAccessAppointment(appointment, req.user))) {
+        return res.status(403).json({ message: 'Forbidden' });
+      }
+
+      const documents = await DocumentService.getAppointmentDocuments(appointment._id);
+      res.json({ documents });
+    } catch (error) {
+      console.error('getAppointmentDocuments error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Log the access, then redirect to a short-lived presigned URL
+  async downloadDocument(req, res) {
+    try {
+      const document = await Document.findById(req.params.id);
+      if (!document) {
+        return res.status(404).json({ message: 'Document not found' });
+      }
+
+      const appointment = await Appointment.findById(document.appointmentId);
+      if (!appointment || !(await canAccessAppointment(appointment, req.user))) {
+        return res.status(403).json({ message: 'Forbidden' });
+      }
+      // Quarantined until the malware scan finds it clean
+      if (!ScanService.isServable(document)) {
+        return document.scan.status === 'infected'
+          ? res.status(409).json({ message: 'This document failed the malware scan and can\'t be downloaded', code: 'FILE_INFECTED' })
+          : res.status(409).json({ message: 'This document is still being scanned for malware', code: 'SCAN_PENDING' });
+      }
+
+      const url = await DocumentService.getLoggedDownloadUrl(document, {
+        userId: req.user.id,
+        role: req.user.role,
+        ip: req.ip,
+        userAgent: req.get('user-agent')
+      });
+
+      res.set('Cache-Control', 'no-store');
+      res.redirect(302, url);
+    } catch (error) {
+      console.error('downloadDocument error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Access history of a document (admin only)
+  async getDocumentAccessLog(req, res) {
+    try {
+      const logs = await DocumentAccessLog.find({ documentId: req.params.id })
+        .populate('userId', 'firstName lastName email role')
+        .sort({ accessedAt: -1 });
+      res.json({ logs });
+    } catch (error) {
+      console.error('getDocumentAccessLog error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  }
+};
+
+module.exports = DocumentHandler;
@@ -3,10 +3,11 @@ const User = require('../models/user.model');
 const { sendEmail } = require('../services/aws.service');
 const { NotFoundError, ValidationError } = require('../utils/error.handler');
 const logger = require('../utils/logger');
+const { CURSOR_SORT, decodeCursor, afterCursor, toCursorPage } = require('../utils/pagination');
 
 const NotificationHandler = {
   async getNotifications(req, res) {
-    const { type, read, page = 1, limit = 10 } = req.query;
+    const { type, read, cursor, page = 1, limit = 10 } = req.query;
     const userId = req.user.id;
 
     // Build query
@@ -14,11 +15,17 @@ const NotificationHandler = {
     if (type) query.type = type;
     if (read !== undefined) query.read = read === 'true';
 
-    // Get notifications with pagination
-    const notifications = await Notification.find(query)
-      .sort({ createdAt: -1 })
-      .skip((page - 1) * limit)
-      .limit(Number(limit));
+    const position = cursor && decodeCursor(cursor);
+    if (cursor && !position) {
+      throw new ValidationError('Invalid cursor');
+    }
+
+    // Get notifications by offset, or after the cursor when one is given
+    const found = await Notification.find(position ? afterCursor(query, position) : query)
+      .sort(CURSOR_SORT)
+      .skip(position ? 0 : (page - 1) * limit)
+      .limit(Number(limit) + 1);
+    const { items: notifications, nextCursor } = toCursorPage(found, Number(limit));
 
     // Get total count
     const total = await Notification.countDocuments(query);
@@ -34,8 +41,9 @@ const NotificationHandler = {
     res.json({
       notifications,
       total,
-      page: Number(page),
-      pages: Math.ceil(total / limit)
+      page: position ? undefined : Number(page),
+      pages: position ? undefined : Math.ceil(total / limit),
+      nextCursor
     });
   },
 
@@ -1,8 +1,114 @@
+const crypto = require('crypto');
+const { getFieldErrors } = require('../middleware/validation.middleware');
+const { v4: uuidv4 } = require('uuid');
+const Payment = require('../models/payment.model');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const User = require('../models/user.model');
+const AppointmentService = require('../services/appointment.service');
+const PaymentService = require('../services/payment.service');
+const PayoutService = require('../services/payout.service');
+const DatabaseService = require('../services/database.service');
+const WebhookService = require('../services/webhook.service');
+const notificationService = require('../services/notification.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+const { getVerificationError } = require('../utils/verification');
+const { formatCurrency } = require('../utils/currency');
+
+const isValidWebhookSecret = (provided) => {
+  const expected = config.payments.webhookSecret;
+  if (!expected || !provided) {
+    return false;
+  }
+  const a = Buffer.from(provided);
+  const b = Buffer.from(expected);
+  return a.length === b.length && crypto.timingSafeEqual(a, b);
+};
+
 const PaymentHandler = {
   async initiatePayment(req, res) {
     try {
-      // TODO: Implement payment initiation logic
-      res.status(201).json({ message: 'Payment initiated (stub)' });
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+
+      const verificationError = getVerificationError(req.user);
+      if (verificationError) {
+        return res.status(403).json(verificationError);
+      }
+
+      const { appointmentId, paymentMethod } = req.body;
+
+      const appointment = await Appointment.findById(appointmentId);
+      if (!appointment) {
+        return res.status(404).json({ message: 'Appointment not found' });
+      }
+
+      if (appointment.patientId.toString() !== req.user.id) {
+        return res.status(403).json({ message: 'Not authorized to pay for this appointment' });
+      }
+
+      // Without pay-before-confirm a booking may be confirmed before it is paid
+      if (appointment.status !== 'pending' && appointment.status !== 'confirmed') {
+        return res.status(409).json({ message: 'Only pending or confirmed appointments can be paid' });
+      }
+
+      if (appointment.paymentStatus === 'paid') {
+        return res.status(409).json({ message: 'Appointment is already paid' });
+      }
+
+      if (appointment.paymentStatus === 'held' && appointment.holdExpiresAt > new Date()) {
+        return res.status(409).json({
+          message: 'A payment is already in progress for this appointment',
+          holdExpiresAt: appointment.holdExpiresAt
+        });
+      }
+
+      const doctor = await Doctor.findById(appointment.doctorId);
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor not found' });
+      }
+
+      // The hold and its payment are recorded together, so a failed payment
+      // insert doesn't leave the slot held
+      const result = await DatabaseService.withTransaction(async (session) => {
+        const held = await AppointmentService.placePaymentHold(appointment, { session });
+        if (!held) {
+          return null;
+        }
+        const created = new Payment({
+          appointmentId: appointment._id,
+          patientId: appointment.patientId,
+          doctorId: appointment.doctorId,
+          // Fee snapshotted at booking; older appointments fall back to the doctor's fee
+          amount: appointment.fee != null ? appointment.fee : doctor.consultationFee,
+          currency: doctor.currency || 'EUR',
+          method: paymentMethod,
+          status: 'pending',
+          transactionId: `txn_${uuidv4()}`
+        });
+        await created.save({ session });
+        return { held, payment: created };
+      });
+      if (!result) {
+        return res.status(409).json({ message: 'This time slot is no longer available' });
+      }
+      const { held, payment } = result;
+
+      res.status(201).json({
+        id: payment._id,
+        appointmentId: payment.appointmentId,
+        amount: payment.amount,
+        currency: payment.currency,
+        formattedAmount: formatCurrency(payment.amount, payment.currency),
+        status: payment.status,
+        paymentMethod: payment.method,
+        transactionId: payment.transactionId,
+        holdExpiresAt: held.holdExpiresAt,
+        createdAt: payment.createdAt
+      });
     } catch (error) {
       console.error('initiatePayment error:', error);
       res.status(500).json({ message: 'Server error' });
@@ -10,13 +116,199 @@ const PaymentHandler = {
   },
   async getPaymentById(req, res) {
     try {
-      // TODO: Implement get payment by ID logic
-      res.json({ message: 'Payment details (stub)' });
+      const payment = await Payment.findById(req.params.id);
+      if (!payment) {
+        return res.status(404).json({ message: 'Payment not found' });
+      }
+
+      const isPatient = payment.patientId.toString() === req.user.id;
+      let isDoctor = false;
+      if (!isPatient && req.user.role === 'doctor') {
+        const doctor = await Doctor.findOne({ userId: req.user.id }).select('_id');
+        isDoctor = !!doctor && payment.doctorId.equals(doctor._id);
+      }
+      if (!isPatient && !isDoctor && req.user.role !== 'admin') {
+        return res.status(403).json({ message: 'Not authorized to view this payment' });
+      }
+      // The patient's insurance details are for the invoice, never for the doctor
+      const patient = !isDoctor
+        ? await User.findById(payment.patientId).select('+insurance')
+        : null;
+
+      res.json({
+        id: payment._id,
+        appointmentId: payment.appointmentId,
+        purpose: payment.purpose,
+        amount: payment.amount,
+        currency: payment.currency,
+        formattedAmount: formatCurrency(payment.amount, payment.currency),
+        status: payment.status,
+        paymentMethod: payment.method,
+        transactionId: payment.transactionId,
+        paidAt: payment.paidAt,
+        refundedAmount: payment.refundedAmount,
+        refundedAt: payment.refundedAt,
+        // The commission split is only relevant to the doctor and admins
+        ...(!isPatient && {
+          commissionPercent: payment.commissionPercent,
+          platformFee: payment.platformFee,
+          doctorNet: payment.doctorNet
+        }),
+        ...(!isDoctor && {
+          insurance: (patient && patient.insurance) || null
+        }),
+        createdAt: payment.createdAt
+      });
     } catch (error) {
       console.error('getPaymentById error:', error);
       res.status(500).json({ message: 'Server error' });
     }
+  },
+  async handleWebhook(req, res) {
+    try {
+      if (!isValidWebhookSecret(req.get('x-webhook-secret'))) {
+        return res.status(401).json({ message: 'Invalid webhook signature' });
+      }
+
+      const { event, data } = req.body;
+      if (!event || !data || !data.transactionId) {
+        return res.status(400).json({ message: 'Invalid webhook payload' });
+      }
+
+      const payment = await Payment.findOne({ transactionId: data.transactionId });
+      if (!payment) {
+        return res.status(404).json({ message: 'Payment not found' });
+      }
+
+      // Providers retry webhooks; only act on the first delivery. A payment
+      // the expiry sweeper failed may still succeed at the provider.
+      const isLateSuccess = event === 'payment.succeeded' &&
+        payment.status === 'failed' && payment.holdExpiredAt != null;
+      if (payment.status !== 'pending' && !isLateSuccess) {
+        return res.json({ received: true });
+      }
+
+      if (event === 'payment.succeeded') {
+        payment.status = 'success';
+        payment.paidAt = new Date();
+
+        const doctor = await Doctor.findById(payment.doctorId);
+        PaymentService.applyCommission(payment, doctor);
+
+        // A reschedule fee doesn't pay for the appointment itself
+        if (payment.purpose === 'reschedule-fee') {
+          await AppointmentService.settleRescheduleFee(payment, 'paid');
+        } else {
+          const appointment = isLateSuccess
+            ? await AppointmentService.reattachLatePayment(payment.appointmentId)
+            : await AppointmentService.confirmPayment(payment.appointmentId);
+          // Cancelled, or lost its slot after the hold lapsed: the patient
+          // was charged for nothing, so the payment is refunded in full
+          if (!appointment) {
+            PaymentService.applyRefund(payment, payment.amount);
+            logger.warn('Payment completed for an appointment that can no longer be kept, refunded', {
+              paymentId: payment._id,
+              appointmentId: payment.appointmentId,
+              amount: payment.amount,
+              late: isLateSuccess
+            });
+          }
+          // An auto-accepted booking that waited for its payment is confirmed now
+          const confirmed = appointment && await AppointmentService.confirmAutoAccepted(appointment);
+          if (confirmed) {
+            notificationService.sendAppointmentConfirmation(confirmed)
+              .catch(err => console.error('Appointment confirmation notification error:', err));
+            notificationService.sendAutoAcceptedBookingNotice(confirmed)
+              .catch(err => console.error('Auto-accepted booking notice error:', err));
+          }
+        }
+      } else if (event === 'payment.failed') {
+        payment.status = 'failed';
+        // The new time stands when a reschedule fee fails; the clinic follows up
+        if (payment.purpose === 'reschedule-fee') {
+          await AppointmentService.settleRescheduleFee(payment, 'failed');
+        } else {
+          await AppointmentService.releasePaymentHold(payment.appointmentId);
+        }
+      } else {
+        return res.json({ received: true });
+      }
+
+      payment.updatedAt = new Date();
+      await payment.save();
+      if (payment.status === 'success') {
+        await WebhookService.publishPaymentSucceeded(payment);
+      }
+
+      res.json({ received: true });
+    } catch (error) {
+      console.error('handleWebhook error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+  async processRefund(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+
+      const payment = await Payment.findById(req.params.id);
+      if (!payment) {
+        return res.status(404).json({ message: 'Payment not found' });
+      }
+
+      if (payment.status !== 'success') {
+        return res.status(409).json({ message: 'Only successful payments can be refunded' });
+      }
+
+      const refundable = Math.round((payment.amount - (payment.refundedAmount || 0)) * 100) / 100;
+      const amount = req.body.amount !== undefined ? Number(req.body.amount) : refundable;
+      if (amount <= 0 || amount > refundable) {
+        return res.status(400).json({ message: `Refund amount must be between 0 and ${formatCurrency(refundable, payment.currency)}` });
+      }
+
+      // Payments made before fees were recorded get the breakdown first
+      if (payment.doctorNet == null) {
+        const doctor = await Doctor.findById(payment.doctorId);
+        PaymentService.applyCommission(payment, doctor);
+      }
+
+      const doctorNetBefore = payment.doctorNet;
+      PaymentService.applyRefund(payment, amount);
+      payment.updatedAt = new Date();
+      await payment.save();
+      // The doctor was already paid their share; take it from the next payout
+      await PayoutService.clawBackRefund(payment, doctorNetBefore);
+
+      if (payment.status === 'refunded') {
+        await Appointment.updateOne(
+          { _id: payment.appointmentId },
+          { $set: { paymentStatus: 'refunded' } }
+        );
+      }
+
+      logger.info('Payment refunded', {
+        paymentId: payment._id,
+        amount,
+        reason: req.body.reason
+      });
+
+      res.json({
+        id: payment._id,
+        status: payment.status,
+        amount: payment.amount,
+        currency: payment.currency,
+        refundedAmount: payment.refundedAmount,
+        formattedRefundedAmount: formatCurrency(payment.refundedAmount, payment.currency),
+        platformFee: payment.platformFee,
+        doctorNet: payment.doctorNet
+      });
+    } catch (error) {
+      console.error('processRefund error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
   }
 };
 
-module.exports = PaymentHandler; 
\ No newline at end of file
+module.exports = PaymentHandler;
@@ -4,6 +4,8 @@ const { validationResult } = require('express-validator');
 const Doctor = require('../models/doctor.model');
 const User = require('../models/user.model');
 const logger = require('../utils/logger');
+const notificationService = require('../services/notification.service');
+const ReviewService = require('../services/review.service');
 
 const ReviewHandler = {
   /**
@@ -14,7 +16,7 @@ const ReviewHandler = {
   async createReview(req, res) {
     try {
       const { doctorId, appointmentId, rating, comment } = req.body;
-      const userId = req.user.userId;
+      const userId = req.user.id;
 
       // Validate appointment exists and belongs to user
       const appointment = await Appointment.findOne({
@@ -46,12 +48,16 @@ const ReviewHandler = {
         userId,
         appointmentId,
         rating,
-        comment
+        comment,
+        isVerified: ReviewService.isVerifiedAppointment(appointment)
       });
 
       // Populate user details
       await review.populate('userId', 'firstName lastName avatarUrl');
 
+      notificationService.sendNewReviewNotification(review)
+        .catch(err => logger.error('New review notification error:', err));
+
       res.status(201).json({
         success: true,
         review
@@ -97,13 +103,14 @@ const ReviewHandler = {
       // Get total count
       const total = await Review.countDocuments({ doctorId });
 
-      // Calculate average rating
+      // Calculate average rating; only verified reviews count towards it
       const ratingStats = await Review.aggregate([
         { $match: { doctorId: doctor._id } },
         {
           $group: {
             _id: null,
-            averageRating: { $avg: '$rating' },
+            verifiedRatingSum: { $sum: { $cond: ['$isVerified', '$rating', 0] } },
+            verifiedReviews: { $sum: { $cond: ['$isVerified', 1, 0] } },
             totalReviews: { $sum: 1 },
             ratingDistribution: {
               $push: {
@@ -126,6 +133,12 @@ const ReviewHandler = {
         });
       }
 
+      const verifiedReviews = ratingStats.length > 0 ? ratingStats[0].verifiedReviews : 0;
+      const ratingSummary = ReviewService.getRatingSummary({
+        rating: verifiedReviews > 0 ? ratingStats[0].verifiedRatingSum / verifiedReviews : 0,
+        totalReviews: verifiedReviews
+      });
+
       res.json({
         success: true,
         reviews,
@@ -136,8 +149,11 @@ const ReviewHandler = {
           pages: Math.ceil(total / limit)
         },
         stats: {
-          averageRating: ratingStats.length > 0 ? ratingStats[0].averageRating : 0,
+          // Withheld (null, with a label) below the minimum number of verified reviews
+          averageRating: ratingSummary.average,
+          ratingLabel: ratingSummary.label,
           totalReviews: ratingStats.length > 0 ? ratingStats[0].totalReviews : 0,
+          verifiedReviews,
           ratingDistribution
         }
       });
@@ -157,7 +173,7 @@ const ReviewHandler = {
    */
   async getUserReviews(req, res) {
     try {
-      const userId = req.user.userId;
+      const userId = req.user.id;
       const { page = 1, limit = 10 } = req.query;
 
       // Calculate pagination
@@ -199,9 +215,9 @@ const ReviewHandler = {
    */
   async updateReview(req, res) {
     try {
-      const { reviewId } = req.params;
+      const { id: reviewId } = req.params;
       const { rating, comment } = req.body;
-      const userId = req.user.userId;
+      const userId = req.user.id;
 
       // Find review and check ownership
       const review = await Review.findOne({ _id: reviewId, userId });
@@ -240,8 +256,8 @@ const ReviewHandler = {
    */
   async deleteReview(req, res) {
     try {
-      const { reviewId } = req.params;
-      const userId = req.user.userId;
+      const { id: reviewId } = req.params;
+      const userId = req.user.id;
 
       // Find review and check ownership
       const review = await Review.findOne({ _id: reviewId, userId });
@@ -253,7 +269,7 @@ const ReviewHandler = {
       }
 
       // Delete review
-      await review.remove();
+      await review.deleteOne();
 
       res.json({
         success: true,
@@ -268,6 +284,59 @@ const ReviewHandler = {
     }
   },
 
+  /**
+   * Post the doctor's public reply to a review (one per review)
+   * @param {Object} req - Express request object
+   * @param {Object} res - Express response object
+   */
+  async replyToReview(req, res) {
+    try {
+      const { id } = req.params;
+      const { text } = req.body;
+
+      const doctor = await Doctor.findOne({ userId: req.user.id });
+      if (!doctor) {
+        return res.status(404).json({
+          success: false,
+          error: 'Doctor profile not found'
+        });
+      }
+
+      const review = await Review.findOne({ _id: id, doctorId: doctor._id });
+      if (!review) {
+        return res.status(404).json({
+          success: false,
+          error: 'Review not found or unauthorized'
+        });
+      }
+
+      // Only the reply is written; the patient's rating and comment stay untouched
+      const updated = await Review.findOneAndUpdate(
+        { _id: id, doctorId: doctor._id, 'reply.text': { $exists: false } },
+        { $set: { reply: { text, createdAt: new Date() } } },
+        { new: true }
+      ).populate('userId', 'firstName lastName avatarUrl');
+
+      if (!updated) {
+        return res.status(409).json({
+          success: false,
+          error: 'A reply has already been posted for this review'
+        });
+      }
+
+      res.status(201).json({
+        success: true,
+        review: updated
+      });
+    } catch (error) {
+      logger.error('Reply to review error:', error);
+      res.status(500).json({
+        success: false,
+        error: 'Failed to post reply'
+      });
+    }
+  },
+
   async getMyReviews(req, res) {
     try {
       // TODO: Implement get my reviews logic
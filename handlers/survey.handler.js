@@ -0,0 +1,98 @@
+const Survey = require('../models/survey.model');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const { getFieldErrors } = require('../middleware/validation.middleware');
+const SurveyService = require('../services/survey.service');
+
+const SurveyHandler = {
+  // Patient submits the survey for one of their completed appointments
+  async submitSurvey(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const { appointmentId, waitTime, communication, wouldRecommend, comment } = req.body;
+      const appointment = await Appointment.findOne({
+        _id: appointmentId,
+        patientId: req.user.id,
+        status: 'completed'
+      });
+      if (!appointment) {
+        return res.status(404).json({ message: 'Completed appointment not found' });
+      }
+      if (await Survey.exists({ appointmentId })) {
+        return res.status(409).json({ message: 'A survey has already been submitted for this appointment' });
+      }
+      const survey = await Survey.create({
+        appointmentId,
+        doctorId: appointment.doctorId,
+        patientId: req.user.id,
+        waitTime,
+        communication,
+        wouldRecommend,
+        comment
+      });
+      res.status(201).json({
+        id: survey._id,
+        appointmentId: survey.appointmentId,
+        waitTime: survey.waitTime,
+        communication: survey.communication,
+        wouldRecommend: survey.wouldRecommend,
+        comment: survey.comment,
+        createdAt: survey.createdAt
+      });
+    } catch (error) {
+      // The unique index catches two submissions racing each other
+      if (error.code === 11000) {
+        return res.status(409).json({ message: 'A survey has already been submitted for this appointment' });
+      }
+      console.error('submitSurvey error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // The authenticated doctor's own quality metrics
+  async getMyMetrics(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const doctor = await Doctor.findOne({ userId: req.user.id }).select('_id');
+      if (!doctor) {
+        return res.status(404).json({ message: 'Doctor profile not found' });
+      }
+      const [metrics] = await SurveyService.getQualityMetrics({
+        doctorId: doctor._id,
+        from: req.query.from,
+        to: req.query.to
+      });
+      res.json(metrics || { doctorId: doctor._id, responses: 0 });
+    } catch (error) {
+      console.error('getMyMetrics error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Quality metrics for all doctors, or one with doctorId (admin only)
+  async getMetrics(req, res) {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const metrics = await SurveyService.getQualityMetrics({
+        doctorId: req.query.doctorId,
+        from: req.query.from,
+        to: req.query.to
+      });
+      res.json({ metrics });
+    } catch (error) {
+      console.error('getMetrics error:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  }
+};
+
+module.exports = SurveyHandler;
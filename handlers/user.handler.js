@@ -1,12 +1,30 @@
 const User = require('../models/user.model');
-const AWSService = require('../services/aws.service');
+const { handleUpload } = require('../services/upload.service');
 const { validationResult } = require('express-validator');
+const { normalizePhoneNumber } = require('../utils/phone');
+const { getFieldErrors } = require('../middleware/validation.middleware');
+const { getReminderSettings, getReminderSettingsErrors } = require('../services/reminder.service');
+const InsuranceService = require('../services/insurance.service');
+const { toCsvRow } = require('../utils/csv');
+const config = require('../config/config');
+
+const DAY_MS = 24 * 60 * 60 * 1000;
+
+const formatReminderSettings = (user) => ({
+  ...getReminderSettings(user),
+  options: {
+    channels: config.reminders.channels,
+    leadTimesMinutes: config.reminders.allowedLeadTimesMinutes,
+    maxLeadTimes: config.reminders.maxLeadTimes
+  }
+});
 
 const UserHandler = {
   // Get user profile
   getProfile: async (req, res) => {
     try {
-      const user = await User.findById(req.user.id);
+      // Insurance details are only ever returned to the user themselves (and admins)
+      const user = await User.findById(req.user.id).select('+insurance');
       if (!user) {
         return res.status(404).json({ message: 'User not found' });
       }
@@ -25,20 +43,49 @@ const UserHandler = {
         return res.status(400).json({ errors: errors.array() });
       }
 
-      const { firstName, lastName, phone, address, languages } = req.body;
+      const { firstName, lastName, phone, address, languages, notificationPreferences, smsConsent, insurance } = req.body;
       const updateData = {};
+      const unsetData = {};
 
       if (firstName) updateData.firstName = firstName;
       if (lastName) updateData.lastName = lastName;
-      if (phone) updateData.phone = phone;
+      if (phone) {
+        const normalized = normalizePhoneNumber(phone);
+        if (!normalized) {
+          return res.status(400).json({ message: 'Invalid phone number' });
+        }
+        const current = req.user.phone || {};
+        if (normalized.number !== current.number || normalized.countryCode !== current.countryCode) {
+          updateData.phone = normalized;
+          updateData.isPhoneVerified = false;
+        }
+      }
       if (address) updateData.address = address;
       if (languages) updateData.languages = languages;
+      if (notificationPreferences && typeof notificationPreferences.reviewEmails === 'boolean') {
+        updateData['notificationPreferences.reviewEmails'] = notificationPreferences.reviewEmails;
+      }
+      // null removes the insurance details
+      if (insurance === null) {
+        unsetData.insurance = 1;
+      } else if (insurance !== undefined) {
+        const insuranceErrors = InsuranceService.getInsuranceErrors(insurance);
+        if (insuranceErrors) {
+          return res.status(400).json({ message: 'Validation Error', errors: insuranceErrors });
+        }
+        updateData.insurance = InsuranceService.normalizeInsurance(insurance);
+      }
+      const currentConsent = !!(req.user.smsConsent && req.user.smsConsent.granted);
+      if (typeof smsConsent === 'boolean' && smsConsent !== currentConsent) {
+        updateData['smsConsent.granted'] = smsConsent;
+        updateData[smsConsent ? 'smsConsent.grantedAt' : 'smsConsent.withdrawnAt'] = new Date();
+      }
 
       const user = await User.findByIdAndUpdate(
         req.user.id,
-        { $set: updateData },
+        { $set: updateData, $unset: unsetData },
         { new: true }
-      );
+      ).select('+insurance');
 
       if (!user) {
         return res.status(404).json({ message: 'User not found' });
@@ -46,6 +93,9 @@ const UserHandler = {
 
       res.json({ message: 'Profile updated successfully', user });
     } catch (error) {
+      if (error.code === 11000 && error.keyPattern && error.keyPattern['phone.number']) {
+        return res.status(409).json({ message: 'Phone number is already in use' });
+      }
       console.error('Error in updateProfile:', error);
       res.status(500).json({ message: 'Server error' });
     }
@@ -54,31 +104,116 @@ const UserHandler = {
   // Update profile picture
   updateProfilePicture: async (req, res) => {
     try {
-      if (!req.file) {
-        return res.status(400).json({ message: 'No file uploaded' });
-      }
-
       const user = await User.findById(req.user.id);
       if (!user) {
         return res.status(404).json({ message: 'User not found' });
       }
 
-      // Upload to S3 using the correct method
-      const avatarUrl = await AWSService.uploadToS3(
-        req.file.buffer,
-        req.file.originalname,
-        req.file.mimetype
-      );
+      // Validate against the profile image limits and upload to S3
+      const avatarUrl = await handleUpload(req.file, 'profileImage', req.user.id);
 
       // Update user's avatar URL
-      user.avatar = avatarUrl;
+      user.avatarUrl = avatarUrl;
       await user.save();
 
       res.json({ message: 'Profile picture updated successfully', avatarUrl });
     } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message });
+      }
       console.error('Error in updateProfilePicture:', error);
       res.status(500).json({ message: 'Server error' });
     }
+  },
+
+  // Completed, paid appointments in a period for submitting to the patient's
+  // insurer, as CSV or JSON. Defaults to the current calendar year.
+  getClaims: async (req, res) => {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+      const to = req.query.to ? new Date(req.query.to) : new Date();
+      const from = req.query.from ? new Date(req.query.from) : new Date(Date.UTC(to.getUTCFullYear(), 0, 1));
+      if (from > to || to - from > config.insurance.claimsMaxDays * DAY_MS) {
+        return res.status(400).json({
+          message: 'Validation Error',
+          errors: { from: `The period must run forwards and cover at most ${config.insurance.claimsMaxDays} days` }
+        });
+      }
+
+      const user = await User.findById(req.user.id).select('+insurance');
+      if (!user) {
+        return res.status(404).json({ message: 'User not found' });
+      }
+      const claims = await InsuranceService.getClaimableAppointments(user._id, from, to);
+      const columns = InsuranceService.CLAIM_COLUMNS;
+      const rows = claims.map(claim => InsuranceService.toClaimRow(claim, user));
+
+      if (req.query.format === 'csv') {
+        const period = `${from.toISOString().slice(0, 10)}_${to.toISOString().slice(0, 10)}`;
+        res.set('Content-Type', 'text/csv; charset=utf-8');
+        res.set('Content-Disposition', `attachment; filename="claims_${period}.csv"`);
+        return res.send(toCsvRow(columns) + rows.map(row => toCsvRow(columns.map(column => row[column]))).join(''));
+      }
+      res.json({ from, to, insurance: user.insurance || null, columns, claims: rows });
+    } catch (error) {
+      console.error('Error in getClaims:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Get appointment reminder settings (role defaults until the user saves their own)
+  getReminderSettings: async (req, res) => {
+    try {
+      const user = await User.findById(req.user.id);
+      if (!user) {
+        return res.status(404).json({ message: 'User not found' });
+      }
+      res.json(formatReminderSettings(user));
+    } catch (error) {
+      console.error('Error in getReminderSettings:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
+  },
+
+  // Replace appointment reminder settings; no channels turns reminders off
+  updateReminderSettings: async (req, res) => {
+    try {
+      const fieldErrors = getFieldErrors(req);
+      if (fieldErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: fieldErrors });
+      }
+
+      const user = await User.findById(req.user.id);
+      if (!user) {
+        return res.status(404).json({ message: 'User not found' });
+      }
+
+      // Either field may be left out to keep its current (or default) value
+      const current = getReminderSettings(user);
+      const settings = {
+        channels: req.body.channels || current.channels,
+        leadTimesMinutes: (req.body.leadTimesMinutes || current.leadTimesMinutes).map(Number)
+      };
+      const settingsErrors = getReminderSettingsErrors(user, settings);
+      if (settingsErrors) {
+        return res.status(400).json({ message: 'Validation Error', errors: settingsErrors });
+      }
+
+      user.reminderSettings = {
+        channels: settings.channels,
+        leadTimesMinutes: [...settings.leadTimesMinutes].sort((a, b) => b - a),
+        updatedAt: new Date()
+      };
+      await user.save();
+
+      res.json({ message: 'Reminder settings updated successfully', settings: formatReminderSettings(user) });
+    } catch (error) {
+      console.error('Error in updateReminderSettings:', error);
+      res.status(500).json({ message: 'Server error' });
+    }
   }
 };
 
@@ -3,6 +3,61 @@ const Appointment = require('../models/appointment.model');
 const User = require('../models/user.model');
 const Doctor = require('../models/doctor.model');
 const { sendEmail } = require('../services/aws.service');
+const AppointmentService = require('../services/appointment.service');
+const AppointmentStatusService = require('../services/appointment.status.service');
+const notificationService = require('../services/notification.service');
+const logger = require('../utils/logger');
+const config = require('../config/config');
+
+// Responses for each reason AppointmentService.getVideoCallError gives
+const VIDEO_CALL_ERRORS = {
+  'not-video': { status: 400, message: 'This appointment is not scheduled for video consultation', code: 'NOT_VIDEO_APPOINTMENT' },
+  'not-confirmed': { status: 409, message: 'Video calls are only available for confirmed appointments', code: 'APPOINTMENT_NOT_CONFIRMED' },
+  unpaid: { status: 409, message: 'The appointment must be paid before the video call', code: 'PAYMENT_REQUIRED' },
+  early: {
+    status: 403,
+    message: `Video sessions open ${config.videoCall.joinEarlyGraceMinutes} minutes before the appointment starts`,
+    code: 'VIDEO_JOIN_TOO_EARLY'
+  },
+  late: {
+    status: 403,
+    message: `Video sessions close ${config.videoCall.joinLateGraceMinutes} minutes after the appointment ends`,
+    code: 'VIDEO_JOIN_TOO_LATE'
+  }
+};
+
+const sendVideoCallError = (res, reason) => {
+  const { status, message, code } = VIDEO_CALL_ERRORS[reason];
+  return res.status(status).json({ message, code });
+};
+
+const PARTICIPANT_ROLES = ['doctor', 'patient'];
+
+// Waiting room view of a session: who has joined, and whether the call is
+// ready (both present), waiting for someone or over
+const getWaitingRoomStatus = (session) => {
+  const participants = {};
+  PARTICIPANT_ROLES.forEach(role => {
+    const state = (session.participants && session.participants[role]) || {};
+    participants[role] = {
+      joined: !!state.joinedAt,
+      joinedAt: state.joinedAt || null,
+      lastJoinedAt: state.lastJoinedAt || null
+    };
+  });
+  const waitingFor = PARTICIPANT_ROLES.filter(role => !participants[role].joined);
+  let state = waitingFor.length === 0 ? 'ready' : 'waiting';
+  if (['ended', 'cancelled'].includes(session.status)) {
+    state = 'ended';
+  }
+  return {
+    sessionId: session._id,
+    status: session.status,
+    state,
+    participants,
+    waitingFor: state === 'waiting' ? waitingFor : []
+  };
+};
 
 const VideoHandler = {
   async createSession(req, res) {
@@ -25,23 +80,22 @@ const VideoHandler = {
         return res.status(403).json({ message: 'Not authorized to access this appointment' });
       }
 
-      // Check if appointment is scheduled for video consultation
-      if (appointment.type !== 'video') {
-        return res.status(400).json({ message: 'This appointment is not scheduled for video consultation' });
+      const callError = AppointmentService.getVideoCallError(appointment);
+      if (callError) {
+        return sendVideoCallError(res, callError);
       }
 
-      // Check if appointment is in the future
-      if (new Date(appointment.scheduledAt) > new Date()) {
-        return res.status(400).json({ message: 'Cannot start video session before scheduled time' });
+      const openSession = await VideoSession.findOne({ appointmentId, status: { $in: ['scheduled', 'active'] } });
+      if (openSession) {
+        return res.status(409).json({ message: 'A video session is already open for this appointment', sessionId: openSession._id });
       }
 
-      // Create video session
+      // Create video session; it becomes active when the first participant joins
       const session = new VideoSession({
         appointmentId,
         doctorId: appointment.doctorId._id,
         patientId: appointment.patientId._id,
-        status: 'active',
-        startTime: new Date()
+        status: 'scheduled'
       });
 
       await session.save();
@@ -87,17 +141,16 @@ const VideoHandler = {
         return res.status(403).json({ message: 'Not authorized to end this session' });
       }
 
-      // Update session status
+      // Update session status; the call lasted from the first join until now
       session.status = 'ended';
-      session.endTime = new Date();
+      session.endedAt = new Date();
+      session.duration = session.startedAt
+        ? Math.round((session.endedAt - session.startedAt) / 1000)
+        : 0;
       await session.save();
 
-      // Update appointment status if needed
-      if (session.appointmentId.status === 'in-progress') {
-        session.appointmentId.status = 'completed';
-        await session.appointmentId.save();
-      }
-
+      // The appointment itself is completed by the doctor or the auto-complete
+      // job, through the status service
       res.json({ message: 'Video session ended successfully', session });
     } catch (error) {
       console.error('End video session error:', error);
@@ -140,29 +193,130 @@ const VideoHandler = {
       const session = await VideoSession.findById(sessionId)
         .populate('appointmentId');
 
-      if (!session) {
+      if (!session || !session.appointmentId) {
         return res.status(404).json({ message: 'Video session not found' });
       }
 
       // Verify user is either the doctor or patient
-      if (session.doctorId.toString() !== userId && 
-          session.patientId.toString() !== userId) {
+      const role = await AppointmentStatusService.getActorRole(session.appointmentId, req.user);
+      if (!PARTICIPANT_ROLES.includes(role)) {
         return res.status(403).json({ message: 'Not authorized to join this session' });
       }
 
-      // Check if session is active
-      if (session.status !== 'active') {
+      if (!['scheduled', 'active'].includes(session.status)) {
         return res.status(400).json({ message: 'Video session is not active' });
       }
 
+      const callError = AppointmentService.getVideoCallError(session.appointmentId);
+      if (callError) {
+        return sendVideoCallError(res, callError);
+      }
+
+      // The first join starts the call
+      const now = new Date();
+      if (!session.startedAt) {
+        session.startedAt = now;
+        session.status = 'active';
+        session.updatedAt = session.startedAt;
+        await session.save();
+      }
+
+      // Record the join. Only the request that sets joinedAt tells the other
+      // party, so a rejoin or a concurrent retry doesn't notify twice.
+      const firstJoin = await VideoSession.findOneAndUpdate(
+        { _id: session._id, [`participants.${role}.joinedAt`]: null },
+        { $set: { [`participants.${role}.joinedAt`]: now, [`participants.${role}.lastJoinedAt`]: now } },
+        { new: true }
+      );
+      const updated = firstJoin || await VideoSession.findByIdAndUpdate(
+        session._id,
+        { $set: { [`participants.${role}.lastJoinedAt`]: now } },
+        { new: true }
+      );
+      const otherRole = role === 'doctor' ? 'patient' : 'doctor';
+      if (firstJoin && firstJoin.participants[otherRole] && firstJoin.participants[otherRole].joinedAt) {
+        notificationService.sendWaitingRoomJoinNotice(session.appointmentId, otherRole)
+          .catch(error => logger.error('Waiting room notice failed:', error));
+      }
+
       // Generate token for video call
       const token = await generateVideoToken(sessionId, userId);
 
-      res.json({ token, session });
+      res.json({
+        token,
+        session: updated,
+        // Language agreed for the consultation at booking, if any
+        language: session.appointmentId.language || null,
+        waitingRoom: getWaitingRoomStatus(updated)
+      });
     } catch (error) {
       console.error('Join session error:', error);
       res.status(500).json({ message: 'Server error joining session' });
     }
+  },
+
+  // Who is in the waiting room, polled by both parties before the call
+  async getSessionStatus(req, res) {
+    try {
+      const session = await VideoSession.findById(req.params.sessionId)
+        .populate('appointmentId');
+
+      if (!session || !session.appointmentId) {
+        return res.status(404).json({ message: 'Video session not found' });
+      }
+
+      if (!(await AppointmentService.isAppointmentParticipant(session.appointmentId, req.user))) {
+        return res.status(403).json({ message: 'Not authorized to view this session' });
+      }
+
+      res.json(getWaitingRoomStatus(session));
+    } catch (error) {
+      console.error('Get session status error:', error);
+      res.status(500).json({ message: 'Server error retrieving session status' });
+    }
+  },
+
+  // Issue a fresh token for the same room after a dropped call
+  async reconnectSession(req, res) {
+    try {
+      const { sessionId } = req.params;
+      const userId = req.user.id;
+
+      const session = await VideoSession.findById(sessionId)
+        .populate('appointmentId');
+
+      if (!session || !session.appointmentId) {
+        return res.status(404).json({ message: 'Video session not found' });
+      }
+
+      const appointment = session.appointmentId;
+      if (!(await AppointmentService.isAppointmentParticipant(appointment, req.user))) {
+        return res.status(403).json({ message: 'Not authorized to join this session' });
+      }
+
+      if (session.status !== 'active') {
+        return res.status(409).json({ message: 'Video session is not active' });
+      }
+
+      const callError = AppointmentService.getVideoCallError(appointment);
+      if (callError) {
+        return sendVideoCallError(res, callError);
+      }
+
+      const token = await generateVideoToken(sessionId, userId);
+      session.sessionToken = token;
+      session.updatedAt = new Date();
+      await session.save();
+
+      res.json({
+        sessionId: session._id,
+        roomId: session.roomId,
+        token
+      });
+    } catch (error) {
+      console.error('Reconnect session error:', error);
+      res.status(500).json({ message: 'Server error reconnecting to session' });
+    }
   }
 };
 
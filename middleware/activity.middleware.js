@@ -0,0 +1,40 @@
+const User = require('../models/user.model');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+/**
+ * Whether a user's last-seen time is stale enough to be written again
+ * @param {Date} lastActiveAt - The stored last-seen time, if any
+ * @param {Date} now - Reference time
+ * @returns {boolean}
+ */
+const isActivityStale = (lastActiveAt, now = new Date()) => {
+  const intervalMs = config.activity.updateIntervalMinutes * 60 * 1000;
+  return !lastActiveAt || now.getTime() - new Date(lastActiveAt).getTime() >= intervalMs;
+};
+
+// Records when the authenticated user was last active. Runs after
+// authentication, so req.user is the freshly loaded user; at most one write per
+// user per interval, and the request never waits for it.
+const activityMiddleware = (req, res, next) => {
+  const user = req.user;
+  const now = new Date();
+
+  if (user && isActivityStale(user.lastActiveAt, now)) {
+    const staleBefore = new Date(now.getTime() - config.activity.updateIntervalMinutes * 60 * 1000);
+    // Conditional so concurrent requests from the same user write only once
+    User.updateOne(
+      {
+        _id: user._id,
+        $or: [{ lastActiveAt: { $exists: false } }, { lastActiveAt: { $lte: staleBefore } }]
+      },
+      { $set: { lastActiveAt: now } }
+    ).catch(error => logger.error('Failed to record user activity:', error));
+    user.lastActiveAt = now;
+  }
+
+  next();
+};
+
+module.exports = activityMiddleware;
+module.exports.isActivityStale = isActivityStale;
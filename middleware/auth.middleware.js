@@ -3,7 +3,9 @@ const config = require('../config/config');
 const Session = require('../models/session.model');
 const User = require('../models/user.model');
 const Doctor = require('../models/doctor.model');
+const TokenService = require('../services/token.service');
 const logger = require('../utils/logger');
+const activityMiddleware = require('./activity.middleware');
 
 class AuthMiddleware {
   // Verify JWT token and session
@@ -22,7 +24,16 @@ class AuthMiddleware {
       
       try {
         const decoded = verifyToken(token);
-        
+
+        // Tokens revoked on logout; ones issued before jti was added can't
+        // be, but expire within minutes
+        if (decoded.jti && await TokenService.isAccessTokenRevoked(decoded.jti)) {
+          return res.status(401).json({
+            success: false,
+            error: 'Token has been revoked'
+          });
+        }
+
         // Find user and check if they exist
         const user = await User.findById(decoded.userId);
         if (!user) {
@@ -57,13 +68,17 @@ class AuthMiddleware {
         // Attach user and session to request object
         req.user = user;
         req.token = token;
+        req.tokenPayload = decoded;
         req.session = session;
-        next();
+        activityMiddleware(req, res, next);
       } catch (error) {
         logger.error('Token verification error:', error);
+        // Access tokens are short-lived; TOKEN_EXPIRED tells clients to use
+        // their refresh token at /auth/refresh
         return res.status(401).json({
           success: false,
-          error: error.message || 'Invalid token'
+          error: error.message || 'Invalid token',
+          ...(error.message === 'Token has expired' && { code: 'TOKEN_EXPIRED' })
         });
       }
     } catch (error) {
@@ -163,6 +178,28 @@ class AuthMiddleware {
     next();
   }
 
+  // Restrict a route (or a whole router) to the given roles. Unlike
+  // authorize(), admins are not let through unless listed explicitly.
+  static requireRole(...roles) {
+    return (req, res, next) => {
+      if (!req.user) {
+        return res.status(401).json({
+          success: false,
+          error: 'Authentication required'
+        });
+      }
+
+      if (!roles.includes(req.user.role)) {
+        return res.status(403).json({
+          success: false,
+          error: 'Insufficient permissions'
+        });
+      }
+
+      next();
+    };
+  }
+
   // Check if user is a doctor
   static requireDoctor(req, res, next) {
     if (req.user.role !== 'doctor' && req.user.role !== 'admin') {
@@ -0,0 +1,39 @@
+const logger = require('../utils/logger');
+
+const BODY_METHODS = ['POST', 'PUT', 'PATCH', 'DELETE'];
+
+// Whether the request carries a body at all; bodiless POSTs such as joining a
+// video session don't need a Content-Type
+const hasBody = (req) => {
+  return req.headers['transfer-encoding'] !== undefined ||
+    parseInt(req.headers['content-length'], 10) > 0;
+};
+
+// Mutating endpoints only accept JSON. Anything else, such as a form-encoded
+// body, would otherwise be left unparsed and fail validation with confusing
+// errors. Multipart bodies pass through for the upload routes, which check
+// them with requireMultipart.
+const requireJson = (req, res, next) => {
+  if (!BODY_METHODS.includes(req.method) || !hasBody(req)) {
+    return next();
+  }
+  if (req.is('application/json') || req.is('multipart/form-data')) {
+    return next();
+  }
+
+  logger.warn(`Unsupported Content-Type on ${req.method} ${req.originalUrl}: ${req.headers['content-type']}`);
+  res.status(415).json({ message: 'Content-Type must be application/json' });
+};
+
+// Upload endpoints take their file as multipart/form-data
+const requireMultipart = (req, res, next) => {
+  if (!req.is('multipart/form-data')) {
+    return res.status(415).json({ message: 'Content-Type must be multipart/form-data' });
+  }
+  next();
+};
+
+module.exports = {
+  requireJson,
+  requireMultipart
+};
@@ -0,0 +1,58 @@
+const config = require('../config/config');
+const { isTimeoutError } = require('../utils/error.handler');
+
+// Only reads get a deadline. A write can't be called back once the database
+// has it, so a mutating request runs to completion rather than risk
+// reporting a failure for a write that still commits.
+const DEADLINE_METHODS = ['GET', 'HEAD'];
+
+/**
+ * Deadline for a path: the first matching route override, or the default
+ * @param {string} path - Path within the API, e.g. /admin/analytics
+ * @param {Object} timeouts - { defaultMs, routes: [{ pattern, ms }] }
+ * @returns {number} - Milliseconds, 0 for no deadline
+ */
+const getTimeoutMs = (path, timeouts = config.requestTimeouts) => {
+  const route = timeouts.routes.find(entry => entry.pattern.test(path));
+  return route ? route.ms : timeouts.defaultMs;
+};
+
+/**
+ * Time left before a request's deadline, for capping database work with
+ * maxTimeMS so a query is cancelled when the request runs out of time
+ * @param {Object} req - Express request
+ * @returns {Object} - { maxTimeMS } to pass as query options, empty without a deadline
+ */
+const getQueryOptions = (req) => {
+  if (!req.deadline) {
+    return {};
+  }
+  return { maxTimeMS: Math.max(1, req.deadline - Date.now()) };
+};
+
+/**
+ * Set a per-route deadline on read requests: req.deadline, for handlers to
+ * cap their queries with (see getQueryOptions), and req.signal, aborted at
+ * the deadline for work that isn't a query. Handlers answer 503 when that
+ * work is cancelled (see isTimeoutError). Mount it on the API router, as
+ * route patterns are matched against the path within the API.
+ * @param {Object} timeouts - Defaults to config.requestTimeouts
+ * @returns {Function} - Express middleware
+ */
+const requestTimeout = (timeouts = config.requestTimeouts) => (req, res, next) => {
+  const ms = DEADLINE_METHODS.includes(req.method) ? getTimeoutMs(req.path, timeouts) : 0;
+  if (!ms) {
+    return next();
+  }
+
+  req.deadline = Date.now() + ms;
+  req.signal = AbortSignal.timeout(ms);
+  next();
+};
+
+module.exports = {
+  getTimeoutMs,
+  getQueryOptions,
+  isTimeoutError,
+  requestTimeout
+};
@@ -1,7 +1,9 @@
 const multer = require('multer');
 const s3Service = require('../services/aws/s3.service');
+const { getUploadConstraints } = require('../services/upload.service');
 const crypto = require('crypto');
 const path = require('path');
+const { requireMultipart } = require('./content-type.middleware');
 
 // Configure multer for memory storage
 const upload = multer({
@@ -28,6 +30,29 @@ const upload = multer({
   }
 });
 
+// Accept a single in-memory file for an upload category, sent as
+// multipart/form-data (415 otherwise). The body is capped at
+// the category's size limit so oversized files are rejected with a 413 before
+// they are fully buffered; type checks happen later in handleUpload.
+const singleUpload = (category, field) => {
+  const { maxSize } = getUploadConstraints(category);
+  const uploader = multer({
+    storage: multer.memoryStorage(),
+    limits: { fileSize: maxSize }
+  }).single(field);
+
+  return (req, res, next) => {
+    requireMultipart(req, res, () => {
+      uploader(req, res, (err) => {
+        if (err && err.code === 'LIMIT_FILE_SIZE') {
+          return res.status(413).json({ message: `File exceeds the maximum size of ${maxSize} bytes` });
+        }
+        next(err);
+      });
+    });
+  };
+};
+
 // Middleware to upload file to S3
 const uploadToS3 = async (req, res, next) => {
   try {
@@ -94,6 +119,7 @@ const getUploadUrl = async (req, res) => {
 
 module.exports = {
   upload,
+  singleUpload,
   uploadToS3,
   getUploadUrl
 }; 
\ No newline at end of file
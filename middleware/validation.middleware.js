@@ -19,7 +19,7 @@ const validate = (validations) => {
           status: 'error',
           message: 'Validation Error',
           errors: errors.array().map(err => ({
-            field: err.param,
+            field: err.path,
             message: err.msg
           }))
         }
@@ -29,6 +29,48 @@ const validate = (validations) => {
   };
 };
 
+/**
+ * Collect validation errors as a map of field name to message, keeping the
+ * first failure for each field so clients can show it next to the input
+ * @param {Object} req - Express request the validations ran against
+ * @returns {Object|null} - e.g. { doctorId: 'Invalid doctor ID' }, or null when valid
+ */
+const getFieldErrors = (req) => {
+  const errors = validationResult(req);
+  if (errors.isEmpty()) {
+    return null;
+  }
+  return errors.array().reduce((fields, err) => {
+    if (!fields[err.path]) {
+      fields[err.path] = err.msg;
+    }
+    return fields;
+  }, {});
+};
+
+/**
+ * Like validate, but responds with a per-field error map
+ * @param {Array} validations - Array of validation chains
+ * @returns {Function} Express middleware function
+ */
+const validateFields = (validations) => {
+  return async (req, res, next) => {
+    await Promise.all(validations.map(validation => validation.run(req)));
+
+    const fieldErrors = getFieldErrors(req);
+    if (fieldErrors) {
+      return res.status(400).json({
+        success: false,
+        error: 'Validation Error',
+        errors: fieldErrors
+      });
+    }
+    next();
+  };
+};
+
 module.exports = {
-  validate
+  validate,
+  validateFields,
+  getFieldErrors
 }; 
\ No newline at end of file
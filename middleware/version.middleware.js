@@ -12,9 +12,11 @@ const versionMiddleware = (req, res, next) => {
   const pathParts = fullPath.split('/');
   logger.info(`Path parts: ${pathParts}`);
   
-  // Find the version part (it should be after /api/)
+  // Find the version part (it should be after /api/). Paths without one,
+  // like /api/doctors, are the legacy alias of v1.
   const apiIndex = pathParts.indexOf('api');
-  const version = apiIndex !== -1 && pathParts[apiIndex + 1] ? pathParts[apiIndex + 1] : null;
+  const segment = apiIndex !== -1 ? pathParts[apiIndex + 1] : null;
+  const version = segment && /^v\d+$/.test(segment) ? segment : null;
   
   logger.info(`Extracted version: ${version}`);
 
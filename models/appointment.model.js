@@ -1,4 +1,11 @@
 const mongoose = require('mongoose');
+const config = require('../config/config');
+const { generateConfirmationCode } = require('../utils/helpers');
+
+// Drafts are bookings still being filled in, so the slot details are optional
+const requiredUnlessDraft = function () {
+  return this.status !== 'draft';
+};
 
 const appointmentSchema = new mongoose.Schema({
   doctorId: {
@@ -13,46 +20,263 @@ const appointmentSchema = new mongoose.Schema({
   },
   date: {
     type: Date,
-    required: true
+    required: requiredUnlessDraft
   },
   startTime: {
     type: String,
-    required: true
+    required: requiredUnlessDraft
   },
   endTime: {
     type: String,
-    required: true
+    required: requiredUnlessDraft
   },
+  // The doctor's time zone when booked; date and times are wall-clock times
+  // there, UTC when unset
+  timeZone: String,
   status: {
     type: String,
-    enum: ['pending', 'confirmed', 'cancelled', 'completed'],
+    // Allowed changes are defined in services/appointment.status.service
+    enum: ['draft', 'pending', 'confirmed', 'cancelled', 'completed', 'no-show'],
     default: 'pending'
   },
+  statusHistory: [{
+    from: String,
+    to: String,
+    actor: {
+      type: String,
+      enum: ['patient', 'doctor', 'admin', 'system']
+    },
+    userId: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'User'
+    },
+    reason: String,
+    at: Date
+  }],
   type: {
     type: String,
     enum: ['in-person', 'video', 'phone'],
-    required: true
+    required: requiredUnlessDraft
   },
+  // Symptoms from the recommendation the booking came from, for the doctor's context
+  symptoms: [String],
   reason: {
     type: String,
-    required: true
+    required: requiredUnlessDraft
+  },
+  // Set when the visit is for a dependent (e.g. a child). patientId stays the
+  // account holder who booked and is billed; these are the clinical patient.
+  patientDetails: {
+    name: String,
+    dob: Date,
+    relationship: {
+      type: String,
+      enum: ['child', 'spouse', 'parent', 'sibling', 'other']
+    }
+  },
+  paymentStatus: {
+    type: String,
+    enum: ['unpaid', 'held', 'paid', 'refunded'],
+    default: 'unpaid'
+  },
+  // While a payment is in progress the slot stays reserved until this time
+  holdExpiresAt: Date,
+  // Doctor's notes shared with the patient
+  patientVisibleNotes: String,
+  // Doctor-only clinical notes. Never loaded unless selected explicitly, so
+  // they can't leak through responses that serialize whole appointments.
+  privateNotes: {
+    type: String,
+    select: false
+  },
+  // Reschedules requested by the patient; capped by config.appointments.maxReschedules
+  rescheduleCount: {
+    type: Number,
+    default: 0
+  },
+  // When the patient was asked to reschedule because the doctor's schedule
+  // stopped covering this time; cleared by rescheduling
+  scheduleConflictNotifiedAt: Date,
+  // Fees for late reschedules by the patient (config.appointments.rescheduleFee).
+  // unpaid fees are left for the clinic to invoice; pending ones await the
+  // payment in paymentId.
+  rescheduleFees: [new mongoose.Schema({
+    amount: Number,
+    currency: String,
+    // How long before the original start the reschedule was made
+    hoursBefore: Number,
+    status: {
+      type: String,
+      enum: ['unpaid', 'pending', 'paid', 'failed']
+    },
+    paymentId: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'Payment'
+    },
+    createdAt: {
+      type: Date,
+      default: Date.now
+    }
+  }, { _id: false })],
+  // Outcome recorded by the doctor when completing the appointment
+  disposition: {
+    type: String,
+    enum: ['resolved', 'referral', 'follow-up-needed', 'prescription-issued']
+  },
+  // Snapshot of the consultation type at booking time, so later changes to
+  // the doctor's prices don't affect existing appointments
+  consultationType: {
+    typeId: mongoose.Schema.Types.ObjectId,
+    name: String
+  },
+  fee: Number,
+  // How fee was derived when a peak pricing rule applied at booking
+  pricing: {
+    baseFee: Number,
+    multiplier: Number,
+    rule: String
+  },
+  durationMinutes: Number,
+  // 'auto' when the doctor auto-accepted bookings at the time it was booked,
+  // so it is confirmed without them (see Doctor.autoAcceptBookings)
+  confirmationMode: {
+    type: String,
+    enum: ['manual', 'auto'],
+    default: 'manual'
+  },
+  // Set when the appointment was completed by the auto-complete job rather than the doctor
+  autoCompleted: {
+    type: Boolean,
+    default: false
   },
-  notes: String,
   cancellationReason: String,
+  // Why the appointment was cancelled, from a fixed list so cancellations can
+  // be analyzed; cancellationReason holds the details
+  cancellationCategory: {
+    type: String,
+    enum: ['patient_unavailable', 'found_other_care', 'doctor_unavailable', 'emergency', 'other']
+  },
+  cancelledBy: {
+    type: String,
+    enum: ['patient', 'doctor', 'admin', 'system']
+  },
   cancellationTime: Date,
+  // Reminders sent to the doctor while the appointment awaits confirmation,
+  // counted since pendingSince (a reschedule makes it pending again)
+  confirmationEscalation: {
+    pendingSince: Date,
+    remindersSent: Number,
+    lastReminderAt: Date,
+    autoCancelledAt: Date
+  },
+  // When the patient was reminded to pay before the unpaid booking expires
+  paymentReminderSentAt: Date,
+  // Set by the former day-ahead reminder worker; such appointments are done
   reminderSent: {
     type: Boolean,
     default: false
+  },
+  // Reminder lead times (minutes) already handled for each participant
+  remindersSent: {
+    patient: [Number],
+    doctor: [Number]
+  },
+  joinLinkSent: {
+    type: Boolean,
+    default: false
+  },
+  // Language agreed for the consultation, from the ones the slot offers
+  language: String,
+  // Client-supplied key of the booking request, so retries don't book twice
+  idempotencyKey: String,
+  // Patient answers to the specialty's intake form, for the doctor to read before the consult
+  intake: {
+    formId: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'IntakeForm'
+    },
+    specialty: String,
+    version: Number,
+    answers: {
+      type: [{
+        _id: false,
+        key: String,
+        label: String,
+        value: mongoose.Schema.Types.Mixed
+      }],
+      // No empty list on appointments without answers, so intake stays unset
+      default: undefined
+    },
+    submittedAt: Date
+  },
+  // Short code for check-in at the clinic, set when the booking is made
+  confirmationCode: {
+    type: String,
+    uppercase: true,
+    trim: true
+  },
+  // Set once the chat's message content and attachments were purged
+  chatPurge: {
+    purgedAt: Date,
+    purgedBy: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'User'
+    },
+    reason: {
+      type: String,
+      enum: ['participant', 'admin', 'retention']
+    },
+    messageCount: Number,
+    attachmentCount: Number
   }
 }, {
-  timestamps: true
+  timestamps: true,
+  toJSON: {
+    transform: (doc, ret) => {
+      // Appointments saved before the notes split still have notes in the
+      // database until scripts/migrateAppointmentNotes.js has run
+      if (ret.patientVisibleNotes === undefined && ret.notes !== undefined) {
+        ret.patientVisibleNotes = ret.notes;
+      }
+      // Older clients read notes
+      ret.notes = ret.patientVisibleNotes;
+      return ret;
+    }
+  }
 });
 
 // Index for faster queries
 appointmentSchema.index({ doctorId: 1, date: 1 });
 appointmentSchema.index({ patientId: 1, date: 1 });
 appointmentSchema.index({ status: 1 });
+appointmentSchema.index({ createdAt: 1 });
+appointmentSchema.index({ status: 1, paymentStatus: 1, holdExpiresAt: 1 });
+appointmentSchema.index(
+  { patientId: 1, idempotencyKey: 1 },
+  { unique: true, partialFilterExpression: { idempotencyKey: { $type: 'string' } } }
+);
+appointmentSchema.index(
+  { confirmationCode: 1 },
+  { unique: true, partialFilterExpression: { confirmationCode: { $type: 'string' } } }
+);
+
+// Every booking gets a confirmation code; drafts get theirs once finalized.
+// Codes are drawn again on the rare clash with an existing one.
+appointmentSchema.pre('validate', async function () {
+  if (this.confirmationCode || this.status === 'draft') {
+    return;
+  }
+  let code;
+  do {
+    code = generateConfirmationCode(config.appointments.confirmationCodeLength);
+  } while (await this.constructor.exists({ confirmationCode: code }));
+  this.confirmationCode = code;
+});
 
 const Appointment = mongoose.model('Appointment', appointmentSchema);
 
+Appointment.DEPENDENT_RELATIONSHIPS = appointmentSchema.path('patientDetails.relationship').enumValues;
+Appointment.DISPOSITIONS = appointmentSchema.path('disposition').enumValues;
+Appointment.CANCELLATION_CATEGORIES = appointmentSchema.path('cancellationCategory').enumValues;
+
 module.exports = Appointment;
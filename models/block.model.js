@@ -0,0 +1,61 @@
+const mongoose = require('mongoose');
+
+// A doctor blocking a patient: no new bookings or chat messages between the
+// two while active. One document per pair; history is the audit trail of
+// every block and unblock.
+const blockSchema = new mongoose.Schema({
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  patientId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  active: {
+    type: Boolean,
+    default: true
+  },
+  reason: String,
+  // Who placed the current block; doctors can't lift a block an admin placed
+  placedBy: {
+    userId: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'User'
+    },
+    role: {
+      type: String,
+      enum: ['doctor', 'admin']
+    }
+  },
+  history: [{
+    action: {
+      type: String,
+      enum: ['blocked', 'unblocked'],
+      required: true
+    },
+    userId: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'User'
+    },
+    role: {
+      type: String,
+      enum: ['doctor', 'admin']
+    },
+    reason: String,
+    at: {
+      type: Date,
+      default: Date.now
+    }
+  }]
+}, {
+  timestamps: true
+});
+
+blockSchema.index({ doctorId: 1, patientId: 1 }, { unique: true });
+blockSchema.index({ patientId: 1, active: 1 });
+blockSchema.index({ active: 1, updatedAt: -1 });
+
+module.exports = mongoose.model('Block', blockSchema);
@@ -0,0 +1,32 @@
+const mongoose = require('mongoose');
+
+// New bookings of a throttled specialty in one hour or day. Removed by the
+// TTL index once the window is over.
+const bookingThrottleCounterSchema = new mongoose.Schema({
+  specialty: {
+    type: String,
+    required: true
+  },
+  window: {
+    type: String,
+    enum: ['hour', 'day'],
+    required: true
+  },
+  startsAt: {
+    type: Date,
+    required: true
+  },
+  count: {
+    type: Number,
+    default: 0
+  },
+  expiresAt: {
+    type: Date,
+    required: true
+  }
+});
+
+bookingThrottleCounterSchema.index({ specialty: 1, window: 1, startsAt: 1 }, { unique: true });
+bookingThrottleCounterSchema.index({ expiresAt: 1 }, { expireAfterSeconds: 0 });
+
+module.exports = mongoose.model('BookingThrottleCounter', bookingThrottleCounterSchema);
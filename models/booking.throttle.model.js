@@ -0,0 +1,32 @@
+const mongoose = require('mongoose');
+
+// An admin's cap on new bookings for a specialty, e.g. during flu season.
+// Specialties without one are unlimited. Counts are kept in
+// BookingThrottleCounter.
+const bookingThrottleSchema = new mongoose.Schema({
+  // Matched case-insensitively against doctors' specializations
+  specialty: {
+    type: String,
+    required: true,
+    unique: true,
+    trim: true,
+    lowercase: true
+  },
+  maxPerHour: {
+    type: Number,
+    min: 1
+  },
+  maxPerDay: {
+    type: Number,
+    min: 1
+  },
+  reason: String,
+  updatedBy: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User'
+  }
+}, {
+  timestamps: true
+});
+
+module.exports = mongoose.model('BookingThrottle', bookingThrottleSchema);
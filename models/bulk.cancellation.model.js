@@ -0,0 +1,54 @@
+const mongoose = require('mongoose');
+
+// Audit record of a doctor cancelling every appointment in a time range at
+// once, with the outcome for each appointment
+const bulkCancellationSchema = new mongoose.Schema({
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  // The user who made the request (the doctor, or an admin acting for them)
+  userId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  from: {
+    type: Date,
+    required: true
+  },
+  to: {
+    type: Date,
+    required: true
+  },
+  reason: {
+    type: String,
+    required: true
+  },
+  cancellationCategory: String,
+  offerRebooking: Boolean,
+  results: [{
+    _id: false,
+    appointmentId: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'Appointment'
+    },
+    outcome: {
+      type: String,
+      enum: ['cancelled', 'failed']
+    },
+    refundedAmount: Number,
+    rebookOptions: Number,
+    error: String
+  }],
+  cancelledCount: Number,
+  failedCount: Number,
+  ip: String
+}, {
+  timestamps: true
+});
+
+bulkCancellationSchema.index({ doctorId: 1, createdAt: -1 });
+
+module.exports = mongoose.model('BulkCancellation', bulkCancellationSchema);
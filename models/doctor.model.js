@@ -1,4 +1,5 @@
 const mongoose = require('mongoose');
+const { isValidTimeZone } = require('../utils/helpers');
 
 const doctorSchema = new mongoose.Schema({
   userId: {
@@ -31,13 +32,80 @@ const doctorSchema = new mongoose.Schema({
     required: true,
     min: 0
   },
+  // Bookable kinds of consultation, e.g. first visit or follow-up, each with
+  // its own length and fee. Bookings without a type use consultationFee.
+  consultationTypes: [{
+    name: {
+      type: String,
+      required: true,
+      trim: true
+    },
+    duration: {
+      type: Number,
+      required: true,
+      min: 5
+    },
+    fee: {
+      type: Number,
+      required: true,
+      min: 0
+    }
+  }],
+  // Peak pricing: slots starting on one of the days within the time range
+  // cost the base fee times the multiplier. See services/pricing.service.js.
+  pricingRules: [{
+    _id: false,
+    days: [{
+      type: String,
+      enum: ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday']
+    }],
+    startTime: {
+      type: String,
+      required: true,
+      match: /^([01][0-9]|2[0-3]):[0-5][0-9]$/
+    },
+    endTime: {
+      type: String,
+      required: true,
+      match: /^([01][0-9]|2[0-3]):[0-5][0-9]$/
+    },
+    multiplier: {
+      type: Number,
+      required: true,
+      min: 0.5,
+      max: 5
+    },
+    // Shown to patients, e.g. "Evening rate"
+    label: {
+      type: String,
+      trim: true,
+      maxlength: 50
+    }
+  }],
+  // Overrides the platform-wide commission for this doctor's payments
+  commissionPercent: {
+    type: Number,
+    min: 0,
+    max: 100
+  },
   currency: {
     type: String,
     default: 'EUR'
   },
+  // IANA zone the doctor's schedule is in, e.g. "Europe/Amsterdam". Falls
+  // back to config.appointments.scheduleTimeZone.
+  timeZone: {
+    type: String,
+    validate: {
+      validator: isValidTimeZone,
+      message: 'Time zone must be an IANA time zone name, e.g. Europe/Amsterdam'
+    }
+  },
+  // Sanitized rich text, see utils/sanitize.js
   about: {
     type: String,
-    required: true
+    required: true,
+    maxlength: 5000
   },
   education: [{
     degree: {
@@ -123,7 +191,67 @@ const doctorSchema = new mongoose.Schema({
     country: {
       type: String,
       default: 'Netherlands'
-    }
+    },
+    // GeoJSON point, [longitude, latitude]. Optional; clinics without it are
+    // left out of nearby searches.
+    coordinates: {
+      type: {
+        type: String,
+        enum: ['Point']
+      },
+      coordinates: {
+        type: [Number],
+        default: undefined
+      }
+    },
+    // Consultation rooms, i.e. how many in-person visits the clinic can host at
+    // once. Doctors at the same address and postal code share them.
+    rooms: {
+      type: Number,
+      min: 1,
+      default: 1
+    },
+    // Stored privately in S3 and served through presigned URLs
+    photos: [{
+      key: {
+        type: String,
+        required: true
+      },
+      contentType: String,
+      size: Number,
+      uploadedAt: {
+        type: Date,
+        default: Date.now
+      },
+      // Malware scan; the photo is only shown once it is clean
+      scan: {
+        status: {
+          type: String,
+          enum: ['pending', 'clean', 'infected']
+        },
+        threat: String,
+        scanner: String,
+        scannedAt: Date
+      }
+    }],
+    // When set, in-person appointments must also fall within these hours
+    openingHours: [{
+      day: {
+        type: String,
+        enum: ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'],
+        required: true
+      },
+      openTime: {
+        type: String,
+        required: true,
+        match: /^([0-1]?[0-9]|2[0-3]):[0-5][0-9]$/
+      },
+      closeTime: {
+        type: String,
+        required: true,
+        match: /^([0-1]?[0-9]|2[0-3]):[0-5][0-9]$/
+      }
+    }]
   },
   availability: [{
     day: {
@@ -141,9 +269,80 @@ const doctorSchema = new mongoose.Schema({
         type: String,
         required: true,
         match: /^([0-1]?[0-9]|2[0-3]):[0-5][0-9]$/
-      }
+      },
+      // Languages consultations in this block are offered in; empty offers
+      // all of the doctor's languages
+      languages: [{
+        type: String,
+        lowercase: true,
+        trim: true
+      }],
+      // Times within the block that aren't bookable, e.g. a lunch break
+      breaks: [{
+        _id: false,
+        startTime: {
+          type: String,
+          required: true,
+          match: /^([0-1]?[0-9]|2[0-3]):[0-5][0-9]$/
+        },
+        endTime: {
+          type: String,
+          required: true,
+          match: /^([0-1]?[0-9]|2[0-3]):[0-5][0-9]$/
+        }
+      }]
     }]
   }],
+  // Languages offered per appointment mode, on top of any block
+  // restriction; an empty or missing list offers all of them
+  consultationLanguages: {
+    'in-person': [{ type: String, lowercase: true, trim: true }],
+    video: [{ type: String, lowercase: true, trim: true }],
+    phone: [{ type: String, lowercase: true, trim: true }]
+  },
+  // Minutes kept free at the start of the first availability block and the
+  // end of the last one each day (warm-up and wind-down). Unlike
+  // unavailability these apply every working day.
+  firstSlotOffset: {
+    type: Number,
+    default: 0,
+    min: 0,
+    max: 240
+  },
+  lastSlotCutoff: {
+    type: Number,
+    default: 0,
+    min: 0,
+    max: 240
+  },
+  // How many days ahead patients can book; unset uses
+  // config.appointments.maxAdvanceBookingDays
+  maxAdvanceBookingDays: {
+    type: Number,
+    min: 1,
+    max: 365
+  },
+  // Most appointments a day, however much availability is left; unset is
+  // unlimited
+  maxAppointmentsPerDay: {
+    type: Number,
+    min: 1,
+    max: 100
+  },
+  // New bookings are confirmed straight away instead of waiting for the
+  // doctor, once any payment required before confirmation is made
+  autoAcceptBookings: {
+    type: Boolean,
+    default: false
+  },
+  // Minutes kept free around appointments of each mode, e.g. travel and
+  // cleanup for in-person visits; unset modes use
+  // config.appointments.bufferMinutes
+  appointmentBuffers: {
+    'in-person': { type: Number, min: 0, max: 120 },
+    video: { type: Number, min: 0, max: 120 },
+    phone: { type: Number, min: 0, max: 120 }
+  },
   unavailability: [{
     date: { type: Date, required: true },
     slots: [{
@@ -170,6 +369,42 @@ const doctorSchema = new mongoose.Schema({
   totalReviews: {
     type: Number,
     default: 0
+  },
+  // Changes to reviewed profile fields waiting for admin approval
+  pendingProfileChanges: {
+    changes: mongoose.Schema.Types.Mixed,
+    submittedAt: Date
+  },
+  // Last admin decision on submitted profile changes
+  profileChangeReview: {
+    status: {
+      type: String,
+      enum: ['approved', 'rejected']
+    },
+    fields: [String],
+    reason: String,
+    reviewedBy: {
+      type: mongoose.Schema.Types.ObjectId,
+      ref: 'User'
+    },
+    reviewedAt: Date
+  },
+  // Availability for instant consults. online is the doctor's toggle; they
+  // only count as online while lastSeenAt is recent (heartbeats).
+  instantConsult: {
+    online: {
+      type: Boolean,
+      default: false
+    },
+    onlineSince: Date,
+    lastSeenAt: Date,
+    // Doctors who waited longest since their last match are matched first
+    lastMatchedAt: Date
+  },
+  // SHA-256 of the secret in the doctor's calendar feed URL
+  calendarFeedTokenHash: {
+    type: String,
+    select: false
   }
 }, {
   timestamps: true
@@ -180,8 +415,13 @@ doctorSchema.index({ userId: 1 });
 doctorSchema.index({ registrationNumber: 1 }, { unique: true });
 doctorSchema.index({ specializations: 1 });
 doctorSchema.index({ 'clinicLocation.city': 1 });
+doctorSchema.index({ 'clinicLocation.coordinates': '2dsphere' });
 doctorSchema.index({ verificationStatus: 1 });
 doctorSchema.index({ status: 1 });
+doctorSchema.index({ createdAt: -1, _id: -1 });
+doctorSchema.index({ 'pendingProfileChanges.submittedAt': 1 }, { sparse: true });
+doctorSchema.index({ calendarFeedTokenHash: 1 }, { unique: true, sparse: true });
+doctorSchema.index({ 'instantConsult.online': 1, specializations: 1 });
 
 // Index for text search
 doctorSchema.index({
@@ -0,0 +1,28 @@
+const mongoose = require('mongoose');
+
+// One row per viewer per doctor per day; the unique index does the deduping
+const doctorViewSchema = new mongoose.Schema({
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  // UTC day of the view, YYYY-MM-DD
+  day: {
+    type: String,
+    required: true
+  },
+  // 'user:<id>' for signed-in viewers, otherwise a hash of IP and user agent
+  viewerKey: {
+    type: String,
+    required: true
+  },
+  viewedAt: {
+    type: Date,
+    default: Date.now
+  }
+}, { collection: 'doctor_views' });
+
+doctorViewSchema.index({ doctorId: 1, day: 1, viewerKey: 1 }, { unique: true });
+
+module.exports = mongoose.model('DoctorView', doctorViewSchema);
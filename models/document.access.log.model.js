@@ -0,0 +1,32 @@
+const mongoose = require('mongoose');
+
+// Audit trail of who accessed which medical document and when
+const documentAccessLogSchema = new mongoose.Schema({
+  documentId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Document',
+    required: true
+  },
+  userId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  role: String,
+  action: {
+    type: String,
+    enum: ['download'],
+    default: 'download'
+  },
+  ip: String,
+  userAgent: String,
+  accessedAt: {
+    type: Date,
+    default: Date.now
+  }
+});
+
+documentAccessLogSchema.index({ documentId: 1, accessedAt: -1 });
+documentAccessLogSchema.index({ userId: 1, accessedAt: -1 });
+
+module.exports = mongoose.model('DocumentAccessLog', documentAccessLogSchema);
@@ -0,0 +1,46 @@
+const mongoose = require('mongoose');
+
+// Medical document attached to an appointment. Stored privately in S3 and only
+// reachable through the download endpoint, which logs every access.
+const documentSchema = new mongoose.Schema({
+  appointmentId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Appointment',
+    required: true
+  },
+  uploadedBy: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  key: {
+    type: String,
+    required: true
+  },
+  fileName: {
+    type: String,
+    required: true
+  },
+  contentType: {
+    type: String,
+    required: true
+  },
+  size: Number,
+  // Malware scan; the document is only served once it is clean
+  scan: {
+    status: {
+      type: String,
+      enum: ['pending', 'clean', 'infected']
+    },
+    threat: String,
+    scanner: String,
+    scannedAt: Date
+  }
+}, {
+  timestamps: true
+});
+
+documentSchema.index({ appointmentId: 1, createdAt: -1 });
+documentSchema.index({ 'scan.status': 1, createdAt: 1 });
+
+module.exports = mongoose.model('Document', documentSchema);
@@ -0,0 +1,56 @@
+const mongoose = require('mongoose');
+
+// A patient's place in the instant consult queue for a specialty. Waiting
+// requests are matched in order of createdAt; a requeued request keeps it.
+const instantConsultSchema = new mongoose.Schema({
+  patientId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  specialty: {
+    type: String,
+    required: true
+  },
+  reason: {
+    type: String,
+    required: true
+  },
+  status: {
+    type: String,
+    enum: ['waiting', 'matched', 'completed', 'cancelled', 'expired'],
+    default: 'waiting'
+  },
+  // Set while matched: the doctor, and the appointment and video session created for the consult
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor'
+  },
+  appointmentId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Appointment'
+  },
+  videoSessionId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'VideoSession'
+  },
+  matchedAt: Date,
+  // Times the request went back to the queue because the matched doctor went offline
+  requeueCount: {
+    type: Number,
+    default: 0
+  },
+  endedAt: Date
+}, {
+  timestamps: true
+});
+
+instantConsultSchema.index({ status: 1, specialty: 1, createdAt: 1 });
+instantConsultSchema.index({ patientId: 1, status: 1 });
+instantConsultSchema.index({ doctorId: 1, status: 1 });
+
+const InstantConsult = mongoose.model('InstantConsult', instantConsultSchema);
+
+InstantConsult.OPEN_STATUSES = ['waiting', 'matched'];
+
+module.exports = InstantConsult;
@@ -0,0 +1,78 @@
+const mongoose = require('mongoose');
+
+// Matches specialties regardless of case, so "Cardiology" and "cardiology" share a form
+const SPECIALTY_COLLATION = { locale: 'en', strength: 2 };
+
+const questionSchema = new mongoose.Schema({
+  // Stable identifier the answers are stored under
+  key: {
+    type: String,
+    required: true,
+    trim: true,
+    match: /^[a-z][a-z0-9_]*$/
+  },
+  label: {
+    type: String,
+    required: true,
+    trim: true,
+    maxlength: 200
+  },
+  type: {
+    type: String,
+    enum: ['text', 'number', 'boolean', 'choice', 'multi-choice'],
+    required: true
+  },
+  required: {
+    type: Boolean,
+    default: false
+  },
+  // Allowed values for choice and multi-choice questions
+  options: [{
+    type: String,
+    trim: true
+  }],
+  // Bounds for number questions
+  min: Number,
+  max: Number,
+  // Longest accepted answer for text questions
+  maxLength: {
+    type: Number,
+    default: 1000
+  }
+}, { _id: false });
+
+// Admin-managed pre-consultation questions for one specialty
+const intakeFormSchema = new mongoose.Schema({
+  specialty: {
+    type: String,
+    required: true,
+    trim: true
+  },
+  title: {
+    type: String,
+    required: true,
+    trim: true,
+    maxlength: 200
+  },
+  questions: [questionSchema],
+  isActive: {
+    type: Boolean,
+    default: true
+  },
+  // Bumped whenever the questions change; stored with each set of answers
+  version: {
+    type: Number,
+    default: 1
+  }
+}, {
+  timestamps: true
+});
+
+intakeFormSchema.index({ specialty: 1 }, { unique: true, collation: SPECIALTY_COLLATION });
+
+const IntakeForm = mongoose.model('IntakeForm', intakeFormSchema);
+
+IntakeForm.QUESTION_TYPES = questionSchema.path('type').enumValues;
+IntakeForm.SPECIALTY_COLLATION = SPECIALTY_COLLATION;
+
+module.exports = IntakeForm;
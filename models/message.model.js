@@ -13,7 +13,8 @@ const messageSchema = new mongoose.Schema({
   },
   content: {
     type: String,
-    required: true
+    required: true,
+    trim: true
   },
   type: {
     type: String,
@@ -33,6 +34,10 @@ const messageSchema = new mongoose.Schema({
     type: mongoose.Schema.Types.ObjectId,
     ref: 'User'
   }],
+  // Set when the content was purged; the record stays for auditing
+  redactedAt: {
+    type: Date
+  },
   createdAt: {
     type: Date,
     default: Date.now
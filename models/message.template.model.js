@@ -0,0 +1,29 @@
+const mongoose = require('mongoose');
+
+// A doctor's saved chat reply. Private to the doctor; sent by referencing it
+// when posting a chat message, see services/message.template.service.js.
+const messageTemplateSchema = new mongoose.Schema({
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  name: {
+    type: String,
+    required: true,
+    trim: true,
+    maxlength: 100
+  },
+  // May contain placeholders such as {{patientFirstName}}
+  content: {
+    type: String,
+    required: true,
+    trim: true
+  }
+}, {
+  timestamps: true
+});
+
+messageTemplateSchema.index({ doctorId: 1, name: 1 }, { unique: true });
+
+module.exports = mongoose.model('MessageTemplate', messageTemplateSchema, 'templates');
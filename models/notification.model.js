@@ -17,7 +17,7 @@ const notificationSchema = new mongoose.Schema({
   },
   type: {
     type: String,
-    enum: ['email', 'sms', 'push'],
+    enum: ['email', 'sms', 'push', 'in-app'],
     required: true
   },
   status: {
@@ -25,6 +25,22 @@ const notificationSchema = new mongoose.Schema({
     enum: ['pending', 'sent', 'failed', 'delivered'],
     default: 'pending'
   },
+  // What SES/SNS reported about an email or SMS after it was sent
+  delivery: {
+    messageId: String,
+    status: {
+      type: String,
+      enum: ['sent', 'delivered', 'bounced', 'complained', 'failed', 'suppressed']
+    },
+    // Bounce type, complaint type or provider response
+    detail: String,
+    updatedAt: Date
+  },
+  link: String,
+  // Structured details the app can act on, e.g. rebooking offers
+  data: mongoose.Schema.Types.Mixed,
+  // Set when created by the queue worker, so redelivered jobs don't duplicate
+  jobId: String,
   read: {
     type: Boolean,
     default: false
@@ -32,7 +48,7 @@ const notificationSchema = new mongoose.Schema({
   relatedTo: {
     model: {
       type: String,
-      enum: ['Appointment', 'Payment', 'Chat']
+      enum: ['Appointment', 'Payment', 'Chat', 'Review', 'Referral', 'InstantConsult']
     },
     id: {
       type: mongoose.Schema.Types.ObjectId
@@ -48,4 +64,9 @@ const notificationSchema = new mongoose.Schema({
   }
 });
 
+notificationSchema.index({ jobId: 1 }, { unique: true, sparse: true });
+// Serves the notification list in cursor order
+notificationSchema.index({ userId: 1, createdAt: -1, _id: -1 });
+notificationSchema.index({ 'delivery.messageId': 1 }, { sparse: true });
+
 module.exports = mongoose.model('Notification', notificationSchema);
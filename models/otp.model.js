@@ -6,6 +6,11 @@ const otpSchema = new mongoose.Schema({
     required: true,
     index: true
   },
+  // Set for phone verification codes, which are sent to a signed-in user
+  userId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User'
+  },
   type: {
     type: String,
     enum: ['email', 'phone'],
@@ -19,6 +24,11 @@ const otpSchema = new mongoose.Schema({
     type: String,
     default: null
   },
+  // Wrong guesses so far
+  attempts: {
+    type: Number,
+    default: 0
+  },
   isExpired: {
     type: Boolean,
     default: false
@@ -41,6 +51,7 @@ const otpSchema = new mongoose.Schema({
 
 // Indexes
 otpSchema.index({ identifier: 1, type: 1, isExpired: 1 });
+otpSchema.index({ userId: 1, type: 1, isExpired: 1 });
 otpSchema.index({ expiresAt: 1 }, { expireAfterSeconds: 0 });
 
 // Pre-save middleware
@@ -0,0 +1,30 @@
+const mongoose = require('mongoose');
+
+// One per doctor and day with payment holds or new bookings. Placing a hold
+// or saving a booking writes it within the same transaction, so two for that
+// day can't go through at once: the second transaction hits a write conflict
+// and reruns its checks. Removed by the TTL index a day after the last one.
+const paymentHoldLockSchema = new mongoose.Schema({
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  date: {
+    type: Date,
+    required: true
+  },
+  version: {
+    type: Number,
+    default: 0
+  },
+  expiresAt: {
+    type: Date,
+    required: true
+  }
+});
+
+paymentHoldLockSchema.index({ doctorId: 1, date: 1 }, { unique: true });
+paymentHoldLockSchema.index({ expiresAt: 1 }, { expireAfterSeconds: 0 });
+
+module.exports = mongoose.model('PaymentHoldLock', paymentHoldLockSchema);
@@ -21,11 +21,21 @@ const paymentSchema = new mongoose.Schema({
     type: Number,
     required: true
   },
+  currency: {
+    type: String,
+    default: 'EUR'
+  },
   status: {
     type: String,
     enum: ['pending', 'success', 'failed', 'refunded'],
     default: 'pending'
   },
+  // What the payment is for: the consultation itself or a late reschedule
+  purpose: {
+    type: String,
+    enum: ['consultation', 'reschedule-fee'],
+    default: 'consultation'
+  },
   method: {
     type: String,
     enum: ['iDEAL', 'card', 'paypal'],
@@ -44,6 +54,25 @@ const paymentSchema = new mongoose.Schema({
   refundedAt: {
     type: Date
   },
+  // Set when the expiry sweeper failed the payment because its hold lapsed;
+  // the provider may still report it succeeded afterwards
+  holdExpiredAt: {
+    type: Date
+  },
+  refundedAmount: {
+    type: Number,
+    default: 0
+  },
+  // Commission breakdown, recorded when the payment succeeds
+  commissionPercent: Number,
+  platformFee: Number,
+  doctorNet: Number,
+  // The payout this payment was paid out to the doctor in, if any
+  payoutId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Payout',
+    default: null
+  },
   createdAt: {
     type: Date,
     default: Date.now
@@ -54,4 +83,10 @@ const paymentSchema = new mongoose.Schema({
   }
 });
 
+paymentSchema.index({ appointmentId: 1 });
+paymentSchema.index({ transactionId: 1 });
+paymentSchema.index({ status: 1, createdAt: 1 });
+paymentSchema.index({ status: 1, paidAt: 1 });
+paymentSchema.index({ doctorId: 1, status: 1, payoutId: 1 });
+
 module.exports = mongoose.model('Payment', paymentSchema);
@@ -0,0 +1,42 @@
+const mongoose = require('mongoose');
+
+// A correction to what a doctor is owed, netted against their next payout.
+// Refunds of payments that were already paid out are clawed back this way.
+const payoutAdjustmentSchema = new mongoose.Schema({
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  paymentId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Payment',
+    required: true
+  },
+  // Negative for a clawback
+  amount: {
+    type: Number,
+    required: true
+  },
+  currency: {
+    type: String,
+    default: 'EUR'
+  },
+  reason: {
+    type: String,
+    enum: ['refund'],
+    required: true
+  },
+  // The payout this adjustment was netted against, if any yet
+  payoutId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Payout',
+    default: null
+  }
+}, {
+  timestamps: true
+});
+
+payoutAdjustmentSchema.index({ doctorId: 1, payoutId: 1, createdAt: 1 });
+
+module.exports = mongoose.model('PayoutAdjustment', payoutAdjustmentSchema);
@@ -0,0 +1,46 @@
+const mongoose = require('mongoose');
+
+const payoutSchema = new mongoose.Schema({
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  // Net amount owed to the doctor after the platform commission
+  amount: {
+    type: Number,
+    required: true
+  },
+  currency: {
+    type: String,
+    default: 'EUR'
+  },
+  periodStart: Date,
+  periodEnd: {
+    type: Date,
+    required: true
+  },
+  status: {
+    type: String,
+    enum: ['pending', 'paid'],
+    default: 'pending'
+  },
+  payments: [{
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Payment'
+  }],
+  // Clawbacks netted against this payout; amount is after them
+  adjustments: [{
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'PayoutAdjustment'
+  }],
+  paidAt: Date,
+  reference: String
+}, {
+  timestamps: true
+});
+
+payoutSchema.index({ doctorId: 1, createdAt: -1 });
+payoutSchema.index({ status: 1 });
+
+module.exports = mongoose.model('Payout', payoutSchema);
@@ -0,0 +1,23 @@
+const mongoose = require('mongoose');
+
+// When phone verification codes were recently sent to a number, for the rate
+// limit (config.verification.phoneOtp). Keyed by the number rather than the
+// account, so more accounts don't buy more texts. Removed by the TTL index
+// once the window after the last send is over.
+const phoneOtpRequestSchema = new mongoose.Schema({
+  // E.164, e.g. "+31612345678"
+  phoneNumber: {
+    type: String,
+    required: true,
+    unique: true
+  },
+  sentAt: [Date],
+  expiresAt: {
+    type: Date,
+    required: true
+  }
+});
+
+phoneOtpRequestSchema.index({ expiresAt: 1 }, { expireAfterSeconds: 0 });
+
+module.exports = mongoose.model('PhoneOtpRequest', phoneOtpRequestSchema);
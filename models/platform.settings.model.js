@@ -0,0 +1,47 @@
+const mongoose = require('mongoose');
+
+// Platform settings admins can change at runtime. There is one document;
+// unset fields fall back to config/config.js. Read through
+// SettingsService.getSetting, which caches it.
+const platformSettingsSchema = new mongoose.Schema({
+  key: {
+    type: String,
+    default: 'platform',
+    unique: true
+  },
+  appointments: {
+    slotDurationMinutes: { type: Number, min: 5, max: 240 },
+    maxReschedules: { type: Number, min: 0, max: 20 },
+    suggestionCount: { type: Number, min: 1, max: 10 }
+  },
+  payments: {
+    holdMinutes: { type: Number, min: 1, max: 120 }
+  },
+  reviews: {
+    minReviewsForRating: { type: Number, min: 0, max: 100 }
+  },
+  chat: {
+    maxTemplatesPerDoctor: { type: Number, min: 1, max: 1000 }
+  },
+  // Bumped on every update; updates must name the version they were based on
+  version: {
+    type: Number,
+    default: 0
+  },
+  updatedBy: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User'
+  },
+  // Recent updates, newest last
+  history: [{
+    _id: false,
+    version: Number,
+    changes: mongoose.Schema.Types.Mixed,
+    updatedBy: { type: mongoose.Schema.Types.ObjectId, ref: 'User' },
+    updatedAt: Date
+  }]
+}, {
+  timestamps: true
+});
+
+module.exports = mongoose.model('PlatformSettings', platformSettingsSchema, 'settings');
@@ -0,0 +1,47 @@
+const mongoose = require('mongoose');
+
+// Matches specialties regardless of case, like intake forms
+const SPECIALTY_COLLATION = { locale: 'en', strength: 2 };
+
+// Admin-managed preparation patients need before a visit (e.g. fasting),
+// included in their appointment reminders. Applies to a specialty, an
+// appointment type, or a specialty seen through one type.
+const prepInstructionSchema = new mongoose.Schema({
+  specialty: {
+    type: String,
+    trim: true,
+    default: null
+  },
+  appointmentType: {
+    type: String,
+    enum: ['in-person', 'video', 'phone', null],
+    default: null
+  },
+  instructions: {
+    type: String,
+    required: true,
+    trim: true,
+    maxlength: 500
+  },
+  isActive: {
+    type: Boolean,
+    default: true
+  }
+}, {
+  timestamps: true
+});
+
+prepInstructionSchema.pre('validate', function (next) {
+  if (!this.specialty && !this.appointmentType) {
+    this.invalidate('specialty', 'A specialty, an appointment type or both is required');
+  }
+  next();
+});
+
+prepInstructionSchema.index({ specialty: 1, appointmentType: 1 }, { unique: true, collation: SPECIALTY_COLLATION });
+
+const PrepInstruction = mongoose.model('PrepInstruction', prepInstructionSchema);
+
+PrepInstruction.SPECIALTY_COLLATION = SPECIALTY_COLLATION;
+
+module.exports = PrepInstruction;
@@ -0,0 +1,37 @@
+const mongoose = require('mongoose');
+
+// Tracks each queued job so redeliveries are detected and attempts are visible
+const queueJobSchema = new mongoose.Schema({
+  jobId: {
+    type: String,
+    required: true,
+    unique: true
+  },
+  type: {
+    type: String,
+    required: true
+  },
+  payload: {
+    type: mongoose.Schema.Types.Mixed
+  },
+  status: {
+    type: String,
+    enum: ['pending', 'failed', 'succeeded', 'dead'],
+    default: 'pending'
+  },
+  attempts: [{
+    at: {
+      type: Date,
+      default: Date.now
+    },
+    receiveCount: Number,
+    error: String
+  }],
+  completedAt: Date
+}, {
+  timestamps: true
+});
+
+queueJobSchema.index({ status: 1, updatedAt: -1 });
+
+module.exports = mongoose.model('QueueJob', queueJobSchema);
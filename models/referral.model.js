@@ -0,0 +1,53 @@
+const mongoose = require('mongoose');
+
+const referralSchema = new mongoose.Schema({
+  // The consultation the referral was made from
+  appointmentId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Appointment',
+    required: true
+  },
+  patientId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  referringDoctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  // A specific colleague, when the referring doctor named one
+  referredDoctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor'
+  },
+  specialty: {
+    type: String,
+    required: true,
+    trim: true
+  },
+  note: {
+    type: String,
+    trim: true,
+    maxlength: 2000
+  },
+  status: {
+    type: String,
+    enum: ['pending', 'booked', 'declined'],
+    default: 'pending'
+  },
+  // The appointment booked for this referral, by the referring doctor or the patient
+  linkedAppointmentId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Appointment'
+  }
+}, {
+  timestamps: true
+});
+
+referralSchema.index({ patientId: 1, createdAt: -1 });
+referralSchema.index({ appointmentId: 1 });
+referralSchema.index({ referringDoctorId: 1, createdAt: -1 });
+
+module.exports = mongoose.model('Referral', referralSchema);
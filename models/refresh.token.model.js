@@ -0,0 +1,38 @@
+const mongoose = require('mongoose');
+
+// A refresh token, exchanged at POST /auth/refresh for a new access token and
+// a new refresh token. Only a SHA-256 hash of the token is stored. Tokens
+// rotated from one another share a familyId, the tokenId of the session they
+// were issued for, so one login's chain can be revoked as a whole. Removed by
+// the TTL index once expired.
+const refreshTokenSchema = new mongoose.Schema({
+  tokenHash: {
+    type: String,
+    required: true,
+    unique: true
+  },
+  userId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  familyId: {
+    type: String,
+    required: true
+  },
+  expiresAt: {
+    type: Date,
+    required: true
+  },
+  // Set once exchanged; presenting the token again revokes its family
+  rotatedAt: Date,
+  revokedAt: Date
+}, {
+  timestamps: true
+});
+
+refreshTokenSchema.index({ familyId: 1 });
+refreshTokenSchema.index({ userId: 1 });
+refreshTokenSchema.index({ expiresAt: 1 }, { expireAfterSeconds: 0 });
+
+module.exports = mongoose.model('RefreshToken', refreshTokenSchema);
@@ -27,6 +27,21 @@ const reviewSchema = new mongoose.Schema({
     type: mongoose.Schema.Types.ObjectId,
     ref: 'Appointment',
     required: true
+  },
+  // Set when the reviewed appointment was completed and paid; only verified
+  // reviews count towards the doctor's rating
+  isVerified: {
+    type: Boolean,
+    default: false
+  },
+  // One public reply from the reviewed doctor
+  reply: {
+    text: {
+      type: String,
+      trim: true,
+      maxlength: 1000
+    },
+    createdAt: Date
   }
 }, {
   timestamps: true
@@ -48,10 +63,10 @@ reviewSchema.pre('save', async function(next) {
   next();
 });
 
-// Update doctor's average rating after review changes
+// Update doctor's average rating from verified reviews after review changes
 reviewSchema.statics.updateDoctorRating = async function(doctorId) {
   const result = await this.aggregate([
-    { $match: { doctorId: mongoose.Types.ObjectId(doctorId) } },
+    { $match: { doctorId: new mongoose.Types.ObjectId(doctorId), isVerified: true } },
     {
       $group: {
         _id: '$doctorId',
@@ -61,12 +76,10 @@ reviewSchema.statics.updateDoctorRating = async function(doctorId) {
     }
   ]);
 
-  if (result.length > 0) {
-    await mongoose.model('Doctor').findByIdAndUpdate(doctorId, {
-      'ratings.average': result[0].averageRating,
-      'ratings.count': result[0].totalReviews
-    });
-  }
+  await mongoose.model('Doctor').findByIdAndUpdate(doctorId, {
+    rating: result.length > 0 ? result[0].averageRating : 0,
+    totalReviews: result.length > 0 ? result[0].totalReviews : 0
+  });
 };
 
 // Update doctor rating after save/remove
@@ -74,7 +87,7 @@ reviewSchema.post('save', function() {
   this.constructor.updateDoctorRating(this.doctorId);
 });
 
-reviewSchema.post('remove', function() {
+reviewSchema.post('deleteOne', { document: true, query: false }, function() {
   this.constructor.updateDoctorRating(this.doctorId);
 });
 
@@ -0,0 +1,26 @@
+const mongoose = require('mongoose');
+
+// An access token revoked before it expired, by its jti. Removed by the TTL
+// index once the token would have expired anyway.
+const revokedTokenSchema = new mongoose.Schema({
+  jti: {
+    type: String,
+    required: true,
+    unique: true
+  },
+  userId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  expiresAt: {
+    type: Date,
+    required: true
+  }
+}, {
+  timestamps: true
+});
+
+revokedTokenSchema.index({ expiresAt: 1 }, { expireAfterSeconds: 0 });
+
+module.exports = mongoose.model('RevokedToken', revokedTokenSchema);
@@ -0,0 +1,31 @@
+const mongoose = require('mongoose');
+
+// Email addresses and phone numbers nothing is sent to any more, after a hard
+// bounce, a complaint or a permanent SMS failure reported by SES/SNS
+const suppressionSchema = new mongoose.Schema({
+  channel: {
+    type: String,
+    enum: ['email', 'sms'],
+    required: true
+  },
+  // Lowercased email address, or phone number in E.164
+  address: {
+    type: String,
+    required: true
+  },
+  reason: {
+    type: String,
+    enum: ['bounce', 'complaint', 'sms-failure', 'manual'],
+    required: true
+  },
+  // Provider's description, e.g. the bounce diagnostic
+  detail: String,
+  // Provider message ID of the send that caused it
+  messageId: String
+}, {
+  timestamps: true
+});
+
+suppressionSchema.index({ channel: 1, address: 1 }, { unique: true });
+
+module.exports = mongoose.model('Suppression', suppressionSchema);
@@ -0,0 +1,51 @@
+const mongoose = require('mongoose');
+
+// Private post-consultation feedback. Unlike reviews these are never shown to
+// other patients; they only feed the doctor's quality metrics.
+const surveySchema = new mongoose.Schema({
+  appointmentId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Appointment',
+    required: true
+  },
+  doctorId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'Doctor',
+    required: true
+  },
+  patientId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User',
+    required: true
+  },
+  // Satisfaction with the wait before being seen, 1 (poor) to 5 (excellent)
+  waitTime: {
+    type: Number,
+    required: true,
+    min: 1,
+    max: 5
+  },
+  // How well the doctor explained and listened, 1 to 5
+  communication: {
+    type: Number,
+    required: true,
+    min: 1,
+    max: 5
+  },
+  wouldRecommend: {
+    type: Boolean,
+    required: true
+  },
+  comment: {
+    type: String,
+    trim: true,
+    maxlength: 1000
+  }
+}, {
+  timestamps: true
+});
+
+surveySchema.index({ appointmentId: 1 }, { unique: true });
+surveySchema.index({ doctorId: 1, createdAt: -1 });
+
+module.exports = mongoose.model('Survey', surveySchema);
@@ -62,7 +62,44 @@ const userSchema = new mongoose.Schema({
   },
   avatarUrl: String,
   languages: [String],
+  // Only for the patient and admins: loaded explicitly where needed
+  insurance: {
+    type: new mongoose.Schema({
+      insurer: String,
+      policyNumber: String,
+      updatedAt: Date
+    }, { _id: false }),
+    select: false
+  },
+  notificationPreferences: {
+    reviewEmails: {
+      type: Boolean,
+      default: true
+    }
+  },
+  // Explicit opt-in to notification SMS, kept apart from notificationPreferences
+  // because it is a legal consent. Verification codes are not affected.
+  smsConsent: {
+    granted: {
+      type: Boolean,
+      default: false
+    },
+    grantedAt: Date,
+    withdrawnAt: Date
+  },
+  // Appointment reminder channels and lead times. Users who never saved
+  // settings (no updatedAt) get config.reminders.defaults for their role.
+  reminderSettings: {
+    channels: [{
+      type: String,
+      enum: ['email', 'sms', 'push', 'in-app']
+    }],
+    leadTimesMinutes: [Number],
+    updatedAt: Date
+  },
   lastLogin: Date,
+  // Refreshed at most every few minutes by the activity middleware
+  lastActiveAt: Date,
   createdAt: {
     type: Date,
     default: Date.now
@@ -87,6 +124,15 @@ userSchema.index({ status: 1 });
 userSchema.index({ lastLogin: 1 });
 userSchema.index({ createdAt: 1 });
 
+// Record an SMS consent decision, stamping when it was given or withdrawn
+userSchema.methods.setSmsConsent = function(granted, now = new Date()) {
+  if (!!granted === !!(this.smsConsent && this.smsConsent.granted)) {
+    return;
+  }
+  this.set('smsConsent.granted', !!granted);
+  this.set(granted ? 'smsConsent.grantedAt' : 'smsConsent.withdrawnAt', now);
+};
+
 // Pre-save middleware
 userSchema.pre('save', function(next) {
   this.updatedAt = new Date();
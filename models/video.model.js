@@ -25,9 +25,22 @@ const videoSessionSchema = new mongoose.Schema({
     type: String,
     required: true
   },
+  // First time a participant joined; the call's duration is measured from here
   startedAt: {
     type: Date
   },
+  // Waiting room: when each party first joined and last (re)joined
+  participants: {
+    doctor: {
+      joinedAt: Date,
+      lastJoinedAt: Date
+    },
+    patient: {
+      joinedAt: Date,
+      lastJoinedAt: Date
+    }
+  },
+  // When the last participant left
   endedAt: {
     type: Date
   },
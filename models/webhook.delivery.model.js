@@ -0,0 +1,51 @@
+const mongoose = require('mongoose');
+
+// One event sent to one endpoint, with every attempt. A replay is a new
+// delivery of the same event, so receivers can deduplicate by eventId.
+const webhookDeliverySchema = new mongoose.Schema({
+  endpointId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'WebhookEndpoint',
+    required: true
+  },
+  eventId: {
+    type: String,
+    required: true
+  },
+  event: {
+    type: String,
+    required: true
+  },
+  // The JSON body sent, exactly as signed
+  body: {
+    type: String,
+    required: true
+  },
+  status: {
+    type: String,
+    // failed deliveries are retried with backoff; dead ones ran out of attempts
+    enum: ['pending', 'succeeded', 'failed', 'dead'],
+    default: 'pending'
+  },
+  attempts: [{
+    _id: false,
+    at: Date,
+    statusCode: Number,
+    error: String,
+    durationMs: Number
+  }],
+  deliveredAt: Date,
+  // The delivery this one replays
+  replayOf: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'WebhookDelivery'
+  }
+}, {
+  timestamps: true
+});
+
+webhookDeliverySchema.index({ endpointId: 1, createdAt: -1 });
+webhookDeliverySchema.index({ status: 1, createdAt: -1 });
+webhookDeliverySchema.index({ eventId: 1 });
+
+module.exports = mongoose.model('WebhookDelivery', webhookDeliverySchema);
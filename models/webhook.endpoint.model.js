@@ -0,0 +1,41 @@
+const mongoose = require('mongoose');
+const { WEBHOOK_EVENTS } = require('../utils/webhook');
+
+// An external system (e.g. a clinic's EHR) receiving signed appointment and
+// payment events
+const webhookEndpointSchema = new mongoose.Schema({
+  url: {
+    type: String,
+    required: true,
+    trim: true
+  },
+  description: {
+    type: String,
+    trim: true
+  },
+  // Events delivered to the endpoint
+  events: [{
+    type: String,
+    enum: WEBHOOK_EVENTS
+  }],
+  // Shared secret the HMAC signature is made with. Shown once, on creation.
+  secret: {
+    type: String,
+    required: true,
+    select: false
+  },
+  active: {
+    type: Boolean,
+    default: true
+  },
+  createdBy: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: 'User'
+  }
+}, {
+  timestamps: true
+});
+
+webhookEndpointSchema.index({ active: 1, events: 1 });
+
+module.exports = mongoose.model('WebhookEndpoint', webhookEndpointSchema);
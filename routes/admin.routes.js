@@ -1,15 +1,22 @@
 const express = require('express');
-const { body, validationResult } = require('express-validator');
+const { body, param, query, validationResult } = require('express-validator');
 const mongoose = require('mongoose');
 const User = require('../models/user.model');
 const Doctor = require('../models/doctor.model');
 const Appointment = require('../models/appointment.model');
 const Payment = require('../models/payment.model');
+const IntakeForm = require('../models/intake.form.model');
+const { getQueryOptions, isTimeoutError } = require('../middleware/timeout.middleware');
+const { WEBHOOK_EVENTS } = require('../utils/webhook');
 const AuthMiddleware = require('../middleware/auth.middleware');
 const AdminHandler = require('../handlers/admin.handler');
 
 const router = express.Router();
 
+// Every admin endpoint requires an authenticated admin; guard the whole router
+// instead of repeating the check on each route.
+router.use(AuthMiddleware.authenticate, AuthMiddleware.requireRole('admin'));
+
 /**
  * @swagger
  * tags:
@@ -278,8 +285,6 @@ const router = express.Router();
  *         description: Server error
  */
 router.get('/doctors',
-  AuthMiddleware.authenticate,
-  AuthMiddleware.authorize(['admin']),
   async (req, res) => {
     try {
       const { verificationStatus, status, specialization, page = 1, limit = 10 } = req.query;
@@ -322,6 +327,84 @@ router.get('/doctors',
   }
 );
 
+/**
+ * @swagger
+ * /api/v1/admin/doctors/profile-changes:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List doctors with profile changes waiting for approval
+ *     description: >
+ *       Changes that verified doctors make to reviewed fields (specializations
+ *       by default) are held here until an admin approves them.
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Doctors with pendingProfileChanges, oldest submission first
+ */
+router.get('/doctors/profile-changes', AdminHandler.getPendingProfileChanges);
+
+/**
+ * @swagger
+ * /api/v1/admin/doctors/{id}/profile-changes:
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Approve or reject a doctor's pending profile changes
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - status
+ *             properties:
+ *               status:
+ *                 type: string
+ *                 enum: [approved, rejected]
+ *               reason:
+ *                 type: string
+ *                 description: Required when rejecting
+ *     responses:
+ *       200:
+ *         description: Changes applied or discarded
+ *       400:
+ *         description: Invalid request data
+ *       404:
+ *         description: Doctor not found
+ *       409:
+ *         description: No pending changes, or they changed since they were loaded
+ */
+router.put('/doctors/:id/profile-changes',
+  [
+    body('status').isIn(['approved', 'rejected']).withMessage('Status must be approved or rejected'),
+    body('reason')
+      .if(body('status').equals('rejected'))
+      .isString().trim().notEmpty().withMessage('A reason is required when rejecting changes')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.reviewProfileChanges(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
 /**
  * @swagger
  * /api/v1/admin/doctors/{id}:
@@ -342,8 +425,6 @@ router.get('/doctors',
  *         description: Doctor details retrieved successfully
  */
 router.get('/doctors/:id', 
-  AuthMiddleware.authenticate, 
-  AuthMiddleware.authorize(['admin']), 
   async (req, res) => {
     try {
       const doctor = await Doctor.findById(req.params.id)
@@ -426,8 +507,6 @@ router.get('/doctors/:id',
  *         description: Server error
  */
 router.post('/doctors/:id/verify',
-  AuthMiddleware.authenticate,
-  AuthMiddleware.authorize(['admin']),
   [
     body('status').isIn(['pending', 'active', 'inactive', 'suspended']).withMessage('Invalid status'),
     body('rejectionReason').optional().isString().withMessage('Rejection reason must be a string')
@@ -540,7 +619,7 @@ router.get('/dashboard', async (req, res) => {
             count: { $sum: 1 }
           }
         }
-      ]),
+      ]).option(getQueryOptions(req)),
       Payment.aggregate([
         { $match: { status: 'success', ...dateFilter } },
         {
@@ -550,7 +629,7 @@ router.get('/dashboard', async (req, res) => {
             count: { $sum: 1 }
           }
         }
-      ])
+      ]).option(getQueryOptions(req))
     ]);
     
     // Format appointment stats
@@ -578,6 +657,9 @@ router.get('/dashboard', async (req, res) => {
       }
     });
   } catch (error) {
+    if (isTimeoutError(error)) {
+      return res.status(503).json({ message: 'Request timed out' });
+    }
     console.error('Admin dashboard error:', error);
     res.status(500).json({ message: 'Server error retrieving dashboard statistics' });
   }
@@ -585,60 +667,120 @@ router.get('/dashboard', async (req, res) => {
 
 /**
  * @swagger
- * /api/v1/admin/appointments:
+ * /api/v1/admin/analytics:
  *   get:
  *     tags:
  *       - Admin
- *     summary: Get all appointments with filter options
+ *     summary: Get time-series analytics
+ *     description: Appointments booked/completed/cancelled, revenue and new users per period, plus top specialties and cancellations in the range by category. Series include empty periods so they can be charted directly.
  *     security:
  *       - bearerAuth: []
  *     parameters:
  *       - in: query
- *         name: status
- *         schema:
- *           type: string
- *           enum: [pending, confirmed, cancelled, completed, no-show]
- *         description: Filter by appointment status
- *       - in: query
- *         name: from
+ *         name: startDate
  *         schema:
  *           type: string
  *           format: date
- *         description: Start date for appointment
+ *         description: Defaults to 30 days before endDate
  *       - in: query
- *         name: to
+ *         name: endDate
  *         schema:
  *           type: string
  *           format: date
- *         description: End date for appointment
- *       - in: query
- *         name: page
- *         schema:
- *           type: integer
- *           default: 1
- *         description: Page number
+ *         description: Defaults to now
  *       - in: query
- *         name: limit
+ *         name: granularity
  *         schema:
- *           type: integer
- *           default: 10
- *         description: Number of items per page
+ *           type: string
+ *           enum: [day, week, month]
+ *           default: day
  *     responses:
  *       200:
- *         description: Appointments retrieved successfully
+ *         description: Analytics retrieved successfully
  *         content:
  *           application/json:
  *             schema:
  *               type: object
  *               properties:
- *                 appointments:
- *                   type: array
- *                   items:
- *                     $ref: '#/definitions/Appointment'
- *                 totalPages:
- *                   type: integer
- *                 totalAppointments:
- *                   type: integer
+ *                 success:
+ *                   type: boolean
+ *                 data:
+ *                   type: object
+ *                   properties:
+ *                     granularity:
+ *                       type: string
+ *                     appointments:
+ *                       type: array
+ *                       items:
+ *                         type: object
+ *                         properties:
+ *                           period:
+ *                             type: string
+ *                             format: date-time
+ *                           booked:
+ *                             type: integer
+ *                           completed:
+ *                             type: integer
+ *                           cancelled:
+ *                             type: integer
+ *                     revenue:
+ *                       type: array
+ *                       description: Successful payments by the period they were paid in
+ *                       items:
+ *                         type: object
+ *                         properties:
+ *                           period:
+ *                             type: string
+ *                             format: date-time
+ *                           amounts:
+ *                             type: object
+ *                             description: Amount paid per currency code
+ *                             additionalProperties:
+ *                               type: number
+ *                             example:
+ *                               EUR: 150
+ *                           payments:
+ *                             type: integer
+ *                     newUsers:
+ *                       type: array
+ *                       items:
+ *                         type: object
+ *                         properties:
+ *                           period:
+ *                             type: string
+ *                             format: date-time
+ *                           patients:
+ *                             type: integer
+ *                           doctors:
+ *                             type: integer
+ *                     topSpecialties:
+ *                       type: array
+ *                       items:
+ *                         type: object
+ *                         properties:
+ *                           specialty:
+ *                             type: string
+ *                           appointments:
+ *                             type: integer
+ *                     cancellationCategories:
+ *                       type: array
+ *                       description: >
+ *                         Appointments cancelled in the range, counted by when
+ *                         they were cancelled. Every category is listed, plus
+ *                         uncategorized for cancellations without one.
+ *                       items:
+ *                         type: object
+ *                         properties:
+ *                           category:
+ *                             type: string
+ *                             enum: [patient_unavailable, found_other_care, doctor_unavailable, emergency, other, uncategorized]
+ *                           count:
+ *                             type: integer
+ *                           byCancelledBy:
+ *                             type: object
+ *                             description: Count per role that cancelled (patient, doctor, admin, system)
+ *       400:
+ *         description: Invalid granularity or date range
  *       401:
  *         description: Unauthorized
  *       403:
@@ -646,122 +788,16 @@ router.get('/dashboard', async (req, res) => {
  *       500:
  *         description: Server error
  */
-router.get('/appointments', async (req, res) => {
-  try {
-    const { 
-      status, 
-      from, 
-      to,
-      page = 1, 
-      limit = 10 
-    } = req.query;
-    
-    // Build query
-    let query = {};
-    
-    // Filter by status
-    if (status && ['pending', 'confirmed', 'cancelled', 'completed', 'no-show'].includes(status)) {
-      query.status = status;
-    }
-    
-    // Filter by date range
-    if (from || to) {
-      query.scheduledAt = {};
-      if (from) query.scheduledAt.$gte = new Date(from);
-      if (to) query.scheduledAt.$lte = new Date(to);
-    }
-    
-    // Calculate pagination
-    const skip = (Number(page) - 1) * Number(limit);
-    
-    // Get appointments with patient/doctor info
-    const appointments = await Appointment.aggregate([
-      { $match: query },
-      {
-        $lookup: {
-          from: 'users',
-          localField: 'patientId',
-          foreignField: '_id',
-          as: 'patient'
-        }
-      },
-      {
-        $lookup: {
-          from: 'doctors',
-          localField: 'doctorId',
-          foreignField: '_id',
-          as: 'doctor'
-        }
-      },
-      {
-        $lookup: {
-          from: 'users',
-          localField: 'doctor.userId',
-          foreignField: '_id',
-          as: 'doctorUser'
-        }
-      },
-      {
-        $lookup: {
-          from: 'payments',
-          localField: '_id',
-          foreignField: 'appointmentId',
-          as: 'payment'
-        }
-      },
-      { $unwind: '$patient' },
-      { $unwind: '$doctor' },
-      { $unwind: '$doctorUser' },
-      {
-        $project: {
-          _id: 1,
-          scheduledAt: 1,
-          status: 1,
-          paymentStatus: 1,
-          mode: 1,
-          secondOpinion: 1,
-          createdAt: 1,
-          'patient._id': 1,
-          'patient.firstName': 1,
-          'patient.lastName': 1,
-          'patient.email': 1,
-          'doctor._id': 1,
-          'doctor.specialties': 1,
-          'doctor.consultationFee': 1,
-          'doctorUser.firstName': 1,
-          'doctorUser.lastName': 1,
-          'doctorUser.email': 1,
-          payment: { $arrayElemAt: ['$payment', 0] }
-        }
-      },
-      { $sort: { scheduledAt: -1 } },
-      { $skip: skip },
-      { $limit: Number(limit) }
-    ]);
-    
-    // Get total count
-    const totalAppointments = await Appointment.countDocuments(query);
-    
-    res.json({
-      appointments,
-      page: Number(page),
-      limit: Number(limit),
-      totalPages: Math.ceil(totalAppointments / Number(limit)),
-      totalAppointments
-    });
-  } catch (error) {
-    console.error('Admin get appointments error:', error);
-    res.status(500).json({ message: 'Server error retrieving appointments' });
-  }
-});
+router.get('/analytics', AdminHandler.getAnalytics);
 
 /**
  * @swagger
- * /api/v1/admin/patients:
+ * /api/v1/admin/queue/dead-letters:
  *   get:
  *     tags:
  *       - Admin
- *     summary: Get all patients
+ *     summary: List jobs that landed in the dead-letter queue
+ *     description: Jobs that failed maxReceiveCount times, with every recorded attempt, plus the approximate dead-letter queue depth.
  *     security:
  *       - bearerAuth: []
  *     parameters:
@@ -770,34 +806,14 @@ router.get('/appointments', async (req, res) => {
  *         schema:
  *           type: integer
  *           default: 1
- *         description: Page number
  *       - in: query
  *         name: limit
  *         schema:
  *           type: integer
- *           default: 10
- *         description: Number of items per page
- *       - in: query
- *         name: search
- *         schema:
- *           type: string
- *         description: Search term for patient name or email
+ *           default: 20
  *     responses:
  *       200:
- *         description: List of patients retrieved successfully
- *         content:
- *           application/json:
- *             schema:
- *               type: object
- *               properties:
- *                 patients:
- *                   type: array
- *                   items:
- *                     $ref: '#/definitions/User'
- *                 totalPages:
- *                   type: integer
- *                 totalPatients:
- *                   type: integer
+ *         description: Dead-letter jobs retrieved successfully
  *       401:
  *         description: Unauthorized
  *       403:
@@ -805,35 +821,1501 @@ router.get('/appointments', async (req, res) => {
  *       500:
  *         description: Server error
  */
-router.get('/patients', async (req, res) => {
-  try {
-    const { page = 1, limit = 10, search } = req.query;
-    
-    // Build query
-    let query = { role: 'patient' };
-    
-    // Add search if provided
-    if (search) {
-      const searchRegex = new RegExp(search, 'i');
-      query.$or = [
-        { firstName: searchRegex },
-        { lastName: searchRegex },
-        { email: searchRegex }
-      ];
-    }
-    
-    // Calculate pagination
-    const skip = (Number(page) - 1) * Number(limit);
-    
-    // Get patients
-    const patients = await User.find(query)
-      .select('firstName lastName email phone avatarUrl createdAt lastLogin')
-      .sort({ createdAt: -1 })
-      .skip(skip)
-      .limit(Number(limit));
-    
-    // Get total count
-    const totalPatients = await User.countDocuments(query);
+router.get('/queue/dead-letters', AdminHandler.getDeadLetterJobs);
+
+/**
+ * @swagger
+ * /api/v1/admin/queue/dead-letters/redrive:
+ *   post:
+ *     tags:
+ *       - Admin
+ *     summary: Redrive dead-lettered jobs
+ *     description: Moves messages from the dead-letter queue back to the main queue.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               limit:
+ *                 type: integer
+ *                 default: 10
+ *                 maximum: 100
+ *     responses:
+ *       200:
+ *         description: Number of messages redriven
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Forbidden - Admin access required
+ *       500:
+ *         description: Server error
+ */
+router.post('/queue/dead-letters/redrive', AdminHandler.redriveDeadLetterJobs);
+
+/**
+ * @swagger
+ * /api/v1/admin/suppressions:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List suppressed email addresses and phone numbers
+ *     description: >
+ *       Addresses that bounced hard, complained or permanently failed SMS
+ *       delivery, as reported by SES/SNS feedback. Nothing is sent to them.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: channel
+ *         schema:
+ *           type: string
+ *           enum: [email, sms]
+ *       - in: query
+ *         name: page
+ *         schema:
+ *           type: integer
+ *           default: 1
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 20
+ *     responses:
+ *       200:
+ *         description: Suppressions retrieved successfully
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Forbidden - Admin access required
+ *       500:
+ *         description: Server error
+ */
+router.get('/suppressions', AdminHandler.getSuppressions);
+
+/**
+ * @swagger
+ * /api/v1/admin/suppressions/{id}:
+ *   delete:
+ *     tags:
+ *       - Admin
+ *     summary: Lift a suppression
+ *     description: Sending to the address resumes.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Suppression lifted
+ *       404:
+ *         description: Suppression not found
+ *       500:
+ *         description: Server error
+ */
+router.delete('/suppressions/:id', AdminHandler.deleteSuppression);
+
+/**
+ * @swagger
+ * /api/v1/admin/payouts:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List doctor payouts
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: status
+ *         schema:
+ *           type: string
+ *           enum: [pending, paid]
+ *       - in: query
+ *         name: doctorId
+ *         schema:
+ *           type: string
+ *       - in: query
+ *         name: page
+ *         schema:
+ *           type: integer
+ *           default: 1
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 20
+ *     responses:
+ *       200:
+ *         description: Payouts retrieved successfully
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Forbidden - Admin access required
+ *   post:
+ *     tags:
+ *       - Admin
+ *     summary: Create payouts for a doctor
+ *     description: Bundles the doctor's successful payments that are not yet in a payout into pending payouts, one per currency. Each payment is included in at most one payout.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - doctorId
+ *             properties:
+ *               doctorId:
+ *                 type: string
+ *               periodStart:
+ *                 type: string
+ *                 format: date-time
+ *               periodEnd:
+ *                 type: string
+ *                 format: date-time
+ *                 description: Payments made up to this time are included (defaults to now)
+ *     responses:
+ *       201:
+ *         description: Payouts created (empty when nothing is owed)
+ *       400:
+ *         description: Invalid input
+ *       404:
+ *         description: Doctor not found
+ */
+router.get('/payouts', AdminHandler.getPayouts);
+
+/**
+ * @swagger
+ * /api/v1/admin/doctors/{id}/commission:
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Set a doctor's commission override
+ *     description: Overrides the platform-wide commission for this doctor's future payments. Send null to fall back to the platform rate.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - commissionPercent
+ *             properties:
+ *               commissionPercent:
+ *                 type: number
+ *                 nullable: true
+ *                 minimum: 0
+ *                 maximum: 100
+ *     responses:
+ *       200:
+ *         description: Commission updated
+ *       400:
+ *         description: Invalid percentage
+ *       404:
+ *         description: Doctor not found
+ */
+router.put('/doctors/:id/commission',
+  [
+    body('commissionPercent')
+      .custom(value => value === null || (typeof value === 'number' && value >= 0 && value <= 100))
+      .withMessage('commissionPercent must be a number between 0 and 100, or null')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.updateDoctorCommission(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+router.post('/payouts',
+  [
+    body('doctorId').isMongoId().withMessage('Valid doctor ID is required'),
+    body('periodStart').optional().isISO8601().withMessage('periodStart must be a date'),
+    body('periodEnd').optional().isISO8601().withMessage('periodEnd must be a date')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.createPayouts(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/admin/payouts/{id}/paid:
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Mark a payout as paid
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               reference:
+ *                 type: string
+ *                 description: Bank or provider reference for the transfer
+ *     responses:
+ *       200:
+ *         description: Payout marked as paid
+ *       404:
+ *         description: Payout not found
+ *       409:
+ *         description: Payout is already paid
+ */
+router.put('/payouts/:id/paid', AdminHandler.markPayoutPaid);
+
+/**
+ * @swagger
+ * /api/v1/admin/reports/financial:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: Export successful payments for accounting
+ *     description: >
+ *       One row per payment that succeeded in the period (by payment date),
+ *       including payments refunded since, joined with its appointment and
+ *       doctor. Columns: paymentId, paidAt, provider, providerReference,
+ *       method, currency, gross, commissionPercent, commission, tax, net,
+ *       refundStatus (none, partial, full), refundedAmount, refundedAt,
+ *       payoutId, appointmentId, appointmentDate, appointmentStartTime,
+ *       appointmentType, appointmentStatus, doctorId, doctorName, patientId.
+ *       Commission and net reflect refunds. No tax is charged, so tax is 0.
+ *       The report is streamed.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: from
+ *         schema:
+ *           type: string
+ *           format: date-time
+ *         description: Defaults to 30 days before to
+ *       - in: query
+ *         name: to
+ *         schema:
+ *           type: string
+ *           format: date-time
+ *         description: Defaults to now
+ *       - in: query
+ *         name: format
+ *         schema:
+ *           type: string
+ *           enum: [json, csv]
+ *           default: json
+ *     responses:
+ *       200:
+ *         description: The report, as JSON ({ from, to, columns, rows }) or a CSV attachment
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *           text/csv:
+ *             schema:
+ *               type: string
+ *       400:
+ *         description: Invalid date range or format
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Forbidden - Admin access required
+ */
+router.get('/reports/financial',
+  [
+    query('from').optional().isISO8601().withMessage('from must be a date'),
+    query('to').optional().isISO8601().withMessage('to must be a date'),
+    query('format').optional().isIn(['json', 'csv']).withMessage('format must be json or csv')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.getFinancialReport(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * components:
+ *   schemas:
+ *     IntakeQuestion:
+ *       type: object
+ *       required:
+ *         - key
+ *         - label
+ *         - type
+ *       properties:
+ *         key:
+ *           type: string
+ *           description: Lowercase identifier answers are stored under, e.g. smoker
+ *         label:
+ *           type: string
+ *         type:
+ *           type: string
+ *           enum: [text, number, boolean, choice, multi-choice]
+ *         required:
+ *           type: boolean
+ *           default: false
+ *         options:
+ *           type: array
+ *           items:
+ *             type: string
+ *           description: Required for choice and multi-choice questions
+ *         min:
+ *           type: number
+ *         max:
+ *           type: number
+ *         maxLength:
+ *           type: integer
+ *           default: 1000
+ * /api/v1/admin/intake-forms:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List intake form templates
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: All intake forms, active or not
+ *   post:
+ *     tags:
+ *       - Admin
+ *     summary: Create the intake form for a specialty
+ *     description: >
+ *       Patients answer the form before consultations with doctors of the
+ *       specialty. Specialties match the doctors' specializations regardless
+ *       of case; each specialty has at most one form.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - specialty
+ *               - title
+ *               - questions
+ *             properties:
+ *               specialty:
+ *                 type: string
+ *               title:
+ *                 type: string
+ *               isActive:
+ *                 type: boolean
+ *                 default: true
+ *               questions:
+ *                 type: array
+ *                 items:
+ *                   $ref: '#/components/schemas/IntakeQuestion'
+ *     responses:
+ *       201:
+ *         description: Form created
+ *       400:
+ *         description: Invalid form or questions
+ *       409:
+ *         description: The specialty already has a form
+ * /api/v1/admin/intake-forms/{id}:
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Update an intake form
+ *     description: Replacing the questions bumps the form version. Deactivated forms are no longer served to patients.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               title:
+ *                 type: string
+ *               isActive:
+ *                 type: boolean
+ *               questions:
+ *                 type: array
+ *                 items:
+ *                   $ref: '#/components/schemas/IntakeQuestion'
+ *     responses:
+ *       200:
+ *         description: Form updated
+ *       400:
+ *         description: Invalid form or questions
+ *       404:
+ *         description: Intake form not found
+ */
+const intakeQuestionValidators = [
+  body('questions.*.key').matches(/^[a-z][a-z0-9_]*$/).withMessage('Question keys must be lowercase letters, digits and underscores'),
+  body('questions.*.label').isString().trim().notEmpty().withMessage('Question label is required'),
+  body('questions.*.type').isIn(IntakeForm.QUESTION_TYPES).withMessage(`Question type must be one of: ${IntakeForm.QUESTION_TYPES.join(', ')}`),
+  body('questions.*.required').optional().isBoolean().withMessage('required must be a boolean'),
+  body('questions.*.options').optional().isArray().withMessage('options must be an array')
+];
+
+router.get('/intake-forms', AdminHandler.getIntakeForms);
+
+router.post('/intake-forms',
+  [
+    body('specialty').isString().trim().notEmpty().withMessage('Specialty is required'),
+    body('title').isString().trim().notEmpty().withMessage('Title is required'),
+    body('isActive').optional().isBoolean().withMessage('isActive must be a boolean'),
+    body('questions').isArray({ min: 1 }).withMessage('At least one question is required'),
+    ...intakeQuestionValidators
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.createIntakeForm(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+router.put('/intake-forms/:id',
+  [
+    body('title').optional().isString().trim().notEmpty().withMessage('Title must be a non-empty string'),
+    body('isActive').optional().isBoolean().withMessage('isActive must be a boolean'),
+    body('questions').optional().isArray({ min: 1 }).withMessage('At least one question is required'),
+    ...intakeQuestionValidators
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.updateIntakeForm(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/admin/prep-instructions:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List visit preparation instructions
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: All prep instructions, active or not
+ *   post:
+ *     tags:
+ *       - Admin
+ *     summary: Add preparation instructions for a specialty or appointment type
+ *     description: >
+ *       Active instructions are added to patients' appointment reminders. They
+ *       apply to a specialty (matching doctors' specializations regardless of
+ *       case), an appointment type, or both. When several apply, specialty and
+ *       type together win over specialty alone, which wins over type alone.
+ *       Appointments nothing applies to get no prep text.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - instructions
+ *             properties:
+ *               specialty:
+ *                 type: string
+ *                 example: Gastroenterologist
+ *               appointmentType:
+ *                 type: string
+ *                 enum: [in-person, video, phone]
+ *               instructions:
+ *                 type: string
+ *                 maxLength: 500
+ *                 example: Do not eat or drink for 8 hours before your appointment.
+ *               isActive:
+ *                 type: boolean
+ *                 default: true
+ *     responses:
+ *       201:
+ *         description: Instructions created
+ *       400:
+ *         description: Missing instructions, or neither specialty nor type given
+ *       409:
+ *         description: Instructions already exist for this specialty and type
+ * /api/v1/admin/prep-instructions/{id}:
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Update or deactivate preparation instructions
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               instructions:
+ *                 type: string
+ *                 maxLength: 500
+ *               isActive:
+ *                 type: boolean
+ *     responses:
+ *       200:
+ *         description: Instructions updated
+ *       400:
+ *         description: Invalid instructions
+ *       404:
+ *         description: Prep instructions not found
+ */
+router.get('/prep-instructions', AdminHandler.getPrepInstructions);
+
+router.post('/prep-instructions',
+  [
+    body('specialty').optional({ values: 'null' }).isString().trim().notEmpty().withMessage('Specialty must be a non-empty string'),
+    body('appointmentType').optional({ values: 'null' }).isIn(['in-person', 'video', 'phone']).withMessage('appointmentType must be in-person, video or phone'),
+    body('instructions').isString().trim().isLength({ min: 1, max: 500 }).withMessage('Instructions of at most 500 characters are required'),
+    body('isActive').optional().isBoolean().withMessage('isActive must be a boolean')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.createPrepInstruction(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+router.put('/prep-instructions/:id',
+  [
+    body('instructions').optional().isString().trim().isLength({ min: 1, max: 500 }).withMessage('Instructions must be 1 to 500 characters'),
+    body('isActive').optional().isBoolean().withMessage('isActive must be a boolean')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.updatePrepInstruction(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/admin/webhooks:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List webhook endpoints
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Endpoints, without their secrets
+ *   post:
+ *     tags:
+ *       - Admin
+ *     summary: Register a webhook endpoint
+ *     description: >
+ *       The endpoint receives POSTs of signed JSON events
+ *       ({ id, type, createdAt, data }). The X-MedConnecter-Signature header
+ *       is "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<raw body>" with the
+ *       secret>". Failed deliveries are retried with backoff through the job
+ *       queue. The secret is only returned in this response.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - url
+ *               - events
+ *             properties:
+ *               url:
+ *                 type: string
+ *               events:
+ *                 type: array
+ *                 items:
+ *                   type: string
+ *                   enum: [appointment.created, appointment.confirmed, appointment.cancelled, appointment.completed, payment.succeeded]
+ *               description:
+ *                 type: string
+ *     responses:
+ *       201:
+ *         description: Endpoint created, with its secret
+ *       400:
+ *         description: Invalid request data
+ */
+router.get('/webhooks', AdminHandler.getWebhookEndpoints);
+
+router.post('/webhooks',
+  [
+    body('url').isURL({ protocols: ['https', 'http'], require_protocol: true }).withMessage('A valid http(s) URL is required'),
+    body('events').isArray({ min: 1 }).withMessage('Events must be a non-empty array'),
+    body('events.*').isIn(WEBHOOK_EVENTS).withMessage(`Events must be among: ${WEBHOOK_EVENTS.join(', ')}`),
+    body('description').optional().isString().trim().isLength({ max: 200 }).withMessage('Description must be at most 200 characters')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.createWebhookEndpoint(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/admin/webhooks/{id}:
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Update a webhook endpoint
+ *     description: rotateSecret issues a new secret, returned once in the response.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               url:
+ *                 type: string
+ *               events:
+ *                 type: array
+ *                 items:
+ *                   type: string
+ *               description:
+ *                 type: string
+ *               active:
+ *                 type: boolean
+ *               rotateSecret:
+ *                 type: boolean
+ *     responses:
+ *       200:
+ *         description: Endpoint updated
+ *       404:
+ *         description: Endpoint not found
+ *   delete:
+ *     tags:
+ *       - Admin
+ *     summary: Delete a webhook endpoint
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Endpoint deleted
+ *       404:
+ *         description: Endpoint not found
+ */
+router.put('/webhooks/:id',
+  [
+    body('url').optional().isURL({ protocols: ['https', 'http'], require_protocol: true }).withMessage('A valid http(s) URL is required'),
+    body('events').optional().isArray({ min: 1 }).withMessage('Events must be a non-empty array'),
+    body('events.*').isIn(WEBHOOK_EVENTS).withMessage(`Events must be among: ${WEBHOOK_EVENTS.join(', ')}`),
+    body('description').optional().isString().trim().isLength({ max: 200 }).withMessage('Description must be at most 200 characters'),
+    body('active').optional().isBoolean().withMessage('active must be a boolean'),
+    body('rotateSecret').optional().isBoolean().withMessage('rotateSecret must be a boolean')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.updateWebhookEndpoint(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+router.delete('/webhooks/:id', AdminHandler.deleteWebhookEndpoint);
+
+/**
+ * @swagger
+ * /api/v1/admin/webhooks/{id}/deliveries:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: An endpoint's deliveries and their attempts
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *       - in: query
+ *         name: status
+ *         schema:
+ *           type: string
+ *           enum: [pending, succeeded, failed, dead]
+ *       - in: query
+ *         name: event
+ *         schema:
+ *           type: string
+ *       - in: query
+ *         name: page
+ *         schema:
+ *           type: integer
+ *           default: 1
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 20
+ *     responses:
+ *       200:
+ *         description: Deliveries retrieved successfully
+ */
+router.get('/webhooks/:id/deliveries', AdminHandler.getWebhookDeliveries);
+
+/**
+ * @swagger
+ * /api/v1/admin/webhooks/deliveries/{id}/replay:
+ *   post:
+ *     tags:
+ *       - Admin
+ *     summary: Send a delivery's event again
+ *     description: >
+ *       Queues a new delivery of the same event (same event id) to the same
+ *       endpoint, signed afresh.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       201:
+ *         description: The new delivery
+ *       404:
+ *         description: Delivery not found
+ */
+router.post('/webhooks/deliveries/:id/replay', AdminHandler.replayWebhookDelivery);
+
+/**
+ * @swagger
+ * /api/v1/admin/blocks:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List doctor-patient blocks
+ *     description: Each block includes its history of who blocked and unblocked the pair, and why.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: doctorId
+ *         schema:
+ *           type: string
+ *       - in: query
+ *         name: patientId
+ *         schema:
+ *           type: string
+ *       - in: query
+ *         name: active
+ *         schema:
+ *           type: boolean
+ *       - in: query
+ *         name: page
+ *         schema:
+ *           type: integer
+ *           default: 1
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 20
+ *     responses:
+ *       200:
+ *         description: Blocks retrieved successfully
+ *   post:
+ *     tags:
+ *       - Admin
+ *     summary: Block a patient for a doctor
+ *     description: >
+ *       Same effect as the doctor blocking the patient. The doctor can't lift
+ *       a block an admin placed.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - doctorId
+ *               - patientId
+ *             properties:
+ *               doctorId:
+ *                 type: string
+ *               patientId:
+ *                 type: string
+ *               reason:
+ *                 type: string
+ *                 maxLength: 500
+ *     responses:
+ *       201:
+ *         description: Patient blocked
+ *       200:
+ *         description: The pair was already blocked
+ *       404:
+ *         description: Doctor or patient not found
+ */
+router.get('/blocks',
+  [
+    query('doctorId').optional().isMongoId().withMessage('Invalid doctor ID'),
+    query('patientId').optional().isMongoId().withMessage('Invalid patient ID'),
+    query('active').optional().isBoolean().withMessage('active must be a boolean')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.getBlocks(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+router.post('/blocks',
+  [
+    body('doctorId').isMongoId().withMessage('Valid doctor ID is required'),
+    body('patientId').isMongoId().withMessage('Valid patient ID is required'),
+    body('reason').optional().isString().trim().isLength({ max: 500 }).withMessage('Reason must be at most 500 characters')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.createBlock(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/admin/blocks/{id}:
+ *   delete:
+ *     tags:
+ *       - Admin
+ *     summary: Lift a block
+ *     description: Bookings and messages between the pair are allowed again. The history is kept.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               reason:
+ *                 type: string
+ *     responses:
+ *       200:
+ *         description: Block lifted
+ *       404:
+ *         description: Block not found or already lifted
+ */
+router.delete('/blocks/:id', AdminHandler.deleteBlock);
+
+/**
+ * @swagger
+ * /api/v1/admin/booking-throttles:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: List specialty booking throttles
+ *     description: >
+ *       Each throttle with bookedThisHour and bookedToday, the new bookings
+ *       counted in the current UTC hour and day. Specialties without a
+ *       throttle are unlimited.
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Throttles retrieved successfully
+ */
+router.get('/booking-throttles', AdminHandler.getBookingThrottles);
+
+/**
+ * @swagger
+ * /api/v1/admin/booking-throttles/{specialty}:
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Throttle new bookings for a specialty
+ *     description: >
+ *       Caps new bookings with doctors of this specialty per UTC hour and/or
+ *       day, e.g. during flu season. Bookings over a cap get 429 with code
+ *       SPECIALTY_BOOKINGS_THROTTLED until the window ends. A limit left out
+ *       is unlimited. The specialty is matched case-insensitively against
+ *       doctors' specializations.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: specialty
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               maxPerHour:
+ *                 type: integer
+ *                 minimum: 1
+ *               maxPerDay:
+ *                 type: integer
+ *                 minimum: 1
+ *               reason:
+ *                 type: string
+ *                 maxLength: 500
+ *     responses:
+ *       201:
+ *         description: Throttle created
+ *       200:
+ *         description: Throttle updated
+ *       400:
+ *         description: Neither limit set, or an invalid limit
+ *   delete:
+ *     tags:
+ *       - Admin
+ *     summary: Lift a specialty's booking throttle
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: specialty
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Throttle removed
+ *       404:
+ *         description: No throttle for this specialty
+ */
+router.put('/booking-throttles/:specialty',
+  [
+    param('specialty').trim().notEmpty().isLength({ max: 100 }).withMessage('Specialty is required'),
+    body('maxPerHour').optional({ nullable: true }).isInt({ min: 1 }).withMessage('maxPerHour must be a whole number of at least 1').toInt(),
+    body('maxPerDay').optional({ nullable: true }).isInt({ min: 1 }).withMessage('maxPerDay must be a whole number of at least 1').toInt(),
+    body('reason').optional().isString().trim().isLength({ max: 500 }).withMessage('Reason must be at most 500 characters')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.setBookingThrottle(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+router.delete('/booking-throttles/:specialty', AdminHandler.deleteBookingThrottle);
+
+/**
+ * @swagger
+ * /api/v1/admin/settings:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: Get platform settings
+ *     description: >
+ *       Settings admins can change at runtime, with their effective values
+ *       (overrides, or the server's configured defaults), which are
+ *       overridden, their allowed ranges and the recent change history.
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Platform settings
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 success:
+ *                   type: boolean
+ *                 data:
+ *                   type: object
+ *                   properties:
+ *                     version:
+ *                       type: integer
+ *                     settings:
+ *                       $ref: '#/components/schemas/PlatformSettings'
+ *                     overridden:
+ *                       type: array
+ *                       items:
+ *                         type: string
+ *                       example: [appointments.slotDurationMinutes]
+ *                     limits:
+ *                       type: object
+ *                     history:
+ *                       type: array
+ *                       items:
+ *                         type: object
+ *   put:
+ *     tags:
+ *       - Admin
+ *     summary: Update platform settings
+ *     description: >
+ *       Changes take effect on this instance immediately and on others within
+ *       SETTINGS_REFRESH_INTERVAL_MS. Only the settings given are changed;
+ *       null resets one to its default. version must be the version last
+ *       read; if someone else saved in between the update is refused with 409.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - version
+ *               - settings
+ *             properties:
+ *               version:
+ *                 type: integer
+ *               settings:
+ *                 $ref: '#/components/schemas/PlatformSettings'
+ *     responses:
+ *       200:
+ *         description: Settings updated
+ *       400:
+ *         description: Unknown setting or value out of range
+ *       409:
+ *         description: The settings changed since the given version
+ * components:
+ *   schemas:
+ *     PlatformSettings:
+ *       type: object
+ *       properties:
+ *         appointments:
+ *           type: object
+ *           properties:
+ *             slotDurationMinutes:
+ *               type: integer
+ *               nullable: true
+ *             maxReschedules:
+ *               type: integer
+ *               nullable: true
+ *             suggestionCount:
+ *               type: integer
+ *               nullable: true
+ *         payments:
+ *           type: object
+ *           properties:
+ *             holdMinutes:
+ *               type: integer
+ *               nullable: true
+ *         reviews:
+ *           type: object
+ *           properties:
+ *             minReviewsForRating:
+ *               type: integer
+ *               nullable: true
+ *         chat:
+ *           type: object
+ *           properties:
+ *             maxTemplatesPerDoctor:
+ *               type: integer
+ *               nullable: true
+ */
+router.get('/settings', AdminHandler.getSettings);
+
+router.put('/settings',
+  [
+    body('version').isInt({ min: 0 }).withMessage('version must be the settings version last read').toInt(),
+    body('settings').isObject().withMessage('settings must be an object')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AdminHandler.updateSettings(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/admin/appointments:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: Get all appointments with filter options
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: status
+ *         schema:
+ *           type: string
+ *           enum: [pending, confirmed, cancelled, completed, no-show]
+ *         description: Filter by appointment status
+ *       - in: query
+ *         name: from
+ *         schema:
+ *           type: string
+ *           format: date
+ *         description: Start date for appointment
+ *       - in: query
+ *         name: to
+ *         schema:
+ *           type: string
+ *           format: date
+ *         description: End date for appointment
+ *       - in: query
+ *         name: page
+ *         schema:
+ *           type: integer
+ *           default: 1
+ *         description: Page number
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 10
+ *         description: Number of items per page
+ *     responses:
+ *       200:
+ *         description: Appointments retrieved successfully
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 appointments:
+ *                   type: array
+ *                   items:
+ *                     $ref: '#/definitions/Appointment'
+ *                 totalPages:
+ *                   type: integer
+ *                 totalAppointments:
+ *                   type: integer
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Forbidden - Admin access required
+ *       500:
+ *         description: Server error
+ */
+router.get('/appointments', async (req, res) => {
+  try {
+    const { 
+      status, 
+      from, 
+      to,
+      page = 1, 
+      limit = 10 
+    } = req.query;
+    
+    // Build query
+    let query = {};
+    
+    // Filter by status
+    if (status && ['pending', 'confirmed', 'cancelled', 'completed', 'no-show'].includes(status)) {
+      query.status = status;
+    }
+    
+    // Filter by date range
+    if (from || to) {
+      query.scheduledAt = {};
+      if (from) query.scheduledAt.$gte = new Date(from);
+      if (to) query.scheduledAt.$lte = new Date(to);
+    }
+    
+    // Calculate pagination
+    const skip = (Number(page) - 1) * Number(limit);
+    
+    // Get appointments with patient/doctor info
+    const appointments = await Appointment.aggregate([
+      { $match: query },
+      {
+        $lookup: {
+          from: 'users',
+          localField: 'patientId',
+          foreignField: '_id',
+          as: 'patient'
+        }
+      },
+      {
+        $lookup: {
+          from: 'doctors',
+          localField: 'doctorId',
+          foreignField: '_id',
+          as: 'doctor'
+        }
+      },
+      {
+        $lookup: {
+          from: 'users',
+          localField: 'doctor.userId',
+          foreignField: '_id',
+          as: 'doctorUser'
+        }
+      },
+      {
+        $lookup: {
+          from: 'payments',
+          localField: '_id',
+          foreignField: 'appointmentId',
+          as: 'payment'
+        }
+      },
+      { $unwind: '$patient' },
+      { $unwind: '$doctor' },
+      { $unwind: '$doctorUser' },
+      {
+        $project: {
+          _id: 1,
+          scheduledAt: 1,
+          status: 1,
+          paymentStatus: 1,
+          mode: 1,
+          secondOpinion: 1,
+          createdAt: 1,
+          'patient._id': 1,
+          'patient.firstName': 1,
+          'patient.lastName': 1,
+          'patient.email': 1,
+          'doctor._id': 1,
+          'doctor.specialties': 1,
+          'doctor.consultationFee': 1,
+          'doctorUser.firstName': 1,
+          'doctorUser.lastName': 1,
+          'doctorUser.email': 1,
+          payment: { $arrayElemAt: ['$payment', 0] }
+        }
+      },
+      { $sort: { scheduledAt: -1 } },
+      { $skip: skip },
+      { $limit: Number(limit) }
+    ]).option(getQueryOptions(req));
+    
+    // Get total count
+    const totalAppointments = await Appointment.countDocuments(query);
+    
+    res.json({
+      appointments,
+      page: Number(page),
+      limit: Number(limit),
+      totalPages: Math.ceil(totalAppointments / Number(limit)),
+      totalAppointments
+    });
+  } catch (error) {
+    if (isTimeoutError(error)) {
+      return res.status(503).json({ message: 'Request timed out' });
+    }
+    console.error('Admin get appointments error:', error);
+    res.status(500).json({ message: 'Server error retrieving appointments' });
+  }
+});
+
+/**
+ * @swagger
+ * /api/v1/admin/patients:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: Get all patients
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: page
+ *         schema:
+ *           type: integer
+ *           default: 1
+ *         description: Page number
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 10
+ *         description: Number of items per page
+ *       - in: query
+ *         name: search
+ *         schema:
+ *           type: string
+ *         description: Search term for patient name or email
+ *     responses:
+ *       200:
+ *         description: List of patients retrieved successfully
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 patients:
+ *                   type: array
+ *                   items:
+ *                     $ref: '#/definitions/User'
+ *                 totalPages:
+ *                   type: integer
+ *                 totalPatients:
+ *                   type: integer
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Forbidden - Admin access required
+ *       500:
+ *         description: Server error
+ */
+router.get('/patients', async (req, res) => {
+  try {
+    const { page = 1, limit = 10, search } = req.query;
+    
+    // Build query
+    let query = { role: 'patient' };
+    
+    // Add search if provided
+    if (search) {
+      const searchRegex = new RegExp(search, 'i');
+      query.$or = [
+        { firstName: searchRegex },
+        { lastName: searchRegex },
+        { email: searchRegex }
+      ];
+    }
+    
+    // Calculate pagination
+    const skip = (Number(page) - 1) * Number(limit);
+    
+    // Get patients
+    const patients = await User.find(query)
+      .select('firstName lastName email phone avatarUrl createdAt lastLogin')
+      .sort({ createdAt: -1 })
+      .skip(skip)
+      .limit(Number(limit));
+    
+    // Get total count
+    const totalPatients = await User.countDocuments(query);
     
     res.json({
       patients,
@@ -878,8 +2360,6 @@ router.get('/patients', async (req, res) => {
  *         description: List of users retrieved successfully
  */
 router.get('/users', 
-  AuthMiddleware.authenticate, 
-  AuthMiddleware.authorize(['admin']), 
   async (req, res) => {
     try {
       const { role, status, page = 1, limit = 10 } = req.query;
@@ -935,8 +2415,6 @@ router.get('/users',
  *         description: User details retrieved successfully
  */
 router.get('/users/:id', 
-  AuthMiddleware.authenticate, 
-  AuthMiddleware.authorize(['admin']), 
   async (req, res) => {
     try {
       const user = await User.findById(req.params.id).select('-password');
@@ -985,8 +2463,6 @@ router.get('/users/:id',
  *         description: User status updated successfully
  */
 router.put('/users/:id/status', 
-  AuthMiddleware.authenticate, 
-  AuthMiddleware.authorize(['admin']),
   [
     body('status').isIn(['active', 'inactive', 'suspended']).withMessage('Invalid status')
   ],
@@ -1045,8 +2521,6 @@ router.put('/users/:id/status',
  *         description: List of reviews retrieved successfully
  */
 router.get('/reviews', 
-  AuthMiddleware.authenticate, 
-  AuthMiddleware.authorize(['admin']), 
   async (req, res) => {
     try {
       const { status, page = 1, limit = 10 } = req.query;
@@ -1112,8 +2586,6 @@ router.get('/reviews',
  *         description: Review status updated successfully
  */
 router.put('/reviews/:id', 
-  AuthMiddleware.authenticate, 
-  AuthMiddleware.authorize(['admin']),
   [
     body('status').isIn(['pending', 'approved', 'rejected']).withMessage('Invalid status')
   ],
@@ -1142,4 +2614,29 @@ router.put('/reviews/:id',
   }
 );
 
+/**
+ * @swagger
+ * /api/v1/admin/metrics:
+ *   get:
+ *     tags:
+ *       - Admin
+ *     summary: Runtime metrics for this instance
+ *     description: >
+ *       Database readiness and the MongoDB queries slower than
+ *       MONGODB_SLOW_QUERY_MS since the instance started, grouped by
+ *       collection, operation and filter shape with the most time spent
+ *       first. Shapes have every value replaced by "?", e.g.
+ *       { "doctorId": "?", "date": { "$gte": "?" } }, so they point at
+ *       missing indexes without exposing patient data.
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: >
+ *           data.database is { healthy, lastCheckedAt }; data.slowQueries is
+ *           { thresholdMs, since, total, queries: [{ collection, operation,
+ *           filter, count, totalMs, avgMs, maxMs, lastSeenAt }] }
+ */
+router.get('/metrics', AdminHandler.getMetrics);
+
 module.exports = router;
@@ -1,5 +1,5 @@
 const express = require('express');
-const { body, validationResult, query } = require('express-validator');
+const { body, header, param, validationResult, query } = require('express-validator');
 const mongoose = require('mongoose');
 const Appointment = require('../models/appointment.model');
 const Doctor = require('../models/doctor.model');
@@ -10,6 +10,8 @@ const AuthMiddleware = require('../middleware/auth.middleware');
 const { sendEmail, sendSMS, queueJob } = require('../services/aws.service');
 const AppointmentHandler = require('../handlers/appointment.handler');
 const logger = require('../utils/logger');
+const AvailabilityService = require('../services/availability.service');
+const { isValidTimeZone } = require('../utils/helpers');
 
 const router = express.Router();
 
@@ -42,14 +44,90 @@ const router = express.Router();
  *           description: Type of appointment
  *         status:
  *           type: string
- *           enum: [pending, confirmed, cancelled, completed]
+ *           enum: [pending, confirmed, cancelled, completed, no-show]
  *           description: Current status of the appointment
+ *         statusHistory:
+ *           type: array
+ *           description: Every status change, oldest first
+ *           items:
+ *             type: object
+ *             properties:
+ *               from:
+ *                 type: string
+ *               to:
+ *                 type: string
+ *               actor:
+ *                 type: string
+ *                 enum: [patient, doctor, admin, system]
+ *               userId:
+ *                 type: string
+ *               reason:
+ *                 type: string
+ *               at:
+ *                 type: string
+ *                 format: date-time
  *         reason:
  *           type: string
  *           description: Reason for the appointment
+ *         patientDetails:
+ *           $ref: '#/components/schemas/DependentDetails'
+ *         symptoms:
+ *           type: array
+ *           items:
+ *             type: string
+ *           description: Symptoms from the recommendation the appointment was booked from
+ *         consultationType:
+ *           type: object
+ *           description: The consultation type booked, as it was at booking time
+ *           properties:
+ *             typeId:
+ *               type: string
+ *             name:
+ *               type: string
+ *         fee:
+ *           type: number
+ *           description: Fee charged for the appointment, fixed at booking time
+ *         durationMinutes:
+ *           type: integer
+ *         confirmationMode:
+ *           type: string
+ *           enum: [manual, auto]
+ *           description: >
+ *             auto when the doctor auto-accepts bookings: the appointment is
+ *             confirmed as it is booked, or once paid when payment is required
+ *             before confirmation. manual bookings stay pending until the
+ *             doctor confirms them.
+ *         confirmationCode:
+ *           type: string
+ *           example: K7PX3MQ2
+ *           description: Code the patient shows at check-in, set when the booking is made (not on drafts)
+ *         patientVisibleNotes:
+ *           type: string
+ *           description: Doctor's notes shared with the patient
  *         notes:
  *           type: string
- *           description: Doctor's notes about the appointment
+ *           deprecated: true
+ *           description: Same as patientVisibleNotes, kept for older clients
+ *         privateNotes:
+ *           type: string
+ *           nullable: true
+ *           description: Doctor-only clinical notes. Only returned to the appointment's doctor.
+ *         disposition:
+ *           type: string
+ *           enum: [resolved, referral, follow-up-needed, prescription-issued]
+ *           description: Outcome recorded by the doctor on completion
+ *         cancellationReason:
+ *           type: string
+ *         cancellationCategory:
+ *           type: string
+ *           enum: [patient_unavailable, found_other_care, doctor_unavailable, emergency, other]
+ *           description: Kind of cancellation. Doctors' range cancellations default to doctor_unavailable.
+ *         rescheduleCount:
+ *           type: integer
+ *           description: Number of times the patient has rescheduled this appointment
+ *         autoCompleted:
+ *           type: boolean
+ *           description: Whether the appointment was completed automatically after its end time
  *         createdAt:
  *           type: string
  *           format: date-time
@@ -58,6 +136,40 @@ const router = express.Router();
  *           type: string
  *           format: date-time
  *           description: When the appointment was last updated
+ *         capabilities:
+ *           type: object
+ *           description: >
+ *             What the requesting participant can do right now, computed with
+ *             the same rules the video and chat endpoints enforce. Returned when
+ *             listing or fetching appointments.
+ *           properties:
+ *             canChat:
+ *               type: boolean
+ *             canStartVideo:
+ *               type: boolean
+ *               description: A video session can be created for this appointment
+ *             canJoinVideo:
+ *               type: boolean
+ *               description: A video session is open and can be joined now
+ *             videoUnavailableReason:
+ *               type: string
+ *               nullable: true
+ *               enum: [not-video, not-confirmed, unpaid, early, late]
+ *     DependentDetails:
+ *       type: object
+ *       description: Present when the appointment is for a dependent rather than the account holder
+ *       properties:
+ *         name:
+ *           type: string
+ *           description: Full name of the dependent
+ *         dob:
+ *           type: string
+ *           format: date
+ *           description: Dependent's date of birth
+ *         relationship:
+ *           type: string
+ *           enum: [child, spouse, parent, sibling, other]
+ *           description: Relationship of the dependent to the account holder
  */
 
 /**
@@ -88,7 +200,7 @@ const router = express.Router();
  *         name: status
  *         schema:
  *           type: string
- *           enum: [pending, confirmed, cancelled, completed]
+ *           enum: [pending, confirmed, cancelled, completed, no-show]
  *         description: Filter by appointment status
  *       - in: query
  *         name: type
@@ -133,6 +245,45 @@ const router = express.Router();
  */
 router.get('/', AuthMiddleware.authenticate, AppointmentHandler.getAppointments);
 
+// Shared by booking and its preview so both accept exactly the same requests
+const bookingValidators = [
+  body('doctorId').isMongoId().withMessage('Invalid doctor ID'),
+  body('date').isDate().withMessage('Invalid date format'),
+  body('timeSlot').isString().withMessage('Time slot is required'),
+  body('type').isIn(['in-person', 'video']).withMessage('Invalid appointment type'),
+  body('reason').optional().isString().withMessage('Reason must be a string'),
+  body('consultationTypeId').optional().isMongoId().withMessage('Invalid consultation type ID'),
+  body('language').optional().matches(AvailabilityService.LANGUAGE_PATTERN).withMessage('Language must be a language code such as "en" or "nl"'),
+  body('referralId').optional().isMongoId().withMessage('Invalid referral ID'),
+  body('patientDetails').optional().isObject().withMessage('Patient details must be an object'),
+  body('patientDetails.name')
+    .if(body('patientDetails').exists())
+    .isString().trim().notEmpty().withMessage('Dependent name is required'),
+  body('patientDetails.dob')
+    .if(body('patientDetails').exists())
+    .isISO8601().withMessage('Dependent date of birth must be a valid date')
+    .custom(value => new Date(value) <= new Date()).withMessage('Dependent date of birth cannot be in the future'),
+  body('patientDetails.relationship')
+    .if(body('patientDetails').exists())
+    .isIn(Appointment.DEPENDENT_RELATIONSHIPS).withMessage('Invalid relationship to account holder')
+];
+
+// Drafts accept any subset of the booking fields; finalizing checks them in full
+const draftValidators = [
+  body('date').optional().isDate().withMessage('Invalid date format'),
+  body('timeSlot').optional().matches(/^\d{2}:\d{2}-\d{2}:\d{2}$/).withMessage('Time slot must look like HH:MM-HH:MM'),
+  body('type').optional().isIn(['in-person', 'video']).withMessage('Invalid appointment type'),
+  body('reason').optional().isString().withMessage('Reason must be a string'),
+  body('symptoms').optional().isArray().withMessage('Symptoms must be an array'),
+  body('consultationTypeId').optional().isMongoId().withMessage('Invalid consultation type ID'),
+  body('language').optional().matches(AvailabilityService.LANGUAGE_PATTERN).withMessage('Language must be a language code such as "en" or "nl"'),
+  body('patientDetails').optional().isObject().withMessage('Patient details must be an object'),
+  body('patientDetails.name').optional().isString().withMessage('Dependent name must be a string'),
+  body('patientDetails.dob').optional().isISO8601().withMessage('Dependent date of birth must be a valid date'),
+  body('patientDetails.relationship').optional()
+    .isIn(Appointment.DEPENDENT_RELATIONSHIPS).withMessage('Invalid relationship to account holder')
+];
+
 /**
  * @swagger
  * /api/v1/appointments:
@@ -140,9 +291,23 @@ router.get('/', AuthMiddleware.authenticate, AppointmentHandler.getAppointments)
  *     tags:
  *       - Appointments
  *     summary: Create a new appointment
- *     description: Create a new appointment with a doctor. If patientId is not provided, the authenticated user is used as the patient.
+ *     description: >
+ *       Create a new appointment with a doctor. If patientId is not provided,
+ *       the authenticated user is used as the patient; only admins may give
+ *       another user's ID. Send an
+ *       Idempotency-Key header (or requestId) to make retries safe: repeating
+ *       the request with the same key within BOOKING_IDEMPOTENCY_WINDOW_HOURS
+ *       (24 by default) returns the appointment it booked, with status 200
+ *       and the Idempotent-Replayed header, instead of booking again.
  *     security:
  *       - bearerAuth: []
+ *     parameters:
+ *       - in: header
+ *         name: Idempotency-Key
+ *         schema:
+ *           type: string
+ *           maxLength: 255
+ *         description: Unique per booking attempt, reused for its retries
  *     requestBody:
  *       required: true
  *       content:
@@ -161,7 +326,7 @@ router.get('/', AuthMiddleware.authenticate, AppointmentHandler.getAppointments)
  *                 description: ID of the doctor
  *               patientId:
  *                 type: string
- *                 description: (Optional) ID of the patient. If not provided, the authenticated user is used.
+ *                 description: (Optional) ID of the patient, for admins booking on someone's behalf. If not provided, the authenticated user is used.
  *               date:
  *                 type: string
  *                 format: date
@@ -176,45 +341,605 @@ router.get('/', AuthMiddleware.authenticate, AppointmentHandler.getAppointments)
  *               reason:
  *                 type: string
  *                 description: Reason for the appointment
+ *               consultationTypeId:
+ *                 type: string
+ *                 description: One of the doctor's consultation types. Its fee is charged and the time slot must match its duration. Without it the doctor's standard consultation fee applies.
+ *               language:
+ *                 type: string
+ *                 example: nl
+ *                 description: >
+ *                   Language wanted for the consultation. Booking is refused
+ *                   with 409 LANGUAGE_NOT_OFFERED when the slot isn't offered
+ *                   in it. Stored on the appointment; without it the slot's
+ *                   only language, if it has just one, is stored.
+ *               patientDetails:
+ *                 $ref: '#/components/schemas/DependentDetails'
+ *               referralId:
+ *                 type: string
+ *                 description: Open referral this booking follows up; it is marked as booked
+ *               requestId:
+ *                 type: string
+ *                 maxLength: 255
+ *                 description: Same as the Idempotency-Key header, for clients that can't set headers
+ *     responses:
+ *       200:
+ *         description: A retry with an idempotency key already used for this booking; the original appointment is returned
+ *         headers:
+ *           Idempotent-Replayed:
+ *             schema:
+ *               type: string
+ *               enum: ['true']
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/Appointment'
+ *       201:
+ *         description: Appointment created successfully
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/Appointment'
+ *       400:
+ *         description: Invalid request data. The errors field maps each invalid field to a message, e.g. {"doctorId":"Invalid doctor ID"}. A date past the doctor's advance booking window is rejected with code BEYOND_BOOKING_WINDOW and lastBookableDate.
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Email (or phone) not verified (code VERIFICATION_REQUIRED, with resendUrl pointing to the endpoint that resends the verification code), or patientId names another user and the caller isn't an admin.
+ *       404:
+ *         description: Doctor not found
+ *       409:
+ *         description: Time slot not available (never returned for a retry with a known idempotency key). The code field is OUTSIDE_DOCTOR_AVAILABILITY or OUTSIDE_CLINIC_HOURS when the slot falls outside the doctor's schedule or, for in-person visits, the clinic's opening hours, SLOT_UNAVAILABLE when it is already taken, CLINIC_AT_CAPACITY when every consultation room at the clinic is in use for an in-person visit, and DAILY_LIMIT_REACHED when the doctor's maxAppointmentsPerDay is reached that day. LANGUAGE_NOT_OFFERED means the slot isn't offered in the requested language; its suggestions are limited to slots that are. The suggestions field lists the closest free slots on the same day (sameDay) and the first free slots on the next day that has any (nextAvailableDay).
+ *       422:
+ *         description: The idempotency key was already used for a different booking (code IDEMPOTENCY_KEY_REUSED)
+ *       429:
+ *         description: New bookings for one of the doctor's specialties are throttled because of high demand (code SPECIALTY_BOOKINGS_THROTTLED). specialty names it; retryAfter and the Retry-After header say when the current hour or day window ends.
+ *       500:
+ *         description: Server error
+ */
+router.post('/', 
+  AuthMiddleware.authenticate,
+  bookingValidators,
+  [
+    header('Idempotency-Key').optional().isString().isLength({ min: 1, max: 255 })
+      .withMessage('Idempotency-Key must be 1 to 255 characters'),
+    body('requestId').optional().isString().isLength({ min: 1, max: 255 })
+      .withMessage('requestId must be 1 to 255 characters')
+  ],
+  async (req, res, next) => {
+    try {
+      logger.info('Creating new appointment', {
+        userId: req.user.id,
+        doctorId: req.body.doctorId,
+        type: req.body.type
+      });
+      await AppointmentHandler.createAppointment(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/preview:
+ *   post:
+ *     tags:
+ *       - Appointments
+ *     summary: Preview a booking without making it
+ *     description: >
+ *       Takes the same body as POST /api/v1/appointments and runs the same
+ *       checks (schedule, clinic hours, conflicts, room capacity, fee) without
+ *       saving anything. Returns a summary for a confirm-booking screen. The
+ *       platform commission comes out of the doctor's share and no tax is
+ *       charged, so the total equals the fee.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - doctorId
+ *               - date
+ *               - timeSlot
+ *               - type
+ *             properties:
+ *               doctorId:
+ *                 type: string
+ *               date:
+ *                 type: string
+ *                 format: date
+ *               timeSlot:
+ *                 type: string
+ *               type:
+ *                 type: string
+ *                 enum: [in-person, video]
+ *               consultationTypeId:
+ *                 type: string
+ *     responses:
+ *       200:
+ *         description: >
+ *           Summary with doctor, slot, type, consultationType, price (baseFee,
+ *           multiplier and rule of the doctor's peak pricing, fee, currency,
+ *           total) and policy (payBeforeConfirm, unpaidExpiryMinutes,
+ *           maxReschedules, lateRescheduleFee with amount, currency and
+ *           freeHoursBefore or null when reschedules are free, cancellation)
+ *       400:
+ *         description: Invalid request data
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Email (or phone) not verified (code VERIFICATION_REQUIRED)
+ *       404:
+ *         description: Doctor not found
+ *       409:
+ *         description: The slot can't be booked; same codes and suggestions as booking
+ */
+router.post('/preview',
+  AuthMiddleware.authenticate,
+  bookingValidators,
+  async (req, res, next) => {
+    try {
+      await AppointmentHandler.previewAppointment(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/from-recommendation:
+ *   post:
+ *     tags:
+ *       - Appointments
+ *     summary: Book the slot offered with a doctor recommendation
+ *     description: >
+ *       Books the slot carried by a bookingToken from
+ *       POST /api/v1/recommendations/help-me-choose. The symptoms from the
+ *       recommendation are stored on the appointment for the doctor.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - bookingToken
+ *               - type
+ *             properties:
+ *               bookingToken:
+ *                 type: string
+ *               type:
+ *                 type: string
+ *                 enum: [in-person, video]
+ *               reason:
+ *                 type: string
+ *               referralId:
+ *                 type: string
+ *                 description: Open referral this booking follows up; it is marked as booked
+ *               language:
+ *                 type: string
+ *                 description: Language for the consultation, as when booking directly
+ *     responses:
+ *       201:
+ *         description: Appointment created successfully
+ *       400:
+ *         description: Invalid request data, the slot is outside the doctor's booking window, or the token is invalid (BOOKING_TOKEN_INVALID) or expired (BOOKING_TOKEN_EXPIRED)
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Email (or phone) not verified (code VERIFICATION_REQUIRED)
+ *       404:
+ *         description: Doctor not found
+ *       409:
+ *         description: The slot can't be booked; same codes and suggestions as booking, e.g. SLOT_UNAVAILABLE when it was taken in the meantime, DAILY_LIMIT_REACHED or LANGUAGE_NOT_OFFERED
+ *       429:
+ *         description: New bookings for the doctor's specialty are throttled (code SPECIALTY_BOOKINGS_THROTTLED); see Retry-After
+ */
+router.post('/from-recommendation',
+  AuthMiddleware.authenticate,
+  [
+    body('bookingToken').isString().notEmpty().withMessage('Booking token is required'),
+    body('type').isIn(['in-person', 'video']).withMessage('Invalid appointment type'),
+    body('reason').optional().isString().withMessage('Reason must be a string'),
+    body('referralId').optional().isMongoId().withMessage('Invalid referral ID'),
+    body('language').optional().matches(AvailabilityService.LANGUAGE_PATTERN).withMessage('Language must be a language code such as "en" or "nl"')
+  ],
+  async (req, res, next) => {
+    try {
+      logger.info('Creating appointment from recommendation', { userId: req.user.id });
+      await AppointmentHandler.createFromRecommendation(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/referrals:
+ *   get:
+ *     tags:
+ *       - Appointments
+ *     summary: List the patient's referrals
+ *     description: >
+ *       Referrals made for the authenticated patient, newest first. Open
+ *       (pending) referrals include recommended doctors in the referred
+ *       specialty, each with their next free slot and a bookingToken for
+ *       POST /api/v1/appointments/from-recommendation. Pass the referralId with
+ *       that booking to mark the referral as booked.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: status
+ *         schema:
+ *           type: string
+ *           enum: [pending, booked, declined]
+ *     responses:
+ *       200:
+ *         description: Referrals retrieved successfully
+ *       401:
+ *         description: Unauthorized
+ *       500:
+ *         description: Server error
+ */
+router.get('/referrals',
+  AuthMiddleware.authenticate,
+  [
+    query('status').optional().isIn(['pending', 'booked', 'declined']).withMessage('Invalid referral status')
+  ],
+  async (req, res, next) => {
+    try {
+      const errors = validationResult(req);
+      if (!errors.isEmpty()) {
+        return res.status(400).json({ errors: errors.array() });
+      }
+      await AppointmentHandler.getReferrals(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/by-code/{code}:
+ *   get:
+ *     tags:
+ *       - Appointments
+ *     summary: Look up an appointment by its confirmation code
+ *     description: >
+ *       For check-in at the clinic: finds the booking behind the code the
+ *       patient shows, with the patient's name. Only admins and the
+ *       appointment's patient and doctor can look a code up; for anyone else
+ *       the code is reported as not found. Codes are case-insensitive.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: code
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The appointment
+ *         content:
+ *           application/json:
+ *             schema:
+ *               allOf:
+ *                 - $ref: '#/components/schemas/Appointment'
+ *                 - type: object
+ *                   properties:
+ *                     patient:
+ *                       type: object
+ *                       properties:
+ *                         _id:
+ *                           type: string
+ *                         firstName:
+ *                           type: string
+ *                         lastName:
+ *                           type: string
+ *       400:
+ *         description: Malformed code
+ *       401:
+ *         description: Unauthorized
+ *       404:
+ *         description: No appointment with this code that the user may see
+ *       500:
+ *         description: Server error
+ */
+router.get('/by-code/:code',
+  AuthMiddleware.authenticate,
+  [
+    param('code').isAlphanumeric().isLength({ min: 6, max: 16 }).withMessage('Invalid confirmation code')
+  ],
+  AppointmentHandler.getAppointmentByCode
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/referrals/{referralId}/decline:
+ *   put:
+ *     tags:
+ *       - Appointments
+ *     summary: Decline a referral
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: referralId
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Referral declined
+ *       401:
+ *         description: Unauthorized
+ *       404:
+ *         description: No open referral with this ID for the patient
+ */
+router.put('/referrals/:referralId/decline',
+  AuthMiddleware.authenticate,
+  async (req, res, next) => {
+    try {
+      await AppointmentHandler.declineReferral(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * components:
+ *   schemas:
+ *     AppointmentDraft:
+ *       type: object
+ *       properties:
+ *         id:
+ *           type: string
+ *         doctorId:
+ *           type: string
+ *         date:
+ *           type: string
+ *           format: date
+ *         timeSlot:
+ *           type: string
+ *           example: "09:00-09:30"
+ *         type:
+ *           type: string
+ *           enum: [in-person, video]
+ *         reason:
+ *           type: string
+ *         symptoms:
+ *           type: array
+ *           items:
+ *             type: string
+ *         consultationTypeId:
+ *           type: string
+ *         language:
+ *           type: string
+ *         patientDetails:
+ *           type: object
+ *         status:
+ *           type: string
+ *           enum: [draft]
+ *         expiresAt:
+ *           type: string
+ *           format: date-time
+ *           description: When the draft is deleted unless it is edited again
+ *     AppointmentDraftInput:
+ *       type: object
+ *       description: Any subset of the booking fields
+ *       properties:
+ *         doctorId:
+ *           type: string
+ *         date:
+ *           type: string
+ *           format: date
+ *         timeSlot:
+ *           type: string
+ *         type:
+ *           type: string
+ *           enum: [in-person, video]
+ *         reason:
+ *           type: string
+ *         symptoms:
+ *           type: array
+ *           items:
+ *             type: string
+ *         consultationTypeId:
+ *           type: string
+ *         language:
+ *           type: string
+ *         patientDetails:
+ *           type: object
+ */
+
+/**
+ * @swagger
+ * /api/v1/appointments/drafts:
+ *   post:
+ *     tags:
+ *       - Appointments
+ *     summary: Start a booking draft
+ *     description: >
+ *       Saves a partly filled-in booking. Drafts don't reserve a slot and are
+ *       only visible to the patient. Untouched drafts are deleted after
+ *       APPOINTMENT_DRAFT_EXPIRY_HOURS (72 by default).
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             allOf:
+ *               - $ref: '#/components/schemas/AppointmentDraftInput'
+ *               - required: [doctorId]
+ *     responses:
+ *       201:
+ *         description: Draft saved
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/AppointmentDraft'
+ *       400:
+ *         description: Validation error
+ *       401:
+ *         description: Unauthorized
+ *       404:
+ *         description: Doctor not found
+ *   get:
+ *     tags:
+ *       - Appointments
+ *     summary: List the patient's booking drafts
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Drafts, most recently edited first
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 drafts:
+ *                   type: array
+ *                   items:
+ *                     $ref: '#/components/schemas/AppointmentDraft'
+ *       401:
+ *         description: Unauthorized
+ */
+router.post('/drafts',
+  AuthMiddleware.authenticate,
+  [
+    body('doctorId').isMongoId().withMessage('Invalid doctor ID'),
+    ...draftValidators
+  ],
+  AppointmentHandler.createDraft
+);
+
+router.get('/drafts',
+  AuthMiddleware.authenticate,
+  AppointmentHandler.getDrafts
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/drafts/{id}:
+ *   put:
+ *     tags:
+ *       - Appointments
+ *     summary: Update a booking draft
+ *     description: Fields left out keep their saved values. Changing the doctor clears the consultation type.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             $ref: '#/components/schemas/AppointmentDraftInput'
+ *     responses:
+ *       200:
+ *         description: Draft saved
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/AppointmentDraft'
+ *       400:
+ *         description: Validation error
+ *       404:
+ *         description: Draft or doctor not found
+ *   delete:
+ *     tags:
+ *       - Appointments
+ *     summary: Discard a booking draft
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Draft discarded
+ *       404:
+ *         description: Draft not found
+ */
+router.put('/drafts/:id',
+  AuthMiddleware.authenticate,
+  [
+    body('doctorId').optional().isMongoId().withMessage('Invalid doctor ID'),
+    ...draftValidators
+  ],
+  AppointmentHandler.updateDraft
+);
+
+router.delete('/drafts/:id',
+  AuthMiddleware.authenticate,
+  AppointmentHandler.deleteDraft
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/drafts/{id}/finalize:
+ *   post:
+ *     tags:
+ *       - Appointments
+ *     summary: Book the appointment a draft describes
+ *     description: >
+ *       Runs every check a direct booking goes through on the draft's saved
+ *       choices. Booking fields sent in the body (e.g. a last-minute
+ *       timeSlot, or a referralId) override the saved ones. On success a
+ *       pending appointment is created and the draft is removed.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       content:
+ *         application/json:
+ *           schema:
+ *             $ref: '#/components/schemas/AppointmentDraftInput'
  *     responses:
  *       201:
- *         description: Appointment created successfully
- *         content:
- *           application/json:
- *             schema:
- *               $ref: '#/components/schemas/Appointment'
+ *         description: Appointment booked; draftId is the removed draft
  *       400:
- *         description: Invalid request data
- *       401:
- *         description: Unauthorized
+ *         description: The draft is incomplete or invalid; errors lists the fields
  *       404:
- *         description: Doctor not found
+ *         description: Draft or doctor not found
  *       409:
- *         description: Time slot not available
- *       500:
- *         description: Server error
+ *         description: The slot can't be booked (with suggestions), or the draft was already finalized
+ *       429:
+ *         description: New bookings for the doctor's specialty are throttled (code SPECIALTY_BOOKINGS_THROTTLED); see Retry-After
  */
-router.post('/', 
+router.post('/drafts/:id/finalize',
   AuthMiddleware.authenticate,
-  [
-    body('doctorId').isMongoId().withMessage('Invalid doctor ID'),
-    body('date').isDate().withMessage('Invalid date format'),
-    body('timeSlot').isString().withMessage('Time slot is required'),
-    body('type').isIn(['in-person', 'video']).withMessage('Invalid appointment type'),
-    body('reason').optional().isString().withMessage('Reason must be a string')
-  ],
-  async (req, res, next) => {
-    try {
-      logger.info('Creating new appointment', {
-        userId: req.user.id,
-        doctorId: req.body.doctorId,
-        type: req.body.type
-      });
-      await AppointmentHandler.createAppointment(req, res);
-    } catch (error) {
-      next(error);
-    }
-  }
+  AppointmentHandler.loadDraftForFinalize,
+  bookingValidators,
+  AppointmentHandler.finalizeDraft
 );
 
 /**
@@ -263,6 +988,109 @@ router.get('/:id',
   }
 );
 
+/**
+ * @swagger
+ * /api/v1/appointments/{id}/context:
+ *   get:
+ *     tags:
+ *       - Appointments
+ *     summary: Get everything for the consult screen in one call
+ *     description: >
+ *       Returns the appointment, a page of its chat history, the notes,
+ *       attachments with short-lived presigned download links, the intake
+ *       answers and a summary of the patient with their last completed visits
+ *       to this doctor. Only the appointment's patient and doctor can fetch it,
+ *       as with the appointment itself; private notes are only included for
+ *       the doctor. Every presigned link is recorded in the document access log.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *         description: Appointment ID
+ *       - in: query
+ *         name: chatPage
+ *         schema:
+ *           type: integer
+ *           minimum: 1
+ *           default: 1
+ *       - in: query
+ *         name: chatLimit
+ *         schema:
+ *           type: integer
+ *           minimum: 1
+ *           maximum: 100
+ *           default: 50
+ *     responses:
+ *       200:
+ *         description: Consult context
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 appointment:
+ *                   $ref: '#/components/schemas/Appointment'
+ *                 chat:
+ *                   type: object
+ *                   description: Same shape as GET /api/v1/chats/{appointmentId}
+ *                 notes:
+ *                   type: object
+ *                   properties:
+ *                     patientVisibleNotes:
+ *                       type: string
+ *                       nullable: true
+ *                     privateNotes:
+ *                       type: string
+ *                       nullable: true
+ *                       description: Doctor only
+ *                     disposition:
+ *                       type: object
+ *                       nullable: true
+ *                 attachments:
+ *                   type: array
+ *                   items:
+ *                     type: object
+ *                     properties:
+ *                       _id:
+ *                         type: string
+ *                       fileName:
+ *                         type: string
+ *                       contentType:
+ *                         type: string
+ *                       size:
+ *                         type: integer
+ *                       url:
+ *                         type: string
+ *                         description: Presigned download URL, valid for DOCUMENT_DOWNLOAD_URL_TTL_SECONDS
+ *                 intake:
+ *                   type: object
+ *                   nullable: true
+ *                 patient:
+ *                   type: object
+ *       400:
+ *         description: Invalid chat paging
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not the appointment's patient or doctor
+ *       404:
+ *         description: Appointment not found
+ *       500:
+ *         description: Server error
+ */
+router.get('/:id/context',
+  AuthMiddleware.authenticate,
+  [
+    query('chatPage').optional().isInt({ min: 1 }).withMessage('chatPage must be a positive integer'),
+    query('chatLimit').optional().isInt({ min: 1, max: 100 }).withMessage('chatLimit must be between 1 and 100')
+  ],
+  AppointmentHandler.getAppointmentContext
+);
+
 /**
  * @swagger
  * /api/v1/appointments/{id}/status:
@@ -270,7 +1098,13 @@ router.get('/:id',
  *     tags:
  *       - Appointments
  *     summary: Update appointment status
- *     description: Update the status of an appointment
+ *     description: >
+ *       Move an appointment to a new status. Allowed changes depend on the
+ *       current status and the caller's role. Pending appointments can be
+ *       confirmed by the doctor or an admin. Confirmed ones can be completed or
+ *       marked no-show by the doctor or an admin. Pending or confirmed ones can
+ *       be cancelled by either participant or an admin. Completed, no-show and
+ *       cancelled are final. Every change is recorded in statusHistory.
  *     security:
  *       - bearerAuth: []
  *     parameters:
@@ -291,8 +1125,19 @@ router.get('/:id',
  *             properties:
  *               status:
  *                 type: string
- *                 enum: [pending, confirmed, cancelled, completed]
+ *                 enum: [pending, confirmed, cancelled, completed, no-show]
  *                 description: New status of the appointment
+ *               reason:
+ *                 type: string
+ *                 description: Why the status changed, kept in the status history
+ *               disposition:
+ *                 type: string
+ *                 enum: [resolved, referral, follow-up-needed, prescription-issued]
+ *                 description: Outcome of the consult. Only allowed with status completed, and required for it when REQUIRE_APPOINTMENT_DISPOSITION is true.
+ *               cancellationCategory:
+ *                 type: string
+ *                 enum: [patient_unavailable, found_other_care, doctor_unavailable, emergency, other]
+ *                 description: Kind of cancellation, for analytics. Only allowed with status cancelled.
  *     responses:
  *       200:
  *         description: Appointment status updated successfully
@@ -301,11 +1146,19 @@ router.get('/:id',
  *             schema:
  *               $ref: '#/components/schemas/Appointment'
  *       400:
- *         description: Invalid status
+ *         description: Invalid status, missing/invalid disposition, or a cancellation category without status cancelled
  *       401:
  *         description: Unauthorized
  *       403:
- *         description: Forbidden - Only doctor or patient can update status
+ *         description: Not a participant, or the caller's role may not make this change (code STATUS_TRANSITION_FORBIDDEN)
+ *       409:
+ *         description: >
+ *           The change is not allowed from the current status
+ *           (INVALID_STATUS_TRANSITION), the status changed meanwhile
+ *           (STATUS_CHANGED), or completing was refused because no video call
+ *           was joined and no chat messages were exchanged while
+ *           COMPLETION_REQUIRES_ACTIVITY is on (CONSULTATION_ACTIVITY_REQUIRED;
+ *           mark it no-show instead, admins may still complete)
  *       404:
  *         description: Appointment not found
  *       500:
@@ -314,8 +1167,11 @@ router.get('/:id',
 router.put('/:id/status', 
   AuthMiddleware.authenticate,
   [
-    body('status').isIn(['pending', 'confirmed', 'cancelled', 'completed'])
-      .withMessage('Invalid appointment status')
+    body('status').isIn(['pending', 'confirmed', 'cancelled', 'completed', 'no-show'])
+      .withMessage('Invalid appointment status'),
+    body('reason').optional().isString().withMessage('Reason must be a string'),
+    body('cancellationCategory').optional().isIn(Appointment.CANCELLATION_CATEGORIES)
+      .withMessage(`cancellationCategory must be one of: ${Appointment.CANCELLATION_CATEGORIES.join(', ')}`)
   ],
   async (req, res, next) => {
     try {
@@ -338,7 +1194,11 @@ router.put('/:id/status',
  *     tags:
  *       - Appointments
  *     summary: Update appointment notes
- *     description: Add or update doctor's notes for an appointment
+ *     description: >
+ *       Add or update the doctor's notes for an appointment. patientVisibleNotes
+ *       are shared with the patient; privateNotes are clinical notes only the
+ *       doctor ever sees. notes is accepted as the older name of
+ *       patientVisibleNotes. Fields left out keep their current value.
  *     security:
  *       - bearerAuth: []
  *     parameters:
@@ -354,12 +1214,17 @@ router.put('/:id/status',
  *         application/json:
  *           schema:
  *             type: object
- *             required:
- *               - notes
  *             properties:
+ *               patientVisibleNotes:
+ *                 type: string
+ *                 description: Notes shared with the patient
+ *               privateNotes:
+ *                 type: string
+ *                 description: Doctor-only clinical notes
  *               notes:
  *                 type: string
- *                 description: Doctor's notes about the appointment
+ *                 deprecated: true
+ *                 description: Same as patientVisibleNotes
  *     responses:
  *       200:
  *         description: Appointment notes updated successfully
@@ -382,7 +1247,11 @@ router.put('/:id/notes',
   AuthMiddleware.authenticate,
   AuthMiddleware.authorize(['doctor']),
   [
-    body('notes').isString().withMessage('Notes must be a string')
+    body('notes').optional().isString().withMessage('Notes must be a string'),
+    body('patientVisibleNotes').optional().isString().withMessage('Patient-visible notes must be a string'),
+    body('privateNotes').optional().isString().withMessage('Private notes must be a string'),
+    body().custom(value => ['notes', 'patientVisibleNotes', 'privateNotes'].some(field => value[field] !== undefined))
+      .withMessage('Send patientVisibleNotes, privateNotes or both')
   ],
   async (req, res, next) => {
     try {
@@ -428,6 +1297,53 @@ router.put('/:id/notes',
  *           type: string
  *           format: date
  *         description: End date (YYYY-MM-DD)
+ *       - in: query
+ *         name: duration
+ *         schema:
+ *           type: integer
+ *           minimum: 5
+ *           maximum: 480
+ *         description: >
+ *           Length of the wanted consultation in minutes. Only start times where
+ *           the whole consultation fits in an availability block, without
+ *           overlapping bookings, are returned. Defaults to the standard slot length.
+ *       - in: query
+ *         name: consultationTypeId
+ *         schema:
+ *           type: string
+ *         description: >
+ *           Price slots for this consultation type, and use its length unless
+ *           duration is given. Otherwise slots are priced at the doctor's
+ *           consultation fee.
+ *       - in: query
+ *         name: type
+ *         schema:
+ *           type: string
+ *           enum: [in-person, video, phone]
+ *         description: >
+ *           Mode to be booked. Slots then keep the buffer between this mode and
+ *           the modes of existing bookings (the larger of the two), so a video
+ *           slot can directly follow another video call while an in-person
+ *           visit keeps its travel and cleanup time. Without it only the
+ *           buffers of existing bookings apply.
+ *       - in: query
+ *         name: language
+ *         schema:
+ *           type: string
+ *           example: nl
+ *         description: >
+ *           Only return slots offered in this language. Doctors can limit
+ *           availability blocks and appointment modes to some of their
+ *           languages; other slots offer all of them. Each entry in
+ *           slotDetails lists its languages.
+ *       - in: query
+ *         name: tz
+ *         schema:
+ *           type: string
+ *           example: America/New_York
+ *         description: >
+ *           IANA time zone of the patient. Each entry in slotDetails then also
+ *           has a local object with the slot's date and times in that zone.
  *     responses:
  *       200:
  *         description: Available slots retrieved successfully
@@ -436,6 +1352,24 @@ router.put('/:id/notes',
  *             schema:
  *               type: object
  *               properties:
+ *                 duration:
+ *                   type: integer
+ *                   description: Slot length used, in minutes
+ *                 currency:
+ *                   type: string
+ *                 lastBookableDate:
+ *                   type: string
+ *                   format: date
+ *                   description: End of the doctor's advance booking window; later days are left out
+ *                 timeZone:
+ *                   type: object
+ *                   properties:
+ *                     doctor:
+ *                       type: string
+ *                       description: Zone the dates and times of the schedule are in
+ *                     requested:
+ *                       type: string
+ *                       nullable: true
  *                 availability:
  *                   type: array
  *                   items:
@@ -449,6 +1383,46 @@ router.put('/:id/notes',
  *                         items:
  *                           type: string
  *                           description: Available time slot
+ *                       slotDetails:
+ *                         type: array
+ *                         description: All slots of the day. isHeld marks slots another patient is paying for; they free up if the hold expires.
+ *                         items:
+ *                           type: object
+ *                           properties:
+ *                             startTime:
+ *                               type: string
+ *                             endTime:
+ *                               type: string
+ *                             isBooked:
+ *                               type: boolean
+ *                             isHeld:
+ *                               type: boolean
+ *                             languages:
+ *                               type: array
+ *                               items:
+ *                                 type: string
+ *                               description: Languages the consultation can be held in at this slot
+ *                             fee:
+ *                               type: number
+ *                               description: Fee for this slot, including any peak pricing rule of the doctor
+ *                             startsAt:
+ *                               type: string
+ *                               format: date-time
+ *                               description: Exact start as a UTC timestamp
+ *                             endsAt:
+ *                               type: string
+ *                               format: date-time
+ *                             local:
+ *                               type: object
+ *                               description: Only with tz. The slot in the requested zone; date can differ from the schedule date.
+ *                               properties:
+ *                                 date:
+ *                                   type: string
+ *                                   format: date
+ *                                 startTime:
+ *                                   type: string
+ *                                 endTime:
+ *                                   type: string
  *       400:
  *         description: Invalid request data
  *       401:
@@ -463,7 +1437,12 @@ router.get('/slots/available',
   [
     query('doctorId').isMongoId().withMessage('Invalid doctor ID'),
     query('startDate').isDate().withMessage('Invalid start date'),
-    query('endDate').isDate().withMessage('Invalid end date')
+    query('endDate').isDate().withMessage('Invalid end date'),
+    query('duration').optional().isInt({ min: 5, max: 480 }).withMessage('Duration must be between 5 and 480 minutes'),
+    query('consultationTypeId').optional().isMongoId().withMessage('Invalid consultation type ID'),
+    query('type').optional().isIn(['in-person', 'video', 'phone']).withMessage('Invalid appointment type'),
+    query('language').optional().matches(AvailabilityService.LANGUAGE_PATTERN).withMessage('Language must be a language code such as "en" or "nl"'),
+    query('tz').optional().custom(isValidTimeZone).withMessage('tz must be an IANA time zone name, e.g. Europe/Amsterdam')
   ],
   async (req, res, next) => {
     try {
@@ -471,7 +1450,8 @@ router.get('/slots/available',
         userId: req.user.id,
         doctorId: req.query.doctorId,
         startDate: req.query.startDate,
-        endDate: req.query.endDate
+        endDate: req.query.endDate,
+        duration: req.query.duration
       });
       await AppointmentHandler.getAvailableSlotsForRange(req, res);
     } catch (error) {
@@ -487,7 +1467,14 @@ router.get('/slots/available',
  *     tags:
  *       - Appointments
  *     summary: Reschedule an appointment
- *     description: Reschedule an existing appointment to a new date and time
+ *     description: >
+ *       Reschedule an existing appointment to a new date and time. Clinics can
+ *       charge patients a fee for rescheduling within a number of hours of the
+ *       appointment (RESCHEDULE_FREE_HOURS); see GET
+ *       /api/v1/appointments/{id}/reschedule-fee. When the fee is collected
+ *       online a paymentMethod is required and a pending payment is created
+ *       with the move, completed through the payment webhook like any other.
+ *       Otherwise the fee is recorded as unpaid for the clinic to invoice.
  *     security:
  *       - bearerAuth: []
  *     parameters:
@@ -514,15 +1501,24 @@ router.get('/slots/available',
  *               timeSlot:
  *                 type: string
  *                 description: New time slot
+ *               paymentMethod:
+ *                 type: string
+ *                 enum: [iDEAL, card, paypal]
+ *                 description: How to pay a late reschedule fee, when one is collected
  *     responses:
  *       200:
- *         description: Appointment rescheduled successfully
+ *         description: >
+ *           Appointment rescheduled successfully, with rescheduleFee (amount,
+ *           currency, status unpaid or pending, or null when free, and the
+ *           payment created for it)
  *         content:
  *           application/json:
  *             schema:
  *               $ref: '#/components/schemas/Appointment'
+ *       402:
+ *         description: A reschedule fee is due and no paymentMethod was given (code RESCHEDULE_FEE_REQUIRED, with rescheduleFee)
  *       400:
- *         description: Invalid request data
+ *         description: Invalid request data, or a date past the doctor's advance booking window (code BEYOND_BOOKING_WINDOW)
  *       401:
  *         description: Unauthorized
  *       403:
@@ -530,7 +1526,7 @@ router.get('/slots/available',
  *       404:
  *         description: Appointment not found
  *       409:
- *         description: Time slot not available
+ *         description: Time slot not available (code OUTSIDE_DOCTOR_AVAILABILITY, OUTSIDE_CLINIC_HOURS, CLINIC_AT_CAPACITY or DAILY_LIMIT_REACHED), or the patient has used up their reschedules for this appointment (code RESCHEDULE_LIMIT_REACHED). Admins are not limited.
  *       500:
  *         description: Server error
  */
@@ -538,7 +1534,8 @@ router.put('/:id/reschedule',
   AuthMiddleware.authenticate,
   [
     body('date').isDate().withMessage('Invalid date format'),
-    body('timeSlot').isString().withMessage('Time slot is required')
+    body('timeSlot').isString().withMessage('Time slot is required'),
+    body('paymentMethod').optional().isIn(['iDEAL', 'card', 'paypal']).withMessage('Invalid payment method')
   ],
   async (req, res, next) => {
     try {
@@ -555,6 +1552,69 @@ router.put('/:id/reschedule',
   }
 );
 
+/**
+ * @swagger
+ * /api/v1/appointments/{id}/reschedule-fee:
+ *   get:
+ *     tags:
+ *       - Appointments
+ *     summary: Preview the fee for rescheduling an appointment
+ *     description: >
+ *       What rescheduling the appointment now would cost the caller. Only the
+ *       patient's own reschedules within freeHoursBefore hours of the start
+ *       are charged; doctors and admins always see 0.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The fee
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 amount:
+ *                   type: number
+ *                 currency:
+ *                   type: string
+ *                 hoursBefore:
+ *                   type: number
+ *                   description: Hours until the appointment starts
+ *                 freeHoursBefore:
+ *                   type: integer
+ *                 collect:
+ *                   type: boolean
+ *                   description: Whether the fee is paid online when rescheduling
+ *                 freeUntil:
+ *                   type: string
+ *                   format: date-time
+ *                   description: Last moment the patient can reschedule for free
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a participant of the appointment
+ *       404:
+ *         description: Appointment not found
+ *       409:
+ *         description: The appointment can no longer be rescheduled
+ */
+router.get('/:id/reschedule-fee',
+  AuthMiddleware.authenticate,
+  async (req, res, next) => {
+    try {
+      await AppointmentHandler.getRescheduleFee(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
 /**
  * @swagger
  * /api/v1/appointments/{id}/cancel:
@@ -562,7 +1622,11 @@ router.put('/:id/reschedule',
  *     tags:
  *       - Appointments
  *     summary: Cancel an appointment
- *     description: Cancel an existing appointment
+ *     description: >
+ *       Cancel an existing appointment. When the doctor cancels, the patient is
+ *       notified with the doctor's next free slots, each carrying a booking token
+ *       that POST /api/v1/appointments/from-recommendation accepts to rebook in
+ *       one step.
  *     security:
  *       - bearerAuth: []
  *     parameters:
@@ -584,6 +1648,10 @@ router.put('/:id/reschedule',
  *               reason:
  *                 type: string
  *                 description: Reason for cancellation
+ *               cancellationCategory:
+ *                 type: string
+ *                 enum: [patient_unavailable, found_other_care, doctor_unavailable, emergency, other]
+ *                 description: Kind of cancellation, for analytics
  *     responses:
  *       200:
  *         description: Appointment cancelled successfully
@@ -623,6 +1691,196 @@ router.put('/:id/cancel',
   }
 );
 
+/**
+ * @swagger
+ * /api/v1/appointments/{id}/refer:
+ *   post:
+ *     tags:
+ *       - Appointments
+ *     summary: Refer the patient to another doctor or specialty
+ *     description: >
+ *       Records a referral from the appointment's doctor. The patient is notified
+ *       with recommended doctors in the specialty (the named doctor first), each
+ *       with a booking token for their next free slot. When booking is given, an
+ *       appointment with the referred doctor is created and linked instead, after
+ *       the same checks as a patient booking.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               referredDoctorId:
+ *                 type: string
+ *               specialty:
+ *                 type: string
+ *                 description: Required unless referredDoctorId is given; defaults to that doctor's first specialization
+ *               note:
+ *                 type: string
+ *                 maxLength: 2000
+ *               booking:
+ *                 type: object
+ *                 description: Book the referred doctor now. Requires referredDoctorId.
+ *                 properties:
+ *                   date:
+ *                     type: string
+ *                     format: date
+ *                   timeSlot:
+ *                     type: string
+ *                     description: e.g. 09:00-09:30
+ *                   type:
+ *                     type: string
+ *                     enum: [in-person, video]
+ *                   consultationTypeId:
+ *                     type: string
+ *                     description: One of the referred doctor's consultation types; sets the fee and must match the slot length
+ *                   language:
+ *                     type: string
+ *                     description: Consultation language, e.g. "nl"
+ *     responses:
+ *       201:
+ *         description: Referral created, with the linked appointment or the recommendations sent to the patient
+ *       400:
+ *         description: Invalid request data
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not the appointment's doctor
+ *       404:
+ *         description: Appointment or referred doctor not found
+ *       409:
+ *         description: The appointment is cancelled, or the requested booking slot is not available (suggestions lists alternatives)
+ *       429:
+ *         description: Bookings in the referred doctor's specialty are throttled right now
+ */
+router.post('/:id/refer',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.authorize(['doctor']),
+  [
+    body('referredDoctorId').optional().isMongoId().withMessage('Invalid doctor ID'),
+    body('specialty').optional().isString().trim().notEmpty().withMessage('Specialty must be a non-empty string'),
+    body('note').optional().isString().isLength({ max: 2000 }).withMessage('Note must be at most 2000 characters'),
+    body('booking').optional().isObject().withMessage('Booking must be an object'),
+    body('booking')
+      .if(body('booking').exists())
+      .custom((value, { req }) => !!req.body.referredDoctorId).withMessage('Booking requires referredDoctorId'),
+    body('booking.date')
+      .if(body('booking').exists())
+      .isDate().withMessage('Invalid date format'),
+    body('booking.timeSlot')
+      .if(body('booking').exists())
+      .matches(/^\d{2}:\d{2}-\d{2}:\d{2}$/).withMessage('Time slot must look like 09:00-09:30'),
+    body('booking.type')
+      .if(body('booking').exists())
+      .isIn(['in-person', 'video']).withMessage('Invalid appointment type'),
+    body('booking.consultationTypeId').optional().isMongoId().withMessage('Invalid consultation type ID'),
+    body('booking.language').optional().matches(AvailabilityService.LANGUAGE_PATTERN).withMessage('Language must be a language code such as "en" or "nl"')
+  ],
+  async (req, res, next) => {
+    try {
+      logger.info('Referring patient', {
+        userId: req.user.id,
+        appointmentId: req.params.id
+      });
+      await AppointmentHandler.referAppointment(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/appointments/{id}/intake-form:
+ *   get:
+ *     tags:
+ *       - Appointments
+ *     summary: Get the intake form for an appointment
+ *     description: >
+ *       Returns the admin-managed intake form for the doctor's specialty (the
+ *       first of the doctor's specializations that has one) and the answers the
+ *       patient already submitted. The doctor uses this, or the intake field of
+ *       the appointment, to prepare for the consultation.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The form, stored answers (intake, null when not answered yet) and whether the caller can submit
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a participant of the appointment
+ *       404:
+ *         description: Appointment not found, or no intake form for its specialty
+ *   post:
+ *     tags:
+ *       - Appointments
+ *     summary: Submit intake form answers
+ *     description: Patient only. Answers are validated against the form and replace earlier answers. Not allowed once the appointment is completed or cancelled.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - answers
+ *             properties:
+ *               answers:
+ *                 type: object
+ *                 description: Answers keyed by question key, e.g. { "smoker": false, "symptoms_since": "2 weeks" }
+ *     responses:
+ *       200:
+ *         description: Answers stored
+ *       400:
+ *         description: Answers don't match the form (errors keyed by question key)
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not the appointment's patient
+ *       404:
+ *         description: Appointment not found, or no intake form for its specialty
+ *       409:
+ *         description: The appointment is completed or cancelled
+ */
+router.get('/:id/intake-form',
+  AuthMiddleware.authenticate,
+  AppointmentHandler.getIntakeForm
+);
+
+router.post('/:id/intake-form',
+  AuthMiddleware.authenticate,
+  [
+    body('answers')
+      .custom(value => !!value && typeof value === 'object' && !Array.isArray(value))
+      .withMessage('Answers must be an object keyed by question key')
+  ],
+  AppointmentHandler.submitIntakeForm
+);
+
 // Helper function to check time slot availability
 async function checkTimeSlotAvailability(doctor, appointmentTime) {
   const day = ['Sunday', 'Monday', 'Tuesday', 'Wednesday', 'Thursday', 'Friday', 'Saturday'][appointmentTime.getDay()];
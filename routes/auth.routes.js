@@ -1,10 +1,13 @@
 const express = require('express');
+const { body } = require('express-validator');
 const router = express.Router();
 const AuthHandler = require('../handlers/auth.handler');
 const AuthMiddleware = require('../middleware/auth.middleware');
 const sessionMiddleware = require('../middleware/session.middleware');
 const Session = require('../models/session.model');
 const logger = require('../utils/logger');
+const { validateFields } = require('../middleware/validation.middleware');
+const { normalizePhoneNumber } = require('../utils/phone');
 
 /**
  * @swagger
@@ -24,6 +27,10 @@ const logger = require('../utils/logger');
  *           format: email
  *         phone:
  *           type: object
+ *           description: >
+ *             Normalized on registration. A number without a country code gets
+ *             the default region (+31), e.g. "06 12345678" is stored as
+ *             countryCode "+31" and number "612345678".
  *           properties:
  *             countryCode:
  *               type: string
@@ -36,6 +43,10 @@ const logger = require('../utils/logger');
  *         role:
  *           type: string
  *           enum: [patient, doctor]
+ *         smsConsent:
+ *           type: boolean
+ *           default: false
+ *           description: Consent to appointment reminders and other notifications by SMS
  *         address:
  *           type: object
  *           properties:
@@ -67,9 +78,27 @@ const logger = require('../utils/logger');
  *       201:
  *         description: User registered successfully
  *       400:
- *         description: Invalid input data
+ *         description: >
+ *           Invalid input data. The errors field maps each invalid field to a
+ *           message, e.g. { "email": "Email is invalid", "firstName": "First name is required" }
  */
-router.post('/register', AuthHandler.register);
+router.post('/register',
+  validateFields([
+    body('email')
+      .exists({ checkFalsy: true }).withMessage('Email is required').bail()
+      .trim().toLowerCase()
+      .isEmail().withMessage('Email is invalid'),
+    body('phone.number')
+      .exists({ checkFalsy: true }).withMessage('Phone number is required').bail()
+      .custom((value, { req }) => normalizePhoneNumber(req.body.phone) !== null).withMessage('Phone number is invalid'),
+    body('firstName').isString().withMessage('First name is required').bail().trim().notEmpty().withMessage('First name is required'),
+    body('lastName').isString().withMessage('Last name is required').bail().trim().notEmpty().withMessage('Last name is required'),
+    body('role').optional().isIn(['patient', 'doctor']).withMessage('Role must be patient or doctor'),
+    body('address').optional().isObject().withMessage('Address must be an object'),
+    body('smsConsent').optional().isBoolean().withMessage('smsConsent must be a boolean')
+  ]),
+  AuthHandler.register
+);
 
 /**
  * @swagger
@@ -131,7 +160,7 @@ router.post('/login/initiate', AuthHandler.initiateLogin);
  *                     type: string
  *     responses:
  *       200:
- *         description: Login successful
+ *         description: Login successful. The access token (token) expires after 15 minutes; trade the refreshToken at /auth/refresh for a new pair.
  *       400:
  *         description: Invalid OTP
  */
@@ -193,6 +222,67 @@ router.post('/verify/email', AuthHandler.verifyEmail);
  */
 router.post('/verify/phone', AuthHandler.verifyPhone);
 
+/**
+ * @swagger
+ * /api/v1/auth/send-otp:
+ *   post:
+ *     summary: Send a code to verify the signed-in user's phone
+ *     description: >
+ *       Texts a 6-digit code to the phone number on the account. It expires
+ *       after 5 minutes, and codes sent earlier stop working. At most 3 codes
+ *       can be requested per phone number every 15 minutes.
+ *     tags: [Authentication]
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Code sent; expiresAt says when it stops working
+ *       400:
+ *         description: Phone is already verified
+ *       429:
+ *         description: >
+ *           Too many codes requested. retryAfter (and the Retry-After header)
+ *           says when a new one can be requested.
+ */
+router.post('/send-otp', AuthMiddleware.authenticate, AuthHandler.sendPhoneOTP);
+
+/**
+ * @swagger
+ * /api/v1/auth/verify-otp:
+ *   post:
+ *     summary: Verify the signed-in user's phone with the code sent by SMS
+ *     description: >
+ *       Marks the phone as verified. A code works once, and stops working
+ *       after 5 wrong guesses.
+ *     tags: [Authentication]
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - otp
+ *             properties:
+ *               otp:
+ *                 type: string
+ *                 example: "123456"
+ *     responses:
+ *       200:
+ *         description: Phone verified successfully
+ *       400:
+ *         description: Invalid or expired OTP
+ */
+router.post('/verify-otp',
+  AuthMiddleware.authenticate,
+  validateFields([
+    body('otp').matches(/^\d{6}$/).withMessage('OTP must be 6 digits')
+  ]),
+  AuthHandler.verifyPhoneOTP
+);
+
 /**
  * @swagger
  * /api/v1/auth/logout:
@@ -221,6 +311,37 @@ router.post('/logout', AuthMiddleware.authenticate, AuthHandler.logout);
  */
 router.post('/logout/all', AuthMiddleware.authenticate, AuthHandler.logoutAll);
 
+/**
+ * @swagger
+ * /api/v1/auth/refresh:
+ *   post:
+ *     summary: Get a new access token
+ *     description: Exchanges a refresh token for a new access token and refresh token. Each refresh token works once; presenting one again revokes every token of its login and ends the session.
+ *     tags: [Authentication]
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - refreshToken
+ *             properties:
+ *               refreshToken:
+ *                 type: string
+ *     responses:
+ *       200:
+ *         description: New token and refreshToken
+ *       401:
+ *         description: Invalid, expired, revoked (INVALID_REFRESH_TOKEN) or already used (REFRESH_TOKEN_REUSED) refresh token
+ */
+router.post('/refresh',
+  validateFields([
+    body('refreshToken').isString().notEmpty().withMessage('Refresh token is required')
+  ]),
+  AuthHandler.refresh
+);
+
 /**
  * @swagger
  * /api/v1/auth/refresh-session:
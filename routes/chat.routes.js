@@ -1,23 +1,16 @@
 const express = require('express');
 const { body, validationResult } = require('express-validator');
 const mongoose = require('mongoose');
-const multer = require('multer');
 const Chat = require('../models/chat.model');
 const Message = require('../models/message.model');
 const Appointment = require('../models/appointment.model');
 const AuthMiddleware = require('../middleware/auth.middleware');
 const ChatHandler = require('../handlers/chat.handler');
-const AWSService = require('../services/aws.service');
+const { singleUpload } = require('../middleware/upload.middleware');
+const config = require('../config/config');
 
 const router = express.Router();
 
-// Configure multer for memory storage
-const storage = multer.memoryStorage();
-const upload = multer({
-  storage,
-  limits: { fileSize: 5 * 1024 * 1024 } // 5MB limit
-});
-
 /**
  * @swagger
  * components:
@@ -47,6 +40,9 @@ const upload = multer({
  *         read:
  *           type: boolean
  *           description: Whether the message has been read
+ *         redacted:
+ *           type: boolean
+ *           description: Whether the content was purged and replaced with a tombstone
  *         createdAt:
  *           type: string
  *           format: date-time
@@ -130,7 +126,10 @@ router.get('/:appointmentId',
  *     tags:
  *       - Chat
  *     summary: Send a text message
- *     description: Send a new text message in the chat
+ *     description: >
+ *       Send a new text message in the chat. The appointment's doctor can send
+ *       one of their saved templates instead by giving templateId without
+ *       content; the server fills in its placeholders for this appointment.
  *     security:
  *       - bearerAuth: []
  *     parameters:
@@ -146,13 +145,14 @@ router.get('/:appointmentId',
  *         application/json:
  *           schema:
  *             type: object
- *             required:
- *               - content
- *               - type
  *             properties:
  *               content:
  *                 type: string
- *                 description: Message content
+ *                 maxLength: 2000
+ *                 description: Message content, must not be blank. Required unless templateId is given.
+ *               templateId:
+ *                 type: string
+ *                 description: One of the sending doctor's message templates; the message is sent as text
  *               type:
  *                 type: string
  *                 enum: [text, image, file]
@@ -165,19 +165,31 @@ router.get('/:appointmentId',
  *             schema:
  *               $ref: '#/components/schemas/Message'
  *       400:
- *         description: Invalid request data
+ *         description: Empty or too long content, or an unknown message type. The errors field maps each invalid field to a message.
  *       401:
  *         description: Unauthorized
+ *       403:
+ *         description: Not a participant, the appointment's doctor is no longer verified (code DOCTOR_NOT_VERIFIED), or templateId sent by someone other than the appointment's doctor
  *       404:
- *         description: Chat not found
+ *         description: Chat or template not found
  *       500:
  *         description: Server error
  */
 router.post('/:appointmentId/message', 
   AuthMiddleware.authenticate,
   [
-    body('content').isString().withMessage('Message content must be a string'),
-    body('type').isIn(['text', 'image', 'file']).withMessage('Invalid message type')
+    body('templateId').optional().isMongoId().withMessage('Invalid template ID'),
+    // With a template the server supplies the text
+    body('content')
+      .if(body('templateId').not().exists())
+      .isString().withMessage('Message content must be a string').bail()
+      .trim()
+      .notEmpty().withMessage('Message content cannot be empty')
+      .isLength({ max: config.chat.maxMessageLength })
+      .withMessage(`Message content cannot exceed ${config.chat.maxMessageLength} characters`),
+    body('type')
+      .if(body('templateId').not().exists())
+      .isIn(Message.schema.path('type').enumValues).withMessage('Invalid message type')
   ],
   ChatHandler.sendMessage
 );
@@ -223,19 +235,78 @@ router.post('/:appointmentId/message',
  *         description: Invalid request data
  *       401:
  *         description: Unauthorized
+ *       403:
+ *         description: Not a participant, or the appointment's doctor is no longer verified (code DOCTOR_NOT_VERIFIED)
  *       404:
  *         description: Chat not found
  *       413:
  *         description: File too large
+ *       422:
+ *         description: Rejected by the malware scan (FILE_INFECTED)
+ *       503:
+ *         description: The malware scanner is unavailable (SCAN_UNAVAILABLE)
  *       500:
  *         description: Server error
  */
 router.post('/:appointmentId/file', 
   AuthMiddleware.authenticate,
-  upload.single('file'),
+  singleUpload('chatAttachment', 'file'),
   ChatHandler.uploadFile
 );
 
+/**
+ * @swagger
+ * /api/v1/chats/{appointmentId}/purge:
+ *   post:
+ *     tags:
+ *       - Chat
+ *     summary: Purge a completed appointment's chat content
+ *     description: >
+ *       For privacy, either participant or an admin can remove the chat
+ *       content of a completed appointment. Message bodies are replaced with
+ *       a tombstone and attachments are deleted from storage; who sent what
+ *       and when is kept for auditing. Purging again only affects messages
+ *       sent since. The retention job does the same automatically after
+ *       RETENTION_CHAT_CONTENT_DAYS.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: appointmentId
+ *         required: true
+ *         schema:
+ *           type: string
+ *         description: Appointment ID
+ *     responses:
+ *       200:
+ *         description: Chat content purged
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 appointmentId:
+ *                   type: string
+ *                 messageCount:
+ *                   type: integer
+ *                 attachmentCount:
+ *                   type: integer
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a participant or admin
+ *       404:
+ *         description: Appointment not found
+ *       409:
+ *         description: The appointment is not completed
+ *       500:
+ *         description: Server error
+ */
+router.post('/:appointmentId/purge',
+  AuthMiddleware.authenticate,
+  ChatHandler.purgeChat
+);
+
 /**
  * @swagger
  * /api/v1/chats/unread-count:
@@ -0,0 +1,76 @@
+const express = require('express');
+const ConfigHandler = require('../handlers/config.handler');
+const logger = require('../utils/logger');
+
+const router = express.Router();
+
+/**
+ * @swagger
+ * tags:
+ *   name: Config
+ *   description: Public platform configuration
+ */
+
+/**
+ * @swagger
+ * /api/v1/config:
+ *   get:
+ *     tags:
+ *       - Config
+ *     summary: Get public platform configuration
+ *     description: Non-secret settings clients need to render forms. No authentication required. The version field changes when the response shape changes.
+ *     security: []
+ *     responses:
+ *       200:
+ *         description: Public configuration
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 version:
+ *                   type: integer
+ *                 appointments:
+ *                   type: object
+ *                   properties:
+ *                     modes:
+ *                       type: array
+ *                       items:
+ *                         type: string
+ *                     slotDurationMinutes:
+ *                       type: integer
+ *                     allowedSlotDurations:
+ *                       type: array
+ *                       items:
+ *                         type: integer
+ *                     dependentRelationships:
+ *                       type: array
+ *                       items:
+ *                         type: string
+ *                 payments:
+ *                   type: object
+ *                   properties:
+ *                     currencies:
+ *                       type: array
+ *                       items:
+ *                         type: string
+ *                     payBeforeConfirm:
+ *                       type: boolean
+ *                     holdMinutes:
+ *                       type: integer
+ *                 uploads:
+ *                   type: object
+ *                   description: Size limit and allowed MIME types per upload category
+ *       500:
+ *         description: Server error
+ */
+router.get('/', async (req, res, next) => {
+  try {
+    logger.info('Fetching public config');
+    await ConfigHandler.getPublicConfig(req, res);
+  } catch (error) {
+    next(error);
+  }
+});
+
+module.exports = router;
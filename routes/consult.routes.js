@@ -0,0 +1,309 @@
+const express = require('express');
+const { body, param } = require('express-validator');
+const AuthMiddleware = require('../middleware/auth.middleware');
+const ConsultHandler = require('../handlers/consult.handler');
+
+const router = express.Router();
+
+/**
+ * @swagger
+ * tags:
+ *   name: Consult
+ *   description: >
+ *     Instant video consults. Verified doctors go online; patients queue per
+ *     specialty and are matched with the next free online doctor, which books
+ *     a video appointment starting right away.
+ */
+
+/**
+ * @swagger
+ * components:
+ *   schemas:
+ *     InstantConsult:
+ *       type: object
+ *       properties:
+ *         id:
+ *           type: string
+ *         status:
+ *           type: string
+ *           enum: [waiting, matched, completed, cancelled, expired]
+ *         specialty:
+ *           type: string
+ *         reason:
+ *           type: string
+ *         requestedAt:
+ *           type: string
+ *           format: date-time
+ *         requeueCount:
+ *           type: integer
+ *           description: Times the matched doctor went offline before joining and the request went back to the queue
+ *         position:
+ *           type: integer
+ *           description: Place in the specialty's queue, while waiting
+ *         onlineDoctors:
+ *           type: integer
+ *           description: Doctors online in the specialty, while waiting
+ *         freeDoctors:
+ *           type: integer
+ *           description: Online doctors not in a consult, while waiting
+ *         expiresAt:
+ *           type: string
+ *           format: date-time
+ *           description: When a waiting request expires (INSTANT_CONSULT_MAX_WAIT_MINUTES)
+ *         doctorId:
+ *           type: string
+ *         appointmentId:
+ *           type: string
+ *           description: The video appointment, once matched
+ *         videoSessionId:
+ *           type: string
+ *         matchedAt:
+ *           type: string
+ *           format: date-time
+ *         fallback:
+ *           type: array
+ *           description: >
+ *             Soonest scheduled appointments in the specialty, once expired or
+ *             while no doctor is online, each with a bookingToken
+ *           items:
+ *             type: object
+ */
+
+/**
+ * @swagger
+ * /api/v1/consult/online:
+ *   put:
+ *     tags:
+ *       - Consult
+ *     summary: Go online or offline for instant consults
+ *     description: >
+ *       Online doctors repeat the call with online true at least every
+ *       heartbeatSeconds; otherwise they count as offline. Going online matches
+ *       waiting patients. Going offline sends patients matched with the doctor,
+ *       who haven't been joined yet, back to the queue in their original place.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - online
+ *             properties:
+ *               online:
+ *                 type: boolean
+ *     responses:
+ *       200:
+ *         description: >
+ *           online, onlineSince, lastSeenAt, heartbeatSeconds and the consult
+ *           the doctor is matched with, if any
+ *       400:
+ *         description: Invalid request data
+ *       403:
+ *         description: The doctor isn't verified (DOCTOR_NOT_VERIFIED)
+ *       404:
+ *         description: Doctor profile not found
+ *   get:
+ *     tags:
+ *       - Consult
+ *     summary: The doctor's instant consult state and current match
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: online, onlineSince, lastSeenAt, heartbeatSeconds and consult
+ *       404:
+ *         description: Doctor profile not found
+ */
+router.put('/online',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  [body('online').isBoolean().withMessage('Online must be true or false')],
+  ConsultHandler.setOnline
+);
+
+router.get('/online',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  ConsultHandler.getOnline
+);
+
+/**
+ * @swagger
+ * /api/v1/consult/instant:
+ *   post:
+ *     tags:
+ *       - Consult
+ *     summary: Request an instant consult
+ *     description: >
+ *       Queues the patient for the specialty and matches them right away when
+ *       a doctor is free. Poll GET /consult/instant/{id} for the queue position
+ *       and, once matched, the appointment and video session to join.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - specialty
+ *               - reason
+ *             properties:
+ *               specialty:
+ *                 type: string
+ *               reason:
+ *                 type: string
+ *                 maxLength: 500
+ *     responses:
+ *       201:
+ *         description: Queued or matched
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/InstantConsult'
+ *       400:
+ *         description: Invalid request data
+ *       409:
+ *         description: >
+ *           INSTANT_CONSULT_OPEN with the open request in consult, or
+ *           NO_DOCTORS_ONLINE with the soonest scheduled appointments in suggestions
+ */
+router.post('/instant',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('patient'),
+  [
+    body('specialty').isString().trim().notEmpty().withMessage('Specialty is required'),
+    body('reason').isString().trim().isLength({ min: 1, max: 500 }).withMessage('Reason is required and must be at most 500 characters')
+  ],
+  ConsultHandler.requestInstant
+);
+
+/**
+ * @swagger
+ * /api/v1/consult/instant/{id}:
+ *   get:
+ *     tags:
+ *       - Consult
+ *     summary: Where an instant consult request stands
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The request
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/InstantConsult'
+ *       403:
+ *         description: Not a patient
+ *       404:
+ *         description: Request not found
+ *   delete:
+ *     tags:
+ *       - Consult
+ *     summary: Leave the instant consult queue
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The cancelled request
+ *       403:
+ *         description: Not a patient
+ *       404:
+ *         description: Request not found
+ *       409:
+ *         description: The request isn't waiting (INSTANT_CONSULT_NOT_WAITING)
+ */
+router.get('/instant/:id',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('patient'),
+  [param('id').isMongoId().withMessage('Invalid request ID')],
+  ConsultHandler.getInstant
+);
+
+router.delete('/instant/:id',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('patient'),
+  [param('id').isMongoId().withMessage('Invalid request ID')],
+  ConsultHandler.cancelInstant
+);
+
+/**
+ * @swagger
+ * /api/v1/consult/admin/instant/{id}:
+ *   get:
+ *     tags:
+ *       - Consult
+ *     summary: Any patient's instant consult request (admin only)
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The request
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/InstantConsult'
+ *       403:
+ *         description: Not an admin
+ *       404:
+ *         description: Request not found
+ *   delete:
+ *     tags:
+ *       - Consult
+ *     summary: Take any patient's request out of the instant consult queue (admin only)
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: The cancelled request
+ *       403:
+ *         description: Not an admin
+ *       404:
+ *         description: Request not found
+ *       409:
+ *         description: The request isn't waiting (INSTANT_CONSULT_NOT_WAITING)
+ */
+router.get('/admin/instant/:id',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('admin'),
+  [param('id').isMongoId().withMessage('Invalid request ID')],
+  ConsultHandler.getAnyInstant
+);
+
+router.delete('/admin/instant/:id',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('admin'),
+  [param('id').isMongoId().withMessage('Invalid request ID')],
+  ConsultHandler.cancelAnyInstant
+);
+
+module.exports = router;
@@ -1,13 +1,15 @@
 const express = require('express');
-const { body, validationResult, query } = require('express-validator');
+const { body, param, validationResult, query } = require('express-validator');
 const mongoose = require('mongoose');
-const multer = require('multer');
 const Doctor = require('../models/doctor.model');
+const Appointment = require('../models/appointment.model');
 const User = require('../models/user.model');
 const AuthMiddleware = require('../middleware/auth.middleware');
 const DoctorHandler = require('../handlers/doctor.handler');
-const AWSService = require('../services/aws.service');
+const { singleUpload } = require('../middleware/upload.middleware');
+const { handleUpload } = require('../services/upload.service');
 const logger = require('../utils/logger');
+const config = require('../config/config');
 
 const router = express.Router();
 
@@ -38,10 +40,24 @@ const router = express.Router();
  *           description: Whether the doctor is verified
  *         rating:
  *           type: number
- *           description: Average rating
+ *           description: Average rating from verified reviews
  *         totalReviews:
  *           type: number
- *           description: Total number of reviews
+ *           description: Number of verified reviews
+ *         ratingSummary:
+ *           type: object
+ *           description: >
+ *             The rating to display. average is null, with label "Not enough
+ *             reviews", until MIN_REVIEWS_FOR_RATING verified reviews exist.
+ *           properties:
+ *             average:
+ *               type: number
+ *               nullable: true
+ *             count:
+ *               type: integer
+ *             label:
+ *               type: string
+ *               nullable: true
  *         createdAt:
  *           type: string
  *           format: date-time
@@ -63,8 +79,28 @@ const router = express.Router();
  *           type: number
  *         consultationFee:
  *           type: number
+ *         consultationTypes:
+ *           type: array
+ *           items:
+ *             type: object
+ *             properties:
+ *               _id:
+ *                 type: string
+ *               name:
+ *                 type: string
+ *               duration:
+ *                 type: integer
+ *               fee:
+ *                 type: number
+ *         pricingRules:
+ *           type: array
+ *           items:
+ *             $ref: '#/components/schemas/PricingRule'
  *         currency:
  *           type: string
+ *         timeZone:
+ *           type: string
+ *           description: IANA time zone of the doctor's schedule
  *         about:
  *           type: string
  *         education:
@@ -126,15 +162,77 @@ const router = express.Router();
  *               type: string
  *             postalCode:
  *               type: string
+ *             rooms:
+ *               type: integer
+ *               minimum: 1
+ *               default: 1
+ *               description: >
+ *                 Consultation rooms for in-person visits. Doctors at the same
+ *                 address and postal code share them; bookings beyond the room
+ *                 count are rejected with CLINIC_AT_CAPACITY.
+ *             coordinates:
+ *               type: object
+ *               description: GeoJSON point used for nearby search
+ *               properties:
+ *                 type:
+ *                   type: string
+ *                   enum: [Point]
+ *                 coordinates:
+ *                   type: array
+ *                   description: "[longitude, latitude]"
+ *                   items:
+ *                     type: number
+ *     PricingRule:
+ *       type: object
+ *       required:
+ *         - days
+ *         - startTime
+ *         - endTime
+ *         - multiplier
+ *       properties:
+ *         days:
+ *           type: array
+ *           items:
+ *             type: string
+ *             enum: [monday, tuesday, wednesday, thursday, friday, saturday, sunday]
+ *         startTime:
+ *           type: string
+ *           example: "18:00"
+ *         endTime:
+ *           type: string
+ *           example: "21:00"
+ *         multiplier:
+ *           type: number
+ *           minimum: 0.5
+ *           maximum: 5
+ *           example: 1.5
+ *         label:
+ *           type: string
+ *           maxLength: 50
+ *           example: Evening rate
+ *     ScheduleConflict:
+ *       type: object
+ *       description: A booked appointment outside the doctor's new schedule
+ *       properties:
+ *         id:
+ *           type: string
+ *         date:
+ *           type: string
+ *           format: date
+ *         startTime:
+ *           type: string
+ *         endTime:
+ *           type: string
+ *         type:
+ *           type: string
+ *         status:
+ *           type: string
+ *           enum: [pending, confirmed]
+ *         patientNotified:
+ *           type: boolean
+ *           description: Whether the patient has been asked to reschedule
  */
 
-// Configure multer for memory storage
-const storage = multer.memoryStorage();
-const upload = multer({
-  storage,
-  limits: { fileSize: 5 * 1024 * 1024 } // 5MB limit
-});
-
 /**
  * @swagger
  * tags:
@@ -175,6 +273,13 @@ const upload = multer({
  *           type: integer
  *           default: 10
  *         description: Number of items per page
+ *       - in: query
+ *         name: cursor
+ *         schema:
+ *           type: string
+ *         description: >
+ *           nextCursor from the previous page. Pages after a cursor stay
+ *           consistent while items are added; page is ignored.
  *     responses:
  *       200:
  *         description: List of doctors retrieved successfully
@@ -186,13 +291,27 @@ const upload = multer({
  *                 doctors:
  *                   type: array
  *                   items:
- *                     $ref: '#/components/schemas/Doctor'
+ *                     allOf:
+ *                       - $ref: '#/components/schemas/Doctor'
+ *                       - type: object
+ *                         properties:
+ *                           nextAvailable:
+ *                             type: string
+ *                             format: date-time
+ *                             nullable: true
+ *                             description: Start of the doctor's next free slot within the next 14 days, or null if none
  *                 total:
  *                   type: integer
  *                 page:
  *                   type: integer
+ *                   description: Only when paging by offset
  *                 pages:
  *                   type: integer
+ *                   description: Only when paging by offset
+ *                 nextCursor:
+ *                   type: string
+ *                   nullable: true
+ *                   description: Cursor of the next page, or null on the last page
  *       401:
  *         description: Unauthorized
  *       500:
@@ -200,6 +319,100 @@ const upload = multer({
  */
 router.get('/', DoctorHandler.getDoctors);
 
+/**
+ * @swagger
+ * /api/v1/doctors/nearby:
+ *   get:
+ *     tags:
+ *       - Doctors
+ *     summary: Find doctors near a location
+ *     description: >
+ *       Verified doctors whose clinic is within the radius. Results can be
+ *       sorted by distance, by rating, or by a composite score that blends
+ *       proximity, rating and how soon the doctor has a free slot. Each doctor
+ *       carries its component scores (0 to 1, higher is better) so clients can
+ *       show why it ranked where it did.
+ *     parameters:
+ *       - in: query
+ *         name: lat
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - in: query
+ *         name: lng
+ *         required: true
+ *         schema:
+ *           type: number
+ *       - in: query
+ *         name: radiusKm
+ *         schema:
+ *           type: number
+ *           default: 25
+ *           maximum: 100
+ *       - in: query
+ *         name: sort
+ *         schema:
+ *           type: string
+ *           enum: [distance, rating, composite]
+ *           default: distance
+ *       - in: query
+ *         name: specialization
+ *         schema:
+ *           type: string
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 10
+ *           maximum: 50
+ *     responses:
+ *       200:
+ *         description: Ranked doctors
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 success:
+ *                   type: boolean
+ *                 sort:
+ *                   type: string
+ *                 radiusKm:
+ *                   type: number
+ *                 weights:
+ *                   type: object
+ *                   description: Weights of the composite score, only present when sort is composite
+ *                 doctors:
+ *                   type: array
+ *                   items:
+ *                     allOf:
+ *                       - $ref: '#/components/schemas/Doctor'
+ *                       - type: object
+ *                         properties:
+ *                           distanceKm:
+ *                             type: number
+ *                           nextAvailable:
+ *                             type: string
+ *                             format: date-time
+ *                             nullable: true
+ *                           scores:
+ *                             type: object
+ *                             properties:
+ *                               distance:
+ *                                 type: number
+ *                               rating:
+ *                                 type: number
+ *                               availability:
+ *                                 type: number
+ *                               composite:
+ *                                 type: number
+ *       400:
+ *         description: Missing or invalid location or sort
+ *       500:
+ *         description: Server error
+ */
+router.get('/nearby', DoctorHandler.getNearbyDoctors);
+
 /**
  * @swagger
  * /api/v1/doctors/profile:
@@ -292,13 +505,49 @@ router.get('/profile', AuthMiddleware.authenticate, DoctorHandler.getDoctorProfi
  *                 type: number
  *                 minimum: 0
  *                 description: Consultation fee amount
+ *               consultationTypes:
+ *                 type: array
+ *                 description: Bookable consultation types with their own duration and fee
+ *                 items:
+ *                   type: object
+ *                   required:
+ *                     - name
+ *                     - duration
+ *                     - fee
+ *                   properties:
+ *                     _id:
+ *                       type: string
+ *                       description: Send back to keep an existing type's ID
+ *                     name:
+ *                       type: string
+ *                       example: Follow-up
+ *                     duration:
+ *                       type: integer
+ *                       enum: [15, 30, 45, 60]
+ *                     fee:
+ *                       type: number
+ *                       minimum: 0
+ *               pricingRules:
+ *                 type: array
+ *                 description: >
+ *                   Peak pricing. A slot starting on one of a rule's days within
+ *                   its time range costs the fee (or consultation type fee) times
+ *                   the multiplier; with several matching rules the highest
+ *                   multiplier applies. Omit to keep the current rules.
+ *                 items:
+ *                   $ref: '#/components/schemas/PricingRule'
  *               currency:
  *                 type: string
  *                 default: EUR
  *                 description: Currency for consultation fee
+ *               timeZone:
+ *                 type: string
+ *                 example: Europe/Amsterdam
+ *                 description: IANA time zone the availability times are in. Omit to keep the current one; defaults to UTC.
  *               about:
  *                 type: string
- *                 description: Doctor's bio or description
+ *                 maxLength: 5000
+ *                 description: Doctor's bio or description. Basic formatting tags (p, br, strong, em, b, i, u, ul, ol, li, a) are kept; any other markup is stripped before storage.
  *               education:
  *                 type: array
  *                 items:
@@ -409,6 +658,21 @@ router.get('/profile', AuthMiddleware.authenticate, DoctorHandler.getDoctorProfi
  *                     type: string
  *                     default: Netherlands
  *                     description: Country name
+ *                   openingHours:
+ *                     type: array
+ *                     description: Clinic opening hours. In-person appointments must fall within these as well as the doctor's availability.
+ *                     items:
+ *                       type: object
+ *                       properties:
+ *                         day:
+ *                           type: string
+ *                           enum: [monday, tuesday, wednesday, thursday, friday, saturday, sunday]
+ *                         openTime:
+ *                           type: string
+ *                           example: "08:00"
+ *                         closeTime:
+ *                           type: string
+ *                           example: "17:00"
  *               availability:
  *                 type: array
  *                 items:
@@ -552,7 +816,7 @@ router.get('/profile', AuthMiddleware.authenticate, DoctorHandler.getDoctorProfi
  *                   type: string
  *                   example: Failed to update doctor profile
  */
-router.post('/profile', AuthMiddleware.authenticate, DoctorHandler.createOrUpdateProfile);
+router.post('/profile', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.createOrUpdateProfile);
 
 /**
  * @swagger
@@ -625,7 +889,7 @@ router.get('/getById', DoctorHandler.getDoctorById);
  *       500:
  *         description: Server error
  */
-router.get('/appointments', DoctorHandler.getAppointments);
+router.get('/appointments', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.getAppointments);
 
 /**
  * @swagger
@@ -654,12 +918,589 @@ router.get('/appointments', DoctorHandler.getAppointments);
  *               status:
  *                 type: string
  *                 enum: [confirmed, cancelled, completed]
+ *               disposition:
+ *                 type: string
+ *                 enum: [resolved, referral, follow-up-needed, prescription-issued]
+ *                 description: Outcome of the consult. Only allowed with status completed, and required for it when REQUIRE_APPOINTMENT_DISPOSITION is true.
  *     responses:
  *       200:
  *         description: Appointment status updated successfully
+ *       400:
+ *         description: Missing or invalid disposition
  */
 router.put('/appointments/:id', AuthMiddleware.authenticate, DoctorHandler.updateAppointmentStatus);
 
+/**
+ * @swagger
+ * /api/v1/doctors/me/calendar-token:
+ *   post:
+ *     tags:
+ *       - Doctors
+ *     summary: Create or rotate the calendar feed token
+ *     description: Returns a secret feed URL for calendar apps. Rotating invalidates the previous URL.
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       201:
+ *         description: Feed token created
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 token:
+ *                   type: string
+ *                 url:
+ *                   type: string
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Doctor profile not found
+ *   delete:
+ *     tags:
+ *       - Doctors
+ *     summary: Revoke the calendar feed token
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Feed token revoked
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Doctor profile not found
+ */
+router.post('/me/calendar-token', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.createCalendarFeedToken);
+router.delete('/me/calendar-token', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.revokeCalendarFeedToken);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/calendar.ics:
+ *   get:
+ *     tags:
+ *       - Doctors
+ *     summary: Doctor calendar feed (ICS)
+ *     description: Upcoming appointments as an iCalendar feed. Authenticated by the feed token in the query string because calendar apps can't send auth headers. Supports ETag/If-None-Match.
+ *     security: []
+ *     parameters:
+ *       - in: query
+ *         name: token
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Calendar feed
+ *         content:
+ *           text/calendar:
+ *             schema:
+ *               type: string
+ *       304:
+ *         description: Feed unchanged
+ *       401:
+ *         description: Missing or invalid feed token
+ */
+router.get('/me/calendar.ics', DoctorHandler.getCalendarFeed);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/cancel-range:
+ *   post:
+ *     tags:
+ *       - Doctors
+ *     summary: Cancel all open appointments in a time range
+ *     description: >
+ *       For emergencies. Cancels every pending or confirmed appointment of the
+ *       doctor starting within the range, fully refunds paid ones, notifies each
+ *       patient (optionally with rebooking times after the range) and records
+ *       an audit entry. This does not block the freed slots; add time off for
+ *       the range so patients can't book them again.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - from
+ *               - to
+ *               - reason
+ *             properties:
+ *               from:
+ *                 type: string
+ *                 format: date-time
+ *               to:
+ *                 type: string
+ *                 format: date-time
+ *               reason:
+ *                 type: string
+ *               cancellationCategory:
+ *                 type: string
+ *                 enum: [patient_unavailable, found_other_care, doctor_unavailable, emergency, other]
+ *                 default: doctor_unavailable
+ *               offerRebooking:
+ *                 type: boolean
+ *                 default: true
+ *     responses:
+ *       200:
+ *         description: Per-appointment results of the cancellation run
+ *       400:
+ *         description: Validation error or range longer than allowed
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Doctor profile not found
+ */
+router.post(
+  '/me/cancel-range',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  [
+    body('from').isISO8601().withMessage('from must be an ISO 8601 date-time'),
+    body('to').isISO8601().withMessage('to must be an ISO 8601 date-time'),
+    body('reason').isString().trim().notEmpty().withMessage('Reason is required'),
+    body('cancellationCategory').optional().isIn(Appointment.CANCELLATION_CATEGORIES).withMessage(`cancellationCategory must be one of: ${Appointment.CANCELLATION_CATEGORIES.join(', ')}`),
+    body('offerRebooking').optional().isBoolean().toBoolean().withMessage('offerRebooking must be a boolean')
+  ],
+  DoctorHandler.cancelAppointmentRange
+);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/payouts:
+ *   get:
+ *     tags:
+ *       - Doctors
+ *     summary: Get the doctor's payouts
+ *     description: Payout history plus the amount currently owed, i.e. successful payments not yet paid out, net of the platform commission.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: page
+ *         schema:
+ *           type: integer
+ *           default: 1
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           default: 20
+ *     responses:
+ *       200:
+ *         description: Payouts retrieved successfully
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 pending:
+ *                   type: array
+ *                   items:
+ *                     type: object
+ *                     properties:
+ *                       currency:
+ *                         type: string
+ *                       amount:
+ *                         type: number
+ *                         description: Net of pending clawbacks for refunds of payments already paid out
+ *                       payments:
+ *                         type: integer
+ *                       adjustments:
+ *                         type: integer
+ *                         description: Pending clawbacks
+ *                 commissionPercent:
+ *                   type: number
+ *                 payouts:
+ *                   type: array
+ *                   items:
+ *                     type: object
+ *                     properties:
+ *                       amount:
+ *                         type: number
+ *                       currency:
+ *                         type: string
+ *                       periodStart:
+ *                         type: string
+ *                         format: date-time
+ *                       periodEnd:
+ *                         type: string
+ *                         format: date-time
+ *                       status:
+ *                         type: string
+ *                         enum: [pending, paid]
+ *                       paidAt:
+ *                         type: string
+ *                         format: date-time
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Doctor profile not found
+ */
+router.get('/me/payouts', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.getMyPayouts);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/view-stats:
+ *   get:
+ *     tags:
+ *       - Doctors
+ *     summary: Get profile view statistics
+ *     description: >
+ *       Daily views of the doctor's public profile and the view-to-booking
+ *       conversion rate over the last days (UTC). A viewer is counted at most
+ *       once per day; the doctor's own views are not counted. The conversion
+ *       rate is appointments booked in the period divided by views, or null
+ *       when there were no views.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: days
+ *         schema:
+ *           type: integer
+ *           minimum: 1
+ *           maximum: 365
+ *           default: 30
+ *     responses:
+ *       200:
+ *         description: View statistics
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 from:
+ *                   type: string
+ *                   format: date
+ *                 to:
+ *                   type: string
+ *                   format: date
+ *                 views:
+ *                   type: integer
+ *                 bookings:
+ *                   type: integer
+ *                 conversionRate:
+ *                   type: number
+ *                   nullable: true
+ *                   example: 0.125
+ *                 daily:
+ *                   type: array
+ *                   items:
+ *                     type: object
+ *                     properties:
+ *                       day:
+ *                         type: string
+ *                         format: date
+ *                       views:
+ *                         type: integer
+ *       400:
+ *         description: Invalid days
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Doctor profile not found
+ */
+router.get('/me/view-stats',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  [
+    query('days')
+      .optional()
+      .isInt({ min: 1, max: config.doctorViews.statsMaxDays })
+      .withMessage(`days must be between 1 and ${config.doctorViews.statsMaxDays}`)
+  ],
+  DoctorHandler.getViewStats
+);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/message-templates:
+ *   get:
+ *     tags:
+ *       - Doctors
+ *     summary: List the doctor's saved chat replies
+ *     description: Templates are private to the doctor. placeholders lists the names that can be used in content as {{name}}.
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: The templates and the available placeholders
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Doctor profile not found
+ *   post:
+ *     tags:
+ *       - Doctors
+ *     summary: Save a chat reply template
+ *     description: >
+ *       content may use placeholders that are filled in when the template is
+ *       sent with POST /chats/{appointmentId}/message: {{patientFirstName}},
+ *       {{patientLastName}}, {{doctorLastName}}, {{appointmentDate}} and
+ *       {{appointmentTime}}.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - name
+ *               - content
+ *             properties:
+ *               name:
+ *                 type: string
+ *                 maxLength: 100
+ *               content:
+ *                 type: string
+ *                 maxLength: 2000
+ *     responses:
+ *       201:
+ *         description: Template saved
+ *       400:
+ *         description: Invalid name or content, or an unknown placeholder
+ *       409:
+ *         description: A template with this name exists, or the template limit is reached
+ * /api/v1/doctors/me/message-templates/{id}:
+ *   put:
+ *     tags:
+ *       - Doctors
+ *     summary: Update a chat reply template
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               name:
+ *                 type: string
+ *               content:
+ *                 type: string
+ *     responses:
+ *       200:
+ *         description: Template updated
+ *       400:
+ *         description: Invalid name or content
+ *       404:
+ *         description: Template not found
+ *       409:
+ *         description: A template with this name exists
+ *   delete:
+ *     tags:
+ *       - Doctors
+ *     summary: Delete a chat reply template
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Template deleted
+ *       404:
+ *         description: Template not found
+ */
+const templateValidators = (optional) => [
+  (optional ? body('name').optional() : body('name'))
+    .isString().trim().notEmpty().isLength({ max: 100 }).withMessage('Name must be 1 to 100 characters'),
+  (optional ? body('content').optional() : body('content'))
+    .isString().trim().notEmpty().isLength({ max: config.chat.maxMessageLength })
+    .withMessage(`Content must be 1 to ${config.chat.maxMessageLength} characters`)
+];
+
+router.get('/me/message-templates', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.getMessageTemplates);
+router.post('/me/message-templates', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), templateValidators(false), DoctorHandler.createMessageTemplate);
+router.put('/me/message-templates/:id', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), templateValidators(true), DoctorHandler.updateMessageTemplate);
+router.delete('/me/message-templates/:id', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.deleteMessageTemplate);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/blocks:
+ *   get:
+ *     tags:
+ *       - Doctors
+ *     summary: Patients the doctor has blocked
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Active blocks with the patient's name
+ *       404:
+ *         description: Doctor profile not found
+ *   post:
+ *     tags:
+ *       - Doctors
+ *     summary: Block a patient
+ *     description: >
+ *       The patient can no longer book with the doctor, and neither side can
+ *       send new messages in their chats. Existing appointments and chat
+ *       history are left as they are. The patient isn't notified; their
+ *       bookings and messages are turned down with a neutral message
+ *       (BOOKING_UNAVAILABLE, CHAT_UNAVAILABLE). Only patients who have had an
+ *       appointment with the doctor can be blocked.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - patientId
+ *             properties:
+ *               patientId:
+ *                 type: string
+ *               reason:
+ *                 type: string
+ *                 maxLength: 500
+ *                 description: Kept for the audit trail; never shown to the patient
+ *     responses:
+ *       201:
+ *         description: Patient blocked
+ *       200:
+ *         description: The patient was already blocked
+ *       400:
+ *         description: Invalid request data
+ *       404:
+ *         description: Doctor profile or patient not found
+ * /api/v1/doctors/me/blocks/{patientId}:
+ *   delete:
+ *     tags:
+ *       - Doctors
+ *     summary: Unblock a patient
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: patientId
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Patient unblocked
+ *       403:
+ *         description: The block was placed by an admin
+ *       404:
+ *         description: Block not found
+ */
+router.get('/me/blocks', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.getBlockedPatients);
+router.post('/me/blocks',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  [
+    body('patientId').isMongoId().withMessage('Invalid patient ID'),
+    body('reason').optional().isString().trim().isLength({ max: 500 }).withMessage('Reason must be at most 500 characters')
+  ],
+  DoctorHandler.blockPatient
+);
+router.delete('/me/blocks/:patientId',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  [param('patientId').isMongoId().withMessage('Invalid patient ID')],
+  DoctorHandler.unblockPatient
+);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/clinic-photos:
+ *   post:
+ *     tags:
+ *       - Doctors
+ *     summary: Add a photo of the doctor's clinic
+ *     description: >
+ *       JPEG, PNG or WebP up to 5 MB; a clinic can have at most 10 photos.
+ *       Photos are returned as presigned URLs in the doctor details.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         multipart/form-data:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - photo
+ *             properties:
+ *               photo:
+ *                 type: string
+ *                 format: binary
+ *     responses:
+ *       201:
+ *         description: Photo added; returns all clinic photos
+ *       400:
+ *         description: No file uploaded
+ *       409:
+ *         description: The clinic already has the maximum number of photos
+ *       413:
+ *         description: File too large
+ *       415:
+ *         description: File type not allowed
+ */
+router.post('/me/clinic-photos',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  singleUpload('clinicPhoto', 'photo'),
+  DoctorHandler.addClinicPhoto
+);
+
+/**
+ * @swagger
+ * /api/v1/doctors/me/clinic-photos/{photoId}:
+ *   delete:
+ *     tags:
+ *       - Doctors
+ *     summary: Remove a photo of the doctor's clinic
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: photoId
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Photo removed; returns the remaining clinic photos
+ *       404:
+ *         description: Photo not found
+ */
+router.delete('/me/clinic-photos/:photoId',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  DoctorHandler.removeClinicPhoto
+);
+
 /**
  * @swagger
  * /api/v1/doctors/profile-picture:
@@ -688,25 +1529,21 @@ router.put('/appointments/:id', AuthMiddleware.authenticate, DoctorHandler.updat
  *         description: Invalid file
  *       401:
  *         description: Unauthorized
+ *       422:
+ *         description: Rejected by the malware scan (FILE_INFECTED)
+ *       503:
+ *         description: The malware scanner is unavailable (SCAN_UNAVAILABLE)
  *       500:
  *         description: Server error
  */
 router.put('/profile-picture', 
   AuthMiddleware.authenticate, 
   AuthMiddleware.authorize(['doctor']), 
-  upload.single('profilePicture'), 
+  singleUpload('profileImage', 'profilePicture'), 
   async (req, res) => {
     try {
-      if (!req.file) {
-        return res.status(400).json({ message: 'No file uploaded' });
-      }
-      
-      // Upload to S3
-      const imageUrl = await AWSService.uploadToS3(
-        req.file.buffer,
-        req.file.originalname,
-        req.file.mimetype
-      );
+      // Validate against the profile image limits and upload to S3
+      const imageUrl = await handleUpload(req.file, 'profileImage', req.user.id);
       
       // Update user profile
       const user = await User.findById(req.user.id);
@@ -722,6 +1559,9 @@ router.put('/profile-picture',
         avatarUrl: imageUrl
       });
     } catch (error) {
+      if (error.isOperational) {
+        return res.status(error.statusCode).json({ message: error.message });
+      }
       console.error('Profile picture upload error:', error);
       res.status(500).json({ message: 'Server error while uploading profile picture' });
     }
@@ -757,7 +1597,7 @@ router.get('/specialties', DoctorHandler.getSpecialties);
  *     tags:
  *       - Doctors
  *     summary: Get doctor's availability
- *     description: Get the availability schedule for a specific doctor
+ *     description: The bookable availability blocks for each day in the range, after time off and the doctor's first-slot offset and last-slot cutoff. The range is cut off at lastBookableDate, the end of the doctor's advance booking window. Days that reached the doctor's maxAppointmentsPerDay have no slots and full set.
  *     security:
  *       - bearerAuth: []
  *     parameters:
@@ -787,6 +1627,9 @@ router.get('/specialties', DoctorHandler.getSpecialties);
  *             schema:
  *               type: object
  *               properties:
+ *                 lastBookableDate:
+ *                   type: string
+ *                   format: date
  *                 availability:
  *                   type: array
  *                   items:
@@ -808,6 +1651,9 @@ router.get('/specialties', DoctorHandler.getSpecialties);
  *                               format: time
  *                             isBooked:
  *                               type: boolean
+ *                       full:
+ *                         type: boolean
+ *                         description: Set when the day reached the doctor's daily appointment cap
  *       401:
  *         description: Unauthorized
  *       404:
@@ -824,7 +1670,14 @@ router.get('/availability', DoctorHandler.getAvailability);
  *     tags:
  *       - Doctors
  *     summary: Update doctor availability
- *     description: Update the authenticated doctor's recurring weekly availability schedule. The request body should be an array of objects, each with a day and a slots array.
+ *     description: >
+ *       Update the authenticated doctor's recurring weekly availability
+ *       schedule, given as an array of objects each with a day and a slots
+ *       array, and the daily warm-up and wind-down. Fields left out keep
+ *       their current values. A change that leaves upcoming booked
+ *       appointments outside the schedule is refused with the list of them
+ *       unless confirmConflicts is true. Those appointments stay booked and
+ *       their patients are asked to reschedule.
  *     security:
  *       - bearerAuth: []
  *     requestBody:
@@ -833,9 +1686,78 @@ router.get('/availability', DoctorHandler.getAvailability);
  *         application/json:
  *           schema:
  *             type: object
- *             required:
- *               - availability
  *             properties:
+ *               firstSlotOffset:
+ *                 type: integer
+ *                 minimum: 0
+ *                 maximum: 240
+ *                 description: Minutes kept free at the start of each day's first availability block
+ *               lastSlotCutoff:
+ *                 type: integer
+ *                 minimum: 0
+ *                 maximum: 240
+ *                 description: Minutes kept free at the end of each day's last availability block
+ *               maxAdvanceBookingDays:
+ *                 type: integer
+ *                 nullable: true
+ *                 minimum: 1
+ *                 maximum: 365
+ *                 description: How many days ahead patients can book. null falls back to the platform default (MAX_ADVANCE_BOOKING_DAYS, 90).
+ *               maxAppointmentsPerDay:
+ *                 type: integer
+ *                 nullable: true
+ *                 minimum: 1
+ *                 maximum: 100
+ *                 description: Most appointments booked on one day. Full days offer no slots. null (the default) is unlimited.
+ *               autoAcceptBookings:
+ *                 type: boolean
+ *                 description: >
+ *                   Confirm new bookings automatically instead of waiting for
+ *                   the doctor. When payment is required before confirmation,
+ *                   bookings are confirmed once paid. Defaults to false.
+ *               appointmentBuffers:
+ *                 type: object
+ *                 description: >
+ *                   Minutes kept free around appointments of each mode, e.g.
+ *                   travel and cleanup for in-person visits. Two neighbouring
+ *                   appointments keep the larger buffer of their modes apart.
+ *                   null falls back to the platform default
+ *                   (APPOINTMENT_BUFFER_*_MINUTES); modes left out are unchanged.
+ *                 properties:
+ *                   in-person:
+ *                     type: integer
+ *                     nullable: true
+ *                     minimum: 0
+ *                     maximum: 120
+ *                   video:
+ *                     type: integer
+ *                     nullable: true
+ *                     minimum: 0
+ *                     maximum: 120
+ *                   phone:
+ *                     type: integer
+ *                     nullable: true
+ *                     minimum: 0
+ *                     maximum: 120
+ *               consultationLanguages:
+ *                 type: object
+ *                 description: >
+ *                   Languages offered per appointment mode, from the doctor's
+ *                   profile languages. A mode left empty offers all of them;
+ *                   modes left out are unchanged.
+ *                 properties:
+ *                   in-person:
+ *                     type: array
+ *                     items:
+ *                       type: string
+ *                   video:
+ *                     type: array
+ *                     items:
+ *                       type: string
+ *                   phone:
+ *                     type: array
+ *                     items:
+ *                       type: string
  *               availability:
  *                 type: array
  *                 items:
@@ -862,6 +1784,30 @@ router.get('/availability', DoctorHandler.getAvailability);
  *                           endTime:
  *                             type: string
  *                             description: Slot end time (HH:mm)
+ *                           languages:
+ *                             type: array
+ *                             items:
+ *                               type: string
+ *                             description: Languages offered in this block, e.g. a Dutch-only morning. Empty offers all of the doctor's languages.
+ *                           breaks:
+ *                             type: array
+ *                             description: >
+ *                               Times within the block that aren't bookable, e.g. a
+ *                               lunch break. Breaks must fall within the block and not
+ *                               overlap; slots restart when a break ends.
+ *                             items:
+ *                               type: object
+ *                               required:
+ *                                 - startTime
+ *                                 - endTime
+ *                               properties:
+ *                                 startTime:
+ *                                   type: string
+ *                                 endTime:
+ *                                   type: string
+ *               confirmConflicts:
+ *                 type: boolean
+ *                 description: Save even though booked appointments fall outside the new schedule
  *     responses:
  *       200:
  *         description: Availability updated successfully
@@ -874,6 +1820,23 @@ router.get('/availability', DoctorHandler.getAvailability);
  *                   type: boolean
  *                 message:
  *                   type: string
+ *                 firstSlotOffset:
+ *                   type: integer
+ *                 lastSlotCutoff:
+ *                   type: integer
+ *                 maxAdvanceBookingDays:
+ *                   type: integer
+ *                   nullable: true
+ *                 maxAppointmentsPerDay:
+ *                   type: integer
+ *                   nullable: true
+ *                 autoAcceptBookings:
+ *                   type: boolean
+ *                 appointmentBuffers:
+ *                   type: object
+ *                   description: Buffer minutes in effect per mode, defaults included
+ *                 consultationLanguages:
+ *                   type: object
  *                 availability:
  *                   type: array
  *                   items:
@@ -890,17 +1853,98 @@ router.get('/availability', DoctorHandler.getAvailability);
  *                               type: string
  *                             endTime:
  *                               type: string
+ *                 conflicts:
+ *                   type: array
+ *                   description: Booked appointments the new schedule doesn't cover, whose patients were asked to reschedule
+ *                   items:
+ *                     $ref: '#/components/schemas/ScheduleConflict'
  *       400:
  *         description: Invalid request data
  *       401:
  *         description: Unauthorized
  *       403:
  *         description: Forbidden - User is not a doctor
+ *       409:
+ *         description: >
+ *           Booked appointments fall outside the new schedule and
+ *           confirmConflicts wasn't set (code SCHEDULE_CONFLICTS, with
+ *           conflicts). Nothing was saved. Switched off with
+ *           CONFIRM_SCHEDULE_CONFLICTS=false.
  *       500:
  *         description: Server error
  */
 router.put('/availability', AuthMiddleware.authenticate, AuthMiddleware.authorize(['doctor']), DoctorHandler.updateAvailability);
 
+/**
+ * @swagger
+ * /api/v1/doctors/me/availability/import:
+ *   post:
+ *     tags:
+ *       - Doctors
+ *     summary: Import the weekly schedule from a CSV
+ *     description: >
+ *       The CSV has one availability block per row as day,startTime,endTime
+ *       (e.g. monday,09:00,12:30), with an optional header row starting with
+ *       day. Each row is validated like PUT /doctors/availability and reported
+ *       as imported, duplicate (already in the schedule) or rejected with the
+ *       reason, e.g. an invalid day or time or an overlap with another block.
+ *       By default the valid rows are applied even when others are rejected;
+ *       with atomic=true nothing is applied if any row is rejected. Booked
+ *       appointments left outside the imported schedule are handled as in PUT
+ *       /doctors/availability.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         multipart/form-data:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - file
+ *             properties:
+ *               file:
+ *                 type: string
+ *                 format: binary
+ *                 description: CSV file, at most 256 KB and 500 rows
+ *               mode:
+ *                 type: string
+ *                 enum: [merge, replace]
+ *                 default: merge
+ *                 description: merge adds the rows to the current schedule; replace builds a new schedule from the rows only
+ *               atomic:
+ *                 type: boolean
+ *                 default: false
+ *               confirmConflicts:
+ *                 type: boolean
+ *                 default: false
+ *     responses:
+ *       200:
+ *         description: Schedule updated. summary counts the rows by outcome, results has one entry per row, conflicts lists booked appointments the schedule no longer covers.
+ *       400:
+ *         description: Missing or empty file, too many rows or invalid mode
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Doctor profile not found
+ *       413:
+ *         description: File too large
+ *       409:
+ *         description: Booked appointments fall outside the imported schedule and confirmConflicts wasn't set (code SCHEDULE_CONFLICTS). Nothing was applied.
+ *       415:
+ *         description: Not sent as multipart/form-data, or not a text file
+ *       422:
+ *         description: Nothing applied, because atomic was set and rows were rejected or a replace had no valid rows. The per-row results are included.
+ */
+router.post('/me/availability/import',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  singleUpload('availabilityImport', 'file'),
+  DoctorHandler.importAvailability
+);
+
 /**
  * @swagger
  * /api/v1/doctors/verify-registration:
@@ -1027,7 +2071,7 @@ router.post('/verify-registration', AuthMiddleware.authenticate, DoctorHandler.v
  *       500:
  *         description: Server error
  */
-router.post('/register', AuthMiddleware.authenticate, DoctorHandler.registerDoctor);
+router.post('/register', AuthMiddleware.authenticate, AuthMiddleware.requireRole('doctor'), DoctorHandler.registerDoctor);
 
 /**
  * @swagger
@@ -0,0 +1,184 @@
+const express = require('express');
+const { body, param } = require('express-validator');
+const AuthMiddleware = require('../middleware/auth.middleware');
+const DocumentHandler = require('../handlers/document.handler');
+const { singleUpload } = require('../middleware/upload.middleware');
+const { validate } = require('../middleware/validation.middleware');
+
+const router = express.Router();
+
+/**
+ * @swagger
+ * components:
+ *   schemas:
+ *     Document:
+ *       type: object
+ *       properties:
+ *         id:
+ *           type: string
+ *         appointmentId:
+ *           type: string
+ *         fileName:
+ *           type: string
+ *         contentType:
+ *           type: string
+ *         size:
+ *           type: number
+ *         scanStatus:
+ *           type: string
+ *           enum: [pending, clean, infected]
+ *           description: >
+ *             Malware scan result. With UPLOAD_SCAN_ENABLED documents start out
+ *             pending and can only be downloaded once clean.
+ *         createdAt:
+ *           type: string
+ *           format: date-time
+ */
+
+/**
+ * @swagger
+ * tags:
+ *   name: Documents
+ *   description: Medical documents attached to appointments
+ */
+
+/**
+ * @swagger
+ * /api/v1/documents:
+ *   post:
+ *     summary: Upload a document to an appointment
+ *     tags: [Documents]
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         multipart/form-data:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - appointmentId
+ *               - file
+ *             properties:
+ *               appointmentId:
+ *                 type: string
+ *               file:
+ *                 type: string
+ *                 format: binary
+ *     responses:
+ *       201:
+ *         description: Document uploaded
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/Document'
+ *       400:
+ *         description: Invalid input or no file uploaded
+ *       403:
+ *         description: Not a participant of the appointment
+ *       404:
+ *         description: Appointment not found
+ *       413:
+ *         description: File too large
+ *       415:
+ *         description: File type not allowed
+ */
+router.post('/',
+  AuthMiddleware.authenticate,
+  singleUpload('document', 'file'),
+  [
+    body('appointmentId').isMongoId().withMessage('Valid appointment ID is required')
+  ],
+  DocumentHandler.uploadDocument
+);
+
+/**
+ * @swagger
+ * /api/v1/documents/appointment/{appointmentId}:
+ *   get:
+ *     summary: List the documents of an appointment
+ *     tags: [Documents]
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: appointmentId
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Documents of the appointment
+ *       403:
+ *         description: Not a participant of the appointment
+ *       404:
+ *         description: Appointment not found
+ */
+router.get('/appointment/:appointmentId',
+  AuthMiddleware.authenticate,
+  validate([param('appointmentId').isMongoId().withMessage('Invalid appointment ID')]),
+  DocumentHandler.getAppointmentDocuments
+);
+
+/**
+ * @swagger
+ * /api/v1/documents/{id}:
+ *   get:
+ *     summary: Download a document
+ *     description: >
+ *       Checks that the caller is a participant of the appointment or an admin,
+ *       records the access, then redirects to a short-lived presigned URL.
+ *       Documents the malware scan hasn't found clean are not served.
+ *     tags: [Documents]
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       302:
+ *         description: Redirect to a presigned download URL
+ *       403:
+ *         description: Not allowed to access this document
+ *       404:
+ *         description: Document not found
+ *       409:
+ *         description: Still being scanned for malware (SCAN_PENDING) or found infected (FILE_INFECTED)
+ */
+router.get('/:id',
+  AuthMiddleware.authenticate,
+  validate([param('id').isMongoId().withMessage('Invalid document ID')]),
+  DocumentHandler.downloadDocument
+);
+
+/**
+ * @swagger
+ * /api/v1/documents/{id}/access-log:
+ *   get:
+ *     summary: Get the access history of a document (admin only)
+ *     tags: [Documents]
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *     responses:
+ *       200:
+ *         description: Access log entries, newest first
+ *       403:
+ *         description: Forbidden
+ */
+router.get('/:id/access-log',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('admin'),
+  validate([param('id').isMongoId().withMessage('Invalid document ID')]),
+  DocumentHandler.getDocumentAccessLog
+);
+
+module.exports = router;
@@ -32,6 +32,21 @@ const router = express.Router();
  *         read:
  *           type: boolean
  *           description: Whether the notification has been read
+ *         delivery:
+ *           type: object
+ *           description: Delivery of an email or SMS notification, updated from SES/SNS feedback
+ *           properties:
+ *             messageId:
+ *               type: string
+ *             status:
+ *               type: string
+ *               enum: [sent, delivered, bounced, complained, failed, suppressed]
+ *             detail:
+ *               type: string
+ *               description: Provider detail, e.g. the bounce type
+ *             updatedAt:
+ *               type: string
+ *               format: date-time
  *         createdAt:
  *           type: string
  *           format: date-time
@@ -83,6 +98,13 @@ const router = express.Router();
  *           type: integer
  *           default: 10
  *         description: Number of items per page
+ *       - in: query
+ *         name: cursor
+ *         schema:
+ *           type: string
+ *         description: >
+ *           nextCursor from the previous page. Pages after a cursor stay
+ *           consistent while items are added; page is ignored.
  *     responses:
  *       200:
  *         description: Notifications retrieved successfully
@@ -99,8 +121,14 @@ const router = express.Router();
  *                   type: integer
  *                 page:
  *                   type: integer
+ *                   description: Only when paging by offset
  *                 pages:
  *                   type: integer
+ *                   description: Only when paging by offset
+ *                 nextCursor:
+ *                   type: string
+ *                   nullable: true
+ *                   description: Cursor of the next page, or null on the last page
  *       401:
  *         description: Unauthorized
  *       500:
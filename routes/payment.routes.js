@@ -34,6 +34,9 @@ const router = express.Router();
  *         currency:
  *           type: string
  *           description: Payment currency
+ *         formattedAmount:
+ *           type: string
+ *           description: The amount formatted for display in DEFAULT_LOCALE, e.g. "€ 45,00"
  *         status:
  *           type: string
  *           enum: [pending, completed, failed, refunded]
@@ -44,6 +47,22 @@ const router = express.Router();
  *         transactionId:
  *           type: string
  *           description: External transaction ID
+ *         refundedAmount:
+ *           type: number
+ *           description: Total amount refunded so far
+ *         commissionPercent:
+ *           type: number
+ *           description: Platform commission applied (doctor and admin only)
+ *         platformFee:
+ *           type: number
+ *           description: Platform's share of the payment (doctor and admin only)
+ *         doctorNet:
+ *           type: number
+ *           description: Doctor's share of the payment (doctor and admin only)
+ *         insurance:
+ *           type: object
+ *           nullable: true
+ *           description: The patient's insurer and policy number for the invoice (patient and admin only)
  *         createdAt:
  *           type: string
  *           format: date-time
@@ -310,34 +329,41 @@ router.get('/:id',
  *             type: object
  *             required:
  *               - appointmentId
- *               - amount
- *               - currency
+ *               - paymentMethod
  *             properties:
  *               appointmentId:
  *                 type: string
  *                 description: ID of the appointment
- *               amount:
- *                 type: number
- *                 description: Payment amount
- *               currency:
- *                 type: string
- *                 description: Payment currency
  *               paymentMethod:
  *                 type: string
+ *                 enum: [iDEAL, card, paypal]
  *                 description: Payment method to use
  *     responses:
  *       201:
- *         description: Payment initiated successfully
+ *         description: Payment initiated and the slot held until holdExpiresAt
  *         content:
  *           application/json:
  *             schema:
- *               $ref: '#/components/schemas/Payment'
+ *               allOf:
+ *                 - $ref: '#/components/schemas/Payment'
+ *                 - type: object
+ *                   properties:
+ *                     holdExpiresAt:
+ *                       type: string
+ *                       format: date-time
+ *                       description: The slot is released if payment hasn't completed by then
  *       400:
- *         description: Invalid request data
+ *         description: Invalid request data. The errors field maps each invalid field to a message, e.g. {"paymentMethod":"Invalid payment method"}
  *       401:
  *         description: Unauthorized
+ *       403:
+ *         description: Not the patient on this appointment, or email (or phone) not verified (code VERIFICATION_REQUIRED, with a resendUrl)
  *       404:
  *         description: Appointment not found
+ *       409:
+ *         description: >
+ *           Appointment already paid, cancelled or completed, payment in
+ *           progress, or slot held by another patient
  *       500:
  *         description: Server error
  */
@@ -345,7 +371,7 @@ router.post('/initiate',
   AuthMiddleware.authenticate,
   [
     body('appointmentId').isMongoId().withMessage('Invalid appointment ID'),
-    body('paymentMethod').isIn(['card', 'bank_transfer']).withMessage('Invalid payment method')
+    body('paymentMethod').isIn(['iDEAL', 'card', 'paypal']).withMessage('Invalid payment method')
   ],
   async (req, res, next) => {
     try {
@@ -436,6 +462,9 @@ router.get('/:id',
  *               reason:
  *                 type: string
  *                 description: Reason for the refund
+ *               amount:
+ *                 type: number
+ *                 description: Partial refund amount; defaults to the full remaining amount. The platform fee is reversed proportionally. If the payment was already paid out, the doctor's share of the refund is deducted from their next payout.
  *     responses:
  *       200:
  *         description: Refund processed successfully
@@ -460,7 +489,8 @@ router.post('/:id/refund',
   AuthMiddleware.authenticate,
   AuthMiddleware.authorize(['admin']),
   [
-    body('reason').isString().withMessage('Refund reason is required')
+    body('reason').isString().withMessage('Refund reason is required'),
+    body('amount').optional().isFloat({ gt: 0 }).withMessage('Refund amount must be positive')
   ],
   async (req, res, next) => {
     try {
@@ -483,7 +513,7 @@ router.post('/:id/refund',
  *     tags:
  *       - Payments
  *     summary: Handle payment webhook
- *     description: Process webhook notifications from payment provider
+ *     description: Process webhook notifications from payment provider. Must carry the shared secret in the x-webhook-secret header.
  *     requestBody:
  *       required: true
  *       content:
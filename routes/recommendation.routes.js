@@ -2,6 +2,9 @@ const express = require('express');
 const { body, validationResult } = require('express-validator');
 const Doctor = require('../models/doctor.model');
 const User = require('../models/user.model');
+const AvailabilityService = require('../services/availability.service');
+const UrgentService = require('../services/urgent.service');
+const { createBookingToken, getSpecialtiesForSymptom } = require('../services/recommendation.service');
 
 const router = express.Router();
 
@@ -26,38 +29,11 @@ router.post('/help-me-choose', [
       insuranceProvider = null
     } = req.body;
 
-    // Map symptoms to specialties based on a basic rule set
-    // In a real system, this would be much more sophisticated
-    const specialtyMap = {
-      'headache': ['General Practitioner', 'Neurologist'],
-      'migraine': ['Neurologist'],
-      'back pain': ['Orthopedist', 'Rheumatologist'],
-      'chest pain': ['Cardiologist', 'Pulmonologist'],
-      'abdominal pain': ['Gastroenterologist', 'General Practitioner'],
-      'cough': ['Pulmonologist', 'General Practitioner'],
-      'fever': ['General Practitioner', 'Infectious Disease'],
-      'rash': ['Dermatologist'],
-      'joint pain': ['Rheumatologist', 'Orthopedist'],
-      'fatigue': ['General Practitioner', 'Endocrinologist'],
-      'depression': ['Psychiatrist', 'Psychologist'],
-      'anxiety': ['Psychiatrist', 'Psychologist'],
-      'shortness of breath': ['Pulmonologist', 'Cardiologist'],
-      'dizziness': ['Neurologist', 'ENT Specialist'],
-      'vision problems': ['Ophthalmologist'],
-      'hearing problems': ['ENT Specialist'],
-      'skin issues': ['Dermatologist'],
-      'digestive problems': ['Gastroenterologist'],
-      'urinary problems': ['Urologist', 'Nephrologist'],
-      'sleep problems': ['Neurologist', 'Psychiatrist'],
-      'weight changes': ['Endocrinologist', 'General Practitioner'],
-      'allergies': ['Allergist', 'Immunologist']
-    };
-    
     // Determine relevant specialties based on symptoms
     const relevantSpecialties = new Set();
     
     symptoms.forEach(symptom => {
-      const matchedSpecialties = specialtyMap[symptom.toLowerCase()] || ['General Practitioner'];
+      const matchedSpecialties = getSpecialtiesForSymptom(symptom);
       matchedSpecialties.forEach(s => relevantSpecialties.add(s));
     });
     
@@ -66,8 +42,7 @@ router.post('/help-me-choose', [
     
     // Build the base query for doctors
     let query = {
-      specialties: { $in: specialtiesArray },
-      verified: true,
+      specializations: { $in: specialtiesArray },
       verificationStatus: 'verified'
     };
     
@@ -118,7 +93,7 @@ router.post('/help-me-choose', [
         
         // Score based on specialty match
         specialtiesArray.forEach(specialty => {
-          if (doctor.specialties.includes(specialty)) {
+          if (doctor.specializations.includes(specialty)) {
             score += 10;
           }
         });
@@ -148,6 +123,17 @@ router.post('/help-me-choose', [
       .filter(Boolean) // Remove null entries
       .sort((a, b) => b.recommendationScore - a.recommendationScore) // Sort by score
       .slice(0, 10); // Return top matches
+
+    // Offer each doctor's next free slot with a token to book it in one call
+    const nextSlots = await AvailabilityService.getNextFreeSlotForDoctors(doctors);
+    doctors = doctors.map(doctor => {
+      const slot = nextSlots.get(doctor._id.toString());
+      return {
+        ...doctor,
+        nextAvailable: slot && { date: slot.date, startTime: slot.startTime, endTime: slot.endTime },
+        bookingToken: slot ? createBookingToken(doctor._id, slot, symptoms) : null
+      };
+    });
     
     // Return the recommended doctors along with the identified specialties
     res.json({
@@ -155,7 +141,7 @@ router.post('/help-me-choose', [
       relevantSpecialties: Array.from(relevantSpecialties),
       symptomSpecialtyMap: symptoms.map(symptom => ({
         symptom,
-        specialties: specialtyMap[symptom.toLowerCase()] || ['General Practitioner']
+        specialties: getSpecialtiesForSymptom(symptom)
       }))
     });
   } catch (error) {
@@ -164,6 +150,38 @@ router.post('/help-me-choose', [
   }
 });
 
+// Same-day care: the soonest free slots across all matching doctors instead
+// of the best doctor. Each option carries a booking token for
+// POST /appointments/from-recommendation. Red-flag symptoms get no slots.
+router.post('/urgent', [
+  body('symptoms').isArray({ min: 1 }).withMessage('At least one symptom is required'),
+  body('symptoms.*').isString().trim().notEmpty().withMessage('Symptoms must be non-empty strings')
+], async (req, res) => {
+  const errors = validationResult(req);
+  if (!errors.isEmpty()) {
+    return res.status(400).json({ errors: errors.array() });
+  }
+
+  try {
+    const result = await UrgentService.findUrgentOptions(req.body.symptoms);
+    if (result.emergency) {
+      return res.json({
+        ...result,
+        message: `These symptoms may need emergency care. Call ${result.emergencyNumber} or go to the nearest emergency department now.`
+      });
+    }
+    res.json({
+      ...result,
+      message: result.options.length === 0
+        ? 'No doctor has a free slot soon enough. If your symptoms get worse, contact your GP or emergency services.'
+        : undefined
+    });
+  } catch (error) {
+    console.error('Urgent recommendation error:', error);
+    res.status(500).json({ message: 'Server error finding urgent appointments' });
+  }
+});
+
 router.get('/common-symptoms', async (req, res) => {
   try {
     // This would ideally come from a database, but for simplicity we're hard-coding
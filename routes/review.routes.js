@@ -34,6 +34,20 @@ const router = express.Router();
  *         comment:
  *           type: string
  *           description: Review comment
+ *         isVerified:
+ *           type: boolean
+ *           description: >
+ *             Whether the reviewed appointment was completed and paid. Only
+ *             verified reviews count towards the doctor's rating.
+ *         reply:
+ *           type: object
+ *           description: The doctor's public reply, if any
+ *           properties:
+ *             text:
+ *               type: string
+ *             createdAt:
+ *               type: string
+ *               format: date-time
  *         createdAt:
  *           type: string
  *           format: date-time
@@ -190,6 +204,56 @@ router.delete('/:id',
   ReviewHandler.deleteReview
 );
 
+/**
+ * @swagger
+ * /api/v1/reviews/{id}/reply:
+ *   post:
+ *     summary: Reply to a review
+ *     description: The reviewed doctor can post one public reply. The patient's review itself can't be changed by the doctor.
+ *     tags: [Reviews]
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: id
+ *         required: true
+ *         schema:
+ *           type: string
+ *         description: Review ID
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - text
+ *             properties:
+ *               text:
+ *                 type: string
+ *                 maxLength: 1000
+ *     responses:
+ *       201:
+ *         description: Reply posted
+ *       403:
+ *         description: Not a doctor
+ *       404:
+ *         description: Review not found or not about this doctor
+ *       409:
+ *         description: A reply already exists
+ *       500:
+ *         description: Server error
+ */
+router.post('/:id/reply',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  validate([
+    param('id').isMongoId().withMessage('Invalid review ID'),
+    body('text').isString().trim().isLength({ min: 1, max: 1000 }).withMessage('Reply must be between 1 and 1000 characters')
+  ]),
+  ReviewHandler.replyToReview
+);
+
 /**
  * @swagger
  * /api/v1/reviews/doctor/{doctorId}:
@@ -0,0 +1,101 @@
+const express = require('express');
+const { query, validationResult } = require('express-validator');
+const SearchService = require('../services/search.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+const router = express.Router();
+
+const searchConfig = config.search.unified;
+
+/**
+ * @swagger
+ * tags:
+ *   name: Search
+ *   description: Universal search across doctors, specialties and symptoms
+ */
+
+/**
+ * @swagger
+ * /api/v1/search:
+ *   get:
+ *     tags:
+ *       - Search
+ *     summary: Search doctors, specialties and symptoms at once
+ *     description: >
+ *       Backend of the universal search box, for patients who don't know
+ *       whether they are typing a name, a specialty or a symptom. Results come
+ *       in one section per type, each ranked (exact, then prefix, then
+ *       contains matches) and limited on its own. Doctors matching by name
+ *       rank above doctors matching by specialization. Symptoms include the
+ *       specialties they map to.
+ *     parameters:
+ *       - in: query
+ *         name: q
+ *         required: true
+ *         schema:
+ *           type: string
+ *           minLength: 2
+ *       - in: query
+ *         name: limit
+ *         schema:
+ *           type: integer
+ *           minimum: 1
+ *           maximum: 20
+ *           default: 5
+ *         description: Maximum results per section
+ *     responses:
+ *       200:
+ *         description: Search results
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 query:
+ *                   type: string
+ *                 sections:
+ *                   type: array
+ *                   items:
+ *                     type: object
+ *                     properties:
+ *                       type:
+ *                         type: string
+ *                         enum: [doctors, specialties, symptoms]
+ *                       results:
+ *                         type: array
+ *                         items:
+ *                           type: object
+ *       400:
+ *         description: Missing or too short query
+ *       500:
+ *         description: Server error
+ */
+router.get('/', [
+  query('q')
+    .isString()
+    .trim()
+    .isLength({ min: searchConfig.minQueryLength })
+    .withMessage(`Search query must be at least ${searchConfig.minQueryLength} characters`),
+  query('limit')
+    .optional()
+    .isInt({ min: 1, max: searchConfig.maxSectionLimit })
+    .withMessage(`Limit must be between 1 and ${searchConfig.maxSectionLimit}`)
+], async (req, res) => {
+  const errors = validationResult(req);
+  if (!errors.isEmpty()) {
+    return res.status(400).json({ errors: errors.array() });
+  }
+
+  try {
+    const sections = await SearchService.search(req.query.q, {
+      limit: req.query.limit ? parseInt(req.query.limit) : undefined
+    });
+    res.json({ query: req.query.q, sections });
+  } catch (error) {
+    logger.error('Search error:', error);
+    res.status(500).json({ message: 'Server error while searching' });
+  }
+});
+
+module.exports = router;
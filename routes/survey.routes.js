@@ -0,0 +1,164 @@
+const express = require('express');
+const { body, query } = require('express-validator');
+const AuthMiddleware = require('../middleware/auth.middleware');
+const SurveyHandler = require('../handlers/survey.handler');
+
+const router = express.Router();
+
+/**
+ * @swagger
+ * tags:
+ *   name: Surveys
+ *   description: >
+ *     Private post-consultation surveys. Answers are never shown to other
+ *     patients; they only feed doctor quality metrics for the doctor and admins.
+ */
+
+/**
+ * @swagger
+ * /api/v1/surveys:
+ *   post:
+ *     tags:
+ *       - Surveys
+ *     summary: Submit the survey for a completed appointment
+ *     description: Only the appointment's patient can submit, once per appointment.
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             required:
+ *               - appointmentId
+ *               - waitTime
+ *               - communication
+ *               - wouldRecommend
+ *             properties:
+ *               appointmentId:
+ *                 type: string
+ *               waitTime:
+ *                 type: integer
+ *                 minimum: 1
+ *                 maximum: 5
+ *                 description: Satisfaction with the wait before being seen
+ *               communication:
+ *                 type: integer
+ *                 minimum: 1
+ *                 maximum: 5
+ *               wouldRecommend:
+ *                 type: boolean
+ *               comment:
+ *                 type: string
+ *                 maxLength: 1000
+ *     responses:
+ *       201:
+ *         description: Survey submitted
+ *       400:
+ *         description: Invalid request data
+ *       401:
+ *         description: Unauthorized
+ *       404:
+ *         description: No completed appointment with this ID for the patient
+ *       409:
+ *         description: A survey was already submitted for the appointment
+ */
+router.post('/',
+  AuthMiddleware.authenticate,
+  [
+    body('appointmentId').isMongoId().withMessage('Invalid appointment ID'),
+    body('waitTime').isInt({ min: 1, max: 5 }).withMessage('Wait time rating must be between 1 and 5'),
+    body('communication').isInt({ min: 1, max: 5 }).withMessage('Communication rating must be between 1 and 5'),
+    body('wouldRecommend').isBoolean().withMessage('Would recommend must be true or false'),
+    body('comment').optional().isString().isLength({ max: 1000 }).withMessage('Comment must be at most 1000 characters')
+  ],
+  SurveyHandler.submitSurvey
+);
+
+/**
+ * @swagger
+ * /api/v1/surveys/metrics/me:
+ *   get:
+ *     tags:
+ *       - Surveys
+ *     summary: The authenticated doctor's survey metrics
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: from
+ *         schema:
+ *           type: string
+ *           format: date
+ *       - in: query
+ *         name: to
+ *         schema:
+ *           type: string
+ *           format: date
+ *     responses:
+ *       200:
+ *         description: >
+ *           responses, averageWaitTime, averageCommunication and
+ *           wouldRecommendPercent
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a doctor
+ */
+router.get('/metrics/me',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('doctor'),
+  [
+    query('from').optional().isDate().withMessage('Invalid from date'),
+    query('to').optional().isDate().withMessage('Invalid to date')
+  ],
+  SurveyHandler.getMyMetrics
+);
+
+/**
+ * @swagger
+ * /api/v1/surveys/metrics:
+ *   get:
+ *     tags:
+ *       - Surveys
+ *     summary: Survey metrics per doctor (admin only)
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: doctorId
+ *         schema:
+ *           type: string
+ *       - in: query
+ *         name: from
+ *         schema:
+ *           type: string
+ *           format: date
+ *       - in: query
+ *         name: to
+ *         schema:
+ *           type: string
+ *           format: date
+ *     responses:
+ *       200:
+ *         description: Metrics for each doctor with responses, most responses first
+ *       400:
+ *         description: Invalid request data
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not an admin
+ */
+router.get('/metrics',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.requireRole('admin'),
+  [
+    query('doctorId').optional().isMongoId().withMessage('Invalid doctor ID'),
+    query('from').optional().isDate().withMessage('Invalid from date'),
+    query('to').optional().isDate().withMessage('Invalid to date')
+  ],
+  SurveyHandler.getMetrics
+);
+
+module.exports = router;
@@ -1,11 +1,11 @@
 const express = require('express');
-const { body, validationResult } = require('express-validator');
+const { body, query, validationResult } = require('express-validator');
 const mongoose = require('mongoose');
-const multer = require('multer');
 const User = require('../models/user.model');
 const AuthMiddleware = require('../middleware/auth.middleware');
 const UserHandler = require('../handlers/user.handler');
-const AWSService = require('../services/aws.service');
+const { singleUpload } = require('../middleware/upload.middleware');
+const config = require('../config/config');
 
 const router = express.Router();
 
@@ -21,7 +21,18 @@ const router = express.Router();
  *         lastName:
  *           type: string
  *         phone:
- *           type: string
+ *           description: >
+ *             A number string, or { countryCode, number }. Numbers without a
+ *             country code get the default region (+31). Returned normalized;
+ *             changing it resets phone verification.
+ *           oneOf:
+ *             - type: string
+ *             - type: object
+ *               properties:
+ *                 countryCode:
+ *                   type: string
+ *                 number:
+ *                   type: string
  *         dob:
  *           type: string
  *           format: date
@@ -32,15 +43,50 @@ const router = express.Router();
  *           type: array
  *           items:
  *             type: string
+ *         notificationPreferences:
+ *           type: object
+ *           properties:
+ *             reviewEmails:
+ *               type: boolean
+ *               description: Doctors get an email for each new review (in-app notifications are always sent)
+ *         insurance:
+ *           type: object
+ *           nullable: true
+ *           description: >
+ *             Health insurance for claiming consultations. Only returned to
+ *             the user and admins (on payments), never to doctors. Send null
+ *             to remove it.
+ *           properties:
+ *             insurer:
+ *               type: string
+ *               example: Zilveren Kruis
+ *               description: One of the insurers in INSURERS, matched case-insensitively
+ *             policyNumber:
+ *               type: string
+ *               description: 5 to 30 letters, digits or dashes
+ *             updatedAt:
+ *               type: string
+ *               format: date-time
+ *               readOnly: true
+ *         smsConsent:
+ *           description: >
+ *             Send true to consent to notification SMS, false to withdraw.
+ *             Profiles return { granted, grantedAt, withdrawnAt }. Without
+ *             consent, SMS notifications are delivered in-app instead.
+ *           oneOf:
+ *             - type: boolean
+ *             - type: object
+ *               properties:
+ *                 granted:
+ *                   type: boolean
+ *                 grantedAt:
+ *                   type: string
+ *                   format: date-time
+ *                 withdrawnAt:
+ *                   type: string
+ *                   format: date-time
  */
 
-// Configure multer for memory storage (we'll upload directly to S3)
-const storage = multer.memoryStorage();
-const upload = multer({
-  storage,
-  limits: { fileSize: 5 * 1024 * 1024 } // 5MB limit
-});
-
 /**
  * @swagger
  * tags:
@@ -102,7 +148,7 @@ router.get('/profile',
  *                 user:
  *                   $ref: '#/components/schemas/User'
  *       400:
- *         description: Invalid input
+ *         description: Invalid input, including an unknown insurer or malformed policy number
  *       401:
  *         description: Unauthorized
  *       404:
@@ -115,9 +161,14 @@ router.put('/profile',
   [
     body('firstName').optional().isString().withMessage('First name must be a string'),
     body('lastName').optional().isString().withMessage('Last name must be a string'),
-    body('phone').optional().isString().withMessage('Phone must be a string'),
+    body('phone').optional()
+      .custom(value => typeof value === 'string' || (value !== null && typeof value === 'object'))
+      .withMessage('Phone must be a number string or an object with countryCode and number'),
     body('address').optional().isObject().withMessage('Address must be an object'),
-    body('languages').optional().isArray().withMessage('Languages must be an array')
+    body('languages').optional().isArray().withMessage('Languages must be an array'),
+    body('notificationPreferences.reviewEmails').optional().isBoolean().withMessage('reviewEmails must be a boolean'),
+    body('smsConsent').optional().isBoolean().withMessage('smsConsent must be a boolean'),
+    body('insurance').optional({ values: 'null' }).isObject().withMessage('Insurance must be an object with insurer and policyNumber')
   ],
   UserHandler.updateProfile
 );
@@ -149,13 +200,226 @@ router.put('/profile',
  *         description: Unauthorized
  *       404:
  *         description: User not found
+ *       422:
+ *         description: Rejected by the malware scan (FILE_INFECTED)
+ *       503:
+ *         description: The malware scanner is unavailable (SCAN_UNAVAILABLE)
  *       500:
  *         description: Server error
  */
 router.post('/profile/picture',
   AuthMiddleware.authenticate,
-  upload.single('picture'),
+  singleUpload('profileImage', 'picture'),
   UserHandler.updateProfilePicture
 );
 
+/**
+ * @swagger
+ * components:
+ *   schemas:
+ *     ReminderSettings:
+ *       type: object
+ *       properties:
+ *         channels:
+ *           type: array
+ *           items:
+ *             type: string
+ *             enum: [email, sms, push, in-app]
+ *         leadTimesMinutes:
+ *           type: array
+ *           description: Minutes before the appointment to send a reminder, latest first
+ *           items:
+ *             type: integer
+ *             enum: [15, 60, 120, 1440, 2880]
+ *         isDefault:
+ *           type: boolean
+ *           description: True until the user saves their own settings
+ *         options:
+ *           type: object
+ *           description: The channels and lead times that can be chosen
+ *           properties:
+ *             channels:
+ *               type: array
+ *               items:
+ *                 type: string
+ *             leadTimesMinutes:
+ *               type: array
+ *               items:
+ *                 type: integer
+ *             maxLeadTimes:
+ *               type: integer
+ */
+
+/**
+ * @swagger
+ * /api/v1/users/me/reminder-settings:
+ *   get:
+ *     summary: Get appointment reminder settings
+ *     description: >
+ *       Until the user saves their own, patients get email and SMS reminders a
+ *       day ahead and doctors get an email a day ahead.
+ *     tags: [Users]
+ *     security:
+ *       - bearerAuth: []
+ *     responses:
+ *       200:
+ *         description: Current reminder settings
+ *         content:
+ *           application/json:
+ *             schema:
+ *               $ref: '#/components/schemas/ReminderSettings'
+ *       401:
+ *         description: Unauthorized
+ *       404:
+ *         description: User not found
+ *       500:
+ *         description: Server error
+ *   put:
+ *     summary: Update appointment reminder settings
+ *     description: >
+ *       Sets the channels reminders go out on and how long before the
+ *       appointment. A field left out keeps its current value; an empty
+ *       channel list turns reminders off. SMS needs SMS consent and a phone
+ *       number on the profile.
+ *     tags: [Users]
+ *     security:
+ *       - bearerAuth: []
+ *     requestBody:
+ *       required: true
+ *       content:
+ *         application/json:
+ *           schema:
+ *             type: object
+ *             properties:
+ *               channels:
+ *                 type: array
+ *                 items:
+ *                   type: string
+ *                   enum: [email, sms, push, in-app]
+ *               leadTimesMinutes:
+ *                 type: array
+ *                 maxItems: 3
+ *                 items:
+ *                   type: integer
+ *                   enum: [15, 60, 120, 1440, 2880]
+ *     responses:
+ *       200:
+ *         description: Reminder settings updated
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 message:
+ *                   type: string
+ *                 settings:
+ *                   $ref: '#/components/schemas/ReminderSettings'
+ *       400:
+ *         description: Invalid channels or lead times, or SMS chosen without consent or a phone number
+ *       401:
+ *         description: Unauthorized
+ *       404:
+ *         description: User not found
+ *       500:
+ *         description: Server error
+ */
+router.get('/me/reminder-settings',
+  AuthMiddleware.authenticate,
+  UserHandler.getReminderSettings
+);
+
+router.put('/me/reminder-settings',
+  AuthMiddleware.authenticate,
+  [
+    body('channels').optional().isArray().withMessage('channels must be an array'),
+    body('channels.*').isIn(config.reminders.channels)
+      .withMessage(`Channels must be among: ${config.reminders.channels.join(', ')}`),
+    body('leadTimesMinutes').optional().isArray().withMessage('leadTimesMinutes must be an array'),
+    body('leadTimesMinutes.*').isInt().withMessage('Lead times must be whole minutes')
+  ],
+  UserHandler.updateReminderSettings
+);
+
+/**
+ * @swagger
+ * /api/v1/users/me/claims:
+ *   get:
+ *     summary: Export insurance claims
+ *     description: >
+ *       The patient's completed, paid appointments in a period, one row per
+ *       appointment with what insurers ask for: treatment date, patient,
+ *       insurer and policy number, the doctor's name and registration number,
+ *       and the amount paid less any refund. Appointments booked for a
+ *       dependent carry the dependent's name and date of birth. Defaults to
+ *       the current calendar year; a period covers at most
+ *       CLAIMS_EXPORT_MAX_DAYS days.
+ *     tags: [Users]
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: query
+ *         name: from
+ *         schema:
+ *           type: string
+ *           format: date
+ *         description: Start of the period, by appointment date
+ *       - in: query
+ *         name: to
+ *         schema:
+ *           type: string
+ *           format: date
+ *       - in: query
+ *         name: format
+ *         schema:
+ *           type: string
+ *           enum: [json, csv]
+ *           default: json
+ *     responses:
+ *       200:
+ *         description: The claims, as JSON or a CSV download
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 from:
+ *                   type: string
+ *                   format: date-time
+ *                 to:
+ *                   type: string
+ *                   format: date-time
+ *                 insurance:
+ *                   type: object
+ *                   nullable: true
+ *                 columns:
+ *                   type: array
+ *                   items:
+ *                     type: string
+ *                 claims:
+ *                   type: array
+ *                   items:
+ *                     type: object
+ *           text/csv:
+ *             schema:
+ *               type: string
+ *       400:
+ *         description: Invalid period or format
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a patient
+ *       500:
+ *         description: Server error
+ */
+router.get('/me/claims',
+  AuthMiddleware.authenticate,
+  AuthMiddleware.authorize(['patient']),
+  [
+    query('from').optional().isISO8601().withMessage('from must be a date'),
+    query('to').optional().isISO8601().withMessage('to must be a date'),
+    query('format').optional().isIn(['json', 'csv']).withMessage('Format must be json or csv')
+  ],
+  UserHandler.getClaims
+);
+
 module.exports = router;
@@ -13,6 +13,19 @@ const router = express.Router();
  * @swagger
  * components:
  *   schemas:
+ *     WaitingRoomParticipant:
+ *       type: object
+ *       properties:
+ *         joined:
+ *           type: boolean
+ *         joinedAt:
+ *           type: string
+ *           format: date-time
+ *           nullable: true
+ *         lastJoinedAt:
+ *           type: string
+ *           format: date-time
+ *           nullable: true
  *     VideoSession:
  *       type: object
  *       properties:
@@ -363,6 +376,112 @@ router.post('/end/:sessionId',
   VideoHandler.endSession
 );
 
+/**
+ * @swagger
+ * /api/v1/video/session/{sessionId}/reconnect:
+ *   post:
+ *     tags:
+ *       - Video
+ *     summary: Reconnect to a video session
+ *     description: >
+ *       Issues a fresh access token for the same room after a dropped call.
+ *       No new session is created. The session must still be active and the
+ *       appointment must not be over.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: sessionId
+ *         required: true
+ *         schema:
+ *           type: string
+ *         description: Session ID
+ *     responses:
+ *       200:
+ *         description: New access token for the session's room
+ *       403:
+ *         description: Not a participant of this session
+ *       404:
+ *         description: Video session not found
+ *       409:
+ *         description: Session is not active or is outside the join window
+ */
+router.post('/session/:sessionId/reconnect',
+  AuthMiddleware.authenticate,
+  async (req, res, next) => {
+    try {
+      logger.info('Reconnecting to video session', {
+        userId: req.user.id,
+        sessionId: req.params.sessionId
+      });
+      await VideoHandler.reconnectSession(req, res);
+    } catch (error) {
+      next(error);
+    }
+  }
+);
+
+/**
+ * @swagger
+ * /api/v1/video/session/{sessionId}/status:
+ *   get:
+ *     tags:
+ *       - Video
+ *     summary: Waiting room status of a video session
+ *     description: >
+ *       Who of the doctor and patient has joined, and whether the call is
+ *       ready (both joined), waiting (waitingFor lists who hasn't joined yet)
+ *       or ended. When the second party joins, the one waiting gets an in-app
+ *       and push notification.
+ *     security:
+ *       - bearerAuth: []
+ *     parameters:
+ *       - in: path
+ *         name: sessionId
+ *         required: true
+ *         schema:
+ *           type: string
+ *         description: Session ID
+ *     responses:
+ *       200:
+ *         description: Waiting room status
+ *         content:
+ *           application/json:
+ *             schema:
+ *               type: object
+ *               properties:
+ *                 sessionId:
+ *                   type: string
+ *                 status:
+ *                   type: string
+ *                   enum: [scheduled, active, ended, cancelled]
+ *                 state:
+ *                   type: string
+ *                   enum: [waiting, ready, ended]
+ *                 participants:
+ *                   type: object
+ *                   properties:
+ *                     doctor:
+ *                       $ref: '#/components/schemas/WaitingRoomParticipant'
+ *                     patient:
+ *                       $ref: '#/components/schemas/WaitingRoomParticipant'
+ *                 waitingFor:
+ *                   type: array
+ *                   items:
+ *                     type: string
+ *                     enum: [doctor, patient]
+ *       401:
+ *         description: Unauthorized
+ *       403:
+ *         description: Not a participant of this session
+ *       404:
+ *         description: Video session not found
+ */
+router.get('/session/:sessionId/status',
+  AuthMiddleware.authenticate,
+  VideoHandler.getSessionStatus
+);
+
 /**
  * @swagger
  * /api/v1/video/sessions/{sessionId}:
@@ -445,7 +564,7 @@ router.get('/sessions/:sessionId',
  *       401:
  *         description: Unauthorized
  *       403:
- *         description: Forbidden - Not authorized to join session
+ *         description: Not authorized to join session, or outside the join window (code VIDEO_JOIN_TOO_EARLY or VIDEO_JOIN_TOO_LATE). The window opens VIDEO_JOIN_EARLY_GRACE_MINUTES before the start and closes VIDEO_JOIN_LATE_GRACE_MINUTES after the end.
  *       404:
  *         description: Session not found
  *       409:
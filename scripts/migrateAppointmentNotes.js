@@ -0,0 +1,33 @@
+const mongoose = require('mongoose');
+const config = require('../config/config');
+
+// Appointment notes were split into patientVisibleNotes and privateNotes.
+// Existing notes were always shown to both parties, so they become
+// patient-visible. Safe to run more than once.
+async function migrateAppointmentNotes() {
+  try {
+    await mongoose.connect(config.mongoUri);
+    console.log('Connected to MongoDB');
+
+    const result = await mongoose.connection.collection('appointments').updateMany(
+      { notes: { $exists: true }, patientVisibleNotes: { $exists: false } },
+      { $rename: { notes: 'patientVisibleNotes' } }
+    );
+    console.log(`Moved notes to patientVisibleNotes on ${result.modifiedCount} appointments`);
+
+    // Appointments that already had both keep patientVisibleNotes
+    const leftover = await mongoose.connection.collection('appointments').updateMany(
+      { notes: { $exists: true } },
+      { $unset: { notes: '' } }
+    );
+    console.log(`Removed leftover notes from ${leftover.modifiedCount} appointments`);
+
+    await mongoose.connection.close();
+    console.log('MongoDB connection closed');
+  } catch (error) {
+    console.error('Error:', error);
+    process.exit(1);
+  }
+}
+
+migrateAppointmentNotes();
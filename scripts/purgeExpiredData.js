@@ -0,0 +1,27 @@
+const mongoose = require('mongoose');
+const config = require('../config/config');
+const RetentionService = require('../services/retention.service');
+
+// Apply the retention policies in config.retention once, outside the
+// scheduled job. Pass --dry-run to only report what would be purged.
+async function purgeExpiredData() {
+  const dryRun = process.argv.includes('--dry-run');
+  try {
+    await mongoose.connect(config.mongoUri);
+    console.log('Connected to MongoDB');
+
+    const results = await RetentionService.purgeExpiredData({ dryRun });
+    results.forEach(({ type, action, cutoff, count }) => {
+      const verb = dryRun ? `Would ${action}` : (action === 'archive' ? 'Archived' : 'Deleted');
+      console.log(`${verb} ${count} ${type} created before ${cutoff.toISOString()}`);
+    });
+
+    await mongoose.connection.close();
+    console.log('MongoDB connection closed');
+  } catch (error) {
+    console.error('Error:', error);
+    process.exit(1);
+  }
+}
+
+purgeExpiredData();
@@ -0,0 +1,1048 @@
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const Payment = require('../models/payment.model');
+const PaymentHoldLock = require('../models/payment.hold.lock.model');
+const VideoSession = require('../models/video.model');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+const { transitionStatus } = require('./appointment.status.service');
+const PaymentService = require('./payment.service');
+const PayoutService = require('./payout.service');
+const { getSetting } = require('./settings.service');
+const { timeToMinutes, getWeekday, getAppointmentStart } = require('../utils/helpers');
+const { formatCurrency } = require('../utils/currency');
+const { AppError } = require('../utils/error.handler');
+
+/**
+ * Whether a user is the patient or the doctor on an appointment
+ * @param {Object} appointment - The appointment
+ * @param {Object} user - The authenticated user
+ * @returns {Promise<boolean>}
+ */
+const isAppointmentParticipant = async (appointment, user) => {
+  if (appointment.patientId.toString() === user.id) {
+    return true;
+  }
+  if (user.role !== 'doctor') {
+    return false;
+  }
+  const doctor = await Doctor.findOne({ userId: user.id }).select('_id');
+  return !!doctor && appointment.doctorId.equals(doctor._id);
+};
+
+/**
+ * Time zone a doctor's schedule is in: their own, or the platform default
+ * @param {Object} doctor - The doctor
+ * @returns {string} - IANA time zone name
+ */
+const getScheduleTimeZone = (doctor) => {
+  return (doctor && doctor.timeZone) || config.appointments.scheduleTimeZone;
+};
+
+/**
+ * Whether an appointment currently has an unexpired payment hold
+ * @param {Object} appointment - The appointment
+ * @param {Date} now - Reference time
+ * @returns {boolean}
+ */
+const hasActiveHold = (appointment, now = new Date()) => {
+  return appointment.paymentStatus === 'held' &&
+    appointment.holdExpiresAt != null &&
+    appointment.holdExpiresAt > now;
+};
+
+/**
+ * When an unpaid booking is cancelled, with pay-before-confirm on
+ * @param {Object} appointment - The appointment
+ * @returns {Date}
+ */
+const getUnpaidDeadline = (appointment) => {
+  return new Date(new Date(appointment.createdAt).getTime() + config.payments.unpaidExpiryMinutes * 60 * 1000);
+};
+
+/**
+ * Whether an appointment still occupies its slot. Cancelled bookings and
+ * drafts never do.
+ * With pay-before-confirm on, unpaid bookings free their slot as soon as their
+ * hold or unpaid window lapses, without waiting for the expiry sweeper.
+ * @param {Object} appointment - The appointment
+ * @param {Date} now - Reference time
+ * @returns {boolean}
+ */
+const isBlockingAppointment = (appointment, now = new Date()) => {
+  if (appointment.status === 'cancelled' || appointment.status === 'draft') {
+    return false;
+  }
+  if (hasActiveHold(appointment, now)) {
+    return true;
+  }
+  if (!config.payments.payBeforeConfirm || appointment.status !== 'pending' || appointment.paymentStatus === 'paid') {
+    return true;
+  }
+  if (appointment.paymentStatus === 'held') {
+    return false;
+  }
+
+  return getUnpaidDeadline(appointment) > now;
+};
+
+/**
+ * Validate the disposition sent with a status change
+ * @param {string} status - The new status
+ * @param {string} disposition - The disposition, if any
+ * @returns {string|null} - Error message, or null when valid
+ */
+const getDispositionError = (status, disposition) => {
+  if (disposition === undefined || disposition === null) {
+    if (status === 'completed' && config.appointments.requireDisposition) {
+      return 'A disposition is required to complete an appointment';
+    }
+    return null;
+  }
+  if (status !== 'completed') {
+    return 'A disposition can only be set when completing an appointment';
+  }
+  if (!Appointment.DISPOSITIONS.includes(disposition)) {
+    return `Disposition must be one of: ${Appointment.DISPOSITIONS.join(', ')}`;
+  }
+  return null;
+};
+
+/**
+ * Validate the cancellation category sent with a status change
+ * @param {string} status - The new status
+ * @param {string} category - The category, if any
+ * @returns {string|null} - Error message, or null when valid
+ */
+const getCancellationCategoryError = (status, category) => {
+  if (category === undefined || category === null) {
+    return null;
+  }
+  if (status !== 'cancelled') {
+    return 'A cancellation category can only be set when cancelling an appointment';
+  }
+  if (!Appointment.CANCELLATION_CATEGORIES.includes(category)) {
+    return `Cancellation category must be one of: ${Appointment.CANCELLATION_CATEGORIES.join(', ')}`;
+  }
+  return null;
+};
+
+/**
+ * Check an appointment time against the doctor's clinic opening hours. Only
+ * in-person visits are restricted, and clinics without hours set allow any time.
+ * @param {Object} doctor - The doctor
+ * @param {Date|string} date - Appointment date
+ * @param {string} startTime - Start time "HH:MM"
+ * @param {string} endTime - End time "HH:MM"
+ * @param {string} type - Appointment mode
+ * @returns {boolean} - Whether the time is allowed
+ */
+const isWithinClinicHours = (doctor, date, startTime, endTime, type) => {
+  if (type !== 'in-person') {
+    return true;
+  }
+
+  const openingHours = (doctor.clinicLocation && doctor.clinicLocation.openingHours) || [];
+  if (openingHours.length === 0) {
+    return true;
+  }
+
+  const weekday = getWeekday(date);
+  const start = timeToMinutes(startTime);
+  const end = timeToMinutes(endTime);
+
+  return openingHours.some(hours =>
+    hours.day === weekday &&
+    start >= timeToMinutes(hours.openTime) &&
+    end <= timeToMinutes(hours.closeTime)
+  );
+};
+
+/**
+ * Last day a doctor can be booked on: today (UTC) plus the doctor's max
+ * advance booking window, or the platform default
+ * @param {Object} doctor - The doctor
+ * @param {Date} now - Reference time
+ * @returns {Date} - The last bookable day (UTC midnight)
+ */
+const getLastBookableDate = (doctor, now = new Date()) => {
+  const days = doctor.maxAdvanceBookingDays || config.appointments.maxAdvanceBookingDays;
+  const last = new Date(now);
+  last.setUTCHours(0, 0, 0, 0);
+  last.setUTCDate(last.getUTCDate() + days);
+  return last;
+};
+
+/**
+ * Why a date can't be booked yet, for dates past the doctor's booking window
+ * @param {Object} doctor - The doctor
+ * @param {Date|string} date - Appointment date
+ * @param {Date} now - Reference time
+ * @returns {Object|null} - { message, code, lastBookableDate }, or null when
+ * the date is within the window
+ */
+const getBookingWindowError = (doctor, date, now = new Date()) => {
+  const lastBookableDate = getLastBookableDate(doctor, now);
+  if (new Date(date) <= lastBookableDate) {
+    return null;
+  }
+  const days = doctor.maxAdvanceBookingDays || config.appointments.maxAdvanceBookingDays;
+  return {
+    message: `Appointments with this doctor can be booked at most ${days} days ahead`,
+    code: 'BEYOND_BOOKING_WINDOW',
+    lastBookableDate: lastBookableDate.toISOString().slice(0, 10)
+  };
+};
+
+/**
+ * Fee a late reschedule costs under config.appointments.rescheduleFee
+ * @param {number} consultationFee - The appointment's fee
+ * @returns {number} - 0 when no fee is configured
+ */
+const getLateRescheduleAmount = (consultationFee) => {
+  const policy = config.appointments.rescheduleFee;
+  const fee = policy.amount > 0 ? policy.amount : (consultationFee || 0) * policy.percent / 100;
+  return Math.round(fee * 100) / 100;
+};
+
+/**
+ * Fee for rescheduling an appointment now, under
+ * config.appointments.rescheduleFee. Only patients pay, and only within
+ * freeHoursBefore hours of the original start.
+ * @param {Object} appointment - The appointment, at its current time
+ * @param {Object} options - actor (from getActorRole), currency and now
+ * @returns {Object} - { amount, currency, formattedAmount, hoursBefore, freeHoursBefore, collect }
+ */
+const getRescheduleFee = (appointment, options = {}) => {
+  const policy = config.appointments.rescheduleFee;
+  const now = options.now || new Date();
+  const start = getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone);
+  const hoursBefore = Math.round((start.getTime() - now.getTime()) / (60 * 60 * 1000) * 10) / 10;
+  const applies = options.actor === 'patient' && hoursBefore < policy.freeHoursBefore;
+  const amount = applies ? getLateRescheduleAmount(appointment.fee) : 0;
+  const currency = options.currency || 'EUR';
+  return {
+    amount,
+    currency,
+    formattedAmount: formatCurrency(amount, currency),
+    hoursBefore,
+    freeHoursBefore: policy.freeHoursBefore,
+    collect: policy.collect
+  };
+};
+
+/**
+ * Record the outcome of a reschedule fee payment on its appointment
+ * @param {Object} payment - The reschedule-fee payment
+ * @param {string} status - 'paid' or 'failed'
+ */
+const settleRescheduleFee = async (payment, status) => {
+  await Appointment.updateOne(
+    { _id: payment.appointmentId, 'rescheduleFees.paymentId': payment._id },
+    { $set: { 'rescheduleFees.$.status': status } }
+  );
+};
+
+/**
+ * Check an in-person booking against the clinic's room capacity. A doctor is
+ * only ever in one appointment at a time whatever the mode; rooms limit how
+ * many in-person visits doctors sharing a clinic can hold in parallel.
+ * @param {Object} doctor - The doctor
+ * @param {Date|string} date - Appointment date
+ * @param {string} startTime - Start time "HH:MM"
+ * @param {string} endTime - End time "HH:MM"
+ * @param {string} type - Appointment mode
+ * @param {Object} options - excludeId of an appointment being rescheduled
+ * @returns {Promise<boolean>} - Whether a room is free for the whole slot
+ */
+const hasClinicRoomAvailable = async (doctor, date, startTime, endTime, type, options = {}) => {
+  const clinic = doctor.clinicLocation;
+  if (type !== 'in-person' || !clinic || !clinic.address || !clinic.postalCode) {
+    return true;
+  }
+
+  const colleagues = await Doctor.find({
+    'clinicLocation.address': clinic.address,
+    'clinicLocation.postalCode': clinic.postalCode
+  }).select('_id');
+
+  const day = new Date(date);
+  day.setUTCHours(0, 0, 0, 0);
+  const appointments = await Appointment.find({
+    doctorId: { $in: colleagues.map(c => c._id) },
+    date: day,
+    type: 'in-person',
+    status: { $ne: 'cancelled' },
+    ...(options.excludeId && { _id: { $ne: options.excludeId } })
+  }).select('startTime endTime status paymentStatus holdExpiresAt createdAt');
+
+  const start = timeToMinutes(startTime);
+  const end = timeToMinutes(endTime);
+  const busy = appointments.filter(a =>
+    isBlockingAppointment(a) &&
+    timeToMinutes(a.startTime) < end && timeToMinutes(a.endTime) > start
+  );
+
+  // Overlapping visits don't necessarily overlap each other, so count the
+  // most rooms in use at any moment of the requested slot
+  const points = [start, ...busy.map(a => timeToMinutes(a.startTime)).filter(t => t > start && t < end)];
+  const peak = Math.max(0, ...points.map(t =>
+    busy.filter(a => timeToMinutes(a.startTime) <= t && timeToMinutes(a.endTime) > t).length
+  ));
+
+  return peak < (clinic.rooms || 1);
+};
+
+/**
+ * Whether an appointment conflicts with any of the others once the buffers of
+ * their modes are kept free, the same way booking checks it
+ * @param {Object} appointment - The appointment
+ * @param {Object[]} others - Other appointments of the doctor that day
+ * @param {Object} session - Session to read the doctor in, if any
+ * @returns {Promise<boolean>}
+ */
+const conflictsWithAny = async (appointment, others, session = null) => {
+  if (others.length === 0) {
+    return false;
+  }
+  // Required here because availability.service depends on this module
+  const { conflictsWithAppointment } = require('./availability.service');
+  const doctor = await Doctor.findById(appointment.doctorId).select('appointmentBuffers').session(session);
+  const start = timeToMinutes(appointment.startTime);
+  const end = timeToMinutes(appointment.endTime);
+  return others.some(other => conflictsWithAppointment(doctor || {}, start, end, appointment.type, other));
+};
+
+/**
+ * Write the doctor's lock for a day within a transaction, so a concurrent
+ * transaction that also writes it hits a write conflict and reruns its
+ * checks once this one has committed. Only effective within a transaction.
+ * @param {string} doctorId - The doctor's ID
+ * @param {Date|string} date - The day
+ * @param {Object} session - The transaction's session
+ */
+const lockDoctorDay = async (doctorId, date, session = null) => {
+  await PaymentHoldLock.updateOne(
+    { doctorId, date },
+    { $inc: { version: 1 }, $set: { expiresAt: new Date(Date.now() + 24 * 60 * 60 * 1000) } },
+    { upsert: true, session }
+  );
+};
+
+/**
+ * Save a new booking unless another booking has taken an overlapping slot
+ * since it was checked. Within a transaction the doctor's day is locked
+ * first, so two bookings for the day are saved one after the other. Without
+ * one, the booking is checked again once saved and withdrawn if it raced
+ * another: both may back out, but the slot is never booked twice.
+ * @param {Object} appointment - The unsaved appointment
+ * @param {Object} session - The transaction's session, if any
+ * @throws {AppError} 409 SLOT_UNAVAILABLE when the slot was taken, so the
+ * transaction is rolled back
+ */
+const saveBooking = async (appointment, session = null) => {
+  const slotTaken = () => new AppError('Time slot overlaps with another appointment', 409, 'SLOT_UNAVAILABLE');
+  await lockDoctorDay(appointment.doctorId, appointment.date, session);
+  if (await isSlotTakenByOther(appointment, new Date(), session)) {
+    throw slotTaken();
+  }
+  await appointment.save({ session });
+  if (!session && await isSlotTakenByOther(appointment)) {
+    await Appointment.deleteOne({ _id: appointment._id });
+    throw slotTaken();
+  }
+};
+
+/**
+ * Reserve an appointment's slot while its payment is in progress
+ * @param {Object} appointment - The appointment being paid for
+ * @param {Object} options - session, to place the hold within a transaction
+ * @returns {Promise<Object|null>} - The held appointment, or null if the slot is
+ * already paid for or held by another booking
+ */
+const placePaymentHold = async (appointment, options = {}) => {
+  const now = new Date();
+
+  // Serialize holds for the doctor's day, so a concurrent hold on an
+  // overlapping slot can't slip past the check below
+  await lockDoctorDay(appointment.doctorId, appointment.date, options.session);
+
+  // Another booking for an overlapping slot that is paid or actively held wins
+  const competing = await Appointment.find({
+    _id: { $ne: appointment._id },
+    doctorId: appointment.doctorId,
+    date: appointment.date,
+    status: { $ne: 'cancelled' },
+    $or: [
+      { paymentStatus: 'paid' },
+      { paymentStatus: 'held', holdExpiresAt: { $gt: now } }
+    ]
+  }).session(options.session || null);
+
+  if (await conflictsWithAny(appointment, competing, options.session)) {
+    return null;
+  }
+
+  const holdExpiresAt = new Date(now.getTime() + getSetting('payments.holdMinutes') * 60 * 1000);
+
+  // Conditional update so two concurrent initiations can't both take the hold
+  return Appointment.findOneAndUpdate(
+    {
+      _id: appointment._id,
+      status: { $in: ['pending', 'confirmed'] },
+      $or: [
+        { paymentStatus: 'unpaid' },
+        { paymentStatus: 'held', holdExpiresAt: { $lte: now } }
+      ]
+    },
+    { $set: { paymentStatus: 'held', holdExpiresAt } },
+    { new: true, session: options.session }
+  );
+};
+
+/**
+ * Mark an appointment as paid and drop its hold
+ * @param {string} appointmentId - The appointment ID
+ * @returns {Promise<Object|null>} - The updated appointment, or null if it was
+ * cancelled before the payment came through
+ */
+const confirmPayment = async (appointmentId) => {
+  return Appointment.findOneAndUpdate(
+    { _id: appointmentId, status: { $ne: 'cancelled' } },
+    { $set: { paymentStatus: 'paid' }, $unset: { holdExpiresAt: 1 } },
+    { new: true }
+  );
+};
+
+/**
+ * Mark an appointment as paid by a payment that succeeded after its hold
+ * lapsed, if the booking can still be kept: not cancelled, not paid or held
+ * by another payment since, and its slot not taken by another booking
+ * @param {string} appointmentId - The appointment ID
+ * @returns {Promise<Object|null>} - The updated appointment, or null when the
+ * payment has nothing to pay for and must be refunded
+ */
+const reattachLatePayment = async (appointmentId) => {
+  const now = new Date();
+  const keepable = {
+    _id: appointmentId,
+    status: { $in: ['pending', 'confirmed'] },
+    $or: [
+      { paymentStatus: 'unpaid' },
+      { paymentStatus: 'held', holdExpiresAt: { $lte: now } }
+    ]
+  };
+  const appointment = await Appointment.findOne(keepable);
+  if (!appointment || await isSlotTakenByOther(appointment, now)) {
+    return null;
+  }
+  return Appointment.findOneAndUpdate(
+    keepable,
+    { $set: { paymentStatus: 'paid' }, $unset: { holdExpiresAt: 1 } },
+    { new: true }
+  );
+};
+
+/**
+ * Release the hold on an appointment whose payment failed
+ * @param {string} appointmentId - The appointment ID
+ */
+const releasePaymentHold = async (appointmentId) => {
+  await Appointment.updateOne(
+    { _id: appointmentId, paymentStatus: 'held' },
+    { $set: { paymentStatus: 'unpaid' }, $unset: { holdExpiresAt: 1 } }
+  );
+};
+
+/**
+ * Whether another booking now occupies an overlapping slot, or the buffer
+ * kept around it. A booking whose hold lapsed stops blocking its slot, so it
+ * may have been booked meanwhile.
+ * @param {Object} appointment - The appointment
+ * @param {Date} now - Reference time
+ * @param {Object} session - Session to read in, if any
+ * @returns {Promise<boolean>}
+ */
+const isSlotTakenByOther = async (appointment, now = new Date(), session = null) => {
+  const others = await Appointment.find({
+    _id: { $ne: appointment._id },
+    doctorId: appointment.doctorId,
+    date: appointment.date,
+    status: { $ne: 'cancelled' }
+  }).select('startTime endTime type status paymentStatus holdExpiresAt createdAt').session(session);
+
+  return conflictsWithAny(appointment, others.filter(other => isBlockingAppointment(other, now)), session);
+};
+
+/**
+ * Release expired payment holds and, when payment is required before a
+ * booking is kept, cancel bookings that were never paid. A booking whose slot
+ * was taken while its hold was lapsed is cancelled rather than released, so
+ * it can't block the slot again.
+ * @returns {Promise<number>} - Number of appointments cancelled
+ */
+const expireUnpaidAppointments = async () => {
+  const now = new Date();
+  let cancelled = 0;
+
+  const expiredHolds = await Appointment.find({
+    status: { $in: ['pending', 'confirmed'] },
+    paymentStatus: 'held',
+    holdExpiresAt: { $lte: now }
+  });
+
+  if (expiredHolds.length > 0) {
+    const ids = expiredHolds.map(appointment => appointment._id);
+    // Marked, so a success the provider reports late is still handled
+    await Payment.updateMany(
+      { appointmentId: { $in: ids }, status: 'pending' },
+      { $set: { status: 'failed', holdExpiredAt: now, updatedAt: now } }
+    );
+
+    let released = 0;
+    for (const appointment of expiredHolds) {
+      if (await isSlotTakenByOther(appointment, now)) {
+        try {
+          await transitionStatus(appointment, 'cancelled', { actor: 'system', reason: 'Slot taken after the payment hold expired' });
+          cancelled += 1;
+        } catch (error) {
+          // Paid or cancelled since the query; leave it be
+          if (error.errorCode !== 'STATUS_CHANGED') throw error;
+        }
+        continue;
+      }
+      // Conditional, as the patient may have started a new payment meanwhile
+      const result = await Appointment.updateOne(
+        { _id: appointment._id, paymentStatus: 'held', holdExpiresAt: { $lte: now } },
+        { $set: { paymentStatus: 'unpaid' }, $unset: { holdExpiresAt: 1 } }
+      );
+      released += result.modifiedCount;
+    }
+    logger.info('Released expired payment holds', { released, cancelled });
+  }
+
+  if (!config.payments.payBeforeConfirm) {
+    return cancelled;
+  }
+
+  const cutoff = new Date(now.getTime() - config.payments.unpaidExpiryMinutes * 60 * 1000);
+  const unpaid = await Appointment.find({ status: 'pending', paymentStatus: 'unpaid', createdAt: { $lte: cutoff } })
+    .select('_id status');
+
+  for (const appointment of unpaid) {
+    try {
+      await transitionStatus(appointment, 'cancelled', { actor: 'system', reason: 'Payment not completed in time' });
+      cancelled += 1;
+    } catch (error) {
+      // Confirmed or cancelled by someone else since the query; leave it be
+      if (error.errorCode !== 'STATUS_CHANGED') throw error;
+    }
+  }
+
+  if (cancelled > 0) {
+    logger.info('Cancelled unpaid appointments', { count: cancelled });
+  }
+
+  return cancelled;
+};
+
+/**
+ * Find unpaid bookings whose unpaid window ends within
+ * config.payments.unpaidReminder.minutesBefore and mark them reminded. Runs
+ * after expireUnpaidAppointments, so bookings it just cancelled, and any that
+ * were paid or have a payment in progress, are left out.
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object[]>} - { appointment, deadline } for each patient to remind
+ */
+const remindUnpaidAppointments = async (now = new Date()) => {
+  if (!config.payments.payBeforeConfirm) {
+    return [];
+  }
+  const expiryMs = config.payments.unpaidExpiryMinutes * 60 * 1000;
+  const leadMs = Math.min(config.payments.unpaidReminder.minutesBefore * 60 * 1000, expiryMs);
+  const filter = {
+    status: 'pending',
+    paymentStatus: 'unpaid',
+    paymentReminderSentAt: null,
+    createdAt: { $lte: new Date(now.getTime() - expiryMs + leadMs), $gt: new Date(now.getTime() - expiryMs) }
+  };
+  const due = await Appointment.find(filter).select('_id');
+
+  const reminders = [];
+  for (const { _id } of due) {
+    // Conditional so two runs can't send the same reminder
+    const updated = await Appointment.findOneAndUpdate(
+      { ...filter, _id },
+      { $set: { paymentReminderSentAt: now } },
+      { new: true }
+    );
+    if (updated) {
+      reminders.push({ appointment: updated, deadline: getUnpaidDeadline(updated) });
+    }
+  }
+
+  if (reminders.length > 0) {
+    logger.info('Reminded patients to pay for their bookings', { count: reminders.length });
+  }
+  return reminders;
+};
+
+// Status history reason for bookings confirmed on the doctor's behalf
+const AUTO_ACCEPT_REASON = 'Auto-accepted by the doctor\'s booking settings';
+
+/**
+ * Set a new booking's confirmation mode from its doctor's settings. Bookings
+ * for doctors who auto-accept are confirmed as they are made, unless payment
+ * is required before confirmation; confirmAutoAccepted confirms those once
+ * they are paid.
+ * @param {Object} appointment - The new, unsaved pending appointment
+ * @param {Object} doctor - Its doctor
+ */
+const applyConfirmationMode = (appointment, doctor) => {
+  if (!doctor.autoAcceptBookings) {
+    return;
+  }
+  appointment.confirmationMode = 'auto';
+  if (config.payments.payBeforeConfirm) {
+    return;
+  }
+  appointment.status = 'confirmed';
+  appointment.statusHistory.push({
+    from: 'pending',
+    to: 'confirmed',
+    actor: 'system',
+    reason: AUTO_ACCEPT_REASON,
+    at: new Date()
+  });
+};
+
+/**
+ * Confirm an auto-accepted booking that was waiting for its payment
+ * @param {Object} appointment - The appointment, just paid
+ * @returns {Promise<Object|null>} - The confirmed appointment, or null when
+ * there was nothing to confirm
+ */
+const confirmAutoAccepted = async (appointment) => {
+  if (appointment.confirmationMode !== 'auto' || appointment.status !== 'pending') {
+    return null;
+  }
+  try {
+    return await transitionStatus(appointment, 'confirmed', { actor: 'system', reason: AUTO_ACCEPT_REASON });
+  } catch (error) {
+    // Confirmed or cancelled by someone else meanwhile
+    if (error.errorCode !== 'STATUS_CHANGED') throw error;
+    return null;
+  }
+};
+
+/**
+ * Refund in full whatever is left of the payments for an appointment the
+ * doctor cancelled
+ * @param {Object} appointment - The cancelled appointment
+ * @returns {Promise<number>} - Total amount refunded now
+ */
+const refundDoctorCancellation = async (appointment) => {
+  const payments = await Payment.find({ appointmentId: appointment._id, status: 'success' });
+  let refunded = 0;
+  for (const payment of payments) {
+    const remaining = Math.round((payment.amount - (payment.refundedAmount || 0)) * 100) / 100;
+    if (remaining <= 0) continue;
+    const doctorNetBefore = PayoutService.getDoctorNet(payment);
+    PaymentService.applyRefund(payment, remaining);
+    payment.updatedAt = new Date();
+    await payment.save();
+    await PayoutService.clawBackRefund(payment, doctorNetBefore);
+    refunded += remaining;
+  }
+  if (refunded > 0) {
+    await Appointment.updateOne({ _id: appointment._id }, { $set: { paymentStatus: 'refunded' } });
+    logger.info('Payment refunded', { appointmentId: appointment._id, amount: refunded, reason: 'Cancelled by doctor' });
+  }
+  return Math.round(refunded * 100) / 100;
+};
+
+/**
+ * Find the appointment an earlier request with the same idempotency key
+ * booked. Keys older than config.appointments.idempotencyWindowHours are
+ * released so the client may use them again.
+ * @param {string} patientId - The patient the booking is for
+ * @param {string} key - The idempotency key
+ * @returns {Promise<Object|null>} - The earlier appointment, or null
+ */
+const findIdempotentBooking = async (patientId, key) => {
+  const appointment = await Appointment.findOne({ patientId, idempotencyKey: key });
+  if (!appointment) {
+    return null;
+  }
+  const windowEnd = appointment.createdAt.getTime() + config.appointments.idempotencyWindowHours * 60 * 60 * 1000;
+  if (windowEnd > Date.now()) {
+    return appointment;
+  }
+  await Appointment.updateOne({ _id: appointment._id }, { $unset: { idempotencyKey: 1 } });
+  return null;
+};
+
+/**
+ * Whether a request reusing an idempotency key asks for the same booking as
+ * the appointment it created
+ * @param {Object} appointment - The appointment booked with the key
+ * @param {Object} body - The new request body
+ * @returns {boolean}
+ */
+const matchesIdempotentBooking = (appointment, body) => {
+  return appointment.doctorId.toString() === String(body.doctorId) &&
+    appointment.date.toISOString().slice(0, 10) === String(body.date) &&
+    `${appointment.startTime}-${appointment.endTime}` === body.timeSlot;
+};
+
+/**
+ * Delete drafts the patient hasn't touched for config.appointments.draftExpiryHours
+ * @returns {Promise<number>} - Number of drafts deleted
+ */
+const expireDrafts = async () => {
+  const cutoff = new Date(Date.now() - config.appointments.draftExpiryHours * 60 * 60 * 1000);
+  const { deletedCount } = await Appointment.deleteMany({ status: 'draft', updatedAt: { $lte: cutoff } });
+  if (deletedCount > 0) {
+    logger.info('Deleted expired appointment drafts', { count: deletedCount });
+  }
+  return deletedCount;
+};
+
+/**
+ * Check whether a video appointment can be joined at a given time
+ * @param {Object} appointment - The appointment
+ * @param {Date} now - Reference time
+ * @returns {string|null} - 'early' or 'late' when outside the join window, null when joinable
+ */
+const getVideoJoinWindowError = (appointment, now = new Date()) => {
+  const { joinEarlyGraceMinutes, joinLateGraceMinutes } = config.videoCall;
+  const opensAt = getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone).getTime() - joinEarlyGraceMinutes * 60 * 1000;
+  const closesAt = getAppointmentStart(appointment.date, appointment.endTime, appointment.timeZone).getTime() + joinLateGraceMinutes * 60 * 1000;
+
+  if (now.getTime() < opensAt) {
+    return 'early';
+  }
+  if (now.getTime() > closesAt) {
+    return 'late';
+  }
+  return null;
+};
+
+/**
+ * Why a video call for an appointment can't be started or joined at a given time
+ * @param {Object} appointment - The appointment
+ * @param {Date} now - Reference time
+ * @returns {string|null} - 'not-video', 'not-confirmed', 'unpaid', 'early' or
+ * 'late', or null when the call is available
+ */
+const getVideoCallError = (appointment, now = new Date()) => {
+  if (appointment.type !== 'video') {
+    return 'not-video';
+  }
+  if (appointment.status !== 'confirmed') {
+    return 'not-confirmed';
+  }
+  if (config.payments.payBeforeConfirm && appointment.paymentStatus !== 'paid') {
+    return 'unpaid';
+  }
+  return getVideoJoinWindowError(appointment, now);
+};
+
+/**
+ * Whether new chat messages may be sent on a doctor's appointments
+ * @param {Object} doctor - The doctor, with verificationStatus and status
+ * @returns {boolean}
+ */
+const isChatOpenForDoctor = (doctor) => {
+  if (!config.chat.requireVerifiedDoctor) {
+    return true;
+  }
+  return !!doctor && doctor.verificationStatus === 'verified' && doctor.status !== 'suspended';
+};
+
+/**
+ * What a participant can do with an appointment right now, using the same
+ * rules the video and chat handlers enforce
+ * @param {Object} appointment - The appointment
+ * @param {Object} context - doctor, the open videoSession if any, and now
+ * @returns {Object} - { canChat, canStartVideo, canJoinVideo, videoUnavailableReason }
+ */
+const getCapabilities = (appointment, context = {}) => {
+  const videoError = getVideoCallError(appointment, context.now);
+  const hasOpenSession = !!context.videoSession && ['scheduled', 'active'].includes(context.videoSession.status);
+  return {
+    canChat: isChatOpenForDoctor(context.doctor),
+    canStartVideo: !videoError && !hasOpenSession,
+    canJoinVideo: !videoError && hasOpenSession,
+    videoUnavailableReason: videoError
+  };
+};
+
+/**
+ * Capabilities for a list of appointments, loading their doctors and open
+ * video sessions in two queries
+ * @param {Object[]} appointments - The appointments
+ * @returns {Promise<Map>} - Appointment ID string to capabilities
+ */
+const getCapabilitiesForAppointments = async (appointments) => {
+  const now = new Date();
+  const [doctors, sessions] = await Promise.all([
+    Doctor.find({ _id: { $in: appointments.map(a => a.doctorId) } }).select('verificationStatus status'),
+    VideoSession.find({
+      appointmentId: { $in: appointments.filter(a => a.type === 'video').map(a => a._id) },
+      status: { $in: ['scheduled', 'active'] }
+    }).select('appointmentId status')
+  ]);
+
+  const result = new Map();
+  for (const appointment of appointments) {
+    result.set(appointment._id.toString(), getCapabilities(appointment, {
+      doctor: doctors.find(d => d._id.equals(appointment.doctorId)),
+      videoSession: sessions.find(s => s.appointmentId.equals(appointment._id)),
+      now
+    }));
+  }
+  return result;
+};
+
+/**
+ * Whether a confirmed appointment has been over long enough to auto-complete
+ * @param {Object} appointment - The appointment
+ * @param {Date} now - Reference time
+ * @returns {boolean}
+ */
+const isDueForAutoComplete = (appointment, now = new Date()) => {
+  if (appointment.status !== 'confirmed') {
+    return false;
+  }
+  const end = getAppointmentStart(appointment.date, appointment.endTime, appointment.timeZone);
+  const dueAt = end.getTime() + config.appointments.autoComplete.delayMinutes * 60 * 1000;
+  return dueAt <= now.getTime();
+};
+
+// No-show for an appointment the auto-complete job found no activity for.
+// Returns 1 when marked, 0 when someone else changed it meanwhile.
+const markUnattended = async (appointment) => {
+  try {
+    await transitionStatus(appointment, 'no-show', {
+      actor: 'system',
+      reason: 'No video call or chat activity during the appointment'
+    });
+    return 1;
+  } catch (error) {
+    if (error.errorCode !== 'STATUS_CHANGED') throw error;
+    return 0;
+  }
+};
+
+/**
+ * Mark confirmed appointments as completed once they are past their end time
+ * plus the configured delay. Appointments with a video call still running are
+ * left for the next run. When completion requires consultation activity and
+ * there was none, the appointment is marked no-show instead.
+ * @returns {Promise<Object[]>} - The appointments that were completed
+ */
+const autoCompleteAppointments = async () => {
+  const now = new Date();
+  const dayEnd = new Date(now);
+  dayEnd.setUTCHours(23, 59, 59, 999);
+
+  const candidates = await Appointment.find({
+    status: 'confirmed',
+    date: { $lte: dayEnd }
+  });
+
+  const completed = [];
+  let noShows = 0;
+  for (const appointment of candidates) {
+    if (!isDueForAutoComplete(appointment, now)) continue;
+
+    const activeSession = await VideoSession.exists({ appointmentId: appointment._id, status: 'active' });
+    if (activeSession) continue;
+
+    // Conditional so a doctor completing or cancelling it meanwhile wins
+    try {
+      completed.push(await transitionStatus(appointment, 'completed', {
+        actor: 'system',
+        reason: 'Auto-completed after the appointment ended',
+        set: { autoCompleted: true }
+      }));
+    } catch (error) {
+      if (error.errorCode === 'CONSULTATION_ACTIVITY_REQUIRED') {
+        noShows += await markUnattended(appointment);
+      } else if (error.errorCode !== 'STATUS_CHANGED') {
+        throw error;
+      }
+    }
+  }
+
+  if (completed.length > 0) {
+    logger.info('Auto-completed appointments', { count: completed.length });
+  }
+  if (noShows > 0) {
+    logger.info('Marked unattended appointments as no-show', { count: noShows });
+  }
+
+  return completed;
+};
+
+/**
+ * When a pending appointment started waiting for the doctor: its last move
+ * back to pending after a reschedule, or else its booking
+ * @param {Object} appointment - The pending appointment
+ * @returns {Date}
+ */
+const getPendingSince = (appointment) => {
+  const history = appointment.statusHistory || [];
+  for (let i = history.length - 1; i >= 0; i--) {
+    if (history[i].to === 'pending' && history[i].at) {
+      return history[i].at;
+    }
+  }
+  return appointment.createdAt;
+};
+
+/**
+ * What the pending escalation job should do with an appointment now: remind
+ * the doctor again, cancel it because the deadline passed, or nothing. The
+ * deadline is config.appointments.pendingEscalation.autoCancelMinutes after
+ * it became pending, or its start time if that comes first.
+ * @param {Object} appointment - The pending appointment
+ * @param {Date} now - Reference time
+ * @returns {Object|null} - { action: 'remind', level, final, pendingSince,
+ * deadline }, { action: 'cancel', deadline }, or null
+ */
+const getEscalationStep = (appointment, now = new Date()) => {
+  const { reminderMinutes, autoCancelMinutes } = config.appointments.pendingEscalation;
+  const pendingSince = getPendingSince(appointment);
+  const deadline = new Date(Math.min(
+    pendingSince.getTime() + autoCancelMinutes * 60 * 1000,
+    getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone).getTime()
+  ));
+  if (deadline <= now) {
+    return { action: 'cancel', deadline };
+  }
+
+  // Reminders sent before a reschedule don't count towards this round
+  const escalation = appointment.confirmationEscalation || {};
+  const sent = escalation.pendingSince && escalation.pendingSince.getTime() === pendingSince.getTime()
+    ? escalation.remindersSent || 0
+    : 0;
+  const elapsedMinutes = (now.getTime() - pendingSince.getTime()) / (60 * 1000);
+  const due = reminderMinutes.filter(minutes => minutes <= elapsedMinutes).length;
+  if (due <= sent) {
+    return null;
+  }
+  // Several reminders due at once (the job was down) are sent as the latest
+  return { action: 'remind', level: due, final: due === reminderMinutes.length, pendingSince, deadline };
+};
+
+/**
+ * Escalate appointments the doctor hasn't confirmed: record a reminder at
+ * each configured interval, and cancel those still pending past their
+ * deadline, refunding the patient in full. Appointments awaiting the
+ * patient's payment are left to expireUnpaidAppointments.
+ * @returns {Promise<Object>} - reminders ({ appointment, final, deadline })
+ * for the doctors to be reminded, and cancelled ({ appointment, refunded })
+ * for the patients to be told
+ */
+const escalatePendingAppointments = async () => {
+  const now = new Date();
+  const filter = { status: 'pending' };
+  if (config.payments.payBeforeConfirm) {
+    filter.paymentStatus = 'paid';
+  }
+  const pending = await Appointment.find(filter);
+
+  const reminders = [];
+  const cancelled = [];
+  for (const appointment of pending) {
+    const step = getEscalationStep(appointment, now);
+    if (!step) continue;
+
+    if (step.action === 'remind') {
+      // Conditional so two runs can't send the same reminder
+      const updated = await Appointment.findOneAndUpdate(
+        {
+          _id: appointment._id,
+          status: 'pending',
+          $or: [
+            { 'confirmationEscalation.pendingSince': { $ne: step.pendingSince } },
+            { 'confirmationEscalation.remindersSent': { $lt: step.level } }
+          ]
+        },
+        {
+          $set: {
+            confirmationEscalation: { pendingSince: step.pendingSince, remindersSent: step.level, lastReminderAt: now }
+          }
+        },
+        { new: true }
+      );
+      if (updated) {
+        reminders.push({ appointment: updated, final: step.final, deadline: step.deadline });
+      }
+      continue;
+    }
+
+    try {
+      const updated = await transitionStatus(appointment, 'cancelled', {
+        actor: 'system',
+        reason: 'Not confirmed by the doctor in time',
+        set: { cancellationCategory: 'doctor_unavailable', 'confirmationEscalation.autoCancelledAt': now }
+      });
+      cancelled.push({ appointment: updated, refunded: await refundDoctorCancellation(updated) });
+    } catch (error) {
+      // Confirmed or cancelled by someone else since the query; leave it be
+      if (error.errorCode !== 'STATUS_CHANGED') throw error;
+    }
+  }
+
+  if (reminders.length > 0) {
+    logger.info('Reminded doctors of unconfirmed appointments', { count: reminders.length });
+  }
+  if (cancelled.length > 0) {
+    logger.info('Cancelled appointments not confirmed in time', { count: cancelled.length });
+  }
+
+  return { reminders, cancelled };
+};
+
+module.exports = {
+  getScheduleTimeZone,
+  isAppointmentParticipant,
+  getDispositionError,
+  getCancellationCategoryError,
+  hasActiveHold,
+  isBlockingAppointment,
+  expireDrafts,
+  applyConfirmationMode,
+  confirmAutoAccepted,
+  refundDoctorCancellation,
+  findIdempotentBooking,
+  matchesIdempotentBooking,
+  isWithinClinicHours,
+  getLastBookableDate,
+  getBookingWindowError,
+  getLateRescheduleAmount,
+  getRescheduleFee,
+  settleRescheduleFee,
+  hasClinicRoomAvailable,
+  saveBooking,
+  placePaymentHold,
+  reattachLatePayment,
+  confirmPayment,
+  releasePaymentHold,
+  expireUnpaidAppointments,
+  getUnpaidDeadline,
+  remindUnpaidAppointments,
+  getVideoJoinWindowError,
+  getVideoCallError,
+  isChatOpenForDoctor,
+  getCapabilities,
+  getCapabilitiesForAppointments,
+  isDueForAutoComplete,
+  autoCompleteAppointments,
+  getPendingSince,
+  getEscalationStep,
+  escalatePendingAppointments
+};
@@ -0,0 +1,194 @@
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const VideoSession = require('../models/video.model');
+const Message = require('../models/message.model');
+const config = require('../config/config');
+const { AppError } = require('../utils/error.handler');
+const WebhookService = require('./webhook.service');
+
+/**
+ * Every appointment status with the statuses it may move to, and the roles
+ * allowed to make each move. A status with no outgoing transitions is final.
+ * 'system' is used by background jobs.
+ */
+const STATUS_TRANSITIONS = {
+  // Finalizing a draft books a new pending appointment and discards the
+  // draft, so a draft itself never changes status
+  draft: {},
+  pending: {
+    // The system confirms bookings for doctors who auto-accept them
+    confirmed: ['doctor', 'admin', 'system'],
+    cancelled: ['patient', 'doctor', 'admin', 'system']
+  },
+  confirmed: {
+    // Rescheduling puts a confirmed appointment back up for confirmation
+    pending: ['patient', 'doctor', 'admin'],
+    completed: ['doctor', 'admin', 'system'],
+    // The system marks unattended appointments when completion requires activity
+    'no-show': ['doctor', 'admin', 'system'],
+    cancelled: ['patient', 'doctor', 'admin', 'system']
+  },
+  completed: {},
+  'no-show': {},
+  cancelled: {}
+};
+
+/**
+ * The role a user acts in on an appointment
+ * @param {Object} appointment - The appointment
+ * @param {Object} user - The authenticated user
+ * @returns {Promise<string|null>} - 'patient', 'doctor' or 'admin', or null for
+ * users with no part in it
+ */
+const getActorRole = async (appointment, user) => {
+  if (appointment.patientId.toString() === user.id) {
+    return 'patient';
+  }
+  if (user.role === 'doctor') {
+    const doctor = await Doctor.findOne({ userId: user.id }).select('_id');
+    if (doctor && appointment.doctorId.equals(doctor._id)) {
+      return 'doctor';
+    }
+  }
+  return user.role === 'admin' ? 'admin' : null;
+};
+
+/**
+ * Whether a status is final, i.e. nothing may change it any more
+ * @param {string} status - The status
+ * @returns {boolean}
+ */
+const isFinalStatus = (status) => {
+  return Object.keys(STATUS_TRANSITIONS[status] || {}).length === 0;
+};
+
+/**
+ * Why a status change is not allowed
+ * @param {string} from - Current status
+ * @param {string} to - Requested status
+ * @param {string} actor - Role making the change
+ * @returns {AppError|null} - The error to report, or null when allowed
+ */
+const getTransitionError = (from, to, actor) => {
+  const roles = STATUS_TRANSITIONS[from] && STATUS_TRANSITIONS[from][to];
+  if (!roles) {
+    return new AppError(`Cannot change an appointment from ${from} to ${to}`, 409, 'INVALID_STATUS_TRANSITION');
+  }
+  if (!roles.includes(actor)) {
+    return new AppError(`A ${actor} cannot change an appointment from ${from} to ${to}`, 403, 'STATUS_TRANSITION_FORBIDDEN');
+  }
+  return null;
+};
+
+/**
+ * Whether the consultation visibly took place: a video call was joined or
+ * chat messages were exchanged
+ * @param {Object} appointment - The appointment
+ * @returns {Promise<Object>} - { videoStartedAt, chatMessages }
+ */
+const getConsultationActivity = async (appointment) => {
+  const [session, chatMessages] = await Promise.all([
+    VideoSession.findOne({ appointmentId: appointment._id, startedAt: { $exists: true } })
+      .sort({ startedAt: 1 })
+      .select('startedAt'),
+    Message.countDocuments({ chatId: appointment._id })
+  ]);
+  return {
+    videoStartedAt: session ? session.startedAt : null,
+    chatMessages
+  };
+};
+
+/**
+ * Why an appointment can't be completed under the completion activity
+ * policy (config.appointments.completionRequiresActivity). Admins override it.
+ * @param {Object} appointment - The appointment
+ * @param {string} actor - Role completing it
+ * @returns {Promise<AppError|null>} - The error to report, or null when allowed
+ */
+const getCompletionActivityError = async (appointment, actor) => {
+  const policy = config.appointments.completionRequiresActivity;
+  if (!policy.enabled || actor === 'admin' || !policy.types.includes(appointment.type)) {
+    return null;
+  }
+  const activity = await getConsultationActivity(appointment);
+  if (activity.videoStartedAt || activity.chatMessages > 0) {
+    return null;
+  }
+  return new AppError(
+    'No video call was joined and no chat messages were exchanged; mark the appointment as no-show instead',
+    409,
+    'CONSULTATION_ACTIVITY_REQUIRED'
+  );
+};
+
+/**
+ * Move an appointment to a new status, enforcing STATUS_TRANSITIONS and
+ * recording the change in its status history. Confirmations, cancellations
+ * and completions are published to webhooks. The update only applies if the
+ * status is still what the caller saw, so concurrent changes can't both win.
+ * @param {Object} appointment - The appointment, with its current status
+ * @param {string} to - The new status
+ * @param {Object} options - actor (role), userId, reason, and set with extra
+ * fields to update together with the status
+ * @returns {Promise<Object>} - The updated appointment
+ * @throws {AppError} - 409 for a transition that doesn't exist, a status
+ * that changed meanwhile or a completion without consultation activity, 403
+ * for a role that may not make it
+ */
+const transitionStatus = async (appointment, to, options = {}) => {
+  const from = appointment.status;
+  const error = getTransitionError(from, to, options.actor);
+  if (error) {
+    throw error;
+  }
+  if (to === 'completed') {
+    const activityError = await getCompletionActivityError(appointment, options.actor);
+    if (activityError) {
+      throw activityError;
+    }
+  }
+
+  const now = new Date();
+  const set = { ...options.set, status: to };
+  if (to === 'cancelled') {
+    set.cancelledBy = options.actor;
+    set.cancellationTime = now;
+    if (options.reason) {
+      set.cancellationReason = options.reason;
+    }
+  }
+
+  const updated = await Appointment.findOneAndUpdate(
+    { _id: appointment._id, status: from },
+    {
+      $set: set,
+      $push: {
+        statusHistory: {
+          from,
+          to,
+          actor: options.actor,
+          userId: options.userId,
+          reason: options.reason,
+          at: now
+        }
+      }
+    },
+    { new: true }
+  );
+  if (!updated) {
+    throw new AppError('The appointment was changed meanwhile; reload it and try again', 409, 'STATUS_CHANGED');
+  }
+  await WebhookService.publishStatusChange(updated);
+  return updated;
+};
+
+module.exports = {
+  STATUS_TRANSITIONS,
+  getActorRole,
+  isFinalStatus,
+  getTransitionError,
+  getConsultationActivity,
+  getCompletionActivityError,
+  transitionStatus
+};
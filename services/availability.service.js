@@ -0,0 +1,657 @@
+const Appointment = require('../models/appointment.model');
+const config = require('../config/config');
+const { timeToMinutes, minutesToTime, getWeekday, getAppointmentStart } = require('../utils/helpers');
+const { hasActiveHold, isBlockingAppointment, isWithinClinicHours, getLastBookableDate, getScheduleTimeZone } = require('./appointment.service');
+const { getSlotPrice } = require('./pricing.service');
+const { getSetting } = require('./settings.service');
+
+// How far ahead to look for the next day with a free slot
+const SUGGESTION_LOOKAHEAD_DAYS = 14;
+
+const WEEKDAYS = ['sunday', 'monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday'];
+
+const overlaps = (startA, endA, startB, endB) => startA < endB && endA > startB;
+
+const APPOINTMENT_MODES = ['in-person', 'video', 'phone'];
+
+const TIME_PATTERN = /^([0-1]?[0-9]|2[0-3]):[0-5][0-9]$/;
+
+// Language codes such as "en", "nl" or "pt-br"
+const LANGUAGE_PATTERN = /^[a-z]{2,3}(-[a-z0-9]{2,8})?$/i;
+
+/**
+ * Why a list of consultation languages can't be saved
+ * @param {*} languages - The list; missing is fine
+ * @returns {string|null}
+ */
+const getLanguagesError = (languages) => {
+  if (languages === undefined || languages === null) {
+    return null;
+  }
+  if (!Array.isArray(languages) || languages.some(language => typeof language !== 'string' || !LANGUAGE_PATTERN.test(language))) {
+    return 'Languages must be a list of language codes such as "en" or "nl"';
+  }
+  return null;
+};
+
+/**
+ * Why an availability block can't be saved
+ * @param {string} day - Weekday name, lowercase
+ * @param {string} startTime - Start (HH:MM)
+ * @param {string} endTime - End (HH:MM)
+ * @returns {string|null} - The problem, or null when the block is valid
+ */
+const getAvailabilitySlotError = (day, startTime, endTime) => {
+  if (!WEEKDAYS.includes(day)) {
+    return `Day must be one of: ${WEEKDAYS.join(', ')}`;
+  }
+  if (!TIME_PATTERN.test(startTime || '') || !TIME_PATTERN.test(endTime || '')) {
+    return 'Times must be HH:MM';
+  }
+  if (timeToMinutes(startTime) >= timeToMinutes(endTime)) {
+    return 'Start time must be before end time';
+  }
+  return null;
+};
+
+/**
+ * Why a block's breaks can't be saved: each must be a valid time range
+ * inside the block, and they must not overlap
+ * @param {Object} slot - The block, with startTime, endTime and breaks
+ * @returns {string|null}
+ */
+const getBreaksError = (slot) => {
+  if (slot.breaks === undefined || slot.breaks === null) {
+    return null;
+  }
+  if (!Array.isArray(slot.breaks)) {
+    return 'Breaks must be an array';
+  }
+  const blockStart = timeToMinutes(slot.startTime);
+  const blockEnd = timeToMinutes(slot.endTime);
+  const ranges = [];
+  for (const pause of slot.breaks) {
+    if (!pause || !TIME_PATTERN.test(pause.startTime || '') || !TIME_PATTERN.test(pause.endTime || '')) {
+      return 'Break times must be HH:MM';
+    }
+    const start = timeToMinutes(pause.startTime);
+    const end = timeToMinutes(pause.endTime);
+    if (start >= end) {
+      return `Break ${pause.startTime}-${pause.endTime} must start before it ends`;
+    }
+    if (start < blockStart || end > blockEnd) {
+      return `Break ${pause.startTime}-${pause.endTime} must fall within the block`;
+    }
+    ranges.push([start, end]);
+  }
+  ranges.sort((a, b) => a[0] - b[0]);
+  for (let i = 1; i < ranges.length; i++) {
+    if (ranges[i][0] < ranges[i - 1][1]) {
+      return 'Breaks must not overlap';
+    }
+  }
+  return null;
+};
+
+/**
+ * Why a weekly schedule can't be saved: each block and its breaks must be
+ * valid, each day listed once and blocks on a day must not overlap
+ * @param {Object[]} availability - Entries as { day, slots: [{ startTime, endTime, languages, breaks }] }
+ * @returns {string|null} - The problem, or null when the schedule is valid
+ */
+const getAvailabilityError = (availability) => {
+  if (!Array.isArray(availability)) {
+    return 'Availability must be an array';
+  }
+  const seen = new Set();
+  for (const entry of availability) {
+    if (!entry || typeof entry !== 'object' || Array.isArray(entry)) {
+      return 'Each availability entry must be an object';
+    }
+    const day = typeof entry.day === 'string' ? entry.day.toLowerCase() : entry.day;
+    if (!WEEKDAYS.includes(day)) {
+      return `Day must be one of: ${WEEKDAYS.join(', ')}`;
+    }
+    if (seen.has(day)) {
+      return `${day} is listed more than once`;
+    }
+    seen.add(day);
+    if (!Array.isArray(entry.slots)) {
+      return `Slots for ${day} must be an array`;
+    }
+    for (const slot of entry.slots) {
+      if (!slot || typeof slot !== 'object') {
+        return `Each availability block on ${day} must be an object`;
+      }
+      const error = getAvailabilitySlotError(day, slot.startTime, slot.endTime) ||
+        getLanguagesError(slot.languages) ||
+        getBreaksError(slot);
+      if (error) {
+        return `${day} ${slot.startTime}-${slot.endTime}: ${error}`;
+      }
+    }
+    const ranges = entry.slots
+      .map(slot => [timeToMinutes(slot.startTime), timeToMinutes(slot.endTime)])
+      .sort((a, b) => a[0] - b[0]);
+    for (let i = 1; i < ranges.length; i++) {
+      if (ranges[i][0] < ranges[i - 1][1]) {
+        return `Availability blocks on ${day} overlap`;
+      }
+    }
+  }
+  return null;
+};
+
+/**
+ * Apply imported day/start/end rows to a weekly schedule. Each row is
+ * validated on its own; rows that are invalid or overlap a block already in
+ * the schedule are rejected without affecting the others.
+ * @param {Object[]} availability - The current schedule
+ * @param {Object[]} rows - Rows as { row, day, startTime, endTime }
+ * @param {string} mode - 'merge' adds to the current schedule, 'replace'
+ * starts from an empty one
+ * @returns {Object} - { availability, results } where results has one entry
+ * per row with status imported, duplicate or rejected (with an error)
+ */
+const importAvailability = (availability, rows, mode) => {
+  const schedule = new Map();
+  if (mode === 'merge') {
+    availability.forEach(entry => {
+      schedule.set(entry.day.toLowerCase(), entry.slots.map(slot => ({ startTime: slot.startTime, endTime: slot.endTime, languages: slot.languages, breaks: slot.breaks })));
+    });
+  }
+
+  const results = rows.map(({ row, day: rawDay, startTime: rawStart, endTime: rawEnd }) => {
+    const day = (rawDay || '').toLowerCase();
+    const error = getAvailabilitySlotError(day, rawStart, rawEnd);
+    if (error) {
+      return { row, day: rawDay, startTime: rawStart, endTime: rawEnd, status: 'rejected', error };
+    }
+    const start = timeToMinutes(rawStart);
+    const end = timeToMinutes(rawEnd);
+    const startTime = minutesToTime(start);
+    const endTime = minutesToTime(end);
+    const slots = schedule.get(day) || [];
+    if (slots.some(slot => slot.startTime === startTime && slot.endTime === endTime)) {
+      return { row, day, startTime, endTime, status: 'duplicate' };
+    }
+    const clash = slots.find(slot => overlaps(start, end, timeToMinutes(slot.startTime), timeToMinutes(slot.endTime)));
+    if (clash) {
+      return { row, day, startTime, endTime, status: 'rejected', error: `Overlaps ${clash.startTime}-${clash.endTime} on ${day}` };
+    }
+    schedule.set(day, [...slots, { startTime, endTime }]);
+    return { row, day, startTime, endTime, status: 'imported' };
+  });
+
+  const imported = WEEKDAYS
+    .filter(day => (schedule.get(day) || []).length > 0)
+    .map(day => ({
+      day,
+      slots: schedule.get(day).sort((a, b) => timeToMinutes(a.startTime) - timeToMinutes(b.startTime))
+    }));
+  return { availability: imported, results };
+};
+
+/**
+ * Split a range around its block's breaks
+ * @param {Object} range - { start, end, languages } in minutes
+ * @param {Object[]} breaks - The block's breaks (HH:MM)
+ * @returns {Object[]} - The parts of the range outside the breaks
+ */
+const withoutBreaks = (range, breaks) => {
+  const pauses = (breaks || [])
+    .map(pause => [timeToMinutes(pause.startTime), timeToMinutes(pause.endTime)])
+    .sort((a, b) => a[0] - b[0]);
+  const parts = [];
+  let start = range.start;
+  for (const [pauseStart, pauseEnd] of pauses) {
+    if (pauseStart > start) {
+      parts.push({ ...range, start, end: Math.min(pauseStart, range.end) });
+    }
+    start = Math.max(start, pauseEnd);
+  }
+  parts.push({ ...range, start });
+  return parts.filter(part => part.start < part.end);
+};
+
+/**
+ * A day's availability blocks in minutes, with the doctor's first-slot offset
+ * taken off the start of the earliest block, the last-slot cutoff off the
+ * end of the latest one, and each block split around its breaks
+ * @param {Object} doctor - The doctor
+ * @param {Object} daySchedule - The day's entry in doctor.availability
+ * @returns {Object[]} - Ranges as { start, end, languages }; ranges trimmed away are left out
+ */
+const getBookableRanges = (doctor, daySchedule) => {
+  const ranges = daySchedule.slots
+    .map(range => ({ start: timeToMinutes(range.startTime), end: timeToMinutes(range.endTime), languages: range.languages, breaks: range.breaks }))
+    .sort((a, b) => a.start - b.start);
+  if (ranges.length === 0) {
+    return ranges;
+  }
+  const dayStart = ranges[0].start + (doctor.firstSlotOffset || 0);
+  const dayEnd = Math.max(...ranges.map(range => range.end)) - (doctor.lastSlotCutoff || 0);
+  return ranges
+    .flatMap(range => withoutBreaks({ start: Math.max(range.start, dayStart), end: Math.min(range.end, dayEnd), languages: range.languages }, range.breaks))
+    .filter(range => range.start < range.end);
+};
+
+const normalizeLanguages = (languages) => (languages || []).map(language => language.toLowerCase());
+
+/**
+ * Languages a consultation is offered in: those both the availability block
+ * and the appointment mode are restricted to, or all of the doctor's
+ * languages when neither is restricted
+ * @param {Object} doctor - The doctor
+ * @param {string[]} blockLanguages - The availability block's languages
+ * @param {string} type - Appointment mode
+ * @param {string[]} doctorLanguages - Languages the doctor speaks
+ * @returns {string[]} - Lowercase; empty when nothing is known
+ */
+const getSlotLanguages = (doctor, blockLanguages, type, doctorLanguages) => {
+  const restrictions = [blockLanguages, doctor.consultationLanguages && doctor.consultationLanguages[type]]
+    .map(normalizeLanguages)
+    .filter(languages => languages.length > 0);
+  if (restrictions.length === 0) {
+    return normalizeLanguages(doctorLanguages);
+  }
+  return restrictions.reduce((offered, languages) => offered.filter(language => languages.includes(language)));
+};
+
+/**
+ * Whether a slot's languages allow a requested language. Without a request,
+ * or when the doctor hasn't listed any languages, anything goes.
+ * @param {string[]} languages - From getSlotLanguages
+ * @param {string} language - Requested language, or none
+ * @returns {boolean}
+ */
+const offersLanguage = (languages, language) => {
+  return !language || languages.length === 0 || languages.includes(language.toLowerCase());
+};
+
+/**
+ * Languages offered for a specific time, from the block it falls in
+ * @param {Object} doctor - The doctor
+ * @param {Object} daySchedule - The day's entry in doctor.availability
+ * @param {string} startTime - Start (HH:MM)
+ * @param {string} endTime - End (HH:MM)
+ * @param {string} type - Appointment mode
+ * @param {string[]} doctorLanguages - Languages the doctor speaks
+ * @returns {string[]}
+ */
+const getLanguagesAt = (doctor, daySchedule, startTime, endTime, type, doctorLanguages) => {
+  const start = timeToMinutes(startTime);
+  const end = timeToMinutes(endTime);
+  const range = getBookableRanges(doctor, daySchedule).find(candidate => start >= candidate.start && end <= candidate.end);
+  return getSlotLanguages(doctor, range && range.languages, type, doctorLanguages);
+};
+
+/**
+ * Whether a time falls entirely within one of the day's bookable blocks
+ * @param {Object} doctor - The doctor
+ * @param {Object} daySchedule - The day's entry in doctor.availability
+ * @param {string} startTime - Start (HH:MM)
+ * @param {string} endTime - End (HH:MM)
+ * @returns {boolean}
+ */
+const fitsDaySchedule = (doctor, daySchedule, startTime, endTime) => {
+  const start = timeToMinutes(startTime);
+  const end = timeToMinutes(endTime);
+  return getBookableRanges(doctor, daySchedule).some(range => start >= range.start && end <= range.end);
+};
+
+/**
+ * Minutes a doctor keeps free around an appointment of a mode: their own
+ * setting, or the platform default
+ * @param {Object} doctor - The doctor
+ * @param {string} type - Appointment mode; none needs no buffer
+ * @returns {number}
+ */
+const getBufferMinutes = (doctor, type) => {
+  const own = doctor.appointmentBuffers && doctor.appointmentBuffers[type];
+  if (own !== undefined && own !== null) {
+    return own;
+  }
+  return config.appointments.bufferMinutes[type] || 0;
+};
+
+/**
+ * Whether a time conflicts with an existing appointment once buffers are
+ * applied. The two need a gap of the larger buffer of their modes, so video
+ * calls can follow each other directly while an in-person visit keeps its
+ * travel and cleanup time whatever comes next to it.
+ * @param {Object} doctor - The doctor
+ * @param {number} start - Start in minutes
+ * @param {number} end - End in minutes
+ * @param {string} type - Mode of the appointment being booked
+ * @param {Object} appointment - Existing appointment with startTime, endTime and type
+ * @returns {boolean}
+ */
+const conflictsWithAppointment = (doctor, start, end, type, appointment) => {
+  const gap = Math.max(getBufferMinutes(doctor, type), getBufferMinutes(doctor, appointment.type));
+  return overlaps(start - gap, end + gap, timeToMinutes(appointment.startTime), timeToMinutes(appointment.endTime));
+};
+
+/**
+ * Whether a doctor's day is full under their maxAppointmentsPerDay
+ * @param {Object} doctor - The doctor
+ * @param {Object[]} appointments - The day's non-cancelled appointments;
+ * lapsed holds and expired unpaid bookings don't count
+ * @param {Date} now - Reference time
+ * @returns {boolean}
+ */
+const isAtDailyCap = (doctor, appointments, now = new Date()) => {
+  if (!doctor.maxAppointmentsPerDay) {
+    return false;
+  }
+  return appointments.filter(a => isBlockingAppointment(a, now)).length >= doctor.maxAppointmentsPerDay;
+};
+
+/**
+ * Split a doctor's schedule for one day into bookable slots and mark each as
+ * booked or held by existing appointments
+ * @param {Object} doctor - The doctor
+ * @param {Date} date - The day (UTC midnight)
+ * @param {Object[]} appointments - The doctor's appointments on that day
+ * @param {Object} options - duration (minutes), step (minutes between slot
+ * starts, defaults to the duration), type (mode being booked, for buffers
+ * and languages), language (only slots offering it), doctorLanguages
+ * (defaults to those of a populated doctor.userId), baseFee (defaults to the
+ * doctor's consultation fee) and now (reference time)
+ * @returns {Object[]} - Slots as { startTime, endTime, isBooked, isHeld, fee,
+ * languages }, fee being the base fee after peak pricing
+ */
+const buildDaySlots = (doctor, date, appointments, options = {}) => {
+  const duration = options.duration || getSetting('appointments.slotDurationMinutes');
+  const step = options.step || duration;
+  const now = options.now || new Date();
+  const dateStr = date.toISOString().slice(0, 10);
+
+  // Days past the doctor's booking window aren't offered
+  const daySchedule = doctor.availability.find(s => s.day.toLowerCase() === getWeekday(date));
+  if (!daySchedule || date > getLastBookableDate(doctor, now)) {
+    return [];
+  }
+
+  const unavailable = (doctor.unavailability || [])
+    .filter(u => u.date.toISOString().slice(0, 10) === dateStr)
+    .flatMap(u => u.slots.map(s => [timeToMinutes(s.startTime), timeToMinutes(s.endTime)]));
+
+  const occupied = appointments.filter(a => isBlockingAppointment(a, now));
+  if (isAtDailyCap(doctor, appointments, now)) {
+    return [];
+  }
+  const doctorLanguages = options.doctorLanguages || (doctor.userId && doctor.userId.languages);
+
+  const slots = [];
+  for (const range of getBookableRanges(doctor, daySchedule)) {
+    const languages = getSlotLanguages(doctor, range.languages, options.type, doctorLanguages);
+    if (!offersLanguage(languages, options.language)) {
+      continue;
+    }
+    // A slot is only offered when the whole consultation fits in the block
+    for (let start = range.start; start + duration <= range.end; start += step) {
+      const end = start + duration;
+      if (unavailable.some(([uStart, uEnd]) => overlaps(start, end, uStart, uEnd))) {
+        continue;
+      }
+
+      const clashes = occupied.filter(a => conflictsWithAppointment(doctor, start, end, options.type, a));
+      const isBooked = clashes.some(a => !hasActiveHold(a, now));
+      const startTime = minutesToTime(start);
+      slots.push({
+        startTime,
+        endTime: minutesToTime(end),
+        isBooked,
+        isHeld: !isBooked && clashes.length > 0,
+        fee: getSlotPrice(doctor, date, startTime, options.baseFee).fee,
+        languages
+      });
+    }
+  }
+
+  return slots;
+};
+
+/**
+ * Slots for every day in a date range, cut off at the end of the doctor's
+ * booking window
+ * @param {Object} doctor - The doctor
+ * @param {Date} startDate - First day
+ * @param {Date} endDate - Last day
+ * @param {Object} options - Passed through to buildDaySlots
+ * @returns {Promise<Object[]>} - One { date, slots } entry per day
+ */
+const getSlotsForRange = async (doctor, startDate, endDate, options = {}) => {
+  const first = new Date(startDate);
+  first.setUTCHours(0, 0, 0, 0);
+  const last = new Date(Math.min(new Date(endDate), getLastBookableDate(doctor, options.now)));
+  last.setUTCHours(0, 0, 0, 0);
+
+  const appointments = await Appointment.find({
+    doctorId: doctor._id,
+    date: { $gte: first, $lte: last },
+    status: { $ne: 'cancelled' }
+  }).select('date startTime endTime type status paymentStatus holdExpiresAt createdAt');
+
+  const days = [];
+  for (let d = new Date(first); d <= last; d.setUTCDate(d.getUTCDate() + 1)) {
+    const dateStr = d.toISOString().slice(0, 10);
+    const dayAppointments = appointments.filter(a => a.date.toISOString().slice(0, 10) === dateStr);
+    days.push({ date: dateStr, slots: buildDaySlots(doctor, new Date(d), dayAppointments, options) });
+  }
+
+  return days;
+};
+
+/**
+ * Free slots that could be booked instead of a requested one: the closest
+ * ones on the same day, and the first slots of the next day that has any
+ * @param {Object} doctor - The doctor
+ * @param {Date|string} date - The requested day
+ * @param {string} startTime - The requested start "HH:MM"
+ * @param {Object} options - duration (minutes), type (appointment mode), limit and now
+ * @returns {Promise<Object>} - { sameDay: [...], nextAvailableDay: { date, slots } | null }
+ */
+const suggestAlternativeSlots = async (doctor, date, startTime, options = {}) => {
+  const limit = options.limit || getSetting('appointments.suggestionCount');
+  const now = options.now || new Date();
+  const first = new Date(date);
+  first.setUTCHours(0, 0, 0, 0);
+  const last = new Date(first);
+  last.setUTCDate(last.getUTCDate() + SUGGESTION_LOOKAHEAD_DAYS);
+
+  const days = await getSlotsForRange(doctor, first, last, options);
+  const freeSlots = (day) => day.slots.filter(slot =>
+    !slot.isBooked &&
+    !slot.isHeld &&
+    getAppointmentStart(day.date, slot.startTime, getScheduleTimeZone(doctor)) > now &&
+    isWithinClinicHours(doctor, day.date, slot.startTime, slot.endTime, options.type)
+  );
+
+  const requested = timeToMinutes(startTime);
+  const sameDay = freeSlots(days[0])
+    .sort((a, b) => Math.abs(timeToMinutes(a.startTime) - requested) - Math.abs(timeToMinutes(b.startTime) - requested))
+    .slice(0, limit)
+    .sort((a, b) => timeToMinutes(a.startTime) - timeToMinutes(b.startTime))
+    .map(({ startTime, endTime }) => ({ startTime, endTime }));
+
+  let nextAvailableDay = null;
+  for (const day of days.slice(1)) {
+    const free = freeSlots(day);
+    if (free.length > 0) {
+      nextAvailableDay = {
+        date: day.date,
+        slots: free.slice(0, limit).map(({ startTime, endTime }) => ({ startTime, endTime }))
+      };
+      break;
+    }
+  }
+
+  return { date: days[0].date, sameDay, nextAvailableDay };
+};
+
+/**
+ * Each doctor's next free slot within the lookahead window, with one
+ * appointment query for the whole list
+ * @param {Object[]} doctors - The doctors
+ * @param {Object} options - now (reference time) and lookaheadDays
+ * @returns {Promise<Map>} - Doctor ID string to { date, startTime, endTime, startsAt },
+ * or null when nothing is free
+ */
+const getNextFreeSlotForDoctors = async (doctors, options = {}) => {
+  const now = options.now || new Date();
+  const lookaheadDays = options.lookaheadDays || config.appointments.nextAvailableLookaheadDays;
+  const first = new Date(now);
+  first.setUTCHours(0, 0, 0, 0);
+  const last = new Date(first);
+  last.setUTCDate(last.getUTCDate() + lookaheadDays);
+
+  const appointments = await Appointment.find({
+    doctorId: { $in: doctors.map(doctor => doctor._id) },
+    date: { $gte: first, $lte: last },
+    status: { $ne: 'cancelled' }
+  }).select('doctorId date startTime endTime type status paymentStatus holdExpiresAt createdAt');
+
+  const result = new Map();
+  for (const doctor of doctors) {
+    const doctorAppointments = appointments.filter(a => a.doctorId.equals(doctor._id));
+    let nextSlot = null;
+
+    for (let d = new Date(first); d <= last && !nextSlot; d.setUTCDate(d.getUTCDate() + 1)) {
+      const dateStr = d.toISOString().slice(0, 10);
+      const dayAppointments = doctorAppointments.filter(a => a.date.toISOString().slice(0, 10) === dateStr);
+      const slot = buildDaySlots(doctor, new Date(d), dayAppointments, { now })
+        .find(s => !s.isBooked && !s.isHeld && getAppointmentStart(dateStr, s.startTime, getScheduleTimeZone(doctor)) > now);
+      if (slot) {
+        nextSlot = {
+          date: dateStr,
+          startTime: slot.startTime,
+          endTime: slot.endTime,
+          startsAt: getAppointmentStart(dateStr, slot.startTime, getScheduleTimeZone(doctor))
+        };
+      }
+    }
+
+    result.set(doctor._id.toString(), nextSlot);
+  }
+
+  return result;
+};
+
+/**
+ * Start of each doctor's next free slot within the lookahead window
+ * @param {Object[]} doctors - The doctors
+ * @param {Object} options - Passed through to getNextFreeSlotForDoctors
+ * @returns {Promise<Map>} - Doctor ID string to Date, or null when nothing is free
+ */
+const getNextAvailableForDoctors = async (doctors, options = {}) => {
+  const slots = await getNextFreeSlotForDoctors(doctors, options);
+  const result = new Map();
+  slots.forEach((slot, doctorId) => result.set(doctorId, slot ? slot.startsAt : null));
+  return result;
+};
+
+/**
+ * A doctor's next free slots from now on, within the lookahead window
+ * @param {Object} doctor - The doctor
+ * @param {Object} options - count, duration (minutes), type (mode being
+ * booked), exclude ({ date, startTime } of a slot not to offer) and now
+ * @returns {Promise<Object[]>} - Slots as { date, startTime, endTime, startsAt }
+ */
+const getUpcomingFreeSlots = async (doctor, options = {}) => {
+  const now = options.now || new Date();
+  const count = options.count || getSetting('appointments.suggestionCount');
+  const last = new Date(now);
+  last.setUTCDate(last.getUTCDate() + config.appointments.nextAvailableLookaheadDays);
+
+  const days = await getSlotsForRange(doctor, now, last, { duration: options.duration, type: options.type, now });
+  const slots = [];
+  for (const day of days) {
+    for (const slot of day.slots) {
+      const startsAt = getAppointmentStart(day.date, slot.startTime, getScheduleTimeZone(doctor));
+      const excluded = options.exclude && options.exclude.date === day.date && options.exclude.startTime === slot.startTime;
+      if (slot.isBooked || slot.isHeld || startsAt <= now || excluded) continue;
+      slots.push({ date: day.date, startTime: slot.startTime, endTime: slot.endTime, startsAt });
+      if (slots.length >= count) {
+        return slots;
+      }
+    }
+  }
+  return slots;
+};
+
+/**
+ * Whether a specific slot is still free to book
+ * @param {Object} doctor - The doctor
+ * @param {string} date - The day "YYYY-MM-DD"
+ * @param {string} startTime - Start "HH:MM"
+ * @param {string} endTime - End "HH:MM"
+ * @param {string} type - Mode being booked, for buffers
+ * @returns {Promise<boolean>}
+ */
+const isSlotFree = async (doctor, date, startTime, endTime, type) => {
+  const day = new Date(date);
+  day.setUTCHours(0, 0, 0, 0);
+  const appointments = await Appointment.find({
+    doctorId: doctor._id,
+    date: day,
+    status: { $ne: 'cancelled' }
+  }).select('date startTime endTime type status paymentStatus holdExpiresAt createdAt');
+
+  const duration = timeToMinutes(endTime) - timeToMinutes(startTime);
+  return buildDaySlots(doctor, day, appointments, { duration, type })
+    .some(slot => slot.startTime === startTime && slot.endTime === endTime && !slot.isBooked && !slot.isHeld);
+};
+
+/**
+ * Upcoming appointments a doctor's schedule no longer covers, e.g. after a
+ * block was removed or shortened. Checks the doctor as given, so pass the
+ * changed schedule before saving it.
+ * @param {Object} doctor - The doctor, with the new availability
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object[]>} - Pending and confirmed appointments, soonest first
+ */
+const findScheduleConflicts = async (doctor, now = new Date()) => {
+  const today = new Date(now);
+  today.setUTCHours(0, 0, 0, 0);
+  const appointments = await Appointment.find({
+    doctorId: doctor._id,
+    status: { $in: ['pending', 'confirmed'] },
+    date: { $gte: today }
+  }).sort({ date: 1, startTime: 1 });
+
+  return appointments.filter(appointment => {
+    if (getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone) <= now || !isBlockingAppointment(appointment, now)) {
+      return false;
+    }
+    const weekday = getWeekday(appointment.date);
+    const daySchedule = doctor.availability.find(s => s.day.toLowerCase() === weekday);
+    return !daySchedule || !fitsDaySchedule(doctor, daySchedule, appointment.startTime, appointment.endTime);
+  });
+};
+
+module.exports = {
+  APPOINTMENT_MODES,
+  getAvailabilitySlotError,
+  LANGUAGE_PATTERN,
+  getLanguagesError,
+  getAvailabilityError,
+  importAvailability,
+  getBookableRanges,
+  fitsDaySchedule,
+  getSlotLanguages,
+  offersLanguage,
+  getLanguagesAt,
+  getBufferMinutes,
+  conflictsWithAppointment,
+  isAtDailyCap,
+  buildDaySlots,
+  getSlotsForRange,
+  suggestAlternativeSlots,
+  getNextFreeSlotForDoctors,
+  getNextAvailableForDoctors,
+  getUpcomingFreeSlots,
+  isSlotFree,
+  findScheduleConflicts
+};
@@ -4,6 +4,9 @@ const { SNSClient, PublishCommand } = require('@aws-sdk/client-sns');
 const { SQSClient, SendMessageCommand } = require('@aws-sdk/client-sqs');
 const { v4: uuidv4 } = require('uuid');
 const config = require('../config/config');
+const { buildSmsAttributes } = require('../utils/sms');
+const DeliveryService = require('./delivery.service');
+const logger = require('../utils/logger');
 
 // Validate AWS configuration
 const validateAWSConfig = () => {
@@ -96,9 +99,14 @@ class AWSService {
     }
   }
 
+  // Returns the SES message ID, or null when the address is suppressed
   static async sendEmail(to, subject, htmlBody, textBody) {
     try {
       validateAWSConfig();
+      if (await DeliveryService.isSuppressed('email', to)) {
+        logger.info('Email to suppressed address skipped', { subject });
+        return null;
+      }
       
       const command = new SendEmailCommand({
         Destination: {
@@ -120,26 +128,35 @@ class AWSService {
             Data: subject
           }
         },
-        Source: config.email.from
+        Source: config.email.from,
+        ConfigurationSetName: config.aws.ses.configurationSet
       });
 
-      await sesClient.send(command);
+      const response = await sesClient.send(command);
+      return response.MessageId;
     } catch (error) {
       console.error('SES error:', error);
       throw new Error('Failed to send email');
     }
   }
 
+  // Returns the SNS message ID, or null when the number is suppressed
   static async sendSMS(phoneNumber, message) {
     try {
       validateAWSConfig();
+      if (await DeliveryService.isSuppressed('sms', phoneNumber)) {
+        logger.info('SMS to suppressed number skipped');
+        return null;
+      }
       
       const command = new PublishCommand({
         Message: message,
-        PhoneNumber: phoneNumber
+        PhoneNumber: phoneNumber,
+        MessageAttributes: buildSmsAttributes(phoneNumber)
       });
 
-      await snsClient.send(command);
+      const response = await snsClient.send(command);
+      return response.MessageId;
     } catch (error) {
       console.error('SNS error:', error);
       throw new Error('Failed to send SMS');
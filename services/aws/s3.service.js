@@ -39,6 +39,17 @@ class S3Service {
     return await s3Client.send(command);
   }
 
+  // Read a file's contents from S3
+  async getFile(key) {
+    const command = new GetObjectCommand({
+      Bucket: this.bucketName,
+      Key: key
+    });
+
+    const response = await s3Client.send(command);
+    return Buffer.from(await response.Body.transformToByteArray());
+  }
+
   // Delete file from S3
   async deleteFile(key) {
     const command = new DeleteObjectCommand({
@@ -1,4 +1,5 @@
 const { snsClient } = require('../../config/aws.config');
+const { buildSmsAttributes } = require('../../utils/sms');
 const { 
   PublishCommand,
   CreateTopicCommand,
@@ -50,7 +51,8 @@ class SNSService {
   async sendSMS(phoneNumber, message) {
     const command = new PublishCommand({
       Message: message,
-      PhoneNumber: phoneNumber
+      PhoneNumber: phoneNumber,
+      MessageAttributes: buildSmsAttributes(phoneNumber)
     });
 
     return await snsClient.send(command);
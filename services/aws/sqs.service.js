@@ -1,14 +1,25 @@
+const { v4: uuidv4 } = require('uuid');
 const { sqsClient } = require('../../config/aws.config');
+const config = require('../../config/config');
 const {
   SendMessageCommand,
   ReceiveMessageCommand,
   DeleteMessageCommand,
+  ChangeMessageVisibilityCommand,
+  GetQueueAttributesCommand,
   CreateQueueCommand
 } = require('@aws-sdk/client-sqs');
 
+// SQS caps visibility timeouts at 12 hours
+const MAX_VISIBILITY_TIMEOUT = 12 * 60 * 60;
+
 class SQSService {
   constructor() {
-    this.queueUrl = process.env.AWS_SQS_QUEUE_URL;
+    this.queueUrl = config.aws.sqs.queueUrl;
+    this.deadLetterQueueUrl = config.aws.sqs.deadLetterQueueUrl;
+    this.maxReceiveCount = config.aws.sqs.maxReceiveCount;
+    this.visibilityTimeout = config.aws.sqs.visibilityTimeoutSeconds;
+    this.retryBaseDelay = config.aws.sqs.retryBaseDelaySeconds;
   }
 
   // Create a new SQS queue
@@ -25,11 +36,16 @@ class SQSService {
     return response.QueueUrl;
   }
 
-  // Send message to queue
-  async sendMessage(messageBody, delaySeconds = 0) {
+  // Send message to queue. Object payloads get a jobId so consumers can
+  // recognise redeliveries of the same job.
+  async sendMessage(messageBody, delaySeconds = 0, queueUrl = this.queueUrl) {
+    const body = typeof messageBody === 'string'
+      ? messageBody
+      : JSON.stringify({ jobId: uuidv4(), ...messageBody });
+
     const command = new SendMessageCommand({
-      QueueUrl: this.queueUrl,
-      MessageBody: typeof messageBody === 'string' ? messageBody : JSON.stringify(messageBody),
+      QueueUrl: queueUrl,
+      MessageBody: body,
       DelaySeconds: delaySeconds
     });
 
@@ -37,27 +53,96 @@ class SQSService {
   }
 
   // Receive messages from queue
-  async receiveMessages(maxMessages = 10) {
+  async receiveMessages(maxMessages = 10, queueUrl = this.queueUrl) {
     const command = new ReceiveMessageCommand({
-      QueueUrl: this.queueUrl,
+      QueueUrl: queueUrl,
       MaxNumberOfMessages: maxMessages,
-      WaitTimeSeconds: 20 // Long polling
+      WaitTimeSeconds: 20, // Long polling
+      VisibilityTimeout: this.visibilityTimeout,
+      AttributeNames: ['ApproximateReceiveCount']
     });
 
     return await sqsClient.send(command);
   }
 
   // Delete message from queue
-  async deleteMessage(receiptHandle) {
+  async deleteMessage(receiptHandle, queueUrl = this.queueUrl) {
     const command = new DeleteMessageCommand({
-      QueueUrl: this.queueUrl,
+      QueueUrl: queueUrl,
       ReceiptHandle: receiptHandle
     });
 
     return await sqsClient.send(command);
   }
 
-  // Process messages with a callback
+  // Hide a message for a while before it can be received again
+  async changeMessageVisibility(receiptHandle, timeoutSeconds) {
+    const command = new ChangeMessageVisibilityCommand({
+      QueueUrl: this.queueUrl,
+      ReceiptHandle: receiptHandle,
+      VisibilityTimeout: Math.min(timeoutSeconds, MAX_VISIBILITY_TIMEOUT)
+    });
+
+    return await sqsClient.send(command);
+  }
+
+  // Exponential backoff between attempts
+  getRetryDelay(receiveCount) {
+    return this.retryBaseDelay * Math.pow(2, receiveCount - 1);
+  }
+
+  // Copy a message to the dead-letter queue and remove it from the main queue
+  async moveToDeadLetterQueue(message) {
+    if (!this.deadLetterQueueUrl) {
+      throw new Error('Dead-letter queue is not configured');
+    }
+
+    await this.sendMessage(message.Body, 0, this.deadLetterQueueUrl);
+    await this.deleteMessage(message.ReceiptHandle);
+  }
+
+  // Approximate number of messages waiting in the dead-letter queue
+  async getDeadLetterCount() {
+    if (!this.deadLetterQueueUrl) {
+      return 0;
+    }
+
+    const response = await sqsClient.send(new GetQueueAttributesCommand({
+      QueueUrl: this.deadLetterQueueUrl,
+      AttributeNames: ['ApproximateNumberOfMessages']
+    }));
+    return parseInt(response.Attributes.ApproximateNumberOfMessages, 10) || 0;
+  }
+
+  // Move up to `limit` messages from the dead-letter queue back to the main queue
+  async redriveDeadLetters(limit = 10) {
+    if (!this.deadLetterQueueUrl) {
+      throw new Error('Dead-letter queue is not configured');
+    }
+
+    const redriven = [];
+    while (redriven.length < limit) {
+      const response = await sqsClient.send(new ReceiveMessageCommand({
+        QueueUrl: this.deadLetterQueueUrl,
+        MaxNumberOfMessages: Math.min(10, limit - redriven.length),
+        WaitTimeSeconds: 0
+      }));
+      if (!response.Messages || response.Messages.length === 0) {
+        break;
+      }
+
+      for (const message of response.Messages) {
+        await this.sendMessage(message.Body);
+        await this.deleteMessage(message.ReceiptHandle, this.deadLetterQueueUrl);
+        redriven.push(message.Body);
+      }
+    }
+
+    return redriven;
+  }
+
+  // Process messages with a callback. Failed messages are retried with
+  // backoff and moved to the dead-letter queue after maxReceiveCount receives.
   async processMessages(callback, maxMessages = 10) {
     const response = await this.receiveMessages(maxMessages);
     
@@ -66,14 +151,25 @@ class SQSService {
     }
 
     for (const message of response.Messages) {
+      const receiveCount = parseInt(message.Attributes?.ApproximateReceiveCount || '1', 10);
       try {
-        await callback(message);
+        await callback(message, receiveCount);
         await this.deleteMessage(message.ReceiptHandle);
       } catch (error) {
         console.error('Error processing message:', error);
+        try {
+          if (receiveCount >= this.maxReceiveCount) {
+            await this.moveToDeadLetterQueue(message);
+          } else {
+            await this.changeMessageVisibility(message.ReceiptHandle, this.getRetryDelay(receiveCount));
+          }
+        } catch (requeueError) {
+          // Leave the message alone; it reappears once the visibility timeout lapses
+          console.error('Error scheduling message retry:', requeueError);
+        }
       }
     }
   }
 }
 
-module.exports = new SQSService(); 
\ No newline at end of file
+module.exports = new SQSService(); 
@@ -0,0 +1,122 @@
+const Block = require('../models/block.model');
+const logger = require('../utils/logger');
+
+// What a blocked patient is told. It doesn't say they were blocked, only that
+// this booking or message can't go through.
+const BOOKING_BLOCKED_RESPONSE = {
+  message: 'This doctor can\'t take this booking. Please choose another doctor.',
+  code: 'BOOKING_UNAVAILABLE'
+};
+const CHAT_BLOCKED_RESPONSE = {
+  message: 'New messages can\'t be sent in this chat. Earlier messages remain available.',
+  code: 'CHAT_UNAVAILABLE'
+};
+
+/**
+ * Whether a doctor has blocked a patient
+ * @param {string} doctorId - The doctor's ID
+ * @param {string} patientId - The patient's user ID
+ * @returns {Promise<boolean>}
+ */
+const isBlocked = async (doctorId, patientId) => {
+  if (!doctorId || !patientId) {
+    return false;
+  }
+  return Boolean(await Block.exists({ doctorId, patientId, active: true }));
+};
+
+/**
+ * Drop the doctors who have blocked a patient from a list
+ * @param {Object[]} doctors - Doctors
+ * @param {string} patientId - The patient's user ID
+ * @returns {Promise<Object[]>}
+ */
+const withoutBlockingDoctors = async (doctors, patientId) => {
+  if (doctors.length === 0) {
+    return doctors;
+  }
+  const blocks = await Block.find({
+    patientId,
+    active: true,
+    doctorId: { $in: doctors.map(doctor => doctor._id) }
+  }).select('doctorId');
+  const blockedIds = new Set(blocks.map(block => block.doctorId.toString()));
+  return doctors.filter(doctor => !blockedIds.has(doctor._id.toString()));
+};
+
+/**
+ * Block a patient for a doctor, or re-activate an earlier block of the pair
+ * @param {string} doctorId - The doctor's ID
+ * @param {string} patientId - The patient's user ID
+ * @param {Object} actor - { userId, role } of who is blocking
+ * @param {string} reason - Why, kept for the audit trail only
+ * @returns {Promise<Object>} - { block, created }, created false when the pair was already blocked
+ */
+const blockPatient = async (doctorId, patientId, actor, reason) => {
+  const entry = { action: 'blocked', userId: actor.userId, role: actor.role, reason, at: new Date() };
+  const block = await Block.findOneAndUpdate(
+    { doctorId, patientId, active: { $ne: true } },
+    {
+      $set: { active: true, reason, placedBy: { userId: actor.userId, role: actor.role } },
+      $push: { history: entry }
+    },
+    { new: true }
+  );
+  if (block) {
+    logger.info('Patient blocked', { blockId: block._id, doctorId, patientId, by: actor.role });
+    return { block, created: true };
+  }
+
+  const existing = await Block.findOne({ doctorId, patientId });
+  if (existing) {
+    return { block: existing, created: false };
+  }
+  try {
+    const created = await Block.create({
+      doctorId,
+      patientId,
+      reason,
+      placedBy: { userId: actor.userId, role: actor.role },
+      history: [entry]
+    });
+    logger.info('Patient blocked', { blockId: created._id, doctorId, patientId, by: actor.role });
+    return { block: created, created: true };
+  } catch (error) {
+    // Blocked by a concurrent request
+    if (error.code === 11000) {
+      return { block: await Block.findOne({ doctorId, patientId }), created: false };
+    }
+    throw error;
+  }
+};
+
+/**
+ * Lift a block. Bookings and messages between the pair are allowed again.
+ * @param {Object} block - The active block
+ * @param {Object} actor - { userId, role } of who is unblocking
+ * @param {string} reason - Optional note for the audit trail
+ * @returns {Promise<Object>} - The updated block
+ */
+const unblock = async (block, actor, reason) => {
+  const updated = await Block.findOneAndUpdate(
+    { _id: block._id, active: true },
+    {
+      $set: { active: false },
+      $push: { history: { action: 'unblocked', userId: actor.userId, role: actor.role, reason, at: new Date() } }
+    },
+    { new: true }
+  );
+  if (updated) {
+    logger.info('Patient unblocked', { blockId: block._id, doctorId: block.doctorId, patientId: block.patientId, by: actor.role });
+  }
+  return updated || block;
+};
+
+module.exports = {
+  BOOKING_BLOCKED_RESPONSE,
+  CHAT_BLOCKED_RESPONSE,
+  isBlocked,
+  withoutBlockingDoctors,
+  blockPatient,
+  unblock
+};
@@ -0,0 +1,171 @@
+const BookingThrottle = require('../models/booking.throttle.model');
+const BookingThrottleCounter = require('../models/booking.throttle.counter.model');
+const logger = require('../utils/logger');
+
+// Throttle windows, aligned to the UTC hour and day, with the limit that
+// applies to each
+const WINDOWS = {
+  hour: { ms: 60 * 60 * 1000, limit: 'maxPerHour' },
+  day: { ms: 24 * 60 * 60 * 1000, limit: 'maxPerDay' }
+};
+
+const normalizeSpecialty = (specialty) => String(specialty || '').trim().toLowerCase();
+
+const getWindowStart = (window, now) => new Date(Math.floor(now.getTime() / WINDOWS[window].ms) * WINDOWS[window].ms);
+
+/**
+ * Active throttles for any of a doctor's specializations
+ * @param {Object} doctor - The doctor being booked
+ * @returns {Promise<Object[]>}
+ */
+const findThrottlesForDoctor = async (doctor) => {
+  const specialties = (doctor.specializations || []).map(normalizeSpecialty).filter(Boolean);
+  if (specialties.length === 0) {
+    return [];
+  }
+  return BookingThrottle.find({ specialty: { $in: specialties } }).lean();
+};
+
+// Add to a window's count, creating its counter on first use
+const incrementCounter = async (counter, by) => {
+  const update = () => BookingThrottleCounter.findOneAndUpdate(
+    { specialty: counter.specialty, window: counter.window, startsAt: counter.startsAt },
+    { $inc: { count: by }, $setOnInsert: { expiresAt: new Date(counter.startsAt.getTime() + WINDOWS[counter.window].ms) } },
+    { new: true, upsert: true }
+  );
+  try {
+    return await update();
+  } catch (error) {
+    // Another booking created the counter first; it exists now
+    if (error.code === 11000) {
+      return update();
+    }
+    throw error;
+  }
+};
+
+/**
+ * Give back counted bookings, e.g. when the booking failed to save
+ * @param {Object[]} reservation - Counters from reserveBooking
+ * @returns {Promise<void>}
+ */
+const releaseBooking = async (reservation) => {
+  for (const counter of reservation || []) {
+    try {
+      await BookingThrottleCounter.updateOne(
+        { specialty: counter.specialty, window: counter.window, startsAt: counter.startsAt, count: { $gt: 0 } },
+        { $inc: { count: -1 } }
+      );
+    } catch (error) {
+      logger.error('Could not release throttled booking', { specialty: counter.specialty, window: counter.window, error: error.message });
+    }
+  }
+};
+
+/**
+ * Count a new booking with a doctor against every throttle on their
+ * specializations. Counting comes first, so concurrent bookings can't all
+ * slip under a limit; a booking over any limit is given back everywhere.
+ * @param {Object} doctor - The doctor being booked
+ * @param {Date} now - Booking time
+ * @returns {Promise<Object>} - { reservation } to release if the booking
+ * isn't saved, or { throttled: { specialty, window, limit, retryAfter } }
+ */
+const reserveBooking = async (doctor, now = new Date()) => {
+  const throttles = await findThrottlesForDoctor(doctor);
+  const reservation = [];
+  for (const throttle of throttles) {
+    for (const [window, { ms, limit }] of Object.entries(WINDOWS)) {
+      if (!throttle[limit]) continue;
+      const counter = { specialty: throttle.specialty, window, startsAt: getWindowStart(window, now) };
+      const { count } = await incrementCounter(counter, 1);
+      reservation.push(counter);
+      if (count > throttle[limit]) {
+        await releaseBooking(reservation);
+        logger.info('Booking throttled', { specialty: throttle.specialty, window, limit: throttle[limit], doctorId: doctor._id });
+        return {
+          throttled: {
+            specialty: throttle.specialty,
+            window,
+            limit: throttle[limit],
+            retryAfter: new Date(counter.startsAt.getTime() + ms)
+          }
+        };
+      }
+    }
+  }
+  return { reservation };
+};
+
+/**
+ * Every throttle with the bookings counted in the current hour and day
+ * @param {Date} now - Current time
+ * @returns {Promise<Object[]>}
+ */
+const listThrottles = async (now = new Date()) => {
+  const throttles = await BookingThrottle.find().sort({ specialty: 1 }).populate('updatedBy', 'firstName lastName email').lean();
+  if (throttles.length === 0) {
+    return [];
+  }
+  const counters = await BookingThrottleCounter.find({
+    specialty: { $in: throttles.map(throttle => throttle.specialty) },
+    $or: Object.keys(WINDOWS).map(window => ({ window, startsAt: getWindowStart(window, now) }))
+  }).lean();
+  return throttles.map(throttle => {
+    const countIn = (window) => {
+      const counter = counters.find(c => c.specialty === throttle.specialty && c.window === window);
+      return counter ? counter.count : 0;
+    };
+    return { ...throttle, bookedThisHour: countIn('hour'), bookedToday: countIn('day') };
+  });
+};
+
+/**
+ * Create or replace a specialty's throttle. A limit left out is unlimited.
+ * @param {string} specialty - The specialty
+ * @param {Object} limits - { maxPerHour, maxPerDay, reason }
+ * @param {string} userId - The admin setting it
+ * @returns {Promise<Object>} - { throttle, created }
+ */
+const setThrottle = async (specialty, { maxPerHour, maxPerDay, reason }, userId) => {
+  const key = normalizeSpecialty(specialty);
+  const $set = { updatedBy: userId };
+  const $unset = {};
+  Object.entries({ maxPerHour, maxPerDay, reason }).forEach(([field, value]) => {
+    if (value === undefined || value === null) {
+      $unset[field] = '';
+    } else {
+      $set[field] = value;
+    }
+  });
+  const update = { $set };
+  if (Object.keys($unset).length > 0) {
+    update.$unset = $unset;
+  }
+  const existed = await BookingThrottle.exists({ specialty: key });
+  const throttle = await BookingThrottle.findOneAndUpdate({ specialty: key }, update, { new: true, upsert: true });
+  logger.info('Booking throttle set', { specialty: key, maxPerHour, maxPerDay, by: userId });
+  return { throttle, created: !existed };
+};
+
+/**
+ * Lift a specialty's throttle
+ * @param {string} specialty - The specialty
+ * @returns {Promise<Object|null>} - The removed throttle, or null if there was none
+ */
+const removeThrottle = async (specialty) => {
+  const removed = await BookingThrottle.findOneAndDelete({ specialty: normalizeSpecialty(specialty) });
+  if (removed) {
+    logger.info('Booking throttle removed', { specialty: removed.specialty });
+  }
+  return removed;
+};
+
+module.exports = {
+  normalizeSpecialty,
+  reserveBooking,
+  releaseBooking,
+  listThrottles,
+  setThrottle,
+  removeThrottle
+};
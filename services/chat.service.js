@@ -1,7 +1,13 @@
 
 const Chat = require('../models/chat.model');
+const Message = require('../models/message.model');
+const Appointment = require('../models/appointment.model');
+const AWSService = require('./aws.service');
 const mongoose = require('mongoose');
 
+// Content left in place of a purged message
+const CHAT_TOMBSTONE = '[message removed]';
+
 /**
  * Save a message to the database
  * @param {string} appointmentId - The appointment ID
@@ -83,6 +89,41 @@ const getMessages = async (appointmentId, userId, limit = 50, skip = 0) => {
   }
 };
 
+/**
+ * One page of an appointment's chat history, oldest first
+ * @param {string} appointmentId - The appointment ID
+ * @param {number} page - Page number, from 1
+ * @param {number} limit - Messages per page
+ * @returns {Promise<Object>} - { messages, total, page, pages }
+ */
+const getMessagePage = async (appointmentId, page = 1, limit = 50) => {
+  const [messages, total] = await Promise.all([
+    Message.find({ chatId: appointmentId })
+      .populate('senderId', 'firstName lastName avatar')
+      .sort({ createdAt: 1 })
+      .skip((page - 1) * limit)
+      .limit(limit),
+    Message.countDocuments({ chatId: appointmentId })
+  ]);
+  return {
+    messages: messages.map(m => ({
+      id: m._id,
+      chatId: m.chatId,
+      senderId: m.senderId,
+      content: m.content,
+      type: m.type,
+      fileUrl: m.fileUrl,
+      read: m.read,
+      redacted: Boolean(m.redactedAt),
+      createdAt: m.createdAt,
+      updatedAt: m.updatedAt
+    })),
+    total,
+    page,
+    pages: Math.ceil(total / limit)
+  };
+};
+
 /**
  * Mark messages as read for a user
  * @param {string} appointmentId - The appointment ID
@@ -122,8 +163,53 @@ const markMessagesAsRead = async (appointmentId, userId) => {
   }
 };
 
+/**
+ * Purge the content of a completed appointment's chat. Attachments are
+ * deleted from S3 first, so a failure leaves the messages intact for a
+ * retry. Message bodies are replaced with a tombstone; senders, timestamps
+ * and counts are kept for auditing.
+ * @param {Object} appointment - The appointment
+ * @param {Object} options - purgedBy (user ID, absent for the retention job)
+ * and reason ('participant', 'admin' or 'retention')
+ * @returns {Promise<Object>} - { messageCount, attachmentCount }
+ */
+const purgeChatContent = async (appointment, options = {}) => {
+  const [messages, chat] = await Promise.all([
+    Message.find({ chatId: appointment._id, redactedAt: { $exists: false } }).select('fileUrl'),
+    Chat.findOne({ appointmentId: appointment._id }).select('messages.fileUrl')
+  ]);
+  const attachments = [
+    ...messages.map(message => message.fileUrl),
+    ...(chat ? chat.messages.map(message => message.fileUrl) : [])
+  ].filter(Boolean);
+
+  await Promise.all([...new Set(attachments)].map(url => AWSService.deleteFromS3(url)));
+
+  const now = new Date();
+  await Message.updateMany(
+    { _id: { $in: messages.map(message => message._id) } },
+    { $set: { content: CHAT_TOMBSTONE, redactedAt: now }, $unset: { fileUrl: '', fileName: '', fileType: '' } }
+  );
+  if (chat && chat.messages.length > 0) {
+    await Chat.updateOne(
+      { _id: chat._id },
+      { $set: { 'messages.$[].content': CHAT_TOMBSTONE }, $unset: { 'messages.$[].fileUrl': '' } }
+    );
+  }
+
+  const summary = { messageCount: messages.length, attachmentCount: attachments.length };
+  await Appointment.updateOne(
+    { _id: appointment._id },
+    { $set: { chatPurge: { purgedAt: now, purgedBy: options.purgedBy, reason: options.reason, ...summary } } }
+  );
+  return summary;
+};
+
 module.exports = {
+  CHAT_TOMBSTONE,
+  purgeChatContent,
   saveMessage,
   getMessages,
+  getMessagePage,
   markMessagesAsRead
 };
@@ -0,0 +1,191 @@
+const mongoose = require('mongoose');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+let healthy = false;
+let lastCheckedAt = null;
+// Whether withTransaction uses transactions; see detectTransactionSupport
+let transactionsEnabled = false;
+
+const setHealthy = (value, reason) => {
+  lastCheckedAt = new Date();
+  if (value === healthy) {
+    return;
+  }
+  healthy = value;
+  if (value) {
+    logger.info('MongoDB is healthy');
+  } else {
+    logger.warn('MongoDB is unhealthy', { reason });
+  }
+};
+
+/**
+ * Driver options for the MongoDB connection, from config
+ * @returns {Object}
+ */
+const getConnectionOptions = () => {
+  const { mongodb } = config;
+  return {
+    maxPoolSize: mongodb.maxPoolSize,
+    minPoolSize: mongodb.minPoolSize,
+    serverSelectionTimeoutMS: mongodb.serverSelectionTimeoutMS,
+    socketTimeoutMS: mongodb.socketTimeoutMS,
+    connectTimeoutMS: mongodb.connectTimeoutMS,
+    family: 4, // Force IPv4
+    retryWrites: mongodb.retryWrites,
+    retryReads: mongodb.retryReads,
+    // Needed to time queries for the slow query log
+    monitorCommands: mongodb.slowQueries.enabled,
+    w: 'majority'
+  };
+};
+
+/**
+ * Ping the database and record whether it answered
+ * @returns {Promise<boolean>} - Whether MongoDB is reachable
+ */
+const checkHealth = async () => {
+  if (mongoose.connection.readyState !== 1) {
+    setHealthy(false, `connection state ${mongoose.connection.readyState}`);
+    return false;
+  }
+  try {
+    await mongoose.connection.db.admin().ping({ maxTimeMS: config.mongodb.pingTimeoutMS });
+    setHealthy(true);
+    return true;
+  } catch (error) {
+    setHealthy(false, error.message);
+    return false;
+  }
+};
+
+/**
+ * Follow driver connection events so readiness changes right away rather than
+ * at the next ping
+ */
+const watchConnection = () => {
+  mongoose.connection.on('connected', () => setHealthy(true));
+  mongoose.connection.on('reconnected', () => setHealthy(true));
+  mongoose.connection.on('disconnected', () => setHealthy(false, 'disconnected'));
+  mongoose.connection.on('error', (error) => setHealthy(false, error.message));
+};
+
+const hasErrorLabel = (error, label) => {
+  return typeof error.hasErrorLabel === 'function' && error.hasErrorLabel(label);
+};
+
+// Commit, retrying while the outcome of the commit is unknown
+const commitWithRetry = async (session, maxAttempts) => {
+  for (let attempt = 1; ; attempt++) {
+    try {
+      return await session.commitTransaction();
+    } catch (error) {
+      if (!hasErrorLabel(error, 'UnknownTransactionCommitResult') || attempt >= maxAttempts) {
+        throw error;
+      }
+      logger.warn('Retrying transaction commit', { attempt, reason: error.message });
+    }
+  }
+};
+
+/**
+ * Decide whether to use transactions, once connected. They need a replica
+ * set or sharded cluster. In 'auto' mode they are used when the server
+ * supports them; MONGODB_TRANSACTIONS=true makes a server without support
+ * an error, and false switches them off.
+ * @returns {Promise<boolean>} - Whether transactions are used
+ * @throws {Error} when transactions are required but not supported
+ */
+const detectTransactionSupport = async () => {
+  const { mode } = config.mongodb.transactions;
+  if (mode === 'false') {
+    transactionsEnabled = false;
+    return false;
+  }
+
+  const hello = await mongoose.connection.db.admin().command({ hello: 1 });
+  const supported = Boolean(hello.setName) || hello.msg === 'isdbgrid';
+  if (!supported && mode === 'true') {
+    throw new Error('MONGODB_TRANSACTIONS=true but MongoDB is a standalone server; ' +
+      'run it as a replica set or set MONGODB_TRANSACTIONS=false');
+  }
+  if (!supported) {
+    logger.warn('MongoDB is a standalone server; multi-document writes run without transactions');
+  }
+  transactionsEnabled = supported;
+  return supported;
+};
+
+// Wait before rerunning a transaction, longer after each attempt and with
+// jitter so two conflicting transactions don't retry in lockstep
+const waitBeforeRetry = (attempt) => {
+  const { retryDelayMs } = config.mongodb.transactions;
+  const delay = attempt * retryDelayMs * (1 + Math.random());
+  return new Promise(resolve => setTimeout(resolve, delay));
+};
+
+/**
+ * Run fn in a transaction, so its writes are applied together or not at all.
+ * Transient transaction errors (write conflicts, elections) rerun the whole
+ * of fn after a short wait, so fn should build the documents it saves
+ * itself rather than reuse ones from an earlier attempt. Without transactions (see
+ * detectTransactionSupport) fn runs once without a session.
+ * @param {Function} fn - async (session) => result; pass session to every read and write
+ * @returns {Promise<*>} - What fn returned
+ */
+const withTransaction = async (fn) => {
+  const { maxAttempts } = config.mongodb.transactions;
+  if (!transactionsEnabled) {
+    return fn(null);
+  }
+
+  const session = await mongoose.startSession();
+  try {
+    for (let attempt = 1; ; attempt++) {
+      session.startTransaction({ readConcern: { level: 'snapshot' }, writeConcern: { w: 'majority' } });
+      let result;
+      try {
+        result = await fn(session);
+      } catch (error) {
+        if (session.inTransaction()) {
+          await session.abortTransaction();
+        }
+        if (hasErrorLabel(error, 'TransientTransactionError') && attempt < maxAttempts) {
+          logger.warn('Retrying transaction', { attempt, reason: error.message });
+          await waitBeforeRetry(attempt);
+          continue;
+        }
+        throw error;
+      }
+      try {
+        await commitWithRetry(session, maxAttempts);
+        return result;
+      } catch (error) {
+        if (hasErrorLabel(error, 'TransientTransactionError') && attempt < maxAttempts) {
+          logger.warn('Retrying transaction', { attempt, reason: error.message });
+          await waitBeforeRetry(attempt);
+          continue;
+        }
+        throw error;
+      }
+    }
+  } finally {
+    await session.endSession();
+  }
+};
+
+/**
+ * Current database readiness, as last observed
+ * @returns {Object} - { healthy, lastCheckedAt }
+ */
+const getHealth = () => ({ healthy, lastCheckedAt });
+
+module.exports = {
+  getConnectionOptions,
+  checkHealth,
+  watchConnection,
+  getHealth,
+  detectTransactionSupport,
+  withTransaction
+};
@@ -0,0 +1,148 @@
+const Notification = require('../models/notification.model');
+const Suppression = require('../models/suppression.model');
+const logger = require('../utils/logger');
+
+// SMS failures SNS reports that retrying won't fix
+const PERMANENT_SMS_FAILURE = /opted out|invalid phone number|not a valid|unknown subscriber/i;
+
+// Addresses are compared case-insensitively for email and digits-only for SMS
+const normalizeAddress = (channel, address) => {
+  const trimmed = String(address).trim();
+  return channel === 'email' ? trimmed.toLowerCase() : trimmed.replace(/[^\d+]/g, '');
+};
+
+/**
+ * Whether sends to an address are suppressed
+ * @param {string} channel - 'email' or 'sms'
+ * @param {string} address - Email address or phone number
+ * @returns {Promise<boolean>}
+ */
+const isSuppressed = async (channel, address) => {
+  return !!(await Suppression.exists({ channel, address: normalizeAddress(channel, address) }));
+};
+
+/**
+ * Stop sending to an address. The first reason recorded is kept.
+ * @param {string} channel - 'email' or 'sms'
+ * @param {string} address - Email address or phone number
+ * @param {string} reason - 'bounce', 'complaint', 'sms-failure' or 'manual'
+ * @param {Object} details - detail and messageId of the send that caused it
+ */
+const suppress = async (channel, address, reason, details = {}) => {
+  await Suppression.updateOne(
+    { channel, address: normalizeAddress(channel, address) },
+    { $setOnInsert: { reason, detail: details.detail, messageId: details.messageId } },
+    { upsert: true }
+  );
+  logger.warn('Address suppressed', { channel, reason, messageId: details.messageId });
+};
+
+/**
+ * Read a delivery event from a feedback queue message: an SES event, wrapped
+ * in an SNS notification or delivered raw, or an SNS SMS delivery status record
+ * @param {string|Object} body - The message body
+ * @returns {Object|null} - { channel, messageId, status, detail, suppress },
+ * or null for events that aren't tracked (sends, opens, clicks)
+ */
+const parseFeedback = (body) => {
+  let event = typeof body === 'string' ? JSON.parse(body) : body;
+  if (event.Type === 'Notification' && typeof event.Message === 'string') {
+    event = JSON.parse(event.Message);
+  }
+
+  const sesType = event.eventType || event.notificationType;
+  if (sesType && event.mail) {
+    const messageId = event.mail.messageId;
+    if (sesType === 'Delivery') {
+      return { channel: 'email', messageId, status: 'delivered', suppress: [] };
+    }
+    if (sesType === 'Bounce') {
+      const { bounceType, bounceSubType, bouncedRecipients = [] } = event.bounce;
+      // Transient bounces (full mailbox, greylisting) may still go through later
+      return {
+        channel: 'email',
+        messageId,
+        status: 'bounced',
+        detail: `${bounceType}/${bounceSubType}`,
+        suppress: bounceType === 'Permanent'
+          ? bouncedRecipients.map(recipient => ({ address: recipient.emailAddress, reason: 'bounce', detail: recipient.diagnosticCode }))
+          : []
+      };
+    }
+    if (sesType === 'Complaint') {
+      const { complaintFeedbackType, complainedRecipients = [] } = event.complaint;
+      return {
+        channel: 'email',
+        messageId,
+        status: 'complained',
+        detail: complaintFeedbackType,
+        suppress: complainedRecipients.map(recipient => ({ address: recipient.emailAddress, reason: 'complaint', detail: complaintFeedbackType }))
+      };
+    }
+    return null;
+  }
+
+  if (event.notification && event.delivery && event.status) {
+    const delivered = event.status === 'SUCCESS';
+    const detail = event.delivery.providerResponse;
+    return {
+      channel: 'sms',
+      messageId: event.notification.messageId,
+      status: delivered ? 'delivered' : 'failed',
+      detail,
+      suppress: !delivered && PERMANENT_SMS_FAILURE.test(detail || '')
+        ? [{ address: event.delivery.destination, reason: 'sms-failure', detail }]
+        : []
+    };
+  }
+
+  return null;
+};
+
+/**
+ * Record a delivery event on the notification it was sent for. A complaint
+ * comes after delivery, so it doesn't mark the notification failed.
+ * @param {string} messageId - Provider message ID
+ * @param {string} status - Delivery status
+ * @param {string} detail - Provider detail, if any
+ */
+const recordDelivery = async (messageId, status, detail) => {
+  const now = new Date();
+  const set = { 'delivery.status': status, 'delivery.updatedAt': now, updatedAt: now };
+  if (detail) {
+    set['delivery.detail'] = detail;
+  }
+  if (status === 'delivered') {
+    set.status = 'delivered';
+  } else if (status === 'bounced' || status === 'failed') {
+    set.status = 'failed';
+  }
+  await Notification.updateOne({ 'delivery.messageId': messageId }, { $set: set });
+};
+
+/**
+ * Apply one feedback queue message: suppress addresses that bounced hard,
+ * complained or can't receive SMS, and update the notification's delivery status
+ * @param {string|Object} body - The message body
+ * @returns {Promise<Object|null>} - The parsed feedback, or null when ignored
+ */
+const handleFeedback = async (body) => {
+  const feedback = parseFeedback(body);
+  if (!feedback) {
+    return null;
+  }
+  for (const entry of feedback.suppress) {
+    await suppress(feedback.channel, entry.address, entry.reason, { detail: entry.detail, messageId: feedback.messageId });
+  }
+  await recordDelivery(feedback.messageId, feedback.status, feedback.detail);
+  return feedback;
+};
+
+module.exports = {
+  normalizeAddress,
+  isSuppressed,
+  suppress,
+  parseFeedback,
+  recordDelivery,
+  handleFeedback
+};
@@ -0,0 +1,70 @@
+const sqsService = require('./aws/sqs.service');
+const DeliveryService = require('./delivery.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+let running = false;
+
+/**
+ * Apply one batch from the delivery feedback queue. Messages that can't be
+ * parsed are dropped; any other failure leaves the message to be received
+ * again once its visibility timeout lapses.
+ * @param {string} queueUrl - The feedback queue
+ */
+const processBatch = async (queueUrl) => {
+  const response = await sqsService.receiveMessages(10, queueUrl);
+  for (const message of response.Messages || []) {
+    try {
+      await DeliveryService.handleFeedback(message.Body);
+    } catch (error) {
+      if (!(error instanceof SyntaxError)) {
+        logger.error('Delivery feedback failed:', error);
+        continue;
+      }
+      logger.warn('Unreadable delivery feedback dropped', { messageId: message.MessageId });
+    }
+    await sqsService.deleteMessage(message.ReceiptHandle, queueUrl);
+  }
+};
+
+const poll = async (queueUrl) => {
+  while (running) {
+    try {
+      await processBatch(queueUrl);
+    } catch (error) {
+      logger.error('Delivery feedback poll failed:', error);
+      await new Promise(resolve => setTimeout(resolve, 5000));
+    }
+  }
+};
+
+/**
+ * Start long-polling the delivery feedback queue
+ */
+const start = () => {
+  const { queueUrl } = config.aws.deliveryFeedback;
+  if (!queueUrl) {
+    logger.warn('Delivery feedback worker not started: AWS_SQS_DELIVERY_FEEDBACK_QUEUE_URL is not set');
+    return;
+  }
+  if (running) {
+    return;
+  }
+
+  running = true;
+  logger.info('Delivery feedback worker started');
+  poll(queueUrl);
+};
+
+/**
+ * Stop polling after the current batch
+ */
+const stop = () => {
+  running = false;
+};
+
+module.exports = {
+  processBatch,
+  start,
+  stop
+};
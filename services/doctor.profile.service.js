@@ -0,0 +1,71 @@
+const config = require('../config/config');
+const s3Service = require('./aws/s3.service');
+const ScanService = require('./scan.service');
+
+/**
+ * Whether a doctor's profile changes are subject to review. Only doctors who
+ * are verified and active have a reviewed profile to protect; everyone else
+ * goes through the full approval anyway.
+ * @param {Object} doctor - The doctor
+ * @returns {boolean}
+ */
+const requiresChangeReview = (doctor) => {
+  return doctor.verificationStatus === 'verified' &&
+    doctor.status === 'active' &&
+    config.doctorProfile.reviewedFields.length > 0;
+};
+
+const isSameValue = (a, b) => JSON.stringify(a) === JSON.stringify(b);
+
+/**
+ * Split a profile update into changes that apply now and changes to reviewed
+ * fields that need admin approval. Unchanged reviewed fields are dropped.
+ * @param {Object} doctor - The doctor as stored
+ * @param {Object} updateData - The requested update
+ * @returns {Object} - { immediate, pending } where pending is null when nothing needs review
+ */
+const splitProfileUpdate = (doctor, updateData) => {
+  const immediate = { ...updateData };
+  const pending = {};
+
+  for (const field of config.doctorProfile.reviewedFields) {
+    if (!(field in immediate)) continue;
+    const current = doctor.toObject ? doctor.toObject()[field] : doctor[field];
+    if (!isSameValue(current, immediate[field])) {
+      pending[field] = immediate[field];
+    }
+    delete immediate[field];
+  }
+
+  return {
+    immediate,
+    pending: Object.keys(pending).length > 0 ? pending : null
+  };
+};
+
+/**
+ * Presigned URLs for a doctor's clinic photos. Photos the malware scan hasn't
+ * found clean are left out, or listed without a URL for the doctor.
+ * @param {Object} doctor - The doctor
+ * @param {Object} options - includeQuarantined to list unscanned and infected photos too
+ * @returns {Promise<Object[]>} - { id, url, contentType, scanStatus, uploadedAt } per photo
+ */
+const getClinicPhotoUrls = async (doctor, options = {}) => {
+  const photos = ((doctor.clinicLocation && doctor.clinicLocation.photos) || [])
+    .filter(photo => options.includeQuarantined || ScanService.isServable(photo));
+  return Promise.all(photos.map(async photo => ({
+    id: photo._id,
+    url: ScanService.isServable(photo)
+      ? await s3Service.getDownloadUrl(photo.key, config.clinicPhotos.urlTtlSeconds)
+      : null,
+    contentType: photo.contentType,
+    scanStatus: photo.scan && photo.scan.status ? photo.scan.status : 'clean',
+    uploadedAt: photo.uploadedAt
+  })));
+};
+
+module.exports = {
+  requiresChangeReview,
+  splitProfileUpdate,
+  getClinicPhotoUrls
+};
@@ -0,0 +1,105 @@
+const crypto = require('crypto');
+const jwt = require('jsonwebtoken');
+const DoctorView = require('../models/doctor.view.model');
+const Appointment = require('../models/appointment.model');
+const config = require('../config/config');
+
+const DAY_MS = 24 * 60 * 60 * 1000;
+
+const toDay = (date) => date.toISOString().slice(0, 10);
+
+/**
+ * Who is viewing, for deduping. Profile pages are public, so a bearer token
+ * is only decoded when present; anonymous viewers are told apart by IP and
+ * user agent.
+ * @param {Object} req - Express request
+ * @returns {Object} - { viewerKey, userId }
+ */
+const getViewer = (req) => {
+  const authHeader = req.headers.authorization;
+  if (authHeader && authHeader.startsWith('Bearer ')) {
+    try {
+      const { userId } = jwt.verify(authHeader.split(' ')[1], config.jwt.secret, { algorithms: ['HS256'] });
+      if (userId) {
+        return { viewerKey: `user:${userId}`, userId: String(userId) };
+      }
+    } catch (error) {
+      // Invalid or expired tokens count as anonymous views
+    }
+  }
+  const hash = crypto.createHash('sha256')
+    .update(`${req.ip}|${req.get('user-agent') || ''}`)
+    .digest('hex');
+  return { viewerKey: `anon:${hash}`, userId: null };
+};
+
+/**
+ * Count a profile view, at most once per viewer per doctor per UTC day
+ * @param {string} doctorId - Doctor viewed
+ * @param {string} viewerKey - From getViewer
+ * @param {Date} now - Time of the view
+ * @returns {Promise<boolean>} - Whether this was the viewer's first view today
+ */
+const recordView = async (doctorId, viewerKey, now = new Date()) => {
+  try {
+    const result = await DoctorView.updateOne(
+      { doctorId, day: toDay(now), viewerKey },
+      { $setOnInsert: { viewedAt: now } },
+      { upsert: true }
+    );
+    return result.upsertedCount > 0;
+  } catch (error) {
+    // Two simultaneous first views: the other one counted it
+    if (error.code === 11000) {
+      return false;
+    }
+    throw error;
+  }
+};
+
+/**
+ * Views per day over the last days, and how many appointments were booked
+ * in the same period
+ * @param {string} doctorId - Doctor's profile ID
+ * @param {Object} options - days and now
+ * @returns {Promise<Object>} - { from, to, views, bookings, conversionRate, daily }
+ */
+const getViewStats = async (doctorId, options = {}) => {
+  const days = options.days || config.doctorViews.statsDefaultDays;
+  const now = options.now || new Date();
+  const to = toDay(now);
+  const fromDate = new Date(Date.parse(to) - (days - 1) * DAY_MS);
+  const from = toDay(fromDate);
+
+  const [counts, bookings] = await Promise.all([
+    DoctorView.aggregate([
+      { $match: { doctorId, day: { $gte: from, $lte: to } } },
+      { $group: { _id: '$day', views: { $sum: 1 } } }
+    ]),
+    Appointment.countDocuments({ doctorId, createdAt: { $gte: fromDate, $lte: now } })
+  ]);
+
+  const viewsByDay = new Map(counts.map(count => [count._id, count.views]));
+  const daily = [];
+  for (let i = 0; i < days; i++) {
+    const day = toDay(new Date(fromDate.getTime() + i * DAY_MS));
+    daily.push({ day, views: viewsByDay.get(day) || 0 });
+  }
+  const views = daily.reduce((sum, entry) => sum + entry.views, 0);
+
+  return {
+    from,
+    to,
+    views,
+    bookings,
+    // Bookings per view; null until the profile has been viewed
+    conversionRate: views > 0 ? Math.round((bookings / views) * 10000) / 10000 : null,
+    daily
+  };
+};
+
+module.exports = {
+  getViewer,
+  recordView,
+  getViewStats
+};
@@ -0,0 +1,44 @@
+const Document = require('../models/document.model');
+const DocumentAccessLog = require('../models/document.access.log.model');
+const s3Service = require('./aws/s3.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+/**
+ * An appointment's documents, newest first
+ * @param {string} appointmentId - The appointment ID
+ * @param {Object} options - includeKeys to keep the storage keys, for presigning
+ * @returns {Promise<Object[]>}
+ */
+const getAppointmentDocuments = (appointmentId, options = {}) => {
+  return Document.find({ appointmentId })
+    .select(options.includeKeys ? '' : '-key')
+    .sort({ createdAt: -1 });
+};
+
+/**
+ * Short-lived presigned URL for a document. The access is logged first so no
+ * download goes unrecorded.
+ * @param {Object} document - The document, including its key
+ * @param {Object} access - userId, role, ip and userAgent of the requester
+ * @returns {Promise<string>}
+ */
+const getLoggedDownloadUrl = async (document, access) => {
+  await DocumentAccessLog.create({
+    documentId: document._id,
+    userId: access.userId,
+    role: access.role,
+    action: 'download',
+    ip: access.ip,
+    userAgent: access.userAgent
+  });
+
+  const url = await s3Service.getDownloadUrl(document.key, config.documents.downloadUrlTtlSeconds);
+  logger.info('Document downloaded', { documentId: document._id, userId: access.userId });
+  return url;
+};
+
+module.exports = {
+  getAppointmentDocuments,
+  getLoggedDownloadUrl
+};
@@ -1,5 +1,6 @@
 const nodemailer = require('nodemailer');
 const logger = require('../utils/logger');
+const { formatCurrency } = require('../utils/currency');
 
 class EmailService {
   constructor() {
@@ -145,6 +146,9 @@ class EmailService {
 
   async sendAppointmentConfirmation(to, appointmentDetails) {
     const subject = 'Appointment Confirmation';
+    const fee = appointmentDetails.fee != null
+      ? formatCurrency(appointmentDetails.fee, appointmentDetails.currency)
+      : null;
     const html = `
       <h1>Appointment Confirmed</h1>
       <p>Your appointment has been confirmed with the following details:</p>
@@ -153,9 +157,13 @@ class EmailService {
         <li>Time: ${appointmentDetails.time}</li>
         <li>Doctor: ${appointmentDetails.doctorName}</li>
         <li>Type: ${appointmentDetails.type}</li>
+        ${appointmentDetails.confirmationCode ? `<li>Confirmation code: ${appointmentDetails.confirmationCode}</li>` : ''}
+        ${fee ? `<li>Fee: ${fee}</li>` : ''}
       </ul>
     `;
-    const text = `Your appointment has been confirmed for ${appointmentDetails.date} at ${appointmentDetails.time} with Dr. ${appointmentDetails.doctorName}.`;
+    const code = appointmentDetails.confirmationCode ? ` Confirmation code: ${appointmentDetails.confirmationCode}.` : '';
+    const feeText = fee ? ` Fee: ${fee}.` : '';
+    const text = `Your appointment has been confirmed for ${appointmentDetails.date} at ${appointmentDetails.time} with Dr. ${appointmentDetails.doctorName}.${code}${feeText}`;
 
     return this.sendEmail({ to, subject, text, html });
   }
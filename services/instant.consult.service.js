@@ -0,0 +1,466 @@
+const { v4: uuidv4 } = require('uuid');
+const InstantConsult = require('../models/instant.consult.model');
+const Doctor = require('../models/doctor.model');
+const Appointment = require('../models/appointment.model');
+const VideoSession = require('../models/video.model');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+const { minutesToTime } = require('../utils/helpers');
+const { isFinalStatus, transitionStatus } = require('./appointment.status.service');
+const { findSoonestOptions } = require('./urgent.service');
+const notificationService = require('./notification.service');
+const WebhookService = require('./webhook.service');
+const { withoutBlockingDoctors } = require('./block.service');
+
+const MINUTE_MS = 60 * 1000;
+
+/**
+ * Whether a doctor counts as online for instant consults: toggled on, with a
+ * heartbeat within INSTANT_CONSULT_HEARTBEAT_SECONDS
+ * @param {Object} doctor - The doctor
+ * @param {Date} now - Reference time
+ * @returns {boolean}
+ */
+const isDoctorOnline = (doctor, now = new Date()) => {
+  const state = doctor.instantConsult;
+  if (!state || !state.online || !state.lastSeenAt) {
+    return false;
+  }
+  return now.getTime() - new Date(state.lastSeenAt).getTime() <= config.instantConsult.heartbeatTimeoutSeconds * 1000;
+};
+
+// Query for verified doctors in a specialty whose heartbeat is recent
+const onlineDoctorQuery = (specialty, now) => ({
+  specializations: specialty,
+  verificationStatus: 'verified',
+  status: { $ne: 'suspended' },
+  'instantConsult.online': true,
+  'instantConsult.lastSeenAt': { $gte: new Date(now.getTime() - config.instantConsult.heartbeatTimeoutSeconds * 1000) }
+});
+
+/**
+ * Order free online doctors for the next match: the one who has waited
+ * longest since their last match first, then the one online longest
+ * @param {Object[]} doctors - Online doctors
+ * @param {Set<string>} busyIds - IDs of doctors already in a consult
+ * @returns {Object[]} - The free doctors, best first
+ */
+const rankDoctors = (doctors, busyIds = new Set()) => {
+  const time = (value) => (value ? new Date(value).getTime() : 0);
+  return doctors
+    .filter(doctor => !busyIds.has(doctor._id.toString()))
+    .sort((a, b) =>
+      time(a.instantConsult.lastMatchedAt) - time(b.instantConsult.lastMatchedAt) ||
+      time(a.instantConsult.onlineSince) - time(b.instantConsult.onlineSince));
+};
+
+/**
+ * Online doctors in a specialty, with the ones free for a consult ranked
+ * @param {string} specialty - The specialty
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object>} - { online, free }
+ */
+const getOnlineDoctors = async (specialty, now = new Date()) => {
+  const online = await Doctor.find(onlineDoctorQuery(specialty, now)).populate('userId', 'lastName');
+  const busy = await InstantConsult.find({
+    status: 'matched',
+    doctorId: { $in: online.map(doctor => doctor._id) }
+  }).select('doctorId');
+  const busyIds = new Set(busy.map(consult => consult.doctorId.toString()));
+  return { online, free: rankDoctors(online, busyIds) };
+};
+
+// Take the first doctor nobody else matched meanwhile; lastMatchedAt serves
+// as the version, so concurrent matchers can't both get the same doctor
+const claimDoctor = async (doctors, now) => {
+  for (const doctor of doctors) {
+    const claimed = await Doctor.findOneAndUpdate(
+      { _id: doctor._id, 'instantConsult.lastMatchedAt': doctor.instantConsult.lastMatchedAt || null },
+      { $set: { 'instantConsult.lastMatchedAt': now } },
+      { new: true }
+    );
+    if (claimed) {
+      return doctor;
+    }
+  }
+  return null;
+};
+
+// Confirmed video appointment starting now, for a matched consult
+const buildConsultAppointment = (consult, doctor, now) => {
+  const { durationMinutes } = config.instantConsult;
+  const date = new Date(now);
+  date.setUTCHours(0, 0, 0, 0);
+  const start = now.getUTCHours() * 60 + now.getUTCMinutes();
+  return new Appointment({
+    doctorId: doctor._id,
+    patientId: consult.patientId,
+    date,
+    startTime: minutesToTime(start),
+    endTime: minutesToTime(Math.min(start + durationMinutes, 24 * 60 - 1)),
+    type: 'video',
+    reason: consult.reason,
+    fee: doctor.consultationFee,
+    durationMinutes,
+    status: 'confirmed',
+    statusHistory: [{ from: 'pending', to: 'confirmed', actor: 'system', reason: 'Instant consult', at: now }]
+  });
+};
+
+/**
+ * Match a waiting request with a doctor: create the appointment and video
+ * session and tell both sides
+ * @param {Object} consult - The waiting request
+ * @param {Object} doctor - The claimed doctor, with userId populated
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object|null>} - The matched request, or null when it
+ * stopped waiting meanwhile
+ */
+const startConsult = async (consult, doctor, now) => {
+  const matched = await InstantConsult.findOneAndUpdate(
+    { _id: consult._id, status: 'waiting' },
+    { $set: { status: 'matched', doctorId: doctor._id, matchedAt: now } },
+    { new: true }
+  );
+  if (!matched) {
+    return null;
+  }
+
+  const appointment = buildConsultAppointment(matched, doctor, now);
+  try {
+    await appointment.save();
+    const session = await VideoSession.create({
+      appointmentId: appointment._id,
+      doctorId: doctor._id,
+      patientId: matched.patientId,
+      roomId: `instant-${uuidv4()}`,
+      sessionToken: uuidv4(),
+      status: 'scheduled'
+    });
+    matched.appointmentId = appointment._id;
+    matched.videoSessionId = session._id;
+    await matched.save();
+    await WebhookService.publishAppointmentEvent('appointment.created', appointment);
+
+    const doctorName = doctor.userId ? `Dr. ${doctor.userId.lastName}` : 'Your doctor';
+    await notificationService.sendInstantConsultMatched(appointment, doctor, doctorName)
+      .catch(error => logger.error('Instant consult match notice failed:', error));
+    return matched;
+  } catch (error) {
+    // Back to the queue so the next run can try again
+    await Appointment.deleteOne({ _id: appointment._id });
+    await InstantConsult.updateOne(
+      { _id: matched._id, status: 'matched' },
+      { $set: { status: 'waiting' }, $unset: { doctorId: 1, matchedAt: 1 } }
+    );
+    throw error;
+  }
+};
+
+/**
+ * Match waiting requests for a specialty with free online doctors, oldest
+ * request first
+ * @param {string} specialty - The specialty
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object[]>} - The requests matched
+ */
+const matchWaiting = async (specialty, now = new Date()) => {
+  const matched = [];
+  for (;;) {
+    const { free } = await getOnlineDoctors(specialty, now);
+    if (free.length === 0) {
+      break;
+    }
+    // Oldest request first; one whose patient every free doctor blocked
+    // keeps its place while the requests behind it are matched
+    const waiting = await InstantConsult.find({ status: 'waiting', specialty }).sort({ createdAt: 1 });
+    let progressed = false;
+    for (const consult of waiting) {
+      const doctor = await claimDoctor(await withoutBlockingDoctors(free, consult.patientId), now);
+      if (doctor) {
+        const result = await startConsult(consult, doctor, now);
+        if (result) {
+          matched.push(result);
+        }
+        progressed = true;
+        break;
+      }
+    }
+    if (!progressed) {
+      break;
+    }
+  }
+  return matched;
+};
+
+/**
+ * Put a matched request back in the queue because its doctor became
+ * unavailable before joining. The appointment is cancelled and the request
+ * keeps its original place.
+ * @param {Object} consult - The matched request; its appointment and video
+ * session may be populated
+ * @param {Date} now - Reference time
+ * @returns {Promise<boolean>} - Whether it was requeued
+ */
+const requeueConsult = async (consult, now = new Date()) => {
+  const requeued = await InstantConsult.findOneAndUpdate(
+    { _id: consult._id, status: 'matched' },
+    {
+      $set: { status: 'waiting' },
+      $unset: { doctorId: 1, appointmentId: 1, videoSessionId: 1, matchedAt: 1 },
+      $inc: { requeueCount: 1 }
+    },
+    { new: true }
+  );
+  if (!requeued) {
+    return false;
+  }
+
+  if (consult.videoSessionId) {
+    await VideoSession.updateOne({ _id: consult.videoSessionId._id }, { $set: { status: 'cancelled', updatedAt: now } });
+  }
+  const appointment = consult.appointmentId && await Appointment.findById(consult.appointmentId._id);
+  if (appointment && !isFinalStatus(appointment.status)) {
+    await transitionStatus(appointment, 'cancelled', {
+      actor: 'system',
+      reason: 'The doctor became unavailable for the instant consult',
+      set: { cancellationCategory: 'doctor_unavailable' }
+    }).catch(error => logger.warn('Could not cancel requeued instant consult appointment', { appointmentId: appointment._id, error: error.message }));
+  }
+  await notificationService.sendInstantConsultRequeued(requeued)
+    .catch(error => logger.error('Instant consult requeue notice failed:', error));
+  return true;
+};
+
+// Whether the doctor has joined a consult's video session
+const hasDoctorJoined = (session) => {
+  return !!(session && session.participants && session.participants.doctor && session.participants.doctor.joinedAt);
+};
+
+/**
+ * Turn a doctor's instant consult availability on or off. Turning it on also
+ * serves as the heartbeat and matches waiting patients; turning it off sends
+ * patients matched with the doctor who haven't started back to the queue.
+ * @param {Object} doctor - The doctor
+ * @param {boolean} online - The new state
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object>} - The doctor's instant consult state
+ */
+const setDoctorOnline = async (doctor, online, now = new Date()) => {
+  const wasOnline = isDoctorOnline(doctor, now);
+  const update = online
+    ? { $set: { 'instantConsult.online': true, 'instantConsult.lastSeenAt': now, ...(wasOnline ? {} : { 'instantConsult.onlineSince': now }) } }
+    : { $set: { 'instantConsult.online': false }, $unset: { 'instantConsult.onlineSince': 1 } };
+  const updated = await Doctor.findByIdAndUpdate(doctor._id, update, { new: true });
+
+  if (online) {
+    for (const specialty of updated.specializations) {
+      await matchWaiting(specialty, now);
+    }
+  } else {
+    const matched = await InstantConsult.find({ doctorId: doctor._id, status: 'matched' })
+      .populate('videoSessionId', 'participants');
+    for (const consult of matched) {
+      if (!hasDoctorJoined(consult.videoSessionId)) {
+        await requeueConsult(consult, now);
+        await matchWaiting(consult.specialty, now);
+      }
+    }
+  }
+  return getDoctorState(updated, now);
+};
+
+/**
+ * A doctor's instant consult state with the consult they were matched with, if any
+ * @param {Object} doctor - The doctor
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object>} - { online, onlineSince, lastSeenAt, heartbeatSeconds, consult }
+ */
+const getDoctorState = async (doctor, now = new Date()) => {
+  const consult = await InstantConsult.findOne({ doctorId: doctor._id, status: 'matched' });
+  const state = doctor.instantConsult || {};
+  return {
+    online: isDoctorOnline(doctor, now),
+    onlineSince: state.onlineSince || null,
+    lastSeenAt: state.lastSeenAt || null,
+    heartbeatSeconds: config.instantConsult.heartbeatTimeoutSeconds,
+    consult: consult && {
+      id: consult._id,
+      appointmentId: consult.appointmentId,
+      videoSessionId: consult.videoSessionId,
+      reason: consult.reason,
+      matchedAt: consult.matchedAt
+    }
+  };
+};
+
+/**
+ * Scheduled soonest appointments offered when no instant consult is possible
+ * @param {string} specialty - The specialty
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object[]>}
+ */
+const getFallbackOptions = (specialty, now = new Date()) => {
+  return findSoonestOptions([specialty], [], { now });
+};
+
+/**
+ * Join the instant consult queue for a specialty. Nobody is queued while no
+ * doctor in the specialty is online; the soonest scheduled slots are offered
+ * instead.
+ * @param {string} patientId - The patient
+ * @param {Object} request - specialty and reason
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object>} - { consult, created } or { consult: null, fallback }
+ */
+const requestConsult = async (patientId, request, now = new Date()) => {
+  const open = await InstantConsult.findOne({ patientId, status: { $in: InstantConsult.OPEN_STATUSES } });
+  if (open) {
+    return { consult: open, created: false };
+  }
+
+  const { online } = await getOnlineDoctors(request.specialty, now);
+  if (online.length === 0) {
+    return { consult: null, fallback: await getFallbackOptions(request.specialty, now) };
+  }
+
+  const consult = await InstantConsult.create({
+    patientId,
+    specialty: request.specialty,
+    reason: request.reason,
+    status: 'waiting'
+  });
+  await matchWaiting(request.specialty, now);
+  return { consult: await InstantConsult.findById(consult._id), created: true };
+};
+
+/**
+ * Where a request stands: its place in the queue and how many doctors are
+ * online while waiting, the appointment and video session once matched, and
+ * scheduled alternatives once it expired or nobody is online
+ * @param {Object} consult - The request
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object>}
+ */
+const getConsultStatus = async (consult, now = new Date()) => {
+  const status = {
+    id: consult._id,
+    status: consult.status,
+    specialty: consult.specialty,
+    reason: consult.reason,
+    requestedAt: consult.createdAt,
+    requeueCount: consult.requeueCount
+  };
+  if (consult.status === 'waiting') {
+    const [ahead, { online, free }] = await Promise.all([
+      InstantConsult.countDocuments({ status: 'waiting', specialty: consult.specialty, createdAt: { $lt: consult.createdAt } }),
+      getOnlineDoctors(consult.specialty, now)
+    ]);
+    status.position = ahead + 1;
+    status.onlineDoctors = online.length;
+    status.freeDoctors = free.length;
+    status.expiresAt = new Date(new Date(consult.createdAt).getTime() + config.instantConsult.maxWaitMinutes * MINUTE_MS);
+    if (online.length === 0) {
+      status.fallback = await getFallbackOptions(consult.specialty, now);
+    }
+  } else if (consult.status === 'matched') {
+    status.doctorId = consult.doctorId;
+    status.appointmentId = consult.appointmentId;
+    status.videoSessionId = consult.videoSessionId;
+    status.matchedAt = consult.matchedAt;
+  } else if (consult.status === 'expired') {
+    status.fallback = await getFallbackOptions(consult.specialty, now);
+  }
+  return status;
+};
+
+/**
+ * Leave the queue. Only waiting requests can be cancelled; a matched one is
+ * cancelled through its appointment.
+ * @param {Object} consult - The request
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object|null>} - The cancelled request, or null when it wasn't waiting
+ */
+const cancelConsult = (consult, now = new Date()) => {
+  return InstantConsult.findOneAndUpdate(
+    { _id: consult._id, status: 'waiting' },
+    { $set: { status: 'cancelled', endedAt: now } },
+    { new: true }
+  );
+};
+
+/**
+ * Scheduled job: requeue matches whose doctor went offline or didn't join in
+ * time, close matched consults whose appointment is over, expire requests
+ * that waited too long, then match what's left
+ * @param {Date} now - Reference time
+ * @returns {Promise<Object>} - Counts of closed, requeued, expired and matched requests
+ */
+const processQueue = async (now = new Date()) => {
+  const { durationMinutes, joinTimeoutMinutes, maxWaitMinutes } = config.instantConsult;
+  const result = { closed: 0, requeued: 0, expired: 0, matched: 0 };
+
+  const matched = await InstantConsult.find({ status: 'matched' })
+    .populate('appointmentId', 'status')
+    .populate('videoSessionId', 'status participants')
+    .populate('doctorId', 'instantConsult');
+  for (const consult of matched) {
+    const appointment = consult.appointmentId;
+    const session = consult.videoSessionId;
+    const since = now.getTime() - consult.matchedAt.getTime();
+
+    if (appointment && !isFinalStatus(appointment.status) && !hasDoctorJoined(session)) {
+      const doctorGone = !consult.doctorId || !isDoctorOnline(consult.doctorId, now);
+      if ((doctorGone || since >= joinTimeoutMinutes * MINUTE_MS) && await requeueConsult(consult, now)) {
+        result.requeued++;
+      }
+      continue;
+    }
+
+    // Over once the appointment is, or once its time is up and the call isn't running
+    const callRunning = session && session.status === 'active';
+    if (!appointment || isFinalStatus(appointment.status) || (since >= durationMinutes * MINUTE_MS && !callRunning)) {
+      const closed = await InstantConsult.updateOne(
+        { _id: consult._id, status: 'matched' },
+        { $set: { status: appointment && appointment.status !== 'cancelled' ? 'completed' : 'cancelled', endedAt: now } }
+      );
+      result.closed += closed.modifiedCount;
+    }
+  }
+
+  const expiredBefore = new Date(now.getTime() - maxWaitMinutes * MINUTE_MS);
+  const stale = await InstantConsult.find({ status: 'waiting', createdAt: { $lt: expiredBefore } });
+  for (const consult of stale) {
+    const expired = await InstantConsult.findOneAndUpdate(
+      { _id: consult._id, status: 'waiting' },
+      { $set: { status: 'expired', endedAt: now } },
+      { new: true }
+    );
+    if (expired) {
+      result.expired++;
+      await notificationService.sendInstantConsultExpired(expired)
+        .catch(error => logger.error('Instant consult expiry notice failed:', error));
+    }
+  }
+
+  const specialties = await InstantConsult.distinct('specialty', { status: 'waiting' });
+  for (const specialty of specialties) {
+    result.matched += (await matchWaiting(specialty, now)).length;
+  }
+  return result;
+};
+
+module.exports = {
+  isDoctorOnline,
+  rankDoctors,
+  getOnlineDoctors,
+  matchWaiting,
+  requeueConsult,
+  setDoctorOnline,
+  getDoctorState,
+  getFallbackOptions,
+  requestConsult,
+  getConsultStatus,
+  cancelConsult,
+  processQueue
+};
@@ -0,0 +1,137 @@
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const config = require('../config/config');
+
+// Policy numbers differ per insurer; this only rules out obvious typos
+const POLICY_NUMBER_PATTERN = /^[A-Z0-9][A-Z0-9-]{4,29}$/i;
+
+// Columns of the claims export, in CSV order
+const CLAIM_COLUMNS = [
+  'appointmentId',
+  'confirmationCode',
+  'treatmentDate',
+  'startTime',
+  'appointmentType',
+  'consultationType',
+  'patientName',
+  'patientDob',
+  'insurer',
+  'policyNumber',
+  'doctorName',
+  'doctorRegistrationNumber',
+  'specialty',
+  'amount',
+  'currency',
+  'paidAt',
+  'paymentReference'
+];
+
+// The configured spelling of an insurer name, matched case-insensitively
+const findInsurer = (name) => {
+  const normalized = name.trim().toLowerCase();
+  return config.insurance.insurers.find(insurer => insurer.toLowerCase() === normalized);
+};
+
+/**
+ * Why insurance details can't be saved, per field
+ * @param {Object} insurance - { insurer, policyNumber }
+ * @returns {Object|null} - Field errors, or null when valid
+ */
+const getInsuranceErrors = (insurance) => {
+  const errors = {};
+  const insurers = config.insurance.insurers;
+  if (typeof insurance.insurer !== 'string' || !insurance.insurer.trim()) {
+    errors['insurance.insurer'] = 'Insurer is required';
+  } else if (insurers.length > 0 && !findInsurer(insurance.insurer)) {
+    errors['insurance.insurer'] = `Insurer must be one of: ${insurers.join(', ')}`;
+  }
+  if (typeof insurance.policyNumber !== 'string' || !POLICY_NUMBER_PATTERN.test(insurance.policyNumber.trim())) {
+    errors['insurance.policyNumber'] = 'Policy number must be 5 to 30 letters, digits or dashes';
+  }
+  return Object.keys(errors).length > 0 ? errors : null;
+};
+
+/**
+ * Insurance details as stored, from validated input
+ * @param {Object} insurance - { insurer, policyNumber }
+ * @returns {Object}
+ */
+const normalizeInsurance = (insurance) => ({
+  insurer: findInsurer(insurance.insurer) || insurance.insurer.trim(),
+  policyNumber: insurance.policyNumber.trim().toUpperCase(),
+  updatedAt: new Date()
+});
+
+/**
+ * Completed, paid appointments of a patient in a period, each with its
+ * payment and doctor
+ * @param {string} patientId - The patient
+ * @param {Date} from - Start of the period, by appointment date
+ * @param {Date} to - End of the period
+ * @returns {Promise<Object[]>} - [{ appointment, payment }], oldest first
+ */
+const getClaimableAppointments = async (patientId, from, to) => {
+  const appointments = await Appointment.find({
+    patientId,
+    status: 'completed',
+    date: { $gte: from, $lte: to }
+  })
+    .populate({ path: 'doctorId', select: 'registrationNumber specializations userId', populate: { path: 'userId', select: 'firstName lastName' } })
+    .sort({ date: 1, startTime: 1 });
+
+  const payments = await Payment.find({
+    appointmentId: { $in: appointments.map(appointment => appointment._id) },
+    status: 'success',
+    // Reschedule fees aren't treatment and aren't claimable
+    purpose: { $ne: 'reschedule-fee' }
+  });
+  const paymentsByAppointment = new Map(payments.map(payment => [payment.appointmentId.toString(), payment]));
+
+  return appointments
+    .filter(appointment => paymentsByAppointment.has(appointment._id.toString()))
+    .map(appointment => ({ appointment, payment: paymentsByAppointment.get(appointment._id.toString()) }));
+};
+
+/**
+ * One claim row keyed by CLAIM_COLUMNS. Appointments booked for a dependent
+ * carry the dependent's name and date of birth; the amount is what was paid
+ * less any partial refund.
+ * @param {Object} claim - { appointment, payment } from getClaimableAppointments
+ * @param {Object} patient - The account holder, with insurance
+ * @returns {Object}
+ */
+const toClaimRow = ({ appointment, payment }, patient) => {
+  const doctor = appointment.doctorId || {};
+  const doctorUser = doctor.userId || {};
+  const dependent = appointment.patientDetails && appointment.patientDetails.name ? appointment.patientDetails : null;
+  const dob = dependent ? dependent.dob : patient.dob;
+  const insurance = patient.insurance || {};
+  return {
+    appointmentId: appointment._id.toString(),
+    confirmationCode: appointment.confirmationCode || null,
+    treatmentDate: appointment.date.toISOString().slice(0, 10),
+    startTime: appointment.startTime,
+    appointmentType: appointment.type,
+    consultationType: appointment.consultationType ? appointment.consultationType.name : null,
+    patientName: dependent ? dependent.name : `${patient.firstName} ${patient.lastName}`,
+    patientDob: dob ? new Date(dob).toISOString().slice(0, 10) : null,
+    insurer: insurance.insurer || null,
+    policyNumber: insurance.policyNumber || null,
+    doctorName: doctorUser.firstName ? `${doctorUser.firstName} ${doctorUser.lastName}` : null,
+    doctorRegistrationNumber: doctor.registrationNumber || null,
+    specialty: (doctor.specializations || [])[0] || null,
+    amount: Math.round((payment.amount - (payment.refundedAmount || 0)) * 100) / 100,
+    currency: payment.currency,
+    paidAt: payment.paidAt,
+    paymentReference: payment.transactionId || payment._id.toString()
+  };
+};
+
+module.exports = {
+  POLICY_NUMBER_PATTERN,
+  CLAIM_COLUMNS,
+  getInsuranceErrors,
+  normalizeInsurance,
+  getClaimableAppointments,
+  toClaimRow
+};
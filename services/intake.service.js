@@ -0,0 +1,133 @@
+const Doctor = require('../models/doctor.model');
+const IntakeForm = require('../models/intake.form.model');
+
+const CHOICE_TYPES = ['choice', 'multi-choice'];
+
+/**
+ * Find the intake form for an appointment, from the doctor's specializations
+ * in the order the doctor listed them
+ * @param {Object} appointment - The appointment
+ * @returns {Promise<Object|null>} - The active form, or null when none of the
+ * doctor's specialties has one
+ */
+const getIntakeFormForAppointment = async (appointment) => {
+  const doctor = await Doctor.findById(appointment.doctorId).select('specializations');
+  if (!doctor || doctor.specializations.length === 0) {
+    return null;
+  }
+
+  const forms = await IntakeForm.find({ specialty: { $in: doctor.specializations }, isActive: true })
+    .collation(IntakeForm.SPECIALTY_COLLATION);
+  for (const specialty of doctor.specializations) {
+    const form = forms.find(candidate => candidate.specialty.toLowerCase() === specialty.toLowerCase());
+    if (form) {
+      return form;
+    }
+  }
+  return null;
+};
+
+/**
+ * Check a template's questions beyond what the schema enforces
+ * @param {Object[]} questions - Questions as sent by the admin
+ * @returns {Object|null} - Errors keyed by question index, or null when valid
+ */
+const getQuestionErrors = (questions) => {
+  const errors = {};
+  const seen = new Set();
+  questions.forEach((question, index) => {
+    if (seen.has(question.key)) {
+      errors[`questions[${index}].key`] = `Duplicate question key ${question.key}`;
+    }
+    seen.add(question.key);
+    if (CHOICE_TYPES.includes(question.type) && (!Array.isArray(question.options) || question.options.length === 0)) {
+      errors[`questions[${index}].options`] = 'Choice questions need at least one option';
+    }
+    if (question.min != null && question.max != null && question.min > question.max) {
+      errors[`questions[${index}].min`] = 'min must not be greater than max';
+    }
+  });
+  return Object.keys(errors).length > 0 ? errors : null;
+};
+
+const getAnswerError = (question, value) => {
+  switch (question.type) {
+    case 'text':
+      if (typeof value !== 'string') return 'Must be text';
+      if (value.length > question.maxLength) return `Must be at most ${question.maxLength} characters`;
+      return null;
+    case 'number':
+      if (typeof value !== 'number' || !Number.isFinite(value)) return 'Must be a number';
+      if (question.min != null && value < question.min) return `Must be at least ${question.min}`;
+      if (question.max != null && value > question.max) return `Must be at most ${question.max}`;
+      return null;
+    case 'boolean':
+      return typeof value === 'boolean' ? null : 'Must be true or false';
+    case 'choice':
+      return question.options.includes(value) ? null : `Must be one of: ${question.options.join(', ')}`;
+    case 'multi-choice':
+      if (!Array.isArray(value) || !value.every(item => question.options.includes(item))) {
+        return `Must be a list of: ${question.options.join(', ')}`;
+      }
+      return null;
+    default:
+      return 'Unsupported question type';
+  }
+};
+
+const isBlank = (value) => value === undefined || value === null || value === ''
+  || (Array.isArray(value) && value.length === 0);
+
+/**
+ * Validate patient answers against a form
+ * @param {Object} form - The intake form
+ * @param {Object} answers - Answers keyed by question key
+ * @returns {Object|null} - Errors keyed by question key, or null when valid
+ */
+const getIntakeAnswerErrors = (form, answers) => {
+  const errors = {};
+  const keys = new Set(form.questions.map(question => question.key));
+  Object.keys(answers).forEach(key => {
+    if (!keys.has(key)) {
+      errors[key] = 'Unknown question';
+    }
+  });
+  form.questions.forEach(question => {
+    const value = answers[question.key];
+    if (isBlank(value)) {
+      if (question.required) {
+        errors[question.key] = 'This question is required';
+      }
+      return;
+    }
+    const error = getAnswerError(question, value);
+    if (error) {
+      errors[question.key] = error;
+    }
+  });
+  return Object.keys(errors).length > 0 ? errors : null;
+};
+
+/**
+ * Snapshot validated answers for storing on the appointment. Labels are kept
+ * so the answers stay readable if the form is edited later.
+ * @param {Object} form - The intake form
+ * @param {Object} answers - Answers keyed by question key
+ * @returns {Object} - The appointment's intake field
+ */
+const buildIntake = (form, answers) => ({
+  formId: form._id,
+  specialty: form.specialty,
+  version: form.version,
+  answers: form.questions
+    .filter(question => !isBlank(answers[question.key]))
+    .map(question => ({ key: question.key, label: question.label, value: answers[question.key] })),
+  submittedAt: new Date()
+});
+
+module.exports = {
+  getIntakeFormForAppointment,
+  getQuestionErrors,
+  getIntakeAnswerErrors,
+  buildIntake
+};
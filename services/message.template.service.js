@@ -0,0 +1,45 @@
+const config = require('../config/config');
+
+// Values a template can pull from the appointment the message is sent in
+const PLACEHOLDERS = {
+  patientFirstName: (context) => (context.patient && context.patient.firstName) || '',
+  patientLastName: (context) => (context.patient && context.patient.lastName) || '',
+  doctorLastName: (context) => (context.doctorUser && context.doctorUser.lastName) || '',
+  appointmentDate: (context) => new Date(context.appointment.date)
+    .toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' }),
+  appointmentTime: (context) => context.appointment.startTime
+};
+
+const PLACEHOLDER_PATTERN = /\{\{\s*(\w+)\s*\}\}/g;
+
+/**
+ * Why a template's content can't be saved
+ * @param {string} content - The template text
+ * @returns {string|null} - The problem, or null when valid
+ */
+const getTemplateContentError = (content) => {
+  const unknown = [...content.matchAll(PLACEHOLDER_PATTERN)]
+    .map(match => match[1])
+    .filter(name => !PLACEHOLDERS[name]);
+  if (unknown.length > 0) {
+    return `Unknown placeholders: ${[...new Set(unknown)].join(', ')}. Available: ${Object.keys(PLACEHOLDERS).join(', ')}`;
+  }
+  return null;
+};
+
+/**
+ * Fill in a template's placeholders for one appointment
+ * @param {string} content - The template text
+ * @param {Object} context - appointment, patient and doctorUser (users with
+ * firstName and lastName)
+ * @returns {string} - The message text
+ */
+const expandTemplate = (content, context) => {
+  return content.replace(PLACEHOLDER_PATTERN, (match, name) => (PLACEHOLDERS[name] ? PLACEHOLDERS[name](context) : match));
+};
+
+module.exports = {
+  TEMPLATE_PLACEHOLDERS: Object.keys(PLACEHOLDERS),
+  getTemplateContentError,
+  expandTemplate
+};
@@ -1,19 +1,40 @@
 const Notification = require('../models/notification.model');
 const User = require('../models/user.model');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const config = require('../config/config');
 const { sendEmail, sendSMS } = require('./aws.service');
 const snsService = require('./aws/sns.service');
 const sqsService = require('./aws/sqs.service');
+const { getAppointmentStart } = require('../utils/helpers');
+const { formatCurrency } = require('../utils/currency');
+const { buildFrontendLink, buildAppointmentLink, buildVideoJoinLink, buildRebookLink, buildPaymentLink } = require('../utils/links');
+const AvailabilityService = require('./availability.service');
+const { createBookingToken } = require('./recommendation.service');
+const { getReminderSettings } = require('./reminder.service');
+const { getActivePrepInstructions, selectPrepInstructions, appendPrepInstructions } = require('./prep.service');
+
+// Record a send on its notification; a null message ID means the address is suppressed
+const setDelivery = (notification, messageId) => {
+  notification.status = messageId ? 'sent' : 'failed';
+  notification.delivery = messageId
+    ? { messageId, status: 'sent', updatedAt: new Date() }
+    : { status: 'suppressed', updatedAt: new Date() };
+};
 
 /**
- * Create and send a notification to a user
+ * Create and send a notification to a user. SMS goes only to users who have
+ * consented to it; for anyone else the message is kept as an in-app notification.
  * @param {string} userId - The user's ID
  * @param {string} title - The notification title
  * @param {string} message - The notification message
- * @param {string} type - The notification type ('email', 'sms', 'push')
+ * @param {string} type - The notification type ('email', 'sms', 'push', 'in-app')
  * @param {Object} relatedTo - Optional related entity info
+ * @param {string} link - Optional deep link shown with the message
+ * @param {Object} data - Optional structured details stored with the notification
  * @returns {Promise<Object>} - The created notification
  */
-const sendNotification = async (userId, title, message, type = 'email', relatedTo = null) => {
+const sendNotification = async (userId, title, message, type = 'email', relatedTo = null, link = null, data = null) => {
   try {
     // Create the notification record
     const notification = new Notification({
@@ -22,7 +43,9 @@ const sendNotification = async (userId, title, message, type = 'email', relatedT
       message,
       type,
       status: 'pending',
-      relatedTo
+      relatedTo,
+      link,
+      data
     });
     
     // Get the user for contact info
@@ -31,21 +54,31 @@ const sendNotification = async (userId, title, message, type = 'email', relatedT
       throw new Error('User not found');
     }
     
-    // Send the notification based on type
+    if (type === 'sms' && !(user.smsConsent && user.smsConsent.granted)) {
+      notification.type = 'in-app';
+      type = 'in-app';
+    }
+    
+    // Send the notification based on type. No message ID comes back when the
+    // address is suppressed; SES/SNS feedback updates delivery later.
     if (type === 'email' && user.email) {
-      await sendEmail(
+      const linkHtml = link ? `<p><a href="${link}">${link}</a></p>` : '';
+      const messageId = await sendEmail(
         user.email,
         title,
-        `<h2>${title}</h2><p>${message}</p>`,
-        message
+        `<h2>${title}</h2><p>${message}</p>${linkHtml}`,
+        link ? `${message}\n\n${link}` : message
       );
-      notification.status = 'sent';
-    } else if (type === 'sms' && user.phone) {
-      await sendSMS(
-        user.phone,
-        `${title}: ${message}`
+      setDelivery(notification, messageId);
+    } else if (type === 'sms' && user.phone && user.phone.number) {
+      const messageId = await sendSMS(
+        `${user.phone.countryCode}${user.phone.number}`,
+        link ? `${title}: ${message} ${link}` : `${title}: ${message}`
       );
-      notification.status = 'sent';
+      setDelivery(notification, messageId);
+    } else if (type === 'in-app') {
+      // Stored record is what the app shows; nothing to deliver
+      notification.status = 'delivered';
     } else if (type === 'push') {
       // Push notification would be implemented here
       // This is just a placeholder
@@ -63,22 +96,72 @@ const sendNotification = async (userId, title, message, type = 'email', relatedT
 };
 
 /**
- * Send appointment reminders for upcoming appointments
+ * Send one reminder on each of the recipient's reminder channels and record
+ * the lead times it covers
+ * @param {Object} appointment - The appointment
+ * @param {string} role - 'patient' or 'doctor'
+ * @param {Object} user - The recipient
+ * @param {number} minutesUntil - Minutes until the appointment starts
+ * @param {Object} content - { message, relatedTo, link, data }
+ * @returns {Promise<number>} - Number of notifications sent
+ */
+const sendParticipantReminder = async (appointment, role, user, minutesUntil, content) => {
+  const settings = getReminderSettings(user);
+  const alreadySent = (appointment.remindersSent && appointment.remindersSent[role]) || [];
+  const due = settings.leadTimesMinutes.filter(lead => lead >= minutesUntil && !alreadySent.includes(lead));
+  if (due.length === 0) {
+    return 0;
+  }
+
+  // Several lead times can fall due at once (e.g. a booking made the day
+  // before); one reminder covers all of them
+  for (const channel of settings.channels) {
+    await sendNotification(
+      user._id,
+      'Appointment Reminder',
+      content.message,
+      channel,
+      content.relatedTo,
+      content.link,
+      content.data
+    );
+  }
+
+  await Appointment.updateOne(
+    { _id: appointment._id },
+    { $addToSet: { [`remindersSent.${role}`]: { $each: due } } }
+  );
+  return settings.channels.length;
+};
+
+/**
+ * Send appointment reminders for upcoming appointments, at the lead times
+ * and on the channels each participant chose in their reminder settings
  * @returns {Promise<number>} - Number of reminders sent
  */
 const sendAppointmentReminders = async () => {
   try {
-    // Get appointments happening in the next 24 hours
+    // Look as far ahead as the longest lead time anyone can pick
     const now = new Date();
-    const tomorrow = new Date(now);
-    tomorrow.setHours(now.getHours() + 24);
+    const horizon = new Date(now.getTime() + Math.max(...config.reminders.allowedLeadTimesMinutes) * 60 * 1000);
+    // From yesterday: in zones behind UTC, yesterday's late appointments are still ahead
+    const dayStart = new Date(now);
+    dayStart.setUTCHours(0, 0, 0, 0);
+    dayStart.setUTCDate(dayStart.getUTCDate() - 1);
     
-    const upcomingAppointments = await Appointment.find({
-      scheduledAt: { $gt: now, $lt: tomorrow },
-      status: 'confirmed'
+    // reminderSent marks appointments the former day-ahead worker already handled
+    const candidates = await Appointment.find({
+      date: { $gte: dayStart, $lte: horizon },
+      status: 'confirmed',
+      reminderSent: { $ne: true }
+    });
+    const upcomingAppointments = candidates.filter(appointment => {
+      const start = getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone);
+      return start > now && start <= horizon;
     });
     
     let reminderCount = 0;
+    const prepInstructions = upcomingAppointments.length > 0 ? await getActivePrepInstructions() : [];
     
     // Send reminders for each appointment
     for (const appointment of upcomingAppointments) {
@@ -87,48 +170,44 @@ const sendAppointmentReminders = async () => {
         Doctor.findById(appointment.doctorId).populate('userId')
       ]);
       
-      if (!patient || !doctor) continue;
+      if (!patient || !doctor || !doctor.userId) continue;
       
       // Format appointment time
-      const apptTime = new Date(appointment.scheduledAt);
-      const timeString = apptTime.toLocaleTimeString('en-US', {
+      const apptTime = getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone);
+      const minutesUntil = (apptTime.getTime() - now.getTime()) / (60 * 1000);
+      // In the doctor's zone, like the times patients booked
+      const timeZone = appointment.timeZone || 'UTC';
+      const timeString = apptTime.toLocaleTimeString(config.locale.defaultLocale, {
+        timeZone,
         hour: '2-digit',
         minute: '2-digit'
       });
-      const dateString = apptTime.toLocaleDateString('en-US', {
+      const dateString = apptTime.toLocaleDateString(config.locale.defaultLocale, {
+        timeZone,
         weekday: 'long',
         month: 'long',
         day: 'numeric'
       });
+      const relatedTo = { model: 'Appointment', id: appointment._id };
+      const link = buildAppointmentLink(appointment._id);
+      // Only the patient needs to know how to prepare
+      const prep = selectPrepInstructions(prepInstructions, doctor.specializations, appointment.type);
       
-      // Send patient reminder
-      await sendNotification(
-        patient._id,
-        'Appointment Reminder',
-        `You have an appointment with Dr. ${doctor.userId.lastName} tomorrow at ${timeString} on ${dateString}.`,
-        'email',
-        { model: 'Appointment', id: appointment._id }
-      );
-      
-      // Send SMS reminder as well
-      await sendNotification(
-        patient._id,
-        'Appointment Reminder',
-        `You have an appointment with Dr. ${doctor.userId.lastName} tomorrow at ${timeString}.`,
-        'sms',
-        { model: 'Appointment', id: appointment._id }
-      );
-      
-      // Send doctor reminder
-      await sendNotification(
-        doctor.userId._id,
-        'Appointment Reminder',
-        `You have an appointment with ${patient.firstName} ${patient.lastName} tomorrow at ${timeString} on ${dateString}.`,
-        'email',
-        { model: 'Appointment', id: appointment._id }
-      );
+      reminderCount += await sendParticipantReminder(appointment, 'patient', patient, minutesUntil, {
+        message: appendPrepInstructions(
+          `You have an appointment with Dr. ${doctor.userId.lastName} at ${timeString} on ${dateString}.`,
+          prep
+        ),
+        relatedTo,
+        link,
+        data: prep ? { prepInstructions: prep } : null
+      });
       
-      reminderCount += 2; // Count both notifications
+      reminderCount += await sendParticipantReminder(appointment, 'doctor', doctor.userId, minutesUntil, {
+        message: `You have an appointment with ${patient.firstName} ${patient.lastName} at ${timeString} on ${dateString}.`,
+        relatedTo,
+        link
+      });
     }
     
     return reminderCount;
@@ -138,6 +217,468 @@ const sendAppointmentReminders = async () => {
   }
 };
 
+/**
+ * Send the video join link to both parties shortly before a video appointment
+ * @returns {Promise<number>} - Number of appointments notified
+ */
+const sendVideoJoinLinks = async () => {
+  try {
+    const now = new Date();
+    const windowEnd = new Date(now.getTime() + config.videoCall.joinLinkLeadMinutes * 60 * 1000);
+    // From yesterday: in zones behind UTC, yesterday's late appointments are still ahead
+    const dayStart = new Date(now);
+    dayStart.setUTCHours(0, 0, 0, 0);
+    dayStart.setUTCDate(dayStart.getUTCDate() - 1);
+    
+    const candidates = await Appointment.find({
+      date: { $gte: dayStart, $lte: windowEnd },
+      type: 'video',
+      status: 'confirmed',
+      joinLinkSent: false
+    });
+    
+    let count = 0;
+    for (const appointment of candidates) {
+      const start = getAppointmentStart(appointment.date, appointment.startTime, appointment.timeZone);
+      if (start < now || start > windowEnd) continue;
+      
+      const doctor = await Doctor.findById(appointment.doctorId);
+      if (!doctor) continue;
+      
+      const relatedTo = { model: 'Appointment', id: appointment._id };
+      const link = buildVideoJoinLink(appointment._id);
+      const message = `Your video consultation starts at ${appointment.startTime}. Use the link below to join.`;
+      
+      await Promise.all([
+        sendNotification(appointment.patientId, 'Video Consultation Starting Soon', message, 'email', relatedTo, link),
+        sendNotification(doctor.userId, 'Video Consultation Starting Soon', message, 'email', relatedTo, link)
+      ]);
+      
+      appointment.joinLinkSent = true;
+      await appointment.save();
+      count++;
+    }
+    
+    return count;
+  } catch (error) {
+    console.error('Error sending video join links:', error);
+    throw error;
+  }
+};
+
+/**
+ * Tell the party waiting in a video call's waiting room that the other one
+ * has joined, in the app and by push
+ * @param {Object} appointment - The video appointment
+ * @param {string} waitingRole - 'patient' or 'doctor', the party to notify
+ * @returns {Promise<void>}
+ */
+const sendWaitingRoomJoinNotice = async (appointment, waitingRole) => {
+  let recipientId = appointment.patientId;
+  if (waitingRole === 'doctor') {
+    const doctor = await Doctor.findById(appointment.doctorId).select('userId');
+    if (!doctor) {
+      return;
+    }
+    recipientId = doctor.userId;
+  }
+
+  const message = waitingRole === 'doctor'
+    ? 'Your patient has joined the video consultation.'
+    : 'Your doctor has joined the video consultation.';
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const link = buildVideoJoinLink(appointment._id);
+  await Promise.all(['in-app', 'push'].map(channel =>
+    sendNotification(recipientId, 'Ready to Start', message, channel, relatedTo, link)
+  ));
+};
+
+/**
+ * Tell the patient their appointment was confirmed
+ * @param {Object} appointment - The confirmed appointment
+ * @returns {Promise<Object>} - The created notification
+ */
+const sendAppointmentConfirmation = async (appointment) => {
+  const link = appointment.type === 'video'
+    ? buildVideoJoinLink(appointment._id)
+    : buildAppointmentLink(appointment._id);
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  const code = appointment.confirmationCode
+    ? ` Your confirmation code is ${appointment.confirmationCode}; show it when you check in.`
+    : '';
+  let fee = '';
+  if (appointment.fee > 0) {
+    const doctor = await Doctor.findById(appointment.doctorId).select('currency');
+    fee = ` The fee is ${formatCurrency(appointment.fee, doctor && doctor.currency)}.`;
+  }
+  
+  return sendNotification(
+    appointment.patientId,
+    'Appointment Confirmed',
+    `Your ${appointment.type} appointment on ${date} at ${appointment.startTime} has been confirmed.${code}${fee}`,
+    'email',
+    { model: 'Appointment', id: appointment._id },
+    link
+  );
+};
+
+/**
+ * Tell a doctor about a booking that was confirmed for them because they
+ * auto-accept bookings, by email and in-app
+ * @param {Object} appointment - The confirmed appointment
+ * @returns {Promise<void>}
+ */
+const sendAutoAcceptedBookingNotice = async (appointment) => {
+  const doctor = await Doctor.findById(appointment.doctorId).select('userId');
+  if (!doctor) {
+    return;
+  }
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  const message = `A ${appointment.type} appointment on ${date} at ${appointment.startTime} was booked and confirmed automatically, as you auto-accept bookings.`;
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const link = buildAppointmentLink(appointment._id);
+
+  await Promise.all(['email', 'in-app'].map(channel =>
+    sendNotification(doctor.userId, 'New Appointment Confirmed', message, channel, relatedTo, link)
+  ));
+};
+
+/**
+ * Tell every admin that an upload was found infected, by email and in-app
+ * @param {Object} details - category, fileId, fileName, uploadedBy and threat
+ * @returns {Promise<void>}
+ */
+const sendInfectedUploadAlert = async (details) => {
+  const admins = await User.find({ role: 'admin', status: 'active' }).select('_id');
+  const message = `The malware scan flagged an upload (${details.category}, "${details.fileName}") ` +
+    `uploaded by user ${details.uploadedBy}: ${details.threat}. The file is not served.`;
+  const data = {
+    category: details.category,
+    fileId: details.fileId ? String(details.fileId) : null,
+    uploadedBy: details.uploadedBy ? String(details.uploadedBy) : null,
+    threat: details.threat
+  };
+  await Promise.all(admins.flatMap(admin => ['email', 'in-app'].map(channel =>
+    sendNotification(admin._id, 'Infected upload quarantined', message, channel, null, null, data)
+  )));
+};
+
+/**
+ * Tell a doctor about a new review on their profile
+ * @param {Object} review - The new review
+ * @returns {Promise<void>}
+ */
+const sendNewReviewNotification = async (review) => {
+  const doctor = await Doctor.findById(review.doctorId).populate('userId');
+  if (!doctor || !doctor.userId) {
+    return;
+  }
+  
+  const snippet = review.comment.length > 100 ? `${review.comment.slice(0, 100)}...` : review.comment;
+  const title = 'New Review';
+  const message = `You received a ${review.rating}-star review: "${snippet}"`;
+  const relatedTo = { model: 'Review', id: review._id };
+  const link = buildFrontendLink(`/doctor/reviews/${review._id}`);
+  
+  await sendNotification(doctor.userId._id, title, message, 'in-app', relatedTo, link);
+  
+  const preferences = doctor.userId.notificationPreferences || {};
+  if (preferences.reviewEmails !== false) {
+    await sendNotification(doctor.userId._id, title, message, 'email', relatedTo, link);
+  }
+};
+
+/**
+ * Ask the doctor to add consultation notes to an appointment that was
+ * completed automatically
+ * @param {Object} appointment - The auto-completed appointment
+ */
+const sendConsultationNotesPrompt = async (appointment) => {
+  const doctor = await Doctor.findById(appointment.doctorId);
+  if (!doctor) {
+    return;
+  }
+  
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  await sendNotification(
+    doctor.userId,
+    'Add Consultation Notes',
+    `Your appointment on ${date} at ${appointment.startTime} was marked completed. Please add your consultation notes.`,
+    'in-app',
+    { model: 'Appointment', id: appointment._id },
+    buildAppointmentLink(appointment._id)
+  );
+};
+
+/**
+ * Invite the patient to the private post-consultation survey
+ * @param {Object} appointment - The completed appointment
+ */
+const sendSurveyInvitation = async (appointment) => {
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  await sendNotification(
+    appointment.patientId,
+    'How was your consultation?',
+    `Please take a minute to tell us about your appointment on ${date} at ${appointment.startTime}. Your answers are only shared with the doctor as part of anonymous totals.`,
+    'email',
+    { model: 'Appointment', id: appointment._id },
+    buildFrontendLink(`/appointments/${appointment._id}/survey`)
+  );
+};
+
+/**
+ * Tell the patient a doctor cancelled their appointment. When enabled, the
+ * doctor's next free slots are offered, each with a token that rebooks it.
+ * @param {Object} appointment - The cancelled appointment
+ * @param {Object} options - offerRebooking (defaults to
+ * config.appointments.rebookOnDoctorCancel.enabled) and after, the time
+ * offered slots must start after (defaults to now)
+ * @returns {Promise<Object[]>} - The rebooking offers that were sent
+ */
+const sendDoctorCancellationNotice = async (appointment, options = {}) => {
+  const doctor = await Doctor.findById(appointment.doctorId).populate('userId', 'lastName');
+  if (!doctor) {
+    return [];
+  }
+
+  const rebookConfig = config.appointments.rebookOnDoctorCancel;
+  let offers = [];
+  const offerRebooking = options.offerRebooking !== undefined ? options.offerRebooking : rebookConfig.enabled;
+  if (offerRebooking) {
+    const slots = await AvailabilityService.getUpcomingFreeSlots(doctor, {
+      count: rebookConfig.slotCount,
+      duration: appointment.durationMinutes,
+      type: appointment.type,
+      now: options.after,
+      exclude: { date: new Date(appointment.date).toISOString().slice(0, 10), startTime: appointment.startTime }
+    });
+    offers = slots.map(slot => {
+      const bookingToken = createBookingToken(doctor._id, slot, appointment.symptoms || [], {
+        ttlMinutes: rebookConfig.tokenTtlHours * 60
+      });
+      return { ...slot, bookingToken, link: buildRebookLink(bookingToken) };
+    });
+  }
+
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  const doctorName = doctor.userId ? `Dr. ${doctor.userId.lastName}` : 'Your doctor';
+  let message = `${doctorName} had to cancel your appointment on ${date} at ${appointment.startTime}.`;
+  if (appointment.cancellationReason) {
+    message += ` Reason: ${appointment.cancellationReason}.`;
+  }
+  if (offers.length > 0) {
+    const options = offers.map(offer => {
+      const offerDate = new Date(offer.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+      return `${offerDate} at ${offer.startTime}: ${offer.link}`;
+    });
+    message += ` You can rebook with one of these times: ${options.join(' | ')}`;
+  }
+
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const data = {
+    rebookOptions: offers.map(({ date: offerDate, startTime, endTime, bookingToken }) => ({ date: offerDate, startTime, endTime, bookingToken }))
+  };
+  const link = offers.length > 0 ? offers[0].link : buildFrontendLink(`/doctors/${doctor._id}`);
+
+  await Promise.all([
+    sendNotification(appointment.patientId, 'Appointment Cancelled', message, 'email', relatedTo, link, data),
+    sendNotification(appointment.patientId, 'Appointment Cancelled', message, 'in-app', relatedTo, link, data)
+  ]);
+
+  return offers;
+};
+
+/**
+ * Ask a patient to reschedule an appointment the doctor's new working hours
+ * no longer cover. The appointment itself stays booked.
+ * @param {Object} appointment - The appointment
+ * @param {string} doctorName - e.g. "Dr. Jansen"
+ * @returns {Promise<void>}
+ */
+const sendScheduleConflictNotice = async (appointment, doctorName) => {
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  const message = `${doctorName} has changed their working hours and your appointment on ${date} at ${appointment.startTime} no longer fits them. It is still booked, but please reschedule it to another time.`;
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const link = buildAppointmentLink(appointment._id);
+
+  await Promise.all([
+    sendNotification(appointment.patientId, 'Please Reschedule Your Appointment', message, 'email', relatedTo, link),
+    sendNotification(appointment.patientId, 'Please Reschedule Your Appointment', message, 'in-app', relatedTo, link)
+  ]);
+};
+
+/**
+ * Remind a doctor that a booking still awaits their confirmation. The last
+ * reminder also goes by SMS.
+ * @param {Object} appointment - The pending appointment
+ * @param {Object} options - deadline (when it is cancelled) and final
+ * (whether this is the last reminder)
+ * @returns {Promise<void>}
+ */
+const sendPendingConfirmationReminder = async (appointment, options) => {
+  const doctor = await Doctor.findById(appointment.doctorId).select('userId');
+  if (!doctor) {
+    return;
+  }
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  const deadline = options.deadline.toLocaleString(config.locale.defaultLocale, {
+    timeZone: appointment.timeZone || 'UTC',
+    dateStyle: 'medium',
+    timeStyle: 'short'
+  });
+  const title = options.final ? 'Last Reminder: Booking Awaiting Confirmation' : 'Booking Awaiting Confirmation';
+  const message = `A ${appointment.type} appointment on ${date} at ${appointment.startTime} is waiting for your confirmation. Unless you confirm it, it will be cancelled and the patient refunded at ${deadline}.`;
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const link = buildAppointmentLink(appointment._id);
+  const channels = options.final ? ['email', 'sms'] : ['email', 'in-app'];
+
+  await Promise.all(channels.map(channel =>
+    sendNotification(doctor.userId, title, message, channel, relatedTo, link)
+  ));
+};
+
+/**
+ * Tell a patient their booking was cancelled because the doctor didn't
+ * confirm it in time
+ * @param {Object} appointment - The cancelled appointment
+ * @param {number} refunded - Amount refunded
+ * @returns {Promise<void>}
+ */
+const sendUnconfirmedCancellationNotice = async (appointment, refunded) => {
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  let message = `Your appointment on ${date} at ${appointment.startTime} wasn't confirmed by the doctor in time, so it has been cancelled.`;
+  if (refunded > 0) {
+    message += ' Your payment has been refunded in full.';
+  }
+  message += ' You can book another time or doctor.';
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const link = buildFrontendLink('/doctors');
+
+  await Promise.all([
+    sendNotification(appointment.patientId, 'Appointment Not Confirmed', message, 'email', relatedTo, link),
+    sendNotification(appointment.patientId, 'Appointment Not Confirmed', message, 'in-app', relatedTo, link)
+  ]);
+};
+
+/**
+ * Remind a patient to pay for a booking before it is cancelled for being
+ * unpaid, by email and SMS, with the payment link
+ * @param {Object} appointment - The pending, unpaid appointment
+ * @param {Date} deadline - When it is cancelled unless paid
+ * @returns {Promise<void>}
+ */
+const sendPaymentReminder = async (appointment, deadline) => {
+  const date = new Date(appointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+  const payBy = deadline.toLocaleString(config.locale.defaultLocale, {
+    timeZone: appointment.timeZone || 'UTC',
+    timeStyle: 'short'
+  });
+  let fee = '';
+  if (appointment.fee > 0) {
+    const doctor = await Doctor.findById(appointment.doctorId).select('currency');
+    fee = ` of ${formatCurrency(appointment.fee, doctor && doctor.currency)}`;
+  }
+  const message = `Your appointment on ${date} at ${appointment.startTime} isn't paid yet. Please complete the payment${fee} by ${payBy} to keep your slot; otherwise it will be cancelled.`;
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const link = buildPaymentLink(appointment._id);
+
+  await Promise.all(['email', 'sms'].map(channel =>
+    sendNotification(appointment.patientId, 'Complete Your Payment', message, channel, relatedTo, link)
+  ));
+};
+
+/**
+ * Tell both sides of an instant consult that they were matched, in the app
+ * and by push, with the link into the video call
+ * @param {Object} appointment - The instant consult's appointment
+ * @param {Object} doctor - The matched doctor, with userId
+ * @param {string} doctorName - e.g. "Dr. Jansen"
+ * @returns {Promise<void>}
+ */
+const sendInstantConsultMatched = async (appointment, doctor, doctorName) => {
+  const relatedTo = { model: 'Appointment', id: appointment._id };
+  const link = buildVideoJoinLink(appointment._id);
+  await Promise.all(['in-app', 'push'].flatMap(channel => [
+    sendNotification(appointment.patientId, 'Your Doctor Is Ready', `${doctorName} is ready for your consult. Join the video call now.`, channel, relatedTo, link),
+    sendNotification(doctor.userId, 'Instant Consult', `A patient is waiting for you: ${appointment.reason}`, channel, relatedTo, link)
+  ]));
+};
+
+/**
+ * Tell a patient their matched doctor became unavailable and they are back
+ * in the instant consult queue
+ * @param {Object} consult - The requeued instant consult request
+ * @returns {Promise<void>}
+ */
+const sendInstantConsultRequeued = async (consult) => {
+  const message = 'Your doctor is no longer available. You keep your place in the queue and will be matched with the next available doctor.';
+  const relatedTo = { model: 'InstantConsult', id: consult._id };
+  await Promise.all(['in-app', 'push'].map(channel =>
+    sendNotification(consult.patientId, 'Back in the Queue', message, channel, relatedTo)
+  ));
+};
+
+/**
+ * Tell a patient no doctor became free in time for their instant consult
+ * @param {Object} consult - The expired instant consult request
+ * @returns {Promise<void>}
+ */
+const sendInstantConsultExpired = async (consult) => {
+  const message = 'No doctor became available for your instant consult. Please book one of the next available appointments instead.';
+  const relatedTo = { model: 'InstantConsult', id: consult._id };
+  const link = buildFrontendLink(`/consult/instant/${consult._id}`);
+  await Promise.all(['in-app', 'push'].map(channel =>
+    sendNotification(consult.patientId, 'No Doctor Available', message, channel, relatedTo, link)
+  ));
+};
+
+/**
+ * Tell a patient they were referred to a specialist, listing recommended
+ * doctors with their next free slot and a link that books it
+ * @param {Object} referral - The referral
+ * @param {Object[]} recommendations - From ReferralService.getRecommendedDoctors
+ * @param {Object} linkedAppointment - Appointment the referring doctor booked, if any
+ * @returns {Promise<Object>} - The in-app notification
+ */
+const sendReferralNotice = async (referral, recommendations, linkedAppointment = null) => {
+  const referringDoctor = await Doctor.findById(referral.referringDoctorId).populate('userId', 'lastName');
+  const doctorName = referringDoctor && referringDoctor.userId ? `Dr. ${referringDoctor.userId.lastName}` : 'Your doctor';
+
+  let message = `${doctorName} has referred you to a ${referral.specialty}.`;
+  if (referral.note) {
+    message += ` Note: ${referral.note}`;
+  }
+  if (linkedAppointment) {
+    const date = new Date(linkedAppointment.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+    message += ` An appointment has been requested for you on ${date} at ${linkedAppointment.startTime}.`;
+  } else if (recommendations.length > 0) {
+    const options = recommendations.map(r => {
+      if (!r.nextSlot) {
+        return r.name;
+      }
+      const date = new Date(r.nextSlot.date).toLocaleDateString(config.locale.defaultLocale, { timeZone: 'UTC' });
+      return `${r.name}, first available ${date} at ${r.nextSlot.startTime}: ${buildRebookLink(r.bookingToken)}`;
+    });
+    message += ` Recommended doctors: ${options.join(' | ')}`;
+  }
+
+  const relatedTo = { model: 'Referral', id: referral._id };
+  const link = linkedAppointment
+    ? buildAppointmentLink(linkedAppointment._id)
+    : buildFrontendLink(`/referrals/${referral._id}`);
+  const data = {
+    referralId: referral._id,
+    linkedAppointmentId: linkedAppointment ? linkedAppointment._id : null,
+    recommendations: recommendations.map(({ doctorId, name, nextSlot, bookingToken }) => ({ doctorId, name, nextSlot, bookingToken }))
+  };
+
+  const [, inApp] = await Promise.all([
+    sendNotification(referral.patientId, 'New Referral', message, 'email', relatedTo, link, data),
+    sendNotification(referral.patientId, 'New Referral', message, 'in-app', relatedTo, link, data)
+  ]);
+  return inApp;
+};
+
 /**
  * Get user notifications
  * @param {string} userId - The user's ID
@@ -190,6 +731,80 @@ const markNotificationAsRead = async (notificationId, userId) => {
 };
 
 class NotificationService {
+  // Scheduled job: reminders for confirmed appointments, per user settings
+  async sendUpcomingReminders() {
+    return sendAppointmentReminders();
+  }
+
+  // Scheduled job: join links shortly before video appointments
+  async sendVideoJoinLinks() {
+    return sendVideoJoinLinks();
+  }
+
+  async sendAppointmentConfirmation(appointment) {
+    return sendAppointmentConfirmation(appointment);
+  }
+
+  async sendWaitingRoomJoinNotice(appointment, waitingRole) {
+    return sendWaitingRoomJoinNotice(appointment, waitingRole);
+  }
+
+  async sendNewReviewNotification(review) {
+    return sendNewReviewNotification(review);
+  }
+
+  async sendInfectedUploadAlert(details) {
+    return sendInfectedUploadAlert(details);
+  }
+
+  async sendConsultationNotesPrompt(appointment) {
+    return sendConsultationNotesPrompt(appointment);
+  }
+
+  async sendDoctorCancellationNotice(appointment, options) {
+    return sendDoctorCancellationNotice(appointment, options);
+  }
+
+  async sendSurveyInvitation(appointment) {
+    return sendSurveyInvitation(appointment);
+  }
+
+  async sendScheduleConflictNotice(appointment, doctorName) {
+    return sendScheduleConflictNotice(appointment, doctorName);
+  }
+
+  async sendReferralNotice(referral, recommendations, linkedAppointment) {
+    return sendReferralNotice(referral, recommendations, linkedAppointment);
+  }
+
+  async sendAutoAcceptedBookingNotice(appointment) {
+    return sendAutoAcceptedBookingNotice(appointment);
+  }
+
+  async sendPendingConfirmationReminder(appointment, options) {
+    return sendPendingConfirmationReminder(appointment, options);
+  }
+
+  async sendUnconfirmedCancellationNotice(appointment, refunded) {
+    return sendUnconfirmedCancellationNotice(appointment, refunded);
+  }
+
+  async sendPaymentReminder(appointment, deadline) {
+    return sendPaymentReminder(appointment, deadline);
+  }
+
+  async sendInstantConsultMatched(appointment, doctor, doctorName) {
+    return sendInstantConsultMatched(appointment, doctor, doctorName);
+  }
+
+  async sendInstantConsultRequeued(consult) {
+    return sendInstantConsultRequeued(consult);
+  }
+
+  async sendInstantConsultExpired(consult) {
+    return sendInstantConsultExpired(consult);
+  }
+
   // Send immediate notification
   async sendNotification(userId, notification) {
     try {
@@ -229,8 +844,9 @@ class NotificationService {
       message: `Reminder: Your appointment is scheduled for ${new Date(appointment.datetime).toLocaleString()}`
     };
 
-    // Send SMS to patient
-    if (appointment.patientPhone) {
+    // Send SMS to patient, if they consented to it
+    const patient = await User.findById(appointment.patientId).select('smsConsent');
+    if (appointment.patientPhone && patient && patient.smsConsent && patient.smsConsent.granted) {
       await snsService.sendSMS(
         appointment.patientPhone,
         message.message
@@ -263,10 +879,11 @@ class NotificationService {
   async sendPaymentNotification(payment) {
     const notification = {
       type: 'PAYMENT_STATUS',
-      message: `Payment ${payment.status} for appointment #${payment.appointmentId}`,
+      message: `Payment of ${formatCurrency(payment.amount, payment.currency)} ${payment.status} for appointment #${payment.appointmentId}`,
       data: {
         paymentId: payment._id,
         amount: payment.amount,
+        currency: payment.currency,
         status: payment.status
       }
     };
@@ -0,0 +1,114 @@
+const Notification = require('../models/notification.model');
+const QueueJob = require('../models/queue.job.model');
+const sqsService = require('./aws/sqs.service');
+const WebhookService = require('./webhook.service');
+const logger = require('../utils/logger');
+
+// Handlers per job type. Each must be safe to run twice for the same jobId.
+const jobHandlers = {
+  async STORE_NOTIFICATION(job) {
+    const { userId, notification } = job;
+    await Notification.updateOne(
+      { jobId: job.jobId },
+      {
+        $setOnInsert: {
+          jobId: job.jobId,
+          userId,
+          title: notification.title || notification.type,
+          message: notification.message,
+          type: 'in-app',
+          status: 'delivered',
+          createdAt: notification.timestamp ? new Date(notification.timestamp) : new Date()
+        }
+      },
+      { upsert: true }
+    );
+  },
+
+  async DELIVER_WEBHOOK(job, receiveCount) {
+    await WebhookService.deliver(job.deliveryId, receiveCount);
+  }
+};
+
+/**
+ * Process one queue message, recording the attempt on its QueueJob
+ * @param {Object} message - The SQS message
+ * @param {number} receiveCount - How many times SQS has delivered it
+ */
+const handleMessage = async (message, receiveCount) => {
+  const body = JSON.parse(message.Body);
+  const jobId = body.jobId || message.MessageId;
+
+  const job = await QueueJob.findOneAndUpdate(
+    { jobId },
+    { $setOnInsert: { jobId, type: body.type, payload: body } },
+    { upsert: true, new: true }
+  );
+
+  // Redelivery of a job that already went through
+  if (job.status === 'succeeded') {
+    return;
+  }
+
+  try {
+    const handler = jobHandlers[body.type];
+    if (!handler) {
+      throw new Error(`No handler for job type ${body.type}`);
+    }
+
+    await handler({ ...body, jobId }, receiveCount);
+
+    job.attempts.push({ receiveCount });
+    job.status = 'succeeded';
+    job.completedAt = new Date();
+    await job.save();
+  } catch (error) {
+    job.attempts.push({ receiveCount, error: error.message });
+    job.status = receiveCount >= sqsService.maxReceiveCount ? 'dead' : 'failed';
+    await job.save();
+    throw error;
+  }
+};
+
+let running = false;
+
+const poll = async () => {
+  while (running) {
+    try {
+      await sqsService.processMessages(handleMessage);
+    } catch (error) {
+      logger.error('Notification worker poll failed:', error);
+      await new Promise(resolve => setTimeout(resolve, 5000));
+    }
+  }
+};
+
+/**
+ * Start long-polling the notification queue
+ */
+const start = () => {
+  if (!sqsService.queueUrl) {
+    logger.warn('Notification worker not started: AWS_SQS_QUEUE_URL is not set');
+    return;
+  }
+  if (running) {
+    return;
+  }
+
+  running = true;
+  logger.info('Notification worker started');
+  poll();
+};
+
+/**
+ * Stop polling after the current batch
+ */
+const stop = () => {
+  running = false;
+};
+
+module.exports = {
+  handleMessage,
+  start,
+  stop
+};
@@ -1,8 +1,12 @@
 const User = require('../models/user.model');
 const OTP = require('../models/otp.model');
+const PhoneOtpRequest = require('../models/phone.otp.request.model');
 const emailService = require('./email.service');
 const smsService = require('./sms.service');
+const { sendSMS } = require('./aws.service');
 const { generateOTP } = require('../utils/otp');
+const { normalizePhoneNumber, toE164 } = require('../utils/phone');
+const config = require('../config/config');
 const logger = require('../utils/logger');
 
 class OTPService {
@@ -173,6 +177,130 @@ class OTPService {
     }
   }
 
+  /**
+   * Take one of a phone number's verification sends for the rate limit
+   * window. Atomic, so concurrent requests can't exceed the limit.
+   * @param {string} phoneNumber - The number in E.164 form
+   * @returns {Promise<Date|null>} - null when sent, or when the next code can
+   * be requested if the limit is reached
+   */
+  static async reservePhoneOTPSend(phoneNumber) {
+    const { maxPerWindow, windowMinutes } = config.verification.phoneOtp;
+    const now = new Date();
+    const windowMs = windowMinutes * 60 * 1000;
+
+    await PhoneOtpRequest.updateOne(
+      { phoneNumber },
+      { $pull: { sentAt: { $lte: new Date(now.getTime() - windowMs) } } }
+    );
+    const filter = { phoneNumber, [`sentAt.${maxPerWindow - 1}`]: { $exists: false } };
+    const update = { $push: { sentAt: now }, $set: { expiresAt: new Date(now.getTime() + windowMs) } };
+    let reserved;
+    try {
+      reserved = await PhoneOtpRequest.findOneAndUpdate(filter, update, { upsert: true, new: true });
+    } catch (error) {
+      // The upsert lost a race to create the record, or the number is at its
+      // limit; either way the record exists now
+      if (error.code !== 11000) throw error;
+      reserved = await PhoneOtpRequest.findOneAndUpdate(filter, update, { new: true });
+    }
+    if (reserved) {
+      return null;
+    }
+
+    const record = await PhoneOtpRequest.findOne({ phoneNumber });
+    const oldest = Math.min(...record.sentAt.map(sentAt => sentAt.getTime()));
+    return new Date(oldest + windowMs);
+  }
+
+  /**
+   * Send a signed-in user a code by SMS to verify their phone number. Codes
+   * sent earlier stop working.
+   * @param {Object} user - The user
+   * @returns {Promise<Object>} - { success, expiresAt }, or { success: false,
+   * retryAfter } when too many codes were requested
+   */
+  static async sendPhoneVerificationOTP(user) {
+    const { expiryMinutes } = config.verification.phoneOtp;
+    // Normalized, so the same number typed differently on another account
+    // shares its limit
+    const normalized = normalizePhoneNumber(user.phone);
+    const phoneNumber = toE164(normalized || user.phone);
+    const retryAfter = await this.reservePhoneOTPSend(phoneNumber);
+    if (retryAfter) {
+      return { success: false, retryAfter };
+    }
+
+    await OTP.updateMany(
+      { userId: user._id, type: 'phone', isExpired: false },
+      { $set: { isExpired: true, expiredAt: new Date() } }
+    );
+
+    const otp = generateOTP();
+    const expiresAt = new Date(Date.now() + expiryMinutes * 60 * 1000);
+    await OTP.create({
+      identifier: phoneNumber,
+      userId: user._id,
+      type: 'phone',
+      otp,
+      countryCode: user.phone.countryCode,
+      expiresAt
+    });
+
+    await sendSMS(phoneNumber, `Your Med Connecter verification code is ${otp}. It expires in ${expiryMinutes} minutes.`);
+    logger.info('Phone verification code sent', { userId: user._id });
+
+    return { success: true, expiresAt };
+  }
+
+  /**
+   * Check a phone verification code and mark the user's phone as verified.
+   * A code stops working once used or after too many wrong guesses.
+   * @param {Object} user - The user
+   * @param {string} otp - The code they entered
+   * @returns {Promise<Object>} - { success }, with error when it doesn't match
+   */
+  static async verifyPhoneVerificationOTP(user, otp) {
+    const { maxAttempts } = config.verification.phoneOtp;
+    const otpRecord = await OTP.findOne({
+      userId: user._id,
+      type: 'phone',
+      isExpired: false,
+      attempts: { $lt: maxAttempts },
+      expiresAt: { $gt: new Date() }
+    }).sort({ createdAt: -1 });
+
+    if (!otpRecord) {
+      return { success: false, error: 'Invalid or expired OTP' };
+    }
+
+    if (otpRecord.otp !== otp) {
+      const guessed = await OTP.findOneAndUpdate(
+        { _id: otpRecord._id },
+        { $inc: { attempts: 1 } },
+        { new: true }
+      );
+      if (guessed && guessed.attempts >= maxAttempts) {
+        await OTP.updateOne({ _id: otpRecord._id }, { $set: { isExpired: true, expiredAt: new Date() } });
+      }
+      return { success: false, error: 'Invalid or expired OTP' };
+    }
+
+    // Conditional so the same code can't be used twice concurrently
+    const used = await OTP.findOneAndUpdate(
+      { _id: otpRecord._id, isExpired: false, attempts: { $lt: maxAttempts } },
+      { $set: { isExpired: true, expiredAt: new Date() } }
+    );
+    if (!used) {
+      return { success: false, error: 'Invalid or expired OTP' };
+    }
+
+    await User.updateOne({ _id: user._id }, { $set: { isPhoneVerified: true } });
+    logger.info('Phone verified', { userId: user._id });
+
+    return { success: true, message: 'Phone verified successfully' };
+  }
+
   // Clean up expired OTPs
   static async cleanupExpiredOTPs() {
     try {
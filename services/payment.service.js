@@ -0,0 +1,72 @@
+const config = require('../config/config');
+
+const roundAmount = (amount) => Math.round(amount * 100) / 100;
+
+/**
+ * Commission the platform takes on a doctor's payments. A per-doctor override
+ * takes precedence over the platform-wide percentage.
+ * @param {Object} doctor - The doctor, if known
+ * @returns {number} - Percentage, 0-100
+ */
+const getCommissionPercent = (doctor) => {
+  if (doctor && doctor.commissionPercent != null) {
+    return doctor.commissionPercent;
+  }
+  return config.payments.commissionPercent;
+};
+
+/**
+ * Split an amount into the platform fee and what the doctor receives
+ * @param {number} amount - Amount paid
+ * @param {number} percent - Commission percentage
+ * @returns {{ platformFee: number, doctorNet: number }}
+ */
+const calculateFees = (amount, percent) => {
+  const platformFee = roundAmount(amount * percent / 100);
+  return {
+    platformFee,
+    doctorNet: roundAmount(amount - platformFee)
+  };
+};
+
+/**
+ * Record the commission breakdown on a payment that just succeeded
+ * @param {Object} payment - The payment document
+ * @param {Object} doctor - The doctor being paid
+ */
+const applyCommission = (payment, doctor) => {
+  const percent = getCommissionPercent(doctor);
+  const { platformFee, doctorNet } = calculateFees(payment.amount, percent);
+  payment.commissionPercent = percent;
+  payment.platformFee = platformFee;
+  payment.doctorNet = doctorNet;
+};
+
+/**
+ * Apply a (partial) refund to a payment. The platform fee is reversed in
+ * proportion to the share of the payment refunded.
+ * @param {Object} payment - The payment document
+ * @param {number} amount - Amount refunded now
+ */
+const applyRefund = (payment, amount) => {
+  const refundedBefore = payment.refundedAmount || 0;
+  const refundedTotal = roundAmount(refundedBefore + amount);
+  const remainingShare = (payment.amount - refundedTotal) / payment.amount;
+  const { platformFee } = calculateFees(payment.amount, payment.commissionPercent || 0);
+
+  payment.refundedAmount = refundedTotal;
+  payment.platformFee = roundAmount(platformFee * remainingShare);
+  payment.doctorNet = roundAmount(payment.amount - refundedTotal - payment.platformFee);
+
+  if (refundedTotal >= payment.amount) {
+    payment.status = 'refunded';
+    payment.refundedAt = new Date();
+  }
+};
+
+module.exports = {
+  getCommissionPercent,
+  calculateFees,
+  applyCommission,
+  applyRefund
+};
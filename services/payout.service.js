@@ -0,0 +1,198 @@
+const Payment = require('../models/payment.model');
+const Payout = require('../models/payout.model');
+const PayoutAdjustment = require('../models/payout.adjustment.model');
+const { getCommissionPercent, calculateFees } = require('./payment.service');
+const DatabaseService = require('./database.service');
+const logger = require('../utils/logger');
+const { formatCurrency } = require('../utils/currency');
+
+const roundAmount = (amount) => Math.round(amount * 100) / 100;
+
+/**
+ * What the doctor receives from a payment after the platform commission.
+ * Payments made before fees were recorded fall back to the platform rate.
+ * @param {Object} payment - A successful payment
+ * @returns {number}
+ */
+const getDoctorNet = (payment) => {
+  if (payment.doctorNet != null) {
+    return payment.doctorNet;
+  }
+  return calculateFees(payment.amount, getCommissionPercent()).doctorNet;
+};
+
+/**
+ * Successful payments not yet included in a payout
+ * @param {string} doctorId - The doctor's ID
+ * @param {Date} periodEnd - Only payments made up to this time
+ * @returns {Promise<Object[]>}
+ */
+const getUnpaidOutPayments = async (doctorId, periodEnd = new Date()) => {
+  return Payment.find({
+    doctorId,
+    status: 'success',
+    payoutId: null,
+    paidAt: { $lte: periodEnd }
+  }).sort({ paidAt: 1 });
+};
+
+/**
+ * Adjustments not yet netted against a payout, oldest first
+ * @param {string} doctorId - The doctor's ID
+ * @returns {Promise<Object[]>}
+ */
+const getPendingAdjustments = async (doctorId) => {
+  return PayoutAdjustment.find({ doctorId, payoutId: null }).sort({ createdAt: 1 });
+};
+
+/**
+ * Amount the doctor is owed but hasn't had paid out yet, per currency, after
+ * any clawbacks still to be netted
+ * @param {string} doctorId - The doctor's ID
+ * @returns {Promise<Object[]>} - [{ currency, amount, formattedAmount, payments, adjustments }]
+ */
+const getPendingPayout = async (doctorId) => {
+  const [payments, adjustments] = await Promise.all([
+    getUnpaidOutPayments(doctorId),
+    getPendingAdjustments(doctorId)
+  ]);
+
+  const byCurrency = {};
+  const entryFor = (currency) => {
+    byCurrency[currency] = byCurrency[currency] || { currency, amount: 0, payments: 0, adjustments: 0 };
+    return byCurrency[currency];
+  };
+  payments.forEach(payment => {
+    const entry = entryFor(payment.currency);
+    entry.amount = roundAmount(entry.amount + getDoctorNet(payment));
+    entry.payments += 1;
+  });
+  adjustments.forEach(adjustment => {
+    const entry = entryFor(adjustment.currency);
+    entry.amount = roundAmount(entry.amount + adjustment.amount);
+    entry.adjustments += 1;
+  });
+
+  return Object.values(byCurrency).map(entry => ({
+    ...entry,
+    formattedAmount: formatCurrency(entry.amount, entry.currency)
+  }));
+};
+
+/**
+ * Bundle a doctor's outstanding payments into payouts, one per currency. Each
+ * payment is claimed with a conditional update so it can only ever end up in
+ * one payout, even if two runs overlap, and in the same transaction as the
+ * payout that claims it. Pending clawbacks are netted against the payout,
+ * oldest first, as far as it covers them; the rest wait for the next one.
+ * @param {string} doctorId - The doctor's ID
+ * @param {Date} periodStart - Start of the payout period, for reference
+ * @param {Date} periodEnd - Payments made up to this time are included
+ * @returns {Promise<Object[]>} - The created payouts
+ */
+const createPayouts = async (doctorId, periodStart, periodEnd = new Date()) => {
+  const payments = await getUnpaidOutPayments(doctorId, periodEnd);
+  const currencies = [...new Set(payments.map(payment => payment.currency))];
+  const adjustments = currencies.length > 0 ? await getPendingAdjustments(doctorId) : [];
+
+  const payouts = [];
+  for (const currency of currencies) {
+    const ids = payments
+      .filter(payment => payment.currency === currency)
+      .map(payment => payment._id);
+
+    // The claims and the payout are saved together, so payments are never
+    // left pointing at a payout that failed to save
+    const payout = await DatabaseService.withTransaction(async (session) => {
+      const created = new Payout({ doctorId, currency, periodStart, periodEnd, amount: 0 });
+      await Payment.updateMany(
+        { _id: { $in: ids }, payoutId: null },
+        { $set: { payoutId: created._id } },
+        { session }
+      );
+
+      // Only count the payments this payout actually claimed
+      const claimed = await Payment.find({ payoutId: created._id }).session(session);
+      if (claimed.length === 0) return null;
+
+      created.payments = claimed.map(payment => payment._id);
+      created.amount = roundAmount(claimed.reduce((sum, payment) => sum + getDoctorNet(payment), 0));
+
+      for (const adjustment of adjustments.filter(a => a.currency === currency)) {
+        if (created.amount + adjustment.amount < 0) continue;
+        const taken = await PayoutAdjustment.findOneAndUpdate(
+          { _id: adjustment._id, payoutId: null },
+          { $set: { payoutId: created._id } },
+          { session }
+        );
+        if (!taken) continue;
+        created.adjustments.push(adjustment._id);
+        created.amount = roundAmount(created.amount + adjustment.amount);
+      }
+
+      await created.save({ session });
+      return created;
+    });
+    if (payout) {
+      payouts.push(payout);
+    }
+  }
+
+  if (payouts.length > 0) {
+    logger.info('Created doctor payouts', { doctorId, count: payouts.length });
+  }
+
+  return payouts;
+};
+
+/**
+ * Claw back what a refund took from the doctor's share of a payment that was
+ * already paid out, from their next payout. Call after
+ * PaymentService.applyRefund has been applied and saved.
+ * @param {Object} payment - The refunded payment
+ * @param {number} doctorNetBefore - The doctor's net before the refund
+ * @returns {Promise<Object|null>} - The adjustment, or null when there is
+ * nothing to claw back
+ */
+const clawBackRefund = async (payment, doctorNetBefore) => {
+  const amount = roundAmount(payment.doctorNet - doctorNetBefore);
+  if (!payment.payoutId || amount >= 0) {
+    return null;
+  }
+
+  const adjustment = await PayoutAdjustment.create({
+    doctorId: payment.doctorId,
+    paymentId: payment._id,
+    amount,
+    currency: payment.currency,
+    reason: 'refund'
+  });
+  logger.info('Refund clawed back from next payout', {
+    doctorId: payment.doctorId,
+    paymentId: payment._id,
+    amount
+  });
+  return adjustment;
+};
+
+/**
+ * Mark a payout as paid
+ * @param {string} payoutId - The payout ID
+ * @param {string} reference - Bank or provider reference for the transfer
+ * @returns {Promise<Object|null>} - The updated payout, or null if it wasn't pending
+ */
+const markPayoutPaid = async (payoutId, reference) => {
+  return Payout.findOneAndUpdate(
+    { _id: payoutId, status: 'pending' },
+    { $set: { status: 'paid', paidAt: new Date(), reference } },
+    { new: true }
+  );
+};
+
+module.exports = {
+  getDoctorNet,
+  getPendingPayout,
+  createPayouts,
+  clawBackRefund,
+  markPayoutPaid
+};
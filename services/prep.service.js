@@ -0,0 +1,61 @@
+const PrepInstruction = require('../models/prep.instruction.model');
+
+/**
+ * Pick the prep instructions for an appointment. A rule for one of the
+ * doctor's specialties and the appointment's type beats one for the
+ * specialty alone, which beats one for the type alone; between specialties
+ * the doctor's listing order decides.
+ * @param {Object[]} instructions - Active PrepInstruction records
+ * @param {string[]} specializations - The doctor's specialties
+ * @param {string} type - The appointment type
+ * @returns {string|null} - The instructions, or null when none apply
+ */
+const selectPrepInstructions = (instructions, specializations, type) => {
+  const specialties = (specializations || []).map(specialty => specialty.toLowerCase());
+  let best = null;
+  let bestRank = null;
+
+  for (const rule of instructions) {
+    if (rule.appointmentType && rule.appointmentType !== type) continue;
+
+    let rank;
+    if (rule.specialty) {
+      const index = specialties.indexOf(rule.specialty.toLowerCase());
+      if (index === -1) continue;
+      rank = index * 2 + (rule.appointmentType ? 0 : 1);
+    } else {
+      rank = specialties.length * 2;
+    }
+
+    if (bestRank === null || rank < bestRank) {
+      best = rule;
+      bestRank = rank;
+    }
+  }
+
+  return best ? best.instructions : null;
+};
+
+/**
+ * Active prep instructions, for the reminder job to load once per run
+ * @returns {Promise<Object[]>}
+ */
+const getActivePrepInstructions = () => {
+  return PrepInstruction.find({ isActive: true }).lean();
+};
+
+/**
+ * A patient's reminder text with any prep instructions appended
+ * @param {string} message - The reminder
+ * @param {string|null} prep - From selectPrepInstructions
+ * @returns {string}
+ */
+const appendPrepInstructions = (message, prep) => {
+  return prep ? `${message} Before your visit: ${prep}` : message;
+};
+
+module.exports = {
+  selectPrepInstructions,
+  getActivePrepInstructions,
+  appendPrepInstructions
+};
@@ -0,0 +1,77 @@
+const { timeToMinutes } = require('../utils/helpers');
+
+const WEEKDAYS = ['sunday', 'monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday'];
+
+const MIN_MULTIPLIER = 0.5;
+const MAX_MULTIPLIER = 5;
+
+const roundMoney = (amount) => Math.round(amount * 100) / 100;
+
+/**
+ * The doctor's pricing rule for a slot. A rule applies when the slot starts on
+ * one of its days within its time range; when several apply the highest
+ * multiplier wins.
+ * @param {Object} doctor - The doctor
+ * @param {Date|string} date - The slot's day (UTC midnight)
+ * @param {string} startTime - Slot start (HH:MM)
+ * @returns {Object|null} - The rule, or null when none applies
+ */
+const getPricingRule = (doctor, date, startTime) => {
+  const weekday = WEEKDAYS[new Date(date).getUTCDay()];
+  const start = timeToMinutes(startTime);
+  return (doctor.pricingRules || [])
+    .filter(rule => rule.days.includes(weekday)
+      && start >= timeToMinutes(rule.startTime) && start < timeToMinutes(rule.endTime))
+    .reduce((best, rule) => (!best || rule.multiplier > best.multiplier ? rule : best), null);
+};
+
+/**
+ * Fee for a slot after the doctor's peak pricing rules
+ * @param {Object} doctor - The doctor
+ * @param {Date|string} date - The slot's day (UTC midnight)
+ * @param {string} startTime - Slot start (HH:MM)
+ * @param {number} baseFee - Fee before pricing rules; defaults to the
+ * doctor's consultation fee
+ * @returns {Object} - { fee, baseFee, multiplier, rule } where rule is the
+ * applied rule's label, or null when the base fee applies
+ */
+const getSlotPrice = (doctor, date, startTime, baseFee = doctor.consultationFee) => {
+  const rule = getPricingRule(doctor, date, startTime);
+  const multiplier = rule ? rule.multiplier : 1;
+  return {
+    fee: roundMoney(baseFee * multiplier),
+    baseFee,
+    multiplier,
+    rule: rule ? rule.label || null : null
+  };
+};
+
+/**
+ * Why a set of pricing rules can't be saved
+ * @param {Object[]} rules - Rules as sent by the doctor
+ * @returns {string|null} - The problem, or null when the rules are valid
+ */
+const getPricingRulesError = (rules) => {
+  if (!Array.isArray(rules)) {
+    return 'Pricing rules must be an array';
+  }
+  const time = /^([01]\d|2[0-3]):[0-5]\d$/;
+  for (const rule of rules) {
+    if (!rule || !Array.isArray(rule.days) || rule.days.length === 0 || !rule.days.every(day => WEEKDAYS.includes(day))) {
+      return `Each pricing rule needs days from: ${WEEKDAYS.join(', ')}`;
+    }
+    if (!time.test(rule.startTime) || !time.test(rule.endTime) || rule.startTime >= rule.endTime) {
+      return 'Each pricing rule needs a startTime before its endTime (HH:MM)';
+    }
+    if (typeof rule.multiplier !== 'number' || rule.multiplier < MIN_MULTIPLIER || rule.multiplier > MAX_MULTIPLIER) {
+      return `Pricing rule multipliers must be between ${MIN_MULTIPLIER} and ${MAX_MULTIPLIER}`;
+    }
+  }
+  return null;
+};
+
+module.exports = {
+  getPricingRule,
+  getSlotPrice,
+  getPricingRulesError
+};
@@ -0,0 +1,144 @@
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+// Commands that read or write a collection, with where each keeps its filter
+const FILTERS = {
+  find: command => command.filter,
+  findAndModify: command => command.query,
+  count: command => command.query,
+  distinct: command => command.query,
+  update: command => command.updates && command.updates[0] && command.updates[0].q,
+  delete: command => command.deletes && command.deletes[0] && command.deletes[0].q,
+  aggregate: command => command.pipeline,
+  insert: () => undefined
+};
+
+// Most distinct slow query shapes kept for the metrics; the least recently
+// seen are dropped first
+const MAX_SHAPES = 200;
+
+// Commands in flight, by connection and request ID
+const started = new Map();
+// Slow queries by collection, operation and filter shape
+const slowQueries = new Map();
+let totalSlow = 0;
+const since = new Date();
+
+const isPlainObject = (value) => {
+  if (!value || typeof value !== 'object') {
+    return false;
+  }
+  const proto = Object.getPrototypeOf(value);
+  return proto === Object.prototype || proto === null;
+};
+
+/**
+ * The shape of a filter or pipeline: its fields and operators with every
+ * value replaced by '?', so logs and metrics never carry patient data. Lists
+ * of values (e.g. for $in) become a single '?'; lists of clauses (e.g. $or,
+ * pipeline stages) keep each clause's shape.
+ * @param {*} value - A filter, pipeline or value in one
+ * @returns {*} - e.g. { doctorId: '?', date: { $gte: '?' } }
+ */
+const getQueryShape = (value) => {
+  if (Array.isArray(value)) {
+    return value.some(item => isPlainObject(item) || Array.isArray(item)) ? value.map(getQueryShape) : '?';
+  }
+  if (isPlainObject(value)) {
+    return Object.fromEntries(Object.entries(value).map(([key, item]) => [key, getQueryShape(item)]));
+  }
+  return '?';
+};
+
+const connectionKey = (event) => `${event.connectionId}:${event.requestId}`;
+
+const onCommandStarted = (event) => {
+  const getFilter = FILTERS[event.commandName];
+  if (!getFilter) {
+    return;
+  }
+  started.set(connectionKey(event), {
+    collection: event.command[event.commandName],
+    operation: event.commandName,
+    command: event.command
+  });
+};
+
+// Count a slow query under its shape, most recently seen last
+const recordSlowQuery = (entry, shape, durationMs) => {
+  const key = `${entry.collection}.${entry.operation} ${JSON.stringify(shape)}`;
+  const stats = slowQueries.get(key) || {
+    collection: entry.collection,
+    operation: entry.operation,
+    filter: shape,
+    count: 0,
+    totalMs: 0,
+    maxMs: 0
+  };
+  stats.count += 1;
+  stats.totalMs += durationMs;
+  stats.maxMs = Math.max(stats.maxMs, durationMs);
+  stats.lastSeenAt = new Date();
+
+  slowQueries.delete(key);
+  slowQueries.set(key, stats);
+  if (slowQueries.size > MAX_SHAPES) {
+    slowQueries.delete(slowQueries.keys().next().value);
+  }
+  totalSlow += 1;
+};
+
+const onCommandFinished = (event, failed) => {
+  const key = connectionKey(event);
+  const entry = started.get(key);
+  if (!entry) {
+    return;
+  }
+  started.delete(key);
+
+  const durationMs = Math.round(event.duration);
+  if (durationMs < config.mongodb.slowQueries.thresholdMs) {
+    return;
+  }
+  const shape = getQueryShape(FILTERS[entry.operation](entry.command));
+  logger.warn('Slow MongoDB query', {
+    collection: entry.collection,
+    operation: entry.operation,
+    durationMs,
+    filter: shape,
+    failed
+  });
+  recordSlowQuery(entry, shape, durationMs);
+};
+
+/**
+ * Time every collection command on a client and log those slower than
+ * config.mongodb.slowQueries.thresholdMs. The client must be connected with
+ * monitorCommands (see DatabaseService.getConnectionOptions).
+ * @param {Object} client - The MongoClient, e.g. mongoose.connection.getClient()
+ */
+const watch = (client) => {
+  client.on('commandStarted', onCommandStarted);
+  client.on('commandSucceeded', event => onCommandFinished(event, false));
+  client.on('commandFailed', event => onCommandFinished(event, true));
+};
+
+/**
+ * Slow queries since the process started, grouped by collection, operation
+ * and filter shape, the most time spent first
+ * @returns {Object} - { thresholdMs, since, total, queries }
+ */
+const getSlowQueryStats = () => ({
+  thresholdMs: config.mongodb.slowQueries.thresholdMs,
+  since,
+  total: totalSlow,
+  queries: [...slowQueries.values()]
+    .sort((a, b) => b.totalMs - a.totalMs)
+    .map(stats => ({ ...stats, avgMs: Math.round(stats.totalMs / stats.count) }))
+});
+
+module.exports = {
+  getQueryShape,
+  watch,
+  getSlowQueryStats
+};
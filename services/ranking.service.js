@@ -0,0 +1,67 @@
+const config = require('../config/config');
+
+const SORT_OPTIONS = ['distance', 'rating', 'composite'];
+
+const MAX_RATING = 5;
+
+const clamp = (value) => Math.min(1, Math.max(0, value));
+
+const round = (value) => Math.round(value * 1000) / 1000;
+
+/**
+ * Score a doctor on each ranking component, all between 0 and 1 where higher
+ * is better
+ * @param {Object} entry - { distanceKm, rating, nextAvailable }
+ * @param {Object} options - radiusKm of the search, lookaheadDays of the
+ * availability check and now (reference time)
+ * @returns {Object} - { distance, rating, availability, composite }
+ */
+const scoreDoctor = (entry, options = {}) => {
+  const now = options.now || new Date();
+  const lookaheadDays = options.lookaheadDays || config.appointments.nextAvailableLookaheadDays;
+  const weights = options.weights || config.search.nearby.weights;
+
+  const distance = clamp(1 - entry.distanceKm / options.radiusKm);
+  const rating = clamp((entry.rating || 0) / MAX_RATING);
+
+  // Sooner is better; nothing free within the lookahead scores zero
+  let availability = 0;
+  if (entry.nextAvailable) {
+    const hoursUntil = (new Date(entry.nextAvailable).getTime() - now.getTime()) / (60 * 60 * 1000);
+    availability = clamp(1 - hoursUntil / (lookaheadDays * 24));
+  }
+
+  const totalWeight = weights.distance + weights.rating + weights.availability;
+  const composite = totalWeight > 0
+    ? (distance * weights.distance + rating * weights.rating + availability * weights.availability) / totalWeight
+    : 0;
+
+  return {
+    distance: round(distance),
+    rating: round(rating),
+    availability: round(availability),
+    composite: round(composite)
+  };
+};
+
+/**
+ * Order scored doctors. Ties fall back to distance so results are stable.
+ * @param {Object[]} entries - Entries with distanceKm, rating and scores
+ * @param {string} sort - One of SORT_OPTIONS
+ * @returns {Object[]} - A new, sorted array
+ */
+const rankDoctors = (entries, sort) => {
+  const byDistance = (a, b) => a.distanceKm - b.distanceKm;
+  const comparators = {
+    distance: byDistance,
+    rating: (a, b) => (b.rating || 0) - (a.rating || 0) || byDistance(a, b),
+    composite: (a, b) => b.scores.composite - a.scores.composite || byDistance(a, b)
+  };
+  return [...entries].sort(comparators[sort]);
+};
+
+module.exports = {
+  SORT_OPTIONS,
+  scoreDoctor,
+  rankDoctors
+};
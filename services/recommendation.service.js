@@ -0,0 +1,121 @@
+const jwt = require('jsonwebtoken');
+const config = require('../config/config');
+
+const BOOKING_TOKEN_PURPOSE = 'recommendation-booking';
+
+// Map symptoms to specialties based on a basic rule set
+// In a real system, this would be much more sophisticated
+const SYMPTOM_SPECIALTIES = {
+  'headache': ['General Practitioner', 'Neurologist'],
+  'migraine': ['Neurologist'],
+  'back pain': ['Orthopedist', 'Rheumatologist'],
+  'chest pain': ['Cardiologist', 'Pulmonologist'],
+  'abdominal pain': ['Gastroenterologist', 'General Practitioner'],
+  'cough': ['Pulmonologist', 'General Practitioner'],
+  'fever': ['General Practitioner', 'Infectious Disease'],
+  'rash': ['Dermatologist'],
+  'joint pain': ['Rheumatologist', 'Orthopedist'],
+  'fatigue': ['General Practitioner', 'Endocrinologist'],
+  'depression': ['Psychiatrist', 'Psychologist'],
+  'anxiety': ['Psychiatrist', 'Psychologist'],
+  'shortness of breath': ['Pulmonologist', 'Cardiologist'],
+  'dizziness': ['Neurologist', 'ENT Specialist'],
+  'vision problems': ['Ophthalmologist'],
+  'hearing problems': ['ENT Specialist'],
+  'skin issues': ['Dermatologist'],
+  'digestive problems': ['Gastroenterologist'],
+  'urinary problems': ['Urologist', 'Nephrologist'],
+  'sleep problems': ['Neurologist', 'Psychiatrist'],
+  'weight changes': ['Endocrinologist', 'General Practitioner'],
+  'allergies': ['Allergist', 'Immunologist']
+};
+
+// Unknown symptoms go to a general practitioner
+const DEFAULT_SPECIALTIES = ['General Practitioner'];
+
+// Symptoms that need emergency services rather than an appointment. Matched
+// as phrases anywhere in what the patient typed.
+const RED_FLAG_SYMPTOMS = [
+  'chest pain',
+  'difficulty breathing',
+  'severe bleeding',
+  'loss of consciousness',
+  'fainting',
+  'seizure',
+  'slurred speech',
+  'face drooping',
+  'sudden weakness',
+  'severe allergic reaction',
+  'suicidal thoughts',
+  'coughing up blood',
+  'vomiting blood'
+];
+
+/**
+ * Specialties that treat a symptom
+ * @param {string} symptom - Symptom name, any case
+ * @returns {string[]}
+ */
+const getSpecialtiesForSymptom = (symptom) => {
+  return SYMPTOM_SPECIALTIES[symptom.toLowerCase()] || DEFAULT_SPECIALTIES;
+};
+
+/**
+ * Sign a short-lived token that lets a patient book a recommended slot in one
+ * call. It carries the slot and the symptoms the recommendation was based on.
+ * @param {string} doctorId - The recommended doctor
+ * @param {Object} slot - { date, startTime, endTime }
+ * @param {string[]} symptoms - Symptoms from the recommendation request
+ * @param {Object} options - ttlMinutes, defaulting to the recommendation token lifetime
+ * @returns {string}
+ */
+const createBookingToken = (doctorId, slot, symptoms, options = {}) => {
+  return jwt.sign(
+    {
+      purpose: BOOKING_TOKEN_PURPOSE,
+      doctorId: doctorId.toString(),
+      date: slot.date,
+      startTime: slot.startTime,
+      endTime: slot.endTime,
+      symptoms
+    },
+    config.jwt.secret,
+    { algorithm: 'HS256', expiresIn: `${options.ttlMinutes || config.recommendations.bookingTokenTtlMinutes}m` }
+  );
+};
+
+/**
+ * Red-flag symptoms among those a patient reported
+ * @param {string[]} symptoms - Symptoms, any case
+ * @returns {string[]} - The red flags matched, empty when none
+ */
+const getRedFlagSymptoms = (symptoms) => {
+  const reported = symptoms.map(symptom => String(symptom).toLowerCase());
+  return RED_FLAG_SYMPTOMS.filter(flag => reported.some(symptom => symptom.includes(flag)));
+};
+
+/**
+ * Verify a booking token
+ * @param {string} token - The token from the recommendation response
+ * @returns {Object} - { payload } when valid, otherwise { error: 'expired' | 'invalid' }
+ */
+const verifyBookingToken = (token) => {
+  try {
+    const payload = jwt.verify(token, config.jwt.secret, { algorithms: ['HS256'] });
+    if (payload.purpose !== BOOKING_TOKEN_PURPOSE) {
+      return { error: 'invalid' };
+    }
+    return { payload };
+  } catch (error) {
+    return { error: error.name === 'TokenExpiredError' ? 'expired' : 'invalid' };
+  }
+};
+
+module.exports = {
+  SYMPTOM_SPECIALTIES,
+  RED_FLAG_SYMPTOMS,
+  getSpecialtiesForSymptom,
+  getRedFlagSymptoms,
+  createBookingToken,
+  verifyBookingToken
+};
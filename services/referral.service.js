@@ -0,0 +1,86 @@
+const Doctor = require('../models/doctor.model');
+const Referral = require('../models/referral.model');
+const config = require('../config/config');
+const AvailabilityService = require('./availability.service');
+const { createBookingToken } = require('./recommendation.service');
+
+/**
+ * Doctors to suggest for a referral: the named colleague first, if any, then
+ * the best rated active doctors in the specialty. Each one comes with their
+ * next free slot and a booking token for it.
+ * @param {Object} referral - The referral, with specialty, referringDoctorId
+ * and optionally referredDoctorId
+ * @param {Object} options - symptoms to carry in the booking tokens
+ * @returns {Promise<Object[]>} - { doctorId, name, specializations, rating, nextSlot, bookingToken }
+ */
+const getRecommendedDoctors = async (referral, options = {}) => {
+  const count = config.referrals.recommendationCount;
+  const exclude = [referral.referringDoctorId];
+
+  const doctors = [];
+  if (referral.referredDoctorId) {
+    const named = await Doctor.findById(referral.referredDoctorId).populate('userId', 'firstName lastName');
+    if (named) {
+      doctors.push(named);
+      exclude.push(named._id);
+    }
+  }
+
+  const others = await Doctor.find({
+    _id: { $nin: exclude },
+    specializations: referral.specialty,
+    verificationStatus: 'verified',
+    status: 'active'
+  })
+    .sort({ rating: -1, totalReviews: -1 })
+    .limit(Math.max(0, count - doctors.length))
+    .populate('userId', 'firstName lastName');
+  doctors.push(...others);
+
+  const nextSlots = await AvailabilityService.getNextFreeSlotForDoctors(doctors);
+  const ttlMinutes = config.referrals.bookingTokenTtlHours * 60;
+
+  return doctors.map(doctor => {
+    const slot = nextSlots.get(doctor._id.toString());
+    return {
+      doctorId: doctor._id,
+      name: doctor.userId ? `Dr. ${doctor.userId.firstName} ${doctor.userId.lastName}` : null,
+      specializations: doctor.specializations,
+      rating: doctor.rating,
+      nextSlot: slot,
+      bookingToken: slot ? createBookingToken(doctor._id, slot, options.symptoms || [], { ttlMinutes }) : null
+    };
+  });
+};
+
+/**
+ * A patient's referral that has not been booked or declined yet
+ * @param {string} referralId - The referral ID
+ * @param {string} patientId - The patient's user ID
+ * @returns {Promise<Object|null>}
+ */
+const findOpenReferral = async (referralId, patientId) => {
+  return Referral.findOne({ _id: referralId, patientId, status: 'pending' });
+};
+
+/**
+ * Mark a referral as booked. Conditional so only the first booking links.
+ * @param {string} referralId - The referral ID
+ * @param {string} appointmentId - The appointment booked for it
+ * @param {Object} options - session, to mark it within a transaction
+ * @returns {Promise<boolean>} - Whether the referral was still open
+ */
+const markReferralBooked = async (referralId, appointmentId, options = {}) => {
+  const result = await Referral.updateOne(
+    { _id: referralId, status: 'pending' },
+    { $set: { status: 'booked', linkedAppointmentId: appointmentId } },
+    { session: options.session }
+  );
+  return result.modifiedCount > 0;
+};
+
+module.exports = {
+  getRecommendedDoctors,
+  findOpenReferral,
+  markReferralBooked
+};
@@ -0,0 +1,63 @@
+const config = require('../config/config');
+
+/**
+ * A user's reminder settings, or the defaults for their role if they never
+ * saved any
+ * @param {Object} user - The user
+ * @returns {{ channels: string[], leadTimesMinutes: number[], isDefault: boolean }}
+ */
+const getReminderSettings = (user) => {
+  const saved = user.reminderSettings;
+  if (saved && saved.updatedAt) {
+    return {
+      channels: [...saved.channels],
+      leadTimesMinutes: [...saved.leadTimesMinutes],
+      isDefault: false
+    };
+  }
+  const defaults = config.reminders.defaults[user.role === 'doctor' ? 'doctor' : 'patient'];
+  return {
+    channels: [...defaults.channels],
+    leadTimesMinutes: [...defaults.leadTimesMinutes],
+    isDefault: true
+  };
+};
+
+/**
+ * Validate reminder settings a user wants to save
+ * @param {Object} user - The user saving them
+ * @param {Object} settings - { channels, leadTimesMinutes }
+ * @returns {Object|null} - Field errors, or null when valid
+ */
+const getReminderSettingsErrors = (user, settings) => {
+  const errors = {};
+  const { channels, leadTimesMinutes } = settings;
+  const { allowedLeadTimesMinutes, maxLeadTimes } = config.reminders;
+
+  if (new Set(channels).size !== channels.length) {
+    errors.channels = 'Channels must not repeat';
+  } else if (channels.includes('sms')) {
+    if (!user.smsConsent || !user.smsConsent.granted) {
+      errors.channels = 'SMS reminders need SMS consent; grant it in your profile first';
+    } else if (!user.phone || !user.phone.number) {
+      errors.channels = 'SMS reminders need a phone number on your profile';
+    }
+  }
+
+  if (new Set(leadTimesMinutes).size !== leadTimesMinutes.length) {
+    errors.leadTimesMinutes = 'Lead times must not repeat';
+  } else if (leadTimesMinutes.length > maxLeadTimes) {
+    errors.leadTimesMinutes = `At most ${maxLeadTimes} lead times are allowed`;
+  } else if (leadTimesMinutes.some(lead => !allowedLeadTimesMinutes.includes(lead))) {
+    errors.leadTimesMinutes = `Lead times must be among: ${allowedLeadTimesMinutes.join(', ')}`;
+  } else if (channels.length > 0 && leadTimesMinutes.length === 0) {
+    errors.leadTimesMinutes = 'Pick at least one lead time, or no channels to turn reminders off';
+  }
+
+  return Object.keys(errors).length > 0 ? errors : null;
+};
+
+module.exports = {
+  getReminderSettings,
+  getReminderSettingsErrors
+};
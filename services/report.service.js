@@ -0,0 +1,156 @@
+const Payment = require('../models/payment.model');
+
+// Columns of the financial report, in CSV order
+const FINANCIAL_REPORT_COLUMNS = [
+  'paymentId',
+  'paidAt',
+  'provider',
+  'providerReference',
+  'method',
+  'currency',
+  'gross',
+  'commissionPercent',
+  'commission',
+  'tax',
+  'net',
+  'refundStatus',
+  'refundedAmount',
+  'refundedAt',
+  'payoutId',
+  'appointmentId',
+  'appointmentDate',
+  'appointmentStartTime',
+  'appointmentType',
+  'appointmentStatus',
+  'doctorId',
+  'doctorName',
+  'patientId'
+];
+
+const getRefundStatus = (payment) => {
+  if (payment.status === 'refunded') return 'full';
+  return payment.refundedAmount > 0 ? 'partial' : 'none';
+};
+
+/**
+ * Payments that succeeded (including those refunded since) in a period, each
+ * joined with its appointment and doctor. Returns an aggregation meant to be
+ * read through a cursor.
+ * @param {Date} from - Start of the period, by payment date
+ * @param {Date} to - End of the period
+ * @returns {Object} - The aggregate
+ */
+const getFinancialReport = (from, to) => {
+  return Payment.aggregate([
+    {
+      $match: {
+        status: { $in: ['success', 'refunded'] },
+        paidAt: { $gte: from, $lte: to }
+      }
+    },
+    { $sort: { paidAt: 1 } },
+    {
+      $lookup: {
+        from: 'appointments',
+        localField: 'appointmentId',
+        foreignField: '_id',
+        as: 'appointment'
+      }
+    },
+    {
+      $lookup: {
+        from: 'doctors',
+        localField: 'doctorId',
+        foreignField: '_id',
+        as: 'doctor'
+      }
+    },
+    {
+      $lookup: {
+        from: 'users',
+        localField: 'doctor.userId',
+        foreignField: '_id',
+        as: 'doctorUser'
+      }
+    },
+    {
+      $project: {
+        amount: 1,
+        currency: 1,
+        status: 1,
+        method: 1,
+        provider: 1,
+        transactionId: 1,
+        paidAt: 1,
+        refundedAmount: 1,
+        refundedAt: 1,
+        commissionPercent: 1,
+        platformFee: 1,
+        doctorNet: 1,
+        payoutId: 1,
+        appointmentId: 1,
+        doctorId: 1,
+        patientId: 1,
+        appointment: {
+          $let: {
+            vars: { appointment: { $arrayElemAt: ['$appointment', 0] } },
+            in: {
+              date: '$$appointment.date',
+              startTime: '$$appointment.startTime',
+              type: '$$appointment.type',
+              status: '$$appointment.status'
+            }
+          }
+        },
+        doctorUser: {
+          $let: {
+            vars: { user: { $arrayElemAt: ['$doctorUser', 0] } },
+            in: { firstName: '$$user.firstName', lastName: '$$user.lastName' }
+          }
+        }
+      }
+    }
+  ]);
+};
+
+/**
+ * Flatten a joined payment into a report row keyed by FINANCIAL_REPORT_COLUMNS.
+ * No tax is charged on consultations, so tax is always 0.
+ * @param {Object} payment - A document from getFinancialReport
+ * @returns {Object}
+ */
+const toFinancialReportRow = (payment) => {
+  const appointment = payment.appointment || {};
+  const doctorUser = payment.doctorUser || {};
+  return {
+    paymentId: payment._id.toString(),
+    paidAt: payment.paidAt,
+    provider: payment.provider,
+    providerReference: payment.transactionId,
+    method: payment.method,
+    currency: payment.currency,
+    gross: payment.amount,
+    commissionPercent: payment.commissionPercent,
+    commission: payment.platformFee,
+    tax: 0,
+    net: payment.doctorNet,
+    refundStatus: getRefundStatus(payment),
+    refundedAmount: payment.refundedAmount || 0,
+    refundedAt: payment.refundedAt,
+    payoutId: payment.payoutId ? payment.payoutId.toString() : null,
+    appointmentId: payment.appointmentId.toString(),
+    appointmentDate: appointment.date ? appointment.date.toISOString().slice(0, 10) : null,
+    appointmentStartTime: appointment.startTime,
+    appointmentType: appointment.type,
+    appointmentStatus: appointment.status,
+    doctorId: payment.doctorId.toString(),
+    doctorName: doctorUser.firstName ? `${doctorUser.firstName} ${doctorUser.lastName}` : null,
+    patientId: payment.patientId.toString()
+  };
+};
+
+module.exports = {
+  FINANCIAL_REPORT_COLUMNS,
+  getFinancialReport,
+  toFinancialReportRow
+};
@@ -0,0 +1,169 @@
+const Message = require('../models/message.model');
+const VideoSession = require('../models/video.model');
+const Notification = require('../models/notification.model');
+const Document = require('../models/document.model');
+const Appointment = require('../models/appointment.model');
+const ChatService = require('./chat.service');
+const s3Service = require('./aws/s3.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+const DAY_MS = 24 * 60 * 60 * 1000;
+
+const ACTIONS = ['delete', 'archive', 'redact'];
+
+// What each retention policy in config.retention.policies covers. medical
+// types are held to the legal minimum; cleanup runs after records are deleted
+// (not archived) for anything stored outside the database. Types with redact
+// keep their records and only strip content, and allow no other action.
+const DATA_TYPES = {
+  chatContent: {
+    model: Appointment,
+    filter: (cutoff) => ({ status: 'completed', date: { $lt: cutoff }, 'chatPurge.purgedAt': { $exists: false } }),
+    redact: async (records) => {
+      for (const record of records) {
+        await ChatService.purgeChatContent(record, { reason: 'retention' });
+      }
+    }
+  },
+  chatMessages: {
+    model: Message,
+    filter: (cutoff) => ({ createdAt: { $lt: cutoff } })
+  },
+  videoSessions: {
+    model: VideoSession,
+    // Scheduled or running calls are left alone however old
+    filter: (cutoff) => ({ status: { $in: ['ended', 'cancelled'] }, createdAt: { $lt: cutoff } })
+  },
+  notifications: {
+    model: Notification,
+    filter: (cutoff) => ({ createdAt: { $lt: cutoff } })
+  },
+  medicalDocuments: {
+    model: Document,
+    medical: true,
+    filter: (cutoff) => ({ createdAt: { $lt: cutoff } }),
+    cleanup: (records) => Promise.all(records.map(record => s3Service.deleteFile(record.key)))
+  }
+};
+
+/**
+ * Retention age in days a data type is actually held to: the configured age,
+ * raised to the legal minimum for medical records
+ * @param {string} type - Key of DATA_TYPES
+ * @param {Object} policy - { days, action }
+ * @returns {number}
+ */
+const getRetentionDays = (type, policy) => {
+  if (DATA_TYPES[type].medical) {
+    return Math.max(policy.days, config.retention.medicalRecordMinDays);
+  }
+  return policy.days;
+};
+
+/**
+ * Oldest creation time a record of a type may have to be kept
+ * @param {string} type - Key of DATA_TYPES
+ * @param {Object} policy - { days, action }
+ * @param {Date} now - Reference time
+ * @returns {Date}
+ */
+const getRetentionCutoff = (type, policy, now = new Date()) => {
+  return new Date(now.getTime() - getRetentionDays(type, policy) * DAY_MS);
+};
+
+// Copy records to the type's archive collection before they are removed.
+// Records already archived by an interrupted run are skipped.
+const archiveRecords = async (model, records) => {
+  const archive = model.db.collection(`${model.collection.collectionName}_archive`);
+  const archivedAt = new Date();
+  try {
+    await archive.insertMany(records.map(record => ({ ...record, archivedAt })), { ordered: false });
+  } catch (error) {
+    const writeErrors = error.writeErrors || [];
+    if (writeErrors.length === 0 || writeErrors.some(writeError => writeError.code !== 11000)) {
+      throw error;
+    }
+  }
+};
+
+/**
+ * Delete or archive one data type's records past their retention age, in
+ * batches
+ * @param {string} type - Key of DATA_TYPES
+ * @param {Object} policy - { days, action }
+ * @param {Object} options - dryRun and now
+ * @returns {Promise<Object>} - { type, action, cutoff, count, dryRun }
+ */
+const purgeType = async (type, policy, options = {}) => {
+  const dataType = DATA_TYPES[type];
+  const cutoff = getRetentionCutoff(type, policy, options.now);
+  const filter = dataType.filter(cutoff);
+  const summary = { type, action: policy.action, cutoff, count: 0, dryRun: Boolean(options.dryRun) };
+
+  if (options.dryRun) {
+    summary.count = await dataType.model.countDocuments(filter);
+    return summary;
+  }
+
+  for (;;) {
+    const records = await dataType.model.find(filter).limit(config.retention.batchSize).lean();
+    if (records.length === 0) {
+      break;
+    }
+    summary.count += records.length;
+    // Redacted records stop matching the filter
+    if (policy.action === 'redact') {
+      await dataType.redact(records);
+      continue;
+    }
+    if (policy.action === 'archive') {
+      await archiveRecords(dataType.model, records);
+    }
+    await dataType.model.deleteMany({ _id: { $in: records.map(record => record._id) } });
+    if (policy.action === 'delete' && dataType.cleanup) {
+      await dataType.cleanup(records);
+    }
+  }
+
+  return summary;
+};
+
+/**
+ * Apply every retention policy. Types with an unknown action are skipped and
+ * reported rather than guessed at.
+ * @param {Object} options - dryRun (defaults to config.retention.dryRun) and now
+ * @returns {Promise<Object[]>} - One summary per data type
+ */
+const purgeExpiredData = async (options = {}) => {
+  const dryRun = options.dryRun !== undefined ? options.dryRun : config.retention.dryRun;
+  const results = [];
+
+  for (const [type, policy] of Object.entries(config.retention.policies)) {
+    if (!DATA_TYPES[type]) {
+      logger.warn('Retention policy for unknown data type skipped', { type });
+      continue;
+    }
+    if (!ACTIONS.includes(policy.action) || (policy.action === 'redact') !== Boolean(DATA_TYPES[type].redact)) {
+      logger.warn('Retention policy with unsupported action skipped', { type, action: policy.action });
+      continue;
+    }
+
+    const summary = await purgeType(type, policy, { dryRun, now: options.now });
+    results.push(summary);
+    if (summary.count > 0) {
+      logger.info(dryRun ? 'Retention purge dry run' : 'Retention purge', summary);
+    }
+  }
+
+  return results;
+};
+
+module.exports = {
+  ACTIONS,
+  DATA_TYPES,
+  getRetentionDays,
+  getRetentionCutoff,
+  purgeType,
+  purgeExpiredData
+};
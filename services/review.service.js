@@ -0,0 +1,30 @@
+const { getSetting } = require('./settings.service');
+
+/**
+ * Whether a review for this appointment counts as verified: the visit took
+ * place and was paid for
+ * @param {Object} appointment - The reviewed appointment
+ * @returns {boolean}
+ */
+const isVerifiedAppointment = (appointment) => {
+  return appointment.status === 'completed' && appointment.paymentStatus === 'paid';
+};
+
+/**
+ * A doctor's rating as it may be shown. Averages over fewer verified reviews
+ * than the reviews.minReviewsForRating setting are withheld.
+ * @param {Object} doctor - Doctor with rating and totalReviews (verified only)
+ * @returns {{ average: number|null, count: number, label: string|null }}
+ */
+const getRatingSummary = (doctor) => {
+  const count = doctor.totalReviews || 0;
+  if (count < getSetting('reviews.minReviewsForRating')) {
+    return { average: null, count, label: 'Not enough reviews' };
+  }
+  return { average: Math.round((doctor.rating || 0) * 10) / 10, count, label: null };
+};
+
+module.exports = {
+  isVerifiedAppointment,
+  getRatingSummary
+};
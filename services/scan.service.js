@@ -0,0 +1,163 @@
+const Document = require('../models/document.model');
+const Doctor = require('../models/doctor.model');
+const s3Service = require('./aws/s3.service');
+const notificationService = require('./notification.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+
+const SCAN_STATUSES = ['pending', 'clean', 'infected'];
+
+// Default scanner: finds nothing. Deployments plug in a real one with
+// setScanner, e.g. a ClamAV daemon or a cloud malware-scanning API.
+const noopScanner = {
+  name: 'none',
+  scan: async () => ({ clean: true })
+};
+
+let scanner = noopScanner;
+
+/**
+ * Replace the scanner used for uploads. A scanner is an object with a name
+ * and an async scan({ buffer, contentType, category }) returning
+ * { clean: boolean, threat?: string }; it throws when it can't give a verdict.
+ * @param {Object} replacement - The scanner, or null for the no-op default
+ */
+const setScanner = (replacement) => {
+  scanner = replacement || noopScanner;
+};
+
+const getScanner = () => scanner;
+
+/**
+ * Scan a file's contents
+ * @param {Buffer} buffer - The file contents
+ * @param {Object} meta - contentType and upload category
+ * @returns {Promise<Object>} - { status: 'clean'|'infected', threat, scanner, scannedAt }
+ */
+const scanFile = async (buffer, meta) => {
+  const result = await scanner.scan({ buffer, contentType: meta.contentType, category: meta.category });
+  return {
+    status: result.clean ? 'clean' : 'infected',
+    threat: result.clean ? undefined : (result.threat || 'unknown'),
+    scanner: scanner.name,
+    scannedAt: new Date()
+  };
+};
+
+/**
+ * Scan state a newly stored private upload starts out with: quarantined until
+ * scanned, or clean right away when scanning is off
+ * @returns {Object}
+ */
+const getInitialScan = () => {
+  return config.uploadScan.enabled ? { status: 'pending' } : { status: 'clean', scanner: 'none', scannedAt: new Date() };
+};
+
+/**
+ * Whether a stored file may be served. Files uploaded before scanning was
+ * introduced have no scan state and are served as before.
+ * @param {Object} file - A document or clinic photo
+ * @returns {boolean}
+ */
+const isServable = (file) => !file.scan || !file.scan.status || file.scan.status === 'clean';
+
+/**
+ * Tell every admin about an infected upload
+ * @param {Object} details - category, fileName, uploadedBy and threat
+ * @returns {Promise<void>}
+ */
+const notifyInfected = async (details) => {
+  logger.warn('Infected upload detected', details);
+  await notificationService.sendInfectedUploadAlert(details);
+};
+
+// Where quarantined files are recorded, per upload category
+const QUARANTINE_TARGETS = {
+  document: {
+    findPending: (cutoff, limit) => Document.find({ 'scan.status': 'pending', createdAt: { $lt: cutoff } }).limit(limit),
+    toFiles: (document) => [{ id: document._id, key: document.key, contentType: document.contentType, fileName: document.fileName, uploadedBy: document.uploadedBy }],
+    save: (id, scan) => Document.updateOne({ _id: id }, { $set: { scan } })
+  },
+  clinicPhoto: {
+    findPending: (cutoff, limit) => Doctor.find({
+      'clinicLocation.photos': { $elemMatch: { 'scan.status': 'pending', uploadedAt: { $lt: cutoff } } }
+    }).select('userId clinicLocation.photos').limit(limit),
+    toFiles: (doctor, cutoff) => doctor.clinicLocation.photos
+      .filter(photo => photo.scan && photo.scan.status === 'pending' && photo.uploadedAt < cutoff)
+      .map(photo => ({ id: photo._id, key: photo.key, contentType: photo.contentType, fileName: photo.key, uploadedBy: doctor.userId })),
+    save: (id, scan) => Doctor.updateOne({ 'clinicLocation.photos._id': id }, { $set: { 'clinicLocation.photos.$.scan': scan } })
+  }
+};
+
+/**
+ * Scan a quarantined private upload and record the verdict. A scanner error
+ * leaves the file quarantined for rescanPendingUploads.
+ * @param {string} category - Key of QUARANTINE_TARGETS
+ * @param {Object} file - id, key, contentType, fileName and uploadedBy
+ * @param {Buffer} buffer - The contents, when still at hand; otherwise read back from S3
+ * @returns {Promise<Object|null>} - The scan recorded, or null when the scan failed
+ */
+const scanQuarantined = async (category, file, buffer) => {
+  try {
+    const contents = buffer || await s3Service.getFile(file.key);
+    const scan = await scanFile(contents, { contentType: file.contentType, category });
+    await QUARANTINE_TARGETS[category].save(file.id, scan);
+    if (scan.status === 'infected') {
+      await notifyInfected({ category, fileId: file.id, fileName: file.fileName, uploadedBy: file.uploadedBy, threat: scan.threat });
+    }
+    return scan;
+  } catch (error) {
+    logger.error('Upload scan failed', { category, fileId: file.id, error: error.message });
+    return null;
+  }
+};
+
+/**
+ * Start scanning a just-stored private upload without holding up the request
+ * @param {string} category - Key of QUARANTINE_TARGETS
+ * @param {Object} file - id, key, contentType, fileName and uploadedBy
+ * @param {Buffer} buffer - The uploaded contents
+ */
+const scanInBackground = (category, file, buffer) => {
+  if (!config.uploadScan.enabled) {
+    return;
+  }
+  setImmediate(() => scanQuarantined(category, file, buffer));
+};
+
+/**
+ * Scheduled job: retry scans of files still quarantined after
+ * UPLOAD_SCAN_RETRY_MINUTES, e.g. because the scanner was unreachable
+ * @param {Date} now - Reference time
+ * @returns {Promise<number>} - Files scanned
+ */
+const rescanPendingUploads = async (now = new Date()) => {
+  if (!config.uploadScan.enabled) {
+    return 0;
+  }
+  const cutoff = new Date(now.getTime() - config.uploadScan.retryAfterMinutes * 60 * 1000);
+  let scanned = 0;
+  for (const [category, target] of Object.entries(QUARANTINE_TARGETS)) {
+    const records = await target.findPending(cutoff, config.uploadScan.batchSize);
+    for (const file of records.flatMap(record => target.toFiles(record, cutoff))) {
+      if (await scanQuarantined(category, file)) {
+        scanned++;
+      }
+    }
+  }
+  return scanned;
+};
+
+module.exports = {
+  SCAN_STATUSES,
+  noopScanner,
+  setScanner,
+  getScanner,
+  scanFile,
+  getInitialScan,
+  isServable,
+  notifyInfected,
+  scanQuarantined,
+  scanInBackground,
+  rescanPendingUploads
+};
@@ -0,0 +1,54 @@
+const logger = require('../utils/logger');
+
+const jobs = [];
+const timers = [];
+
+/**
+ * Register a recurring background job
+ * @param {string} name - Job name used in logs
+ * @param {number} intervalMs - How often the job runs
+ * @param {Function} handler - Async function doing the work
+ */
+const registerJob = (name, intervalMs, handler) => {
+  jobs.push({ name, intervalMs, handler, running: false });
+};
+
+const runJob = async (job) => {
+  // Skip a tick rather than overlap a run that is still going
+  if (job.running) {
+    return;
+  }
+
+  job.running = true;
+  try {
+    await job.handler();
+  } catch (error) {
+    logger.error(`Background job ${job.name} failed:`, error);
+  } finally {
+    job.running = false;
+  }
+};
+
+/**
+ * Start all registered jobs
+ */
+const start = () => {
+  jobs.forEach(job => {
+    timers.push(setInterval(() => runJob(job), job.intervalMs));
+    logger.info(`Scheduled background job ${job.name}`, { intervalMs: job.intervalMs });
+  });
+};
+
+/**
+ * Stop all running jobs
+ */
+const stop = () => {
+  timers.forEach(timer => clearInterval(timer));
+  timers.length = 0;
+};
+
+module.exports = {
+  registerJob,
+  start,
+  stop
+};
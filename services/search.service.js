@@ -0,0 +1,161 @@
+const Doctor = require('../models/doctor.model');
+const User = require('../models/user.model');
+const config = require('../config/config');
+const ReviewService = require('./review.service');
+const { SYMPTOM_SPECIALTIES } = require('./recommendation.service');
+const { escapeRegex } = require('../utils/helpers');
+
+const SECTION_TYPES = ['doctors', 'specialties', 'symptoms'];
+
+/**
+ * How well a text matches a query: 0 for an exact match, 1 when the text or
+ * one of its words starts with the query, 2 when it only contains it
+ * @param {string} text - Candidate text
+ * @param {string} query - Lower-cased, trimmed query
+ * @returns {number|null} - The rank, or null when it doesn't match
+ */
+const getMatchRank = (text, query) => {
+  const value = (text || '').toLowerCase();
+  if (value === query) return 0;
+  if (value.startsWith(query) || value.split(/\s+/).some(word => word.startsWith(query))) return 1;
+  if (value.includes(query)) return 2;
+  return null;
+};
+
+// Keep matching entries, best match first, alphabetical within a rank
+const rankByName = (entries, query, getName) => {
+  return entries
+    .map(entry => ({ entry, rank: getMatchRank(getName(entry), query) }))
+    .filter(({ rank }) => rank !== null)
+    .sort((a, b) => a.rank - b.rank || getName(a.entry).localeCompare(getName(b.entry)))
+    .map(({ entry }) => entry);
+};
+
+/**
+ * All specialties doctors on the platform list
+ * @returns {Promise<string[]>}
+ */
+const getSpecialties = () => {
+  return Doctor.distinct('specializations', { specializations: { $ne: [] } });
+};
+
+/**
+ * Specialties matching a query
+ * @param {string} query - Search text
+ * @param {number} limit - Maximum results
+ * @returns {Promise<Object[]>} - [{ name }]
+ */
+const searchSpecialties = async (query, limit) => {
+  const specialties = await getSpecialties();
+  return rankByName(specialties, query.toLowerCase(), name => name)
+    .slice(0, limit)
+    .map(name => ({ name }));
+};
+
+/**
+ * Known symptoms matching a query, with the specialties that treat them
+ * @param {string} query - Search text
+ * @param {number} limit - Maximum results
+ * @returns {Object[]} - [{ symptom, specialties }]
+ */
+const searchSymptoms = (query, limit) => {
+  return rankByName(Object.keys(SYMPTOM_SPECIALTIES), query.toLowerCase(), symptom => symptom)
+    .slice(0, limit)
+    .map(symptom => ({ symptom, specialties: SYMPTOM_SPECIALTIES[symptom] }));
+};
+
+/**
+ * Verified doctors whose name or specialization matches a query. Name
+ * matches rank above specialization matches, then by how well they match and
+ * by rating.
+ * @param {string} query - Search text; every word must match the first or last name
+ * @param {number} limit - Maximum results
+ * @returns {Promise<Object[]>}
+ */
+const searchDoctors = async (query, limit) => {
+  const normalized = query.toLowerCase();
+  const words = normalized.split(/\s+/).filter(Boolean);
+  const maxCandidates = config.search.unified.maxDoctorCandidates;
+
+  const users = await User.find({
+    role: 'doctor',
+    $and: words.map(word => {
+      const pattern = new RegExp(escapeRegex(word), 'i');
+      return { $or: [{ firstName: pattern }, { lastName: pattern }] };
+    })
+  }).select('_id').limit(maxCandidates);
+
+  const doctors = await Doctor.find({
+    verificationStatus: 'verified',
+    $or: [
+      { userId: { $in: users.map(user => user._id) } },
+      { specializations: new RegExp(escapeRegex(normalized), 'i') }
+    ]
+  })
+    .populate('userId', 'firstName lastName avatarUrl')
+    .limit(maxCandidates);
+
+  return doctors
+    .filter(doctor => doctor.userId)
+    .map(doctor => {
+      const fullName = `${doctor.userId.firstName} ${doctor.userId.lastName}`;
+      const nameRank = getMatchRank(fullName, normalized);
+      const specialtyRanks = (doctor.specializations || [])
+        .map(specialty => getMatchRank(specialty, normalized))
+        .filter(rank => rank !== null);
+      // Name matches on separate words ("jan bakker" vs "Jan de Bakker") rank as contains
+      const matchedOnName = users.some(user => user._id.equals(doctor.userId._id));
+      return {
+        doctor,
+        matchedOn: matchedOnName ? 'name' : 'specialization',
+        rank: matchedOnName
+          ? (nameRank !== null ? nameRank : 2)
+          : 3 + Math.min(...specialtyRanks, 2)
+      };
+    })
+    .sort((a, b) => a.rank - b.rank || (b.doctor.rating || 0) - (a.doctor.rating || 0))
+    .slice(0, limit)
+    .map(({ doctor, matchedOn }) => ({
+      _id: doctor._id,
+      firstName: doctor.userId.firstName,
+      lastName: doctor.userId.lastName,
+      avatarUrl: doctor.userId.avatarUrl,
+      specializations: doctor.specializations,
+      ratingSummary: ReviewService.getRatingSummary(doctor),
+      matchedOn
+    }));
+};
+
+/**
+ * Search doctors, specialties and symptoms at once for the universal search
+ * box. Each section is ranked and limited on its own.
+ * @param {string} query - Search text
+ * @param {Object} options - limit per section
+ * @returns {Promise<Object[]>} - [{ type, results }] in SECTION_TYPES order
+ */
+const search = async (query, options = {}) => {
+  const limit = options.limit || config.search.unified.sectionLimit;
+  const trimmed = query.trim();
+
+  const [doctors, specialties, symptoms] = await Promise.all([
+    searchDoctors(trimmed, limit),
+    searchSpecialties(trimmed, limit),
+    searchSymptoms(trimmed, limit)
+  ]);
+
+  return [
+    { type: 'doctors', results: doctors },
+    { type: 'specialties', results: specialties },
+    { type: 'symptoms', results: symptoms }
+  ];
+};
+
+module.exports = {
+  SECTION_TYPES,
+  getMatchRank,
+  getSpecialties,
+  searchDoctors,
+  searchSpecialties,
+  searchSymptoms,
+  search
+};
@@ -0,0 +1,187 @@
+const PlatformSettings = require('../models/platform.settings.model');
+const config = require('../config/config');
+
+const SETTINGS_KEY = 'platform';
+
+// Updates kept in the settings document's history
+const MAX_HISTORY = 50;
+
+// Settings admins can change, with their allowed range. All are whole
+// numbers; defaults come from the same path in config.
+const SETTING_DEFINITIONS = {
+  'appointments.slotDurationMinutes': { min: 5, max: 240 },
+  'appointments.maxReschedules': { min: 0, max: 20 },
+  'appointments.suggestionCount': { min: 1, max: 10 },
+  'payments.holdMinutes': { min: 1, max: 120 },
+  'reviews.minReviewsForRating': { min: 0, max: 100 },
+  'chat.maxTemplatesPerDoctor': { min: 1, max: 1000 }
+};
+
+// Stored settings as last loaded; null until the first refresh
+let cached = null;
+
+const getPath = (object, path) => path.split('.').reduce((value, key) => (value == null ? undefined : value[key]), object);
+
+/**
+ * Current value of a setting: the stored override, or the config default.
+ * Reads the cache, so it can be used anywhere without awaiting.
+ * @param {string} path - Key of SETTING_DEFINITIONS, e.g. 'appointments.slotDurationMinutes'
+ * @returns {*}
+ */
+const getSetting = (path) => {
+  const stored = cached ? getPath(cached, path) : undefined;
+  return stored !== undefined && stored !== null ? stored : getPath(config, path);
+};
+
+/**
+ * Every setting with its effective value, and which ones are overridden
+ * @returns {Object} - { version, settings, overridden, updatedAt }
+ */
+const getSettings = () => {
+  const settings = {};
+  const overridden = [];
+  Object.keys(SETTING_DEFINITIONS).forEach(path => {
+    const [section, name] = path.split('.');
+    settings[section] = settings[section] || {};
+    settings[section][name] = getSetting(path);
+    const stored = cached ? getPath(cached, path) : undefined;
+    if (stored !== undefined && stored !== null) {
+      overridden.push(path);
+    }
+  });
+  return {
+    version: (cached && cached.version) || 0,
+    settings,
+    overridden,
+    updatedAt: (cached && cached.updatedAt) || null
+  };
+};
+
+/**
+ * Reload the stored settings into the cache. Runs at startup, on a timer so
+ * other instances pick up changes, and after every update.
+ * @returns {Promise<Object>} - The stored settings
+ */
+const refresh = async () => {
+  cached = (await PlatformSettings.findOne({ key: SETTINGS_KEY }).select('-history').lean()) || {};
+  return cached;
+};
+
+/**
+ * Flatten { section: { name: value } } into { 'section.name': value }
+ * @param {Object} settings - Nested settings from a request
+ * @returns {Object}
+ */
+const flattenSettings = (settings) => {
+  const changes = {};
+  Object.entries(settings || {}).forEach(([section, values]) => {
+    if (values && typeof values === 'object' && !Array.isArray(values)) {
+      Object.entries(values).forEach(([name, value]) => {
+        changes[`${section}.${name}`] = value;
+      });
+    } else {
+      changes[section] = values;
+    }
+  });
+  return changes;
+};
+
+/**
+ * Check flattened changes against SETTING_DEFINITIONS. null resets a setting
+ * to its default.
+ * @param {Object} changes - { 'section.name': value }
+ * @returns {Object|null} - Field errors, or null when valid
+ */
+const getSettingsErrors = (changes) => {
+  const errors = {};
+  const paths = Object.keys(changes);
+  if (paths.length === 0) {
+    return { settings: 'At least one setting is required' };
+  }
+  paths.forEach(path => {
+    const definition = SETTING_DEFINITIONS[path];
+    const value = changes[path];
+    if (!definition) {
+      errors[path] = 'Unknown setting';
+    } else if (value !== null && (!Number.isInteger(value) || value < definition.min || value > definition.max)) {
+      errors[path] = `Must be a whole number between ${definition.min} and ${definition.max}, or null for the default`;
+    }
+  });
+  return Object.keys(errors).length > 0 ? errors : null;
+};
+
+/**
+ * Apply validated changes, if the stored settings are still at the version
+ * the caller read
+ * @param {Object} changes - Flattened, validated changes
+ * @param {number} expectedVersion - Version the changes were based on
+ * @param {string} userId - The admin making them
+ * @returns {Promise<boolean>} - false when the version no longer matches
+ */
+const updateSettings = async (changes, expectedVersion, userId) => {
+  const $set = { updatedBy: userId };
+  const $unset = {};
+  Object.entries(changes).forEach(([path, value]) => {
+    if (value === null) {
+      $unset[path] = '';
+    } else {
+      $set[path] = value;
+    }
+  });
+  const update = {
+    $set,
+    $inc: { version: 1 },
+    $push: {
+      history: {
+        $each: [{ version: expectedVersion + 1, changes, updatedBy: userId, updatedAt: new Date() }],
+        $slice: -MAX_HISTORY
+      }
+    }
+  };
+  if (Object.keys($unset).length > 0) {
+    update.$unset = $unset;
+  }
+
+  try {
+    // The first update creates the document; otherwise a stale version matches nothing
+    const updated = await PlatformSettings.findOneAndUpdate(
+      { key: SETTINGS_KEY, version: expectedVersion },
+      update,
+      { new: true, upsert: expectedVersion === 0 }
+    );
+    if (!updated) {
+      return false;
+    }
+  } catch (error) {
+    // Upsert racing an existing document means the version was stale
+    if (error.code === 11000) {
+      return false;
+    }
+    throw error;
+  }
+
+  await refresh();
+  return true;
+};
+
+/**
+ * Recent updates, newest first
+ * @returns {Promise<Object[]>}
+ */
+const getHistory = async () => {
+  const stored = await PlatformSettings.findOne({ key: SETTINGS_KEY })
+    .select('history')
+    .populate('history.updatedBy', 'firstName lastName email');
+  return stored ? [...stored.history].reverse() : [];
+};
+
+module.exports = {
+  SETTING_DEFINITIONS,
+  getSetting,
+  getSettings,
+  refresh,
+  flattenSettings,
+  getSettingsErrors,
+  updateSettings,
+  getHistory
+};
@@ -1,6 +1,7 @@
 const { PublishCommand } = require('@aws-sdk/client-sns');
 const { snsClient } = require('../utils/aws');
 const logger = require('../utils/logger');
+const { buildSmsAttributes } = require('../utils/sms');
 
 class SMSService {
   constructor() {
@@ -65,16 +66,7 @@ class SMSService {
       const params = {
         Message: message,
         PhoneNumber: formattedNumber,
-        MessageAttributes: {
-          'AWS.SNS.SMS.SenderID': {
-            DataType: 'String',
-            StringValue: 'MEDCONN'
-          },
-          'AWS.SNS.SMS.SMSType': {
-            DataType: 'String',
-            StringValue: 'Transactional'
-          }
-        }
+        MessageAttributes: buildSmsAttributes(formattedNumber)
       };
 
       const command = new PublishCommand(params);
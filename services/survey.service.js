@@ -0,0 +1,48 @@
+const mongoose = require('mongoose');
+const Survey = require('../models/survey.model');
+
+const round = (value) => value == null ? null : Math.round(value * 100) / 100;
+
+/**
+ * Aggregate survey answers into quality metrics
+ * @param {Object} filter - doctorId to limit to one doctor, from and to dates
+ * @returns {Promise<Object[]>} - One entry per doctor with responses,
+ * averageWaitTime, averageCommunication and wouldRecommendPercent
+ */
+const getQualityMetrics = async (filter = {}) => {
+  const match = {};
+  if (filter.doctorId) {
+    match.doctorId = new mongoose.Types.ObjectId(filter.doctorId);
+  }
+  if (filter.from || filter.to) {
+    match.createdAt = {};
+    if (filter.from) match.createdAt.$gte = new Date(filter.from);
+    if (filter.to) match.createdAt.$lte = new Date(filter.to);
+  }
+
+  const results = await Survey.aggregate([
+    { $match: match },
+    {
+      $group: {
+        _id: '$doctorId',
+        responses: { $sum: 1 },
+        averageWaitTime: { $avg: '$waitTime' },
+        averageCommunication: { $avg: '$communication' },
+        recommended: { $sum: { $cond: ['$wouldRecommend', 1, 0] } }
+      }
+    },
+    { $sort: { responses: -1 } }
+  ]);
+
+  return results.map(result => ({
+    doctorId: result._id,
+    responses: result.responses,
+    averageWaitTime: round(result.averageWaitTime),
+    averageCommunication: round(result.averageCommunication),
+    wouldRecommendPercent: round((result.recommended / result.responses) * 100)
+  }));
+};
+
+module.exports = {
+  getQualityMetrics
+};
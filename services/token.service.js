@@ -0,0 +1,143 @@
+const crypto = require('crypto');
+const RefreshToken = require('../models/refresh.token.model');
+const RevokedToken = require('../models/revoked.token.model');
+const Session = require('../models/session.model');
+const User = require('../models/user.model');
+const config = require('../config/config');
+const { generateToken } = require('../utils/helpers');
+const { AppError } = require('../utils/error.handler');
+const logger = require('../utils/logger');
+
+const hashToken = (token) => crypto.createHash('sha256').update(token).digest('hex');
+
+/**
+ * Create a refresh token for a session
+ * @param {string} userId - The user's ID
+ * @param {string} familyId - The session's tokenId
+ * @returns {Promise<string>} - The token; only its hash is stored
+ */
+const issueRefreshToken = async (userId, familyId) => {
+  const token = crypto.randomBytes(32).toString('base64url');
+  await RefreshToken.create({
+    tokenHash: hashToken(token),
+    userId,
+    familyId,
+    expiresAt: new Date(Date.now() + config.jwt.refreshTokenDays * 24 * 60 * 60 * 1000)
+  });
+  return token;
+};
+
+/**
+ * Revoke every refresh token of a session and end the session, so access
+ * tokens issued for it stop working too
+ * @param {string} familyId - The session's tokenId
+ * @returns {Promise<void>}
+ */
+const revokeFamily = async (familyId) => {
+  const now = new Date();
+  await RefreshToken.updateMany(
+    { familyId, revokedAt: null },
+    { $set: { revokedAt: now } }
+  );
+  await Session.updateMany(
+    { tokenId: familyId, isActive: true },
+    { $set: { isActive: false, loggedOutAt: now } }
+  );
+};
+
+/**
+ * Revoke all of a user's refresh tokens, e.g. when they log out everywhere
+ * @param {string} userId - The user's ID
+ * @returns {Promise<void>}
+ */
+const revokeUserRefreshTokens = async (userId) => {
+  await RefreshToken.updateMany(
+    { userId, revokedAt: null },
+    { $set: { revokedAt: new Date() } }
+  );
+};
+
+/**
+ * Exchange a refresh token for a new access token and refresh token. Each
+ * refresh token works once: presenting one that was already exchanged means
+ * it was copied, so its whole family is revoked.
+ * @param {string} token - The refresh token
+ * @returns {Promise<Object>} - { user, token, refreshToken }
+ * @throws {AppError} 401 INVALID_REFRESH_TOKEN for unknown, expired or
+ * revoked tokens, 401 REFRESH_TOKEN_REUSED for exchanged ones
+ */
+const rotateRefreshToken = async (token) => {
+  const tokenHash = hashToken(token);
+  const now = new Date();
+
+  const stored = await RefreshToken.findOneAndUpdate(
+    { tokenHash, rotatedAt: null, revokedAt: null, expiresAt: { $gt: now } },
+    { $set: { rotatedAt: now } },
+    { new: true }
+  );
+  if (!stored) {
+    const existing = await RefreshToken.findOne({ tokenHash });
+    if (existing && existing.rotatedAt && !existing.revokedAt) {
+      logger.warn('Refresh token reused; revoking its family', {
+        userId: existing.userId,
+        familyId: existing.familyId
+      });
+      await revokeFamily(existing.familyId);
+      throw new AppError('Refresh token has already been used', 401, 'REFRESH_TOKEN_REUSED');
+    }
+    throw new AppError('Invalid or expired refresh token', 401, 'INVALID_REFRESH_TOKEN');
+  }
+
+  const [user, session] = await Promise.all([
+    User.findById(stored.userId),
+    Session.findOne({ tokenId: stored.familyId, isActive: true })
+  ]);
+  if (!user || user.status !== 'active' || !session) {
+    await revokeFamily(stored.familyId);
+    throw new AppError('Invalid or expired refresh token', 401, 'INVALID_REFRESH_TOKEN');
+  }
+
+  session.lastActivity = now;
+  await session.save();
+
+  return {
+    user,
+    token: generateToken(user, stored.familyId).token,
+    refreshToken: await issueRefreshToken(user._id, stored.familyId)
+  };
+};
+
+/**
+ * Revoke an access token before it expires. Tokens without a jti, issued
+ * before it was added, are ignored; revoking a token twice is harmless.
+ * @param {Object} payload - The token's verified payload
+ * @returns {Promise<void>}
+ */
+const revokeAccessToken = async (payload) => {
+  if (!payload.jti) {
+    return;
+  }
+  await RevokedToken.updateOne(
+    { jti: payload.jti },
+    { $setOnInsert: { userId: payload.userId, expiresAt: new Date(payload.exp * 1000) } },
+    { upsert: true }
+  );
+};
+
+/**
+ * Whether an access token was revoked
+ * @param {string} jti - The token's jti
+ * @returns {Promise<boolean>}
+ */
+const isAccessTokenRevoked = async (jti) => {
+  return Boolean(await RevokedToken.exists({ jti }));
+};
+
+module.exports = {
+  issueRefreshToken,
+  rotateRefreshToken,
+  revokeFamily,
+  revokeUserRefreshTokens,
+  revokeAccessToken,
+  isAccessTokenRevoked
+};
@@ -0,0 +1,131 @@
+const { v4: uuidv4 } = require('uuid');
+const AWSService = require('./aws.service');
+const s3Service = require('./aws/s3.service');
+const ScanService = require('./scan.service');
+const config = require('../config/config');
+const { AppError, ValidationError } = require('../utils/error.handler');
+
+// Magic-number signatures for the content types we accept. The client-supplied
+// mimetype is never trusted on its own.
+const SIGNATURES = [
+  { type: 'image/jpeg', test: buf => buf.length >= 3 && buf[0] === 0xff && buf[1] === 0xd8 && buf[2] === 0xff },
+  { type: 'image/png', test: buf => buf.subarray(0, 8).equals(Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a])) },
+  { type: 'image/gif', test: buf => buf.subarray(0, 4).toString('ascii') === 'GIF8' },
+  { type: 'image/webp', test: buf => buf.subarray(0, 4).toString('ascii') === 'RIFF' && buf.subarray(8, 12).toString('ascii') === 'WEBP' },
+  { type: 'application/pdf', test: buf => buf.subarray(0, 5).toString('ascii') === '%PDF-' }
+];
+
+/**
+ * Detect a file's content type from its leading bytes
+ * @param {Buffer} buffer - The file contents
+ * @returns {string|null} - The detected MIME type, or null if unrecognised
+ */
+const sniffContentType = (buffer) => {
+  const match = SIGNATURES.find(signature => signature.test(buffer));
+  return match ? match.type : null;
+};
+
+/**
+ * Get the configured constraints for an upload category
+ * @param {string} category - Upload category, e.g. 'profileImage'
+ * @returns {{maxSize: number, allowedTypes: string[]}}
+ */
+const getUploadConstraints = (category) => {
+  const constraints = config.uploads[category];
+  if (!constraints) {
+    throw new Error(`Unknown upload category: ${category}`);
+  }
+  return constraints;
+};
+
+/**
+ * Validate an uploaded file against its category's size and type limits
+ * @param {Object} file - Multer file object (memory storage)
+ * @param {string} category - Upload category
+ * @returns {string} - The sniffed content type
+ */
+const validateUpload = (file, category) => {
+  const { maxSize, allowedTypes } = getUploadConstraints(category);
+
+  if (!file || !file.buffer || file.buffer.length === 0) {
+    throw new ValidationError('No file uploaded');
+  }
+
+  if (file.buffer.length > maxSize) {
+    throw new AppError(`File exceeds the maximum size of ${maxSize} bytes`, 413, 'FILE_TOO_LARGE');
+  }
+
+  const contentType = sniffContentType(file.buffer);
+  if (!contentType || !allowedTypes.includes(contentType)) {
+    throw new AppError(`File type not allowed. Allowed types: ${allowedTypes.join(', ')}`, 415, 'UNSUPPORTED_FILE_TYPE');
+  }
+
+  if (file.mimetype && file.mimetype !== contentType) {
+    throw new AppError('File content does not match its declared type', 415, 'UNSUPPORTED_FILE_TYPE');
+  }
+
+  return contentType;
+};
+
+/**
+ * Scan a file that is about to be made public. Infected files are refused
+ * and reported to admins; when the scanner can't give a verdict the upload
+ * is refused too, since a public file can't be quarantined.
+ * @param {Object} file - Multer file object (memory storage)
+ * @param {string} category - Upload category
+ * @param {string} contentType - The sniffed content type
+ * @param {string} uploadedBy - ID of the uploading user
+ */
+const scanBeforePublishing = async (file, category, contentType, uploadedBy) => {
+  if (!config.uploadScan.enabled) {
+    return;
+  }
+  let scan;
+  try {
+    scan = await ScanService.scanFile(file.buffer, { contentType, category });
+  } catch (error) {
+    throw new AppError('The file could not be checked for malware, please try again later', 503, 'SCAN_UNAVAILABLE');
+  }
+  if (scan.status === 'infected') {
+    await ScanService.notifyInfected({ category, fileName: file.originalname, uploadedBy, threat: scan.threat });
+    throw new AppError('The file was rejected by the malware scan', 422, 'FILE_INFECTED');
+  }
+};
+
+/**
+ * Validate and scan an uploaded file and store it publicly in S3
+ * @param {Object} file - Multer file object (memory storage)
+ * @param {string} category - Upload category
+ * @param {string} uploadedBy - ID of the uploading user, for infection reports
+ * @returns {Promise<string>} - The URL of the stored file
+ */
+const handleUpload = async (file, category, uploadedBy) => {
+  const contentType = validateUpload(file, category);
+  await scanBeforePublishing(file, category, contentType, uploadedBy);
+  return AWSService.uploadToS3(file.buffer, file.originalname, contentType);
+};
+
+/**
+ * Validate an uploaded file and store it privately in S3 (no public URL)
+ * @param {Object} file - Multer file object (memory storage)
+ * @param {string} category - Upload category
+ * @param {string} prefix - Key prefix, e.g. "documents/<appointmentId>"
+ * @returns {Promise<Object>} - The S3 key, the verified content type and the
+ * initial scan state; store the scan with the file and start
+ * ScanService.scanInBackground once it is saved
+ */
+const handlePrivateUpload = async (file, category, prefix) => {
+  const contentType = validateUpload(file, category);
+  const safeName = file.originalname.replace(/[^a-zA-Z0-9._-]/g, '_');
+  const key = `${prefix}/${uuidv4()}-${safeName}`;
+  await s3Service.uploadFile(key, file.buffer, contentType);
+  return { key, contentType, scan: ScanService.getInitialScan() };
+};
+
+module.exports = {
+  sniffContentType,
+  getUploadConstraints,
+  validateUpload,
+  handleUpload,
+  handlePrivateUpload
+};
@@ -0,0 +1,131 @@
+const Doctor = require('../models/doctor.model');
+const Appointment = require('../models/appointment.model');
+const config = require('../config/config');
+const AvailabilityService = require('./availability.service');
+const ReviewService = require('./review.service');
+const { isBlockingAppointment } = require('./appointment.service');
+const { createBookingToken, getSpecialtiesForSymptom, getRedFlagSymptoms } = require('./recommendation.service');
+
+const HOUR_MS = 60 * 60 * 1000;
+
+/**
+ * Pick the soonest urgent options: each doctor's next free slot, dropped
+ * when it starts too late, ordered by start time. Doctors free at the same
+ * time are ordered by how busy they are today, then by rating.
+ * @param {Object[]} candidates - [{ doctor, slot, load }], slot from
+ * AvailabilityService.getNextFreeSlotForDoctors or null
+ * @param {Object} options - now, maxWaitHours and limit
+ * @returns {Object[]} - The kept candidates, best first
+ */
+const rankUrgentOptions = (candidates, options = {}) => {
+  const urgentConfig = config.recommendations.urgent;
+  const now = options.now || new Date();
+  const latest = now.getTime() + (options.maxWaitHours || urgentConfig.maxWaitHours) * HOUR_MS;
+
+  return candidates
+    .filter(({ slot }) => slot && slot.startsAt.getTime() <= latest)
+    .sort((a, b) =>
+      a.slot.startsAt - b.slot.startsAt ||
+      a.load - b.load ||
+      (b.doctor.rating || 0) - (a.doctor.rating || 0))
+    .slice(0, options.limit || urgentConfig.maxOptions);
+};
+
+// Appointments each doctor still has today, as a measure of current load
+const getTodaysLoad = async (doctors, now) => {
+  const today = new Date(now);
+  today.setUTCHours(0, 0, 0, 0);
+  const appointments = await Appointment.find({
+    doctorId: { $in: doctors.map(doctor => doctor._id) },
+    date: today,
+    status: { $in: ['pending', 'confirmed'] }
+  }).select('doctorId status paymentStatus holdExpiresAt createdAt');
+
+  const load = new Map();
+  appointments
+    .filter(appointment => isBlockingAppointment(appointment, now))
+    .forEach(appointment => {
+      const key = appointment.doctorId.toString();
+      load.set(key, (load.get(key) || 0) + 1);
+    });
+  return load;
+};
+
+/**
+ * Soonest bookable slots across every verified doctor in the specialties
+ * @param {string[]} specialties - Specialties to consider
+ * @param {string[]} symptoms - Symptoms carried into the booking tokens
+ * @param {Object} options - now, limit and maxWaitHours
+ * @returns {Promise<Object[]>} - Options with doctor, slot and booking token, soonest first
+ */
+const findSoonestOptions = async (specialties, symptoms, options = {}) => {
+  const urgentConfig = config.recommendations.urgent;
+  const now = options.now || new Date();
+
+  const doctors = await Doctor.find({
+    specializations: { $in: specialties },
+    verificationStatus: 'verified'
+  })
+    .populate('userId', 'firstName lastName avatarUrl')
+    .limit(urgentConfig.maxCandidates);
+  const available = doctors.filter(doctor => doctor.userId);
+
+  // Today and tomorrow cover any wait up to a day
+  const lookaheadDays = Math.ceil((options.maxWaitHours || urgentConfig.maxWaitHours) / 24);
+  const [slots, load] = await Promise.all([
+    AvailabilityService.getNextFreeSlotForDoctors(available, { now, lookaheadDays }),
+    getTodaysLoad(available, now)
+  ]);
+
+  const ranked = rankUrgentOptions(available.map(doctor => ({
+    doctor,
+    slot: slots.get(doctor._id.toString()),
+    load: load.get(doctor._id.toString()) || 0
+  })), { now, limit: options.limit, maxWaitHours: options.maxWaitHours });
+
+  return ranked.map(({ doctor, slot, load: todaysAppointments }) => ({
+    doctor: {
+      _id: doctor._id,
+      firstName: doctor.userId.firstName,
+      lastName: doctor.userId.lastName,
+      avatarUrl: doctor.userId.avatarUrl,
+      specializations: doctor.specializations,
+      ratingSummary: ReviewService.getRatingSummary(doctor)
+    },
+    date: slot.date,
+    startTime: slot.startTime,
+    endTime: slot.endTime,
+    startsAt: slot.startsAt,
+    todaysAppointments,
+    bookingToken: createBookingToken(doctor._id, slot, symptoms)
+  }));
+};
+
+/**
+ * Soonest slots across every verified doctor treating the symptoms, for
+ * patients who need care today rather than a particular doctor. Red-flag
+ * symptoms get no slots; the patient is sent to emergency services instead.
+ * @param {string[]} symptoms - Reported symptoms
+ * @param {Object} options - now, limit and maxWaitHours
+ * @returns {Promise<Object>} - { emergency, redFlags, emergencyNumber } or
+ * { emergency: false, specialties, options }
+ */
+const findUrgentOptions = async (symptoms, options = {}) => {
+  const redFlags = getRedFlagSymptoms(symptoms);
+  if (redFlags.length > 0) {
+    return { emergency: true, redFlags, emergencyNumber: config.recommendations.urgent.emergencyNumber };
+  }
+
+  const specialties = [...new Set(symptoms.flatMap(symptom => getSpecialtiesForSymptom(symptom)))];
+  return {
+    emergency: false,
+    specialties,
+    options: await findSoonestOptions(specialties, symptoms, options)
+  };
+};
+
+module.exports = {
+  rankUrgentOptions,
+  findSoonestOptions,
+  findUrgentOptions
+};
@@ -0,0 +1,212 @@
+const crypto = require('crypto');
+const axios = require('axios');
+const { v4: uuidv4 } = require('uuid');
+const WebhookEndpoint = require('../models/webhook.endpoint.model');
+const WebhookDelivery = require('../models/webhook.delivery.model');
+const sqsService = require('./aws/sqs.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+const { SIGNATURE_HEADER, buildSignatureHeader } = require('../utils/webhook');
+
+// Appointment statuses that are published when an appointment moves to them
+const STATUS_EVENTS = {
+  confirmed: 'appointment.confirmed',
+  cancelled: 'appointment.cancelled',
+  completed: 'appointment.completed'
+};
+
+// Secret for a new endpoint
+const generateSecret = () => `whsec_${crypto.randomBytes(24).toString('hex')}`;
+
+// What receivers get about an appointment; notes and intake answers stay in the app
+const formatAppointment = (appointment) => ({
+  id: appointment._id,
+  doctorId: appointment.doctorId && (appointment.doctorId._id || appointment.doctorId),
+  patientId: appointment.patientId && (appointment.patientId._id || appointment.patientId),
+  date: appointment.date,
+  startTime: appointment.startTime,
+  endTime: appointment.endTime,
+  type: appointment.type,
+  status: appointment.status,
+  paymentStatus: appointment.paymentStatus,
+  confirmationCode: appointment.confirmationCode,
+  cancelledBy: appointment.cancelledBy,
+  cancellationCategory: appointment.cancellationCategory
+});
+
+const formatPayment = (payment) => ({
+  id: payment._id,
+  appointmentId: payment.appointmentId,
+  amount: payment.amount,
+  currency: payment.currency,
+  purpose: payment.purpose,
+  paymentMethod: payment.paymentMethod,
+  paidAt: payment.paidAt
+});
+
+/**
+ * Queue a delivery for the notification worker. When it can't be queued it
+ * stays pending for an admin to replay.
+ * @param {Object} delivery - The delivery
+ */
+const enqueueDelivery = async (delivery) => {
+  try {
+    await sqsService.sendMessage({ type: 'DELIVER_WEBHOOK', deliveryId: delivery._id.toString() });
+  } catch (error) {
+    logger.error('Could not queue webhook delivery', { deliveryId: delivery._id, error: error.message });
+  }
+};
+
+/**
+ * Record and queue one delivery of an event to every active endpoint
+ * subscribed to it
+ * @param {string} event - One of WEBHOOK_EVENTS
+ * @param {Object} data - The event's data
+ * @param {Date} now - Event time
+ * @returns {Promise<Object[]>} - The deliveries created
+ */
+const publishEvent = async (event, data, now = new Date()) => {
+  const endpoints = await WebhookEndpoint.find({ active: true, events: event }).select('_id');
+  if (endpoints.length === 0) {
+    return [];
+  }
+
+  const eventId = `evt_${uuidv4()}`;
+  const body = JSON.stringify({ id: eventId, type: event, createdAt: now.toISOString(), data });
+  const deliveries = await WebhookDelivery.insertMany(endpoints.map(endpoint => ({
+    endpointId: endpoint._id,
+    eventId,
+    event,
+    body
+  })));
+  for (const delivery of deliveries) {
+    await enqueueDelivery(delivery);
+  }
+  return deliveries;
+};
+
+/**
+ * Publish an appointment event. Never throws, so a webhook problem can't
+ * fail the booking or status change it reports.
+ * @param {string} event - e.g. 'appointment.created'
+ * @param {Object} appointment - The appointment as it is now
+ * @returns {Promise<void>}
+ */
+const publishAppointmentEvent = async (event, appointment) => {
+  try {
+    await publishEvent(event, { appointment: formatAppointment(appointment) });
+  } catch (error) {
+    logger.error('Could not publish webhook event', { event, appointmentId: appointment._id, error: error.message });
+  }
+};
+
+/**
+ * Publish the event for an appointment's new status, if it has one
+ * @param {Object} appointment - The appointment after the change
+ * @returns {Promise<void>}
+ */
+const publishStatusChange = async (appointment) => {
+  const event = STATUS_EVENTS[appointment.status];
+  if (event) {
+    await publishAppointmentEvent(event, appointment);
+  }
+};
+
+/**
+ * Publish payment.succeeded. Never throws.
+ * @param {Object} payment - The successful payment
+ * @returns {Promise<void>}
+ */
+const publishPaymentSucceeded = async (payment) => {
+  try {
+    await publishEvent('payment.succeeded', { payment: formatPayment(payment) });
+  } catch (error) {
+    logger.error('Could not publish webhook event', { event: 'payment.succeeded', paymentId: payment._id, error: error.message });
+  }
+};
+
+/**
+ * Worker job: POST a delivery's body to its endpoint, signed with the
+ * endpoint's secret, and record the attempt. Throws on failure so the queue
+ * retries with backoff; the last allowed attempt marks the delivery dead.
+ * @param {string} deliveryId - The delivery
+ * @param {number} receiveCount - Which attempt this is
+ * @returns {Promise<void>}
+ */
+const deliver = async (deliveryId, receiveCount = 1) => {
+  const delivery = await WebhookDelivery.findById(deliveryId);
+  if (!delivery || delivery.status === 'succeeded') {
+    return;
+  }
+  const endpoint = await WebhookEndpoint.findById(delivery.endpointId).select('+secret');
+  if (!endpoint || !endpoint.active) {
+    delivery.status = 'dead';
+    delivery.attempts.push({ at: new Date(), error: 'Endpoint deleted or deactivated' });
+    await delivery.save();
+    return;
+  }
+
+  const startedAt = Date.now();
+  let statusCode;
+  let failure;
+  try {
+    const response = await axios.post(endpoint.url, delivery.body, {
+      headers: {
+        'Content-Type': 'application/json',
+        [SIGNATURE_HEADER]: buildSignatureHeader(endpoint.secret, delivery.body),
+        'X-MedConnecter-Event': delivery.event,
+        'X-MedConnecter-Delivery': delivery._id.toString()
+      },
+      timeout: config.webhooks.timeoutMs,
+      maxRedirects: 0,
+      validateStatus: () => true
+    });
+    statusCode = response.status;
+    if (statusCode < 200 || statusCode >= 300) {
+      failure = `Endpoint responded with HTTP ${statusCode}`;
+    }
+  } catch (error) {
+    failure = error.message;
+  }
+
+  delivery.attempts.push({ at: new Date(), statusCode, error: failure, durationMs: Date.now() - startedAt });
+  if (failure) {
+    delivery.status = receiveCount >= sqsService.maxReceiveCount ? 'dead' : 'failed';
+  } else {
+    delivery.status = 'succeeded';
+    delivery.deliveredAt = new Date();
+  }
+  await delivery.save();
+  if (failure) {
+    throw new Error(`Webhook delivery ${delivery._id} failed: ${failure}`);
+  }
+};
+
+/**
+ * Send a delivery's event again as a new delivery to the same endpoint
+ * @param {Object} delivery - The delivery to replay
+ * @returns {Promise<Object>} - The new delivery
+ */
+const replayDelivery = async (delivery) => {
+  const replay = await WebhookDelivery.create({
+    endpointId: delivery.endpointId,
+    eventId: delivery.eventId,
+    event: delivery.event,
+    body: delivery.body,
+    replayOf: delivery._id
+  });
+  await enqueueDelivery(replay);
+  return replay;
+};
+
+module.exports = {
+  STATUS_EVENTS,
+  generateSecret,
+  formatAppointment,
+  publishEvent,
+  publishAppointmentEvent,
+  publishStatusChange,
+  publishPaymentSucceeded,
+  deliver,
+  replayDelivery
+};
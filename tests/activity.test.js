@@ -0,0 +1,114 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const User = require('../models/user.model');
+const { isActivityStale } = require('../middleware/activity.middleware');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+const MINUTE = 60 * 1000;
+
+// The activity write happens after the response, so wait for it to land
+const waitForLastActive = async (userId, after) => {
+  for (let attempt = 0; attempt < 50; attempt++) {
+    const { lastActiveAt } = await User.findById(userId).lean();
+    if (lastActiveAt && (!after || lastActiveAt > after)) {
+      return lastActiveAt;
+    }
+    await new Promise(resolve => setTimeout(resolve, 20));
+  }
+  throw new Error('lastActiveAt was not updated');
+};
+
+describe('isActivityStale', () => {
+  const now = new Date('2026-03-02T10:00:00Z');
+
+  it.each([
+    [undefined, true],
+    [new Date(now.getTime() - 4 * MINUTE), false],
+    [new Date(now.getTime() - 5 * MINUTE), true]
+  ])('with last activity %s is %s', (lastActiveAt, stale) => {
+    expect(isActivityStale(lastActiveAt, now)).toBe(stale);
+  });
+});
+
+describe('last-seen tracking', () => {
+  let user;
+  let auth;
+
+  beforeEach(async () => {
+    user = await createUser();
+    auth = await authHeader(user);
+  });
+
+  afterEach(() => {
+    jest.restoreAllMocks();
+  });
+
+  const getProfile = () => request(app)
+    .get('/api/v1/users/profile')
+    .set('Authorization', auth)
+    .expect(200);
+
+  it('records the first authenticated request', async () => {
+    const before = new Date();
+
+    await getProfile();
+
+    expect((await waitForLastActive(user._id)).getTime()).toBeGreaterThanOrEqual(before.getTime() - 1000);
+  });
+
+  it('writes at most once per interval', async () => {
+    await getProfile();
+    const first = await waitForLastActive(user._id);
+    const updateOne = jest.spyOn(User, 'updateOne');
+
+    await getProfile();
+    await getProfile();
+
+    expect(updateOne).not.toHaveBeenCalled();
+    expect((await User.findById(user._id)).lastActiveAt).toEqual(first);
+  });
+
+  it('writes again once the interval has passed', async () => {
+    const stale = new Date(Date.now() - 6 * MINUTE);
+    await User.updateOne({ _id: user._id }, { lastActiveAt: stale });
+
+    await getProfile();
+
+    expect((await waitForLastActive(user._id, stale)).getTime()).toBeGreaterThan(stale.getTime());
+  });
+
+  it('shows doctors the last-seen time of their patients', async () => {
+    const lastActiveAt = new Date(Date.now() - 60 * MINUTE);
+    await User.updateOne({ _id: user._id }, { lastActiveAt });
+    const { user: doctorUser, doctor } = await createDoctor();
+    await Appointment.create({
+      doctorId: doctor._id,
+      patientId: user._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up'
+    });
+
+    const res = await request(app)
+      .get('/api/v1/doctors/appointments')
+      .set('Authorization', await authHeader(doctorUser));
+
+    expect(res.status).toBe(200);
+    expect(res.body[0].patientId.lastActiveAt).toBe(lastActiveAt.toISOString());
+  });
+
+  it('keeps the appointment list to doctors', async () => {
+    const res = await request(app)
+      .get('/api/v1/doctors/appointments')
+      .set('Authorization', auth);
+
+    expect(res.status).toBe(403);
+  });
+});
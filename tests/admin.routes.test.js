@@ -0,0 +1,250 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const SettingsService = require('../services/settings.service');
+const { FINANCIAL_REPORT_COLUMNS } = require('../services/report.service');
+const { parseCsv } = require('../utils/csv');
+const config = require('../config/config');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('/api/v1/admin', () => {
+  beforeEach(async () => {
+    await createDoctor();
+  });
+
+  const listDoctors = (authorization) => request(app)
+    .get('/api/v1/admin/doctors')
+    .set('Authorization', authorization);
+
+  it('lets admins in', async () => {
+    const res = await listDoctors(await authHeader(await createUser({ role: 'admin' })));
+
+    expect(res.status).toBe(200);
+    expect(res.body.total).toBe(1);
+  });
+
+  it('returns 403 to patients', async () => {
+    const res = await listDoctors(await authHeader(await createUser()));
+
+    expect(res.status).toBe(403);
+    expect(res.body.doctors).toBeUndefined();
+  });
+
+  it('returns 403 to doctors', async () => {
+    const { user } = await createDoctor();
+
+    const res = await listDoctors(await authHeader(user));
+
+    expect(res.status).toBe(403);
+  });
+
+  it('returns 401 without a token', async () => {
+    const res = await request(app).get('/api/v1/admin/doctors');
+
+    expect(res.status).toBe(401);
+  });
+});
+
+describe('/api/v1/admin/settings', () => {
+  const date = daysFromToday(3);
+  let adminAuth;
+  let doctor;
+
+  beforeEach(async () => {
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+    ({ doctor } = await createDoctor());
+  });
+
+  // The database is emptied after each test; drop the cached overrides too
+  afterEach(async () => {
+    await SettingsService.refresh();
+  });
+
+  const updateSettings = (settings, version = 0, authorization = adminAuth) => request(app)
+    .put('/api/v1/admin/settings')
+    .set('Authorization', authorization)
+    .send({ version, settings });
+
+  const firstSlot = async () => {
+    const res = await request(app)
+      .get('/api/v1/appointments/slots/available')
+      .set('Authorization', await authHeader(await createUser()))
+      .query({ doctorId: doctor._id.toString(), startDate: date, endDate: date });
+    return res.body.availability[0].slotDetails[0];
+  };
+
+  it('serves the config defaults until something is changed', async () => {
+    const res = await request(app)
+      .get('/api/v1/admin/settings')
+      .set('Authorization', adminAuth);
+
+    expect(res.status).toBe(200);
+    expect(res.body.data).toMatchObject({ version: 0, overridden: [] });
+    expect(res.body.data.settings.appointments.slotDurationMinutes).toBe(config.appointments.slotDurationMinutes);
+  });
+
+  it('changes the slot length patients are offered', async () => {
+    expect(await firstSlot()).toMatchObject({ startTime: '09:00', endTime: '09:30' });
+
+    const res = await updateSettings({ appointments: { slotDurationMinutes: 60 } });
+
+    expect(res.status).toBe(200);
+    expect(res.body.data).toMatchObject({ version: 1, overridden: ['appointments.slotDurationMinutes'] });
+    expect(await firstSlot()).toMatchObject({ startTime: '09:00', endTime: '10:00' });
+  });
+
+  it('goes back to the default when a setting is reset', async () => {
+    await updateSettings({ appointments: { slotDurationMinutes: 60 } }).expect(200);
+
+    await updateSettings({ appointments: { slotDurationMinutes: null } }, 1).expect(200);
+
+    expect(await firstSlot()).toMatchObject({ startTime: '09:00', endTime: '09:30' });
+  });
+
+  it('rejects an update based on an old version', async () => {
+    await updateSettings({ appointments: { slotDurationMinutes: 60 } }).expect(200);
+
+    const res = await updateSettings({ appointments: { slotDurationMinutes: 45 } }, 0);
+
+    expect(res.status).toBe(409);
+    expect(res.body.data.settings.appointments.slotDurationMinutes).toBe(60);
+  });
+
+  it('rejects out-of-range and unknown settings', async () => {
+    const res = await updateSettings({ appointments: { slotDurationMinutes: 1 }, payments: { currency: 5 } });
+
+    expect(res.status).toBe(400);
+    expect(Object.keys(res.body.errors).sort()).toEqual(['appointments.slotDurationMinutes', 'payments.currency']);
+    expect(await firstSlot()).toMatchObject({ endTime: '09:30' });
+  });
+
+  it('keeps non-admins from changing settings', async () => {
+    const res = await updateSettings({ appointments: { slotDurationMinutes: 60 } }, 0, await authHeader(await createUser()));
+
+    expect(res.status).toBe(403);
+  });
+});
+
+describe('GET /api/v1/admin/reports/financial', () => {
+  let adminAuth;
+  let doctor;
+  let doctorUser;
+  let patient;
+  let paid;
+  let day;
+
+  beforeEach(async () => {
+    day = 0;
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+    ({ doctor, user: doctorUser } = await createDoctor());
+    patient = await createUser();
+    paid = await pay('2026-03-10T09:00:00Z', { transactionId: 'tr_paid' });
+    await pay('2026-03-12T09:00:00Z', {
+      transactionId: 'tr_refunded',
+      status: 'refunded',
+      refundedAmount: 60,
+      refundedAt: new Date('2026-03-13T09:00:00Z')
+    });
+    await pay('2026-03-11T09:00:00Z', { transactionId: 'tr_failed', status: 'failed' });
+    // Outside the period asked for below
+    await pay('2026-04-02T09:00:00Z', { transactionId: 'tr_april' });
+  });
+
+  // A payment made at paidAt for its own completed appointment
+  const pay = async (paidAt, fields) => {
+    day += 1;
+    const appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(-day),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      status: 'completed',
+      paymentStatus: 'paid'
+    });
+    return Payment.create({
+      appointmentId: appointment._id,
+      patientId: patient._id,
+      doctorId: doctor._id,
+      amount: 60,
+      status: 'success',
+      method: 'iDEAL',
+      paidAt: new Date(paidAt),
+      commissionPercent: 15,
+      platformFee: 9,
+      doctorNet: 51,
+      ...fields
+    });
+  };
+
+  const report = (query, authorization = adminAuth) => request(app)
+    .get('/api/v1/admin/reports/financial')
+    .set('Authorization', authorization)
+    .query({ from: '2026-03-01', to: '2026-03-31', ...query });
+
+  it('lists the successful and refunded payments in the period, oldest first', async () => {
+    const res = await report();
+
+    expect(res.status).toBe(200);
+    expect(res.body.data.columns).toEqual(FINANCIAL_REPORT_COLUMNS);
+    const { rows } = res.body.data;
+    expect(rows.map(row => row.providerReference)).toEqual(['tr_paid', 'tr_refunded']);
+    expect(rows[0]).toEqual({
+      paymentId: paid._id.toString(),
+      paidAt: '2026-03-10T09:00:00.000Z',
+      provider: 'Mollie',
+      providerReference: 'tr_paid',
+      method: 'iDEAL',
+      currency: 'EUR',
+      gross: 60,
+      commissionPercent: 15,
+      commission: 9,
+      tax: 0,
+      net: 51,
+      refundStatus: 'none',
+      refundedAmount: 0,
+      payoutId: null,
+      appointmentId: paid.appointmentId.toString(),
+      appointmentDate: daysFromToday(-1),
+      appointmentStartTime: '10:00',
+      appointmentType: 'video',
+      appointmentStatus: 'completed',
+      doctorId: doctor._id.toString(),
+      doctorName: `${doctorUser.firstName} ${doctorUser.lastName}`,
+      patientId: patient._id.toString()
+    });
+    expect(rows[1]).toMatchObject({ refundStatus: 'full', refundedAmount: 60, refundedAt: '2026-03-13T09:00:00.000Z' });
+  });
+
+  it('exports the same rows as CSV', async () => {
+    const res = await report({ format: 'csv' });
+
+    expect(res.status).toBe(200);
+    expect(res.headers['content-type']).toMatch(/^text\/csv/);
+    expect(res.headers['content-disposition']).toBe('attachment; filename="financial-report_2026-03-01_2026-03-31.csv"');
+    const [header, ...rows] = parseCsv(res.text);
+    expect(header).toEqual(FINANCIAL_REPORT_COLUMNS);
+    expect(rows).toHaveLength(2);
+    const row = Object.fromEntries(header.map((column, i) => [column, rows[0][i]]));
+    expect(row).toMatchObject({ providerReference: 'tr_paid', gross: '60', net: '51', refundStatus: 'none', refundedAt: '' });
+  });
+
+  it('rejects a reversed period', async () => {
+    const res = await report({ from: '2026-04-01', to: '2026-03-01' });
+
+    expect(res.status).toBe(400);
+  });
+
+  it('is admin-only', async () => {
+    const res = await report({}, await authHeader(doctorUser));
+
+    expect(res.status).toBe(403);
+  });
+});
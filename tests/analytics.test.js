@@ -0,0 +1,146 @@
+jest.mock('../services/aws.service');
+
+const mongoose = require('mongoose');
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('GET /api/v1/admin/analytics', () => {
+  let adminAuth;
+
+  beforeEach(async () => {
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+  });
+
+  const payment = (fields) => ({
+    appointmentId: new mongoose.Types.ObjectId(),
+    patientId: new mongoose.Types.ObjectId(),
+    doctorId: new mongoose.Types.ObjectId(),
+    method: 'iDEAL',
+    status: 'success',
+    ...fields
+  });
+
+  const getRevenue = async () => {
+    const res = await request(app)
+      .get('/api/v1/admin/analytics')
+      .set('Authorization', adminAuth)
+      .query({ startDate: '2026-03-01T00:00:00Z', endDate: '2026-03-03T23:59:59Z', granularity: 'day' })
+      .expect(200);
+    return res.body.data.revenue;
+  };
+
+  it('keeps revenue apart per currency', async () => {
+    await Payment.insertMany([
+      payment({ amount: 50, currency: 'EUR', paidAt: new Date('2026-03-02T09:00:00Z') }),
+      payment({ amount: 70, currency: 'EUR', paidAt: new Date('2026-03-02T15:00:00Z') }),
+      payment({ amount: 40, currency: 'USD', paidAt: new Date('2026-03-02T11:00:00Z') })
+    ]);
+
+    const revenue = await getRevenue();
+
+    expect(revenue).toEqual([
+      { period: '2026-03-01T00:00:00.000Z', amounts: {}, payments: 0 },
+      { period: '2026-03-02T00:00:00.000Z', amounts: { EUR: 120, USD: 40 }, payments: 3 },
+      { period: '2026-03-03T00:00:00.000Z', amounts: {}, payments: 0 }
+    ]);
+  });
+
+  it('counts a payment in the period it was paid, not created', async () => {
+    await Payment.insertMany([
+      // Created before the range, paid inside it
+      payment({ amount: 50, createdAt: new Date('2026-02-27T10:00:00Z'), paidAt: new Date('2026-03-01T10:00:00Z') }),
+      // Created inside the range, paid after it
+      payment({ amount: 30, createdAt: new Date('2026-03-03T22:00:00Z'), paidAt: new Date('2026-03-04T08:00:00Z') }),
+      // Still pending
+      payment({ amount: 25, status: 'pending', createdAt: new Date('2026-03-02T10:00:00Z') })
+    ]);
+
+    const revenue = await getRevenue();
+
+    expect(revenue.map(point => point.amounts)).toEqual([{ EUR: 50 }, {}, {}]);
+  });
+});
+
+describe('cancellation categories', () => {
+  let adminAuth;
+  let doctorAuth;
+  let doctor;
+  let patient;
+  let patientAuth;
+
+  beforeEach(async () => {
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+    let doctorUser;
+    ({ doctor, user: doctorUser } = await createDoctor());
+    doctorAuth = await authHeader(doctorUser);
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+  });
+
+  const book = (startTime) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date: daysFromToday(2),
+    startTime,
+    endTime: startTime.replace(':00', ':30'),
+    type: 'video',
+    reason: 'Check-up'
+  });
+
+  const cancel = (appointment, authorization, fields) => request(app)
+    .put(`/api/v1/appointments/${appointment._id}/status`)
+    .set('Authorization', authorization)
+    .send({ status: 'cancelled', reason: 'Something came up', ...fields });
+
+  const getCategories = async () => {
+    const res = await request(app)
+      .get('/api/v1/admin/analytics')
+      .set('Authorization', adminAuth)
+      .query({
+        startDate: new Date(Date.now() - 60 * 60 * 1000).toISOString(),
+        endDate: new Date(Date.now() + 60 * 1000).toISOString()
+      })
+      .expect(200);
+    return Object.fromEntries(res.body.data.cancellationCategories.map(({ category, ...counts }) => [category, counts]));
+  };
+
+  it('rejects a category outside the vocabulary', async () => {
+    const appointment = await book('10:00');
+
+    const res = await cancel(appointment, patientAuth, { cancellationCategory: 'bored' });
+
+    expect(res.status).toBe(400);
+    expect((await Appointment.findById(appointment._id)).status).toBe('pending');
+  });
+
+  it('stores a valid category with the free-text reason', async () => {
+    const appointment = await book('10:00');
+
+    await cancel(appointment, patientAuth, { cancellationCategory: 'found_other_care' }).expect(200);
+
+    expect(await Appointment.findById(appointment._id).lean()).toMatchObject({
+      status: 'cancelled',
+      cancellationCategory: 'found_other_care',
+      cancellationReason: 'Something came up'
+    });
+  });
+
+  it('counts cancellations per category and canceller in the analytics', async () => {
+    await cancel(await book('10:00'), patientAuth, { cancellationCategory: 'patient_unavailable' }).expect(200);
+    await cancel(await book('11:00'), patientAuth, { cancellationCategory: 'patient_unavailable' }).expect(200);
+    await cancel(await book('12:00'), doctorAuth, { cancellationCategory: 'emergency' }).expect(200);
+    await cancel(await book('13:00'), patientAuth).expect(200);
+
+    const categories = await getCategories();
+
+    expect(categories.patient_unavailable).toEqual({ count: 2, byCancelledBy: { patient: 2 } });
+    expect(categories.emergency).toEqual({ count: 1, byCancelledBy: { doctor: 1 } });
+    expect(categories.uncategorized).toEqual({ count: 1, byCancelledBy: { patient: 1 } });
+    expect(categories.other).toEqual({ count: 0, byCancelledBy: {} });
+  });
+});
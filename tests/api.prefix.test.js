@@ -0,0 +1,87 @@
+jest.mock('../services/aws.service');
+jest.mock('../middleware/version.middleware', () => {
+  const versionMiddleware = jest.requireActual('../middleware/version.middleware');
+  return jest.fn(versionMiddleware);
+});
+
+const request = require('supertest');
+const versionMiddleware = require('../middleware/version.middleware');
+const app = require('../app');
+
+describe('API prefixes', () => {
+  beforeEach(() => {
+    versionMiddleware.mockClear();
+  });
+
+  it('serves the API under /api/v1', async () => {
+    const res = await request(app).get('/api/v1/config');
+
+    expect(res.status).toBe(200);
+    expect(versionMiddleware).toHaveBeenCalledTimes(1);
+  });
+
+  it('keeps the unversioned /api routes working', async () => {
+    const v1 = await request(app).get('/api/v1/config');
+
+    const res = await request(app).get('/api/config');
+
+    expect(res.status).toBe(200);
+    expect(res.body).toEqual(v1.body);
+  });
+
+  it('runs the API middleware once for unknown /api/v1 paths', async () => {
+    const res = await request(app).get('/api/v1/no-such-route');
+
+    expect(res.status).toBe(404);
+    expect(versionMiddleware).toHaveBeenCalledTimes(1);
+  });
+
+  it('rejects unsupported versions', async () => {
+    const res = await request(app).get('/api/v2/config');
+
+    expect(res.status).toBe(400);
+  });
+});
+
+describe('request content types', () => {
+  it('rejects a form-encoded body with 415', async () => {
+    const res = await request(app)
+      .post('/api/v1/auth/login')
+      .type('form')
+      .send({ email: 'patient@example.com', password: 'secret' });
+
+    expect(res.status).toBe(415);
+    expect(res.body.message).toBe('Content-Type must be application/json');
+  });
+
+  it('rejects a plain text body on the unversioned routes too', async () => {
+    const res = await request(app)
+      .put('/api/appointments/123/status')
+      .set('Content-Type', 'text/plain')
+      .send('confirmed');
+
+    expect(res.status).toBe(415);
+  });
+
+  it('lets multipart bodies through for the upload routes', async () => {
+    const res = await request(app)
+      .post('/api/v1/no-such-route')
+      .attach('file', Buffer.from('data'), 'file.txt');
+
+    expect(res.status).toBe(404);
+  });
+
+  it('does not require a Content-Type on requests without a body', async () => {
+    const res = await request(app).post('/api/v1/no-such-route');
+
+    expect(res.status).toBe(404);
+  });
+
+  it('leaves reads alone', async () => {
+    const res = await request(app)
+      .get('/api/v1/config')
+      .set('Content-Type', 'text/plain');
+
+    expect(res.status).toBe(200);
+  });
+});
@@ -0,0 +1,929 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const BulkCancellation = require('../models/bulk.cancellation.model');
+const Payment = require('../models/payment.model');
+const Notification = require('../models/notification.model');
+const VideoSession = require('../models/video.model');
+const Message = require('../models/message.model');
+const AppointmentService = require('../services/appointment.service');
+const AppointmentStatusService = require('../services/appointment.status.service');
+const AvailabilityService = require('../services/availability.service');
+const notificationService = require('../services/notification.service');
+const config = require('../config/config');
+const { STATUS_TRANSITIONS, getTransitionError, isFinalStatus, transitionStatus } = require('../services/appointment.status.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('appointment status transitions', () => {
+  describe('getTransitionError', () => {
+    it('allows the doctor to confirm a pending appointment', () => {
+      expect(getTransitionError('pending', 'confirmed', 'doctor')).toBeNull();
+    });
+
+    it('does not let the patient confirm their own booking', () => {
+      expect(getTransitionError('pending', 'confirmed', 'patient').errorCode).toBe('STATUS_TRANSITION_FORBIDDEN');
+    });
+
+    it('rejects transitions that do not exist', () => {
+      expect(getTransitionError('pending', 'completed', 'doctor').errorCode).toBe('INVALID_STATUS_TRANSITION');
+      expect(getTransitionError('cancelled', 'confirmed', 'admin').errorCode).toBe('INVALID_STATUS_TRANSITION');
+    });
+
+    it.each([
+      ['pending', 'confirmed', ['doctor', 'admin', 'system'], ['patient']],
+      ['pending', 'cancelled', ['patient', 'doctor', 'admin', 'system'], []],
+      ['confirmed', 'pending', ['patient', 'doctor', 'admin'], ['system']],
+      ['confirmed', 'completed', ['doctor', 'admin', 'system'], ['patient']],
+      ['confirmed', 'no-show', ['doctor', 'admin', 'system'], ['patient']],
+      ['confirmed', 'cancelled', ['patient', 'doctor', 'admin', 'system'], []]
+    ])('allows %s to %s only for the roles it lists', (from, to, allowed, forbidden) => {
+      allowed.forEach(actor => expect(getTransitionError(from, to, actor)).toBeNull());
+      forbidden.forEach(actor => {
+        expect(getTransitionError(from, to, actor)).toMatchObject({ statusCode: 403, errorCode: 'STATUS_TRANSITION_FORBIDDEN' });
+      });
+    });
+
+    it('lets nobody move an appointment out of a final status', () => {
+      ['completed', 'no-show', 'cancelled'].forEach(from => {
+        Object.keys(STATUS_TRANSITIONS).forEach(to => {
+          expect(getTransitionError(from, to, 'admin')).toMatchObject({ statusCode: 409, errorCode: 'INVALID_STATUS_TRANSITION' });
+        });
+      });
+    });
+
+    it('never lets a draft change status', () => {
+      ['pending', 'confirmed', 'cancelled'].forEach(to => {
+        expect(getTransitionError('draft', to, 'admin').errorCode).toBe('INVALID_STATUS_TRANSITION');
+      });
+    });
+
+    it('treats completed, no-show and cancelled as final', () => {
+      ['completed', 'no-show', 'cancelled'].forEach(status => expect(isFinalStatus(status)).toBe(true));
+      ['pending', 'confirmed'].forEach(status => expect(isFinalStatus(status)).toBe(false));
+    });
+  });
+
+  describe('transitionStatus', () => {
+    let appointment;
+
+    beforeEach(async () => {
+      const { doctor } = await createDoctor();
+      const patient = await createUser();
+      appointment = await Appointment.create({
+        doctorId: doctor._id,
+        patientId: patient._id,
+        date: daysFromToday(2),
+        startTime: '10:00',
+        endTime: '10:30',
+        type: 'video',
+        reason: 'Check-up'
+      });
+    });
+
+    it('records the change in the status history', async () => {
+      const updated = await transitionStatus(appointment, 'cancelled', { actor: 'patient', reason: 'Feeling better' });
+
+      expect(updated.status).toBe('cancelled');
+      expect(updated.cancelledBy).toBe('patient');
+      expect(updated.cancellationReason).toBe('Feeling better');
+      expect(updated.statusHistory).toHaveLength(1);
+      expect(updated.statusHistory[0]).toMatchObject({ from: 'pending', to: 'cancelled', actor: 'patient' });
+    });
+
+    it('fails when the status changed since it was read', async () => {
+      await transitionStatus(appointment, 'confirmed', { actor: 'doctor' });
+
+      await expect(transitionStatus(appointment, 'cancelled', { actor: 'patient' }))
+        .rejects.toMatchObject({ errorCode: 'STATUS_CHANGED', statusCode: 409 });
+      expect((await Appointment.findById(appointment._id)).status).toBe('confirmed');
+    });
+  });
+
+  describe('PUT /api/v1/appointments/:id/status', () => {
+    let appointment;
+    let patientAuth;
+    let doctorAuth;
+
+    beforeEach(async () => {
+      const { user: doctorUser, doctor } = await createDoctor();
+      const patient = await createUser();
+      patientAuth = await authHeader(patient);
+      doctorAuth = await authHeader(doctorUser);
+      appointment = await Appointment.create({
+        doctorId: doctor._id,
+        patientId: patient._id,
+        date: daysFromToday(2),
+        startTime: '10:00',
+        endTime: '10:30',
+        type: 'video',
+        reason: 'Check-up'
+      });
+    });
+
+    const setStatus = (authorization, status) => request(app)
+      .put(`/api/v1/appointments/${appointment._id}/status`)
+      .set('Authorization', authorization)
+      .send({ status });
+
+    it('lets the doctor confirm', async () => {
+      const res = await setStatus(doctorAuth, 'confirmed');
+
+      expect(res.status).toBe(200);
+      expect(res.body.status).toBe('confirmed');
+    });
+
+    it('returns 403 when the patient tries to confirm', async () => {
+      const res = await setStatus(patientAuth, 'confirmed');
+
+      expect(res.status).toBe(403);
+      expect(res.body.code).toBe('STATUS_TRANSITION_FORBIDDEN');
+    });
+
+    it('returns 409 for a cancelled appointment', async () => {
+      await setStatus(patientAuth, 'cancelled').expect(200);
+
+      const res = await setStatus(doctorAuth, 'confirmed');
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('INVALID_STATUS_TRANSITION');
+    });
+
+    it('returns 403 to users with no part in the appointment', async () => {
+      const res = await setStatus(await authHeader(await createUser()), 'cancelled');
+
+      expect(res.status).toBe(403);
+    });
+
+    it('lets the doctor complete a confirmed appointment and records each step', async () => {
+      await setStatus(doctorAuth, 'confirmed').expect(200);
+
+      const res = await setStatus(doctorAuth, 'completed');
+
+      expect(res.status).toBe(200);
+      const updated = await Appointment.findById(appointment._id).lean();
+      expect(updated.statusHistory.map(({ from, to, actor }) => ({ from, to, actor }))).toEqual([
+        { from: 'pending', to: 'confirmed', actor: 'doctor' },
+        { from: 'confirmed', to: 'completed', actor: 'doctor' }
+      ]);
+    });
+
+    it.each(['completed', 'no-show'])('returns 403 when the patient marks it %s', async (status) => {
+      await setStatus(doctorAuth, 'confirmed').expect(200);
+
+      const res = await setStatus(patientAuth, status);
+
+      expect(res.status).toBe(403);
+      expect((await Appointment.findById(appointment._id)).status).toBe('confirmed');
+    });
+
+    it('returns 409 when completing an appointment that was never confirmed', async () => {
+      const res = await setStatus(doctorAuth, 'completed');
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('INVALID_STATUS_TRANSITION');
+    });
+
+    it('lets an admin cancel any appointment', async () => {
+      const res = await setStatus(await authHeader(await createUser({ role: 'admin' })), 'cancelled');
+
+      expect(res.status).toBe(200);
+      expect((await Appointment.findById(appointment._id)).cancelledBy).toBe('admin');
+    });
+
+    it('returns 409 when the status changes while the request runs', async () => {
+      // The patient cancels between the doctor's request reading the
+      // appointment and writing the new status
+      const getActorRole = AppointmentStatusService.getActorRole;
+      const spy = jest.spyOn(AppointmentStatusService, 'getActorRole').mockImplementationOnce(async (...args) => {
+        await Appointment.updateOne({ _id: appointment._id }, { $set: { status: 'cancelled' } });
+        return getActorRole(...args);
+      });
+
+      const res = await setStatus(doctorAuth, 'confirmed');
+      spy.mockRestore();
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('STATUS_CHANGED');
+      const stored = await Appointment.findById(appointment._id);
+      expect(stored.status).toBe('cancelled');
+      expect(stored.statusHistory).toHaveLength(0);
+    });
+
+    describe('with completion requiring activity', () => {
+      beforeEach(async () => {
+        config.appointments.completionRequiresActivity.enabled = true;
+        await setStatus(doctorAuth, 'confirmed').expect(200);
+      });
+
+      afterEach(() => {
+        config.appointments.completionRequiresActivity.enabled = false;
+      });
+
+      it('returns 409 when nobody joined the call or chatted', async () => {
+        const res = await setStatus(doctorAuth, 'completed');
+
+        expect(res.status).toBe(409);
+        expect(res.body.code).toBe('CONSULTATION_ACTIVITY_REQUIRED');
+        expect((await Appointment.findById(appointment._id)).status).toBe('confirmed');
+        await setStatus(doctorAuth, 'no-show').expect(200);
+      });
+
+      it('completes once the video call was joined', async () => {
+        await VideoSession.create({
+          appointmentId: appointment._id,
+          doctorId: appointment.doctorId,
+          patientId: appointment.patientId,
+          roomId: 'room-1',
+          sessionToken: 'token-1',
+          status: 'ended',
+          startedAt: new Date()
+        });
+
+        const res = await setStatus(doctorAuth, 'completed');
+
+        expect(res.status).toBe(200);
+      });
+
+      it('completes once a chat message was sent', async () => {
+        await Message.create({ chatId: appointment._id, senderId: appointment.patientId, content: 'Hello', type: 'text' });
+
+        const res = await setStatus(doctorAuth, 'completed');
+
+        expect(res.status).toBe(200);
+      });
+
+      it('lets an admin complete it anyway', async () => {
+        const res = await setStatus(await authHeader(await createUser({ role: 'admin' })), 'completed');
+
+        expect(res.status).toBe(200);
+      });
+
+      it('only applies to the configured appointment types', async () => {
+        await Appointment.updateOne({ _id: appointment._id }, { $set: { type: 'in-person' } });
+
+        const res = await setStatus(doctorAuth, 'completed');
+
+        expect(res.status).toBe(200);
+      });
+    });
+  });
+
+  describe('PUT /api/v1/appointments/:id/cancel', () => {
+    let appointment;
+    let patientAuth;
+
+    beforeEach(async () => {
+      const { doctor } = await createDoctor();
+      const patient = await createUser();
+      patientAuth = await authHeader(patient);
+      appointment = await Appointment.create({
+        doctorId: doctor._id,
+        patientId: patient._id,
+        date: daysFromToday(2),
+        startTime: '10:00',
+        endTime: '10:30',
+        type: 'video',
+        reason: 'Check-up',
+        status: 'confirmed'
+      });
+    });
+
+    const cancel = () => request(app)
+      .put(`/api/v1/appointments/${appointment._id}/cancel`)
+      .set('Authorization', patientAuth)
+      .send({ reason: 'Feeling better' });
+
+    it('cancels through the status service', async () => {
+      const res = await cancel();
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ status: 'cancelled', cancelledBy: 'patient', cancellationReason: 'Feeling better' });
+      const stored = await Appointment.findById(appointment._id);
+      expect(stored.statusHistory[0]).toMatchObject({ from: 'confirmed', to: 'cancelled', actor: 'patient' });
+    });
+
+    it('returns 409 for a completed appointment', async () => {
+      await Appointment.updateOne({ _id: appointment._id }, { $set: { status: 'completed' } });
+
+      const res = await cancel();
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('INVALID_STATUS_TRANSITION');
+    });
+
+    it('returns 409 when the status changes while the request runs', async () => {
+      const getActorRole = AppointmentStatusService.getActorRole;
+      const spy = jest.spyOn(AppointmentStatusService, 'getActorRole').mockImplementationOnce(async (...args) => {
+        await Appointment.updateOne({ _id: appointment._id }, { $set: { status: 'completed' } });
+        return getActorRole(...args);
+      });
+
+      const res = await cancel();
+      spy.mockRestore();
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('STATUS_CHANGED');
+      expect((await Appointment.findById(appointment._id)).status).toBe('completed');
+    });
+  });
+});
+
+describe('completing with a disposition', () => {
+  let appointment;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    const { user: doctorUser, doctor } = await createDoctor();
+    doctorAuth = await authHeader(doctorUser);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: (await createUser())._id,
+      date: daysFromToday(-1),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      status: 'confirmed'
+    });
+  });
+
+  afterEach(() => {
+    config.appointments.requireDisposition = false;
+  });
+
+  const complete = (body = {}) => request(app)
+    .put(`/api/v1/appointments/${appointment._id}/status`)
+    .set('Authorization', doctorAuth)
+    .send({ status: 'completed', ...body });
+
+  describe('when not required', () => {
+    it('completes without a disposition', async () => {
+      const res = await complete();
+
+      expect(res.status).toBe(200);
+      expect(res.body.status).toBe('completed');
+      expect(res.body.disposition).toBeUndefined();
+    });
+
+    it('records a disposition that is sent', async () => {
+      const res = await complete({ disposition: 'follow-up-needed' });
+
+      expect(res.status).toBe(200);
+      expect((await Appointment.findById(appointment._id)).disposition).toBe('follow-up-needed');
+    });
+  });
+
+  describe('when required', () => {
+    beforeEach(() => {
+      config.appointments.requireDisposition = true;
+    });
+
+    it('rejects completing without a disposition', async () => {
+      const res = await complete();
+
+      expect(res.status).toBe(400);
+      expect((await Appointment.findById(appointment._id)).status).toBe('confirmed');
+    });
+
+    it('completes with a disposition', async () => {
+      const res = await complete({ disposition: 'resolved' });
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ status: 'completed', disposition: 'resolved' });
+    });
+  });
+});
+
+describe('POST /api/v1/doctors/me/cancel-range', () => {
+  const date = daysFromToday(3);
+  let doctor;
+  let doctorAuth;
+  let patient;
+
+  beforeEach(async () => {
+    let doctorUser;
+    ({ user: doctorUser, doctor } = await createDoctor());
+    doctorAuth = await authHeader(doctorUser);
+    patient = await createUser();
+  });
+
+  const book = (startTime, endTime, fields = {}) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date,
+    startTime,
+    endTime,
+    type: 'video',
+    reason: 'Check-up',
+    fee: 50,
+    ...fields
+  });
+
+  const cancelRange = (body = {}) => request(app)
+    .post('/api/v1/doctors/me/cancel-range')
+    .set('Authorization', doctorAuth)
+    .send({ from: `${date}T10:00:00.000Z`, to: `${date}T16:00:00.000Z`, reason: 'Family emergency', ...body });
+
+  it('cancels the open appointments starting in the range, from inclusive and to exclusive', async () => {
+    const before = await book('09:00', '09:30');
+    const atStart = await book('10:00', '10:30', { status: 'confirmed' });
+    const inside = await book('12:00', '12:30');
+    const atEnd = await book('16:00', '16:30');
+
+    const res = await cancelRange({ offerRebooking: false });
+
+    expect(res.status).toBe(200);
+    expect(res.body.data).toMatchObject({ cancelled: 2, failed: 0 });
+    expect(res.body.data.results.map(result => result.appointmentId).sort())
+      .toEqual([atStart._id.toString(), inside._id.toString()].sort());
+    for (const cancelled of [atStart, inside]) {
+      expect(await Appointment.findById(cancelled._id).lean()).toMatchObject({
+        status: 'cancelled',
+        cancelledBy: 'doctor',
+        cancellationReason: 'Family emergency',
+        cancellationCategory: 'doctor_unavailable'
+      });
+    }
+    expect((await Appointment.findById(before._id)).status).toBe('pending');
+    expect((await Appointment.findById(atEnd._id)).status).toBe('pending');
+    expect(await BulkCancellation.countDocuments({ doctorId: doctor._id, cancelledCount: 2 })).toBe(1);
+  });
+
+  it('leaves appointments that were already cancelled or completed alone', async () => {
+    const cancelled = await book('11:00', '11:30', { status: 'cancelled', cancelledBy: 'patient' });
+    const completed = await book('12:00', '12:30', { status: 'completed' });
+
+    const res = await cancelRange({ offerRebooking: false });
+
+    expect(res.body.data).toMatchObject({ cancelled: 0, results: [] });
+    expect((await Appointment.findById(cancelled._id)).cancelledBy).toBe('patient');
+    expect((await Appointment.findById(completed._id)).status).toBe('completed');
+  });
+
+  it('refunds paid appointments in full', async () => {
+    const paid = await book('12:00', '12:30', { paymentStatus: 'paid' });
+    const payment = await Payment.create({
+      appointmentId: paid._id,
+      patientId: patient._id,
+      doctorId: doctor._id,
+      amount: 50,
+      status: 'success',
+      method: 'card',
+      paidAt: new Date(),
+      doctorNet: 50
+    });
+    const unpaid = await book('13:00', '13:30');
+
+    const res = await cancelRange({ offerRebooking: false });
+
+    const refunds = Object.fromEntries(res.body.data.results.map(result => [result.appointmentId, result.refundedAmount]));
+    expect(refunds).toEqual({ [paid._id.toString()]: 50, [unpaid._id.toString()]: 0 });
+    expect(await Payment.findById(payment._id).lean()).toMatchObject({ status: 'refunded', refundedAmount: 50 });
+    expect((await Appointment.findById(paid._id)).paymentStatus).toBe('refunded');
+  });
+
+  it('rejects a range that ends before it starts', async () => {
+    await book('12:00', '12:30');
+
+    const res = await cancelRange({ from: `${date}T16:00:00.000Z`, to: `${date}T10:00:00.000Z` });
+
+    expect(res.status).toBe(400);
+    expect(await Appointment.countDocuments({ status: 'cancelled' })).toBe(0);
+  });
+});
+
+describe('cancellation by the doctor', () => {
+  const date = daysFromToday(2);
+  const { rebookOnDoctorCancel } = config.appointments;
+  let appointment;
+  let patient;
+  let patientAuth;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    const { user: doctorUser, doctor } = await createDoctor();
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+    doctorAuth = await authHeader(doctorUser);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date,
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      status: 'confirmed'
+    });
+  });
+
+  afterEach(() => {
+    rebookOnDoctorCancel.enabled = true;
+  });
+
+  const cancel = (authorization) => request(app)
+    .put(`/api/v1/appointments/${appointment._id}/cancel`)
+    .set('Authorization', authorization)
+    .send({ reason: 'Called away' })
+    .expect(200);
+
+  // The notice is sent after the cancellation responds
+  const cancellationNotices = async () => {
+    for (let attempt = 0; attempt < 50; attempt++) {
+      const sent = await Notification.find({ userId: patient._id, title: 'Appointment Cancelled' });
+      if (sent.length === 2) return sent;
+      await new Promise(resolve => setTimeout(resolve, 20));
+    }
+    throw new Error('No cancellation notice was sent');
+  };
+
+  it('offers the patient the doctor\'s next free slots, each with a booking token', async () => {
+    await cancel(doctorAuth);
+
+    const sent = await cancellationNotices();
+    expect(sent.map(notification => notification.type).sort()).toEqual(['email', 'in-app']);
+    const { rebookOptions } = sent[0].data;
+    expect(rebookOptions).toHaveLength(rebookOnDoctorCancel.slotCount);
+    rebookOptions.forEach(option => expect(option.bookingToken).toEqual(expect.any(String)));
+    expect(rebookOptions).not.toContainEqual(expect.objectContaining({ date, startTime: '10:00' }));
+    expect(sent[0].message).toContain('Reason: Called away.');
+    expect(sent[0].link).toContain(encodeURIComponent(rebookOptions[0].bookingToken));
+  });
+
+  it('rebooks an offered slot with its token', async () => {
+    await cancel(doctorAuth);
+    const [{ data }] = await cancellationNotices();
+    const [offer] = data.rebookOptions;
+
+    const res = await request(app)
+      .post('/api/v1/appointments/from-recommendation')
+      .set('Authorization', patientAuth)
+      .send({ bookingToken: offer.bookingToken, type: 'video', reason: 'Rebooking' });
+
+    expect(res.status).toBe(201);
+    const rebooked = await Appointment.findOne({ patientId: patient._id, status: { $ne: 'cancelled' } });
+    expect(rebooked.startTime).toBe(offer.startTime);
+  });
+
+  it('sends no offers when turned off', async () => {
+    rebookOnDoctorCancel.enabled = false;
+
+    await cancel(doctorAuth);
+
+    const sent = await cancellationNotices();
+    expect(sent[0].data.rebookOptions).toEqual([]);
+    expect(sent[0].message).not.toContain('rebook');
+  });
+
+  it('does not send the notice when the patient cancels', async () => {
+    await cancel(patientAuth);
+    await new Promise(resolve => setTimeout(resolve, 100));
+
+    expect(await Notification.countDocuments({ userId: patient._id, title: 'Appointment Cancelled' })).toBe(0);
+  });
+});
+
+describe('appointment links in notifications', () => {
+  let doctor;
+  let doctorUser;
+  let patient;
+
+  beforeEach(async () => {
+    ({ doctor, user: doctorUser } = await createDoctor());
+    patient = await createUser();
+  });
+
+  const book = (fields = {}) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date: daysFromToday(2),
+    startTime: '10:00',
+    endTime: '10:30',
+    type: 'in-person',
+    reason: 'Check-up',
+    status: 'confirmed',
+    ...fields
+  });
+
+  const redirectTarget = (link) => {
+    const url = new URL(link);
+    expect(`${url.origin}${url.pathname}`).toBe(`${config.frontendUrl}/login`);
+    return url.searchParams.get('redirect');
+  };
+
+  it('links an in-person confirmation to the appointment page', async () => {
+    const appointment = await book();
+
+    await notificationService.sendAppointmentConfirmation(appointment);
+
+    const sent = await Notification.findOne({ userId: patient._id, title: 'Appointment Confirmed' });
+    expect(sent.relatedTo.id.toString()).toBe(appointment._id.toString());
+    expect(redirectTarget(sent.link)).toBe(`/appointments/${appointment._id}`);
+  });
+
+  it('links a video confirmation to the video join page', async () => {
+    const appointment = await book({ type: 'video' });
+
+    await notificationService.sendAppointmentConfirmation(appointment);
+
+    const sent = await Notification.findOne({ userId: patient._id, title: 'Appointment Confirmed' });
+    expect(redirectTarget(sent.link)).toBe(`/appointments/${appointment._id}/video`);
+  });
+
+  it('sends both participants the join link for their own video appointment, once', async () => {
+    const start = new Date(Date.now() + 5 * 60 * 1000);
+    const time = (date) => date.toISOString().slice(11, 16);
+    const appointment = await book({
+      type: 'video',
+      date: start.toISOString().slice(0, 10),
+      startTime: time(start),
+      endTime: time(new Date(start.getTime() + 30 * 60 * 1000)),
+      timeZone: 'UTC'
+    });
+    const other = await book({ type: 'video', date: daysFromToday(3) });
+
+    expect(await notificationService.sendVideoJoinLinks()).toBe(1);
+    expect(await notificationService.sendVideoJoinLinks()).toBe(0);
+
+    const sent = await Notification.find({ title: 'Video Consultation Starting Soon' });
+    expect(sent.map(notification => notification.userId.toString()).sort())
+      .toEqual([patient._id.toString(), doctorUser._id.toString()].sort());
+    sent.forEach(notification => {
+      expect(notification.relatedTo.id.toString()).toBe(appointment._id.toString());
+      expect(redirectTarget(notification.link)).toBe(`/appointments/${appointment._id}/video`);
+    });
+    expect((await Appointment.findById(other._id)).joinLinkSent).toBe(false);
+  });
+});
+
+describe('auto-completing appointments', () => {
+  const delayMinutes = config.appointments.autoComplete.delayMinutes;
+  let doctor;
+  let patient;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    patient = await createUser();
+  });
+
+  afterEach(() => {
+    config.appointments.completionRequiresActivity.enabled = false;
+  });
+
+  const book = (fields = {}) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date: daysFromToday(-1),
+    startTime: '10:00',
+    endTime: '10:30',
+    type: 'in-person',
+    reason: 'Check-up',
+    status: 'confirmed',
+    timeZone: 'UTC',
+    ...fields
+  });
+
+  describe('isDueForAutoComplete', () => {
+    const appointment = { status: 'confirmed', date: new Date('2026-03-10'), endTime: '10:30', timeZone: 'UTC' };
+    const end = new Date('2026-03-10T10:30:00.000Z');
+    const minutesAfterEnd = (minutes) => new Date(end.getTime() + minutes * 60 * 1000);
+
+    it('waits until the configured delay after the end time has passed', () => {
+      expect(AppointmentService.isDueForAutoComplete(appointment, minutesAfterEnd(delayMinutes - 1))).toBe(false);
+      expect(AppointmentService.isDueForAutoComplete(appointment, minutesAfterEnd(delayMinutes))).toBe(true);
+    });
+
+    it('measures the end time in the appointment\'s time zone', () => {
+      const amsterdam = { ...appointment, timeZone: 'Europe/Amsterdam' };
+      // 10:30 in Amsterdam is 09:30 UTC in March
+      expect(AppointmentService.isDueForAutoComplete(amsterdam, minutesAfterEnd(delayMinutes - 60))).toBe(true);
+      expect(AppointmentService.isDueForAutoComplete(amsterdam, minutesAfterEnd(delayMinutes - 61))).toBe(false);
+    });
+
+    it('only completes confirmed appointments', () => {
+      const later = minutesAfterEnd(delayMinutes + 60);
+      ['pending', 'cancelled', 'completed'].forEach(status => {
+        expect(AppointmentService.isDueForAutoComplete({ ...appointment, status }, later)).toBe(false);
+      });
+    });
+  });
+
+  it('completes confirmed appointments that ended long enough ago', async () => {
+    const ended = await book();
+    const upcoming = await book({ date: daysFromToday(1) });
+    const pending = await book({ status: 'pending' });
+
+    const completed = await AppointmentService.autoCompleteAppointments();
+
+    expect(completed.map(appointment => appointment._id.toString())).toEqual([ended._id.toString()]);
+    const updated = await Appointment.findById(ended._id).lean();
+    expect(updated).toMatchObject({ status: 'completed', autoCompleted: true });
+    expect(updated.statusHistory[0]).toMatchObject({ from: 'confirmed', to: 'completed', actor: 'system' });
+    expect((await Appointment.findById(upcoming._id)).status).toBe('confirmed');
+    expect((await Appointment.findById(pending._id)).status).toBe('pending');
+  });
+
+  it('leaves a video appointment whose call is still running for the next run', async () => {
+    const running = await book({ type: 'video' });
+    await VideoSession.create({
+      appointmentId: running._id,
+      doctorId: doctor._id,
+      patientId: patient._id,
+      roomId: 'room-1',
+      sessionToken: 'token-1',
+      status: 'active'
+    });
+
+    expect(await AppointmentService.autoCompleteAppointments()).toHaveLength(0);
+    expect((await Appointment.findById(running._id)).status).toBe('confirmed');
+  });
+
+  it('marks a video appointment with no activity as no-show when completion requires activity', async () => {
+    config.appointments.completionRequiresActivity.enabled = true;
+    const unattended = await book({ type: 'video' });
+
+    expect(await AppointmentService.autoCompleteAppointments()).toHaveLength(0);
+    expect((await Appointment.findById(unattended._id)).status).toBe('no-show');
+  });
+});
+
+describe('escalating bookings the doctor leaves unconfirmed', () => {
+  const MINUTE_MS = 60 * 1000;
+  const escalation = { ...config.appointments.pendingEscalation };
+  let doctor;
+  let doctorUser;
+  let patient;
+
+  beforeEach(async () => {
+    ({ user: doctorUser, doctor } = await createDoctor());
+    patient = await createUser();
+    Object.assign(config.appointments.pendingEscalation, { reminderMinutes: [60, 240], autoCancelMinutes: 24 * 60 });
+  });
+
+  afterEach(() => {
+    Object.assign(config.appointments.pendingEscalation, escalation);
+    config.payments.payBeforeConfirm = false;
+  });
+
+  // A pending booking that has waited the given number of minutes
+  const book = async (minutesPending, fields = {}) => {
+    const appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(3),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50,
+      status: 'pending',
+      ...fields
+    });
+    await Appointment.collection.updateOne(
+      { _id: appointment._id },
+      { $set: { createdAt: new Date(Date.now() - minutesPending * MINUTE_MS) } }
+    );
+    return Appointment.findById(appointment._id);
+  };
+
+  describe('getEscalationStep', () => {
+    const pendingSince = new Date('2026-03-10T08:00:00.000Z');
+    const appointment = { createdAt: pendingSince, date: new Date('2026-03-20'), startTime: '10:00', statusHistory: [] };
+    const after = (minutes) => new Date(pendingSince.getTime() + minutes * MINUTE_MS);
+    const withReminders = (remindersSent, since = pendingSince) => ({
+      ...appointment,
+      confirmationEscalation: { pendingSince: since, remindersSent }
+    });
+
+    it('reminds the doctor at each interval, the last time as the final reminder', () => {
+      expect(AppointmentService.getEscalationStep(appointment, after(59))).toBeNull();
+      expect(AppointmentService.getEscalationStep(appointment, after(60))).toMatchObject({ action: 'remind', level: 1, final: false });
+      expect(AppointmentService.getEscalationStep(withReminders(1), after(239))).toBeNull();
+      expect(AppointmentService.getEscalationStep(withReminders(1), after(240))).toMatchObject({ action: 'remind', level: 2, final: true });
+      expect(AppointmentService.getEscalationStep(withReminders(2), after(600))).toBeNull();
+    });
+
+    it('cancels at the deadline', () => {
+      expect(AppointmentService.getEscalationStep(withReminders(2), after(24 * 60))).toEqual({
+        action: 'cancel',
+        deadline: after(24 * 60)
+      });
+    });
+
+    it('cancels by the start time when that comes before the deadline', () => {
+      const soon = { ...appointment, date: new Date('2026-03-10'), startTime: '12:00' };
+
+      expect(AppointmentService.getEscalationStep(soon, after(60)).deadline).toEqual(new Date('2026-03-10T12:00:00.000Z'));
+      expect(AppointmentService.getEscalationStep(soon, after(4 * 60))).toMatchObject({ action: 'cancel' });
+    });
+
+    it('sends only the latest of several reminders that fell due at once', () => {
+      expect(AppointmentService.getEscalationStep(appointment, after(300))).toMatchObject({ level: 2, final: true });
+    });
+
+    it('starts a new round when a reschedule makes the booking pending again', () => {
+      const rescheduledAt = after(600);
+      const rescheduled = {
+        ...withReminders(2),
+        statusHistory: [{ from: 'confirmed', to: 'pending', at: rescheduledAt }]
+      };
+
+      expect(AppointmentService.getPendingSince(rescheduled)).toEqual(rescheduledAt);
+      expect(AppointmentService.getEscalationStep(rescheduled, after(659))).toBeNull();
+      expect(AppointmentService.getEscalationStep(rescheduled, after(660))).toMatchObject({ action: 'remind', level: 1 });
+      expect(AppointmentService.getEscalationStep(rescheduled, after(24 * 60 + 30)).action).toBe('remind');
+    });
+  });
+
+  describe('escalatePendingAppointments', () => {
+    it('records each reminder once', async () => {
+      const waiting = await book(61);
+      await book(30);
+      await book(600, { status: 'confirmed' });
+
+      const { reminders, cancelled } = await AppointmentService.escalatePendingAppointments();
+
+      expect(cancelled).toEqual([]);
+      expect(reminders.map(({ appointment, final }) => [appointment._id.toString(), final])).toEqual([[waiting._id.toString(), false]]);
+      expect((await Appointment.findById(waiting._id)).confirmationEscalation).toMatchObject({
+        pendingSince: waiting.createdAt,
+        remindersSent: 1
+      });
+      expect((await AppointmentService.escalatePendingAppointments()).reminders).toEqual([]);
+    });
+
+    it('sends the final reminder once the last interval has passed', async () => {
+      await book(241);
+
+      const { reminders } = await AppointmentService.escalatePendingAppointments();
+
+      expect(reminders).toHaveLength(1);
+      expect(reminders[0].final).toBe(true);
+      expect(reminders[0].appointment.confirmationEscalation.remindersSent).toBe(2);
+    });
+
+    it('cancels and refunds a booking still unconfirmed past the deadline, freeing the slot', async () => {
+      const stale = await book(24 * 60 + 1);
+      const payment = await Payment.create({
+        appointmentId: stale._id,
+        patientId: patient._id,
+        doctorId: doctor._id,
+        amount: 50,
+        status: 'success',
+        method: 'card',
+        paidAt: new Date(),
+        doctorNet: 50
+      });
+
+      const { reminders, cancelled } = await AppointmentService.escalatePendingAppointments();
+
+      expect(reminders).toEqual([]);
+      expect(cancelled).toHaveLength(1);
+      expect(cancelled[0].refunded).toBe(50);
+      const updated = await Appointment.findById(stale._id);
+      expect(updated).toMatchObject({ status: 'cancelled', cancellationCategory: 'doctor_unavailable', paymentStatus: 'refunded' });
+      expect(updated.confirmationEscalation.autoCancelledAt).toBeInstanceOf(Date);
+      expect(updated.statusHistory[updated.statusHistory.length - 1]).toMatchObject({ from: 'pending', to: 'cancelled', actor: 'system' });
+      expect((await Payment.findById(payment._id)).status).toBe('refunded');
+      expect(await AvailabilityService.isSlotFree(doctor, daysFromToday(3), '10:00', '10:30', 'video')).toBe(true);
+    });
+
+    it('leaves bookings awaiting the patient\'s payment to the unpaid expiry', async () => {
+      config.payments.payBeforeConfirm = true;
+      await book(24 * 60 + 1, { paymentStatus: 'pending' });
+
+      expect(await AppointmentService.escalatePendingAppointments()).toEqual({ reminders: [], cancelled: [] });
+    });
+  });
+
+  describe('notifications', () => {
+    it('reminds the doctor of the booking and its deadline', async () => {
+      const appointment = await book(61);
+
+      await notificationService.sendPendingConfirmationReminder(appointment, {
+        final: false,
+        deadline: new Date(Date.now() + 23 * 60 * MINUTE_MS)
+      });
+
+      const sent = await Notification.find({ userId: doctorUser._id });
+      expect(sent.map(notification => notification.type).sort()).toEqual(['email', 'in-app']);
+      expect(sent[0].title).toBe('Booking Awaiting Confirmation');
+      expect(sent[0].message).toMatch(/is waiting for your confirmation\. Unless you confirm it, it will be cancelled and the patient refunded at /);
+    });
+
+    it('tells the patient the booking was cancelled and refunded', async () => {
+      const appointment = await book(24 * 60 + 1);
+
+      await notificationService.sendUnconfirmedCancellationNotice(appointment, 50);
+
+      const sent = await Notification.find({ userId: patient._id });
+      expect(sent.map(notification => notification.type).sort()).toEqual(['email', 'in-app']);
+      expect(sent[0]).toMatchObject({ title: 'Appointment Not Confirmed' });
+      expect(sent[0].message).toContain('wasn\'t confirmed by the doctor in time, so it has been cancelled. Your payment has been refunded in full.');
+    });
+  });
+});
@@ -0,0 +1,244 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Session = require('../models/session.model');
+const User = require('../models/user.model');
+const RefreshToken = require('../models/refresh.token.model');
+const RevokedToken = require('../models/revoked.token.model');
+const TokenService = require('../services/token.service');
+const emailService = require('../services/email.service');
+const { generateToken } = require('../utils/helpers');
+const { useDatabase, createUser, authHeader } = require('./helpers');
+
+useDatabase();
+
+describe('POST /api/v1/auth/refresh', () => {
+  let user;
+  let tokenId;
+  let refreshToken;
+
+  beforeEach(async () => {
+    user = await createUser();
+    ({ tokenId } = generateToken(user));
+    await Session.create({ userId: user._id, tokenId });
+    refreshToken = await TokenService.issueRefreshToken(user._id, tokenId);
+  });
+
+  const refresh = (token) => request(app)
+    .post('/api/v1/auth/refresh')
+    .send({ refreshToken: token });
+
+  it('rotates the refresh token', async () => {
+    const res = await refresh(refreshToken);
+
+    expect(res.status).toBe(200);
+    expect(res.body.token).toEqual(expect.any(String));
+    expect(res.body.refreshToken).not.toBe(refreshToken);
+
+    const me = await request(app)
+      .get('/api/v1/users/profile')
+      .set('Authorization', `Bearer ${res.body.token}`);
+    expect(me.status).toBe(200);
+  });
+
+  it('accepts each refresh token once', async () => {
+    await refresh(refreshToken);
+
+    const res = await refresh(refreshToken);
+
+    expect(res.status).toBe(401);
+    expect(res.body.code).toBe('REFRESH_TOKEN_REUSED');
+  });
+
+  it('revokes the whole family when a token is reused', async () => {
+    const rotated = await refresh(refreshToken);
+    await refresh(refreshToken);
+
+    const res = await refresh(rotated.body.refreshToken);
+
+    expect(res.status).toBe(401);
+    expect(res.body.code).toBe('INVALID_REFRESH_TOKEN');
+    expect(await Session.findOne({ tokenId })).toMatchObject({ isActive: false });
+    const me = await request(app)
+      .get('/api/v1/users/profile')
+      .set('Authorization', `Bearer ${rotated.body.token}`);
+    expect(me.status).toBe(401);
+  });
+
+  it('rejects unknown tokens', async () => {
+    const res = await refresh('not-a-refresh-token');
+
+    expect(res.status).toBe(401);
+    expect(res.body.code).toBe('INVALID_REFRESH_TOKEN');
+  });
+
+  it('stops working after logout', async () => {
+    const { token } = generateToken(user, tokenId);
+    await request(app)
+      .post('/api/v1/auth/logout')
+      .set('Authorization', `Bearer ${token}`);
+
+    const res = await refresh(refreshToken);
+
+    expect(res.status).toBe(401);
+    expect(await RefreshToken.countDocuments({ familyId: tokenId, revokedAt: null })).toBe(0);
+  });
+});
+
+describe('POST /api/v1/auth/logout', () => {
+  it('revokes the access token until it would have expired', async () => {
+    const user = await createUser();
+    const auth = await authHeader(user);
+
+    const res = await request(app)
+      .post('/api/v1/auth/logout')
+      .set('Authorization', auth);
+
+    expect(res.status).toBe(200);
+    const revoked = await RevokedToken.findOne({ userId: user._id });
+    expect(revoked.expiresAt.getTime()).toBeGreaterThan(Date.now());
+    const me = await request(app)
+      .get('/api/v1/users/profile')
+      .set('Authorization', auth);
+    expect(me.status).toBe(401);
+    expect(me.body.error).toBe('Token has been revoked');
+  });
+});
+
+describe('POST /api/v1/auth/register', () => {
+  const valid = () => ({
+    email: 'new.patient@example.com',
+    phone: { countryCode: '+31', number: '612345678' },
+    firstName: 'New',
+    lastName: 'Patient'
+  });
+
+  beforeEach(() => {
+    jest.spyOn(emailService, 'sendOTP').mockResolvedValue();
+  });
+
+  afterEach(() => {
+    jest.restoreAllMocks();
+  });
+
+  const register = (body) => request(app)
+    .post('/api/v1/auth/register')
+    .send(body);
+
+  it('registers a valid patient', async () => {
+    const res = await register(valid());
+
+    expect(res.status).toBe(201);
+    expect(await User.countDocuments({ email: 'new.patient@example.com' })).toBe(1);
+  });
+
+  it('stores the email and phone normalized', async () => {
+    const res = await register({
+      ...valid(),
+      email: '  New.Patient@Example.COM ',
+      phone: { countryCode: '+31', number: '06 1234-5678' }
+    });
+
+    expect(res.status).toBe(201);
+    const user = await User.findOne();
+    expect(user.email).toBe('new.patient@example.com');
+    expect(user.phone.toObject()).toEqual({ countryCode: '+31', number: '612345678' });
+  });
+
+  it('finds a verified account by its email in another case', async () => {
+    await createUser({ email: 'new.patient@example.com' });
+
+    const res = await register({ ...valid(), email: ' NEW.Patient@example.com', phone: { countryCode: '+31', number: '687654321' } });
+
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe('User with this email or phone already exists and is verified');
+    expect(await User.countDocuments()).toBe(1);
+  });
+
+  it('finds a verified account by its phone in another format', async () => {
+    await createUser({ phone: { countryCode: '+31', number: '612345678' } });
+
+    const res = await register({ ...valid(), phone: { countryCode: '+31', number: '0031 6 12 34 56 78' } });
+
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe('User with this email or phone already exists and is verified');
+    expect(await User.countDocuments()).toBe(1);
+  });
+
+  it.each([
+    ['email', { email: '' }, 'Email is required'],
+    ['email', { email: 'not-an-email' }, 'Email is invalid'],
+    ['phone.number', { phone: { countryCode: '+31' } }, 'Phone number is required'],
+    ['phone.number', { phone: { countryCode: '+31', number: 'call me' } }, 'Phone number is invalid'],
+    ['firstName', { firstName: '  ' }, 'First name is required'],
+    ['lastName', { lastName: undefined }, 'Last name is required'],
+    ['role', { role: 'admin' }, 'Role must be patient or doctor'],
+    ['address', { address: 'Damrak 1' }, 'Address must be an object'],
+    ['smsConsent', { smsConsent: 'yes please' }, 'smsConsent must be a boolean']
+  ])('maps an invalid %s to its field: %s', async (field, fields, message) => {
+    const res = await register({ ...valid(), ...fields });
+
+    expect(res.status).toBe(400);
+    expect(res.body).toEqual({ success: false, error: 'Validation Error', errors: { [field]: message } });
+    expect(await User.countDocuments()).toBe(0);
+  });
+
+  it('reports every invalid field at once', async () => {
+    const res = await register({ email: 'nope' });
+
+    expect(res.status).toBe(400);
+    expect(res.body.errors).toEqual({
+      email: 'Email is invalid',
+      'phone.number': 'Phone number is required',
+      firstName: 'First name is required',
+      lastName: 'Last name is required'
+    });
+  });
+});
+
+describe('PUT /api/v1/users/profile', () => {
+  const update = async (user, body) => request(app)
+    .put('/api/v1/users/profile')
+    .set('Authorization', await authHeader(user))
+    .send(body);
+
+  it('stores a local phone number with the country code', async () => {
+    const user = await createUser();
+
+    const res = await update(user, { phone: '06-1234 5678' });
+
+    expect(res.status).toBe(200);
+    const updated = await User.findById(user._id);
+    expect(updated.phone.toObject()).toEqual({ countryCode: '+31', number: '612345678' });
+    expect(updated.isPhoneVerified).toBe(false);
+  });
+
+  it('keeps the phone verified when the number is the same once normalized', async () => {
+    const user = await createUser({ phone: { countryCode: '+31', number: '612345678' } });
+
+    const res = await update(user, { phone: '+31 6 12345678' });
+
+    expect(res.status).toBe(200);
+    expect(await User.findById(user._id)).toMatchObject({ isPhoneVerified: true });
+  });
+
+  it('rejects a number another user has in another format', async () => {
+    await createUser({ phone: { countryCode: '+31', number: '612345678' } });
+    const user = await createUser();
+
+    const res = await update(user, { phone: '06 12 34 56 78' });
+
+    expect(res.status).toBe(409);
+    expect(res.body.message).toBe('Phone number is already in use');
+  });
+
+  it('rejects an invalid number', async () => {
+    const user = await createUser();
+
+    const res = await update(user, { phone: '12' });
+
+    expect(res.status).toBe(400);
+    expect(res.body.message).toBe('Invalid phone number');
+  });
+});
@@ -0,0 +1,640 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const AppointmentService = require('../services/appointment.service');
+const AvailabilityService = require('../services/availability.service');
+const Doctor = require('../models/doctor.model');
+const Notification = require('../models/notification.model');
+const config = require('../config/config');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('GET /api/v1/appointments/slots/available', () => {
+  const date = daysFromToday(3);
+  let patientAuth;
+
+  beforeEach(async () => {
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const getSlots = (doctor, query = {}) => request(app)
+    .get('/api/v1/appointments/slots/available')
+    .set('Authorization', patientAuth)
+    .query({ doctorId: doctor._id.toString(), startDate: date, endDate: date, ...query });
+
+  const firstSlot = (res) => res.body.availability[0].slotDetails[0];
+
+  it('reads the schedule in UTC for doctors without a time zone', async () => {
+    const { doctor } = await createDoctor();
+
+    const res = await getSlots(doctor);
+
+    expect(res.status).toBe(200);
+    expect(res.body.timeZone.doctor).toBe('UTC');
+    expect(firstSlot(res)).toMatchObject({ startTime: '09:00', startsAt: `${date}T09:00:00.000Z` });
+  });
+
+  it('reads the schedule in the doctor\'s time zone', async () => {
+    const { doctor } = await createDoctor({ timeZone: 'Asia/Kolkata' });
+
+    const res = await getSlots(doctor);
+
+    expect(res.body.timeZone.doctor).toBe('Asia/Kolkata');
+    expect(firstSlot(res)).toMatchObject({
+      startTime: '09:00',
+      endTime: '09:30',
+      startsAt: `${date}T03:30:00.000Z`,
+      endsAt: `${date}T04:00:00.000Z`
+    });
+  });
+
+  it('converts slots to the patient\'s time zone', async () => {
+    const { doctor } = await createDoctor({ timeZone: 'Asia/Kolkata' });
+
+    const res = await getSlots(doctor, { tz: 'America/Sao_Paulo' });
+
+    expect(res.body.timeZone.requested).toBe('America/Sao_Paulo');
+    expect(firstSlot(res).local).toEqual({ date, startTime: '00:30', endTime: '01:00' });
+  });
+
+  it('rejects an unknown time zone', async () => {
+    const { doctor } = await createDoctor();
+
+    const res = await getSlots(doctor, { tz: 'Mars/Olympus_Mons' });
+
+    expect(res.status).toBe(400);
+  });
+
+  describe('with a duration', () => {
+    const freeSlots = (res) => res.body.availability[0].slots;
+
+    it('only offers start times where the whole visit fits in the block', async () => {
+      const { doctor } = await createDoctor();
+
+      const res = await getSlots(doctor, { duration: 90 });
+
+      expect(res.status).toBe(200);
+      expect(res.body.duration).toBe(90);
+      expect(freeSlots(res)[0]).toBe('09:00-10:30');
+      expect(freeSlots(res)).toContain('09:30-11:00');
+      expect(freeSlots(res)[freeSlots(res).length - 1]).toBe('15:30-17:00');
+      expect(freeSlots(res).some(slot => slot.startsWith('16:'))).toBe(false);
+    });
+
+    it('leaves out start times whose visit would run into a booking', async () => {
+      const { doctor } = await createDoctor();
+      await Appointment.create({
+        doctorId: doctor._id,
+        patientId: (await createUser())._id,
+        date,
+        startTime: '12:00',
+        endTime: '12:30',
+        type: 'video',
+        reason: 'Check-up'
+      });
+
+      const res = await getSlots(doctor, { duration: 90 });
+
+      expect(freeSlots(res)).toContain('10:30-12:00');
+      expect(freeSlots(res)).not.toContain('11:00-12:30');
+      expect(freeSlots(res)).not.toContain('11:30-13:00');
+      expect(freeSlots(res)).toContain('12:30-14:00');
+    });
+
+    it('uses the standard slot length without one', async () => {
+      const { doctor } = await createDoctor();
+
+      const res = await getSlots(doctor);
+
+      expect(res.body.duration).toBe(30);
+      expect(freeSlots(res)).toContain('16:30-17:00');
+    });
+
+    it.each(['2', '600', 'long'])('rejects the duration %s', async (duration) => {
+      const { doctor } = await createDoctor();
+
+      const res = await getSlots(doctor, { duration });
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors).toEqual({ duration: 'Duration must be between 5 and 480 minutes' });
+    });
+  });
+
+  describe('with a first-slot offset and last-slot cutoff', () => {
+    const DAYS = ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'];
+    const startTimes = (res) => res.body.availability[0].slotDetails.map(slot => slot.startTime);
+
+    const book = (doctor, timeSlot) => request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', patientAuth)
+      .send({ doctorId: doctor._id.toString(), date, timeSlot, type: 'video', reason: 'Check-up' });
+
+    it('moves the first slot later and the last slot earlier', async () => {
+      const { doctor } = await createDoctor({ firstSlotOffset: 30, lastSlotCutoff: 60 });
+
+      const res = await getSlots(doctor);
+
+      expect(startTimes(res)[0]).toBe('09:30');
+      expect(startTimes(res)[startTimes(res).length - 1]).toBe('15:30');
+    });
+
+    it('only trims the start of the first block and the end of the last one', async () => {
+      const { doctor } = await createDoctor({
+        firstSlotOffset: 30,
+        lastSlotCutoff: 30,
+        availability: DAYS.map(day => ({
+          day,
+          slots: [{ startTime: '13:00', endTime: '17:00' }, { startTime: '09:00', endTime: '12:00' }]
+        }))
+      });
+
+      const res = await getSlots(doctor);
+
+      expect(startTimes(res)).toEqual(expect.arrayContaining(['09:30', '11:30', '13:00', '16:00']));
+      expect(startTimes(res)).not.toContain('09:00');
+      expect(startTimes(res)).not.toContain('16:30');
+    });
+
+    it('refuses bookings in the trimmed time', async () => {
+      const { doctor } = await createDoctor({ firstSlotOffset: 30, lastSlotCutoff: 60 });
+
+      const early = await book(doctor, '09:00-09:30');
+      const late = await book(doctor, '16:00-16:30');
+
+      expect(early.status).toBe(409);
+      expect(early.body.code).toBe('OUTSIDE_DOCTOR_AVAILABILITY');
+      expect(late.body.code).toBe('OUTSIDE_DOCTOR_AVAILABILITY');
+      expect((await book(doctor, '09:30-10:00')).status).toBe(201);
+    });
+
+    it('is saved with the weekly schedule', async () => {
+      const { user, doctor } = await createDoctor();
+
+      const res = await request(app)
+        .put('/api/v1/doctors/me/availability')
+        .set('Authorization', await authHeader(user))
+        .send({ firstSlotOffset: 15, lastSlotCutoff: 45 });
+
+      expect(res.status).toBe(200);
+      const saved = await Doctor.findById(doctor._id);
+      expect(saved).toMatchObject({ firstSlotOffset: 15, lastSlotCutoff: 45 });
+      expect(saved.availability).toHaveLength(7);
+    });
+
+    it.each([-5, 300, 12.5])('rejects an offset of %p minutes', async (firstSlotOffset) => {
+      const { user } = await createDoctor();
+
+      const res = await request(app)
+        .put('/api/v1/doctors/me/availability')
+        .set('Authorization', await authHeader(user))
+        .send({ firstSlotOffset });
+
+      expect(res.status).toBe(400);
+      expect(res.body.error).toBe('firstSlotOffset must be a whole number of minutes between 0 and 240');
+    });
+  });
+
+  describe('with a lunch break', () => {
+    const DAYS = ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'];
+    const lunchBreak = { startTime: '12:00', endTime: '13:00' };
+    const withBreaks = (breaks) => DAYS.map(day => ({ day, slots: [{ startTime: '09:00', endTime: '17:00', breaks }] }));
+
+    const startTimes = (res) => res.body.availability[0].slotDetails.map(slot => slot.startTime);
+
+    it('leaves out the slots inside the break', async () => {
+      const { doctor } = await createDoctor({ availability: withBreaks([lunchBreak]) });
+
+      const res = await getSlots(doctor);
+
+      expect(res.status).toBe(200);
+      expect(startTimes(res)).toEqual(expect.arrayContaining(['11:30', '13:00']));
+      expect(startTimes(res)).not.toContain('12:00');
+      expect(startTimes(res)).not.toContain('12:30');
+    });
+
+    it('refuses a booking that falls in the break', async () => {
+      const { doctor } = await createDoctor({ availability: withBreaks([lunchBreak]) });
+
+      const res = await request(app)
+        .post('/api/v1/appointments')
+        .set('Authorization', patientAuth)
+        .send({ doctorId: doctor._id.toString(), date, timeSlot: '12:00-12:30', type: 'video', reason: 'Check-up' });
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('OUTSIDE_DOCTOR_AVAILABILITY');
+      expect(await Appointment.countDocuments()).toBe(0);
+    });
+
+    it('rejects a break outside its block', async () => {
+      const { user } = await createDoctor();
+
+      const res = await request(app)
+        .put('/api/v1/doctors/me/availability')
+        .set('Authorization', await authHeader(user))
+        .send({ availability: withBreaks([{ startTime: '08:00', endTime: '09:30' }]) });
+
+      expect(res.status).toBe(400);
+      expect(res.body.error).toMatch(/within the block/);
+    });
+
+    it('rejects overlapping breaks', async () => {
+      const { user } = await createDoctor();
+
+      const res = await request(app)
+        .put('/api/v1/doctors/me/availability')
+        .set('Authorization', await authHeader(user))
+        .send({ availability: withBreaks([lunchBreak, { startTime: '12:30', endTime: '13:30' }]) });
+
+      expect(res.status).toBe(400);
+      expect(res.body.error).toMatch(/overlap/);
+    });
+  });
+});
+
+describe('AvailabilityService.getAvailabilityError', () => {
+  const { getAvailabilityError } = AvailabilityService;
+
+  it('rejects entries that are not objects', () => {
+    expect(getAvailabilityError([null])).toBe('Each availability entry must be an object');
+    expect(getAvailabilityError(['monday'])).toBe('Each availability entry must be an object');
+  });
+
+  it('rejects an unknown day even without slots', () => {
+    expect(getAvailabilityError([{ day: 'funday', slots: [] }])).toMatch(/^Day must be one of/);
+  });
+
+  it('rejects blocks that are not objects', () => {
+    expect(getAvailabilityError([{ day: 'monday', slots: [null] }])).toMatch(/must be an object/);
+  });
+
+  it('accepts a day with no blocks', () => {
+    expect(getAvailabilityError([{ day: 'Monday', slots: [] }])).toBeNull();
+  });
+
+  it('answers a null entry with 400 rather than a server error', async () => {
+    const { user } = await createDoctor();
+
+    const res = await request(app)
+      .put('/api/v1/doctors/me/availability')
+      .set('Authorization', await authHeader(user))
+      .send({ availability: [null] });
+
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe('Each availability entry must be an object');
+  });
+});
+
+describe('Doctor.timeZone', () => {
+  it('must be an IANA time zone name', async () => {
+    await expect(createDoctor({ timeZone: 'CEST+2' })).rejects.toThrow(/IANA time zone/);
+  });
+});
+
+describe('AvailabilityService.conflictsWithAppointment', () => {
+  const existing = { startTime: '10:00', endTime: '11:00', type: 'video' };
+  const minutes = (time) => {
+    const [hours, mins] = time.split(':').map(Number);
+    return hours * 60 + mins;
+  };
+  const conflicts = (doctor, start, end, type = 'video', appointment = existing) => {
+    return AvailabilityService.conflictsWithAppointment(doctor, minutes(start), minutes(end), type, appointment);
+  };
+
+  it.each([
+    ['ends where the existing one starts', '09:00', '10:00', false],
+    ['starts where the existing one ends', '11:00', '11:30', false],
+    ['lies entirely before it', '08:00', '09:00', false],
+    ['overlaps its start', '09:30', '10:30', true],
+    ['overlaps its end', '10:30', '11:30', true],
+    ['sits inside it', '10:15', '10:45', true],
+    ['contains it', '09:30', '11:30', true],
+    ['matches it exactly', '10:00', '11:00', true]
+  ])('a new appointment that %s conflicts: %s', (_case, start, end, expected) => {
+    expect(conflicts({}, start, end)).toBe(expected);
+  });
+
+  describe('with an in-person buffer', () => {
+    const doctor = { appointmentBuffers: { 'in-person': 15 } };
+
+    it('keeps the buffer after an in-person visit, whatever follows', () => {
+      const visit = { ...existing, type: 'in-person' };
+
+      expect(conflicts(doctor, '11:00', '11:30', 'video', visit)).toBe(true);
+      expect(conflicts(doctor, '11:15', '11:45', 'video', visit)).toBe(false);
+    });
+
+    it('keeps the buffer before an in-person visit', () => {
+      expect(conflicts(doctor, '11:00', '11:30', 'in-person')).toBe(true);
+      expect(conflicts(doctor, '11:15', '11:45', 'in-person')).toBe(false);
+    });
+
+    it('lets video calls follow each other directly', () => {
+      expect(conflicts(doctor, '11:00', '11:30', 'video')).toBe(false);
+    });
+  });
+});
+
+describe('payment holds next to an in-person visit', () => {
+  const date = daysFromToday(2);
+  let doctor;
+  let patientAuth;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor({ appointmentBuffers: { 'in-person': 15 } }));
+    patientAuth = await authHeader(await createUser());
+    await Appointment.create({
+      doctorId: doctor._id,
+      patientId: (await createUser())._id,
+      date,
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'in-person',
+      reason: 'Check-up',
+      paymentStatus: 'paid'
+    });
+  });
+
+  const videoCall = async (startTime, endTime) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: (await createUser())._id,
+    date,
+    startTime,
+    endTime,
+    type: 'video',
+    reason: 'Check-up'
+  });
+
+  it('are refused within the visit\'s buffer, as booking is', async () => {
+    const booked = await request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', patientAuth)
+      .send({ doctorId: doctor._id.toString(), date, timeSlot: '10:30-11:00', type: 'video', reason: 'Check-up' });
+    expect(booked.status).toBe(409);
+    expect(booked.body.code).toBe('SLOT_UNAVAILABLE');
+
+    const held = await AppointmentService.placePaymentHold(await videoCall('10:30', '11:00'));
+
+    expect(held).toBeNull();
+  });
+
+  it('are placed once the buffer has passed', async () => {
+    const held = await AppointmentService.placePaymentHold(await videoCall('10:45', '11:15'));
+
+    expect(held.paymentStatus).toBe('held');
+  });
+});
+
+describe('POST /api/v1/doctors/me/availability/import', () => {
+  let doctor;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    doctorAuth = await authHeader(user);
+  });
+
+  const importCsv = (csv, fields = {}) => {
+    const req = request(app)
+      .post('/api/v1/doctors/me/availability/import')
+      .set('Authorization', doctorAuth)
+      .attach('file', Buffer.from(csv), { filename: 'schedule.csv', contentType: 'text/csv' });
+    Object.entries(fields).forEach(([name, value]) => req.field(name, value));
+    return req;
+  };
+
+  const storedSchedule = async () => {
+    const { availability } = await Doctor.findById(doctor._id).lean();
+    return availability.map(({ day, slots }) => ({
+      day,
+      slots: slots.map(({ startTime, endTime }) => `${startTime}-${endTime}`)
+    }));
+  };
+
+  it('replaces the schedule with a valid import', async () => {
+    const res = await importCsv('day,start,end\nmonday,09:00,12:00\nmonday,13:00,17:00\nwednesday,08:30,12:30\n', {
+      mode: 'replace'
+    });
+
+    expect(res.status).toBe(200);
+    expect(res.body.summary).toMatchObject({ rows: 3, imported: 3, rejected: 0, applied: true });
+    expect(await storedSchedule()).toEqual([
+      { day: 'monday', slots: ['09:00-12:00', '13:00-17:00'] },
+      { day: 'wednesday', slots: ['08:30-12:30'] }
+    ]);
+  });
+
+  it('imports the valid rows and reports the invalid ones', async () => {
+    const res = await importCsv([
+      'day,start,end',
+      'monday,09:00,12:00',
+      'funday,09:00,12:00',
+      'tuesday,14:00,13:00',
+      'monday,11:00,13:00',
+      'tuesday,9am,noon'
+    ].join('\n'), { mode: 'replace' });
+
+    expect(res.status).toBe(200);
+    expect(res.body.summary).toMatchObject({ rows: 5, imported: 1, rejected: 4, applied: true });
+    expect(res.body.results.map(({ row, status }) => ({ row, status }))).toEqual([
+      { row: 2, status: 'imported' },
+      { row: 3, status: 'rejected' },
+      { row: 4, status: 'rejected' },
+      { row: 5, status: 'rejected' },
+      { row: 6, status: 'rejected' }
+    ]);
+    expect(res.body.results[3].error).toBe('Overlaps 09:00-12:00 on monday');
+    expect(await storedSchedule()).toEqual([{ day: 'monday', slots: ['09:00-12:00'] }]);
+  });
+
+  it('imports nothing when atomic and any row is invalid', async () => {
+    const before = await storedSchedule();
+
+    const res = await importCsv('monday,09:00,12:00\nfunday,09:00,12:00', { mode: 'replace', atomic: 'true' });
+
+    expect(res.status).toBe(422);
+    expect(res.body.summary).toMatchObject({ imported: 1, rejected: 1, applied: false });
+    expect(await storedSchedule()).toEqual(before);
+  });
+
+  it('merges into the current schedule, skipping rows it already has', async () => {
+    const res = await importCsv('monday,09:00,17:00\nmonday,18:00,20:00');
+
+    expect(res.status).toBe(200);
+    expect(res.body.summary).toMatchObject({ mode: 'merge', imported: 1, duplicates: 1 });
+    const monday = (await storedSchedule()).find(entry => entry.day === 'monday');
+    expect(monday.slots).toEqual(['09:00-17:00', '18:00-20:00']);
+  });
+});
+
+describe('next available slot in doctor listings', () => {
+  const date = daysFromToday(2);
+  const weekday = ['sunday', 'monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday'][new Date(date).getUTCDay()];
+
+  const listNextAvailable = async () => {
+    const res = await request(app).get('/api/v1/doctors').expect(200);
+    return Object.fromEntries(res.body.doctors.map(doctor => [doctor._id, doctor.nextAvailable]));
+  };
+
+  // One half-hour slot a week, so a booking moves the next one a week on
+  const weeklySlotDoctor = () => createDoctor({
+    availability: [{ day: weekday, slots: [{ startTime: '10:00', endTime: '10:30' }] }]
+  });
+
+  it('shows the start of the first free slot', async () => {
+    const { doctor } = await weeklySlotDoctor();
+
+    const nextAvailable = await listNextAvailable();
+
+    expect(nextAvailable[doctor._id]).toBe(`${date}T10:00:00.000Z`);
+  });
+
+  it('moves on once that slot is booked', async () => {
+    const { doctor } = await weeklySlotDoctor();
+    await Appointment.create({
+      doctorId: doctor._id,
+      patientId: (await createUser())._id,
+      date,
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up'
+    });
+
+    const nextAvailable = await listNextAvailable();
+
+    expect(nextAvailable[doctor._id]).toBe(`${daysFromToday(9)}T10:00:00.000Z`);
+  });
+
+  it('is null when nothing is free within the lookahead window', async () => {
+    const { doctor } = await createDoctor({ availability: [] });
+
+    const nextAvailable = await listNextAvailable();
+
+    expect(nextAvailable[doctor._id]).toBeNull();
+  });
+});
+
+describe('schedule changes that strand booked appointments', () => {
+  const date = daysFromToday(2);
+  const WEEKDAYS = ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'];
+  // Mornings only, dropping the afternoons
+  const mornings = WEEKDAYS.map(day => ({ day, slots: [{ startTime: '09:00', endTime: '13:00' }] }));
+  let doctor;
+  let doctorAuth;
+  let patient;
+  let stranded;
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    doctorAuth = await authHeader(user);
+    patient = await createUser();
+    const book = (fields) => Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date,
+      type: 'video',
+      reason: 'Check-up',
+      status: 'confirmed',
+      ...fields
+    });
+    stranded = [
+      await book({ startTime: '15:00', endTime: '15:30' }),
+      await book({ startTime: '16:00', endTime: '16:30', status: 'pending' })
+    ];
+    await book({ startTime: '10:00', endTime: '10:30' });
+    await book({ startTime: '14:00', endTime: '14:30', status: 'cancelled' });
+    await book({ date: daysFromToday(-1), startTime: '15:00', endTime: '15:30', status: 'completed' });
+  });
+
+  afterEach(() => {
+    config.appointments.confirmScheduleConflicts = true;
+  });
+
+  const updateAvailability = (body) => request(app)
+    .put('/api/v1/doctors/me/availability')
+    .set('Authorization', doctorAuth)
+    .send(body);
+
+  const notices = () => Notification.find({ userId: patient._id, title: 'Please Reschedule Your Appointment' });
+
+  it('refuses the change and lists the appointments it would leave uncovered', async () => {
+    const res = await updateAvailability({ availability: mornings });
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('SCHEDULE_CONFLICTS');
+    expect(res.body.conflicts).toEqual([
+      { id: stranded[0]._id.toString(), date, startTime: '15:00', endTime: '15:30', type: 'video', status: 'confirmed', patientNotified: false },
+      { id: stranded[1]._id.toString(), date, startTime: '16:00', endTime: '16:30', type: 'video', status: 'pending', patientNotified: false }
+    ]);
+    expect((await Doctor.findById(doctor._id)).availability[0].slots[0].endTime).toBe('17:00');
+    expect(await notices()).toHaveLength(0);
+  });
+
+  it('saves a confirmed change, keeps the appointments and asks the patients to reschedule', async () => {
+    const res = await updateAvailability({ availability: mornings, confirmConflicts: true });
+
+    expect(res.status).toBe(200);
+    expect(res.body.conflicts.map(conflict => [conflict.startTime, conflict.patientNotified])).toEqual([
+      ['15:00', true],
+      ['16:00', true]
+    ]);
+    expect((await Doctor.findById(doctor._id)).availability[0].slots[0].endTime).toBe('13:00');
+    const appointments = await Appointment.find({ _id: { $in: stranded.map(appointment => appointment._id) } });
+    expect(appointments.map(appointment => appointment.status).sort()).toEqual(['confirmed', 'pending']);
+    expect(appointments.every(appointment => appointment.scheduleConflictNotifiedAt)).toBe(true);
+    expect((await notices()).map(notice => notice.type).sort()).toEqual(['email', 'email', 'in-app', 'in-app']);
+  });
+
+  it('only asks each patient once', async () => {
+    await updateAvailability({ availability: mornings, confirmConflicts: true }).expect(200);
+
+    const res = await updateAvailability({ lastSlotCutoff: 30, confirmConflicts: true });
+
+    expect(res.status).toBe(200);
+    expect(res.body.conflicts).toHaveLength(2);
+    expect(await notices()).toHaveLength(4);
+  });
+
+  it('counts a shortened day as a schedule change', async () => {
+    const res = await updateAvailability({ lastSlotCutoff: 60 });
+
+    expect(res.status).toBe(409);
+    expect(res.body.conflicts.map(conflict => conflict.startTime)).toEqual(['16:00']);
+  });
+
+  it('saves a change that leaves every booking covered', async () => {
+    const res = await updateAvailability({
+      availability: WEEKDAYS.map(day => ({ day, slots: [{ startTime: '08:00', endTime: '18:00' }] }))
+    });
+
+    expect(res.status).toBe(200);
+    expect(res.body.conflicts).toEqual([]);
+  });
+
+  it('saves without confirmation when the policy is off, still notifying the patients', async () => {
+    config.appointments.confirmScheduleConflicts = false;
+
+    const res = await updateAvailability({ availability: mornings });
+
+    expect(res.status).toBe(200);
+    expect(res.body.conflicts).toHaveLength(2);
+    expect(await notices()).toHaveLength(4);
+  });
+
+  it('checks an imported schedule the same way', async () => {
+    const res = await request(app)
+      .post('/api/v1/doctors/me/availability/import')
+      .set('Authorization', doctorAuth)
+      .attach('file', Buffer.from(WEEKDAYS.map(day => `${day},09:00,13:00`).join('\n')), { filename: 'schedule.csv', contentType: 'text/csv' })
+      .field('mode', 'replace');
+
+    expect(res.status).toBe(409);
+    expect(res.body).toMatchObject({ code: 'SCHEDULE_CONFLICTS', summary: { applied: false } });
+    expect(res.body.conflicts).toHaveLength(2);
+  });
+});
@@ -0,0 +1,135 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Block = require('../models/block.model');
+const Message = require('../models/message.model');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('patient blocks', () => {
+  let doctor;
+  let patient;
+  let doctorAuth;
+  let patientAuth;
+  let appointment;
+
+  beforeEach(async () => {
+    const created = await createDoctor();
+    doctor = created.doctor;
+    doctorAuth = await authHeader(created.user);
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50,
+      status: 'confirmed'
+    });
+  });
+
+  const block = (patientId = patient._id.toString()) => request(app)
+    .post('/api/v1/doctors/me/blocks')
+    .set('Authorization', doctorAuth)
+    .send({ patientId, reason: 'Abusive messages' });
+
+  const book = (fields = {}, authorization = patientAuth) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', authorization)
+    .send({
+      doctorId: doctor._id.toString(),
+      date: daysFromToday(3),
+      timeSlot: '11:00-11:30',
+      type: 'video',
+      reason: 'Follow-up',
+      ...fields
+    });
+
+  const sendMessage = (authorization) => request(app)
+    .post(`/api/v1/chats/${appointment._id}/message`)
+    .set('Authorization', authorization)
+    .send({ content: 'Hello', type: 'text' });
+
+  it('rejects a new booking from a blocked patient without saying why', async () => {
+    await block().expect(201);
+
+    const res = await book();
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('BOOKING_UNAVAILABLE');
+    expect(res.body.message).not.toMatch(/block/i);
+    expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+  });
+
+  it('rejects a blocked patient booking under another patient\'s ID', async () => {
+    await block().expect(201);
+    const other = await createUser();
+
+    const res = await book({ patientId: other._id.toString() });
+
+    expect(res.status).toBe(403);
+    expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+  });
+
+  it('lets an admin book for a patient, checking that patient\'s block', async () => {
+    await block().expect(201);
+    const adminAuth = await authHeader(await createUser({ role: 'admin' }));
+
+    const blocked = await book({ patientId: patient._id.toString() }, adminAuth);
+    const other = await book({ patientId: (await createUser())._id.toString() }, adminAuth);
+
+    expect(blocked.status).toBe(409);
+    expect(blocked.body.code).toBe('BOOKING_UNAVAILABLE');
+    expect(other.status).toBe(201);
+  });
+
+  it('rejects new chat messages both ways', async () => {
+    await block().expect(201);
+
+    const fromPatient = await sendMessage(patientAuth);
+    const fromDoctor = await sendMessage(doctorAuth);
+
+    expect(fromPatient.status).toBe(403);
+    expect(fromPatient.body.code).toBe('CHAT_UNAVAILABLE');
+    expect(fromDoctor.status).toBe(403);
+    expect(await Message.countDocuments()).toBe(0);
+  });
+
+  it('leaves existing appointments alone', async () => {
+    await block().expect(201);
+
+    const existing = await Appointment.findById(appointment._id);
+    expect(existing.status).toBe('confirmed');
+  });
+
+  it('only blocks patients who booked with the doctor', async () => {
+    const stranger = await createUser();
+
+    const res = await block(stranger._id.toString());
+
+    expect(res.status).toBe(404);
+    expect(await Block.countDocuments()).toBe(0);
+  });
+
+  it('allows bookings again once lifted, keeping the audit trail', async () => {
+    await block().expect(201);
+
+    await request(app)
+      .delete(`/api/v1/doctors/me/blocks/${patient._id}`)
+      .set('Authorization', doctorAuth)
+      .expect(200);
+    const res = await book();
+
+    expect(res.status).toBe(201);
+    const lifted = await Block.findOne({ doctorId: doctor._id, patientId: patient._id });
+    expect(lifted.active).toBe(false);
+    expect(lifted.history.map(entry => entry.action)).toEqual(['blocked', 'unblocked']);
+  });
+});
@@ -0,0 +1,1340 @@
+jest.mock('../services/aws.service');
+
+const mongoose = require('mongoose');
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const Referral = require('../models/referral.model');
+const User = require('../models/user.model');
+const AppointmentService = require('../services/appointment.service');
+const DatabaseService = require('../services/database.service');
+const config = require('../config/config');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('POST /api/v1/appointments', () => {
+  const date = daysFromToday(2);
+  let doctor;
+  let patientAuth;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const book = (authorization, timeSlot) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', authorization)
+    .send({ doctorId: doctor._id.toString(), date, timeSlot, type: 'video', reason: 'Check-up' });
+
+  it('books a free slot as pending', async () => {
+    const res = await book(patientAuth, '10:00-10:30');
+
+    expect(res.status).toBe(201);
+    expect(res.body.status).toBe('pending');
+    expect(res.body.confirmationMode).toBe('manual');
+  });
+
+  it('rejects a booking overlapping another one', async () => {
+    await book(patientAuth, '10:00-10:30').expect(201);
+
+    const res = await book(await authHeader(await createUser()), '10:15-10:45');
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('SLOT_UNAVAILABLE');
+    expect(res.body.suggestions.date).toBe(date);
+  });
+
+  it('suggests the free slots closest to a taken one', async () => {
+    await book(patientAuth, '10:00-10:30').expect(201);
+
+    const res = await book(await authHeader(await createUser()), '10:00-10:30');
+
+    expect(res.status).toBe(409);
+    const { sameDay, nextAvailableDay } = res.body.suggestions;
+    expect(sameDay).toHaveLength(config.appointments.suggestionCount);
+    expect(sameDay).toEqual(expect.arrayContaining([
+      { startTime: '09:30', endTime: '10:00' },
+      { startTime: '10:30', endTime: '11:00' }
+    ]));
+    expect(sameDay).not.toContainEqual({ startTime: '10:00', endTime: '10:30' });
+    expect(nextAvailableDay.date).toBe(daysFromToday(3));
+    expect(nextAvailableDay.slots[0]).toEqual({ startTime: '09:00', endTime: '09:30' });
+  });
+
+  it('points to the next day with a free slot when the day is full', async () => {
+    ({ doctor } = await createDoctor({
+      availability: ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday']
+        .map(day => ({ day, slots: [{ startTime: '10:00', endTime: '10:30' }] }))
+    }));
+    await book(patientAuth, '10:00-10:30').expect(201);
+
+    const res = await book(await authHeader(await createUser()), '10:00-10:30');
+
+    expect(res.status).toBe(409);
+    expect(res.body.suggestions.sameDay).toEqual([]);
+    expect(res.body.suggestions.nextAvailableDay).toEqual({
+      date: daysFromToday(3),
+      slots: [{ startTime: '10:00', endTime: '10:30' }]
+    });
+  });
+
+  it('allows back-to-back bookings', async () => {
+    await book(patientAuth, '10:00-10:30').expect(201);
+
+    const res = await book(await authHeader(await createUser()), '10:30-11:00');
+
+    expect(res.status).toBe(201);
+  });
+
+  it('frees the slot of a cancelled booking', async () => {
+    const first = await book(patientAuth, '10:00-10:30').expect(201);
+    await Appointment.updateOne({ _id: first.body.id }, { $set: { status: 'cancelled' } });
+
+    const res = await book(await authHeader(await createUser()), '10:00-10:30');
+
+    expect(res.status).toBe(201);
+  });
+
+  it('rejects a slot outside the doctor\'s hours', async () => {
+    const res = await book(patientAuth, '18:00-18:30');
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('OUTSIDE_DOCTOR_AVAILABILITY');
+  });
+
+  describe('with an idempotency key', () => {
+    const bookWithKey = (key, timeSlot = '10:00-10:30') => book(patientAuth, timeSlot).set('Idempotency-Key', key);
+
+    it('books once when the same request is sent twice', async () => {
+      const first = await bookWithKey('booking-1');
+      const retry = await bookWithKey('booking-1');
+
+      expect(first.status).toBe(201);
+      expect(retry.status).toBe(200);
+      expect(retry.headers['idempotent-replayed']).toBe('true');
+      expect(retry.body.id).toBe(first.body.id);
+      expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+    });
+
+    it('accepts the key as requestId in the body', async () => {
+      const send = () => request(app)
+        .post('/api/v1/appointments')
+        .set('Authorization', patientAuth)
+        .send({
+          doctorId: doctor._id.toString(),
+          date,
+          timeSlot: '10:00-10:30',
+          type: 'video',
+          reason: 'Check-up',
+          requestId: 'booking-1'
+        });
+
+      const first = await send().expect(201);
+      const retry = await send();
+
+      expect(retry.status).toBe(200);
+      expect(retry.body.id).toBe(first.body.id);
+      expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+    });
+
+    it('still reports a slot conflict to someone else', async () => {
+      await bookWithKey('booking-1').expect(201);
+
+      const res = await book(await authHeader(await createUser()), '10:00-10:30').set('Idempotency-Key', 'booking-1');
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('SLOT_UNAVAILABLE');
+    });
+
+    it('rejects the key for a different booking', async () => {
+      await bookWithKey('booking-1').expect(201);
+
+      const res = await bookWithKey('booking-1', '11:00-11:30');
+
+      expect(res.status).toBe(422);
+      expect(res.body.code).toBe('IDEMPOTENCY_KEY_REUSED');
+      expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+    });
+
+    it('releases the key once its window has passed', async () => {
+      const first = await bookWithKey('booking-1').expect(201);
+      const windowMs = config.appointments.idempotencyWindowHours * 60 * 60 * 1000;
+      await Appointment.collection.updateOne(
+        { _id: new mongoose.Types.ObjectId(first.body.id) },
+        { $set: { createdAt: new Date(Date.now() - windowMs - 1000) } }
+      );
+
+      const res = await bookWithKey('booking-1', '11:00-11:30');
+
+      expect(res.status).toBe(201);
+      expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(2);
+    });
+  });
+
+  describe('with pay-before-confirm', () => {
+    beforeEach(() => {
+      config.payments.payBeforeConfirm = true;
+    });
+
+    afterEach(() => {
+      config.payments.payBeforeConfirm = false;
+    });
+
+    // Past its unpaid window, so only a payment hold can keep the slot
+    const makeStale = (id) => Appointment.collection.updateOne(
+      { _id: new mongoose.Types.ObjectId(id) },
+      { $set: { createdAt: new Date(Date.now() - (config.payments.unpaidExpiryMinutes + 5) * 60 * 1000) } }
+    );
+
+    it('frees the slot of a booking left unpaid past its window', async () => {
+      const first = await book(patientAuth, '10:00-10:30').expect(201);
+      await makeStale(first.body.id);
+
+      const res = await book(await authHeader(await createUser()), '10:00-10:30');
+
+      expect(res.status).toBe(201);
+    });
+
+    it('keeps a held slot blocked until the hold expires', async () => {
+      const first = await book(patientAuth, '10:00-10:30').expect(201);
+      const payment = await request(app)
+        .post('/api/v1/payments/initiate')
+        .set('Authorization', patientAuth)
+        .send({ appointmentId: first.body.id, paymentMethod: 'iDEAL' })
+        .expect(201);
+      expect(new Date(payment.body.holdExpiresAt).getTime()).toBeGreaterThan(Date.now());
+      const appointment = await Appointment.findById(first.body.id);
+      await makeStale(appointment._id);
+
+      const otherAuth = await authHeader(await createUser());
+      const blocked = await book(otherAuth, '10:00-10:30');
+      expect(blocked.status).toBe(409);
+      expect(blocked.body.code).toBe('SLOT_UNAVAILABLE');
+
+      await Appointment.collection.updateOne(
+        { _id: appointment._id },
+        { $set: { holdExpiresAt: new Date(Date.now() - 1000) } }
+      );
+      const res = await book(otherAuth, '10:00-10:30');
+      expect(res.status).toBe(201);
+    });
+
+    it('lets only one of two bookings for a slot hold it', async () => {
+      const first = await book(patientAuth, '10:00-10:30').expect(201);
+      await makeStale(first.body.id);
+      const secondAuth = await authHeader(await createUser());
+      const second = await book(secondAuth, '10:00-10:30').expect(201);
+
+      await request(app)
+        .post('/api/v1/payments/initiate')
+        .set('Authorization', secondAuth)
+        .send({ appointmentId: second.body.id, paymentMethod: 'card' })
+        .expect(201);
+      const res = await request(app)
+        .post('/api/v1/payments/initiate')
+        .set('Authorization', patientAuth)
+        .send({ appointmentId: first.body.id, paymentMethod: 'card' });
+
+      expect(res.status).toBe(409);
+    });
+
+    describe('expiring holds', () => {
+      let first;
+
+      beforeEach(async () => {
+        first = await book(patientAuth, '10:00-10:30').expect(201);
+        await request(app)
+          .post('/api/v1/payments/initiate')
+          .set('Authorization', patientAuth)
+          .send({ appointmentId: first.body.id, paymentMethod: 'iDEAL' })
+          .expect(201);
+        await Appointment.collection.updateOne(
+          { _id: new mongoose.Types.ObjectId(first.body.id) },
+          { $set: { holdExpiresAt: new Date(Date.now() - 1000) } }
+        );
+      });
+
+      it('releases a lapsed hold on a slot nobody took', async () => {
+        await AppointmentService.expireUnpaidAppointments();
+
+        const released = await Appointment.findById(first.body.id);
+        expect(released.status).toBe('pending');
+        expect(released.paymentStatus).toBe('unpaid');
+      });
+
+      it('cancels a lapsed hold whose slot was booked meanwhile', async () => {
+        const second = await book(await authHeader(await createUser()), '10:00-10:30').expect(201);
+
+        await AppointmentService.expireUnpaidAppointments();
+
+        expect((await Appointment.findById(first.body.id)).status).toBe('cancelled');
+        expect((await Appointment.findById(second.body.id)).status).toBe('pending');
+        const third = await book(await authHeader(await createUser()), '10:00-10:30');
+        expect(third.status).toBe(409);
+      });
+    });
+  });
+
+  describe('validation errors', () => {
+    const valid = () => ({ doctorId: doctor._id.toString(), date, timeSlot: '10:00-10:30', type: 'video', reason: 'Check-up' });
+
+    const send = (body) => request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', patientAuth)
+      .send(body);
+
+    it.each([
+      ['doctorId', { doctorId: 'not-an-id' }, 'Invalid doctor ID'],
+      ['date', { date: '16/10/2026' }, 'Invalid date format'],
+      ['timeSlot', { timeSlot: 930 }, 'Time slot is required'],
+      ['type', { type: 'phone' }, 'Invalid appointment type'],
+      ['reason', { reason: 42 }, 'Reason must be a string'],
+      ['consultationTypeId', { consultationTypeId: 'basic' }, 'Invalid consultation type ID'],
+      ['language', { language: 'English' }, 'Language must be a language code such as "en" or "nl"'],
+      ['referralId', { referralId: 'ref-1' }, 'Invalid referral ID'],
+      ['patientDetails', { patientDetails: 'my son' }, 'Patient details must be an object'],
+      ['patientDetails.relationship', { patientDetails: { name: 'Sam', dob: '2015-01-01', relationship: 'neighbour' } }, 'Invalid relationship to account holder']
+    ])('maps an invalid %s to its field', async (field, fields, message) => {
+      const res = await send({ ...valid(), ...fields });
+
+      expect(res.status).toBe(400);
+      expect(res.body).toEqual({ message: 'Validation Error', errors: { [field]: message } });
+      expect(await Appointment.countDocuments()).toBe(0);
+    });
+
+    it('reports every invalid field at once', async () => {
+      const res = await send({ reason: 'Check-up' });
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors).toEqual({
+        doctorId: 'Invalid doctor ID',
+        date: 'Invalid date format',
+        timeSlot: 'Time slot is required',
+        type: 'Invalid appointment type'
+      });
+    });
+  });
+
+  describe('two bookings for the same slot at once', () => {
+    const bookBoth = async () => {
+      const [first, second] = await Promise.all([
+        book(patientAuth, '10:00-10:30'),
+        book(await authHeader(await createUser()), '10:15-10:45')
+      ]);
+      return [first.status, second.status].sort();
+    };
+
+    it('books exactly one of them', async () => {
+      expect(await bookBoth()).toEqual([201, 409]);
+      expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+    });
+
+    it('replays the booking to a retry sent alongside it', async () => {
+      const send = () => book(patientAuth, '10:00-10:30').set('Idempotency-Key', 'booking-1');
+
+      const statuses = (await Promise.all([send(), send()])).map(res => res.status).sort();
+
+      expect(statuses).toEqual([200, 201]);
+      expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+    });
+
+    describe('without transactions', () => {
+      beforeEach(async () => {
+        config.mongodb.transactions.mode = 'false';
+        await DatabaseService.detectTransactionSupport();
+      });
+
+      afterEach(async () => {
+        config.mongodb.transactions.mode = 'auto';
+        await DatabaseService.detectTransactionSupport();
+      });
+
+      it('never keeps both', async () => {
+        const statuses = await bookBoth();
+
+        expect(statuses).not.toEqual([201, 201]);
+        expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(statuses.filter(s => s === 201).length);
+      });
+    });
+  });
+
+  describe('from an unverified account', () => {
+    afterEach(() => {
+      config.verification.requirePhone = false;
+    });
+
+    it('refuses the booking with a link to resend the verification', async () => {
+      const unverified = await authHeader(await createUser({ isEmailVerified: false }));
+
+      const res = await book(unverified, '10:00-10:30');
+
+      expect(res.status).toBe(403);
+      expect(res.body).toMatchObject({ code: 'VERIFICATION_REQUIRED', missing: ['email'] });
+      expect(res.body.resendUrl).toMatch(/\/api\/v1\/auth\/verify\/resend$/);
+      expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(0);
+    });
+
+    it('requires a verified phone only when the policy asks for it', async () => {
+      const authorization = await authHeader(await createUser({ isPhoneVerified: false }));
+      await book(authorization, '10:00-10:30').expect(201);
+
+      config.verification.requirePhone = true;
+      const res = await book(authorization, '11:00-11:30');
+
+      expect(res.status).toBe(403);
+      expect(res.body.missing).toEqual(['phone']);
+    });
+
+    it('still lets them look up the doctor\'s free slots', async () => {
+      const unverified = await authHeader(await createUser({ isEmailVerified: false }));
+
+      const res = await request(app)
+        .get('/api/v1/appointments/slots/available')
+        .set('Authorization', unverified)
+        .query({ doctorId: doctor._id.toString(), startDate: date, endDate: date });
+
+      expect(res.status).toBe(200);
+    });
+  });
+});
+
+describe('POST /api/v1/appointments/preview', () => {
+  const date = daysFromToday(2);
+  const WEEKDAYS = ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'];
+  let doctor;
+  let patientAuth;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor({
+      pricingRules: [{ days: WEEKDAYS, startTime: '16:00', endTime: '17:00', multiplier: 1.5, label: 'Late afternoon' }]
+    }));
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const send = (path, fields = {}) => request(app)
+    .post(path)
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), date, timeSlot: '16:00-16:30', type: 'video', reason: 'Check-up', ...fields });
+  const preview = (fields) => send('/api/v1/appointments/preview', fields);
+  const create = (fields) => send('/api/v1/appointments', fields);
+
+  it('summarizes the booking creation would make, without saving it', async () => {
+    const res = await preview();
+
+    expect(res.status).toBe(200);
+    expect(await Appointment.countDocuments()).toBe(0);
+
+    const created = await create();
+
+    expect(created.status).toBe(201);
+    expect(res.body.slot).toMatchObject({
+      date,
+      startTime: created.body.startTime,
+      endTime: created.body.endTime,
+      durationMinutes: created.body.durationMinutes
+    });
+    expect(res.body.price).toMatchObject({
+      baseFee: 50,
+      multiplier: 1.5,
+      rule: 'Late afternoon',
+      fee: created.body.fee,
+      total: 75,
+      currency: 'EUR'
+    });
+    expect(created.body.pricing).toEqual({ baseFee: 50, multiplier: 1.5, rule: 'Late afternoon' });
+    expect(res.body.policy.confirmationMode).toBe(created.body.confirmationMode);
+  });
+
+  it('rejects a taken slot the way creation does', async () => {
+    await create().expect(201);
+
+    const [previewed, created] = [await preview(), await create()];
+
+    expect(previewed.status).toBe(409);
+    expect(created.status).toBe(409);
+    expect(previewed.body.code).toBe('SLOT_UNAVAILABLE');
+    expect(previewed.body.suggestions).toEqual(created.body.suggestions);
+  });
+
+  it('rejects a slot outside the doctor\'s hours the way creation does', async () => {
+    const previewed = await preview({ timeSlot: '18:00-18:30' });
+    const created = await create({ timeSlot: '18:00-18:30' });
+
+    expect(previewed.status).toBe(409);
+    expect(previewed.body.code).toBe('OUTSIDE_DOCTOR_AVAILABILITY');
+    expect(created.body.code).toBe(previewed.body.code);
+  });
+
+  it('reports the same field errors as creation', async () => {
+    const previewed = await preview({ type: 'carrier-pigeon', timeSlot: 'soon' });
+    const created = await create({ type: 'carrier-pigeon', timeSlot: 'soon' });
+
+    expect(previewed.status).toBe(400);
+    expect(previewed.body).toEqual(created.body);
+  });
+});
+
+describe('confirmation codes', () => {
+  const codeLength = config.appointments.confirmationCodeLength;
+  let doctor;
+  let doctorUser;
+  let patient;
+
+  beforeEach(async () => {
+    ({ doctor, user: doctorUser } = await createDoctor());
+    patient = await createUser();
+  });
+
+  const create = (fields = {}) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date: daysFromToday(2),
+    startTime: '10:00',
+    endTime: '10:30',
+    type: 'in-person',
+    reason: 'Check-up',
+    ...fields
+  });
+
+  const lookUp = async (code, user) => request(app)
+    .get(`/api/v1/appointments/by-code/${code}`)
+    .set('Authorization', await authHeader(user));
+
+  it('gives each booking a readable code of its own', async () => {
+    const booked = await request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', await authHeader(patient))
+      .send({ doctorId: doctor._id.toString(), date: daysFromToday(2), timeSlot: '10:00-10:30', type: 'video', reason: 'Check-up' });
+    const others = await Promise.all(Array.from({ length: 20 }, (_, i) => create({ startTime: `1${i % 10}:00` })));
+
+    expect(booked.status).toBe(201);
+    const codes = [booked.body.confirmationCode, ...others.map(appointment => appointment.confirmationCode)];
+    codes.forEach(code => expect(code).toMatch(new RegExp(`^[A-HJKMNP-Z2-9]{${codeLength}}$`)));
+    expect(new Set(codes).size).toBe(codes.length);
+  });
+
+  it('refuses to store a code that is already taken', async () => {
+    await create({ confirmationCode: 'K7PX3MQ2' });
+
+    await expect(create({ confirmationCode: 'K7PX3MQ2' })).rejects.toMatchObject({ code: 11000 });
+  });
+
+  it('leaves drafts without a code', async () => {
+    expect((await create({ status: 'draft' })).confirmationCode).toBeUndefined();
+  });
+
+  describe('GET /api/v1/appointments/by-code/:code', () => {
+    it('finds the appointment for its patient and doctor, in any case', async () => {
+      const appointment = await create();
+
+      const byPatient = await lookUp(appointment.confirmationCode.toLowerCase(), patient);
+      const byDoctor = await lookUp(appointment.confirmationCode, doctorUser);
+
+      expect(byPatient.status).toBe(200);
+      expect(byPatient.body._id).toBe(appointment._id.toString());
+      expect(byDoctor.status).toBe(200);
+      expect(byDoctor.body.patient).toMatchObject({ firstName: patient.firstName, lastName: patient.lastName });
+    });
+
+    it('finds it for an admin', async () => {
+      const appointment = await create();
+
+      expect((await lookUp(appointment.confirmationCode, await createUser({ role: 'admin' }))).status).toBe(200);
+    });
+
+    it('returns 404 to anyone else, as for an unknown code', async () => {
+      const appointment = await create();
+      const { user: otherDoctor } = await createDoctor();
+
+      expect((await lookUp(appointment.confirmationCode, await createUser())).status).toBe(404);
+      expect((await lookUp(appointment.confirmationCode, otherDoctor)).status).toBe(404);
+      expect((await lookUp('ZZZZZZZZ', patient)).status).toBe(404);
+    });
+
+    it('rejects a malformed code', async () => {
+      expect((await lookUp('AB-12', patient)).status).toBe(400);
+    });
+  });
+});
+
+describe('referrals', () => {
+  const date = daysFromToday(2);
+  let referringAuth;
+  let patient;
+  let patientAuth;
+  let appointment;
+  let referred;
+
+  beforeEach(async () => {
+    const { user: referringUser, doctor: referring } = await createDoctor();
+    referringAuth = await authHeader(referringUser);
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+    appointment = await Appointment.create({
+      doctorId: referring._id,
+      patientId: patient._id,
+      date,
+      startTime: '09:00',
+      endTime: '09:30',
+      type: 'video',
+      reason: 'Chest pain'
+    });
+    ({ doctor: referred } = await createDoctor({ specializations: ['cardiology'] }));
+  });
+
+  const refer = (body) => request(app)
+    .post(`/api/v1/appointments/${appointment._id}/refer`)
+    .set('Authorization', referringAuth)
+    .send({ referredDoctorId: referred._id.toString(), ...body });
+
+  describe('POST /api/v1/appointments/:id/refer', () => {
+    it('records the referral with recommended doctors, the named one first', async () => {
+      const { doctor: other } = await createDoctor({ specializations: ['cardiology'] });
+
+      const res = await refer({ note: 'Please check the ECG' });
+
+      expect(res.status).toBe(201);
+      expect(res.body).toMatchObject({ status: 'pending', specialty: 'cardiology', linkedAppointment: null });
+      expect(res.body.recommendations.map(r => r.doctorId)).toEqual([referred._id.toString(), other._id.toString()]);
+      expect(res.body.recommendations[0].bookingToken).toEqual(expect.any(String));
+      expect(await Appointment.countDocuments({ doctorId: referred._id })).toBe(0);
+    });
+
+    it('books the referred doctor together with the referral', async () => {
+      const res = await refer({ booking: { date, timeSlot: '10:00-10:30', type: 'video' } });
+
+      expect(res.status).toBe(201);
+      expect(res.body.status).toBe('booked');
+      expect(res.body.recommendations).toEqual([]);
+      const linked = await Appointment.findById(res.body.linkedAppointment._id).lean();
+      expect(linked).toMatchObject({ status: 'pending', fee: 50, reason: 'Referral for cardiology' });
+      expect(linked.patientId.equals(patient._id)).toBe(true);
+      expect((await Referral.findById(res.body._id)).linkedAppointmentId.equals(linked._id)).toBe(true);
+    });
+
+    it('prices the booking by the chosen consultation type', async () => {
+      referred.consultationTypes.push({ name: 'Cardiac review', duration: 30, fee: 80 });
+      await referred.save();
+
+      const res = await refer({
+        booking: { date, timeSlot: '10:00-10:30', type: 'video', consultationTypeId: referred.consultationTypes[0]._id.toString() }
+      });
+
+      expect(res.status).toBe(201);
+      expect(res.body.linkedAppointment.fee).toBe(80);
+      expect(res.body.linkedAppointment.consultationType.name).toBe('Cardiac review');
+    });
+
+    it('confirms the booking for a doctor who auto-accepts', async () => {
+      referred.autoAcceptBookings = true;
+      await referred.save();
+
+      const res = await refer({ booking: { date, timeSlot: '10:00-10:30', type: 'video' } });
+
+      expect(res.status).toBe(201);
+      expect(res.body.linkedAppointment.status).toBe('confirmed');
+    });
+
+    it('saves nothing when the slot is taken', async () => {
+      await Appointment.create({
+        doctorId: referred._id,
+        patientId: (await createUser())._id,
+        date,
+        startTime: '10:00',
+        endTime: '10:30',
+        type: 'video',
+        reason: 'Check-up'
+      });
+
+      const res = await refer({ booking: { date, timeSlot: '10:15-10:45', type: 'video' } });
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('SLOT_UNAVAILABLE');
+      expect(await Referral.countDocuments()).toBe(0);
+    });
+
+    it('saves nothing when the referred doctor\'s day is full', async () => {
+      referred.maxAppointmentsPerDay = 1;
+      await referred.save();
+      await Appointment.create({
+        doctorId: referred._id,
+        patientId: (await createUser())._id,
+        date,
+        startTime: '14:00',
+        endTime: '14:30',
+        type: 'video',
+        reason: 'Check-up'
+      });
+
+      const res = await refer({ booking: { date, timeSlot: '10:00-10:30', type: 'video' } });
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('DAILY_LIMIT_REACHED');
+      expect(await Referral.countDocuments()).toBe(0);
+    });
+
+    it('is for the appointment\'s own doctor only', async () => {
+      const { user: otherDoctor } = await createDoctor();
+
+      const res = await request(app)
+        .post(`/api/v1/appointments/${appointment._id}/refer`)
+        .set('Authorization', await authHeader(otherDoctor))
+        .send({ referredDoctorId: referred._id.toString() });
+
+      expect(res.status).toBe(403);
+      expect(await Referral.countDocuments()).toBe(0);
+    });
+  });
+
+  describe('the patient\'s recommendations', () => {
+    beforeEach(async () => {
+      await refer({}).expect(201);
+    });
+
+    const getReferrals = () => request(app)
+      .get('/api/v1/appointments/referrals')
+      .set('Authorization', patientAuth);
+
+    it('lists open referrals with a bookable slot per doctor', async () => {
+      const res = await getReferrals();
+
+      expect(res.status).toBe(200);
+      expect(res.body.referrals).toHaveLength(1);
+      const [recommendation] = res.body.referrals[0].recommendations;
+      expect(recommendation.doctorId).toBe(referred._id.toString());
+      expect(recommendation.nextSlot).toMatchObject({ date: expect.any(String), startTime: expect.any(String) });
+      expect(recommendation.bookingToken).toEqual(expect.any(String));
+    });
+
+    it('marks the referral booked when its recommendation is booked', async () => {
+      const [referral] = (await getReferrals()).body.referrals;
+
+      const res = await request(app)
+        .post('/api/v1/appointments/from-recommendation')
+        .set('Authorization', patientAuth)
+        .send({ bookingToken: referral.recommendations[0].bookingToken, type: 'video', reason: 'Referral', referralId: referral._id });
+
+      expect(res.status).toBe(201);
+      expect(res.body.doctorId).toBe(referred._id.toString());
+      const booked = await Referral.findById(referral._id);
+      expect(booked.status).toBe('booked');
+      expect(booked.linkedAppointmentId.toString()).toBe(res.body.id);
+      const after = await getReferrals();
+      expect(after.body.referrals[0].recommendations).toEqual([]);
+    });
+  });
+});
+
+describe('clinic opening hours', () => {
+  const date = daysFromToday(2);
+  let patientAuth;
+
+  beforeEach(async () => {
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const everyDay = (openTime, closeTime) => ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday']
+    .map(day => ({ day, openTime, closeTime }));
+
+  const withClinicHours = (openingHours) => createDoctor({
+    clinicLocation: { address: 'Damrak 1', city: 'Amsterdam', postalCode: '1012LG', openingHours }
+  });
+
+  const book = (doctor, timeSlot, type = 'in-person') => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), date, timeSlot, type, reason: 'Check-up' });
+
+  it('books an in-person visit within the clinic\'s hours', async () => {
+    const { doctor } = await withClinicHours(everyDay('12:00', '16:00'));
+
+    const res = await book(doctor, '13:00-13:30');
+
+    expect(res.status).toBe(201);
+  });
+
+  it('rejects an in-person visit the doctor is available for but the clinic is closed', async () => {
+    const { doctor } = await withClinicHours(everyDay('12:00', '16:00'));
+
+    const res = await book(doctor, '10:00-10:30');
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('OUTSIDE_CLINIC_HOURS');
+    expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(0);
+  });
+
+  it('rejects a visit running past closing time', async () => {
+    const { doctor } = await withClinicHours(everyDay('12:00', '16:00'));
+
+    const res = await book(doctor, '15:45-16:15');
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('OUTSIDE_CLINIC_HOURS');
+  });
+
+  it('does not apply to video calls', async () => {
+    const { doctor } = await withClinicHours(everyDay('12:00', '16:00'));
+
+    const res = await book(doctor, '10:00-10:30', 'video');
+
+    expect(res.status).toBe(201);
+  });
+
+  it('allows any time the doctor is available when the clinic has no hours set', async () => {
+    const { doctor } = await withClinicHours([]);
+
+    const res = await book(doctor, '10:00-10:30');
+
+    expect(res.status).toBe(201);
+  });
+
+  describe('on a server outside UTC', () => {
+    const serverTimeZone = process.env.TZ;
+    const weekday = ['sunday', 'monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday'][new Date(date).getUTCDay()];
+
+    // West of UTC, midnight UTC of the booked date is still the day before locally
+    beforeAll(() => {
+      process.env.TZ = 'America/Los_Angeles';
+    });
+
+    afterAll(() => {
+      process.env.TZ = serverTimeZone;
+    });
+
+    it('checks the weekday of the booked date, as the slot list shows it', async () => {
+      const { doctor } = await createDoctor({
+        availability: [{ day: weekday, slots: [{ startTime: '09:00', endTime: '17:00' }] }],
+        clinicLocation: {
+          address: 'Damrak 1',
+          city: 'Amsterdam',
+          postalCode: '1012LG',
+          openingHours: [{ day: weekday, openTime: '09:00', closeTime: '17:00' }]
+        }
+      });
+      const slots = await request(app)
+        .get('/api/v1/appointments/slots/available')
+        .set('Authorization', patientAuth)
+        .query({ doctorId: doctor._id.toString(), startDate: date, endDate: date });
+      expect(slots.body.availability[0].slotDetails[0].startTime).toBe('09:00');
+
+      const res = await book(doctor, '09:00-09:30');
+
+      expect(res.status).toBe(201);
+    });
+  });
+});
+
+describe('PUT /api/v1/appointments/:id/reschedule', () => {
+  const date = daysFromToday(2);
+  let appointment;
+  let patientAuth;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    const { user: doctorUser, doctor } = await createDoctor();
+    const patient = await createUser();
+    patientAuth = await authHeader(patient);
+    doctorAuth = await authHeader(doctorUser);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date,
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50
+    });
+  });
+
+  const reschedule = (authorization, timeSlot = '11:00-11:30') => request(app)
+    .put(`/api/v1/appointments/${appointment._id}/reschedule`)
+    .set('Authorization', authorization)
+    .send({ date, timeSlot });
+
+  const setRescheduleCount = (count) => Appointment.updateOne({ _id: appointment._id }, { $set: { rescheduleCount: count } });
+
+  describe('the patient\'s reschedule limit', () => {
+    const limit = config.appointments.maxReschedules;
+
+    it('allows the last reschedule up to the limit and counts it', async () => {
+      await setRescheduleCount(limit - 1);
+
+      const res = await reschedule(patientAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ startTime: '11:00', endTime: '11:30', rescheduleCount: limit });
+    });
+
+    it('rejects a reschedule over the limit', async () => {
+      await setRescheduleCount(limit);
+
+      const res = await reschedule(patientAuth);
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('RESCHEDULE_LIMIT_REACHED');
+      expect((await Appointment.findById(appointment._id)).startTime).toBe('10:00');
+    });
+
+    it('does not limit or count the doctor\'s reschedules', async () => {
+      await setRescheduleCount(limit);
+
+      const res = await reschedule(doctorAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.rescheduleCount).toBe(limit);
+    });
+
+    it('lets an admin reschedule past the limit', async () => {
+      await setRescheduleCount(limit);
+
+      const res = await reschedule(await authHeader(await createUser({ role: 'admin' })));
+
+      expect(res.status).toBe(200);
+      expect(res.body.startTime).toBe('11:00');
+    });
+  });
+});
+
+describe('booking drafts', () => {
+  const date = daysFromToday(2);
+  let doctor;
+  let patientAuth;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const createDraft = (body = {}) => request(app)
+    .post('/api/v1/appointments/drafts')
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), type: 'video', ...body });
+
+  const finalize = (id, body = {}) => request(app)
+    .post(`/api/v1/appointments/drafts/${id}/finalize`)
+    .set('Authorization', patientAuth)
+    .send(body);
+
+  it('saves a draft without a slot and lists it for resuming', async () => {
+    const created = await createDraft();
+    expect(created.status).toBe(201);
+    expect(created.body).toMatchObject({ status: 'draft', type: 'video' });
+    expect(created.body.timeSlot).toBeUndefined();
+
+    const res = await request(app)
+      .get('/api/v1/appointments/drafts')
+      .set('Authorization', patientAuth);
+
+    expect(res.status).toBe(200);
+    expect(res.body.drafts.map(draft => draft.id)).toEqual([created.body.id]);
+  });
+
+  it('keeps saved fields when more are filled in', async () => {
+    const created = await createDraft({ reason: 'Rash' });
+
+    const res = await request(app)
+      .put(`/api/v1/appointments/drafts/${created.body.id}`)
+      .set('Authorization', patientAuth)
+      .send({ date, timeSlot: '10:00-10:30' });
+
+    expect(res.status).toBe(200);
+    expect(res.body).toMatchObject({ reason: 'Rash', date, timeSlot: '10:00-10:30' });
+  });
+
+  it('does not block the slot it names', async () => {
+    await createDraft({ date, timeSlot: '10:00-10:30' }).expect(201);
+
+    const res = await request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', await authHeader(await createUser()))
+      .send({ doctorId: doctor._id.toString(), date, timeSlot: '10:00-10:30', type: 'video', reason: 'Check-up' });
+
+    expect(res.status).toBe(201);
+  });
+
+  it('books a pending appointment in place of the draft when finalized', async () => {
+    const draft = await createDraft({ date, timeSlot: '10:00-10:30', reason: 'Rash' });
+
+    const res = await finalize(draft.body.id);
+
+    expect(res.status).toBe(201);
+    expect(res.body).toMatchObject({ status: 'pending', startTime: '10:00', reason: 'Rash', draftId: draft.body.id });
+    expect(res.body.confirmationCode).toEqual(expect.any(String));
+    expect(await Appointment.findById(draft.body.id)).toBeNull();
+    expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(1);
+  });
+
+  it('runs the booking checks again when finalizing', async () => {
+    const draft = await createDraft({ date, timeSlot: '10:00-10:30', reason: 'Rash' });
+    await request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', await authHeader(await createUser()))
+      .send({ doctorId: doctor._id.toString(), date, timeSlot: '10:00-10:30', type: 'video', reason: 'Check-up' })
+      .expect(201);
+
+    const res = await finalize(draft.body.id);
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('SLOT_UNAVAILABLE');
+    expect((await Appointment.findById(draft.body.id)).status).toBe('draft');
+  });
+
+  it('needs a slot and a reason to finalize', async () => {
+    const draft = await createDraft();
+
+    expect((await finalize(draft.body.id)).status).toBe(400);
+    expect((await finalize(draft.body.id, { date, timeSlot: '10:00-10:30' })).status).toBe(400);
+    expect((await finalize(draft.body.id, { date, timeSlot: '10:00-10:30', reason: 'Rash' })).status).toBe(201);
+  });
+
+  it('finalizes a draft only once', async () => {
+    const draft = await createDraft({ date, timeSlot: '10:00-10:30', reason: 'Rash' });
+    await finalize(draft.body.id).expect(201);
+
+    const res = await finalize(draft.body.id);
+
+    expect(res.status).toBe(404);
+  });
+
+  it('deletes drafts left untouched past their expiry', async () => {
+    const stale = await createDraft();
+    const fresh = await createDraft();
+    const expiryMs = config.appointments.draftExpiryHours * 60 * 60 * 1000;
+    await Appointment.collection.updateOne(
+      { _id: new mongoose.Types.ObjectId(stale.body.id) },
+      { $set: { updatedAt: new Date(Date.now() - expiryMs - 1000) } }
+    );
+
+    const deleted = await AppointmentService.expireDrafts();
+
+    expect(deleted).toBe(1);
+    expect(await Appointment.findById(stale.body.id)).toBeNull();
+    expect(await Appointment.findById(fresh.body.id)).not.toBeNull();
+  });
+});
+
+describe('clinic room capacity', () => {
+  const date = daysFromToday(2);
+
+  // Doctors at the same address share its consultation rooms
+  const atClinic = (rooms) => createDoctor({
+    clinicLocation: { address: 'Damrak 1', city: 'Amsterdam', postalCode: '1012LG', rooms }
+  });
+
+  const book = async (doctor, timeSlot, type = 'in-person') => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', await authHeader(await createUser()))
+    .send({ doctorId: doctor._id.toString(), date, timeSlot, type, reason: 'Check-up' });
+
+  describe('with a single room', () => {
+    let first;
+    let second;
+
+    beforeEach(async () => {
+      ({ doctor: first } = await atClinic(1));
+      ({ doctor: second } = await atClinic(1));
+      expect((await book(first, '10:00-10:30')).status).toBe(201);
+    });
+
+    it('rejects an overlapping in-person visit with a colleague', async () => {
+      const res = await book(second, '10:15-10:45');
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('CLINIC_AT_CAPACITY');
+      expect(await Appointment.countDocuments({ doctorId: second._id })).toBe(0);
+    });
+
+    it('books the room once it is free again', async () => {
+      expect((await book(second, '10:30-11:00')).status).toBe(201);
+    });
+
+    it('lets a colleague take a video call meanwhile', async () => {
+      expect((await book(second, '10:00-10:30', 'video')).status).toBe(201);
+    });
+
+    it('keeps a doctor to one appointment at a time whatever the mode', async () => {
+      const res = await book(first, '10:00-10:30', 'video');
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('SLOT_UNAVAILABLE');
+    });
+
+    it('does not count cancelled visits', async () => {
+      await Appointment.updateMany({ doctorId: first._id }, { $set: { status: 'cancelled' } });
+
+      expect((await book(second, '10:00-10:30')).status).toBe(201);
+    });
+  });
+
+  describe('with two rooms', () => {
+    it('hosts two visits at once but not a third', async () => {
+      const doctors = [];
+      for (let i = 0; i < 3; i++) {
+        doctors.push((await atClinic(2)).doctor);
+      }
+
+      expect((await book(doctors[0], '10:00-10:30')).status).toBe(201);
+      expect((await book(doctors[1], '10:00-10:30')).status).toBe(201);
+      const res = await book(doctors[2], '10:00-10:30');
+
+      expect(res.status).toBe(409);
+      expect(res.body.code).toBe('CLINIC_AT_CAPACITY');
+    });
+
+    it('counts the rooms in use at each moment, not every overlapping visit', async () => {
+      const doctors = [];
+      for (let i = 0; i < 3; i++) {
+        doctors.push((await atClinic(2)).doctor);
+      }
+      // Back to back, so only one room is in use at any time
+      expect((await book(doctors[0], '10:00-10:30')).status).toBe(201);
+      expect((await book(doctors[1], '10:30-11:00')).status).toBe(201);
+
+      expect((await book(doctors[2], '10:15-10:45')).status).toBe(201);
+    });
+  });
+});
+
+describe('daily appointment cap', () => {
+  const date = daysFromToday(2);
+  let doctor;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor({ maxAppointmentsPerDay: 2 }));
+  });
+
+  const book = async (timeSlot) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', await authHeader(await createUser()))
+    .send({ doctorId: doctor._id.toString(), date, timeSlot, type: 'video', reason: 'Check-up' });
+
+  it('rejects the booking after the cap is reached', async () => {
+    expect((await book('09:00-09:30')).status).toBe(201);
+    expect((await book('10:00-10:30')).status).toBe(201);
+
+    const res = await book('11:00-11:30');
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('DAILY_LIMIT_REACHED');
+    expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(2);
+  });
+
+  it('does not count cancelled appointments', async () => {
+    const first = await book('09:00-09:30');
+    expect((await book('10:00-10:30')).status).toBe(201);
+    await Appointment.updateOne({ _id: first.body.id }, { $set: { status: 'cancelled' } });
+
+    const res = await book('11:00-11:30');
+
+    expect(res.status).toBe(201);
+  });
+
+  it('offers no more slots that day once full', async () => {
+    expect((await book('09:00-09:30')).status).toBe(201);
+    expect((await book('10:00-10:30')).status).toBe(201);
+
+    const res = await request(app)
+      .get('/api/v1/appointments/slots/available')
+      .set('Authorization', await authHeader(await createUser()))
+      .query({ doctorId: doctor._id.toString(), startDate: date, endDate: date });
+
+    expect(res.status).toBe(200);
+    expect(res.body.availability[0].slots).toEqual([]);
+  });
+});
+
+describe('advance booking window', () => {
+  let patientAuth;
+
+  beforeEach(async () => {
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const book = (doctor, date) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), date, timeSlot: '10:00-10:30', type: 'video', reason: 'Check-up' });
+
+  it('books the last day of the platform window', async () => {
+    const { doctor } = await createDoctor();
+
+    const res = await book(doctor, daysFromToday(config.appointments.maxAdvanceBookingDays));
+
+    expect(res.status).toBe(201);
+  });
+
+  it('rejects a booking beyond the platform window', async () => {
+    const { doctor } = await createDoctor();
+
+    const res = await book(doctor, daysFromToday(config.appointments.maxAdvanceBookingDays + 1));
+
+    expect(res.status).toBe(400);
+    expect(res.body).toMatchObject({
+      code: 'BEYOND_BOOKING_WINDOW',
+      lastBookableDate: daysFromToday(config.appointments.maxAdvanceBookingDays)
+    });
+  });
+
+  it('uses the doctor\'s own window when set', async () => {
+    const { doctor } = await createDoctor({ maxAdvanceBookingDays: 7 });
+
+    expect((await book(doctor, daysFromToday(7))).status).toBe(201);
+    const res = await book(doctor, daysFromToday(8));
+
+    expect(res.status).toBe(400);
+    expect(res.body.code).toBe('BEYOND_BOOKING_WINDOW');
+  });
+
+  it('offers no slots past the window', async () => {
+    const { doctor } = await createDoctor({ maxAdvanceBookingDays: 7 });
+
+    const res = await request(app)
+      .get('/api/v1/appointments/slots/available')
+      .set('Authorization', patientAuth)
+      .query({ doctorId: doctor._id.toString(), startDate: daysFromToday(6), endDate: daysFromToday(9) });
+
+    expect(res.status).toBe(200);
+    expect(res.body.lastBookableDate).toBe(daysFromToday(7));
+    expect(res.body.availability.map(day => day.date)).toEqual([daysFromToday(6), daysFromToday(7)]);
+  });
+});
+
+describe('consultation languages', () => {
+  const date = daysFromToday(2);
+  let doctor;
+  let doctorUser;
+  let patientAuth;
+
+  // Dutch-only mornings; afternoons offer all of the doctor's languages
+  beforeEach(async () => {
+    ({ user: doctorUser, doctor } = await createDoctor({
+      availability: ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'].map(day => ({
+        day,
+        slots: [
+          { startTime: '09:00', endTime: '12:00', languages: ['nl'] },
+          { startTime: '13:00', endTime: '17:00' }
+        ]
+      }))
+    }));
+    await User.updateOne({ _id: doctorUser._id }, { $set: { languages: ['en', 'nl'] } });
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const book = (timeSlot, language) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), date, timeSlot, type: 'video', reason: 'Check-up', language });
+
+  const getSlots = (query = {}) => request(app)
+    .get('/api/v1/appointments/slots/available')
+    .set('Authorization', patientAuth)
+    .query({ doctorId: doctor._id.toString(), startDate: date, endDate: date, ...query });
+
+  it('rejects a language the slot is not offered in and suggests slots that are', async () => {
+    const res = await book('10:00-10:30', 'en');
+
+    expect(res.status).toBe(409);
+    expect(res.body).toMatchObject({
+      code: 'LANGUAGE_NOT_OFFERED',
+      languages: ['nl'],
+      message: 'Consultations at this time are offered in nl, not en'
+    });
+    expect(res.body.suggestions.sameDay.length).toBeGreaterThan(0);
+    expect(res.body.suggestions.sameDay.every(slot => slot.startTime >= '13:00')).toBe(true);
+    expect(await Appointment.countDocuments()).toBe(0);
+  });
+
+  it('stores the requested language on the appointment', async () => {
+    const res = await book('10:00-10:30', 'NL');
+
+    expect(res.status).toBe(201);
+    expect(res.body.language).toBe('nl');
+    expect((await Appointment.findById(res.body.id)).language).toBe('nl');
+  });
+
+  it('stores the slot\'s only language when none is requested', async () => {
+    const res = await book('10:00-10:30');
+
+    expect(res.status).toBe(201);
+    expect(res.body.language).toBe('nl');
+  });
+
+  it('books any of the doctor\'s languages in an unrestricted block', async () => {
+    const res = await book('14:00-14:30', 'en');
+
+    expect(res.status).toBe(201);
+    expect(res.body.language).toBe('en');
+  });
+
+  it('applies the languages the appointment mode is limited to', async () => {
+    await Doctor.updateOne({ _id: doctor._id }, { $set: { 'consultationLanguages.video': ['en'] } });
+
+    const res = await book('14:00-14:30', 'nl');
+
+    expect(res.status).toBe(409);
+    expect(res.body).toMatchObject({ code: 'LANGUAGE_NOT_OFFERED', languages: ['en'] });
+  });
+
+  it('rejects an invalid language code', async () => {
+    const res = await book('14:00-14:30', 'english');
+
+    expect(res.status).toBe(400);
+  });
+
+  describe('available slots', () => {
+    it('lists the languages of each slot', async () => {
+      const res = await getSlots();
+
+      expect(res.status).toBe(200);
+      const languages = Object.fromEntries(res.body.availability[0].slotDetails.map(slot => [slot.startTime, slot.languages]));
+      expect(languages['09:00']).toEqual(['nl']);
+      expect(languages['13:00']).toEqual(['en', 'nl']);
+    });
+
+    it('filters out slots not offered in the requested language', async () => {
+      const res = await getSlots({ language: 'en' });
+
+      expect(res.status).toBe(200);
+      const { slots } = res.body.availability[0];
+      expect(slots[0]).toBe('13:00-13:30');
+      expect(slots.some(slot => slot < '12:00')).toBe(false);
+    });
+  });
+
+  it('keeps the agreed language when the appointment is rescheduled', async () => {
+    const booked = await book('14:00-14:30', 'en').expect(201);
+
+    const res = await request(app)
+      .put(`/api/v1/appointments/${booked.body.id}/reschedule`)
+      .set('Authorization', patientAuth)
+      .send({ date, timeSlot: '10:00-10:30' });
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('LANGUAGE_NOT_OFFERED');
+  });
+
+  describe('PUT /api/v1/doctors/me/availability', () => {
+    const update = async (body) => request(app)
+      .put('/api/v1/doctors/me/availability')
+      .set('Authorization', await authHeader(doctorUser))
+      .send(body);
+
+    it('saves the languages offered per appointment mode', async () => {
+      const res = await update({ consultationLanguages: { video: ['EN'] } });
+
+      expect(res.status).toBe(200);
+      expect(res.body.consultationLanguages).toEqual({ 'in-person': [], video: ['en'], phone: [] });
+    });
+
+    it('rejects a language that is not on the doctor\'s profile', async () => {
+      const res = await update({ consultationLanguages: { video: ['fr'] } });
+
+      expect(res.status).toBe(400);
+      expect(res.body.error).toBe('fr is not one of the languages on your profile (en, nl)');
+    });
+  });
+});
@@ -0,0 +1,193 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const BookingThrottle = require('../models/booking.throttle.model');
+const BookingThrottleCounter = require('../models/booking.throttle.counter.model');
+const BookingThrottleService = require('../services/booking.throttle.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('specialty booking throttles', () => {
+  const date = daysFromToday(2);
+  let adminAuth;
+  let pulmonologist;
+  let gp;
+
+  beforeEach(async () => {
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+    ({ doctor: pulmonologist } = await createDoctor({ specializations: ['Pulmonologist', 'Internal Medicine'] }));
+    ({ doctor: gp } = await createDoctor());
+  });
+
+  const setThrottle = (specialty, body, authorization = adminAuth) => request(app)
+    .put(`/api/v1/admin/booking-throttles/${encodeURIComponent(specialty)}`)
+    .set('Authorization', authorization)
+    .send(body);
+
+  const book = async (doctor, timeSlot) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', await authHeader(await createUser()))
+    .send({ doctorId: doctor._id.toString(), date, timeSlot, type: 'video', reason: 'Shortness of breath' });
+
+  describe('POST /api/v1/appointments', () => {
+    it('refuses new bookings for a specialty once its hourly limit is reached', async () => {
+      await setThrottle('pulmonologist', { maxPerHour: 2, reason: 'Flu season' }).expect(201);
+      expect((await book(pulmonologist, '09:00-09:30')).status).toBe(201);
+      expect((await book(pulmonologist, '09:30-10:00')).status).toBe(201);
+
+      const res = await book(pulmonologist, '10:00-10:30');
+
+      expect(res.status).toBe(429);
+      expect(res.body).toMatchObject({ code: 'SPECIALTY_BOOKINGS_THROTTLED', specialty: 'pulmonologist' });
+      expect(res.body.message).toBe('New pulmonologist bookings are limited right now because of high demand. Please try again later.');
+      expect(Number(res.headers['retry-after'])).toBeGreaterThan(0);
+      expect(Number(res.headers['retry-after'])).toBeLessThanOrEqual(60 * 60);
+      expect(await Appointment.countDocuments({ doctorId: pulmonologist._id })).toBe(2);
+    });
+
+    it('applies the daily limit on its own', async () => {
+      await setThrottle('Pulmonologist', { maxPerDay: 1 }).expect(201);
+      expect((await book(pulmonologist, '09:00-09:30')).status).toBe(201);
+
+      const res = await book(pulmonologist, '11:00-11:30');
+
+      expect(res.status).toBe(429);
+      expect(new Date(res.body.retryAfter).getTime() % (24 * 60 * 60 * 1000)).toBe(0);
+    });
+
+    it('leaves other specialties unlimited', async () => {
+      await setThrottle('pulmonologist', { maxPerHour: 1 }).expect(201);
+      expect((await book(pulmonologist, '09:00-09:30')).status).toBe(201);
+
+      expect((await book(gp, '09:00-09:30')).status).toBe(201);
+      expect((await book(gp, '09:30-10:00')).status).toBe(201);
+    });
+
+    it('does not count a booking refused for another reason', async () => {
+      await setThrottle('pulmonologist', { maxPerHour: 1 }).expect(201);
+
+      expect((await book(pulmonologist, '18:00-18:30')).status).toBe(409);
+      expect((await book(pulmonologist, '09:00-09:30')).status).toBe(201);
+    });
+
+    it('counts bookings again once the throttle is lifted', async () => {
+      await setThrottle('pulmonologist', { maxPerHour: 1 }).expect(201);
+      expect((await book(pulmonologist, '09:00-09:30')).status).toBe(201);
+      expect((await book(pulmonologist, '09:30-10:00')).status).toBe(429);
+
+      await request(app)
+        .delete('/api/v1/admin/booking-throttles/pulmonologist')
+        .set('Authorization', adminAuth)
+        .expect(200);
+
+      expect((await book(pulmonologist, '09:30-10:00')).status).toBe(201);
+    });
+  });
+
+  describe('BookingThrottleService.reserveBooking', () => {
+    const now = new Date('2026-03-10T10:15:00.000Z');
+
+    it('counts against every throttled specialty of the doctor and gives back an over-limit booking everywhere', async () => {
+      await BookingThrottle.create([
+        { specialty: 'pulmonologist', maxPerHour: 5 },
+        { specialty: 'internal medicine', maxPerHour: 1 }
+      ]);
+
+      const first = await BookingThrottleService.reserveBooking(pulmonologist, now);
+      const second = await BookingThrottleService.reserveBooking(pulmonologist, now);
+
+      expect(first.reservation).toHaveLength(2);
+      expect(second.throttled).toEqual({
+        specialty: 'internal medicine',
+        window: 'hour',
+        limit: 1,
+        retryAfter: new Date('2026-03-10T11:00:00.000Z')
+      });
+      const counts = await BookingThrottleCounter.find().lean();
+      expect(Object.fromEntries(counts.map(counter => [counter.specialty, counter.count]))).toEqual({
+        pulmonologist: 1,
+        'internal medicine': 1
+      });
+    });
+
+    it('releases a reservation whose booking was not saved', async () => {
+      await BookingThrottle.create({ specialty: 'pulmonologist', maxPerHour: 1 });
+      const { reservation } = await BookingThrottleService.reserveBooking(pulmonologist, now);
+
+      await BookingThrottleService.releaseBooking(reservation);
+
+      expect((await BookingThrottleService.reserveBooking(pulmonologist, now)).reservation).toHaveLength(1);
+    });
+
+    it('starts each window from zero', async () => {
+      await BookingThrottle.create({ specialty: 'pulmonologist', maxPerHour: 1 });
+      await BookingThrottleService.reserveBooking(pulmonologist, now);
+
+      const nextHour = await BookingThrottleService.reserveBooking(pulmonologist, new Date('2026-03-10T11:00:00.000Z'));
+
+      expect(nextHour.reservation).toHaveLength(1);
+      const counter = await BookingThrottleCounter.findOne({ startsAt: new Date('2026-03-10T11:00:00.000Z') });
+      expect(counter.expiresAt).toEqual(new Date('2026-03-10T12:00:00.000Z'));
+    });
+
+    it('reserves nothing for a doctor without throttled specialties', async () => {
+      expect(await BookingThrottleService.reserveBooking(gp, now)).toEqual({ reservation: [] });
+      expect(await BookingThrottleCounter.countDocuments()).toBe(0);
+    });
+  });
+
+  describe('/api/v1/admin/booking-throttles', () => {
+    it('lists throttles with the bookings counted this hour and today', async () => {
+      await setThrottle('Pulmonologist', { maxPerHour: 3, maxPerDay: 20, reason: 'Flu season' }).expect(201);
+      expect((await book(pulmonologist, '09:00-09:30')).status).toBe(201);
+
+      const res = await request(app).get('/api/v1/admin/booking-throttles').set('Authorization', adminAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.data).toEqual([expect.objectContaining({
+        specialty: 'pulmonologist',
+        maxPerHour: 3,
+        maxPerDay: 20,
+        reason: 'Flu season',
+        bookedThisHour: 1,
+        bookedToday: 1
+      })]);
+    });
+
+    it('replaces a throttle, dropping limits left out', async () => {
+      await setThrottle('pulmonologist', { maxPerHour: 3, maxPerDay: 20 }).expect(201);
+
+      const res = await setThrottle('pulmonologist', { maxPerDay: 10 });
+
+      expect(res.status).toBe(200);
+      expect(res.body.data.maxPerDay).toBe(10);
+      expect(res.body.data).not.toHaveProperty('maxPerHour');
+    });
+
+    it.each([
+      ['no limit', {}, 'Set maxPerHour, maxPerDay or both'],
+      ['a zero limit', { maxPerHour: 0 }, 'maxPerHour must be a whole number of at least 1']
+    ])('rejects %s', async (_case, body, error) => {
+      const res = await setThrottle('pulmonologist', body);
+
+      expect(res.status).toBe(400);
+      expect(JSON.stringify(res.body)).toContain(error);
+      expect(await BookingThrottle.countDocuments()).toBe(0);
+    });
+
+    it('returns 404 when lifting a throttle that does not exist', async () => {
+      const res = await request(app).delete('/api/v1/admin/booking-throttles/cardiology').set('Authorization', adminAuth);
+
+      expect(res.status).toBe(404);
+    });
+
+    it('is for admins only', async () => {
+      const res = await setThrottle('pulmonologist', { maxPerHour: 1 }, await authHeader(await createUser()));
+
+      expect(res.status).toBe(403);
+    });
+  });
+});
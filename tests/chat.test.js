@@ -0,0 +1,333 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const Message = require('../models/message.model');
+const AWSService = require('../services/aws.service');
+const { CHAT_TOMBSTONE } = require('../services/chat.service');
+const config = require('../config/config');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('chat messages', () => {
+  let appointment;
+  let patientAuth;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    const { user, doctor } = await createDoctor();
+    const patient = await createUser();
+    patientAuth = await authHeader(patient);
+    doctorAuth = await authHeader(user);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50,
+      status: 'confirmed'
+    });
+  });
+
+  const send = (body, authorization = patientAuth) => request(app)
+    .post(`/api/v1/chats/${appointment._id}/message`)
+    .set('Authorization', authorization)
+    .send(body);
+
+  describe('POST /api/v1/chats/:appointmentId/message', () => {
+    it('stores a valid message', async () => {
+      const res = await send({ content: '  Hello doctor  ', type: 'text' });
+
+      expect(res.status).toBe(201);
+      expect(res.body.content).toBe('Hello doctor');
+      expect(await Message.countDocuments({ chatId: appointment._id })).toBe(1);
+    });
+
+    it.each([
+      ['oversized content', { content: 'a'.repeat(config.chat.maxMessageLength + 1), type: 'text' }, 'content'],
+      ['blank content', { content: '   ', type: 'text' }, 'content'],
+      ['non-string content', { content: { $gt: '' }, type: 'text' }, 'content'],
+      ['an unknown type', { content: 'Hello', type: 'script' }, 'type']
+    ])('rejects %s without storing a message', async (_case, body, field) => {
+      const res = await send(body);
+
+      expect(res.status).toBe(400);
+      expect(res.body.message).toBe('Validation Error');
+      expect(res.body.errors).toHaveProperty(field);
+      expect(await Message.countDocuments()).toBe(0);
+    });
+
+    it('rejects someone outside the appointment', async () => {
+      const res = await send({ content: 'Hello', type: 'text' }, await authHeader(await createUser()));
+
+      expect(res.status).toBe(403);
+      expect(await Message.countDocuments()).toBe(0);
+    });
+  });
+
+  describe('with a doctor whose verification was revoked', () => {
+    beforeEach(async () => {
+      await send({ content: 'Before the revocation', type: 'text' }).expect(201);
+      await Doctor.updateOne({ _id: appointment.doctorId }, { $set: { verificationStatus: 'rejected' } });
+    });
+
+    afterEach(() => {
+      config.chat.requireVerifiedDoctor = true;
+    });
+
+    it('refuses new messages to the doctor', async () => {
+      const res = await send({ content: 'Are you there?', type: 'text' });
+
+      expect(res.status).toBe(403);
+      expect(res.body.code).toBe('DOCTOR_NOT_VERIFIED');
+      expect(await Message.countDocuments()).toBe(1);
+    });
+
+    it('refuses new messages from the doctor', async () => {
+      const res = await send({ content: 'Still here', type: 'text' }, doctorAuth);
+
+      expect(res.status).toBe(403);
+      expect(res.body.code).toBe('DOCTOR_NOT_VERIFIED');
+    });
+
+    it('keeps the history readable', async () => {
+      const res = await request(app)
+        .get(`/api/v1/chats/${appointment._id}`)
+        .set('Authorization', patientAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.messages.map(message => message.content)).toEqual(['Before the revocation']);
+    });
+
+    it('allows messages when the restriction is turned off', async () => {
+      config.chat.requireVerifiedDoctor = false;
+
+      const res = await send({ content: 'Are you there?', type: 'text' });
+
+      expect(res.status).toBe(201);
+    });
+  });
+});
+
+describe('message templates', () => {
+  let appointment;
+  let patient;
+  let doctorUser;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    let doctor;
+    ({ user: doctorUser, doctor } = await createDoctor());
+    doctorAuth = await authHeader(doctorUser);
+    patient = await createUser();
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50,
+      status: 'confirmed'
+    });
+  });
+
+  const createTemplate = (fields, authorization = doctorAuth) => request(app)
+    .post('/api/v1/doctors/me/message-templates')
+    .set('Authorization', authorization)
+    .send({ name: 'Results', content: 'Hi {{patientFirstName}}, your results are in. See you at {{appointmentTime}}. Dr. {{doctorLastName}}', ...fields });
+
+  const send = (body, authorization = doctorAuth) => request(app)
+    .post(`/api/v1/chats/${appointment._id}/message`)
+    .set('Authorization', authorization)
+    .send(body);
+
+  describe('POST /api/v1/doctors/me/message-templates', () => {
+    it('saves a template for the doctor', async () => {
+      const res = await createTemplate();
+
+      expect(res.status).toBe(201);
+      expect(res.body.template).toMatchObject({ name: 'Results' });
+      const listed = await request(app)
+        .get('/api/v1/doctors/me/message-templates')
+        .set('Authorization', doctorAuth);
+      expect(listed.body.templates.map(template => template.name)).toEqual(['Results']);
+      expect(listed.body.placeholders).toContain('patientFirstName');
+    });
+
+    it('rejects unknown placeholders', async () => {
+      const res = await createTemplate({ content: 'Hi {{nickname}}' });
+
+      expect(res.status).toBe(400);
+      expect(res.body.error).toMatch(/^Unknown placeholders: nickname\./);
+    });
+
+    it('rejects a second template with the same name', async () => {
+      await createTemplate().expect(201);
+
+      const res = await createTemplate({ content: 'Something else' });
+
+      expect(res.status).toBe(409);
+      expect(res.body.error).toBe('You already have a template with this name');
+    });
+
+    it('keeps templates private to their doctor', async () => {
+      await createTemplate().expect(201);
+      const { user } = await createDoctor();
+
+      const res = await request(app)
+        .get('/api/v1/doctors/me/message-templates')
+        .set('Authorization', await authHeader(user));
+
+      expect(res.body.templates).toEqual([]);
+    });
+  });
+
+  describe('sending a template', () => {
+    it('expands the template for the appointment', async () => {
+      const template = (await createTemplate()).body.template;
+
+      const res = await send({ templateId: template._id });
+
+      expect(res.status).toBe(201);
+      expect(res.body).toMatchObject({
+        type: 'text',
+        content: `Hi ${patient.firstName}, your results are in. See you at 10:00. Dr. ${doctorUser.lastName}`
+      });
+      expect(await Message.countDocuments({ chatId: appointment._id })).toBe(1);
+    });
+
+    it('does not send another doctor\'s template', async () => {
+      const { user } = await createDoctor();
+      const template = (await createTemplate({}, await authHeader(user))).body.template;
+
+      const res = await send({ templateId: template._id });
+
+      expect(res.status).toBe(404);
+      expect(res.body.message).toBe('Template not found');
+      expect(await Message.countDocuments()).toBe(0);
+    });
+
+    it('is for the appointment\'s doctor only', async () => {
+      const template = (await createTemplate()).body.template;
+
+      const res = await send({ templateId: template._id }, await authHeader(patient));
+
+      expect(res.status).toBe(403);
+      expect(res.body.message).toBe('Only the appointment\'s doctor can send templates');
+    });
+  });
+});
+
+describe('POST /api/v1/chats/:appointmentId/purge', () => {
+  const fileUrl = 'https://bucket.example.com/chat/results.pdf';
+  let appointment;
+  let patient;
+  let patientAuth;
+
+  beforeEach(async () => {
+    const { doctor } = await createDoctor();
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(-2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      status: 'completed'
+    });
+    await Message.create([
+      { chatId: appointment._id, senderId: patient._id, content: 'Here are my results', type: 'text' },
+      { chatId: appointment._id, senderId: patient._id, content: 'results.pdf', type: 'file', fileUrl, fileName: 'results.pdf', fileType: 'application/pdf' }
+    ]);
+    AWSService.deleteFromS3.mockResolvedValue();
+  });
+
+  afterEach(() => {
+    AWSService.deleteFromS3.mockReset();
+  });
+
+  const purge = (authorization) => request(app)
+    .post(`/api/v1/chats/${appointment._id}/purge`)
+    .set('Authorization', authorization);
+
+  it('replaces every message with a tombstone and deletes the attachments', async () => {
+    const res = await purge(patientAuth);
+
+    expect(res.status).toBe(200);
+    expect(res.body).toEqual({ appointmentId: appointment._id.toString(), messageCount: 2, attachmentCount: 1 });
+    expect(AWSService.deleteFromS3).toHaveBeenCalledTimes(1);
+    expect(AWSService.deleteFromS3).toHaveBeenCalledWith(fileUrl);
+
+    const messages = await Message.find({ chatId: appointment._id });
+    expect(messages).toHaveLength(2);
+    expect(messages.every(message => message.content === CHAT_TOMBSTONE && message.redactedAt)).toBe(true);
+    expect(messages.some(message => message.fileUrl || message.fileName || message.fileType)).toBe(false);
+
+    const purged = await Appointment.findById(appointment._id);
+    expect(purged.chatPurge).toMatchObject({ reason: 'participant', messageCount: 2, attachmentCount: 1 });
+    expect(purged.chatPurge.purgedBy.toString()).toBe(patient._id.toString());
+    expect(purged.chatPurge.purgedAt).toBeInstanceOf(Date);
+  });
+
+  it('keeps the message history in place with redacted markers', async () => {
+    await purge(patientAuth).expect(200);
+
+    const res = await request(app)
+      .get(`/api/v1/chats/${appointment._id}`)
+      .set('Authorization', patientAuth);
+
+    expect(res.body.total).toBe(2);
+    expect(res.body.messages.map(message => [message.content, message.redacted])).toEqual([
+      [CHAT_TOMBSTONE, true],
+      [CHAT_TOMBSTONE, true]
+    ]);
+  });
+
+  it('leaves the messages untouched when an attachment cannot be deleted', async () => {
+    AWSService.deleteFromS3.mockRejectedValue(new Error('S3 unavailable'));
+    jest.spyOn(console, 'error').mockImplementation(() => {});
+
+    const res = await purge(patientAuth);
+
+    console.error.mockRestore();
+    expect(res.status).toBe(500);
+    expect(await Message.countDocuments({ chatId: appointment._id, redactedAt: { $exists: true } })).toBe(0);
+    expect((await Appointment.findById(appointment._id)).chatPurge?.purgedAt).toBeUndefined();
+  });
+
+  it('records an admin purge as such', async () => {
+    const res = await purge(await authHeader(await createUser({ role: 'admin' })));
+
+    expect(res.status).toBe(200);
+    expect((await Appointment.findById(appointment._id)).chatPurge.reason).toBe('admin');
+  });
+
+  it('denies anyone outside the appointment', async () => {
+    const res = await purge(await authHeader(await createUser()));
+
+    expect(res.status).toBe(403);
+    expect(res.body.message).toBe('Not a participant in this chat');
+    expect(await Message.countDocuments({ chatId: appointment._id, content: CHAT_TOMBSTONE })).toBe(0);
+  });
+
+  it('only purges the chat of a completed appointment', async () => {
+    await Appointment.updateOne({ _id: appointment._id }, { status: 'confirmed' });
+
+    const res = await purge(patientAuth);
+
+    expect(res.status).toBe(409);
+    expect(res.body.message).toBe('Only the chat of a completed appointment can be purged');
+    expect(AWSService.deleteFromS3).not.toHaveBeenCalled();
+  });
+});
@@ -0,0 +1,157 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const PaymentService = require('../services/payment.service');
+const config = require('../config/config');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('platform commission', () => {
+  describe('calculateFees', () => {
+    it.each([
+      [0, 0, 50],
+      [10, 5, 45],
+      [12.5, 6.25, 43.75],
+      [15, 7.5, 42.5],
+      [33, 16.5, 33.5],
+      [100, 50, 0]
+    ])('takes %s%% of 50 as a fee of %s, leaving %s', (percent, platformFee, doctorNet) => {
+      expect(PaymentService.calculateFees(50, percent)).toEqual({ platformFee, doctorNet });
+    });
+
+    it('rounds to cents without losing any', () => {
+      const { platformFee, doctorNet } = PaymentService.calculateFees(19.99, 10);
+
+      expect(platformFee).toBe(2);
+      expect(doctorNet).toBe(17.99);
+    });
+  });
+
+  describe('getCommissionPercent', () => {
+    const platformPercent = config.payments.commissionPercent;
+
+    beforeEach(() => {
+      config.payments.commissionPercent = 20;
+    });
+
+    afterEach(() => {
+      config.payments.commissionPercent = platformPercent;
+    });
+
+    it('uses the platform rate by default', () => {
+      expect(PaymentService.getCommissionPercent({})).toBe(20);
+      expect(PaymentService.getCommissionPercent()).toBe(20);
+    });
+
+    it('prefers a doctor\'s override, including none at all', () => {
+      expect(PaymentService.getCommissionPercent({ commissionPercent: 5 })).toBe(5);
+      expect(PaymentService.getCommissionPercent({ commissionPercent: 0 })).toBe(0);
+    });
+  });
+
+  describe('applyRefund', () => {
+    const paidPayment = () => {
+      const payment = { amount: 80, refundedAmount: 0, status: 'success' };
+      PaymentService.applyCommission(payment, { commissionPercent: 25 });
+      return payment;
+    };
+
+    it('reverses the fee in proportion to the share refunded', () => {
+      const payment = paidPayment();
+      expect(payment).toMatchObject({ platformFee: 20, doctorNet: 60 });
+
+      PaymentService.applyRefund(payment, 20);
+
+      expect(payment).toMatchObject({ refundedAmount: 20, platformFee: 15, doctorNet: 45, status: 'success' });
+    });
+
+    it('reverses the whole fee once refunded in full', () => {
+      const payment = paidPayment();
+
+      PaymentService.applyRefund(payment, 20);
+      PaymentService.applyRefund(payment, 60);
+
+      expect(payment).toMatchObject({ refundedAmount: 80, platformFee: 0, doctorNet: 0, status: 'refunded' });
+      expect(payment.refundedAt).toBeInstanceOf(Date);
+    });
+  });
+
+  describe('payments', () => {
+    let payment;
+    let adminAuth;
+    let doctorAuth;
+    let patientAuth;
+
+    beforeEach(async () => {
+      const { user, doctor } = await createDoctor({ commissionPercent: 15 });
+      const patient = await createUser();
+      patientAuth = await authHeader(patient);
+      doctorAuth = await authHeader(user);
+      adminAuth = await authHeader(await createUser({ role: 'admin' }));
+      const appointment = await Appointment.create({
+        doctorId: doctor._id,
+        patientId: patient._id,
+        date: daysFromToday(2),
+        startTime: '10:00',
+        endTime: '10:30',
+        type: 'video',
+        reason: 'Check-up',
+        fee: 50
+      });
+
+      const { transactionId } = (await request(app)
+        .post('/api/v1/payments/initiate')
+        .set('Authorization', patientAuth)
+        .send({ appointmentId: appointment._id.toString(), paymentMethod: 'iDEAL' })
+        .expect(201)).body;
+      await request(app)
+        .post('/api/v1/payments/webhook')
+        .set('x-webhook-secret', process.env.PAYMENT_WEBHOOK_SECRET)
+        .send({ event: 'payment.succeeded', data: { transactionId } })
+        .expect(200);
+      payment = await Payment.findOne({ transactionId });
+    });
+
+    it('records the doctor\'s commission when the payment succeeds', () => {
+      expect(payment.toObject()).toMatchObject({ commissionPercent: 15, platformFee: 7.5, doctorNet: 42.5 });
+    });
+
+    it('shows the breakdown to the doctor but not the patient', async () => {
+      const doctorView = await request(app)
+        .get(`/api/v1/payments/${payment._id}`)
+        .set('Authorization', doctorAuth);
+      const patientView = await request(app)
+        .get(`/api/v1/payments/${payment._id}`)
+        .set('Authorization', patientAuth);
+
+      expect(doctorView.body).toMatchObject({ commissionPercent: 15, platformFee: 7.5, doctorNet: 42.5 });
+      expect(patientView.body.platformFee).toBeUndefined();
+    });
+
+    it('reverses the fee proportionally on a partial refund', async () => {
+      const res = await request(app)
+        .post(`/api/v1/payments/${payment._id}/refund`)
+        .set('Authorization', adminAuth)
+        .send({ reason: 'Late start', amount: 20 });
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ refundedAmount: 20, platformFee: 4.5, doctorNet: 25.5 });
+    });
+
+    it('rejects an invalid refund with field errors', async () => {
+      const res = await request(app)
+        .post(`/api/v1/payments/${payment._id}/refund`)
+        .set('Authorization', adminAuth)
+        .send({ reason: 'Late start', amount: -5 });
+
+      expect(res.status).toBe(400);
+      expect(res.body).toEqual({ message: 'Validation Error', errors: { amount: 'Refund amount must be positive' } });
+      const unchanged = await Payment.findById(payment._id);
+      expect(unchanged.refundedAmount).toBe(0);
+    });
+  });
+});
@@ -0,0 +1,147 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const InstantConsult = require('../models/instant.consult.model');
+const { useDatabase, createUser, createDoctor, authHeader } = require('./helpers');
+
+useDatabase();
+
+describe('instant consults', () => {
+  let patient;
+  let patientAuth;
+
+  beforeEach(async () => {
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+  });
+
+  const goOnline = async (doctorUser, online = true) => request(app)
+    .put('/api/v1/consult/online')
+    .set('Authorization', await authHeader(doctorUser))
+    .send({ online })
+    .expect(200);
+
+  const requestConsult = () => request(app)
+    .post('/api/v1/consult/instant')
+    .set('Authorization', patientAuth)
+    .send({ specialty: 'general-practice', reason: 'Sore throat' });
+
+  it('matches the patient with an online doctor right away', async () => {
+    const { user, doctor } = await createDoctor();
+    await goOnline(user);
+
+    const res = await requestConsult();
+
+    expect(res.status).toBe(201);
+    expect(res.body.status).toBe('matched');
+    expect(res.body.doctorId).toBe(doctor._id.toString());
+    const appointment = await Appointment.findById(res.body.appointmentId);
+    expect(appointment.toObject()).toMatchObject({ type: 'video', status: 'confirmed' });
+  });
+
+  it('offers scheduled slots instead of queueing when nobody is online', async () => {
+    await createDoctor();
+
+    const res = await requestConsult();
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('NO_DOCTORS_ONLINE');
+    expect(res.body.suggestions).toEqual(expect.any(Array));
+    expect(await InstantConsult.countDocuments()).toBe(0);
+  });
+
+  it('rejects a second open request', async () => {
+    const { user } = await createDoctor();
+    await goOnline(user);
+    await requestConsult().expect(201);
+
+    const res = await requestConsult();
+
+    expect(res.status).toBe(409);
+    expect(res.body.code).toBe('INSTANT_CONSULT_OPEN');
+  });
+
+  it('requeues the patient when the doctor goes offline before joining', async () => {
+    const first = await createDoctor();
+    await goOnline(first.user);
+    const matched = await requestConsult().expect(201);
+
+    await goOnline(first.user, false);
+
+    const requeued = await InstantConsult.findById(matched.body.id);
+    expect(requeued.toObject()).toMatchObject({ status: 'waiting', requeueCount: 1 });
+    const cancelled = await Appointment.findById(matched.body.appointmentId);
+    expect(cancelled.status).toBe('cancelled');
+
+    const second = await createDoctor();
+    await goOnline(second.user);
+
+    const rematched = await InstantConsult.findById(matched.body.id);
+    expect(rematched.status).toBe('matched');
+    expect(rematched.doctorId.toString()).toBe(second.doctor._id.toString());
+  });
+
+  describe('lookups', () => {
+    let consult;
+
+    beforeEach(async () => {
+      consult = await InstantConsult.create({
+        patientId: patient._id,
+        specialty: 'general-practice',
+        reason: 'Sore throat',
+        status: 'waiting'
+      });
+    });
+
+    it('lets the patient see and cancel their own request', async () => {
+      await request(app)
+        .get(`/api/v1/consult/instant/${consult._id}`)
+        .set('Authorization', patientAuth)
+        .expect(200);
+
+      const res = await request(app)
+        .delete(`/api/v1/consult/instant/${consult._id}`)
+        .set('Authorization', patientAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.status).toBe('cancelled');
+    });
+
+    it('hides another patient\'s request', async () => {
+      const other = await createUser();
+
+      const res = await request(app)
+        .get(`/api/v1/consult/instant/${consult._id}`)
+        .set('Authorization', await authHeader(other));
+
+      expect(res.status).toBe(404);
+    });
+
+    it('keeps admins on the admin routes', async () => {
+      const adminAuth = await authHeader(await createUser({ role: 'admin' }));
+
+      const patientRoute = await request(app)
+        .get(`/api/v1/consult/instant/${consult._id}`)
+        .set('Authorization', adminAuth);
+      const adminRoute = await request(app)
+        .get(`/api/v1/consult/admin/instant/${consult._id}`)
+        .set('Authorization', adminAuth);
+
+      expect(patientRoute.status).toBe(403);
+      expect(adminRoute.status).toBe(200);
+      expect(adminRoute.body.id).toBe(consult._id.toString());
+    });
+
+    it('keeps patients off the admin routes', async () => {
+      const res = await request(app)
+        .delete(`/api/v1/consult/admin/instant/${consult._id}`)
+        .set('Authorization', patientAuth);
+
+      expect(res.status).toBe(403);
+      const unchanged = await InstantConsult.findById(consult._id);
+      expect(unchanged.status).toBe('waiting');
+    });
+  });
+});
@@ -0,0 +1,133 @@
+jest.mock('../services/aws.service');
+jest.mock('../services/aws/s3.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Document = require('../models/document.model');
+const DocumentAccessLog = require('../models/document.access.log.model');
+const Message = require('../models/message.model');
+const s3Service = require('../services/aws/s3.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('GET /api/v1/appointments/:id/context', () => {
+  let appointment;
+  let patient;
+  let doctorUser;
+  let doctorAuth;
+  let patientAuth;
+
+  beforeEach(async () => {
+    let doctor;
+    ({ user: doctorUser, doctor } = await createDoctor());
+    doctorAuth = await authHeader(doctorUser);
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+    const booking = {
+      doctorId: doctor._id,
+      patientId: patient._id,
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up'
+    };
+    await Appointment.create({ ...booking, date: daysFromToday(-30), status: 'completed', disposition: 'follow-up-needed' });
+    appointment = await Appointment.create({
+      ...booking,
+      date: daysFromToday(2),
+      status: 'confirmed',
+      patientVisibleNotes: 'Bring your test results',
+      privateNotes: 'Suspect migraine'
+    });
+    const sentAt = Date.now() - 60 * 1000;
+    await Message.create(['Hello doctor', 'Hello', 'See you tomorrow'].map((content, index) => ({
+      chatId: appointment._id,
+      senderId: patient._id,
+      content,
+      type: 'text',
+      createdAt: new Date(sentAt + index * 1000)
+    })));
+    await Document.create({
+      appointmentId: appointment._id,
+      uploadedBy: patient._id,
+      key: 'documents/results.pdf',
+      fileName: 'results.pdf',
+      contentType: 'application/pdf',
+      scan: { status: 'clean' }
+    });
+    await Document.create({
+      appointmentId: appointment._id,
+      uploadedBy: patient._id,
+      key: 'documents/scan.pdf',
+      fileName: 'scan.pdf',
+      contentType: 'application/pdf',
+      scan: { status: 'pending' }
+    });
+    s3Service.getDownloadUrl.mockResolvedValue('https://bucket.example.com/signed');
+  });
+
+  afterEach(() => {
+    s3Service.getDownloadUrl.mockReset();
+  });
+
+  const getContext = (authorization, query = {}) => request(app)
+    .get(`/api/v1/appointments/${appointment._id}/context`)
+    .set('Authorization', authorization)
+    .query(query);
+
+  it('bundles everything the doctor needs for the consult', async () => {
+    const res = await getContext(doctorAuth, { chatLimit: 2 });
+
+    expect(res.status).toBe(200);
+    expect(res.headers['cache-control']).toBe('no-store');
+    expect(res.body.appointment).toMatchObject({ _id: appointment._id.toString(), status: 'confirmed' });
+    expect(res.body.appointment.capabilities).toBeDefined();
+    expect(res.body.chat).toMatchObject({ total: 3, page: 1, pages: 2 });
+    expect(res.body.chat.messages.map(message => message.content)).toEqual(['Hello doctor', 'Hello']);
+    expect(res.body.notes).toEqual({
+      patientVisibleNotes: 'Bring your test results',
+      privateNotes: 'Suspect migraine',
+      disposition: null
+    });
+    expect(res.body.intake).toBeNull();
+    expect(res.body.patient).toMatchObject({ id: patient._id.toString(), firstName: patient.firstName });
+    expect(res.body.patient.previousVisits).toEqual([expect.objectContaining({ disposition: 'follow-up-needed' })]);
+  });
+
+  it('presigns only clean attachments and logs each link', async () => {
+    const res = await getContext(doctorAuth);
+
+    const urls = Object.fromEntries(res.body.attachments.map(attachment => [attachment.fileName, attachment.url]));
+    expect(urls).toEqual({ 'results.pdf': 'https://bucket.example.com/signed', 'scan.pdf': null });
+    expect(res.body.attachments.every(attachment => attachment.key === undefined)).toBe(true);
+    expect(await DocumentAccessLog.countDocuments({ userId: doctorUser._id, action: 'download' })).toBe(1);
+  });
+
+  it('gives the patient the bundle without private notes', async () => {
+    const res = await getContext(patientAuth);
+
+    expect(res.status).toBe(200);
+    expect(res.body.notes).not.toHaveProperty('privateNotes');
+  });
+
+  it.each([
+    ['another patient', () => createUser()],
+    ['another doctor', async () => (await createDoctor()).user]
+  ])('denies %s the whole bundle', async (_case, createOutsider) => {
+    const res = await getContext(await authHeader(await createOutsider()));
+
+    expect(res.status).toBe(403);
+    expect(res.body).toEqual({ message: 'Forbidden' });
+    expect(s3Service.getDownloadUrl).not.toHaveBeenCalled();
+    expect(await DocumentAccessLog.countDocuments()).toBe(0);
+  });
+
+  it('rejects an invalid chat page size', async () => {
+    const res = await getContext(doctorAuth, { chatLimit: 500 });
+
+    expect(res.status).toBe(400);
+    expect(res.body.errors.chatLimit).toBe('chatLimit must be between 1 and 100');
+  });
+});
@@ -0,0 +1,61 @@
+const { formatCurrency } = require('../utils/currency');
+const helpers = require('../utils/helpers');
+const AppointmentService = require('../services/appointment.service');
+const config = require('../config/config');
+
+// Intl separates symbols with (narrow) non-breaking spaces
+const format = (...args) => formatCurrency(...args).replace(/\s/g, ' ');
+
+describe('formatCurrency', () => {
+  const locale = config.locale.defaultLocale;
+  const rescheduleFee = { ...config.appointments.rescheduleFee };
+
+  afterEach(() => {
+    config.locale.defaultLocale = locale;
+    Object.assign(config.appointments.rescheduleFee, rescheduleFee);
+  });
+
+  it.each([
+    [45, 'EUR', 'nl-NL', '€ 45,00'],
+    [1234.5, 'EUR', 'de-DE', '1.234,50 €'],
+    [1234.5, 'USD', 'en-US', '$1,234.50'],
+    [1234.5, 'GBP', 'en-GB', '£1,234.50'],
+    [4500, 'JPY', 'en-US', '¥4,500'],
+    [1.2345, 'KWD', 'en', 'KWD 1.235'],
+    [99.9, 'CHF', 'de-CH', 'CHF 99.90']
+  ])('formats %p %s in %s as %p', (amount, currency, localeCode, expected) => {
+    expect(format(amount, currency, localeCode)).toBe(expected);
+  });
+
+  it('uses the configured locale and EUR by default', () => {
+    config.locale.defaultLocale = 'en-IE';
+
+    expect(format(45)).toBe('€45.00');
+    expect(format(45, null)).toBe('€45.00');
+  });
+
+  it('accepts a lowercase currency code', () => {
+    expect(format(10, 'usd', 'en-US')).toBe('$10.00');
+  });
+
+  it.each([
+    ['a malformed currency code', 'EURO', 'nl-NL', '45.00 EURO'],
+    ['a malformed locale', 'EUR', 'not a locale', '45.00 EUR']
+  ])('falls back to the plain amount and code for %s', (_case, currency, localeCode, expected) => {
+    expect(format(45, currency, localeCode)).toBe(expected);
+  });
+
+  it('is what the older helpers export uses', () => {
+    expect(helpers.formatCurrency).toBe(formatCurrency);
+  });
+
+  it('formats the late reschedule fee in the appointment\'s currency', () => {
+    config.locale.defaultLocale = 'en-US';
+    config.appointments.rescheduleFee.amount = 15;
+    const appointment = { date: new Date(), startTime: '23:59', fee: 50 };
+
+    const fee = AppointmentService.getRescheduleFee(appointment, { actor: 'patient', currency: 'USD', now: new Date() });
+
+    expect(fee).toMatchObject({ amount: 15, currency: 'USD', formattedAmount: '$15.00' });
+  });
+});
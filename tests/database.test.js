@@ -0,0 +1,145 @@
+jest.mock('../services/aws.service');
+
+const mongoose = require('mongoose');
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const DatabaseService = require('../services/database.service');
+const ReferralService = require('../services/referral.service');
+const { createBookingToken } = require('../services/recommendation.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+afterEach(() => {
+  jest.restoreAllMocks();
+});
+
+describe('DatabaseService.withTransaction', () => {
+  const paymentFor = (appointment) => new Payment({
+    appointmentId: appointment._id,
+    patientId: appointment.patientId,
+    doctorId: appointment.doctorId,
+    amount: 50,
+    method: 'card'
+  });
+
+  const newAppointment = async () => {
+    const { doctor } = await createDoctor();
+    return new Appointment({
+      doctorId: doctor._id,
+      patientId: (await createUser())._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up'
+    });
+  };
+
+  it('commits all writes together', async () => {
+    const appointment = await newAppointment();
+
+    await DatabaseService.withTransaction(async (session) => {
+      await appointment.save({ session });
+      await paymentFor(appointment).save({ session });
+    });
+
+    expect(await Appointment.countDocuments()).toBe(1);
+    expect(await Payment.countDocuments()).toBe(1);
+  });
+
+  it('rolls back every write when one fails', async () => {
+    const appointment = await newAppointment();
+
+    await expect(DatabaseService.withTransaction(async (session) => {
+      await appointment.save({ session });
+      await paymentFor(appointment).save({ session });
+      throw new Error('Payment provider unavailable');
+    })).rejects.toThrow('Payment provider unavailable');
+
+    expect(await Appointment.countDocuments()).toBe(0);
+    expect(await Payment.countDocuments()).toBe(0);
+  });
+
+  it('reruns fn after a transient transaction error', async () => {
+    let attempts = 0;
+
+    const result = await DatabaseService.withTransaction(async (session) => {
+      attempts += 1;
+      await paymentFor(await newAppointment()).save({ session });
+      if (attempts === 1) {
+        const error = new mongoose.mongo.MongoServerError({ message: 'Write conflict' });
+        error.addErrorLabel('TransientTransactionError');
+        throw error;
+      }
+      return 'done';
+    });
+
+    expect(result).toBe('done');
+    expect(attempts).toBe(2);
+    expect(await Payment.countDocuments()).toBe(1);
+  });
+});
+
+describe('booking with a referral', () => {
+  const date = daysFromToday(2);
+  const referralId = new mongoose.Types.ObjectId().toString();
+  let doctor;
+  let patientAuth;
+
+  // The referral can be booked, but marking it booked fails
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    patientAuth = await authHeader(await createUser());
+    jest.spyOn(ReferralService, 'findOpenReferral').mockResolvedValue({});
+    jest.spyOn(ReferralService, 'markReferralBooked').mockRejectedValue(new Error('Referral update failed'));
+  });
+
+  it('saves no appointment when marking the referral fails', async () => {
+    const res = await request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', patientAuth)
+      .send({
+        doctorId: doctor._id.toString(),
+        date,
+        timeSlot: '10:00-10:30',
+        type: 'video',
+        reason: 'Check-up',
+        referralId
+      });
+
+    expect(res.status).toBe(500);
+    expect(await Appointment.countDocuments()).toBe(0);
+  });
+
+  it('saves no appointment from a recommendation when marking the referral fails', async () => {
+    const bookingToken = createBookingToken(doctor._id, { date, startTime: '10:00', endTime: '10:30' }, []);
+
+    const res = await request(app)
+      .post('/api/v1/appointments/from-recommendation')
+      .set('Authorization', patientAuth)
+      .send({ bookingToken, type: 'video', reason: 'Check-up', referralId });
+
+    expect(res.status).toBe(500);
+    expect(await Appointment.countDocuments()).toBe(0);
+  });
+
+  it('keeps the draft when marking the referral fails', async () => {
+    const draft = await request(app)
+      .post('/api/v1/appointments/drafts')
+      .set('Authorization', patientAuth)
+      .send({ doctorId: doctor._id.toString(), date, timeSlot: '10:00-10:30', type: 'video' })
+      .expect(201);
+
+    const res = await request(app)
+      .post(`/api/v1/appointments/drafts/${draft.body.id}/finalize`)
+      .set('Authorization', patientAuth)
+      .send({ reason: 'Check-up', referralId });
+
+    expect(res.status).toBe(500);
+    expect(await Appointment.countDocuments({ status: { $ne: 'draft' } })).toBe(0);
+    expect(await Appointment.countDocuments({ _id: draft.body.id, status: 'draft' })).toBe(1);
+  });
+});
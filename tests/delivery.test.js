@@ -0,0 +1,183 @@
+// Sends go through the real AWSService with the SES client stubbed
+process.env.AWS_ACCESS_KEY_ID = 'test-access-key';
+process.env.AWS_SECRET_ACCESS_KEY = 'test-secret-key';
+process.env.AWS_BUCKET = 'test-bucket';
+
+const { SESClient } = require('@aws-sdk/client-ses');
+const {
+  SQSClient,
+  ReceiveMessageCommand,
+  SendMessageCommand,
+  DeleteMessageCommand,
+  ChangeMessageVisibilityCommand
+} = require('@aws-sdk/client-sqs');
+const AWSService = require('../services/aws.service');
+const DeliveryService = require('../services/delivery.service');
+const sqsService = require('../services/aws/sqs.service');
+const { handleMessage } = require('../services/notification.worker');
+const Notification = require('../models/notification.model');
+const QueueJob = require('../models/queue.job.model');
+const Suppression = require('../models/suppression.model');
+const { useDatabase, createUser } = require('./helpers');
+
+useDatabase();
+
+// An SES bounce event as the feedback queue receives it, wrapped by SNS
+const bounceEvent = (messageId, address, bounceType = 'Permanent') => JSON.stringify({
+  Type: 'Notification',
+  Message: JSON.stringify({
+    eventType: 'Bounce',
+    mail: { messageId },
+    bounce: {
+      bounceType,
+      bounceSubType: bounceType === 'Permanent' ? 'General' : 'MailboxFull',
+      bouncedRecipients: [{ emailAddress: address, diagnosticCode: 'smtp; 550 5.1.1 user unknown' }]
+    }
+  })
+});
+
+describe('email delivery feedback', () => {
+  let sesSend;
+  let user;
+  let notification;
+
+  beforeEach(async () => {
+    sesSend = jest.spyOn(SESClient.prototype, 'send').mockResolvedValue({ MessageId: 'ses-message-1' });
+    user = await createUser({ email: 'Patient@Example.com' });
+    const messageId = await AWSService.sendEmail(user.email, 'Appointment confirmed', '<p>See you</p>', 'See you');
+    notification = await Notification.create({
+      userId: user._id,
+      title: 'Appointment confirmed',
+      message: 'See you',
+      type: 'email',
+      status: 'sent',
+      delivery: { messageId, status: 'sent', updatedAt: new Date() }
+    });
+  });
+
+  afterEach(() => {
+    sesSend.mockRestore();
+  });
+
+  it('suppresses a hard-bounced address on subsequent sends', async () => {
+    await DeliveryService.handleFeedback(bounceEvent('ses-message-1', 'patient@example.com'));
+
+    const messageId = await AWSService.sendEmail(user.email, 'Reminder', '<p>Tomorrow</p>', 'Tomorrow');
+
+    expect(messageId).toBeNull();
+    expect(sesSend).toHaveBeenCalledTimes(1);
+    const suppression = await Suppression.findOne({ channel: 'email' });
+    expect(suppression.toObject()).toMatchObject({ address: 'patient@example.com', reason: 'bounce' });
+  });
+
+  it('marks the notification bounced', async () => {
+    await DeliveryService.handleFeedback(bounceEvent('ses-message-1', 'patient@example.com'));
+
+    const bounced = await Notification.findById(notification._id);
+    expect(bounced.status).toBe('failed');
+    expect(bounced.delivery.status).toBe('bounced');
+    expect(bounced.delivery.detail).toBe('Permanent/General');
+  });
+
+  it('keeps sending after a transient bounce', async () => {
+    await DeliveryService.handleFeedback(bounceEvent('ses-message-1', 'patient@example.com', 'Transient'));
+
+    const messageId = await AWSService.sendEmail(user.email, 'Reminder', '<p>Tomorrow</p>', 'Tomorrow');
+
+    expect(messageId).toBe('ses-message-1');
+    expect(sesSend).toHaveBeenCalledTimes(2);
+    expect(await Suppression.countDocuments()).toBe(0);
+  });
+
+  it('records a delivery without suppressing', async () => {
+    await DeliveryService.handleFeedback({ eventType: 'Delivery', mail: { messageId: 'ses-message-1' } });
+
+    const delivered = await Notification.findById(notification._id);
+    expect(delivered.status).toBe('delivered');
+    expect(delivered.delivery.status).toBe('delivered');
+    expect(await DeliveryService.isSuppressed('email', user.email)).toBe(false);
+  });
+});
+
+describe('notification queue worker', () => {
+  const QUEUE_URL = 'https://sqs.test/notifications';
+  const DLQ_URL = 'https://sqs.test/notifications-dlq';
+  let sqsSend;
+  let sent;
+  let body;
+  let receiveCount;
+
+  beforeEach(() => {
+    sqsService.queueUrl = QUEUE_URL;
+    sqsService.deadLetterQueueUrl = DLQ_URL;
+    sent = [];
+    receiveCount = 0;
+    // The queue holds one message, received again after every failure
+    sqsSend = jest.spyOn(SQSClient.prototype, 'send').mockImplementation(async (command) => {
+      if (command instanceof ReceiveMessageCommand) {
+        receiveCount += 1;
+        return {
+          Messages: [{
+            MessageId: 'message-1',
+            ReceiptHandle: `receipt-${receiveCount}`,
+            Body: body,
+            Attributes: { ApproximateReceiveCount: String(receiveCount) }
+          }]
+        };
+      }
+      sent.push(command);
+      return {};
+    });
+  });
+
+  afterEach(() => {
+    sqsSend.mockRestore();
+  });
+
+  const sentOf = (Command) => sent.filter(command => command instanceof Command).map(command => command.input);
+
+  it('stores the notification and deletes the message once, even when delivered twice', async () => {
+    const user = await createUser();
+    body = JSON.stringify({
+      jobId: 'job-1',
+      type: 'STORE_NOTIFICATION',
+      userId: user._id.toString(),
+      notification: { title: 'Appointment booked', message: 'See you soon' }
+    });
+
+    await sqsService.processMessages(handleMessage);
+    await sqsService.processMessages(handleMessage);
+
+    expect(await Notification.countDocuments({ userId: user._id, jobId: 'job-1' })).toBe(1);
+    expect(sentOf(DeleteMessageCommand)).toEqual([
+      { QueueUrl: QUEUE_URL, ReceiptHandle: 'receipt-1' },
+      { QueueUrl: QUEUE_URL, ReceiptHandle: 'receipt-2' }
+    ]);
+    const job = await QueueJob.findOne({ jobId: 'job-1' });
+    expect(job.status).toBe('succeeded');
+    expect(job.attempts).toHaveLength(1);
+  });
+
+  it('retries a failing job with backoff, then moves it to the dead-letter queue', async () => {
+    body = JSON.stringify({ jobId: 'job-2', type: 'NO_SUCH_JOB' });
+
+    for (let i = 1; i < sqsService.maxReceiveCount; i++) {
+      await sqsService.processMessages(handleMessage);
+      expect((await QueueJob.findOne({ jobId: 'job-2' })).status).toBe('failed');
+    }
+    expect(sentOf(ChangeMessageVisibilityCommand).map(input => input.VisibilityTimeout))
+      .toEqual(Array.from({ length: sqsService.maxReceiveCount - 1 }, (_, i) => sqsService.getRetryDelay(i + 1)));
+    expect(sentOf(SendMessageCommand)).toHaveLength(0);
+
+    await sqsService.processMessages(handleMessage);
+
+    expect(sentOf(SendMessageCommand)).toEqual([{ QueueUrl: DLQ_URL, MessageBody: body, DelaySeconds: 0 }]);
+    expect(sentOf(DeleteMessageCommand)).toEqual([
+      { QueueUrl: QUEUE_URL, ReceiptHandle: `receipt-${sqsService.maxReceiveCount}` }
+    ]);
+    const job = await QueueJob.findOne({ jobId: 'job-2' });
+    expect(job.status).toBe('dead');
+    expect(job.attempts).toHaveLength(sqsService.maxReceiveCount);
+    expect(job.attempts[0].error).toBe('No handler for job type NO_SUCH_JOB');
+  });
+});
@@ -0,0 +1,289 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const config = require('../config/config');
+const { sanitizeRichText } = require('../utils/sanitize');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('sanitizeRichText', () => {
+  it('removes scripts along with their content', () => {
+    expect(sanitizeRichText('<p>Hello</p><script>alert(1)</script>')).toBe('<p>Hello</p>');
+  });
+
+  it('keeps allowed tags without their attributes', () => {
+    expect(sanitizeRichText('<p onclick="steal()">Hi <strong class="x">there</strong></p>'))
+      .toBe('<p>Hi <strong>there</strong></p>');
+  });
+
+  it('drops disallowed tags but keeps their text', () => {
+    expect(sanitizeRichText('<div><img src=x onerror=alert(1)>Text</div>')).toBe('Text');
+  });
+
+  it('keeps http links and drops javascript ones', () => {
+    expect(sanitizeRichText('<a href="https://example.com">site</a>'))
+      .toBe('<a href="https://example.com" rel="nofollow noopener noreferrer" target="_blank">site</a>');
+    expect(sanitizeRichText('<a href="javascript:alert(1)">x</a>')).toBe('<a>x</a>');
+  });
+
+  it('escapes stray angle brackets', () => {
+    expect(sanitizeRichText('1 < 2 > 0')).toBe('1 &lt; 2 &gt; 0');
+  });
+});
+
+describe('POST /api/v1/doctors/profile', () => {
+  let doctor;
+  let auth;
+
+  beforeEach(async () => {
+    // A profile still in review, so the update is stored directly
+    const created = await createDoctor({ status: 'pending' });
+    doctor = created.doctor;
+    auth = await authHeader(created.user);
+  });
+
+  const updateProfile = (fields) => request(app)
+    .post('/api/v1/doctors/profile')
+    .set('Authorization', auth)
+    .send({
+      specializations: ['general-practice'],
+      experience: 5,
+      consultationFee: 50,
+      education: [{ degree: 'MD', institution: 'University of Amsterdam', year: 2010 }],
+      clinicLocation: { address: 'Damrak 1', city: 'Amsterdam', postalCode: '1012LG' },
+      ...fields
+    });
+
+  it('removes a script from the bio before storing it', async () => {
+    const res = await updateProfile({ about: '<p>Experienced GP</p><script>alert(document.cookie)</script>' });
+
+    expect(res.status).toBe(200);
+    expect(res.body.doctor.about).toBe('<p>Experienced GP</p>');
+    expect((await Doctor.findById(doctor._id)).about).toBe('<p>Experienced GP</p>');
+  });
+
+  it('sanitizes service descriptions', async () => {
+    const res = await updateProfile({
+      about: 'Experienced GP',
+      services: [{ name: 'Check-up', price: 50, description: 'Yearly <script>x()</script>check-up' }]
+    });
+
+    expect(res.status).toBe(200);
+    const stored = await Doctor.findById(doctor._id);
+    expect(stored.services[0].description).toBe('Yearly check-up');
+  });
+
+  it('rejects a bio that is only markup', async () => {
+    const res = await updateProfile({ about: '<script>alert(1)</script>' });
+
+    expect(res.status).toBe(400);
+    expect((await Doctor.findById(doctor._id)).about).toBe('General practitioner');
+  });
+
+  it('rejects an overly long bio', async () => {
+    const res = await updateProfile({ about: 'a'.repeat(5001) });
+
+    expect(res.status).toBe(400);
+  });
+
+  it('stores the clinic\'s room count', async () => {
+    const res = await updateProfile({
+      about: 'Experienced GP',
+      clinicLocation: { address: 'Damrak 1', city: 'Amsterdam', postalCode: '1012LG', rooms: 2 }
+    });
+
+    expect(res.status).toBe(200);
+    expect((await Doctor.findById(doctor._id)).clinicLocation.rooms).toBe(2);
+  });
+
+  it.each([0, 1.5, '2'])('rejects %p clinic rooms', async (rooms) => {
+    const res = await updateProfile({
+      about: 'Experienced GP',
+      clinicLocation: { address: 'Damrak 1', city: 'Amsterdam', postalCode: '1012LG', rooms }
+    });
+
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe('Clinic rooms must be a whole number of at least 1');
+  });
+
+  it('stores peak pricing rules', async () => {
+    const rule = { days: ['saturday', 'sunday'], startTime: '09:00', endTime: '17:00', multiplier: 1.5, label: 'Weekend rate' };
+
+    const res = await updateProfile({ about: 'Experienced GP', pricingRules: [rule] });
+
+    expect(res.status).toBe(200);
+    expect((await Doctor.findById(doctor._id)).toObject().pricingRules).toEqual([rule]);
+  });
+
+  it.each([
+    [{ days: ['caturday'], startTime: '09:00', endTime: '17:00', multiplier: 1.5 }, 'Each pricing rule needs days from: sunday, monday, tuesday, wednesday, thursday, friday, saturday'],
+    [{ days: ['saturday'], startTime: '17:00', endTime: '09:00', multiplier: 1.5 }, 'Each pricing rule needs a startTime before its endTime (HH:MM)'],
+    [{ days: ['saturday'], startTime: '09:00', endTime: '17:00', multiplier: 10 }, 'Pricing rule multipliers must be between 0.5 and 5']
+  ])('rejects the pricing rule %o', async (rule, error) => {
+    const res = await updateProfile({ about: 'Experienced GP', pricingRules: [rule] });
+
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe(error);
+  });
+});
+
+describe('profile changes by an approved doctor', () => {
+  let doctor;
+  let auth;
+  let adminAuth;
+
+  beforeEach(async () => {
+    const created = await createDoctor();
+    doctor = created.doctor;
+    auth = await authHeader(created.user);
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+  });
+
+  const updateProfile = (fields) => request(app)
+    .post('/api/v1/doctors/profile')
+    .set('Authorization', auth)
+    .send({
+      specializations: ['general-practice'],
+      experience: 5,
+      consultationFee: 50,
+      about: 'General practitioner',
+      clinicLocation: { address: 'Damrak 1', city: 'Amsterdam', postalCode: '1012LG' },
+      ...fields
+    });
+
+  const review = (status) => request(app)
+    .put(`/api/v1/admin/doctors/${doctor._id}/profile-changes`)
+    .set('Authorization', adminAuth)
+    .send({ status, reason: 'Checked the certificate' });
+
+  it('applies bio and fee changes at once and keeps the profile live', async () => {
+    const res = await updateProfile({ about: 'GP with a focus on sports injuries', consultationFee: 65 });
+
+    expect(res.status).toBe(200);
+    const stored = await Doctor.findById(doctor._id).lean();
+    expect(stored).toMatchObject({ about: 'GP with a focus on sports injuries', consultationFee: 65, status: 'active' });
+    expect(stored.pendingProfileChanges).toBeUndefined();
+  });
+
+  it('holds a specialization change for review while applying the rest', async () => {
+    const res = await updateProfile({ specializations: ['cardiology'], consultationFee: 65 });
+
+    expect(res.status).toBe(200);
+    expect(res.body.message).toMatch(/specializations are waiting for admin approval/);
+    const stored = await Doctor.findById(doctor._id).lean();
+    expect(stored).toMatchObject({ specializations: ['general-practice'], consultationFee: 65, status: 'active' });
+    expect(stored.pendingProfileChanges.changes).toEqual({ specializations: ['cardiology'] });
+
+    const listed = await request(app)
+      .get('/api/v1/admin/doctors/profile-changes')
+      .set('Authorization', adminAuth);
+    expect(listed.body.data.map(entry => entry._id)).toEqual([doctor._id.toString()]);
+  });
+
+  it('applies the held change once an admin approves it', async () => {
+    await updateProfile({ specializations: ['cardiology'] }).expect(200);
+
+    const res = await review('approved');
+
+    expect(res.status).toBe(200);
+    const stored = await Doctor.findById(doctor._id).lean();
+    expect(stored.specializations).toEqual(['cardiology']);
+    expect(stored.pendingProfileChanges).toBeUndefined();
+    expect(stored.profileChangeReview).toMatchObject({ status: 'approved', fields: ['specializations'] });
+  });
+
+  it('drops the held change when an admin rejects it', async () => {
+    await updateProfile({ specializations: ['cardiology'] }).expect(200);
+
+    await review('rejected').expect(200);
+
+    const stored = await Doctor.findById(doctor._id).lean();
+    expect(stored.specializations).toEqual(['general-practice']);
+    expect(stored.pendingProfileChanges).toBeUndefined();
+    expect(stored.profileChangeReview.status).toBe('rejected');
+  });
+
+  it('has nothing to review when only unreviewed fields changed', async () => {
+    await updateProfile({ consultationFee: 65 }).expect(200);
+
+    expect((await review('approved')).status).toBe(409);
+  });
+});
+
+describe('calendar feed', () => {
+  let doctor;
+  let feedUrl;
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    const res = await request(app)
+      .post('/api/v1/doctors/me/calendar-token')
+      .set('Authorization', await authHeader(user));
+    feedUrl = new URL(res.body.url);
+  });
+
+  afterEach(() => {
+    jest.restoreAllMocks();
+  });
+
+  const book = async (startTime, endTime) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: (await createUser())._id,
+    date: daysFromToday(2),
+    startTime,
+    endTime,
+    type: 'video',
+    reason: 'Check-up',
+    status: 'confirmed'
+  });
+
+  const getFeed = (etag) => {
+    const req = request(app).get(feedUrl.pathname).query({ token: feedUrl.searchParams.get('token') });
+    return etag ? req.set('If-None-Match', etag) : req;
+  };
+
+  it('hands out a feed URL under the mounted API prefix', () => {
+    expect(feedUrl.pathname).toBe(`${config.apiPrefix}/doctors/me/calendar.ics`);
+  });
+
+  it('serves the upcoming appointments as ICS', async () => {
+    await book('10:00', '10:30');
+
+    const res = await getFeed();
+
+    expect(res.status).toBe(200);
+    expect(res.headers['content-type']).toMatch(/text\/calendar/);
+    expect(res.headers.etag).toEqual(expect.any(String));
+    expect(res.text).toMatch(/BEGIN:VEVENT/);
+  });
+
+  it('answers an unchanged feed with 304 without loading its appointments', async () => {
+    await book('10:00', '10:30');
+    const { headers } = await getFeed();
+    const find = jest.spyOn(Appointment, 'find');
+
+    const res = await getFeed(headers.etag);
+
+    expect(res.status).toBe(304);
+    expect(find).not.toHaveBeenCalled();
+  });
+
+  it('changes the ETag when an appointment is added or updated', async () => {
+    const appointment = await book('10:00', '10:30');
+    const first = (await getFeed()).headers.etag;
+
+    await Appointment.updateOne({ _id: appointment._id }, { $set: { status: 'pending' } });
+    const updated = await getFeed(first);
+    await book('11:00', '11:30');
+    const added = await getFeed(updated.headers.etag);
+
+    expect(updated.status).toBe(200);
+    expect(added.status).toBe(200);
+    expect(added.headers.etag).not.toBe(updated.headers.etag);
+  });
+});
@@ -0,0 +1,129 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const DoctorView = require('../models/doctor.view.model');
+const DoctorViewService = require('../services/doctor.view.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('doctor profile views', () => {
+  let doctor;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    doctorAuth = await authHeader(user);
+  });
+
+  const viewProfile = (authorization) => {
+    const req = request(app).get('/api/v1/doctors/getById').query({ id: doctor._id.toString() });
+    return authorization ? req.set('Authorization', authorization) : req;
+  };
+
+  // Views are recorded without holding up the profile response
+  const waitForViews = async (count) => {
+    for (let attempt = 0; attempt < 50; attempt++) {
+      if (await DoctorView.countDocuments({ doctorId: doctor._id }) >= count) return;
+      await new Promise(resolve => setTimeout(resolve, 20));
+    }
+  };
+
+  const settle = () => new Promise(resolve => setTimeout(resolve, 100));
+
+  describe('recording', () => {
+    it('records a view and dedupes it within the day', async () => {
+      const patientAuth = await authHeader(await createUser());
+
+      await viewProfile(patientAuth).expect(200);
+      await waitForViews(1);
+      await viewProfile(patientAuth).expect(200);
+      await settle();
+
+      const views = await DoctorView.find({ doctorId: doctor._id });
+      expect(views).toHaveLength(1);
+      expect(views[0].day).toBe(daysFromToday(0));
+    });
+
+    it('counts each viewer once', async () => {
+      await viewProfile(await authHeader(await createUser())).expect(200);
+      await viewProfile(await authHeader(await createUser())).expect(200);
+      await viewProfile().expect(200);
+      await waitForViews(3);
+
+      expect(await DoctorView.countDocuments({ doctorId: doctor._id })).toBe(3);
+    });
+
+    it('does not count the doctor viewing their own profile', async () => {
+      await viewProfile(doctorAuth).expect(200);
+      await settle();
+
+      expect(await DoctorView.countDocuments()).toBe(0);
+    });
+
+    it('counts the same viewer again on another day', async () => {
+      const viewerKey = 'user:viewer';
+
+      expect(await DoctorViewService.recordView(doctor._id, viewerKey, new Date('2026-03-10T08:00:00Z'))).toBe(true);
+      expect(await DoctorViewService.recordView(doctor._id, viewerKey, new Date('2026-03-10T20:00:00Z'))).toBe(false);
+      expect(await DoctorViewService.recordView(doctor._id, viewerKey, new Date('2026-03-11T08:00:00Z'))).toBe(true);
+    });
+  });
+
+  describe('GET /api/v1/doctors/me/view-stats', () => {
+    const getStats = (query = {}, authorization = doctorAuth) => request(app)
+      .get('/api/v1/doctors/me/view-stats')
+      .set('Authorization', authorization)
+      .query(query);
+
+    it('returns daily views and the view-to-booking conversion rate', async () => {
+      const today = daysFromToday(0);
+      const yesterday = daysFromToday(-1);
+      await DoctorView.create([
+        { doctorId: doctor._id, day: today, viewerKey: 'user:a' },
+        { doctorId: doctor._id, day: today, viewerKey: 'user:b' },
+        { doctorId: doctor._id, day: yesterday, viewerKey: 'user:a' },
+        { doctorId: doctor._id, day: daysFromToday(-10), viewerKey: 'user:c' }
+      ]);
+      const patient = await createUser();
+      await Appointment.create({
+        doctorId: doctor._id,
+        patientId: patient._id,
+        date: daysFromToday(2),
+        startTime: '10:00',
+        endTime: '10:30',
+        type: 'video',
+        reason: 'Check-up'
+      });
+
+      const res = await getStats({ days: 7 });
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ from: daysFromToday(-6), to: today, views: 3, bookings: 1, conversionRate: 0.3333 });
+      expect(res.body.daily).toHaveLength(7);
+      expect(res.body.daily.slice(-2)).toEqual([{ day: yesterday, views: 1 }, { day: today, views: 2 }]);
+    });
+
+    it('reports no conversion rate before the first view', async () => {
+      const res = await getStats();
+
+      expect(res.body).toMatchObject({ views: 0, conversionRate: null });
+      expect(res.body.daily).toHaveLength(30);
+    });
+
+    it('rejects a period over the maximum', async () => {
+      const res = await getStats({ days: 366 });
+
+      expect(res.status).toBe(400);
+    });
+
+    it('is for doctors only', async () => {
+      const res = await getStats({}, await authHeader(await createUser()));
+
+      expect(res.status).toBe(403);
+    });
+  });
+});
@@ -0,0 +1,6 @@
+// Environment for the test suite, set before any module reads its config
+process.env.NODE_ENV = 'test';
+process.env.TZ = 'UTC';
+process.env.LOG_LEVEL = process.env.LOG_LEVEL || 'error';
+process.env.JWT_SECRET = 'test-jwt-secret';
+process.env.PAYMENT_WEBHOOK_SECRET = 'test-webhook-secret';
@@ -0,0 +1,115 @@
+const mongoose = require('mongoose');
+const { MongoMemoryReplSet } = require('mongodb-memory-server');
+const User = require('../models/user.model');
+const Doctor = require('../models/doctor.model');
+const Session = require('../models/session.model');
+const DatabaseService = require('../services/database.service');
+const { generateToken } = require('../utils/helpers');
+
+const WEEKDAYS = ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday'];
+
+let replSet;
+let sequence = 0;
+
+/**
+ * Run the test file against a fresh in-memory MongoDB. A single-node replica
+ * set, so bookings and payments can use transactions. Collections are emptied
+ * after every test.
+ */
+const useDatabase = () => {
+  beforeAll(async () => {
+    replSet = await MongoMemoryReplSet.create({ replSet: { count: 1, storageEngine: 'wiredTiger' } });
+    await mongoose.connect(replSet.getUri());
+    await DatabaseService.detectTransactionSupport();
+    // Create collections and indexes up front; transactions can't build them
+    await Promise.all(Object.values(mongoose.models).map(model => model.init()));
+  });
+
+  afterEach(async () => {
+    const collections = await mongoose.connection.db.collections();
+    await Promise.all(collections.map(collection => collection.deleteMany({})));
+  });
+
+  afterAll(async () => {
+    await mongoose.disconnect();
+    await replSet.stop();
+  });
+};
+
+const nextId = () => {
+  sequence += 1;
+  return sequence;
+};
+
+/**
+ * A verified, active user
+ * @param {Object} overrides - Fields to set
+ * @returns {Promise<Object>}
+ */
+const createUser = (overrides = {}) => {
+  const n = nextId();
+  return User.create({
+    email: `user${n}@example.com`,
+    phone: { countryCode: '+31', number: String(612000000 + n) },
+    firstName: 'Test',
+    lastName: `User${n}`,
+    role: 'patient',
+    isEmailVerified: true,
+    isPhoneVerified: true,
+    ...overrides
+  });
+};
+
+/**
+ * An approved doctor available 09:00-17:00 every day, with their user
+ * @param {Object} overrides - Doctor fields to set
+ * @returns {Promise<Object>} - { user, doctor }
+ */
+const createDoctor = async (overrides = {}) => {
+  const user = await createUser({ role: 'doctor' });
+  const doctor = await Doctor.create({
+    userId: user._id,
+    registrationNumber: String(100000000 + nextId()),
+    verificationStatus: 'verified',
+    status: 'active',
+    specializations: ['general-practice'],
+    experience: 5,
+    consultationFee: 50,
+    about: 'General practitioner',
+    clinicLocation: { address: 'Damrak 1', city: 'Amsterdam', postalCode: '1012LG' },
+    availability: WEEKDAYS.map(day => ({ day, slots: [{ startTime: '09:00', endTime: '17:00' }] })),
+    ...overrides
+  });
+  return { user, doctor };
+};
+
+/**
+ * Authorization header for a user, with an active session behind it
+ * @param {Object} user - The user
+ * @returns {Promise<string>}
+ */
+const authHeader = async (user) => {
+  const { token, tokenId } = generateToken(user);
+  await Session.create({ userId: user._id, tokenId });
+  return `Bearer ${token}`;
+};
+
+/**
+ * A date days from today, as the YYYY-MM-DD the booking API takes
+ * @param {number} days - Days ahead
+ * @returns {string}
+ */
+const daysFromToday = (days) => {
+  const date = new Date();
+  date.setUTCHours(0, 0, 0, 0);
+  date.setUTCDate(date.getUTCDate() + days);
+  return date.toISOString().slice(0, 10);
+};
+
+module.exports = {
+  useDatabase,
+  createUser,
+  createDoctor,
+  authHeader,
+  daysFromToday
+};
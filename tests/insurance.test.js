@@ -0,0 +1,228 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const User = require('../models/user.model');
+const { CLAIM_COLUMNS } = require('../services/insurance.service');
+const { toCsvRow } = require('../utils/csv');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('patient insurance', () => {
+  const insurance = { insurer: 'Zilveren Kruis', policyNumber: 'ZK-12345678' };
+  let patient;
+  let patientAuth;
+  let doctor;
+  let doctorUser;
+
+  beforeEach(async () => {
+    ({ user: doctorUser, doctor } = await createDoctor({ specializations: ['Dermatologist'] }));
+    patient = await createUser({ dob: new Date('1985-04-12') });
+    patientAuth = await authHeader(patient);
+  });
+
+  const updateProfile = (body, authorization = patientAuth) => request(app)
+    .put('/api/v1/users/profile')
+    .set('Authorization', authorization)
+    .send(body);
+
+  // A completed appointment, paid unless payment is false
+  const visit = async (days, fields = {}, payment = {}) => {
+    const appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(days),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50,
+      status: 'completed',
+      ...fields
+    });
+    if (payment) {
+      await Payment.create({
+        appointmentId: appointment._id,
+        patientId: patient._id,
+        doctorId: doctor._id,
+        amount: 50,
+        status: 'success',
+        method: 'iDEAL',
+        transactionId: `tr_${appointment._id}`,
+        paidAt: new Date(),
+        ...payment
+      });
+    }
+    return appointment;
+  };
+
+  describe('on the profile', () => {
+    it('stores the insurer in its configured spelling and the policy number in capitals', async () => {
+      const res = await updateProfile({ insurance: { insurer: 'zilveren kruis', policyNumber: ' zk-12345678 ' } });
+
+      expect(res.status).toBe(200);
+      expect(res.body.user.insurance).toMatchObject(insurance);
+
+      const profile = await request(app).get('/api/v1/users/profile').set('Authorization', patientAuth);
+      expect(profile.body.insurance).toMatchObject(insurance);
+    });
+
+    it.each([
+      ['an unknown insurer', { insurer: 'Acme Health', policyNumber: 'ZK-12345678' }, 'insurance.insurer'],
+      ['a missing insurer', { policyNumber: 'ZK-12345678' }, 'insurance.insurer'],
+      ['a short policy number', { insurer: 'VGZ', policyNumber: '123' }, 'insurance.policyNumber'],
+      ['a policy number with spaces', { insurer: 'VGZ', policyNumber: '12 345 678' }, 'insurance.policyNumber']
+    ])('rejects %s', async (_case, details, field) => {
+      const res = await updateProfile({ insurance: details });
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors).toHaveProperty([field]);
+      expect((await User.findById(patient._id).select('+insurance')).insurance).toBeUndefined();
+    });
+
+    it('removes the details when set to null', async () => {
+      await updateProfile({ insurance }).expect(200);
+
+      const res = await updateProfile({ insurance: null });
+
+      expect(res.status).toBe(200);
+      expect(res.body.user.insurance).toBeUndefined();
+    });
+
+    it('is not returned by default user queries', async () => {
+      await updateProfile({ insurance }).expect(200);
+
+      expect((await User.findById(patient._id)).insurance).toBeUndefined();
+    });
+  });
+
+  describe('on the invoice', () => {
+    let paymentId;
+
+    beforeEach(async () => {
+      await updateProfile({ insurance }).expect(200);
+      const appointment = await visit(-3);
+      paymentId = (await Payment.findOne({ appointmentId: appointment._id }))._id;
+    });
+
+    const getPayment = (authorization) => request(app)
+      .get(`/api/v1/payments/${paymentId}`)
+      .set('Authorization', authorization);
+
+    it('is shown to the patient', async () => {
+      const res = await getPayment(patientAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.insurance).toMatchObject(insurance);
+    });
+
+    it('is shown to admins', async () => {
+      const res = await getPayment(await authHeader(await createUser({ role: 'admin' })));
+
+      expect(res.body.insurance).toMatchObject(insurance);
+    });
+
+    it('is never shown to the doctor', async () => {
+      const res = await getPayment(await authHeader(doctorUser));
+
+      expect(res.status).toBe(200);
+      expect(res.body).not.toHaveProperty('insurance');
+    });
+  });
+
+  describe('GET /api/v1/users/me/claims', () => {
+    const period = { from: daysFromToday(-30), to: daysFromToday(0) };
+
+    const getClaims = (query = {}, authorization = patientAuth) => request(app)
+      .get('/api/v1/users/me/claims')
+      .set('Authorization', authorization)
+      .query({ ...period, ...query });
+
+    beforeEach(async () => {
+      await updateProfile({ insurance }).expect(200);
+    });
+
+    it('lists completed, paid appointments in the period formatted for the insurer', async () => {
+      const claimed = await visit(-10, { confirmationCode: 'MC-ABC123' });
+      await visit(-5, {}, false);
+      await visit(-4, { status: 'confirmed' });
+      await visit(-60);
+      await Appointment.create({
+        doctorId: doctor._id,
+        patientId: (await createUser())._id,
+        date: daysFromToday(-8),
+        startTime: '11:00',
+        endTime: '11:30',
+        type: 'video',
+        reason: 'Check-up',
+        status: 'completed'
+      });
+
+      const res = await getClaims();
+
+      expect(res.status).toBe(200);
+      expect(res.body.insurance).toMatchObject(insurance);
+      expect(res.body.columns).toEqual(CLAIM_COLUMNS);
+      expect(res.body.claims).toEqual([{
+        appointmentId: claimed._id.toString(),
+        confirmationCode: 'MC-ABC123',
+        treatmentDate: daysFromToday(-10),
+        startTime: '10:00',
+        appointmentType: 'video',
+        consultationType: null,
+        patientName: `${patient.firstName} ${patient.lastName}`,
+        patientDob: '1985-04-12',
+        insurer: 'Zilveren Kruis',
+        policyNumber: 'ZK-12345678',
+        doctorName: `${doctorUser.firstName} ${doctorUser.lastName}`,
+        doctorRegistrationNumber: doctor.registrationNumber,
+        specialty: 'Dermatologist',
+        amount: 50,
+        currency: 'EUR',
+        paidAt: expect.any(String),
+        paymentReference: `tr_${claimed._id}`
+      }]);
+    });
+
+    it('claims a dependent\'s visit under their own name and the amount net of refunds', async () => {
+      await visit(-10, {
+        patientDetails: { name: 'Sam Jansen', dob: new Date('2015-09-01'), relationship: 'child' }
+      }, { refundedAmount: 12.5 });
+
+      const res = await getClaims();
+
+      expect(res.body.claims[0]).toMatchObject({ patientName: 'Sam Jansen', patientDob: '2015-09-01', amount: 37.5 });
+    });
+
+    it('exports the claims as CSV', async () => {
+      const claimed = await visit(-10);
+
+      const res = await getClaims({ format: 'csv' });
+
+      expect(res.status).toBe(200);
+      expect(res.headers['content-type']).toMatch(/^text\/csv/);
+      expect(res.headers['content-disposition']).toBe(`attachment; filename="claims_${period.from}_${period.to}.csv"`);
+      const [header, row, end] = res.text.split('\r\n');
+      expect(`${header}\r\n`).toBe(toCsvRow(CLAIM_COLUMNS));
+      expect(row.startsWith(`${claimed._id},${claimed.confirmationCode},${daysFromToday(-10)},10:00,video,,`)).toBe(true);
+      expect(row).toContain('Zilveren Kruis,ZK-12345678');
+      expect(end).toBe('');
+    });
+
+    it('rejects a period over the maximum', async () => {
+      const res = await getClaims({ from: daysFromToday(-400) });
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors.from).toMatch(/^The period must run forwards/);
+    });
+
+    it('is for patients only', async () => {
+      const res = await getClaims({}, await authHeader(doctorUser));
+
+      expect(res.status).toBe(403);
+    });
+  });
+});
@@ -0,0 +1,258 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const IntakeForm = require('../models/intake.form.model');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('intake forms', () => {
+  let doctor;
+  let doctorAuth;
+  let patient;
+  let patientAuth;
+  let adminAuth;
+
+  const questions = [
+    { key: 'symptoms', label: 'What are your symptoms?', type: 'text', required: true },
+    { key: 'pain_level', label: 'Pain level', type: 'number', min: 0, max: 10 },
+    { key: 'smoker', label: 'Do you smoke?', type: 'boolean' },
+    { key: 'duration', label: 'How long?', type: 'choice', options: ['days', 'weeks', 'months'] }
+  ];
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    doctorAuth = await authHeader(user);
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+  });
+
+  const book = (fields = {}) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date: daysFromToday(3),
+    startTime: '10:00',
+    endTime: '10:30',
+    type: 'video',
+    reason: 'Check-up',
+    status: 'confirmed',
+    ...fields
+  });
+
+  const createForm = (fields = {}) => request(app)
+    .post('/api/v1/admin/intake-forms')
+    .set('Authorization', adminAuth)
+    .send({ specialty: 'general-practice', title: 'GP intake', questions, ...fields });
+
+  const getForm = (appointment, authorization = patientAuth) => request(app)
+    .get(`/api/v1/appointments/${appointment._id}/intake-form`)
+    .set('Authorization', authorization);
+
+  const submit = (appointment, answers, authorization = patientAuth) => request(app)
+    .post(`/api/v1/appointments/${appointment._id}/intake-form`)
+    .set('Authorization', authorization)
+    .send({ answers });
+
+  describe('admin templates', () => {
+    it('creates one form per specialty, ignoring case', async () => {
+      const res = await createForm();
+
+      expect(res.status).toBe(201);
+      expect(res.body.data.form).toMatchObject({ specialty: 'general-practice', version: 1, isActive: true });
+
+      const duplicate = await createForm({ specialty: 'General-Practice' });
+      expect(duplicate.status).toBe(409);
+      expect(duplicate.body.error).toBe('This specialty already has an intake form');
+    });
+
+    it('rejects duplicate keys and choice questions without options', async () => {
+      const res = await createForm({
+        questions: [
+          { key: 'symptoms', label: 'Symptoms', type: 'text' },
+          { key: 'symptoms', label: 'Again', type: 'text' },
+          { key: 'duration', label: 'How long?', type: 'choice' }
+        ]
+      });
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors).toEqual({
+        'questions[1].key': 'Duplicate question key symptoms',
+        'questions[2].options': 'Choice questions need at least one option'
+      });
+    });
+
+    it('bumps the version when the questions change', async () => {
+      const form = (await createForm()).body.data.form;
+
+      const res = await request(app)
+        .put(`/api/v1/admin/intake-forms/${form._id}`)
+        .set('Authorization', adminAuth)
+        .send({ questions: questions.slice(0, 1) });
+
+      expect(res.status).toBe(200);
+      expect(res.body.data.form.version).toBe(2);
+      expect(res.body.data.form.questions).toHaveLength(1);
+    });
+
+    it('is limited to admins', async () => {
+      const res = await request(app)
+        .post('/api/v1/admin/intake-forms')
+        .set('Authorization', patientAuth)
+        .send({ specialty: 'general-practice', title: 'GP intake', questions });
+
+      expect(res.status).toBe(403);
+      expect(await IntakeForm.countDocuments()).toBe(0);
+    });
+  });
+
+  describe('GET /api/v1/appointments/:id/intake-form', () => {
+    it('serves the form for the doctor\'s specialty', async () => {
+      await createForm();
+      const appointment = await book();
+
+      const res = await getForm(appointment);
+
+      expect(res.status).toBe(200);
+      expect(res.body.form).toMatchObject({ specialty: 'general-practice', title: 'GP intake', version: 1 });
+      expect(res.body.form.questions.map(question => question.key)).toEqual(['symptoms', 'pain_level', 'smoker', 'duration']);
+      expect(res.body.intake).toBeNull();
+      expect(res.body.canSubmit).toBe(true);
+    });
+
+    it('uses the first of the doctor\'s specializations that has a form', async () => {
+      await doctor.updateOne({ specializations: ['dermatology', 'cardiology', 'general-practice'] });
+      await createForm();
+      await createForm({ specialty: 'Cardiology', title: 'Heart intake' });
+      const appointment = await book();
+
+      const res = await getForm(appointment);
+
+      expect(res.body.form.title).toBe('Heart intake');
+    });
+
+    it('ignores inactive forms', async () => {
+      await createForm({ isActive: false });
+      const appointment = await book();
+
+      const res = await getForm(appointment);
+
+      expect(res.status).toBe(404);
+      expect(res.body.message).toBe('No intake form for this appointment');
+    });
+
+    it('lets the doctor read the form but not submit it', async () => {
+      await createForm();
+      const appointment = await book();
+
+      const res = await getForm(appointment, doctorAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.canSubmit).toBe(false);
+    });
+
+    it('is hidden from other users', async () => {
+      await createForm();
+      const appointment = await book();
+
+      const res = await getForm(appointment, await authHeader(await createUser()));
+
+      expect(res.status).toBe(403);
+    });
+  });
+
+  describe('POST /api/v1/appointments/:id/intake-form', () => {
+    it('stores the answers with their labels and the form version', async () => {
+      await createForm();
+      const appointment = await book();
+
+      const res = await submit(appointment, { symptoms: 'Headache', pain_level: 6, duration: 'days' });
+
+      expect(res.status).toBe(200);
+      const { intake } = await Appointment.findById(appointment._id);
+      expect(intake).toMatchObject({ specialty: 'general-practice', version: 1 });
+      expect(intake.answers.map(({ key, label, value }) => ({ key, label, value }))).toEqual([
+        { key: 'symptoms', label: 'What are your symptoms?', value: 'Headache' },
+        { key: 'pain_level', label: 'Pain level', value: 6 },
+        { key: 'duration', label: 'How long?', value: 'days' }
+      ]);
+      expect(intake.submittedAt).toBeInstanceOf(Date);
+    });
+
+    it('replaces earlier answers', async () => {
+      await createForm();
+      const appointment = await book();
+      await submit(appointment, { symptoms: 'Headache' });
+
+      await submit(appointment, { symptoms: 'Fever', smoker: false });
+
+      const { intake } = await Appointment.findById(appointment._id);
+      expect(intake.answers.map(answer => answer.value)).toEqual(['Fever', false]);
+    });
+
+    it('validates the answers against the form', async () => {
+      await createForm();
+      const appointment = await book();
+
+      const res = await submit(appointment, { pain_level: 11, smoker: 'no', duration: 'years', allergies: 'none' });
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors).toEqual({
+        symptoms: 'This question is required',
+        pain_level: 'Must be at most 10',
+        smoker: 'Must be true or false',
+        duration: 'Must be one of: days, weeks, months',
+        allergies: 'Unknown question'
+      });
+      expect((await Appointment.findById(appointment._id)).intake.submittedAt).toBeUndefined();
+    });
+
+    it('rejects answers that are not an object', async () => {
+      await createForm();
+      const appointment = await book();
+
+      const res = await submit(appointment, ['Headache']);
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors.answers).toBe('Answers must be an object keyed by question key');
+    });
+
+    it('only accepts answers from the patient', async () => {
+      await createForm();
+      const appointment = await book();
+
+      const res = await submit(appointment, { symptoms: 'Headache' }, doctorAuth);
+
+      expect(res.status).toBe(403);
+      expect(res.body.message).toBe('Only the patient can answer the intake form');
+    });
+
+    it('is closed once the appointment is finished', async () => {
+      await createForm();
+      const appointment = await book({ status: 'completed', date: daysFromToday(-1) });
+
+      const res = await submit(appointment, { symptoms: 'Headache' });
+
+      expect(res.status).toBe(409);
+      expect(res.body.message).toBe('Cannot answer the intake form of a completed appointment');
+    });
+
+    it('surfaces the answers to the doctor', async () => {
+      await createForm();
+      const appointment = await book();
+      await submit(appointment, { symptoms: 'Headache' });
+
+      const res = await request(app)
+        .get(`/api/v1/appointments/${appointment._id}`)
+        .set('Authorization', doctorAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.intake.answers).toEqual([
+        expect.objectContaining({ key: 'symptoms', label: 'What are your symptoms?', value: 'Headache' })
+      ]);
+    });
+  });
+});
@@ -0,0 +1,86 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const { useDatabase, createDoctor } = require('./helpers');
+
+useDatabase();
+
+// Central Amsterdam
+const ORIGIN = { lat: 52.37, lng: 4.89 };
+
+const createDoctorAt = async (lngOffset, rating) => {
+  const { doctor } = await createDoctor({
+    clinicLocation: {
+      address: 'Damrak 1',
+      city: 'Amsterdam',
+      postalCode: '1012LG',
+      coordinates: { type: 'Point', coordinates: [ORIGIN.lng + lngOffset, ORIGIN.lat] }
+    },
+    rating,
+    totalReviews: 10
+  });
+  return doctor;
+};
+
+const nearby = (query) => request(app)
+  .get('/api/v1/doctors/nearby')
+  .query({ ...ORIGIN, ...query });
+
+describe('GET /api/v1/doctors/nearby', () => {
+  let close;
+  let farther;
+
+  beforeEach(async () => {
+    // About 0.7 km and 7 km away
+    close = await createDoctorAt(0.01, 1);
+    farther = await createDoctorAt(0.1, 5);
+  });
+
+  const ids = (res) => res.body.doctors.map(doctor => doctor._id);
+
+  it('orders by distance', async () => {
+    const res = await nearby({ sort: 'distance' });
+
+    expect(res.status).toBe(200);
+    expect(ids(res)).toEqual([close.id, farther.id]);
+    expect(res.body.doctors[0].distanceKm).toBeLessThan(res.body.doctors[1].distanceKm);
+  });
+
+  it('puts a better rated doctor first in the composite ranking', async () => {
+    const res = await nearby({ sort: 'composite' });
+
+    expect(res.status).toBe(200);
+    expect(ids(res)).toEqual([farther.id, close.id]);
+    expect(res.body.weights).toEqual({ distance: 0.5, rating: 0.3, availability: 0.2 });
+    const [first, second] = res.body.doctors;
+    expect(first.scores.composite).toBeGreaterThan(second.scores.composite);
+    expect(first.scores.distance).toBeLessThan(second.scores.distance);
+    expect(first.scores.rating).toBe(1);
+    expect(second.scores.rating).toBe(0.2);
+  });
+
+  it('orders by rating', async () => {
+    const res = await nearby({ sort: 'rating' });
+
+    expect(ids(res)).toEqual([farther.id, close.id]);
+    expect(res.body.weights).toBeUndefined();
+  });
+
+  it('leaves out doctors outside the radius', async () => {
+    const res = await nearby({ radiusKm: 2 });
+
+    expect(ids(res)).toEqual([close.id]);
+  });
+
+  it.each([
+    [{ sort: 'price' }, 'sort must be one of: distance, rating, composite'],
+    [{ lat: 'north' }, 'Valid lat and lng query parameters are required'],
+    [{ lng: 200 }, 'Valid lat and lng query parameters are required']
+  ])('rejects %j', async (query, error) => {
+    const res = await nearby(query);
+
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe(error);
+  });
+});
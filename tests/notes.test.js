@@ -0,0 +1,137 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('appointment notes', () => {
+  let appointment;
+  let doctorAuth;
+  let patientAuth;
+
+  beforeEach(async () => {
+    const { user, doctor } = await createDoctor();
+    doctorAuth = await authHeader(user);
+    const patient = await createUser();
+    patientAuth = await authHeader(patient);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      status: 'confirmed',
+      patientVisibleNotes: 'Bring your test results',
+      privateNotes: 'Suspect migraine'
+    });
+  });
+
+  const updateNotes = (fields, authorization = doctorAuth) => request(app)
+    .put(`/api/v1/appointments/${appointment._id}/notes`)
+    .set('Authorization', authorization)
+    .send(fields);
+
+  const get = (path, authorization) => request(app)
+    .get(`/api/v1/appointments${path}`)
+    .set('Authorization', authorization);
+
+  describe('reading', () => {
+    it('shows the doctor both kinds of notes', async () => {
+      const res = await get(`/${appointment._id}`, doctorAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({
+        patientVisibleNotes: 'Bring your test results',
+        notes: 'Bring your test results',
+        privateNotes: 'Suspect migraine'
+      });
+    });
+
+    it('never shows the patient the private notes', async () => {
+      const res = await get(`/${appointment._id}`, patientAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.patientVisibleNotes).toBe('Bring your test results');
+      expect(res.body).not.toHaveProperty('privateNotes');
+      expect(JSON.stringify(res.body)).not.toContain('Suspect migraine');
+    });
+
+    it('keeps private notes out of the patient\'s appointment list', async () => {
+      const res = await get('', patientAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body.appointments).toHaveLength(1);
+      expect(JSON.stringify(res.body)).not.toContain('Suspect migraine');
+    });
+
+    it('keeps private notes out of the patient\'s consult context', async () => {
+      const [patientView, doctorView] = [
+        await get(`/${appointment._id}/context`, patientAuth),
+        await get(`/${appointment._id}/context`, doctorAuth)
+      ];
+
+      expect(patientView.status).toBe(200);
+      expect(patientView.body.notes).toEqual({ patientVisibleNotes: 'Bring your test results', disposition: null });
+      expect(JSON.stringify(patientView.body)).not.toContain('Suspect migraine');
+      expect(doctorView.body.notes.privateNotes).toBe('Suspect migraine');
+    });
+
+    it('reads notes saved before the split as patient-visible', async () => {
+      await Appointment.collection.updateOne(
+        { _id: appointment._id },
+        { $set: { notes: 'Legacy note' }, $unset: { patientVisibleNotes: '' } }
+      );
+
+      const res = await get(`/${appointment._id}`, patientAuth);
+
+      expect(res.body).toMatchObject({ patientVisibleNotes: 'Legacy note', notes: 'Legacy note' });
+    });
+  });
+
+  describe('PUT /api/v1/appointments/:id/notes', () => {
+    it('updates each kind of note on its own', async () => {
+      const res = await updateNotes({ privateNotes: 'Migraine confirmed' });
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ patientVisibleNotes: 'Bring your test results', privateNotes: 'Migraine confirmed' });
+      const stored = await Appointment.findById(appointment._id).select('+privateNotes');
+      expect(stored.patientVisibleNotes).toBe('Bring your test results');
+      expect(stored.privateNotes).toBe('Migraine confirmed');
+    });
+
+    it('accepts notes as the older name of patientVisibleNotes', async () => {
+      const res = await updateNotes({ notes: 'Rest for a week' });
+
+      expect(res.status).toBe(200);
+      const stored = await Appointment.findById(appointment._id).select('+privateNotes');
+      expect(stored.patientVisibleNotes).toBe('Rest for a week');
+      expect(stored.privateNotes).toBe('Suspect migraine');
+    });
+
+    it('does not let the patient write notes', async () => {
+      const res = await updateNotes({ privateNotes: 'Nothing wrong' }, patientAuth);
+
+      expect(res.status).toBe(403);
+      expect((await Appointment.findById(appointment._id).select('+privateNotes')).privateNotes).toBe('Suspect migraine');
+    });
+
+    it('does not let another doctor write notes', async () => {
+      const { user } = await createDoctor();
+
+      const res = await updateNotes({ privateNotes: 'Nothing wrong' }, await authHeader(user));
+
+      expect(res.status).toBe(403);
+    });
+
+    it('needs at least one of the notes', async () => {
+      const res = await updateNotes({});
+
+      expect(res.status).toBe(400);
+    });
+  });
+});
@@ -0,0 +1,179 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const OTP = require('../models/otp.model');
+const User = require('../models/user.model');
+const OTPService = require('../services/otp.service');
+const config = require('../config/config');
+const { sendSMS } = require('../services/aws.service');
+const { useDatabase, createUser, authHeader } = require('./helpers');
+
+useDatabase();
+
+describe('POST /api/v1/auth/send-otp', () => {
+  const { maxPerWindow } = config.verification.phoneOtp;
+
+  const sendOtp = (auth) => request(app)
+    .post('/api/v1/auth/send-otp')
+    .set('Authorization', auth);
+
+  const unverifiedUser = (number) => createUser({
+    phone: { countryCode: '+31', number },
+    isPhoneVerified: false
+  });
+
+  beforeEach(() => {
+    sendSMS.mockClear();
+  });
+
+  it('limits how many codes a number gets', async () => {
+    const auth = await authHeader(await unverifiedUser('612345678'));
+    for (let i = 0; i < maxPerWindow; i += 1) {
+      expect((await sendOtp(auth)).status).toBe(200);
+    }
+
+    const res = await sendOtp(auth);
+
+    expect(res.status).toBe(429);
+    expect(res.headers['retry-after']).toBeDefined();
+    expect(sendSMS).toHaveBeenCalledTimes(maxPerWindow);
+  });
+
+  it('counts the number, not the account', async () => {
+    const first = await authHeader(await unverifiedUser('612345678'));
+    // The same number with a trunk 0, on another account
+    const second = await authHeader(await unverifiedUser('06-1234 5678'));
+    for (let i = 0; i < maxPerWindow; i += 1) {
+      await sendOtp(first);
+    }
+
+    const res = await sendOtp(second);
+
+    expect(res.status).toBe(429);
+    expect(sendSMS).toHaveBeenCalledTimes(maxPerWindow);
+  });
+
+  it('doesn\'t limit other numbers', async () => {
+    const first = await authHeader(await unverifiedUser('612345678'));
+    const second = await authHeader(await unverifiedUser('687654321'));
+    for (let i = 0; i < maxPerWindow; i += 1) {
+      await sendOtp(first);
+    }
+
+    const res = await sendOtp(second);
+
+    expect(res.status).toBe(200);
+    expect(sendSMS).toHaveBeenLastCalledWith('+31687654321', expect.any(String));
+  });
+});
+
+describe('POST /api/v1/auth/verify-otp', () => {
+  const { maxAttempts } = config.verification.phoneOtp;
+  let user;
+  let auth;
+
+  beforeEach(async () => {
+    sendSMS.mockClear();
+    user = await createUser({ phone: { countryCode: '+31', number: '612345678' }, isPhoneVerified: false });
+    auth = await authHeader(user);
+  });
+
+  // Request a code and read it from the SMS
+  const requestCode = async () => {
+    await request(app).post('/api/v1/auth/send-otp').set('Authorization', auth).expect(200);
+    const [, message] = sendSMS.mock.calls[sendSMS.mock.calls.length - 1];
+    return message.match(/code is (\d{6})/)[1];
+  };
+
+  const verify = (otp) => request(app)
+    .post('/api/v1/auth/verify-otp')
+    .set('Authorization', auth)
+    .send({ otp });
+
+  // A six-digit code that isn't the given one
+  const otherCode = (code) => String((Number(code) + 1) % 1000000).padStart(6, '0');
+
+  const isPhoneVerified = async () => (await User.findById(user._id)).isPhoneVerified;
+
+  it('verifies the phone with the code sent by SMS', async () => {
+    const code = await requestCode();
+
+    expect(sendSMS).toHaveBeenCalledWith('+31612345678', expect.stringContaining(`expires in ${config.verification.phoneOtp.expiryMinutes} minutes`));
+    const res = await verify(code);
+
+    expect(res.status).toBe(200);
+    expect(res.body).toEqual({ success: true, message: 'Phone verified successfully' });
+    expect(await isPhoneVerified()).toBe(true);
+    expect(await OTP.findOne({ userId: user._id })).toMatchObject({ isExpired: true, expiredAt: expect.any(Date) });
+  });
+
+  it('rejects a wrong code and still accepts the right one afterwards', async () => {
+    const code = await requestCode();
+
+    const res = await verify(otherCode(code));
+
+    expect(res.status).toBe(400);
+    expect(res.body).toEqual({ success: false, error: 'Invalid or expired OTP' });
+    expect(await isPhoneVerified()).toBe(false);
+    expect((await OTP.findOne({ userId: user._id })).attempts).toBe(1);
+    expect((await verify(code)).status).toBe(200);
+  });
+
+  it('stops accepting a code after too many wrong guesses', async () => {
+    const code = await requestCode();
+    for (let i = 0; i < maxAttempts; i += 1) {
+      expect((await verify(otherCode(code))).status).toBe(400);
+    }
+
+    const res = await verify(code);
+
+    expect(res.status).toBe(400);
+    expect(await isPhoneVerified()).toBe(false);
+  });
+
+  it('rejects an expired code', async () => {
+    const code = await requestCode();
+    await OTP.updateOne({ userId: user._id }, { $set: { expiresAt: new Date(Date.now() - 1000) } });
+
+    const res = await verify(code);
+
+    expect(res.status).toBe(400);
+    expect(res.body.error).toBe('Invalid or expired OTP');
+    expect(await isPhoneVerified()).toBe(false);
+  });
+
+  it('rejects a code replaced by a newer one', async () => {
+    const oldCode = await requestCode();
+    const newCode = await requestCode();
+    // Codes are random; only check the old one when the two differ
+    if (oldCode !== newCode) {
+      expect((await verify(oldCode)).status).toBe(400);
+      expect(await isPhoneVerified()).toBe(false);
+    }
+
+    expect((await verify(newCode)).status).toBe(200);
+    expect(await OTP.countDocuments({ userId: user._id, isExpired: false })).toBe(0);
+  });
+
+  it('rejects a code that was already used', async () => {
+    const code = await requestCode();
+    await verify(code).expect(200);
+
+    expect(await OTPService.verifyPhoneVerificationOTP(user, code)).toEqual({ success: false, error: 'Invalid or expired OTP' });
+
+    // A new number must be verified with a new code, not the old one
+    await User.updateOne({ _id: user._id }, { $set: { phone: { countryCode: '+31', number: '687654321' }, isPhoneVerified: false } });
+    const res = await verify(code);
+
+    expect(res.status).toBe(400);
+    expect(await isPhoneVerified()).toBe(false);
+  });
+
+  it.each(['12345', '1234567', 'abcdef'])('rejects %p as malformed', async (otp) => {
+    const res = await verify(otp);
+
+    expect(res.status).toBe(400);
+    expect(res.body.errors.otp).toBe('OTP must be 6 digits');
+  });
+});
@@ -0,0 +1,114 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Notification = require('../models/notification.model');
+const { encodeCursor, decodeCursor } = require('../utils/pagination');
+const { useDatabase, createUser, createDoctor, authHeader } = require('./helpers');
+
+useDatabase();
+
+const MINUTE = 60 * 1000;
+
+describe('cursor pagination', () => {
+  it('round-trips a cursor', () => {
+    const doc = { createdAt: new Date('2026-01-02T03:04:05.678Z'), _id: '64b7f0c2e4b0a1a2b3c4d5e6' };
+
+    const position = decodeCursor(encodeCursor(doc));
+
+    expect(position.createdAt).toEqual(doc.createdAt);
+    expect(position.id.toString()).toBe(doc._id);
+  });
+
+  it.each(['not-a-cursor', Buffer.from('{"createdAt":"x","id":"y"}').toString('base64url')])(
+    'rejects the malformed cursor %s',
+    (cursor) => {
+      expect(decodeCursor(cursor)).toBeNull();
+    }
+  );
+
+  describe('GET /api/v1/notifications', () => {
+    let user;
+    let auth;
+    const start = Date.now() - 60 * MINUTE;
+
+    beforeEach(async () => {
+      user = await createUser();
+      auth = await authHeader(user);
+      // Minutes apart, the last two sharing a timestamp
+      await Notification.insertMany([0, 1, 2, 3, 4, 4].map((minutes, i) => ({
+        userId: user._id,
+        title: `Notification ${i}`,
+        message: 'Hello',
+        type: 'in-app',
+        createdAt: new Date(start + minutes * MINUTE)
+      })));
+    });
+
+    const getPage = (query) => request(app)
+      .get('/api/v1/notifications')
+      .set('Authorization', auth)
+      .query(query);
+
+    it('neither repeats nor skips items when one is added mid-scroll', async () => {
+      const first = await getPage({ limit: 2 }).expect(200);
+      await Notification.create({ userId: user._id, title: 'Newest', message: 'Hello', type: 'in-app' });
+
+      const titles = first.body.notifications.map(n => n.title);
+      let cursor = first.body.nextCursor;
+      while (cursor) {
+        const page = await getPage({ limit: 2, cursor }).expect(200);
+        titles.push(...page.body.notifications.map(n => n.title));
+        cursor = page.body.nextCursor;
+      }
+
+      expect(titles).toHaveLength(6);
+      expect(new Set(titles).size).toBe(6);
+      expect(titles).not.toContain('Newest');
+    });
+
+    it('keeps offset paging with a cursor for the next page', async () => {
+      const res = await getPage({ page: 2, limit: 2 });
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ total: 6, page: 2, pages: 3 });
+      expect(res.body.notifications).toHaveLength(2);
+      expect(res.body.nextCursor).toEqual(expect.any(String));
+    });
+
+    it('returns no cursor on the last page', async () => {
+      const res = await getPage({ limit: 10 });
+
+      expect(res.body.notifications).toHaveLength(6);
+      expect(res.body.nextCursor).toBeNull();
+    });
+
+    it('rejects an invalid cursor', async () => {
+      const res = await getPage({ cursor: 'not-a-cursor' });
+
+      expect(res.status).toBe(400);
+    });
+  });
+
+  describe('GET /api/v1/doctors', () => {
+    it('neither repeats nor skips doctors when one registers mid-scroll', async () => {
+      const created = [];
+      for (let i = 0; i < 5; i += 1) {
+        created.push((await createDoctor()).doctor._id.toString());
+      }
+
+      const first = await request(app).get('/api/v1/doctors').query({ limit: 2 }).expect(200);
+      await createDoctor();
+
+      const ids = first.body.doctors.map(d => d._id);
+      let cursor = first.body.nextCursor;
+      while (cursor) {
+        const page = await request(app).get('/api/v1/doctors').query({ limit: 2, cursor }).expect(200);
+        ids.push(...page.body.doctors.map(d => d._id));
+        cursor = page.body.nextCursor;
+      }
+
+      expect(ids.sort()).toEqual(created.sort());
+    });
+  });
+});
@@ -0,0 +1,757 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Payment = require('../models/payment.model');
+const Payout = require('../models/payout.model');
+const Notification = require('../models/notification.model');
+const AppointmentService = require('../services/appointment.service');
+const PayoutService = require('../services/payout.service');
+const notificationService = require('../services/notification.service');
+const config = require('../config/config');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+const WEBHOOK_SECRET = process.env.PAYMENT_WEBHOOK_SECRET;
+
+const sendWebhook = (event, transactionId, secret = WEBHOOK_SECRET) => request(app)
+  .post('/api/v1/payments/webhook')
+  .set('x-webhook-secret', secret)
+  .send({ event, data: { transactionId } });
+
+describe('payments', () => {
+  let appointment;
+  let patientAuth;
+
+  beforeEach(async () => {
+    const { doctor } = await createDoctor();
+    const patient = await createUser();
+    patientAuth = await authHeader(patient);
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50
+    });
+  });
+
+  const initiate = () => request(app)
+    .post('/api/v1/payments/initiate')
+    .set('Authorization', patientAuth)
+    .send({ appointmentId: appointment._id.toString(), paymentMethod: 'iDEAL' });
+
+  describe('POST /api/v1/payments/initiate', () => {
+    it('creates a pending payment and holds the slot', async () => {
+      const res = await initiate();
+
+      expect(res.status).toBe(201);
+      expect(res.body).toMatchObject({ amount: 50, currency: 'EUR', status: 'pending' });
+      const held = await Appointment.findById(appointment._id);
+      expect(held.paymentStatus).toBe('held');
+      expect(held.holdExpiresAt.toISOString()).toBe(res.body.holdExpiresAt);
+    });
+
+    it('rejects a second payment while the first is in progress', async () => {
+      await initiate().expect(201);
+
+      const res = await initiate();
+
+      expect(res.status).toBe(409);
+    });
+
+    it('accepts a booking the doctor already confirmed', async () => {
+      await Appointment.updateOne({ _id: appointment._id }, { $set: { status: 'confirmed' } });
+
+      const res = await initiate();
+
+      expect(res.status).toBe(201);
+    });
+
+    it('rejects a cancelled booking', async () => {
+      await Appointment.updateOne({ _id: appointment._id }, { $set: { status: 'cancelled' } });
+
+      const res = await initiate();
+
+      expect(res.status).toBe(409);
+    });
+
+    it('lets only one of two overlapping bookings hold the slot', async () => {
+      const rival = await createUser();
+      const rivalAuth = await authHeader(rival);
+      const other = await Appointment.create({
+        doctorId: appointment.doctorId,
+        patientId: rival._id,
+        date: appointment.date,
+        startTime: '10:15',
+        endTime: '10:45',
+        type: 'video',
+        reason: 'Check-up',
+        fee: 50
+      });
+
+      const results = await Promise.all([
+        initiate(),
+        request(app)
+          .post('/api/v1/payments/initiate')
+          .set('Authorization', rivalAuth)
+          .send({ appointmentId: other._id.toString(), paymentMethod: 'iDEAL' })
+      ]);
+
+      expect(results.map(res => res.status).sort()).toEqual([201, 409]);
+      expect(await Appointment.countDocuments({ paymentStatus: 'held' })).toBe(1);
+    });
+
+    it.each([
+      ['appointmentId', { appointmentId: '42' }, 'Invalid appointment ID'],
+      ['paymentMethod', { paymentMethod: 'cash' }, 'Invalid payment method']
+    ])('maps an invalid %s to its field', async (field, fields, message) => {
+      const res = await request(app)
+        .post('/api/v1/payments/initiate')
+        .set('Authorization', patientAuth)
+        .send({ appointmentId: appointment._id.toString(), paymentMethod: 'iDEAL', ...fields });
+
+      expect(res.status).toBe(400);
+      expect(res.body).toEqual({ message: 'Validation Error', errors: { [field]: message } });
+      expect(await Payment.countDocuments()).toBe(0);
+    });
+  });
+
+  describe('POST /api/v1/payments/webhook', () => {
+    let transactionId;
+
+    beforeEach(async () => {
+      transactionId = (await initiate().expect(201)).body.transactionId;
+    });
+
+    it('rejects a request without the shared secret', async () => {
+      const res = await sendWebhook('payment.succeeded', transactionId, 'wrong-secret');
+
+      expect(res.status).toBe(401);
+      expect((await Payment.findOne({ transactionId })).status).toBe('pending');
+    });
+
+    it('marks the payment and the appointment paid', async () => {
+      const res = await sendWebhook('payment.succeeded', transactionId);
+
+      expect(res.status).toBe(200);
+      const payment = await Payment.findOne({ transactionId });
+      expect(payment.status).toBe('success');
+      expect(payment.paidAt).toBeInstanceOf(Date);
+      expect(payment.doctorNet).toBe(50);
+      const paid = await Appointment.findById(appointment._id);
+      expect(paid.paymentStatus).toBe('paid');
+      expect(paid.holdExpiresAt).toBeUndefined();
+    });
+
+    it('ignores a repeated delivery', async () => {
+      await sendWebhook('payment.succeeded', transactionId).expect(200);
+      const paidAt = (await Payment.findOne({ transactionId })).paidAt;
+
+      await sendWebhook('payment.failed', transactionId).expect(200);
+
+      const payment = await Payment.findOne({ transactionId });
+      expect(payment.status).toBe('success');
+      expect(payment.paidAt).toEqual(paidAt);
+    });
+
+    describe('after the hold expired', () => {
+      beforeEach(async () => {
+        await Appointment.updateOne(
+          { _id: appointment._id },
+          { $set: { holdExpiresAt: new Date(Date.now() - 60 * 1000) } }
+        );
+      });
+
+      it('keeps the booking when its slot is still free', async () => {
+        await AppointmentService.expireUnpaidAppointments();
+        expect((await Payment.findOne({ transactionId })).status).toBe('failed');
+
+        await sendWebhook('payment.succeeded', transactionId).expect(200);
+
+        expect((await Payment.findOne({ transactionId })).status).toBe('success');
+        expect((await Appointment.findById(appointment._id)).paymentStatus).toBe('paid');
+      });
+
+      it('refunds the payment when the slot was taken meanwhile', async () => {
+        await Appointment.create({
+          doctorId: appointment.doctorId,
+          patientId: (await createUser())._id,
+          date: appointment.date,
+          startTime: '10:00',
+          endTime: '10:30',
+          type: 'video',
+          reason: 'Check-up',
+          fee: 50
+        });
+        await AppointmentService.expireUnpaidAppointments();
+        expect((await Appointment.findById(appointment._id)).status).toBe('cancelled');
+
+        await sendWebhook('payment.succeeded', transactionId).expect(200);
+
+        const payment = await Payment.findOne({ transactionId });
+        expect(payment.status).toBe('refunded');
+        expect(payment.refundedAmount).toBe(50);
+      });
+    });
+
+    it('releases the hold when the payment fails', async () => {
+      await sendWebhook('payment.failed', transactionId).expect(200);
+
+      expect((await Payment.findOne({ transactionId })).status).toBe('failed');
+      const released = await Appointment.findById(appointment._id);
+      expect(released.paymentStatus).toBe('unpaid');
+      expect(released.holdExpiresAt).toBeUndefined();
+    });
+  });
+
+  describe('POST /api/v1/payments/:id/refund', () => {
+    let payment;
+    let adminAuth;
+
+    beforeEach(async () => {
+      const { transactionId } = (await initiate().expect(201)).body;
+      await sendWebhook('payment.succeeded', transactionId).expect(200);
+      payment = await Payment.findOne({ transactionId });
+      adminAuth = await authHeader(await createUser({ role: 'admin' }));
+    });
+
+    const refund = (authorization, body) => request(app)
+      .post(`/api/v1/payments/${payment._id}/refund`)
+      .set('Authorization', authorization)
+      .send(body);
+
+    it('refunds part of a payment', async () => {
+      const res = await refund(adminAuth, { reason: 'Late start', amount: 20 });
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ status: 'success', refundedAmount: 20, doctorNet: 30 });
+      expect((await Appointment.findById(appointment._id)).paymentStatus).toBe('paid');
+    });
+
+    it('marks the payment and the appointment refunded once refunded in full', async () => {
+      await refund(adminAuth, { reason: 'Late start', amount: 20 }).expect(200);
+
+      const res = await refund(adminAuth, { reason: 'Cancelled' });
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ status: 'refunded', refundedAmount: 50 });
+      expect((await Appointment.findById(appointment._id)).paymentStatus).toBe('refunded');
+    });
+
+    it('rejects more than what is left', async () => {
+      const res = await refund(adminAuth, { reason: 'Too much', amount: 60 });
+
+      expect(res.status).toBe(400);
+    });
+
+    it('claws the doctor\'s share back from the next payout once paid out', async () => {
+      const [first] = await PayoutService.createPayouts(payment.doctorId, undefined, new Date());
+      expect(first.amount).toBe(50);
+
+      await refund(adminAuth, { reason: 'Late start', amount: 20 }).expect(200);
+      const [pending] = await PayoutService.getPendingPayout(payment.doctorId);
+      expect(pending).toMatchObject({ amount: -20, payments: 0, adjustments: 1 });
+
+      await Payment.create({
+        appointmentId: appointment._id,
+        patientId: payment.patientId,
+        doctorId: payment.doctorId,
+        amount: 50,
+        status: 'success',
+        method: 'card',
+        paidAt: new Date(),
+        doctorNet: 50
+      });
+      const [second] = await PayoutService.createPayouts(payment.doctorId, first.periodEnd, new Date());
+
+      expect(second.amount).toBe(30);
+      expect(second.adjustments).toHaveLength(1);
+      expect(await PayoutService.getPendingPayout(payment.doctorId)).toEqual([]);
+    });
+
+    it('is for admins only', async () => {
+      const res = await refund(patientAuth, { reason: 'Please' });
+
+      expect(res.status).toBe(403);
+      expect((await Payment.findById(payment._id)).refundedAmount).toBe(0);
+    });
+  });
+});
+
+describe('consultation types', () => {
+  let doctor;
+  let patientAuth;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor({
+      consultationTypes: [
+        { name: 'First visit', duration: 45, fee: 80 },
+        { name: 'Follow-up', duration: 15, fee: 30 }
+      ]
+    }));
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const typeNamed = (name) => doctor.consultationTypes.find(type => type.name === name);
+
+  const book = (timeSlot, consultationTypeId) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', patientAuth)
+    .send({
+      doctorId: doctor._id.toString(),
+      date: daysFromToday(2),
+      timeSlot,
+      type: 'video',
+      reason: 'Check-up',
+      ...(consultationTypeId && { consultationTypeId: consultationTypeId.toString() })
+    });
+
+  const pay = (appointmentId) => request(app)
+    .post('/api/v1/payments/initiate')
+    .set('Authorization', patientAuth)
+    .send({ appointmentId, paymentMethod: 'card' });
+
+  it.each([
+    ['First visit', '10:00-10:45', 80],
+    ['Follow-up', '10:00-10:15', 30]
+  ])('charges the %s fee', async (name, timeSlot, fee) => {
+    const type = typeNamed(name);
+
+    const booked = await book(timeSlot, type._id);
+
+    expect(booked.status).toBe(201);
+    expect(booked.body).toMatchObject({ fee, consultationType: { typeId: type._id.toString(), name } });
+    const payment = await pay(booked.body.id);
+    expect(payment.status).toBe(201);
+    expect(payment.body.amount).toBe(fee);
+  });
+
+  it('charges the consultation fee when no type is chosen', async () => {
+    const booked = await book('10:00-10:30');
+
+    expect(booked.status).toBe(201);
+    expect(booked.body.fee).toBe(doctor.consultationFee);
+    expect((await pay(booked.body.id)).body.amount).toBe(doctor.consultationFee);
+  });
+
+  it('rejects a type another doctor offers', async () => {
+    const { doctor: other } = await createDoctor({
+      consultationTypes: [{ name: 'Second opinion', duration: 30, fee: 120 }]
+    });
+
+    const res = await book('10:00-10:30', other.consultationTypes[0]._id);
+
+    expect(res.status).toBe(400);
+    expect(res.body.errors).toHaveProperty('consultationTypeId');
+    expect(await Appointment.countDocuments({ doctorId: doctor._id })).toBe(0);
+  });
+
+  it('rejects a slot that does not match the type\'s duration', async () => {
+    const res = await book('10:00-10:30', typeNamed('First visit')._id);
+
+    expect(res.status).toBe(400);
+    expect(res.body.errors).toHaveProperty('timeSlot');
+  });
+});
+
+describe('peak pricing', () => {
+  // The next Saturday and Wednesday at least two days out
+  const nextDay = (weekday) => {
+    const days = [2, 3, 4, 5, 6, 7, 8].find(n => new Date(daysFromToday(n)).getUTCDay() === weekday);
+    return daysFromToday(days);
+  };
+  const saturday = nextDay(6);
+  const wednesday = nextDay(3);
+  let doctor;
+  let patientAuth;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor({
+      consultationTypes: [{ name: 'First visit', duration: 30, fee: 80 }],
+      pricingRules: [
+        { days: ['saturday', 'sunday'], startTime: '09:00', endTime: '17:00', multiplier: 1.5, label: 'Weekend rate' },
+        { days: ['saturday'], startTime: '12:00', endTime: '14:00', multiplier: 2 }
+      ]
+    }));
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const book = (date, timeSlot, fields = {}) => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), date, timeSlot, type: 'video', reason: 'Check-up', ...fields });
+
+  const pay = (appointmentId) => request(app)
+    .post('/api/v1/payments/initiate')
+    .set('Authorization', patientAuth)
+    .send({ appointmentId, paymentMethod: 'card' });
+
+  it('charges the multiplied fee for a weekend slot and snapshots the rule', async () => {
+    const booked = await book(saturday, '10:00-10:30');
+
+    expect(booked.status).toBe(201);
+    expect(booked.body.fee).toBe(75);
+    expect(booked.body.pricing).toEqual({ baseFee: 50, multiplier: 1.5, rule: 'Weekend rate' });
+    expect((await Appointment.findById(booked.body.id)).pricing).toMatchObject({ baseFee: 50, multiplier: 1.5 });
+    expect((await pay(booked.body.id)).body.amount).toBe(75);
+  });
+
+  it('keeps the snapshot when the doctor changes the rules later', async () => {
+    const booked = await book(saturday, '10:00-10:30');
+    await doctor.updateOne({ pricingRules: [] });
+
+    expect((await pay(booked.body.id)).body.amount).toBe(75);
+  });
+
+  it('applies the highest multiplier when several rules match', async () => {
+    const booked = await book(saturday, '12:30-13:00');
+
+    expect(booked.body.fee).toBe(100);
+    expect(booked.body.pricing).toEqual({ baseFee: 50, multiplier: 2 });
+  });
+
+  it('multiplies the consultation type\'s fee', async () => {
+    const booked = await book(saturday, '10:00-10:30', { consultationTypeId: doctor.consultationTypes[0]._id.toString() });
+
+    expect(booked.body.fee).toBe(120);
+  });
+
+  it('charges the base fee when no rule matches', async () => {
+    const booked = await book(wednesday, '10:00-10:30');
+
+    expect(booked.status).toBe(201);
+    expect(booked.body.fee).toBe(50);
+    expect(booked.body.pricing).toBeUndefined();
+    expect((await pay(booked.body.id)).body.amount).toBe(50);
+  });
+
+  it('shows each slot\'s fee in the availability', async () => {
+    const res = await request(app)
+      .get('/api/v1/appointments/slots/available')
+      .set('Authorization', patientAuth)
+      .query({ doctorId: doctor._id.toString(), startDate: saturday, endDate: saturday });
+
+    expect(res.status).toBe(200);
+    const fees = Object.fromEntries(res.body.availability[0].slotDetails.map(slot => [slot.startTime, slot.fee]));
+    expect(fees).toMatchObject({ '09:00': 75, '12:00': 100, '13:30': 100, '14:00': 75 });
+  });
+
+});
+
+describe('auto-accepted bookings', () => {
+  let doctor;
+  let patientAuth;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor({ autoAcceptBookings: true }));
+    patientAuth = await authHeader(await createUser());
+  });
+
+  const book = () => request(app)
+    .post('/api/v1/appointments')
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), date: daysFromToday(2), timeSlot: '10:00-10:30', type: 'video', reason: 'Check-up' });
+
+  const pay = async (appointmentId) => {
+    const initiated = await request(app)
+      .post('/api/v1/payments/initiate')
+      .set('Authorization', patientAuth)
+      .send({ appointmentId, paymentMethod: 'iDEAL' });
+    expect(initiated.status).toBe(201);
+    await sendWebhook('payment.succeeded', initiated.body.transactionId).expect(200);
+    return Appointment.findById(appointmentId);
+  };
+
+  it('are confirmed on booking and can be paid', async () => {
+    const booked = await book();
+    expect(booked.status).toBe(201);
+    expect(booked.body).toMatchObject({ status: 'confirmed', confirmationMode: 'auto' });
+
+    const paid = await pay(booked.body.id);
+
+    expect(paid.status).toBe('confirmed');
+    expect(paid.paymentStatus).toBe('paid');
+  });
+
+  describe('with pay-before-confirm', () => {
+    beforeEach(() => {
+      config.payments.payBeforeConfirm = true;
+    });
+
+    afterEach(() => {
+      config.payments.payBeforeConfirm = false;
+    });
+
+    it('are confirmed once paid', async () => {
+      const booked = await book();
+      expect(booked.body).toMatchObject({ status: 'pending', confirmationMode: 'auto' });
+
+      const paid = await pay(booked.body.id);
+
+      expect(paid.status).toBe('confirmed');
+      expect(paid.paymentStatus).toBe('paid');
+    });
+  });
+});
+
+describe('PayoutService.createPayouts', () => {
+  let doctor;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    const patient = await createUser();
+    await Payment.create({
+      appointmentId: (await Appointment.create({
+        doctorId: doctor._id,
+        patientId: patient._id,
+        date: daysFromToday(-1),
+        startTime: '10:00',
+        endTime: '10:30',
+        type: 'video',
+        reason: 'Check-up',
+        fee: 50
+      }))._id,
+      patientId: patient._id,
+      doctorId: doctor._id,
+      amount: 50,
+      status: 'success',
+      method: 'card',
+      paidAt: new Date(),
+      doctorNet: 45
+    });
+  });
+
+  afterEach(() => {
+    jest.restoreAllMocks();
+  });
+
+  it('pays each payment out once', async () => {
+    const [payout] = await PayoutService.createPayouts(doctor._id, undefined, new Date());
+
+    expect(payout.amount).toBe(45);
+    expect(await PayoutService.createPayouts(doctor._id, undefined, new Date())).toEqual([]);
+  });
+
+  it('leaves the payments unclaimed when the payout fails to save', async () => {
+    jest.spyOn(Payout.prototype, 'save').mockRejectedValueOnce(new Error('write failed'));
+
+    await expect(PayoutService.createPayouts(doctor._id, undefined, new Date())).rejects.toThrow('write failed');
+
+    expect(await Payment.countDocuments({ payoutId: { $ne: null } })).toBe(0);
+    const [retried] = await PayoutService.createPayouts(doctor._id, undefined, new Date());
+    expect(retried.amount).toBe(45);
+  });
+});
+
+describe('reschedule fees', () => {
+  const policy = { ...config.appointments.rescheduleFee };
+  let doctor;
+  let patient;
+  let patientAuth;
+
+  beforeEach(async () => {
+    config.appointments.rescheduleFee = { freeHoursBefore: 72, amount: 20, percent: 0, collect: true };
+    ({ doctor } = await createDoctor());
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+  });
+
+  afterEach(() => {
+    config.appointments.rescheduleFee = policy;
+  });
+
+  const book = (days) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date: daysFromToday(days),
+    startTime: '10:00',
+    endTime: '10:30',
+    type: 'video',
+    reason: 'Check-up',
+    fee: 50
+  });
+
+  const reschedule = (appointment, body = {}) => request(app)
+    .put(`/api/v1/appointments/${appointment._id}/reschedule`)
+    .set('Authorization', patientAuth)
+    .send({ date: daysFromToday(6), timeSlot: '11:00-11:30', ...body });
+
+  it('is free well before the appointment', async () => {
+    const appointment = await book(5);
+
+    const res = await reschedule(appointment);
+
+    expect(res.status).toBe(200);
+    expect(res.body.rescheduleFee).toMatchObject({ amount: 0, status: null, payment: null });
+    expect(await Payment.countDocuments()).toBe(0);
+  });
+
+  it('asks for a payment method when rescheduling late', async () => {
+    const appointment = await book(1);
+
+    const res = await reschedule(appointment);
+
+    expect(res.status).toBe(402);
+    expect(res.body.code).toBe('RESCHEDULE_FEE_REQUIRED');
+    expect(res.body.rescheduleFee.amount).toBe(20);
+    expect((await Appointment.findById(appointment._id)).startTime).toBe('10:00');
+  });
+
+  it('shows the fee before rescheduling', async () => {
+    const appointment = await book(1);
+
+    const res = await request(app)
+      .get(`/api/v1/appointments/${appointment._id}/reschedule-fee`)
+      .set('Authorization', patientAuth);
+
+    expect(res.status).toBe(200);
+    expect(res.body).toMatchObject({ amount: 20, currency: 'EUR', freeHoursBefore: 72 });
+  });
+
+  it('only records the fee when it is not collected', async () => {
+    config.appointments.rescheduleFee.collect = false;
+    const appointment = await book(1);
+
+    const res = await reschedule(appointment);
+
+    expect(res.status).toBe(200);
+    expect(res.body.rescheduleFee).toMatchObject({ amount: 20, status: 'unpaid', payment: null });
+    expect((await Appointment.findById(appointment._id)).rescheduleFees[0].status).toBe('unpaid');
+  });
+
+  describe('when collected', () => {
+    let appointment;
+    let transactionId;
+
+    beforeEach(async () => {
+      appointment = await book(1);
+      const res = await reschedule(appointment, { paymentMethod: 'card' });
+      expect(res.status).toBe(200);
+      expect(res.body.rescheduleFee).toMatchObject({ amount: 20, status: 'pending' });
+      transactionId = res.body.rescheduleFee.payment.transactionId;
+    });
+
+    const feeStatus = async () => (await Appointment.findById(appointment._id)).rescheduleFees[0].status;
+
+    it('moves the appointment with the fee pending', async () => {
+      const moved = await Appointment.findById(appointment._id);
+      expect(moved.startTime).toBe('11:00');
+      expect(moved.rescheduleFees[0].status).toBe('pending');
+      expect(await Payment.findOne({ transactionId }).lean()).toMatchObject({ purpose: 'reschedule-fee', amount: 20, status: 'pending' });
+    });
+
+    it('settles the fee when its payment succeeds', async () => {
+      await sendWebhook('payment.succeeded', transactionId).expect(200);
+
+      expect(await feeStatus()).toBe('paid');
+      expect((await Payment.findOne({ transactionId })).status).toBe('success');
+      // The fee doesn't pay for the consultation itself
+      expect((await Appointment.findById(appointment._id)).paymentStatus).toBe('unpaid');
+    });
+
+    it('marks the fee failed and keeps the new time when its payment fails', async () => {
+      await sendWebhook('payment.failed', transactionId).expect(200);
+
+      expect(await feeStatus()).toBe('failed');
+      expect((await Payment.findOne({ transactionId })).status).toBe('failed');
+      const moved = await Appointment.findById(appointment._id);
+      expect(moved.startTime).toBe('11:00');
+      expect(moved.status).toBe('pending');
+    });
+  });
+});
+
+describe('unpaid booking reminders', () => {
+  const expiryMinutes = config.payments.unpaidExpiryMinutes;
+  const leadMinutes = config.payments.unpaidReminder.minutesBefore;
+  let doctor;
+  let patient;
+
+  beforeEach(async () => {
+    config.payments.payBeforeConfirm = true;
+    ({ doctor } = await createDoctor());
+    patient = await createUser();
+  });
+
+  afterEach(() => {
+    config.payments.payBeforeConfirm = false;
+  });
+
+  // A booking made minutesAgo minutes ago
+  const book = async (minutesAgo, fields = {}) => {
+    const appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      fee: 50,
+      ...fields
+    });
+    await Appointment.collection.updateOne(
+      { _id: appointment._id },
+      { $set: { createdAt: new Date(Date.now() - minutesAgo * 60 * 1000) } }
+    );
+    return appointment;
+  };
+
+  // What the scheduled job does each run
+  const runJob = async () => {
+    await AppointmentService.expireUnpaidAppointments();
+    const reminders = await AppointmentService.remindUnpaidAppointments();
+    for (const { appointment, deadline } of reminders) {
+      await notificationService.sendPaymentReminder(appointment, deadline);
+    }
+    return reminders;
+  };
+
+  const remindersFor = (appointment) => Notification.find({
+    userId: patient._id,
+    title: 'Complete Your Payment',
+    'relatedTo.id': appointment._id
+  });
+
+  it('reminds the patient once, with the payment link, shortly before the deadline', async () => {
+    const appointment = await book(expiryMinutes - leadMinutes + 5);
+
+    const reminders = await runJob();
+    await runJob();
+
+    expect(reminders).toHaveLength(1);
+    expect(reminders[0].deadline.getTime()).toBeGreaterThan(Date.now());
+    const sent = await remindersFor(appointment);
+    expect(sent.map(notification => notification.type).sort()).toEqual(['email', 'in-app']);
+    expect(sent[0].link).toContain(appointment._id.toString());
+    expect((await Appointment.findById(appointment._id)).paymentReminderSentAt).toBeInstanceOf(Date);
+  });
+
+  it('waits until the deadline is near', async () => {
+    const appointment = await book(1);
+
+    expect(await runJob()).toEqual([]);
+    expect(await remindersFor(appointment)).toHaveLength(0);
+  });
+
+  it('does not remind about a paid booking', async () => {
+    const appointment = await book(expiryMinutes - leadMinutes + 5, { paymentStatus: 'paid' });
+
+    expect(await runJob()).toEqual([]);
+    expect(await remindersFor(appointment)).toHaveLength(0);
+  });
+
+  it('does not remind about a booking whose unpaid window has passed', async () => {
+    const appointment = await book(expiryMinutes + 5);
+
+    expect(await runJob()).toEqual([]);
+    expect(await remindersFor(appointment)).toHaveLength(0);
+    expect((await Appointment.findById(appointment._id)).status).toBe('cancelled');
+  });
+});
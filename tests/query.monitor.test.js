@@ -0,0 +1,95 @@
+jest.mock('../services/aws.service');
+
+const { EventEmitter } = require('events');
+const request = require('supertest');
+const app = require('../app');
+const QueryMonitorService = require('../services/query.monitor.service');
+const config = require('../config/config');
+const logger = require('../utils/logger');
+const { useDatabase, createUser, authHeader } = require('./helpers');
+
+useDatabase();
+
+describe('slow query monitoring', () => {
+  const { thresholdMs } = config.mongodb.slowQueries;
+  let client;
+  let warn;
+  let requestId = 0;
+
+  beforeAll(() => {
+    // A stand-in for the MongoClient's command monitoring events
+    client = new EventEmitter();
+    QueryMonitorService.watch(client);
+  });
+
+  beforeEach(() => {
+    warn = jest.spyOn(logger, 'warn').mockImplementation(() => {});
+  });
+
+  afterEach(() => {
+    warn.mockRestore();
+  });
+
+  // Emit a command taking durationMs, as the driver reports it
+  const runCommand = (commandName, command, durationMs, outcome = 'commandSucceeded') => {
+    requestId += 1;
+    client.emit('commandStarted', { connectionId: 1, requestId, commandName, command: { [commandName]: 'users', ...command } });
+    client.emit(outcome, { connectionId: 1, requestId, commandName, duration: durationMs });
+  };
+
+  const slowQueryLogs = () => warn.mock.calls.filter(([message]) => message === 'Slow MongoDB query');
+
+  it('logs a query slower than the threshold with its filter shape only', () => {
+    runCommand('find', { filter: { email: 'patient@example.com', age: { $gt: 40 }, role: { $in: ['patient', 'doctor'] } } }, thresholdMs + 250);
+
+    expect(slowQueryLogs()).toHaveLength(1);
+    const [, details] = slowQueryLogs()[0];
+    expect(details).toEqual({
+      collection: 'users',
+      operation: 'find',
+      durationMs: thresholdMs + 250,
+      filter: { email: '?', age: { $gt: '?' }, role: { $in: '?' } },
+      failed: false
+    });
+    expect(JSON.stringify(details)).not.toContain('patient@example.com');
+  });
+
+  it('ignores a query under the threshold', () => {
+    runCommand('find', { filter: { email: 'patient@example.com' } }, thresholdMs - 1);
+
+    expect(slowQueryLogs()).toHaveLength(0);
+  });
+
+  it('ignores commands that aren\'t collection queries', () => {
+    runCommand('hello', {}, thresholdMs + 1000);
+
+    expect(slowQueryLogs()).toHaveLength(0);
+  });
+
+  it('logs a slow failed query', () => {
+    runCommand('aggregate', { pipeline: [{ $match: { doctorId: 'abc' } }, { $group: { _id: '$status' } }] }, thresholdMs, 'commandFailed');
+
+    const [, details] = slowQueryLogs()[0];
+    expect(details.failed).toBe(true);
+    expect(details.filter).toEqual([{ $match: { doctorId: '?' } }, { $group: { _id: '?' } }]);
+  });
+
+  it('groups slow queries by shape in the admin metrics', async () => {
+    runCommand('update', { updates: [{ q: { _id: 'a' }, u: { $set: { status: 'x' } } }] }, thresholdMs + 100);
+    runCommand('update', { updates: [{ q: { _id: 'b' }, u: { $set: { status: 'y' } } }] }, thresholdMs + 300);
+
+    const res = await request(app)
+      .get('/api/v1/admin/metrics')
+      .set('Authorization', await authHeader(await createUser({ role: 'admin' })));
+
+    expect(res.status).toBe(200);
+    const update = res.body.data.slowQueries.queries.find(query => query.operation === 'update');
+    expect(update).toMatchObject({
+      collection: 'users',
+      filter: { _id: '?' },
+      count: 2,
+      maxMs: thresholdMs + 300,
+      avgMs: thresholdMs + 200
+    });
+  });
+});
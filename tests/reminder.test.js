@@ -0,0 +1,280 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Notification = require('../models/notification.model');
+const User = require('../models/user.model');
+const awsService = require('../services/aws.service');
+const notificationService = require('../services/notification.service');
+const { toZonedDateTime } = require('../utils/helpers');
+const { useDatabase, createUser, createDoctor, authHeader } = require('./helpers');
+
+useDatabase();
+
+const MINUTE = 60 * 1000;
+
+// A fixed-offset zone where it is around midday now, so appointments close
+// to now never cross midnight
+const middayTimeZone = () => {
+  const offset = 12 - new Date().getUTCHours();
+  if (offset === 0) return 'UTC';
+  // Etc/GMT names have the sign reversed
+  return offset > 0 ? `Etc/GMT-${offset}` : `Etc/GMT+${-offset}`;
+};
+
+const consented = { granted: true, grantedAt: new Date() };
+
+afterEach(() => {
+  jest.clearAllMocks();
+});
+
+describe('reminder settings', () => {
+  const settingsFor = async (user) => request(app)
+    .get('/api/v1/users/me/reminder-settings')
+    .set('Authorization', await authHeader(user));
+
+  const save = async (user, body) => request(app)
+    .put('/api/v1/users/me/reminder-settings')
+    .set('Authorization', await authHeader(user))
+    .send(body);
+
+  it('returns the role defaults until the user saves their own', async () => {
+    const res = await settingsFor(await createUser());
+
+    expect(res.status).toBe(200);
+    expect(res.body).toMatchObject({ channels: ['email', 'sms'], leadTimesMinutes: [1440], isDefault: true });
+    expect(res.body.options.leadTimesMinutes).toEqual([15, 60, 120, 1440, 2880]);
+  });
+
+  it('saves channels and lead times, latest first', async () => {
+    const user = await createUser();
+
+    const res = await save(user, { channels: ['email', 'in-app'], leadTimesMinutes: [60, 1440] });
+
+    expect(res.status).toBe(200);
+    expect((await settingsFor(user)).body).toMatchObject({
+      channels: ['email', 'in-app'],
+      leadTimesMinutes: [1440, 60],
+      isDefault: false
+    });
+  });
+
+  it('turns reminders off with no channels', async () => {
+    const user = await createUser();
+
+    const res = await save(user, { channels: [], leadTimesMinutes: [] });
+
+    expect(res.status).toBe(200);
+    expect(res.body.settings.channels).toEqual([]);
+  });
+
+  it.each([
+    [{ channels: ['sms'] }, { channels: 'SMS reminders need SMS consent; grant it in your profile first' }],
+    [{ channels: ['email', 'email'] }, { channels: 'Channels must not repeat' }],
+    [{ channels: ['pigeon'] }, { 'channels[0]': 'Channels must be among: email, sms, push, in-app' }],
+    [{ leadTimesMinutes: [45] }, { leadTimesMinutes: 'Lead times must be among: 15, 60, 120, 1440, 2880' }],
+    [{ leadTimesMinutes: [15, 60, 120, 1440] }, { leadTimesMinutes: 'At most 3 lead times are allowed' }],
+    [{ channels: ['email'], leadTimesMinutes: [] }, { leadTimesMinutes: 'Pick at least one lead time, or no channels to turn reminders off' }]
+  ])('rejects %j', async (body, errors) => {
+    const res = await save(await createUser(), body);
+
+    expect(res.status).toBe(400);
+    expect(res.body.errors).toEqual(errors);
+  });
+});
+
+describe('reminder worker', () => {
+  let doctor;
+  let patient;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    patient = await createUser({ smsConsent: consented });
+  });
+
+  // A confirmed appointment starting startsIn minutes from now
+  const book = (startsIn) => {
+    const timeZone = middayTimeZone();
+    const start = toZonedDateTime(new Date(Date.now() + startsIn * MINUTE), timeZone);
+    const end = toZonedDateTime(new Date(Date.now() + (startsIn + 30) * MINUTE), timeZone);
+    return Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: start.date,
+      startTime: start.time,
+      endTime: end.time,
+      timeZone,
+      type: 'video',
+      reason: 'Check-up',
+      status: 'confirmed'
+    });
+  };
+
+  const remindersTo = async (user) => (await Notification.find({ userId: user._id, title: 'Appointment Reminder' }))
+    .map(notification => notification.type)
+    .sort();
+
+  it('reminds on every default channel the patient consented to', async () => {
+    await book(60);
+
+    await notificationService.sendUpcomingReminders();
+
+    expect(await remindersTo(patient)).toEqual(['email', 'sms']);
+    expect(awsService.sendSMS).toHaveBeenCalledTimes(1);
+  });
+
+  it('skips SMS for a patient who turned it off but kept email', async () => {
+    await User.updateOne(
+      { _id: patient._id },
+      { reminderSettings: { channels: ['email'], leadTimesMinutes: [120], updatedAt: new Date() } }
+    );
+    await book(60);
+
+    await notificationService.sendUpcomingReminders();
+
+    expect(await remindersTo(patient)).toEqual(['email']);
+    expect(awsService.sendSMS).not.toHaveBeenCalled();
+    expect(awsService.sendEmail).toHaveBeenCalledWith(patient.email, 'Appointment Reminder', expect.any(String), expect.any(String));
+  });
+
+  it('waits for the patient\'s lead time', async () => {
+    await User.updateOne(
+      { _id: patient._id },
+      { reminderSettings: { channels: ['email'], leadTimesMinutes: [15], updatedAt: new Date() } }
+    );
+    await book(60);
+
+    await notificationService.sendUpcomingReminders();
+
+    expect(await remindersTo(patient)).toEqual([]);
+  });
+
+  it('reminds once per lead time', async () => {
+    const appointment = await book(60);
+
+    await notificationService.sendUpcomingReminders();
+    await notificationService.sendUpcomingReminders();
+
+    expect(await remindersTo(patient)).toEqual(['email', 'sms']);
+    expect([...(await Appointment.findById(appointment._id)).remindersSent.patient]).toEqual([1440]);
+  });
+
+  it('sends nothing to a patient who turned reminders off', async () => {
+    await User.updateOne(
+      { _id: patient._id },
+      { reminderSettings: { channels: [], leadTimesMinutes: [], updatedAt: new Date() } }
+    );
+    await book(60);
+
+    await notificationService.sendUpcomingReminders();
+
+    expect(await remindersTo(patient)).toEqual([]);
+  });
+});
+
+describe('prep instructions in reminders', () => {
+  const fasting = 'Do not eat for 8 hours before the appointment.';
+  let doctorUser;
+  let doctor;
+  let patient;
+  let adminAuth;
+
+  beforeEach(async () => {
+    ({ user: doctorUser, doctor } = await createDoctor({ specializations: ['General Practice', 'Gastroenterology'] }));
+    patient = await createUser();
+    adminAuth = await authHeader(await createUser({ role: 'admin' }));
+    await User.updateOne(
+      { _id: { $in: [patient._id, doctorUser._id] } },
+      { reminderSettings: { channels: ['email'], leadTimesMinutes: [120], updatedAt: new Date() } }
+    );
+  });
+
+  const addInstruction = (fields) => request(app)
+    .post('/api/v1/admin/prep-instructions')
+    .set('Authorization', adminAuth)
+    .send(fields);
+
+  // A confirmed appointment starting an hour from now
+  const book = (type = 'in-person') => {
+    const timeZone = middayTimeZone();
+    const start = toZonedDateTime(new Date(Date.now() + 60 * MINUTE), timeZone);
+    const end = toZonedDateTime(new Date(Date.now() + 90 * MINUTE), timeZone);
+    return Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: start.date,
+      startTime: start.time,
+      endTime: end.time,
+      timeZone,
+      type,
+      reason: 'Check-up',
+      status: 'confirmed'
+    });
+  };
+
+  const reminderTo = (user) => Notification.findOne({ userId: user._id, title: 'Appointment Reminder' });
+
+  it('adds a fasting-required specialty\'s prep note to the patient\'s reminder', async () => {
+    await addInstruction({ specialty: 'gastroenterology', instructions: fasting }).expect(201);
+    await book();
+
+    await notificationService.sendUpcomingReminders();
+
+    const reminder = await reminderTo(patient);
+    expect(reminder.message).toMatch(new RegExp(`Before your visit: ${fasting}$`));
+    expect(reminder.data).toEqual({ prepInstructions: fasting });
+    expect(awsService.sendEmail).toHaveBeenCalledWith(patient.email, 'Appointment Reminder', expect.stringContaining(fasting), expect.stringContaining(fasting));
+  });
+
+  it('leaves the doctor\'s reminder without the prep note', async () => {
+    await addInstruction({ specialty: 'Gastroenterology', instructions: fasting }).expect(201);
+    await book();
+
+    await notificationService.sendUpcomingReminders();
+
+    const reminder = await reminderTo(doctorUser);
+    expect(reminder).not.toBeNull();
+    expect(reminder.message).not.toContain(fasting);
+  });
+
+  it('sends the plain reminder when no instructions apply', async () => {
+    await addInstruction({ specialty: 'Cardiology', instructions: 'Bring your ECG.' }).expect(201);
+    await addInstruction({ specialty: 'Gastroenterology', instructions: fasting, isActive: false }).expect(201);
+    await book();
+
+    await notificationService.sendUpcomingReminders();
+
+    const reminder = await reminderTo(patient);
+    expect(reminder.message).not.toContain('Before your visit');
+    expect(reminder.data).toBeFalsy();
+  });
+
+  it('prefers the instructions for the specialty and appointment type', async () => {
+    await addInstruction({ appointmentType: 'video', instructions: 'Test your camera.' }).expect(201);
+    await addInstruction({ specialty: 'Gastroenterology', instructions: fasting }).expect(201);
+    await addInstruction({ specialty: 'Gastroenterology', appointmentType: 'video', instructions: 'Have your food diary at hand.' }).expect(201);
+    await book('video');
+
+    await notificationService.sendUpcomingReminders();
+
+    expect((await reminderTo(patient)).data).toEqual({ prepInstructions: 'Have your food diary at hand.' });
+  });
+
+  describe('POST /api/v1/admin/prep-instructions', () => {
+    it('needs a specialty or an appointment type', async () => {
+      const res = await addInstruction({ instructions: fasting });
+
+      expect(res.status).toBe(400);
+      expect(res.body.error).toMatch(/A specialty, an appointment type or both is required/);
+    });
+
+    it('keeps one instruction per specialty and type, ignoring case', async () => {
+      await addInstruction({ specialty: 'Gastroenterology', instructions: fasting }).expect(201);
+
+      const res = await addInstruction({ specialty: 'gastroenterology', instructions: 'Something else' });
+
+      expect(res.status).toBe(409);
+    });
+  });
+});
@@ -0,0 +1,161 @@
+jest.mock('../services/aws.service');
+jest.mock('../services/aws/s3.service');
+
+const mongoose = require('mongoose');
+const Appointment = require('../models/appointment.model');
+const Document = require('../models/document.model');
+const Notification = require('../models/notification.model');
+const VideoSession = require('../models/video.model');
+const RetentionService = require('../services/retention.service');
+const s3Service = require('../services/aws/s3.service');
+const config = require('../config/config');
+const { useDatabase, createUser, createDoctor, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('data retention', () => {
+  const DAY_MS = 24 * 60 * 60 * 1000;
+  const policies = config.retention.policies;
+  let user;
+  let doctor;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    user = await createUser();
+    s3Service.deleteFile.mockResolvedValue();
+  });
+
+  afterEach(() => {
+    config.retention.policies = policies;
+    s3Service.deleteFile.mockReset();
+  });
+
+  // Only apply the given policies for the test
+  const usePolicies = (overrides) => {
+    config.retention.policies = overrides;
+  };
+
+  // Move a record's creation time the given number of days into the past
+  const age = async (model, record, days) => {
+    await model.collection.updateOne(
+      { _id: record._id },
+      { $set: { createdAt: new Date(Date.now() - days * DAY_MS) } }
+    );
+    return record;
+  };
+
+  const notify = () => Notification.create({ userId: user._id, title: 'Reminder', message: 'See you soon', type: 'in-app' });
+
+  const startSession = (status) => VideoSession.create({
+    appointmentId: new mongoose.Types.ObjectId(),
+    doctorId: doctor._id,
+    patientId: user._id,
+    roomId: `room-${status}`,
+    sessionToken: `token-${status}`,
+    status
+  });
+
+  const upload = () => Document.create({
+    appointmentId: new mongoose.Types.ObjectId(),
+    uploadedBy: user._id,
+    key: `documents/${new mongoose.Types.ObjectId()}.pdf`,
+    fileName: 'results.pdf',
+    contentType: 'application/pdf'
+  });
+
+  it('deletes records past their retention age and keeps newer ones', async () => {
+    usePolicies({ notifications: { days: 90, action: 'delete' } });
+    const old = await age(Notification, await notify(), 91);
+    const recent = await age(Notification, await notify(), 89);
+
+    const results = await RetentionService.purgeExpiredData({ dryRun: false });
+
+    expect(results).toEqual([expect.objectContaining({ type: 'notifications', action: 'delete', count: 1, dryRun: false })]);
+    expect(await Notification.findById(old._id)).toBeNull();
+    expect(await Notification.findById(recent._id)).not.toBeNull();
+  });
+
+  it('only counts what would go in a dry run', async () => {
+    usePolicies({ notifications: { days: 90, action: 'delete' } });
+    await age(Notification, await notify(), 91);
+
+    const results = await RetentionService.purgeExpiredData({ dryRun: true });
+
+    expect(results[0]).toMatchObject({ count: 1, dryRun: true });
+    expect(await Notification.countDocuments()).toBe(1);
+  });
+
+  it('moves archived records to the archive collection', async () => {
+    usePolicies({ videoSessions: { days: 30, action: 'archive' } });
+    const ended = await age(VideoSession, await startSession('ended'), 31);
+
+    await RetentionService.purgeExpiredData({ dryRun: false });
+
+    expect(await VideoSession.findById(ended._id)).toBeNull();
+    const archived = await mongoose.connection.collection('videosessions_archive').findOne({ _id: ended._id });
+    expect(archived).toMatchObject({ status: 'ended', archivedAt: expect.any(Date) });
+  });
+
+  it('keeps video sessions that are still scheduled or running however old', async () => {
+    usePolicies({ videoSessions: { days: 30, action: 'delete' } });
+    await age(VideoSession, await startSession('scheduled'), 31);
+    await age(VideoSession, await startSession('active'), 31);
+
+    await RetentionService.purgeExpiredData({ dryRun: false });
+
+    expect(await VideoSession.countDocuments()).toBe(2);
+  });
+
+  describe('medical documents', () => {
+    it('are kept until the legal minimum whatever is configured', async () => {
+      usePolicies({ medicalDocuments: { days: 30, action: 'delete' } });
+      await age(Document, await upload(), 365);
+
+      const results = await RetentionService.purgeExpiredData({ dryRun: false });
+
+      expect(results[0].count).toBe(0);
+      expect(await Document.countDocuments()).toBe(1);
+      expect(s3Service.deleteFile).not.toHaveBeenCalled();
+      expect(RetentionService.getRetentionDays('medicalDocuments', { days: 30 })).toBe(config.retention.medicalRecordMinDays);
+    });
+
+    it('are deleted along with their files past the legal minimum', async () => {
+      usePolicies({ medicalDocuments: { days: 30, action: 'delete' } });
+      const old = await age(Document, await upload(), config.retention.medicalRecordMinDays + 1);
+
+      await RetentionService.purgeExpiredData({ dryRun: false });
+
+      expect(await Document.countDocuments()).toBe(0);
+      expect(s3Service.deleteFile).toHaveBeenCalledWith(old.key);
+    });
+  });
+
+  it('redacts the chat content of old completed appointments', async () => {
+    usePolicies({ chatContent: { days: 180, action: 'redact' } });
+    const appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: user._id,
+      date: daysFromToday(-181),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      status: 'completed'
+    });
+
+    const results = await RetentionService.purgeExpiredData({ dryRun: false });
+
+    expect(results[0]).toMatchObject({ type: 'chatContent', count: 1 });
+    expect((await Appointment.findById(appointment._id)).chatPurge).toMatchObject({ reason: 'retention' });
+  });
+
+  it('skips policies with an action their data type does not support', async () => {
+    usePolicies({ notifications: { days: 90, action: 'shred' }, chatMessages: { days: 90, action: 'redact' } });
+    await age(Notification, await notify(), 91);
+
+    const results = await RetentionService.purgeExpiredData({ dryRun: false });
+
+    expect(results).toEqual([]);
+    expect(await Notification.countDocuments()).toBe(1);
+  });
+});
@@ -0,0 +1,122 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const Review = require('../models/review.model');
+const config = require('../config/config');
+const { getRatingSummary } = require('../services/review.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('getRatingSummary', () => {
+  const { minReviewsForRating } = config.reviews;
+
+  afterEach(() => {
+    config.reviews.minReviewsForRating = minReviewsForRating;
+  });
+
+  it('withholds the average below the minimum number of reviews', () => {
+    config.reviews.minReviewsForRating = 3;
+
+    expect(getRatingSummary({ rating: 4.6, totalReviews: 2 })).toEqual({ average: null, count: 2, label: 'Not enough reviews' });
+  });
+
+  it('shows the average, to one decimal, from the minimum on', () => {
+    config.reviews.minReviewsForRating = 3;
+
+    expect(getRatingSummary({ rating: 4.66, totalReviews: 3 })).toEqual({ average: 4.7, count: 3, label: null });
+  });
+});
+
+describe('reviews', () => {
+  let doctor;
+  let patient;
+  let patientAuth;
+  let slot = 0;
+
+  beforeEach(async () => {
+    ({ doctor } = await createDoctor());
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+  });
+
+  const visit = (fields = {}) => {
+    slot += 1;
+    return Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(-slot),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up',
+      status: 'completed',
+      paymentStatus: 'paid',
+      ...fields
+    });
+  };
+
+  const review = (appointment, rating) => request(app)
+    .post('/api/v1/reviews')
+    .set('Authorization', patientAuth)
+    .send({ doctorId: doctor._id.toString(), appointmentId: appointment._id.toString(), rating, comment: 'Helpful' });
+
+  const stats = async () => (await request(app).get(`/api/v1/reviews/doctor/${doctor._id}`).expect(200)).body.stats;
+
+  // The doctor's rating is recalculated after the review is saved
+  const doctorRating = async (totalReviews) => {
+    for (let attempt = 0; attempt < 50; attempt++) {
+      const current = await Doctor.findById(doctor._id);
+      if (current.totalReviews === totalReviews) return current;
+      await new Promise(resolve => setTimeout(resolve, 20));
+    }
+    throw new Error('The doctor\'s rating was not updated');
+  };
+
+  it('marks a review of a completed, paid visit as verified', async () => {
+    const res = await review(await visit(), 5);
+
+    expect(res.status).toBe(201);
+    expect(res.body.review.isVerified).toBe(true);
+  });
+
+  it('does not verify a review of an unpaid visit', async () => {
+    const res = await review(await visit({ paymentStatus: 'unpaid' }), 5);
+
+    expect(res.status).toBe(201);
+    expect(res.body.review.isVerified).toBe(false);
+  });
+
+  it('refuses a review of a visit that has not taken place', async () => {
+    const res = await review(await visit({ status: 'confirmed', date: daysFromToday(2) }), 5);
+
+    expect(res.status).toBe(404);
+    expect(await Review.countDocuments()).toBe(0);
+  });
+
+  it('averages only verified reviews', async () => {
+    for (const rating of [5, 4, 3]) {
+      await review(await visit(), rating).expect(201);
+    }
+    await review(await visit({ paymentStatus: 'unpaid' }), 1).expect(201);
+
+    expect(await stats()).toMatchObject({ averageRating: 4, ratingLabel: null, totalReviews: 4, verifiedReviews: 3 });
+    expect(await doctorRating(3)).toMatchObject({ rating: 4 });
+  });
+
+  it('shows "Not enough reviews" below the threshold', async () => {
+    for (const rating of [5, 4]) {
+      await review(await visit(), rating).expect(201);
+    }
+    // Unverified reviews don't help reach it
+    await review(await visit({ paymentStatus: 'unpaid' }), 5).expect(201);
+
+    expect(await stats()).toMatchObject({ averageRating: null, ratingLabel: 'Not enough reviews', verifiedReviews: 2 });
+    await doctorRating(2);
+    const profile = await request(app).get('/api/v1/doctors/getById').query({ id: doctor._id.toString() });
+    expect(profile.body.doctor.ratingSummary).toEqual({ average: null, count: 2, label: 'Not enough reviews' });
+  });
+});
@@ -0,0 +1,77 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const User = require('../models/user.model');
+const { getMatchRank } = require('../services/search.service');
+const { useDatabase, createDoctor } = require('./helpers');
+
+useDatabase();
+
+describe('GET /api/v1/search', () => {
+  // A doctor whose user has the given name
+  const createNamedDoctor = async (firstName, lastName, overrides = {}) => {
+    const { user, doctor } = await createDoctor(overrides);
+    await User.updateOne({ _id: user._id }, { $set: { firstName, lastName } });
+    return doctor;
+  };
+
+  const search = (query) => request(app)
+    .get('/api/v1/search')
+    .query(query);
+
+  const section = (res, type) => res.body.sections.find(entry => entry.type === type).results;
+
+  it('returns doctors, specialties and symptoms in typed sections', async () => {
+    await createNamedDoctor('Anna', 'Painter');
+    await createNamedDoctor('Bram', 'de Vries', { specializations: ['pain medicine'] });
+
+    const res = await search({ q: 'pain' });
+
+    expect(res.status).toBe(200);
+    expect(res.body.sections.map(entry => entry.type)).toEqual(['doctors', 'specialties', 'symptoms']);
+    expect(section(res, 'doctors').map(doctor => [doctor.lastName, doctor.matchedOn])).toEqual([
+      ['Painter', 'name'],
+      ['de Vries', 'specialization']
+    ]);
+    expect(section(res, 'specialties')).toEqual([{ name: 'pain medicine' }]);
+    expect(section(res, 'symptoms')).toContainEqual({ symptom: 'back pain', specialties: ['Orthopedist', 'Rheumatologist'] });
+  });
+
+  it('ranks exact matches first and limits each section', async () => {
+    const res = await search({ q: 'pain', limit: 2 });
+
+    expect(section(res, 'symptoms').map(result => result.symptom)).toEqual(['abdominal pain', 'back pain']);
+
+    const exact = await search({ q: 'migraine' });
+    expect(section(exact, 'symptoms')[0]).toEqual({ symptom: 'migraine', specialties: ['Neurologist'] });
+  });
+
+  it('leaves out doctors who are not verified', async () => {
+    await createNamedDoctor('Anna', 'Painter', { verificationStatus: 'pending' });
+
+    const res = await search({ q: 'painter' });
+
+    expect(section(res, 'doctors')).toEqual([]);
+  });
+
+  it.each([
+    [{}, 'q'],
+    [{ q: 'p' }, 'q'],
+    [{ q: 'pain', limit: 0 }, 'limit']
+  ])('rejects %o', async (query, field) => {
+    const res = await search(query);
+
+    expect(res.status).toBe(400);
+    expect(res.body.errors.map(error => error.path)).toContain(field);
+  });
+
+  describe('getMatchRank', () => {
+    it('ranks exact, word-prefix and contained matches', () => {
+      expect(getMatchRank('cardiology', 'cardiology')).toBe(0);
+      expect(getMatchRank('chest pain', 'pain')).toBe(1);
+      expect(getMatchRank('cardiology', 'diolog')).toBe(2);
+      expect(getMatchRank('cardiology', 'neuro')).toBeNull();
+    });
+  });
+});
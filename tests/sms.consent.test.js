@@ -0,0 +1,104 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Notification = require('../models/notification.model');
+const User = require('../models/user.model');
+const awsService = require('../services/aws.service');
+const emailService = require('../services/email.service');
+const notificationService = require('../services/notification.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+afterEach(() => {
+  jest.clearAllMocks();
+});
+
+describe('SMS notifications', () => {
+  // The last confirmation reminder goes out by email and SMS
+  const sendFinalReminder = async (smsConsent) => {
+    const { user, doctor } = await createDoctor();
+    await User.updateOne({ _id: user._id }, { smsConsent });
+    const appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: (await createUser())._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up'
+    });
+    await notificationService.sendPendingConfirmationReminder(appointment, {
+      deadline: new Date(Date.now() + 60 * 60 * 1000),
+      final: true
+    });
+    return { user, sent: await Notification.find({ userId: user._id }) };
+  };
+
+  it('keeps the SMS in the app for a user who has not consented, and still emails', async () => {
+    const { user, sent } = await sendFinalReminder({ granted: false });
+
+    expect(awsService.sendSMS).not.toHaveBeenCalled();
+    expect(awsService.sendEmail).toHaveBeenCalledWith(user.email, expect.any(String), expect.any(String), expect.any(String));
+    expect(sent.map(notification => notification.type).sort()).toEqual(['email', 'in-app']);
+  });
+
+  it('texts a user who has consented', async () => {
+    const { user, sent } = await sendFinalReminder({ granted: true, grantedAt: new Date() });
+
+    expect(awsService.sendSMS).toHaveBeenCalledWith(`+31${user.phone.number}`, expect.any(String));
+    expect(sent.map(notification => notification.type).sort()).toEqual(['email', 'sms']);
+  });
+});
+
+describe('SMS consent', () => {
+  it('is recorded at registration', async () => {
+    jest.spyOn(emailService, 'sendOTP').mockResolvedValue();
+
+    const res = await request(app)
+      .post('/api/v1/auth/register')
+      .send({
+        email: 'consenting@example.com',
+        phone: { countryCode: '+31', number: '612345678' },
+        firstName: 'New',
+        lastName: 'Patient',
+        smsConsent: true
+      });
+
+    expect(res.status).toBe(201);
+    const { smsConsent } = await User.findOne({ email: 'consenting@example.com' });
+    expect(smsConsent.granted).toBe(true);
+    expect(smsConsent.grantedAt).toBeInstanceOf(Date);
+    jest.restoreAllMocks();
+  });
+
+  it('is off unless given', async () => {
+    const user = await createUser();
+
+    const res = await request(app)
+      .get('/api/v1/users/profile')
+      .set('Authorization', await authHeader(user));
+
+    expect(res.body.smsConsent).toMatchObject({ granted: false });
+  });
+
+  it('can be given and withdrawn in the profile', async () => {
+    const user = await createUser();
+    const auth = await authHeader(user);
+    const update = (smsConsent) => request(app)
+      .put('/api/v1/users/profile')
+      .set('Authorization', auth)
+      .send({ smsConsent });
+
+    const granted = await update(true);
+
+    expect(granted.status).toBe(200);
+    expect(granted.body.user.smsConsent).toMatchObject({ granted: true, grantedAt: expect.any(String) });
+
+    const withdrawn = await update(false);
+
+    expect(withdrawn.body.user.smsConsent).toMatchObject({ granted: false, withdrawnAt: expect.any(String) });
+  });
+});
@@ -0,0 +1,72 @@
+const { snsClient } = require('../config/aws.config');
+const snsService = require('../services/aws/sns.service');
+const config = require('../config/config');
+const { buildSmsAttributes, getSenderIdError, getSmsConfigErrors } = require('../utils/sms');
+
+describe('SMS sender ID', () => {
+  const defaults = { ...config.sms };
+
+  afterEach(() => {
+    Object.assign(config.sms, defaults);
+    jest.restoreAllMocks();
+  });
+
+  describe('snsService.sendSMS', () => {
+    it('sets the sender ID attribute on the publish input', async () => {
+      config.sms.senderId = 'MedConnect';
+      const send = jest.spyOn(snsClient, 'send').mockResolvedValue({ MessageId: 'message-1' });
+
+      await snsService.sendSMS('+31612345678', 'Your code is 123456');
+
+      expect(send).toHaveBeenCalledTimes(1);
+      const { input } = send.mock.calls[0][0];
+      expect(input).toMatchObject({ PhoneNumber: '+31612345678', Message: 'Your code is 123456' });
+      expect(input.MessageAttributes['AWS.SNS.SMS.SenderID']).toEqual({ DataType: 'String', StringValue: 'MedConnect' });
+      expect(input.MessageAttributes['AWS.SNS.SMS.SMSType']).toEqual({ DataType: 'String', StringValue: 'Transactional' });
+    });
+  });
+
+  describe('buildSmsAttributes', () => {
+    it('uses the region\'s origination number instead of a sender ID where sender IDs are not supported', () => {
+      config.sms.regions = { '+1': { senderId: null, originationNumber: '+12025550123' } };
+
+      const attributes = buildSmsAttributes('+12025550199');
+
+      expect(attributes).not.toHaveProperty(['AWS.SNS.SMS.SenderID']);
+      expect(attributes['AWS.MM.SMS.OriginationNumber']).toEqual({ DataType: 'String', StringValue: '+12025550123' });
+    });
+
+    it('prefers the longest matching calling code', () => {
+      config.sms.regions = { '+4': { senderId: 'Europe' }, '+44': { senderId: 'Britain' } };
+
+      expect(buildSmsAttributes('+447700900123')['AWS.SNS.SMS.SenderID'].StringValue).toBe('Britain');
+      expect(buildSmsAttributes('+4915112345678')['AWS.SNS.SMS.SenderID'].StringValue).toBe('Europe');
+    });
+
+    it('leaves an invalid sender ID off rather than failing the message', () => {
+      config.sms.senderId = 'Med Connect Clinic';
+
+      expect(buildSmsAttributes('+31612345678')).not.toHaveProperty(['AWS.SNS.SMS.SenderID']);
+    });
+  });
+
+  describe('validation', () => {
+    it.each(['MEDCONN', 'Clinic24', 'A'])('accepts %p', (senderId) => {
+      expect(getSenderIdError(senderId)).toBeNull();
+    });
+
+    it.each(['', '123456', 'MedConnectNL', 'Med-Conn'])('rejects %p', (senderId) => {
+      expect(getSenderIdError(senderId)).toBe(`SMS sender ID "${senderId}" must be 1-11 letters or digits with at least one letter`);
+    });
+
+    it('reports every misconfigured setting with where it is set', () => {
+      config.sms.smsType = 'Urgent';
+      config.sms.regions = { '+1': { senderId: null, originationNumber: '2025550123' } };
+
+      expect(getSmsConfigErrors()).toEqual([
+        'default: SMS type must be one of Transactional, Promotional',
+        '+1: SMS origination number must be in E.164 format'
+      ]);
+    });
+  });
+});
@@ -0,0 +1,169 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Notification = require('../models/notification.model');
+const Survey = require('../models/survey.model');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('post-consultation surveys', () => {
+  let doctor;
+  let doctorAuth;
+  let patient;
+  let patientAuth;
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    doctorAuth = await authHeader(user);
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+  });
+
+  const book = (fields = {}) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date: daysFromToday(-1),
+    startTime: '10:00',
+    endTime: '10:30',
+    type: 'video',
+    reason: 'Check-up',
+    status: 'completed',
+    ...fields
+  });
+
+  const answers = { waitTime: 4, communication: 5, wouldRecommend: true };
+
+  const submit = (appointment, fields = {}, authorization = patientAuth) => request(app)
+    .post('/api/v1/surveys')
+    .set('Authorization', authorization)
+    .send({ appointmentId: appointment._id.toString(), ...answers, ...fields });
+
+  describe('POST /api/v1/surveys', () => {
+    it('stores the patient\'s answers for a completed appointment', async () => {
+      const appointment = await book();
+
+      const res = await submit(appointment, { comment: 'Very thorough' });
+
+      expect(res.status).toBe(201);
+      expect(res.body).toMatchObject({ ...answers, comment: 'Very thorough' });
+      expect(await Survey.findOne({ appointmentId: appointment._id })).toMatchObject({
+        doctorId: doctor._id,
+        patientId: patient._id
+      });
+    });
+
+    it('accepts one survey per appointment', async () => {
+      const appointment = await book();
+      await submit(appointment).expect(201);
+
+      const res = await submit(appointment, { waitTime: 1 });
+
+      expect(res.status).toBe(409);
+      expect(await Survey.countDocuments()).toBe(1);
+    });
+
+    it('refuses an appointment that is not completed', async () => {
+      const appointment = await book({ status: 'confirmed', date: daysFromToday(2) });
+
+      expect((await submit(appointment)).status).toBe(404);
+    });
+
+    it('refuses another patient\'s appointment', async () => {
+      const appointment = await book();
+
+      const res = await submit(appointment, {}, await authHeader(await createUser()));
+
+      expect(res.status).toBe(404);
+    });
+
+    it('maps invalid answers to their fields', async () => {
+      const appointment = await book();
+
+      const res = await submit(appointment, { waitTime: 6, wouldRecommend: 'maybe' });
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors).toEqual({
+        waitTime: 'Wait time rating must be between 1 and 5',
+        wouldRecommend: 'Would recommend must be true or false'
+      });
+    });
+  });
+
+  describe('quality metrics', () => {
+    beforeEach(async () => {
+      const surveys = [
+        { waitTime: 2, communication: 4, wouldRecommend: true },
+        { waitTime: 3, communication: 5, wouldRecommend: true },
+        { waitTime: 5, communication: 3, wouldRecommend: false }
+      ];
+      for (const [i, survey] of surveys.entries()) {
+        await submit(await book({ startTime: `1${i}:00`, endTime: `1${i}:30` }), survey).expect(201);
+      }
+      // Another doctor's survey stays out of this doctor's metrics
+      const { doctor: other } = await createDoctor();
+      await Survey.create({
+        appointmentId: (await book({ doctorId: other._id, startTime: '15:00', endTime: '15:30' }))._id,
+        doctorId: other._id,
+        patientId: patient._id,
+        waitTime: 1,
+        communication: 1,
+        wouldRecommend: false
+      });
+    });
+
+    const expected = {
+      responses: 3,
+      averageWaitTime: 3.33,
+      averageCommunication: 4,
+      wouldRecommendPercent: 66.67
+    };
+
+    it('shows a doctor their own averages', async () => {
+      const res = await request(app)
+        .get('/api/v1/surveys/metrics/me')
+        .set('Authorization', doctorAuth);
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ doctorId: doctor._id.toString(), ...expected });
+    });
+
+    it('shows admins every doctor', async () => {
+      const res = await request(app)
+        .get('/api/v1/surveys/metrics')
+        .set('Authorization', await authHeader(await createUser({ role: 'admin' })));
+
+      expect(res.status).toBe(200);
+      expect(res.body.metrics).toHaveLength(2);
+      expect(res.body.metrics[0]).toMatchObject({ doctorId: doctor._id.toString(), ...expected });
+    });
+
+    it('is not shown to patients', async () => {
+      const res = await request(app)
+        .get('/api/v1/surveys/metrics')
+        .set('Authorization', patientAuth);
+
+      expect(res.status).toBe(403);
+    });
+  });
+
+  it('invites the patient when the doctor completes the appointment', async () => {
+    const appointment = await book({ status: 'confirmed' });
+
+    await request(app)
+      .put(`/api/v1/appointments/${appointment._id}/status`)
+      .set('Authorization', doctorAuth)
+      .send({ status: 'completed' })
+      .expect(200);
+
+    let invitation;
+    for (let attempt = 0; attempt < 50 && !invitation; attempt++) {
+      invitation = await Notification.findOne({ userId: patient._id, title: 'How was your consultation?' });
+      if (!invitation) await new Promise(resolve => setTimeout(resolve, 20));
+    }
+    expect(invitation.link).toContain(encodeURIComponent(`/appointments/${appointment._id}/survey`));
+  });
+});
@@ -0,0 +1,77 @@
+const express = require('express');
+const mongoose = require('mongoose');
+const request = require('supertest');
+const { setTimeout: sleep } = require('timers/promises');
+const config = require('../config/config');
+const { getTimeoutMs, getQueryOptions, requestTimeout } = require('../middleware/timeout.middleware');
+const { errorHandler } = require('../utils/error.handler');
+const { useDatabase } = require('./helpers');
+
+useDatabase();
+
+const SlowDoc = mongoose.model('SlowDoc', new mongoose.Schema({ n: Number }));
+
+describe('getTimeoutMs', () => {
+  it('uses the default for ordinary routes', () => {
+    expect(getTimeoutMs('/appointments')).toBe(config.requestTimeouts.defaultMs);
+  });
+
+  it('has no deadline for exports', () => {
+    expect(getTimeoutMs('/admin/reports/financial')).toBe(0);
+    expect(getTimeoutMs('/doctors/me/calendar.ics')).toBe(0);
+  });
+});
+
+describe('requestTimeout', () => {
+  const DEADLINE_MS = 200;
+
+  // An app whose only route is slow, behind a short deadline
+  const slowApp = (method, handler) => {
+    const app = express();
+    app.use(requestTimeout({ defaultMs: DEADLINE_MS, routes: [] }));
+    app[method]('/slow', async (req, res, next) => {
+      try {
+        await handler(req);
+        res.json({ done: true });
+      } catch (error) {
+        next(error);
+      }
+    });
+    app.use(errorHandler);
+    return app;
+  };
+
+  it('cancels a slow query at the deadline', async () => {
+    await SlowDoc.create({ n: 1 });
+    const app = slowApp('get', req => SlowDoc.find({ $where: 'sleep(5000) || true' }).setOptions(getQueryOptions(req)));
+    const startedAt = Date.now();
+
+    const res = await request(app).get('/slow');
+
+    expect(res.status).toBe(503);
+    expect(Date.now() - startedAt).toBeLessThan(2000);
+  });
+
+  it('aborts other slow work at the deadline', async () => {
+    const app = slowApp('get', req => sleep(5000, undefined, { signal: req.signal }));
+    const startedAt = Date.now();
+
+    const res = await request(app).get('/slow');
+
+    expect(res.status).toBe(503);
+    expect(Date.now() - startedAt).toBeLessThan(2000);
+  });
+
+  it('lets writes run past the deadline', async () => {
+    const app = slowApp('post', async (req) => {
+      expect(req.deadline).toBeUndefined();
+      await sleep(DEADLINE_MS * 2);
+      await SlowDoc.create({ n: 2 });
+    });
+
+    const res = await request(app).post('/slow');
+
+    expect(res.status).toBe(200);
+    expect(await SlowDoc.countDocuments({ n: 2 })).toBe(1);
+  });
+});
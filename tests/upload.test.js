@@ -0,0 +1,299 @@
+jest.mock('../services/aws.service');
+jest.mock('../services/aws/s3.service');
+
+const request = require('supertest');
+const app = require('../app');
+const AWSService = require('../services/aws.service');
+const s3Service = require('../services/aws/s3.service');
+const ScanService = require('../services/scan.service');
+const User = require('../models/user.model');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const Document = require('../models/document.model');
+const Notification = require('../models/notification.model');
+const config = require('../config/config');
+const { validateUpload, handleUpload } = require('../services/upload.service');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+const JPEG = Buffer.from([0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10]);
+const PDF = Buffer.from('%PDF-1.7\n');
+// A Windows executable, accepted by no category
+const EXE = Buffer.from('MZ\x90\x00\x03\x00\x00\x00', 'binary');
+
+// A file of the given content, padded with zeros to size bytes
+const fileOf = (content, size, mimetype) => {
+  const buffer = Buffer.alloc(Math.max(size, content.length));
+  content.copy(buffer);
+  return { buffer, originalname: 'upload', mimetype };
+};
+
+// The error validateUpload throws for a file
+const rejectionOf = (file, category) => {
+  try {
+    validateUpload(file, category);
+  } catch (error) {
+    return error;
+  }
+  throw new Error('File was accepted');
+};
+
+describe('upload limits', () => {
+  describe.each([
+    ['profileImage', JPEG, 'image/jpeg'],
+    ['chatAttachment', PDF, 'application/pdf'],
+    ['document', PDF, 'application/pdf'],
+    ['clinicPhoto', JPEG, 'image/jpeg']
+  ])('%s', (category, content, mimetype) => {
+    const { maxSize } = config.uploads[category];
+
+    it('accepts an allowed file at the size limit', () => {
+      expect(validateUpload(fileOf(content, maxSize, mimetype), category)).toBe(mimetype);
+    });
+
+    it('rejects a file over the size limit', () => {
+      const error = rejectionOf(fileOf(content, maxSize + 1, mimetype), category);
+
+      expect(error).toMatchObject({ statusCode: 413, errorCode: 'FILE_TOO_LARGE' });
+    });
+
+    it('rejects a disallowed type', () => {
+      const error = rejectionOf(fileOf(EXE, EXE.length, 'application/octet-stream'), category);
+
+      expect(error).toMatchObject({ statusCode: 415, errorCode: 'UNSUPPORTED_FILE_TYPE' });
+    });
+
+    it('rejects a disallowed file declared as an allowed type', () => {
+      const error = rejectionOf(fileOf(EXE, EXE.length, mimetype), category);
+
+      expect(error).toMatchObject({ statusCode: 415 });
+    });
+  });
+
+  it('rejects a type allowed elsewhere but not in the category', () => {
+    const error = rejectionOf(fileOf(PDF, PDF.length, 'application/pdf'), 'profileImage');
+
+    expect(error).toMatchObject({ statusCode: 415 });
+  });
+
+  it('uploads an accepted file with its sniffed type', async () => {
+    AWSService.uploadToS3.mockResolvedValue('https://bucket.example.com/avatar.jpg');
+
+    const url = await handleUpload(fileOf(JPEG, JPEG.length, 'image/jpeg'), 'profileImage');
+
+    expect(url).toBe('https://bucket.example.com/avatar.jpg');
+    expect(AWSService.uploadToS3).toHaveBeenCalledWith(expect.any(Buffer), 'upload', 'image/jpeg');
+  });
+
+  describe('POST /api/v1/users/profile/picture', () => {
+    let user;
+    let auth;
+
+    beforeEach(async () => {
+      AWSService.uploadToS3.mockReset();
+      user = await createUser();
+      auth = await authHeader(user);
+    });
+
+    const upload = (buffer, contentType) => request(app)
+      .post('/api/v1/users/profile/picture')
+      .set('Authorization', auth)
+      .attach('picture', buffer, { filename: 'avatar', contentType });
+
+    it('rejects a picture over the profile image limit before uploading it', async () => {
+      const res = await upload(Buffer.alloc(config.uploads.profileImage.maxSize + 1), 'image/jpeg');
+
+      expect(res.status).toBe(413);
+      expect(AWSService.uploadToS3).not.toHaveBeenCalled();
+    });
+
+    it('rejects a picture of a disallowed type', async () => {
+      const res = await upload(PDF, 'application/pdf');
+
+      expect(res.status).toBe(415);
+      expect(AWSService.uploadToS3).not.toHaveBeenCalled();
+      expect((await User.findById(user._id)).avatarUrl).toBeFalsy();
+    });
+  });
+});
+
+describe('malware scanning of documents', () => {
+  let patient;
+  let auth;
+  let admin;
+  let appointment;
+
+  beforeEach(async () => {
+    config.uploadScan.enabled = true;
+    s3Service.uploadFile.mockResolvedValue();
+    s3Service.getDownloadUrl.mockResolvedValue('https://bucket.example.com/signed');
+    const { doctor } = await createDoctor();
+    patient = await createUser();
+    auth = await authHeader(patient);
+    admin = await createUser({ role: 'admin' });
+    appointment = await Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: daysFromToday(2),
+      startTime: '10:00',
+      endTime: '10:30',
+      type: 'video',
+      reason: 'Check-up'
+    });
+  });
+
+  afterEach(() => {
+    config.uploadScan.enabled = false;
+    ScanService.setScanner(null);
+    s3Service.getDownloadUrl.mockReset();
+  });
+
+  const upload = () => request(app)
+    .post('/api/v1/documents')
+    .set('Authorization', auth)
+    .field('appointmentId', appointment._id.toString())
+    .attach('file', PDF, { filename: 'results.pdf', contentType: 'application/pdf' });
+
+  const download = (id) => request(app)
+    .get(`/api/v1/documents/${id}`)
+    .set('Authorization', auth);
+
+  // The scan runs after the upload responds
+  const scanned = async (id) => {
+    for (let attempt = 0; attempt < 50; attempt++) {
+      const document = await Document.findById(id);
+      if (document.scan.status !== 'pending') return document;
+      await new Promise(resolve => setTimeout(resolve, 20));
+    }
+    throw new Error('The document was not scanned');
+  };
+
+  it('does not serve a file the scanner finds infected, and tells the admins', async () => {
+    ScanService.setScanner({ name: 'stub', scan: async () => ({ clean: false, threat: 'EICAR-Test-File' }) });
+
+    const res = await upload();
+
+    expect(res.status).toBe(201);
+    expect(res.body.scanStatus).toBe('pending');
+    const document = await scanned(res.body.id);
+    expect(document.scan).toMatchObject({ status: 'infected', threat: 'EICAR-Test-File', scanner: 'stub' });
+
+    const served = await download(res.body.id);
+    expect(served.status).toBe(409);
+    expect(served.body.code).toBe('FILE_INFECTED');
+    expect(s3Service.getDownloadUrl).not.toHaveBeenCalled();
+    expect(await Notification.countDocuments({ userId: admin._id, title: 'Infected upload quarantined', type: 'in-app' })).toBe(1);
+  });
+
+  it('keeps a file quarantined until it is scanned', async () => {
+    ScanService.setScanner({ name: 'stub', scan: () => new Promise(() => {}) });
+
+    const res = await upload();
+
+    const served = await download(res.body.id);
+    expect(served.status).toBe(409);
+    expect(served.body.code).toBe('SCAN_PENDING');
+  });
+
+  it('serves a file the scanner finds clean', async () => {
+    ScanService.setScanner({ name: 'stub', scan: async () => ({ clean: true }) });
+
+    const res = await upload();
+    await scanned(res.body.id);
+
+    const served = await download(res.body.id);
+    expect(served.status).toBe(302);
+    expect(served.headers.location).toBe('https://bucket.example.com/signed');
+  });
+});
+
+describe('clinic photos', () => {
+  let doctor;
+  let auth;
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    auth = await authHeader(user);
+    s3Service.uploadFile.mockResolvedValue();
+    s3Service.deleteFile.mockResolvedValue();
+    s3Service.getDownloadUrl.mockImplementation(async key => `https://bucket.example.com/${key}?signed`);
+  });
+
+  afterEach(() => {
+    jest.resetAllMocks();
+  });
+
+  const addPhoto = (authorization = auth, content = JPEG, contentType = 'image/jpeg') => request(app)
+    .post('/api/v1/doctors/me/clinic-photos')
+    .set('Authorization', authorization)
+    .attach('photo', content, { filename: 'waiting-room.jpg', contentType });
+
+  it('stores a photo and returns a presigned URL for it', async () => {
+    const res = await addPhoto();
+
+    expect(res.status).toBe(201);
+    expect(res.body.photos).toHaveLength(1);
+    const [{ key }] = (await Doctor.findById(doctor._id)).clinicLocation.photos;
+    expect(key).toMatch(new RegExp(`^clinic-photos/${doctor._id}/`));
+    expect(s3Service.uploadFile).toHaveBeenCalledWith(key, expect.any(Buffer), 'image/jpeg');
+    expect(res.body.photos[0]).toMatchObject({ url: `https://bucket.example.com/${key}?signed`, contentType: 'image/jpeg' });
+
+    const profile = await request(app).get('/api/v1/doctors/getById').query({ id: doctor._id.toString() });
+    expect(profile.body.doctor.clinicPhotos).toEqual(res.body.photos);
+  });
+
+  it('refuses a photo past the limit', async () => {
+    const { maxPerClinic } = config.clinicPhotos;
+    await Doctor.updateOne(
+      { _id: doctor._id },
+      { 'clinicLocation.photos': Array.from({ length: maxPerClinic }, (_, i) => ({ key: `clinic-photos/${i}.jpg`, contentType: 'image/jpeg' })) }
+    );
+
+    const res = await addPhoto();
+
+    expect(res.status).toBe(409);
+    expect(res.body.error).toBe(`A clinic can have at most ${maxPerClinic} photos`);
+    expect(s3Service.uploadFile).not.toHaveBeenCalled();
+    expect((await Doctor.findById(doctor._id)).clinicLocation.photos).toHaveLength(maxPerClinic);
+  });
+
+  it('refuses a file that is not an image', async () => {
+    const res = await addPhoto(auth, PDF, 'application/pdf');
+
+    expect(res.status).toBe(415);
+    expect((await Doctor.findById(doctor._id)).clinicLocation.photos).toHaveLength(0);
+  });
+
+  it('only lets doctors add photos', async () => {
+    const res = await addPhoto(await authHeader(await createUser()));
+
+    expect(res.status).toBe(403);
+  });
+
+  it('removes a photo and its file', async () => {
+    const added = await addPhoto();
+    const [photo] = added.body.photos;
+
+    const res = await request(app)
+      .delete(`/api/v1/doctors/me/clinic-photos/${photo.id}`)
+      .set('Authorization', auth);
+
+    expect(res.status).toBe(200);
+    expect(res.body.photos).toEqual([]);
+    expect(s3Service.deleteFile).toHaveBeenCalledWith(expect.stringMatching(/^clinic-photos\//));
+  });
+
+  it('does not remove another doctor\'s photo', async () => {
+    const [photo] = (await addPhoto()).body.photos;
+    const { user: other } = await createDoctor();
+
+    const res = await request(app)
+      .delete(`/api/v1/doctors/me/clinic-photos/${photo.id}`)
+      .set('Authorization', await authHeader(other));
+
+    expect(res.status).toBe(404);
+    expect((await Doctor.findById(doctor._id)).clinicLocation.photos).toHaveLength(1);
+  });
+});
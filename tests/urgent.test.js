@@ -0,0 +1,117 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const UrgentService = require('../services/urgent.service');
+const { verifyBookingToken } = require('../services/recommendation.service');
+const { useDatabase, createUser, createDoctor, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+describe('urgent appointments', () => {
+  const date = daysFromToday(3);
+  // Early on the day, before any doctor's first slot
+  const now = new Date(`${date}T08:00:00.000Z`);
+  let patient;
+
+  beforeEach(async () => {
+    patient = await createUser();
+  });
+
+  // A general practitioner available from the given time to 17:00 every day
+  const createGp = (startTime = '09:00', overrides = {}) => createDoctor({
+    specializations: ['General Practitioner'],
+    availability: ['monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday', 'sunday']
+      .map(day => ({ day, slots: [{ startTime, endTime: '17:00' }] })),
+    ...overrides
+  }).then(({ doctor }) => doctor);
+
+  const book = (doctor, startTime, endTime) => Appointment.create({
+    doctorId: doctor._id,
+    patientId: patient._id,
+    date,
+    startTime,
+    endTime,
+    type: 'video',
+    reason: 'Check-up',
+    status: 'confirmed'
+  });
+
+  describe('UrgentService.findUrgentOptions', () => {
+    it('returns the earliest slot across doctors first', async () => {
+      const busy = await createGp('09:00');
+      await book(busy, '09:00', '09:30');
+      await book(busy, '09:30', '10:00');
+      const later = await createGp('09:30');
+      await createGp('09:00', { specializations: ['Dermatologist'] });
+      await createGp('08:30', { verificationStatus: 'pending' });
+
+      const result = await UrgentService.findUrgentOptions(['fever'], { now });
+
+      expect(result.emergency).toBe(false);
+      expect(result.specialties).toEqual(['General Practitioner', 'Infectious Disease']);
+      expect(result.options.map(option => [option.doctor._id.toString(), option.startTime])).toEqual([
+        [later._id.toString(), '09:30'],
+        [busy._id.toString(), '10:00']
+      ]);
+      expect(result.options[0]).toMatchObject({ date, endTime: '10:00', todaysAppointments: 0 });
+      expect(result.options[1].todaysAppointments).toBe(2);
+    });
+
+    it('prefers the less busy doctor when both are free at the same time', async () => {
+      const busy = await createGp('09:00');
+      await book(busy, '12:00', '12:30');
+      const quiet = await createGp('09:00');
+
+      const { options } = await UrgentService.findUrgentOptions(['fever'], { now });
+
+      expect(options.map(option => option.doctor._id.toString())).toEqual([quiet._id.toString(), busy._id.toString()]);
+      expect(options.map(option => option.startTime)).toEqual(['09:00', '09:00']);
+    });
+
+    it('only offers slots within the maximum wait', async () => {
+      await createGp('12:00');
+
+      const { options } = await UrgentService.findUrgentOptions(['fever'], { now, maxWaitHours: 2 });
+
+      expect(options).toEqual([]);
+    });
+
+    it('gives each option a token that books its slot', async () => {
+      const doctor = await createGp('09:00');
+
+      const { options } = await UrgentService.findUrgentOptions(['fever'], { now });
+
+      expect(verifyBookingToken(options[0].bookingToken).payload).toMatchObject({
+        doctorId: doctor._id.toString(),
+        date,
+        startTime: '09:00'
+      });
+    });
+  });
+
+  describe('POST /api/v1/recommendations/urgent', () => {
+    const urgent = (symptoms) => request(app)
+      .post('/api/v1/recommendations/urgent')
+      .send({ symptoms });
+
+    it('sends red-flag symptoms to emergency services instead of offering slots', async () => {
+      await createGp();
+
+      const res = await urgent(['Sudden chest pain', 'fever']);
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ emergency: true, redFlags: ['chest pain'], emergencyNumber: '112' });
+      expect(res.body.message).toMatch(/^These symptoms may need emergency care\. Call 112/);
+      expect(res.body).not.toHaveProperty('options');
+    });
+
+    it('requires at least one symptom', async () => {
+      const res = await urgent([]);
+
+      expect(res.status).toBe(400);
+      expect(res.body.errors[0].msg).toBe('At least one symptom is required');
+    });
+  });
+});
@@ -0,0 +1,338 @@
+jest.mock('../services/aws.service');
+
+const request = require('supertest');
+const app = require('../app');
+const Appointment = require('../models/appointment.model');
+const Doctor = require('../models/doctor.model');
+const VideoSession = require('../models/video.model');
+const Notification = require('../models/notification.model');
+const config = require('../config/config');
+const { toZonedDateTime } = require('../utils/helpers');
+const { useDatabase, createUser, createDoctor, authHeader } = require('./helpers');
+
+useDatabase();
+
+const MINUTE = 60 * 1000;
+
+// A fixed-offset zone where it is around midday now, so appointments close
+// to now never cross midnight
+const middayTimeZone = () => {
+  const offset = 12 - new Date().getUTCHours();
+  if (offset === 0) return 'UTC';
+  // Etc/GMT names have the sign reversed
+  return offset > 0 ? `Etc/GMT-${offset}` : `Etc/GMT+${-offset}`;
+};
+
+describe('video sessions', () => {
+  let doctor;
+  let patient;
+  let patientAuth;
+  let doctorAuth;
+
+  beforeEach(async () => {
+    let user;
+    ({ user, doctor } = await createDoctor());
+    patient = await createUser();
+    patientAuth = await authHeader(patient);
+    doctorAuth = await authHeader(user);
+  });
+
+  // A confirmed video appointment starting startsIn minutes from now
+  const book = (startsIn, durationMinutes = 30) => {
+    const timeZone = middayTimeZone();
+    const start = toZonedDateTime(new Date(Date.now() + startsIn * MINUTE), timeZone);
+    const end = toZonedDateTime(new Date(Date.now() + (startsIn + durationMinutes) * MINUTE), timeZone);
+    return Appointment.create({
+      doctorId: doctor._id,
+      patientId: patient._id,
+      date: start.date,
+      startTime: start.time,
+      endTime: end.time,
+      timeZone,
+      type: 'video',
+      reason: 'Check-up',
+      status: 'confirmed'
+    });
+  };
+
+  const openSession = (appointment, fields = {}) => VideoSession.create({
+    appointmentId: appointment._id,
+    doctorId: doctor._id,
+    patientId: patient._id,
+    roomId: `room-${appointment._id}`,
+    sessionToken: 'original-token',
+    status: 'active',
+    startedAt: new Date(),
+    ...fields
+  });
+
+  describe('POST /api/v1/video/session/:sessionId/reconnect', () => {
+    const reconnect = (session, authorization = patientAuth) => request(app)
+      .post(`/api/v1/video/session/${session._id}/reconnect`)
+      .set('Authorization', authorization);
+
+    it('issues a fresh token for the same room of an ongoing call', async () => {
+      const session = await openSession(await book(-5));
+
+      const res = await reconnect(session);
+
+      expect(res.status).toBe(200);
+      expect(res.body).toMatchObject({ sessionId: session._id.toString(), roomId: session.roomId });
+      expect(res.body.token).toEqual(expect.any(String));
+      expect(res.body.token).not.toBe('original-token');
+      expect((await VideoSession.findById(session._id)).sessionToken).toBe(res.body.token);
+      expect(await VideoSession.countDocuments()).toBe(1);
+    });
+
+    it('lets the doctor reconnect too', async () => {
+      const session = await openSession(await book(-5));
+
+      expect((await reconnect(session, doctorAuth)).status).toBe(200);
+    });
+
+    it('refuses a session that has ended', async () => {
+      const session = await openSession(await book(-5), { status: 'ended', endedAt: new Date() });
+
+      const res = await reconnect(session);
+
+      expect(res.status).toBe(409);
+      expect((await VideoSession.findById(session._id)).sessionToken).toBe('original-token');
+    });
+
+    it('refuses once the appointment window has closed', async () => {
+      const session = await openSession(await book(-120));
+
+      const res = await reconnect(session);
+
+      expect(res.status).toBe(403);
+      expect(res.body.code).toBe('VIDEO_JOIN_TOO_LATE');
+    });
+
+    it('refuses someone outside the appointment', async () => {
+      const session = await openSession(await book(-5));
+      const stranger = await createUser();
+
+      expect((await reconnect(session, await authHeader(stranger))).status).toBe(403);
+    });
+  });
+
+  describe('POST /api/v1/video/join/:sessionId', () => {
+    const { joinEarlyGraceMinutes, joinLateGraceMinutes } = config.videoCall;
+
+    const join = (session, authorization = patientAuth) => request(app)
+      .post(`/api/v1/video/join/${session._id}`)
+      .set('Authorization', authorization);
+
+    const scheduledSession = async (startsIn, durationMinutes) =>
+      openSession(await book(startsIn, durationMinutes), { status: 'scheduled', startedAt: undefined });
+
+    it('refuses to join before the early grace period', async () => {
+      const session = await scheduledSession(joinEarlyGraceMinutes + 5);
+
+      const res = await join(session);
+
+      expect(res.status).toBe(403);
+      expect(res.body.code).toBe('VIDEO_JOIN_TOO_EARLY');
+      expect((await VideoSession.findById(session._id)).status).toBe('scheduled');
+    });
+
+    it('lets participants join within the early grace period and starts the call on the first join', async () => {
+      const session = await scheduledSession(joinEarlyGraceMinutes - 5);
+
+      const res = await join(session);
+
+      expect(res.status).toBe(200);
+      const started = await VideoSession.findById(session._id);
+      expect(started.status).toBe('active');
+      expect(started.startedAt).toBeInstanceOf(Date);
+      expect(started.participants.patient.joinedAt).toEqual(started.startedAt);
+    });
+
+    it('keeps the call start at the first join when the other party joins later', async () => {
+      const session = await scheduledSession(-5);
+      await join(session).expect(200);
+      const { startedAt } = await VideoSession.findById(session._id);
+
+      await join(session, doctorAuth).expect(200);
+
+      const joined = await VideoSession.findById(session._id);
+      expect(joined.startedAt).toEqual(startedAt);
+      expect(joined.participants.doctor.joinedAt.getTime()).toBeGreaterThanOrEqual(startedAt.getTime());
+    });
+
+    it('lets participants join within the late grace period after the end', async () => {
+      const session = await scheduledSession(-30 - (joinLateGraceMinutes - 5), 30);
+
+      expect((await join(session)).status).toBe(200);
+    });
+
+    it('refuses to join once the late grace period has passed', async () => {
+      const session = await scheduledSession(-30 - (joinLateGraceMinutes + 5), 30);
+
+      const res = await join(session);
+
+      expect(res.status).toBe(403);
+      expect(res.body.code).toBe('VIDEO_JOIN_TOO_LATE');
+    });
+
+    it('measures the call from the first join rather than from when the session was created', async () => {
+      const session = await scheduledSession(-5);
+      await join(session).expect(200);
+      const firstJoin = new Date(Date.now() - 10 * MINUTE);
+      await VideoSession.updateOne(
+        { _id: session._id },
+        { $set: { startedAt: firstJoin, createdAt: new Date(Date.now() - 60 * MINUTE) } }
+      );
+
+      const res = await request(app)
+        .post(`/api/v1/video/end/${session._id}`)
+        .set('Authorization', patientAuth);
+
+      expect(res.status).toBe(200);
+      const ended = await VideoSession.findById(session._id);
+      expect(ended.status).toBe('ended');
+      expect(ended.duration).toBe(Math.round((ended.endedAt - firstJoin) / 1000));
+    });
+  });
+
+  describe('waiting room', () => {
+    const join = (session, authorization) => request(app)
+      .post(`/api/v1/video/join/${session._id}`)
+      .set('Authorization', authorization);
+
+    const getStatus = (session, authorization = patientAuth) => request(app)
+      .get(`/api/v1/video/session/${session._id}/status`)
+      .set('Authorization', authorization);
+
+    const joinNotices = () => Notification.find({ title: 'Ready to Start' }).sort({ type: 1 });
+
+    // The join notice is sent without holding up the response
+    const waitForNotices = async (count) => {
+      for (let attempt = 0; attempt < 50; attempt++) {
+        if ((await joinNotices()).length >= count) return;
+        await new Promise(resolve => setTimeout(resolve, 20));
+      }
+    };
+
+    let session;
+
+    beforeEach(async () => {
+      session = await openSession(await book(-5), { status: 'scheduled', startedAt: undefined });
+    });
+
+    it('reflects each party joining', async () => {
+      const before = await getStatus(session);
+      expect(before.status).toBe(200);
+      expect(before.body).toMatchObject({
+        state: 'waiting',
+        waitingFor: ['doctor', 'patient'],
+        participants: { doctor: { joined: false }, patient: { joined: false } }
+      });
+
+      const patientJoin = await join(session, patientAuth);
+      expect(patientJoin.body.waitingRoom).toMatchObject({ state: 'waiting', waitingFor: ['doctor'] });
+      const waiting = await getStatus(session, doctorAuth);
+      expect(waiting.body).toMatchObject({ state: 'waiting', waitingFor: ['doctor'], participants: { patient: { joined: true } } });
+
+      await join(session, doctorAuth).expect(200);
+      const ready = await getStatus(session);
+      expect(ready.body).toMatchObject({
+        state: 'ready',
+        waitingFor: [],
+        participants: { doctor: { joined: true }, patient: { joined: true } }
+      });
+    });
+
+    it('tells the waiting party once when the other joins', async () => {
+      await join(session, patientAuth).expect(200);
+      await join(session, doctorAuth).expect(200);
+      await waitForNotices(2);
+
+      const notices = await joinNotices();
+      expect(notices.map(notice => [notice.userId.toString(), notice.type])).toEqual([
+        [patient._id.toString(), 'in-app'],
+        [patient._id.toString(), 'push']
+      ]);
+      expect(notices[0].message).toBe('Your doctor has joined the video consultation.');
+
+      await join(session, doctorAuth).expect(200);
+      await join(session, patientAuth).expect(200);
+      await new Promise(resolve => setTimeout(resolve, 100));
+      expect(await joinNotices()).toHaveLength(2);
+    });
+
+    it('does not notify anyone while the first party waits alone', async () => {
+      await join(session, doctorAuth).expect(200);
+      await new Promise(resolve => setTimeout(resolve, 100));
+
+      expect(await joinNotices()).toHaveLength(0);
+    });
+
+    it('reports an ended call as ended', async () => {
+      await VideoSession.updateOne({ _id: session._id }, { $set: { status: 'ended' } });
+
+      const res = await getStatus(session);
+
+      expect(res.body).toMatchObject({ status: 'ended', state: 'ended', waitingFor: [] });
+    });
+
+    it('is hidden from anyone outside the appointment', async () => {
+      const res = await getStatus(session, await authHeader(await createUser()));
+
+      expect(res.status).toBe(403);
+    });
+  });
+
+  describe('capabilities in GET /api/v1/appointments/:id', () => {
+    const getCapabilities = async (appointment) => {
+      const res = await request(app)
+        .get(`/api/v1/appointments/${appointment._id}`)
+        .set('Authorization', patientAuth)
+        .expect(200);
+      return res.body.capabilities;
+    };
+
+    it('lets a confirmed video appointment start a call and chat', async () => {
+      const appointment = await book(5);
+
+      expect(await getCapabilities(appointment)).toEqual({
+        canChat: true,
+        canStartVideo: true,
+        canJoinVideo: false,
+        videoUnavailableReason: null
+      });
+    });
+
+    it('offers joining instead of starting once a call is open', async () => {
+      const appointment = await book(-5);
+      await openSession(appointment);
+
+      expect(await getCapabilities(appointment)).toMatchObject({ canStartVideo: false, canJoinVideo: true });
+    });
+
+    it('only offers chat for an in-person appointment', async () => {
+      const appointment = await book(5);
+      await Appointment.updateOne({ _id: appointment._id }, { type: 'in-person' });
+
+      expect(await getCapabilities(appointment)).toEqual({
+        canChat: true,
+        canStartVideo: false,
+        canJoinVideo: false,
+        videoUnavailableReason: 'not-video'
+      });
+    });
+
+    it('gives the reason a call is not available yet', async () => {
+      const appointment = await book(config.videoCall.joinEarlyGraceMinutes + 60);
+
+      expect(await getCapabilities(appointment)).toMatchObject({ canStartVideo: false, videoUnavailableReason: 'early' });
+    });
+
+    it('closes chat with a suspended doctor', async () => {
+      const appointment = await book(5);
+      await Doctor.updateOne({ _id: doctor._id }, { status: 'suspended' });
+
+      expect(await getCapabilities(appointment)).toMatchObject({ canChat: false });
+    });
+  });
+});
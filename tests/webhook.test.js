@@ -0,0 +1,111 @@
+jest.mock('../services/aws.service');
+jest.mock('../services/aws/sqs.service');
+
+const axios = require('axios');
+const request = require('supertest');
+const app = require('../app');
+const WebhookEndpoint = require('../models/webhook.endpoint.model');
+const WebhookDelivery = require('../models/webhook.delivery.model');
+const WebhookService = require('../services/webhook.service');
+const sqsService = require('../services/aws/sqs.service');
+const { SIGNATURE_HEADER, buildSignatureHeader, verifySignature } = require('../utils/webhook');
+const { useDatabase, createUser, createDoctor, authHeader, daysFromToday } = require('./helpers');
+
+useDatabase();
+
+const SECRET = 'whsec_test';
+
+describe('outbound webhooks', () => {
+  describe('signatures', () => {
+    const body = JSON.stringify({ id: 'evt_1', type: 'appointment.created' });
+
+    it('verifies a signature made with the same secret', () => {
+      expect(verifySignature(SECRET, buildSignatureHeader(SECRET, body), body)).toBe(true);
+    });
+
+    it('rejects another secret, a changed body or an old timestamp', () => {
+      const header = buildSignatureHeader(SECRET, body);
+
+      expect(verifySignature('whsec_other', header, body)).toBe(false);
+      expect(verifySignature(SECRET, header, body.replace('created', 'cancelled'))).toBe(false);
+      expect(verifySignature(SECRET, buildSignatureHeader(SECRET, body, new Date(Date.now() - 10 * 60 * 1000)), body)).toBe(false);
+    });
+  });
+
+  describe('when an appointment is booked', () => {
+    let endpoint;
+    let doctor;
+    let patientAuth;
+
+    beforeEach(async () => {
+      sqsService.sendMessage.mockReset();
+      endpoint = await WebhookEndpoint.create({
+        url: 'https://ehr.example.com/hooks',
+        events: ['appointment.created'],
+        secret: SECRET
+      });
+      await WebhookEndpoint.create({
+        url: 'https://other.example.com/hooks',
+        events: ['payment.succeeded'],
+        secret: 'whsec_other'
+      });
+      ({ doctor } = await createDoctor());
+      patientAuth = await authHeader(await createUser());
+    });
+
+    afterEach(() => {
+      jest.restoreAllMocks();
+    });
+
+    const book = () => request(app)
+      .post('/api/v1/appointments')
+      .set('Authorization', patientAuth)
+      .send({
+        doctorId: doctor._id.toString(),
+        date: daysFromToday(2),
+        timeSlot: '10:00-10:30',
+        type: 'video',
+        reason: 'Check-up'
+      })
+      .expect(201);
+
+    it('enqueues a delivery to each subscribed endpoint', async () => {
+      const res = await book();
+
+      const deliveries = await WebhookDelivery.find();
+      expect(deliveries).toHaveLength(1);
+      expect(deliveries[0].endpointId.toString()).toBe(endpoint._id.toString());
+      expect(deliveries[0].event).toBe('appointment.created');
+      expect(JSON.parse(deliveries[0].body).data.appointment.id).toBe(res.body.id);
+      expect(sqsService.sendMessage).toHaveBeenCalledWith({ type: 'DELIVER_WEBHOOK', deliveryId: deliveries[0]._id.toString() });
+    });
+
+    it('delivers the event with a valid signature', async () => {
+      await book();
+      const delivery = await WebhookDelivery.findOne();
+      const post = jest.spyOn(axios, 'post').mockResolvedValue({ status: 204 });
+
+      await WebhookService.deliver(delivery._id.toString());
+
+      const [url, body, { headers }] = post.mock.calls[0];
+      expect(url).toBe(endpoint.url);
+      expect(body).toBe(delivery.body);
+      expect(verifySignature(SECRET, headers[SIGNATURE_HEADER], body)).toBe(true);
+      const delivered = await WebhookDelivery.findById(delivery._id);
+      expect(delivered.status).toBe('succeeded');
+      expect(delivered.attempts).toHaveLength(1);
+    });
+
+    it('records a failed attempt and throws so the queue retries', async () => {
+      await book();
+      const delivery = await WebhookDelivery.findOne();
+      jest.spyOn(axios, 'post').mockResolvedValue({ status: 500 });
+
+      await expect(WebhookService.deliver(delivery._id.toString(), 1)).rejects.toThrow('HTTP 500');
+
+      const failed = await WebhookDelivery.findById(delivery._id);
+      expect(failed.status).toBe('failed');
+      expect(failed.attempts[0].statusCode).toBe(500);
+    });
+  });
+});
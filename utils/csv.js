@@ -0,0 +1,82 @@
+/**
+ * Format one CSV field. Values are quoted when needed, and text that a
+ * spreadsheet would run as a formula is prefixed with a quote.
+ * @param {*} value - The field value
+ * @returns {string}
+ */
+const toCsvField = (value) => {
+  if (value === null || value === undefined) {
+    return '';
+  }
+  let text = value instanceof Date ? value.toISOString() : String(value);
+  if (typeof value === 'string' && /^[=+\-@\t\r]/.test(text)) {
+    text = `'${text}`;
+  }
+  return /[",\r\n]/.test(text) ? `"${text.replace(/"/g, '""')}"` : text;
+};
+
+/**
+ * Format one CSV line, including the line break
+ * @param {Array} values - Field values in column order
+ * @returns {string}
+ */
+const toCsvRow = (values) => `${values.map(toCsvField).join(',')}\r\n`;
+
+/**
+ * Parse CSV text into rows of fields. Handles quoted fields with commas,
+ * doubled quotes and line breaks; blank lines are skipped.
+ * @param {string} text - The CSV contents
+ * @returns {string[][]} - One array of trimmed fields per row
+ */
+const parseCsv = (text) => {
+  const rows = [];
+  let row = [];
+  let field = '';
+  let quoted = false;
+  const input = text.replace(/^\uFEFF/, '');
+
+  const endRow = () => {
+    row.push(field.trim());
+    if (row.length > 1 || row[0] !== '') {
+      rows.push(row);
+    }
+    row = [];
+    field = '';
+  };
+
+  for (let i = 0; i < input.length; i++) {
+    const char = input[i];
+    if (quoted) {
+      if (char === '"' && input[i + 1] === '"') {
+        field += '"';
+        i++;
+      } else if (char === '"') {
+        quoted = false;
+      } else {
+        field += char;
+      }
+    } else if (char === '"') {
+      quoted = true;
+    } else if (char === ',') {
+      row.push(field.trim());
+      field = '';
+    } else if (char === '\n' || char === '\r') {
+      if (char === '\r' && input[i + 1] === '\n') {
+        i++;
+      }
+      endRow();
+    } else {
+      field += char;
+    }
+  }
+  if (field !== '' || row.length > 0) {
+    endRow();
+  }
+  return rows;
+};
+
+module.exports = {
+  toCsvField,
+  toCsvRow,
+  parseCsv
+};
@@ -0,0 +1,35 @@
+const config = require('../config/config');
+
+// Intl formatters are costly to build, so keep one per locale and currency
+const formatters = new Map();
+
+const getFormatter = (currency, locale) => {
+  const key = `${locale}|${currency}`;
+  if (!formatters.has(key)) {
+    formatters.set(key, new Intl.NumberFormat(locale, { style: 'currency', currency }));
+  }
+  return formatters.get(key);
+};
+
+/**
+ * Format an amount for people: the currency's symbol and decimal places in
+ * the locale's style, e.g. "€ 45,00" for EUR in nl-NL, "¥4,500" for JPY in
+ * en-US or "KWD 1.235" for KWD in en. A malformed code or locale falls back to
+ * "45.00 EUR".
+ * @param {number} amount - The amount in the currency's main unit
+ * @param {string} currency - ISO 4217 code
+ * @param {string} locale - BCP 47 locale (defaults to DEFAULT_LOCALE)
+ * @returns {string}
+ */
+const formatCurrency = (amount, currency = 'EUR', locale = config.locale.defaultLocale) => {
+  const code = String(currency || 'EUR').toUpperCase();
+  try {
+    return getFormatter(code, locale).format(amount);
+  } catch (error) {
+    return `${Number(amount).toFixed(2)} ${code}`;
+  }
+};
+
+module.exports = {
+  formatCurrency
+};
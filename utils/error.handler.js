@@ -47,7 +47,27 @@ class ConflictError extends AppError {
   }
 }
 
+/**
+ * Whether an error is work cancelled at the request's deadline: a query
+ * past its maxTimeMS, or work stopped by req.signal
+ * @param {Error} error - The error
+ * @returns {boolean}
+ */
+const isTimeoutError = (error) => {
+  return error.code === 50 || error.codeName === 'MaxTimeMSExpired' ||
+    error.name === 'TimeoutError' || error.name === 'AbortError';
+};
+
 const errorHandler = (err, req, res, next) => {
+  // Work cancelled at the request's deadline (see timeout.middleware)
+  if (isTimeoutError(err)) {
+    logger.warn(`Request timed out: ${req.method} ${req.originalUrl}`);
+    return res.status(503).json({
+      status: 'error',
+      message: 'Request timed out'
+    });
+  }
+
   err.statusCode = err.statusCode || 500;
   err.status = err.status || 'error';
 
@@ -96,5 +116,6 @@ module.exports = {
   AuthorizationError,
   NotFoundError,
   ConflictError,
+  isTimeoutError,
   errorHandler
 }; 
\ No newline at end of file
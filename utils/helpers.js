@@ -1,5 +1,6 @@
 const jwt = require('jsonwebtoken');
 const config = require('../config');
+const appConfig = require('../config/config');
 const validator = require('validator');
 const crypto = require('crypto');
 const logger = require('./logger');
@@ -9,17 +10,17 @@ const generateOTP = () => {
   return Math.floor(100000 + Math.random() * 900000).toString();
 };
 
-// Generate JWT token
-const generateToken = (user) => {
+// Generate a short-lived JWT access token. tokenId identifies the session;
+// tokens refreshed within a session keep it. jti identifies the token itself,
+// so it can be revoked on logout.
+const generateToken = (user, tokenId = crypto.randomBytes(32).toString('hex')) => {
   try {
-    // Generate a unique token ID
-    const tokenId = crypto.randomBytes(32).toString('hex');
-    
     const payload = {
       userId: user._id,
       tokenId: tokenId, // Include tokenId in payload
+      jti: crypto.randomBytes(16).toString('hex'),
       iat: Math.floor(Date.now() / 1000),
-      exp: Math.floor(Date.now() / 1000) + (24 * 60 * 60) // 24 hours
+      exp: Math.floor(Date.now() / 1000) + appConfig.jwt.accessTokenMinutes * 60
     };
 
     const token = jwt.sign(payload, process.env.JWT_SECRET, {
@@ -90,13 +91,8 @@ const isValidAddress = (address) => {
   );
 };
 
-// Format currency
-const formatCurrency = (amount, currency = 'EUR') => {
-  return new Intl.NumberFormat('nl-NL', {
-    style: 'currency',
-    currency
-  }).format(amount);
-};
+// Format currency (kept here for existing callers; see utils/currency)
+const { formatCurrency } = require('./currency');
 
 // Validate time slot
 const isValidTimeSlot = (startTime, endTime) => {
@@ -105,6 +101,80 @@ const isValidTimeSlot = (startTime, endTime) => {
   return start < end && start > new Date();
 };
 
+// Convert an "HH:MM" time string to minutes since midnight
+const timeToMinutes = (time) => {
+  const [hours, minutes] = time.split(':').map(Number);
+  return hours * 60 + minutes;
+};
+
+// Convert minutes since midnight to an "HH:MM" time string
+const minutesToTime = (minutes) => {
+  const hours = Math.floor(minutes / 60);
+  const mins = minutes % 60;
+  return `${hours.toString().padStart(2, '0')}:${mins.toString().padStart(2, '0')}`;
+};
+
+const WEEKDAYS = ['sunday', 'monday', 'tuesday', 'wednesday', 'thursday', 'friday', 'saturday'];
+
+// Lower-case weekday name of an appointment date. Dates are stored as UTC
+// midnight of the calendar day, so it is read in UTC whatever the server's
+// own time zone.
+const getWeekday = (date) => WEEKDAYS[new Date(date).getUTCDay()];
+
+// Combine an appointment's date and "HH:MM" start time into a Date. The time
+// is wall-clock time in timeZone, the doctor's zone (UTC when not given).
+const getAppointmentStart = (date, startTime, timeZone) => {
+  const start = new Date(date);
+  start.setUTCHours(0, timeToMinutes(startTime), 0, 0);
+  if (!timeZone || timeZone === 'UTC') {
+    return start;
+  }
+  // Take off the zone's offset, checked again at the result in case a DST
+  // change falls between the two
+  const first = new Date(start.getTime() - getTimeZoneOffset(start, timeZone));
+  return new Date(start.getTime() - getTimeZoneOffset(first, timeZone));
+};
+
+// Milliseconds a time zone is ahead of UTC at an instant
+const getTimeZoneOffset = (instant, timeZone) => {
+  const { date, time } = toZonedDateTime(instant, timeZone);
+  const wallClock = Date.parse(`${date}T${time}:00Z`);
+  return wallClock - Math.floor(instant.getTime() / 60000) * 60000;
+};
+
+// Whether a string is an IANA time zone name the runtime knows, e.g. "Europe/Amsterdam"
+const isValidTimeZone = (timeZone) => {
+  try {
+    new Intl.DateTimeFormat('en-US', { timeZone });
+    return true;
+  } catch (error) {
+    return false;
+  }
+};
+
+// Wall-clock date ("YYYY-MM-DD") and time ("HH:MM") of an instant in a time zone
+const toZonedDateTime = (instant, timeZone) => {
+  const parts = {};
+  new Intl.DateTimeFormat('en-CA', {
+    timeZone,
+    year: 'numeric',
+    month: '2-digit',
+    day: '2-digit',
+    hour: '2-digit',
+    minute: '2-digit',
+    hourCycle: 'h23'
+  }).formatToParts(instant).forEach(part => {
+    parts[part.type] = part.value;
+  });
+  return {
+    date: `${parts.year}-${parts.month}-${parts.day}`,
+    time: `${parts.hour}:${parts.minute}`
+  };
+};
+
+// Escape user input for use as a literal inside a RegExp
+const escapeRegex = (value) => value.replace(/[.*+?^${}()|[\]\\]/g, '\\$&');
+
 // Calculate average rating
 const calculateAverageRating = (ratings) => {
   if (!ratings || ratings.length === 0) return 0;
@@ -117,6 +187,18 @@ const formatDate = (date) => {
   return new Date(date).toISOString();
 };
 
+// Characters for codes people read out or type in: no 0/O, 1/I/L lookalikes
+const CONFIRMATION_CODE_ALPHABET = 'ABCDEFGHJKMNPQRSTUVWXYZ23456789';
+
+// Random, human-readable code such as "K7PX3MQ2"
+const generateConfirmationCode = (length) => {
+  let code = '';
+  for (let i = 0; i < length; i++) {
+    code += CONFIRMATION_CODE_ALPHABET[crypto.randomInt(CONFIRMATION_CODE_ALPHABET.length)];
+  }
+  return code;
+};
+
 // Generate unique ID
 const generateUniqueId = () => {
   return Date.now().toString(36) + Math.random().toString(36).substr(2);
@@ -133,7 +215,16 @@ module.exports = {
   isValidAddress,
   formatCurrency,
   isValidTimeSlot,
+  timeToMinutes,
+  minutesToTime,
+  getWeekday,
+  getAppointmentStart,
+  isValidTimeZone,
+  toZonedDateTime,
+  escapeRegex,
   calculateAverageRating,
   formatDate,
+  CONFIRMATION_CODE_ALPHABET,
+  generateConfirmationCode,
   generateUniqueId
 }; 
\ No newline at end of file
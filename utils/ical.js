@@ -0,0 +1,75 @@
+// Minimal iCalendar (RFC 5545) writer for read-only feeds
+
+const escapeText = (value) => {
+  return String(value || '')
+    .replace(/\\/g, '\\\\')
+    .replace(/;/g, '\\;')
+    .replace(/,/g, '\\,')
+    .replace(/\r?\n/g, '\\n');
+};
+
+const formatDateTime = (date) => {
+  return date.toISOString().replace(/[-:]/g, '').replace(/\.\d{3}/, '');
+};
+
+// Lines longer than 75 octets must be folded onto continuation lines
+const foldLine = (line) => {
+  const parts = [];
+  let rest = line;
+  while (rest.length > 75) {
+    parts.push(rest.slice(0, 75));
+    rest = ` ${rest.slice(75)}`;
+  }
+  parts.push(rest);
+  return parts.join('\r\n');
+};
+
+/**
+ * Build an iCalendar document
+ * @param {string} name - Calendar display name
+ * @param {Object[]} events - Events with uid, start, end, summary, description, location, updatedAt
+ * @param {Object} options - timeZone the calendar is shown in by default;
+ * event times are always UTC
+ * @returns {string} - The .ics body
+ */
+const buildCalendar = (name, events, options = {}) => {
+  const lines = [
+    'BEGIN:VCALENDAR',
+    'VERSION:2.0',
+    'PRODID:-//Med Connecter//Doctor Calendar//EN',
+    'CALSCALE:GREGORIAN',
+    'METHOD:PUBLISH',
+    `X-WR-CALNAME:${escapeText(name)}`
+  ];
+  if (options.timeZone) {
+    lines.push(`X-WR-TIMEZONE:${options.timeZone}`);
+  }
+
+  events.forEach(event => {
+    lines.push(
+      'BEGIN:VEVENT',
+      `UID:${event.uid}`,
+      `DTSTAMP:${formatDateTime(event.updatedAt || new Date())}`,
+      `DTSTART:${formatDateTime(event.start)}`,
+      `DTEND:${formatDateTime(event.end)}`,
+      `SUMMARY:${escapeText(event.summary)}`
+    );
+    if (event.description) {
+      lines.push(`DESCRIPTION:${escapeText(event.description)}`);
+    }
+    if (event.location) {
+      lines.push(`LOCATION:${escapeText(event.location)}`);
+    }
+    if (event.status) {
+      lines.push(`STATUS:${event.status}`);
+    }
+    lines.push('END:VEVENT');
+  });
+
+  lines.push('END:VCALENDAR');
+  return lines.map(foldLine).join('\r\n') + '\r\n';
+};
+
+module.exports = {
+  buildCalendar
+};
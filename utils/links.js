@@ -0,0 +1,35 @@
+const config = require('../config/config');
+
+// Email and SMS recipients usually aren't signed in, so links go through the
+// login page and the frontend redirects to the target afterwards.
+const buildFrontendLink = (path) => {
+  return `${config.frontendUrl}/login?redirect=${encodeURIComponent(path)}`;
+};
+
+// Link to an appointment's detail page
+const buildAppointmentLink = (appointmentId) => {
+  return buildFrontendLink(`/appointments/${appointmentId}`);
+};
+
+// Link to the page that joins the video session for an appointment
+const buildVideoJoinLink = (appointmentId) => {
+  return buildFrontendLink(`/appointments/${appointmentId}/video`);
+};
+
+// Link to the page that pays for an appointment
+const buildPaymentLink = (appointmentId) => {
+  return buildFrontendLink(`/appointments/${appointmentId}/pay`);
+};
+
+// Link that books an offered slot with its booking token
+const buildRebookLink = (bookingToken) => {
+  return buildFrontendLink(`/book?token=${encodeURIComponent(bookingToken)}`);
+};
+
+module.exports = {
+  buildFrontendLink,
+  buildRebookLink,
+  buildAppointmentLink,
+  buildVideoJoinLink,
+  buildPaymentLink
+};
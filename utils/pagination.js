@@ -0,0 +1,75 @@
+const mongoose = require('mongoose');
+
+// Newest first, with _id breaking ties between documents created in the same millisecond
+const CURSOR_SORT = { createdAt: -1, _id: -1 };
+
+/**
+ * Opaque cursor pointing just past a document in CURSOR_SORT order
+ * @param {Object} doc - The last document of a page
+ * @returns {string}
+ */
+const encodeCursor = (doc) => {
+  const payload = JSON.stringify({ createdAt: new Date(doc.createdAt).toISOString(), id: doc._id.toString() });
+  return Buffer.from(payload).toString('base64url');
+};
+
+/**
+ * Read a cursor made by encodeCursor
+ * @param {string} cursor - The cursor
+ * @returns {Object|null} - { createdAt, id }, or null when it isn't a valid cursor
+ */
+const decodeCursor = (cursor) => {
+  try {
+    const { createdAt, id } = JSON.parse(Buffer.from(String(cursor), 'base64url').toString('utf8'));
+    const date = new Date(createdAt);
+    if (isNaN(date.getTime()) || !mongoose.Types.ObjectId.isValid(id)) {
+      return null;
+    }
+    return { createdAt: date, id: new mongoose.Types.ObjectId(id) };
+  } catch (error) {
+    return null;
+  }
+};
+
+/**
+ * Narrow a query to the documents after a cursor in CURSOR_SORT order.
+ * Documents added meanwhile sort before the cursor when newer, so pages
+ * neither repeat nor skip anything.
+ * @param {Object} query - The list's filter
+ * @param {Object} position - A decoded cursor
+ * @returns {Object}
+ */
+const afterCursor = (query, position) => ({
+  $and: [
+    query,
+    {
+      $or: [
+        { createdAt: { $lt: position.createdAt } },
+        { createdAt: position.createdAt, _id: { $lt: position.id } }
+      ]
+    }
+  ]
+});
+
+/**
+ * Split a page fetched with one extra document into the page and the cursor
+ * of the next one
+ * @param {Object[]} docs - Up to limit + 1 documents in CURSOR_SORT order
+ * @param {number} limit - Page size
+ * @returns {Object} - { items, nextCursor }, nextCursor null on the last page
+ */
+const toCursorPage = (docs, limit) => {
+  const items = docs.slice(0, limit);
+  return {
+    items,
+    nextCursor: docs.length > limit ? encodeCursor(items[items.length - 1]) : null
+  };
+};
+
+module.exports = {
+  CURSOR_SORT,
+  encodeCursor,
+  decodeCursor,
+  afterCursor,
+  toCursorPage
+};
@@ -0,0 +1,59 @@
+const config = require('../config/config');
+
+// Formatting people commonly type into phone numbers
+const FORMATTING_CHARS = /[\s\-().\/]/g;
+
+const toCountryCode = (code) => `+${String(code).replace(/\D/g, '')}`;
+
+/**
+ * Normalize a phone number to a country code plus national number, which
+ * together form the E.164 number SNS needs. Numbers entered without a country
+ * code get the configured default region; a leading trunk 0 is dropped, so a
+ * Dutch "06 12345678" becomes +31 612345678.
+ * @param {Object|string} phone - { countryCode, number } or a single number string
+ * @returns {Object|null} - { countryCode, number }, or null if it isn't a valid number
+ */
+const normalizePhoneNumber = (phone) => {
+  if (!phone) {
+    return null;
+  }
+  const raw = typeof phone === 'string' ? phone : phone.number;
+  if (typeof raw !== 'string') {
+    return null;
+  }
+
+  const countryCode = toCountryCode(
+    (typeof phone === 'object' && phone.countryCode) || config.locale.defaultCountryCode
+  );
+  let digits = raw.replace(FORMATTING_CHARS, '');
+
+  // International format: must be in the given (or default) country
+  if (digits.startsWith('+') || digits.startsWith('00')) {
+    const international = `+${digits.replace(/^(\+|00)/, '')}`;
+    if (!international.startsWith(countryCode)) {
+      return null;
+    }
+    digits = international.slice(countryCode.length);
+  } else if (digits.startsWith('0')) {
+    digits = digits.slice(1);
+  }
+
+  // E.164 allows at most 15 digits including the country code
+  if (!/^[1-9]\d{5,13}$/.test(digits) || countryCode.length - 1 + digits.length > 15) {
+    return null;
+  }
+
+  return { countryCode, number: digits };
+};
+
+/**
+ * Full E.164 form of a stored phone number
+ * @param {Object} phone - { countryCode, number }
+ * @returns {string}
+ */
+const toE164 = (phone) => `${phone.countryCode}${phone.number}`;
+
+module.exports = {
+  normalizePhoneNumber,
+  toE164
+};
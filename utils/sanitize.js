@@ -0,0 +1,72 @@
+// Allowlist HTML sanitizer for user-authored rich text (doctor bios etc.).
+// The output is rebuilt from scratch: only allowlisted tags are emitted, with
+// no attributes except a vetted href on links, and all other markup is dropped.
+
+const ALLOWED_TAGS = ['p', 'br', 'strong', 'em', 'b', 'i', 'u', 'ul', 'ol', 'li', 'a'];
+
+// Tags whose content is dropped along with the tag itself
+const DROP_CONTENT_TAGS = ['script', 'style', 'iframe', 'object', 'embed', 'noscript', 'template', 'textarea', 'title'];
+
+const SAFE_URL = /^(https?:|mailto:)/i;
+
+const escapeText = (text) => text.replace(/</g, '&lt;').replace(/>/g, '&gt;');
+
+const escapeAttribute = (value) => {
+  return value
+    .replace(/&/g, '&amp;')
+    .replace(/"/g, '&quot;')
+    .replace(/</g, '&lt;')
+    .replace(/>/g, '&gt;');
+};
+
+const buildTag = (name, isClosing, attributes) => {
+  if (isClosing) {
+    return name === 'br' ? '' : `</${name}>`;
+  }
+  if (name !== 'a') {
+    return `<${name}>`;
+  }
+
+  const match = attributes.match(/href\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))/i);
+  const href = match ? (match[1] || match[2] || match[3] || '').trim() : '';
+  if (!SAFE_URL.test(href)) {
+    return '<a>';
+  }
+  return `<a href="${escapeAttribute(href)}" rel="nofollow noopener noreferrer" target="_blank">`;
+};
+
+/**
+ * Strip disallowed tags and attributes from rich text
+ * @param {string} html - Untrusted input
+ * @returns {string} - Sanitized HTML
+ */
+const sanitizeRichText = (html) => {
+  if (typeof html !== 'string') {
+    return html;
+  }
+
+  const dropContent = new RegExp(`<(${DROP_CONTENT_TAGS.join('|')})\\b[\\s\\S]*?(?:<\\/\\1\\s*>|$)`, 'gi');
+  const input = html
+    .replace(/<!--[\s\S]*?(?:-->|$)/g, '')
+    .replace(dropContent, '');
+
+  const tagPattern = /<(\/?)([a-zA-Z][a-zA-Z0-9-]*)([^>]*)>/g;
+  let output = '';
+  let lastIndex = 0;
+  let match;
+  while ((match = tagPattern.exec(input)) !== null) {
+    output += escapeText(input.slice(lastIndex, match.index));
+    const name = match[2].toLowerCase();
+    if (ALLOWED_TAGS.includes(name)) {
+      output += buildTag(name, match[1] === '/', match[3]);
+    }
+    lastIndex = tagPattern.lastIndex;
+  }
+  output += escapeText(input.slice(lastIndex));
+
+  return output.trim();
+};
+
+module.exports = {
+  sanitizeRichText
+};
@@ -0,0 +1,87 @@
+const config = require('../config/config');
+
+// SNS alphanumeric sender IDs: 1-11 letters or digits, at least one letter
+const SENDER_ID_PATTERN = /^(?=.*[A-Za-z])[A-Za-z0-9]{1,11}$/;
+
+const E164_PATTERN = /^\+[1-9]\d{6,14}$/;
+
+const SMS_TYPES = ['Transactional', 'Promotional'];
+
+/**
+ * Why a sender ID can't be used, or null when it is valid
+ * @param {string} senderId - Alphanumeric sender ID
+ * @returns {string|null}
+ */
+const getSenderIdError = (senderId) => {
+  if (!SENDER_ID_PATTERN.test(senderId)) {
+    return `SMS sender ID "${senderId}" must be 1-11 letters or digits with at least one letter`;
+  }
+  return null;
+};
+
+/**
+ * Sender settings for a destination number: the platform defaults, overridden
+ * by the longest matching calling code in config.sms.regions
+ * @param {string} phoneNumber - E.164 destination
+ * @returns {Object} - { senderId, originationNumber, smsType }
+ */
+const getSmsSender = (phoneNumber) => {
+  const { senderId, originationNumber, smsType, regions } = config.sms;
+  const region = Object.keys(regions || {})
+    .filter(code => phoneNumber.startsWith(code))
+    .sort((a, b) => b.length - a.length)[0];
+  return { senderId, originationNumber, smsType, ...(region ? regions[region] : {}) };
+};
+
+/**
+ * Check the SMS sender settings, the defaults and every region
+ * @returns {string[]} - Problems found; empty when the settings are usable
+ */
+const getSmsConfigErrors = () => {
+  const errors = [];
+  const check = (settings, label) => {
+    if (settings.senderId && getSenderIdError(settings.senderId)) {
+      errors.push(`${label}: ${getSenderIdError(settings.senderId)}`);
+    }
+    if (settings.originationNumber && !E164_PATTERN.test(settings.originationNumber)) {
+      errors.push(`${label}: SMS origination number must be in E.164 format`);
+    }
+    if (settings.smsType && !SMS_TYPES.includes(settings.smsType)) {
+      errors.push(`${label}: SMS type must be one of ${SMS_TYPES.join(', ')}`);
+    }
+  };
+  check(config.sms, 'default');
+  Object.entries(config.sms.regions || {}).forEach(([code, settings]) => check(settings, code));
+  return errors;
+};
+
+/**
+ * SNS message attributes for an SMS: the sender ID and origination number
+ * for the destination's region, and the SMS type. Settings that fail
+ * validation are left out, so SNS falls back to its own sender rather than
+ * rejecting the message.
+ * @param {string} phoneNumber - E.164 destination
+ * @returns {Object} - MessageAttributes for a PublishCommand
+ */
+const buildSmsAttributes = (phoneNumber) => {
+  const sender = getSmsSender(phoneNumber);
+  const attributes = {};
+  if (sender.senderId && !getSenderIdError(sender.senderId)) {
+    attributes['AWS.SNS.SMS.SenderID'] = { DataType: 'String', StringValue: sender.senderId };
+  }
+  if (sender.originationNumber && E164_PATTERN.test(sender.originationNumber)) {
+    attributes['AWS.MM.SMS.OriginationNumber'] = { DataType: 'String', StringValue: sender.originationNumber };
+  }
+  if (SMS_TYPES.includes(sender.smsType)) {
+    attributes['AWS.SNS.SMS.SMSType'] = { DataType: 'String', StringValue: sender.smsType };
+  }
+  return attributes;
+};
+
+module.exports = {
+  SMS_TYPES,
+  getSenderIdError,
+  getSmsSender,
+  getSmsConfigErrors,
+  buildSmsAttributes
+};
@@ -0,0 +1,30 @@
+const config = require('../config/config');
+
+/**
+ * Check a user against the verification policy for sensitive actions
+ * (booking and paying)
+ * @param {Object} user - The authenticated user
+ * @returns {Object|null} - Error body for a 403, or null when allowed
+ */
+const getVerificationError = (user) => {
+  const { requireEmail, requirePhone } = config.verification;
+  const missing = [];
+  if (requireEmail && !user.isEmailVerified) missing.push('email');
+  if (requirePhone && !user.isPhoneVerified) missing.push('phone');
+
+  if (missing.length === 0) {
+    return null;
+  }
+
+  return {
+    message: `Please verify your ${missing.join(' and ')} before continuing`,
+    code: 'VERIFICATION_REQUIRED',
+    missing,
+    // POST { identifier, type } to this URL to get a new verification code
+    resendUrl: `${config.apiUrl}/api/v1/auth/verify/resend`
+  };
+};
+
+module.exports = {
+  getVerificationError
+};
@@ -0,0 +1,67 @@
+const crypto = require('crypto');
+
+// Events outbound webhooks can subscribe to
+const WEBHOOK_EVENTS = [
+  'appointment.created',
+  'appointment.confirmed',
+  'appointment.cancelled',
+  'appointment.completed',
+  'payment.succeeded'
+];
+
+const SIGNATURE_HEADER = 'X-MedConnecter-Signature';
+
+/**
+ * HMAC-SHA256 of "<timestamp>.<body>" with the endpoint's secret, hex encoded
+ * @param {string} secret - The endpoint's secret
+ * @param {number} timestamp - Unix time in seconds
+ * @param {string} body - The exact request body
+ * @returns {string}
+ */
+const signPayload = (secret, timestamp, body) => {
+  return crypto.createHmac('sha256', secret).update(`${timestamp}.${body}`).digest('hex');
+};
+
+/**
+ * Value of the signature header: "t=<timestamp>,v1=<signature>". The
+ * timestamp is signed too, so receivers can reject replayed requests.
+ * @param {string} secret - The endpoint's secret
+ * @param {string} body - The exact request body
+ * @param {Date} now - Signing time
+ * @returns {string}
+ */
+const buildSignatureHeader = (secret, body, now = new Date()) => {
+  const timestamp = Math.floor(now.getTime() / 1000);
+  return `t=${timestamp},v1=${signPayload(secret, timestamp, body)}`;
+};
+
+/**
+ * Check a signature header the way a receiver should
+ * @param {string} secret - The endpoint's secret
+ * @param {string} header - The signature header received
+ * @param {string} body - The raw request body received
+ * @param {Object} options - toleranceSeconds (default 300) and now
+ * @returns {boolean}
+ */
+const verifySignature = (secret, header, body, options = {}) => {
+  const parts = Object.fromEntries(String(header || '').split(',').map(part => part.split('=')));
+  const timestamp = Number(parts.t);
+  if (!timestamp || !parts.v1) {
+    return false;
+  }
+  const now = options.now || new Date();
+  if (Math.abs(now.getTime() / 1000 - timestamp) > (options.toleranceSeconds || 300)) {
+    return false;
+  }
+  const expected = Buffer.from(signPayload(secret, timestamp, body));
+  const received = Buffer.from(parts.v1);
+  return expected.length === received.length && crypto.timingSafeEqual(expected, received);
+};
+
+module.exports = {
+  WEBHOOK_EVENTS,
+  SIGNATURE_HEADER,
+  signPayload,
+  buildSignatureHeader,
+  verifySignature
+};